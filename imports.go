@@ -17,25 +17,77 @@ package caddyl4
 import (
 	// plugging in the standard modules for the layer4 app
 	_ "github.com/mholt/caddy-l4/layer4"
+	_ "github.com/mholt/caddy-l4/modules/l4amqp"
+	_ "github.com/mholt/caddy-l4/modules/l4auditstore"
+	_ "github.com/mholt/caddy-l4/modules/l4beanstalkd"
+	_ "github.com/mholt/caddy-l4/modules/l4burst"
+	_ "github.com/mholt/caddy-l4/modules/l4bytebudget"
+	_ "github.com/mholt/caddy-l4/modules/l4bytehash"
 	_ "github.com/mholt/caddy-l4/modules/l4clock"
+	_ "github.com/mholt/caddy-l4/modules/l4coap"
+	_ "github.com/mholt/caddy-l4/modules/l4confidence"
 	_ "github.com/mholt/caddy-l4/modules/l4dns"
 	_ "github.com/mholt/caddy-l4/modules/l4echo"
+	_ "github.com/mholt/caddy-l4/modules/l4elasticsearch"
+	_ "github.com/mholt/caddy-l4/modules/l4entropy"
+	_ "github.com/mholt/caddy-l4/modules/l4expression"
+	_ "github.com/mholt/caddy-l4/modules/l4extauthz"
+	_ "github.com/mholt/caddy-l4/modules/l4geoblock"
+	_ "github.com/mholt/caddy-l4/modules/l4gearman"
+	_ "github.com/mholt/caddy-l4/modules/l4graphite"
+	_ "github.com/mholt/caddy-l4/modules/l4grpc"
 	_ "github.com/mholt/caddy-l4/modules/l4http"
+	_ "github.com/mholt/caddy-l4/modules/l4idletimeout"
+	_ "github.com/mholt/caddy-l4/modules/l4imap"
+	_ "github.com/mholt/caddy-l4/modules/l4irc"
+	_ "github.com/mholt/caddy-l4/modules/l4kafka"
+	_ "github.com/mholt/caddy-l4/modules/l4keepalive"
+	_ "github.com/mholt/caddy-l4/modules/l4ldap"
+	_ "github.com/mholt/caddy-l4/modules/l4log"
+	_ "github.com/mholt/caddy-l4/modules/l4memcached"
+	_ "github.com/mholt/caddy-l4/modules/l4migrate"
+	_ "github.com/mholt/caddy-l4/modules/l4minbytes"
+	_ "github.com/mholt/caddy-l4/modules/l4modbus"
+	_ "github.com/mholt/caddy-l4/modules/l4mongo"
+	_ "github.com/mholt/caddy-l4/modules/l4mqtt"
+	_ "github.com/mholt/caddy-l4/modules/l4mysql"
+	_ "github.com/mholt/caddy-l4/modules/l4negotiate"
+	_ "github.com/mholt/caddy-l4/modules/l4nsq"
+	_ "github.com/mholt/caddy-l4/modules/l4ntp"
 	_ "github.com/mholt/caddy-l4/modules/l4openvpn"
+	_ "github.com/mholt/caddy-l4/modules/l4pop3"
 	_ "github.com/mholt/caddy-l4/modules/l4postgres"
+	_ "github.com/mholt/caddy-l4/modules/l4pptp"
+	_ "github.com/mholt/caddy-l4/modules/l4prometheus"
 	_ "github.com/mholt/caddy-l4/modules/l4proxy"
 	_ "github.com/mholt/caddy-l4/modules/l4proxyprotocol"
+	_ "github.com/mholt/caddy-l4/modules/l4pulsar"
 	_ "github.com/mholt/caddy-l4/modules/l4quic"
+	_ "github.com/mholt/caddy-l4/modules/l4radius"
 	_ "github.com/mholt/caddy-l4/modules/l4rdp"
+	_ "github.com/mholt/caddy-l4/modules/l4redis"
 	_ "github.com/mholt/caddy-l4/modules/l4regexp"
 	_ "github.com/mholt/caddy-l4/modules/l4remoteiplist"
+	_ "github.com/mholt/caddy-l4/modules/l4riemann"
+	_ "github.com/mholt/caddy-l4/modules/l4rtsp"
+	_ "github.com/mholt/caddy-l4/modules/l4sentry"
+	_ "github.com/mholt/caddy-l4/modules/l4sip"
+	_ "github.com/mholt/caddy-l4/modules/l4smtp"
 	_ "github.com/mholt/caddy-l4/modules/l4socks"
 	_ "github.com/mholt/caddy-l4/modules/l4ssh"
+	_ "github.com/mholt/caddy-l4/modules/l4streamevents"
+	_ "github.com/mholt/caddy-l4/modules/l4statsd"
+	_ "github.com/mholt/caddy-l4/modules/l4stun"
 	_ "github.com/mholt/caddy-l4/modules/l4subroute"
 	_ "github.com/mholt/caddy-l4/modules/l4tee"
+	_ "github.com/mholt/caddy-l4/modules/l4tenantquota"
 	_ "github.com/mholt/caddy-l4/modules/l4throttle"
 	_ "github.com/mholt/caddy-l4/modules/l4tls"
+	_ "github.com/mholt/caddy-l4/modules/l4tunnel"
+	_ "github.com/mholt/caddy-l4/modules/l4vnc"
+	_ "github.com/mholt/caddy-l4/modules/l4websocket"
 	_ "github.com/mholt/caddy-l4/modules/l4winbox"
 	_ "github.com/mholt/caddy-l4/modules/l4wireguard"
+	_ "github.com/mholt/caddy-l4/modules/l4x11"
 	_ "github.com/mholt/caddy-l4/modules/l4xmpp"
 )
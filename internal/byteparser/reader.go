@@ -0,0 +1,208 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package byteparser provides helpers for parsing protocol messages, e.g. in matchers: a bounded reader
+// for binary messages, and line and character helpers for text-based protocols.
+package byteparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrShortBuffer is returned by Reader.Err if a read went past the end of the buffer.
+	ErrShortBuffer = errors.New("read past the end of the buffer")
+	// ErrNoTerminator is returned by Reader.Err if a null-terminated string has no terminator.
+	ErrNoTerminator = errors.New("missing null terminator")
+	// ErrInvalidLength is returned by Reader.Err if a negative length was given.
+	ErrInvalidLength = errors.New("invalid length")
+)
+
+// Reader reads integers, strings and bytes from a buffer without ever reading past its end. Errors are
+// sticky: once a read fails, it doesn't advance the reader, and all the following reads return zero values,
+// so that a whole message can be parsed before checking Err once. The returned byte slices share the buffer.
+type Reader struct {
+	buf []byte
+	off int
+	err error
+}
+
+// NewReader returns a Reader reading from buf.
+func NewReader(buf []byte) *Reader {
+	return &Reader{buf: buf}
+}
+
+// Err returns the error of the first failed read, if any.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Len returns the number of bytes left to read.
+func (r *Reader) Len() int {
+	return len(r.buf) - r.off
+}
+
+// Offset returns the number of bytes read so far.
+func (r *Reader) Offset() int {
+	return r.off
+}
+
+// Remaining returns the bytes left to read without advancing r.
+func (r *Reader) Remaining() []byte {
+	return r.buf[r.off:]
+}
+
+// next advances r by n bytes and returns them, or returns nil if they can't be read.
+func (r *Reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 {
+		r.err = ErrInvalidLength
+		return nil
+	}
+	if n > r.Len() {
+		r.err = ErrShortBuffer
+		return nil
+	}
+	b := r.buf[r.off : r.off+n : r.off+n]
+	r.off += n
+	return b
+}
+
+// Skip advances r by n bytes.
+func (r *Reader) Skip(n int) {
+	r.next(n)
+}
+
+// ReadBytes reads n bytes.
+func (r *Reader) ReadBytes(n int) []byte {
+	return r.next(n)
+}
+
+// ReadRemaining reads all the bytes left.
+func (r *Reader) ReadRemaining() []byte {
+	return r.next(r.Len())
+}
+
+// ReadUint8 reads a byte.
+func (r *Reader) ReadUint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// ReadUint16 reads a big-endian uint16.
+func (r *Reader) ReadUint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// ReadUint32 reads a big-endian uint32.
+func (r *Reader) ReadUint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// ReadUint64 reads a big-endian uint64.
+func (r *Reader) ReadUint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// ReadUint16LE reads a little-endian uint16.
+func (r *Reader) ReadUint16LE() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+// ReadUint32LE reads a little-endian uint32.
+func (r *Reader) ReadUint32LE() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// ReadUint64LE reads a little-endian uint64.
+func (r *Reader) ReadUint64LE() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// ReadCString reads a null-terminated string and returns it without the terminator.
+func (r *Reader) ReadCString() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.Remaining(), 0)
+	if i < 0 {
+		r.err = ErrNoTerminator
+		return ""
+	}
+	s := string(r.next(i))
+	r.off++ // Skip the terminator
+	return s
+}
+
+// ReadString8 reads a string prefixed by its length as a byte.
+func (r *Reader) ReadString8() string {
+	return r.readPrefixed(func() int { return int(r.ReadUint8()) })
+}
+
+// ReadString16 reads a string prefixed by its length as a big-endian uint16.
+func (r *Reader) ReadString16() string {
+	return r.readPrefixed(func() int { return int(r.ReadUint16()) })
+}
+
+// ReadString32 reads a string prefixed by its length as a big-endian uint32.
+func (r *Reader) ReadString32() string {
+	return r.readPrefixed(func() int { return int(r.ReadUint32()) })
+}
+
+// ReadString16LE reads a string prefixed by its length as a little-endian uint16.
+func (r *Reader) ReadString16LE() string {
+	return r.readPrefixed(func() int { return int(r.ReadUint16LE()) })
+}
+
+// ReadString32LE reads a string prefixed by its length as a little-endian uint32.
+func (r *Reader) ReadString32LE() string {
+	return r.readPrefixed(func() int { return int(r.ReadUint32LE()) })
+}
+
+// readPrefixed reads a string prefixed by the length returned by readLen. If the string
+// can't be read, r is rewound to the length, so that failed reads don't advance r.
+func (r *Reader) readPrefixed(readLen func() int) string {
+	off := r.off
+	n := readLen()
+	b := r.next(n)
+	if r.err != nil {
+		r.off = off
+		return ""
+	}
+	return string(b)
+}
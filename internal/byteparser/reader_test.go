@@ -0,0 +1,184 @@
+package byteparser
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReader_Integers(t *testing.T) {
+	r := NewReader([]byte{
+		0x01,
+		0x01, 0x02,
+		0x01, 0x02, 0x03, 0x04,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x01, 0x02,
+		0x01, 0x02, 0x03, 0x04,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	})
+
+	if v := r.ReadUint8(); v != 0x01 {
+		t.Fatalf("unexpected uint8 | got %#x\n", v)
+	}
+	if v := r.ReadUint16(); v != 0x0102 {
+		t.Fatalf("unexpected uint16 | got %#x\n", v)
+	}
+	if v := r.ReadUint32(); v != 0x01020304 {
+		t.Fatalf("unexpected uint32 | got %#x\n", v)
+	}
+	if v := r.ReadUint64(); v != 0x0102030405060708 {
+		t.Fatalf("unexpected uint64 | got %#x\n", v)
+	}
+	if v := r.ReadUint16LE(); v != 0x0201 {
+		t.Fatalf("unexpected little-endian uint16 | got %#x\n", v)
+	}
+	if v := r.ReadUint32LE(); v != 0x04030201 {
+		t.Fatalf("unexpected little-endian uint32 | got %#x\n", v)
+	}
+	if v := r.ReadUint64LE(); v != 0x0807060504030201 {
+		t.Fatalf("unexpected little-endian uint64 | got %#x\n", v)
+	}
+
+	// reading at the exact end succeeds and leaves nothing
+	if r.Err() != nil || r.Len() != 0 || r.Offset() != 29 {
+		t.Fatalf("unexpected state at the end | err %v, len %d, offset %d\n", r.Err(), r.Len(), r.Offset())
+	}
+
+	// reading past the end fails
+	if v := r.ReadUint8(); v != 0 || !errors.Is(r.Err(), ErrShortBuffer) {
+		t.Fatalf("unexpected read past the end | got %#x, err %v\n", v, r.Err())
+	}
+}
+
+func TestReader_PastEnd(t *testing.T) {
+	for i, read := range []func(r *Reader) any{
+		func(r *Reader) any { return r.ReadUint16() },
+		func(r *Reader) any { return r.ReadUint32() },
+		func(r *Reader) any { return r.ReadUint64() },
+		func(r *Reader) any { return r.ReadUint16LE() },
+		func(r *Reader) any { return r.ReadUint32LE() },
+		func(r *Reader) any { return r.ReadUint64LE() },
+		func(r *Reader) any { return len(r.ReadBytes(2)) },
+		func(r *Reader) any { r.Skip(2); return 0 },
+	} {
+		// a partial value isn't read, and the reader doesn't advance
+		r := NewReader([]byte{0x01})
+		if v := read(r); v != uint16(0) && v != uint32(0) && v != uint64(0) && v != 0 {
+			t.Fatalf("test %d: unexpected value past the end | got %v\n", i, v)
+		}
+		if !errors.Is(r.Err(), ErrShortBuffer) {
+			t.Fatalf("test %d: unexpected error | got %v, want %v\n", i, r.Err(), ErrShortBuffer)
+		}
+		if r.Offset() != 0 || r.Len() != 1 {
+			t.Fatalf("test %d: reader advanced past the end | offset %d, len %d\n", i, r.Offset(), r.Len())
+		}
+	}
+}
+
+func TestReader_StickyError(t *testing.T) {
+	r := NewReader([]byte{0x00, 0x01, 0x02, 0x03, 'a', 0x00})
+
+	r.Skip(3)
+	_ = r.ReadUint32()
+	if !errors.Is(r.Err(), ErrShortBuffer) {
+		t.Fatalf("unexpected error | got %v, want %v\n", r.Err(), ErrShortBuffer)
+	}
+
+	// all the following reads fail, even if they would fit
+	if v := r.ReadUint8(); v != 0 {
+		t.Fatalf("unexpected uint8 after an error | got %#x\n", v)
+	}
+	if s := r.ReadCString(); s != "" {
+		t.Fatalf("unexpected string after an error | got %q\n", s)
+	}
+	if b := r.ReadRemaining(); b != nil {
+		t.Fatalf("unexpected bytes after an error | got %v\n", b)
+	}
+	if !errors.Is(r.Err(), ErrShortBuffer) || r.Offset() != 3 {
+		t.Fatalf("unexpected state after an error | err %v, offset %d\n", r.Err(), r.Offset())
+	}
+
+	// a negative length is an error as well
+	r = NewReader([]byte{0x00})
+	if b := r.ReadBytes(-1); b != nil || !errors.Is(r.Err(), ErrInvalidLength) {
+		t.Fatalf("unexpected read of a negative length | got %v, err %v\n", b, r.Err())
+	}
+}
+
+func TestReader_CString(t *testing.T) {
+	for i, tc := range []struct {
+		data    []byte
+		strings []string
+		err     error
+		offset  int
+	}{
+		{data: []byte("user\x00alice\x00\x00"), strings: []string{"user", "alice", ""}, offset: 12},
+		{data: []byte("\x00"), strings: []string{""}, offset: 1},
+		// a missing terminator, even at the exact end, is an error and the reader doesn't advance
+		{data: []byte("user\x00alice"), strings: []string{"user", ""}, err: ErrNoTerminator, offset: 5},
+		{data: []byte{}, strings: []string{""}, err: ErrNoTerminator, offset: 0},
+	} {
+		r := NewReader(tc.data)
+		for j, want := range tc.strings {
+			if s := r.ReadCString(); s != want {
+				t.Fatalf("test %d: unexpected string %d | got %q, want %q\n", i, j, s, want)
+			}
+		}
+		if !errors.Is(r.Err(), tc.err) || r.Offset() != tc.offset {
+			t.Fatalf("test %d: unexpected state | err %v, want %v, offset %d, want %d\n", i, r.Err(), tc.err, r.Offset(), tc.offset)
+		}
+	}
+}
+
+func TestReader_PrefixedStrings(t *testing.T) {
+	for i, tc := range []struct {
+		data   []byte
+		read   func(r *Reader) string
+		want   string
+		err    error
+		offset int
+	}{
+		{data: []byte("\x03abc"), read: (*Reader).ReadString8, want: "abc", offset: 4},
+		{data: []byte("\x00"), read: (*Reader).ReadString8, want: "", offset: 1},
+		{data: []byte("\x00\x03abcd"), read: (*Reader).ReadString16, want: "abc", offset: 5},
+		{data: []byte("\x00\x00\x00\x03abc"), read: (*Reader).ReadString32, want: "abc", offset: 7},
+		{data: []byte("\x03\x00abc"), read: (*Reader).ReadString16LE, want: "abc", offset: 5},
+		{data: []byte("\x03\x00\x00\x00abc"), read: (*Reader).ReadString32LE, want: "abc", offset: 7},
+
+		// a length past the end is an error and the reader isn't advanced, not even by the length
+		{data: []byte("\x04abc"), read: (*Reader).ReadString8, err: ErrShortBuffer},
+		{data: []byte("\x00\x04abc"), read: (*Reader).ReadString16, err: ErrShortBuffer},
+		{data: []byte("\xff\xff\xff\xffabc"), read: (*Reader).ReadString32, err: ErrShortBuffer},
+		{data: []byte("\x00"), read: (*Reader).ReadString16, err: ErrShortBuffer},
+		{data: []byte{}, read: (*Reader).ReadString8, err: ErrShortBuffer},
+	} {
+		r := NewReader(tc.data)
+		if s := tc.read(r); s != tc.want {
+			t.Fatalf("test %d: unexpected string | got %q, want %q\n", i, s, tc.want)
+		}
+		if !errors.Is(r.Err(), tc.err) || r.Offset() != tc.offset {
+			t.Fatalf("test %d: unexpected state | err %v, want %v, offset %d, want %d\n", i, r.Err(), tc.err, r.Offset(), tc.offset)
+		}
+	}
+}
+
+func TestReader_Remaining(t *testing.T) {
+	data := []byte{0x01, 0x02, 0x03, 0x04}
+	r := NewReader(data)
+
+	r.Skip(1)
+	if b := r.Remaining(); !bytes.Equal(b, data[1:]) || r.Offset() != 1 {
+		t.Fatalf("unexpected remaining bytes | got %v, offset %d\n", b, r.Offset())
+	}
+	if b := r.ReadBytes(2); !bytes.Equal(b, data[1:3]) {
+		t.Fatalf("unexpected bytes | got %v\n", b)
+	}
+	if b := r.ReadRemaining(); !bytes.Equal(b, data[3:]) || r.Len() != 0 {
+		t.Fatalf("unexpected remaining bytes | got %v, len %d\n", b, r.Len())
+	}
+
+	// reading the remaining bytes at the exact end succeeds with no bytes
+	if b := r.ReadRemaining(); len(b) != 0 || r.Err() != nil {
+		t.Fatalf("unexpected remaining bytes at the end | got %v, err %v\n", b, r.Err())
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package byteparser
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// ReadLine reads a line terminated by CRLF or a bare LF from r and returns it without the terminator.
+// The returned slice shares the buffer of r, so it's only valid until the next read. If the line doesn't
+// fit into the buffer of r, bufio.ErrBufferFull is returned, which bounds the bytes read by matchers.
+func ReadLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), nil
+}
+
+// IsPrintable returns true if b consists of printable ASCII characters only.
+func IsPrintable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package byteparser
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	r := bufio.NewReaderSize(strings.NewReader("CRLF\r\nLF\n\r\nCR\rtrailing"), 16)
+
+	for _, want := range []string{"CRLF", "LF", "", "CR\rtrailing"} {
+		line, err := ReadLine(r)
+		if want == "CR\rtrailing" {
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("unterminated line should not be read | got %q, %v\n", line, err)
+			}
+			continue
+		}
+		if err != nil || string(line) != want {
+			t.Fatalf("unexpected line | got %q, %v, want %q\n", line, err, want)
+		}
+	}
+
+	r = bufio.NewReaderSize(strings.NewReader(strings.Repeat("x", 32)+"\n"), 16)
+	if _, err := ReadLine(r); !errors.Is(err, bufio.ErrBufferFull) {
+		t.Fatalf("line exceeding the buffer should not be read | got %v\n", err)
+	}
+}
+
+func TestIsPrintable(t *testing.T) {
+	for _, tc := range []struct {
+		b    string
+		want bool
+	}{
+		{b: "", want: true},
+		{b: "EHLO mail.example.com", want: true},
+		{b: "~ !", want: true},
+		{b: "tab\t", want: false},
+		{b: "del\x7f", want: false},
+		{b: "utf-8 \xc3\xa9", want: false},
+	} {
+		if got := IsPrintable([]byte(tc.b)); got != tc.want {
+			t.Fatalf("unexpected result for %q | got %t, want %t\n", tc.b, got, tc.want)
+		}
+	}
+}
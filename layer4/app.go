@@ -15,6 +15,7 @@
 package layer4
 
 import (
+	"context"
 	"fmt"
 	"net"
 
@@ -33,10 +34,17 @@ type App struct {
 	// the order of servers does not matter.
 	Servers map[string]*Server `json:"servers,omitempty"`
 
-	listeners   []net.Listener
-	packetConns []net.PacketConn
-	logger      *zap.Logger
-	ctx         caddy.Context
+	// MatchingTimeout is the default matching timeout of the servers not setting their own,
+	// i.e. how long the matchers of a connection may wait for data before it's closed.
+	// Default: 3s.
+	MatchingTimeout caddy.Duration `json:"matching_timeout,omitempty"`
+
+	listeners      []net.Listener
+	packetConns    []net.PacketConn
+	logger         *zap.Logger
+	ctx            caddy.Context
+	shutdownCtx    context.Context
+	cancelShutdown context.CancelFunc
 }
 
 // CaddyModule returns the Caddy module information.
@@ -51,13 +59,23 @@ func (*App) CaddyModule() caddy.ModuleInfo {
 func (a *App) Provision(ctx caddy.Context) error {
 	a.ctx = ctx
 	a.logger = ctx.Logger()
+	a.shutdownCtx, a.cancelShutdown = newShutdownContext(ctx)
 
+	oldContext := ctx.Context
 	for srvName, srv := range a.Servers {
+		if srv.MatchingTimeout <= 0 {
+			srv.MatchingTimeout = a.MatchingTimeout
+		}
+
+		// expose the server name to its routes, e.g. for labeling metrics
+		ctx.Context = context.WithValue(oldContext, serverNameCtxKey, srvName)
+		srv.shutdownCtx = a.shutdownCtx
 		err := srv.Provision(ctx, a.logger)
 		if err != nil {
 			return fmt.Errorf("server '%s': %v", srvName, err)
 		}
 	}
+	ctx.Context = oldContext
 
 	return nil
 }
@@ -93,8 +111,16 @@ func (a *App) Start() error {
 	return nil
 }
 
-// Stop stops the servers and closes all listeners.
+// Stop stops the servers and closes all listeners. The connections being handled outlive config reloads,
+// but once Caddy is exiting, their reads are aborted, so that their handlers return promptly.
 func (a *App) Stop() error {
+	if caddy.Exiting() {
+		a.cancelShutdown()
+	} else if next, ok := activeApp(); ok && next != a {
+		// the connections of a replaced config are aborted along with those of the config replacing it
+		context.AfterFunc(next.shutdownCtx, a.cancelShutdown)
+	}
+
 	for _, pc := range a.packetConns {
 		err := pc.Close()
 		if err != nil {
@@ -116,5 +142,15 @@ func (a *App) Stop() error {
 	return nil
 }
 
+// activeApp returns the app of the active config, if it has one.
+func activeApp() (*App, bool) {
+	app, err := caddy.ActiveContext().AppIfConfigured("layer4")
+	if err != nil {
+		return nil, false
+	}
+	a, ok := app.(*App)
+	return a, ok
+}
+
 // Interface guard
 var _ caddy.App = (*App)(nil)
@@ -19,6 +19,7 @@ func init() {
 //
 //	{
 //		layer4 {
+//			matching_timeout <duration>
 //			# srv0
 //			<addresses...> {
 //				...
@@ -53,6 +54,25 @@ func parseLayer4(d *caddyfile.Dispenser, existingVal any) (any, error) {
 
 	i := len(app.Servers)
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if optionName := d.Val(); optionName == "matching_timeout" {
+			if app.MatchingTimeout != 0 {
+				return nil, d.Errf("duplicate option '%s'", optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return nil, d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("parsing option '%s' duration: %v", optionName, err)
+			}
+			if dur <= 0 {
+				return nil, d.Errf("parsing option '%s' duration: must be positive", optionName)
+			}
+			app.MatchingTimeout = caddy.Duration(dur)
+			continue
+		}
+
 		server := &Server{}
 		var inst any = server
 		unm, ok := inst.(caddyfile.Unmarshaler)
@@ -75,6 +95,14 @@ func parseLayer4(d *caddyfile.Dispenser, existingVal any) (any, error) {
 // ParseCaddyfileNestedRoutes parses the Caddyfile tokens for nested named matcher sets, handlers and matching timeout,
 // composes a list of route configurations, and adjusts the matching timeout.
 func ParseCaddyfileNestedRoutes(d *caddyfile.Dispenser, routes *RouteList, matchingTimeout *caddy.Duration) error {
+	return parseCaddyfileNestedRoutes(d, routes, matchingTimeout, nil)
+}
+
+// parseCaddyfileNestedRoutes acts like ParseCaddyfileNestedRoutes, but also lets parseOption parse any other option.
+// It must return false if the option is unknown, or advance d past its arguments and return true otherwise.
+func parseCaddyfileNestedRoutes(d *caddyfile.Dispenser, routes *RouteList, matchingTimeout *caddy.Duration,
+	parseOption func(optionName string) (bool, error),
+) error {
 	var hasMatchingTimeout bool
 	matcherSetTokensByName, routeTokens := make(map[string][]caddyfile.Token), make([]caddyfile.Token, 0)
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
@@ -98,6 +126,14 @@ func ParseCaddyfileNestedRoutes(d *caddyfile.Dispenser, routes *RouteList, match
 			*matchingTimeout, hasMatchingTimeout = caddy.Duration(dur), true
 		} else if optionName == "route" {
 			routeTokens = append(routeTokens, d.NextSegment()...)
+		} else if parseOption != nil {
+			known, err := parseOption(optionName)
+			if err != nil {
+				return err
+			}
+			if !known {
+				return d.ArgErr()
+			}
 		} else {
 			return d.ArgErr()
 		}
@@ -0,0 +1,61 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// CloseConn closes conn. If conn is a TCP connection, i.e. it supports CloseWrite and SetLinger,
+// it's closed according to the following options; other connections are closed immediately.
+//
+// If grace is positive, the writing side of conn is shut down first, and bytes sent by the peer are
+// read and discarded until the peer closes its side too, or grace elapses. This way the peer has time
+// to read all the bytes written to conn: closing a TCP connection with unread bytes makes the OS reset
+// it, and the peer may discard the bytes it hasn't read yet. If linger is not nil, SO_LINGER is set on
+// conn before it's closed, so that closing blocks for linger while unsent bytes are being sent, or
+// resets the connection if linger is zero. Linger is rounded up to whole seconds.
+func CloseConn(conn net.Conn, linger *time.Duration, grace time.Duration) error {
+	if grace > 0 {
+		if cw, ok := conn.(closeWriter); ok && cw.CloseWrite() == nil {
+			if err := conn.SetReadDeadline(time.Now().Add(grace)); err == nil {
+				_, _ = io.Copy(io.Discard, conn)
+			}
+		}
+	}
+
+	if linger != nil {
+		if ls, ok := conn.(lingerSetter); ok {
+			_ = ls.SetLinger(int(math.Ceil(linger.Seconds())))
+		}
+	}
+
+	return conn.Close()
+}
+
+// closeWriter is implemented by connections which can shut down their writing side, e.g. *net.TCPConn.
+type closeWriter interface {
+	// CloseWrite shuts down the writing side of the connection.
+	CloseWrite() error
+}
+
+// lingerSetter is implemented by connections which support SO_LINGER, e.g. *net.TCPConn.
+type lingerSetter interface {
+	// SetLinger sets the behavior of Close on a connection which still has data waiting to be sent.
+	SetLinger(sec int) error
+}
@@ -0,0 +1,98 @@
+package layer4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// closeTester accepts a TCP connection, reads a 5-byte request, writes response and closes the connection
+// with the given options. The client sends extra bytes with its request, which are left unread by the server.
+// It returns the bytes read by the client until the connection is closed, and the error which ended reading.
+func closeTester(t *testing.T, response []byte, linger *time.Duration, grace time.Duration) ([]byte, error) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		request := make([]byte, 5)
+		if _, err = io.ReadFull(conn, request); err == nil {
+			_, err = conn.Write(response)
+		}
+		serverDone <- errors.Join(err, CloseConn(conn, linger, grace))
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	if _, err = client.Write(append([]byte("hello"), bytes.Repeat([]byte{'x'}, 64*1024)...)); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+
+	// give the server time to write the response and close the connection before it's read
+	time.Sleep(100 * time.Millisecond)
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(client)
+	_ = client.Close() // the client closes promptly once the response is read
+
+	if serverErr := <-serverDone; serverErr != nil {
+		t.Fatalf("Unexpected server error: %s\n", serverErr)
+	}
+	return received, err
+}
+
+func TestCloseConn_Grace(t *testing.T) {
+	response := bytes.Repeat([]byte("world!"), 1024)
+
+	received, err := closeTester(t, response, nil, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if !bytes.Equal(received, response) {
+		t.Fatalf("response was truncated | got %d bytes, want %d\n", len(received), len(response))
+	}
+}
+
+func TestCloseConn_Linger(t *testing.T) {
+	// with a linger of zero, the connection is reset even if it's half closed first,
+	// so the response may be lost, but reading must not end cleanly
+	zero := time.Duration(0)
+	_, err := closeTester(t, []byte("world!"), &zero, 0)
+	if err == nil {
+		t.Fatalf("connection should have been reset")
+	}
+}
+
+func TestCloseConn_NonTCP(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	// connections without CloseWrite are closed immediately, even with a grace period
+	start := time.Now()
+	if err := CloseConn(out, nil, time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("closing took too long | %s\n", time.Since(start))
+	}
+	if _, err := in.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("connection should have been closed | %v\n", err)
+	}
+}
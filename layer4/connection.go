@@ -15,10 +15,13 @@
 package layer4
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -31,21 +34,32 @@ import (
 // connection handler chain where the underlying connection is not yet a layer4
 // Connection value.
 func WrapConnection(underlying net.Conn, buf []byte, logger *zap.Logger) *Connection {
+	return wrapConnection(context.Background(), underlying, buf, logger)
+}
+
+// wrapConnection is like WrapConnection, but the context of the connection is derived from ctx.
+func wrapConnection(ctx context.Context, underlying net.Conn, buf []byte, logger *zap.Logger) *Connection {
 	repl := caddy.NewReplacer()
 	repl.Set("l4.conn.remote_addr", underlying.RemoteAddr())
 	repl.Set("l4.conn.local_addr", underlying.LocalAddr())
 	repl.Set("l4.conn.wrap_time", time.Now().UTC())
 
-	ctx := context.Background()
 	ctx = context.WithValue(ctx, VarsCtxKey, make(map[string]any))
+	ctx = context.WithValue(ctx, ValuesCtxKey, make(map[any]any))
 	ctx = context.WithValue(ctx, ReplacerCtxKey, repl)
 
-	return &Connection{
+	cx := &Connection{
 		Conn:    underlying,
 		Context: ctx,
 		Logger:  logger,
 		buf:     buf,
+		aborted: new(atomic.Bool),
 	}
+	cx.routeBytes = &routeBytes{owner: cx}
+	if len(buf) > 0 {
+		cx.arrivals = []arrival{{size: len(buf), at: time.Now()}}
+	}
+	return cx
 }
 
 // Connection contains information about the connection as it
@@ -71,8 +85,26 @@ type Connection struct {
 	offset       int
 	frozenOffset int
 	matching     bool
+	arrivals     []arrival // when buf has grown
 
 	bytesRead, bytesWritten uint64
+	routeBytes              *routeBytes  // shared with wrapping connections
+	aborted                 *atomic.Bool // shared with wrapping connections, see abortOnShutdown
+}
+
+// routeBytes points to the last route matching a connection, whose metrics count the bytes read from and written
+// to it. It's shared by the connections returned by Wrap, so that routes matching them count the bytes too, but only
+// the bytes of the connection returned by WrapConnection, i.e. of the underlying connection, are counted, so that
+// bytes aren't counted twice, e.g. before and after TLS decryption.
+type routeBytes struct {
+	owner *Connection
+	route atomic.Pointer[Route]
+}
+
+// arrival records the time at which the matching buffer has grown to size bytes.
+type arrival struct {
+	size int
+	at   time.Time
 }
 
 var (
@@ -89,41 +121,149 @@ func (cx *Connection) GetContext() context.Context {
 // Read implements io.Reader in such a way that reads first
 // deplete any associated buffer from the prior recording,
 // and once depleted (or if there isn't one), it continues
-// reading from the underlying connection.
+// reading from the underlying connection. In matching mode,
+// only the buffer is read, and each byte of it is delivered
+// once more after the matching mode stops; otherwise, each
+// byte is delivered exactly once, whether it was prefetched,
+// peeked at or read from the underlying connection.
 func (cx *Connection) Read(p []byte) (n int, err error) {
-	// if we are matching and consumed the buffer exit with error
-	if cx.matching && (len(cx.buf) == 0 || len(cx.buf) == cx.offset) {
-		return 0, ErrConsumedAllPrefetchedBytes
-	}
-
 	// if there is a buffer we should read from, start
 	// with that; we only read from the underlying conn
 	// after the buffer has been "depleted"
-	if len(cx.buf) > 0 && cx.offset < len(cx.buf) {
-		n := copy(p, cx.buf[cx.offset:])
-		cx.offset += n
-		if !cx.matching && cx.offset == len(cx.buf) {
-			// if we are not in matching mode reset buf automatically after it was consumed
-			cx.offset = 0
-			cx.buf = cx.buf[:0]
-		}
-		return n, nil
+	if cx.offset < len(cx.buf) {
+		return cx.readBuffer(p), nil
+	}
+
+	// if we are matching and consumed the buffer exit with error
+	if cx.matching {
+		return 0, ErrConsumedAllPrefetchedBytes
 	}
 
 	// buffer has been "depleted" so read from
-	// underlying connection
+	// underlying connection, unless Caddy is exiting
+	if err = abortedErr(cx.aborted, nil); err != nil {
+		return 0, err
+	}
 	n, err = cx.Conn.Read(p)
-	cx.bytesRead += uint64(n) //nolint:gosec // disable G115
+	cx.countRead(n)
+	if err != nil {
+		err = abortedErr(cx.aborted, err)
+	}
 
 	return
 }
 
+// readBuffer copies the buffered bytes that haven't been read yet into p, and returns their number.
+func (cx *Connection) readBuffer(p []byte) int {
+	n := copy(p, cx.buf[cx.offset:])
+	cx.offset += n
+	if !cx.matching && cx.offset == len(cx.buf) {
+		// if we are not in matching mode reset buf automatically after it was consumed
+		cx.offset = 0
+		cx.buf = cx.buf[:0]
+		cx.arrivals = nil
+	}
+	return n
+}
+
+// Peek returns the next n bytes without advancing the reader, so that the next reads return them, like
+// bufio.Reader.Peek. The bytes are only valid until the next read. Do not write into the slice. In matching
+// mode, only the buffer is peeked at: if fewer than n bytes are available, they are returned along with
+// ErrConsumedAllPrefetchedBytes, or ErrMatchingBufferFull if no more bytes will be prefetched. Otherwise,
+// missing bytes are read from the underlying connection into the buffer, and if n exceeds MaxMatchingBytes,
+// ErrMatchingBufferFull is returned. Peeking works with matchers and handlers reading in any way, e.g. with
+// io.ReadFull or a bufio.Reader, since the peeked bytes are delivered by the reads of cx exactly once.
+func (cx *Connection) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+
+	if cx.matching {
+		if available := len(cx.buf) - cx.offset; available < n {
+			if len(cx.buf) >= MaxMatchingBytes {
+				return cx.buf[cx.offset:], ErrMatchingBufferFull
+			}
+			return cx.buf[cx.offset:], ErrConsumedAllPrefetchedBytes
+		}
+		return cx.buf[cx.offset : cx.offset+n], nil
+	}
+
+	if n > MaxMatchingBytes {
+		buf, err := cx.Peek(MaxMatchingBytes)
+		if err == nil {
+			err = ErrMatchingBufferFull
+		}
+		return buf, err
+	}
+	for len(cx.buf)-cx.offset < n {
+		if err := abortedErr(cx.aborted, nil); err != nil {
+			return cx.buf[cx.offset:], err
+		}
+		if cap(cx.buf) < cx.offset+n {
+			cx.buf = slices.Grow(cx.buf, max(cx.offset+n-len(cx.buf), prefetchChunkSize))
+		}
+		read, err := cx.Conn.Read(cx.buf[len(cx.buf):cap(cx.buf)])
+		cx.buf = cx.buf[:len(cx.buf)+read]
+		cx.countRead(read)
+		if read > 0 {
+			cx.arrivals = append(cx.arrivals, arrival{size: len(cx.buf), at: time.Now()})
+		}
+		if err != nil {
+			return cx.buf[cx.offset:], abortedErr(cx.aborted, err)
+		}
+	}
+	return cx.buf[cx.offset : cx.offset+n], nil
+}
+
 func (cx *Connection) Write(p []byte) (n int, err error) {
 	n, err = cx.Conn.Write(p)
 	cx.bytesWritten += uint64(n) //nolint:gosec // disable G115
+	if rb := cx.routeBytes; rb != nil && rb.owner == cx {
+		if r := rb.route.Load(); r != nil && r.bytesWritten != nil {
+			r.bytesWritten.Add(float64(n))
+		}
+	}
 	return
 }
 
+// countRead counts n bytes read from the underlying connection.
+func (cx *Connection) countRead(n int) {
+	cx.bytesRead += uint64(n) //nolint:gosec // disable G115
+	if rb := cx.routeBytes; rb != nil && rb.owner == cx {
+		if r := rb.route.Load(); r != nil && r.bytesRead != nil {
+			r.bytesRead.Add(float64(n))
+		}
+	}
+}
+
+// observeRoute records r as the last route matching cx, and makes its metrics count the bytes read from and written
+// to the underlying connection from now on, if enabled. The first route to do so also counts the bytes read and
+// written before.
+func (cx *Connection) observeRoute(r *Route) {
+	rb := cx.routeBytes
+	if rb == nil {
+		return
+	}
+	if rb.route.Swap(r) == nil && r.bytesRead != nil {
+		r.bytesRead.Add(float64(rb.owner.bytesRead))
+		r.bytesWritten.Add(float64(rb.owner.bytesWritten))
+	}
+}
+
+// MatchedRoute returns the label of the last route matching cx, i.e. its index, prefixed with the label of its
+// parent route for nested route lists, e.g. 1.0 for the first route of a subroute handler of the second route,
+// or an empty string if no route has matched yet. UDP connections are sessions of the datagrams sent from the
+// same remote address, which are matched once, so that all their datagrams are handled by the same route.
+func (cx *Connection) MatchedRoute() string {
+	if cx.routeBytes == nil {
+		return ""
+	}
+	if r := cx.routeBytes.route.Load(); r != nil {
+		return r.label
+	}
+	return ""
+}
+
 // Wrap wraps conn in a new Connection based on cx (reusing
 // cx's existing buffer and context). This is useful after
 // a connection is wrapped by a package that does not support
@@ -136,8 +276,11 @@ func (cx *Connection) Wrap(conn net.Conn) *Connection {
 		buf:          cx.buf,
 		offset:       cx.offset,
 		matching:     cx.matching,
+		arrivals:     cx.arrivals,
 		bytesRead:    cx.bytesRead,
 		bytesWritten: cx.bytesWritten,
+		routeBytes:   cx.routeBytes,
+		aborted:      cx.aborted,
 	}
 }
 
@@ -145,7 +288,10 @@ func (cx *Connection) Wrap(conn net.Conn) *Connection {
 func (cx *Connection) prefetch() (err error) {
 	var n int
 
-	// read once
+	// read once, unless Caddy is exiting
+	if err = abortedErr(cx.aborted, nil); err != nil {
+		return err
+	}
 	if len(cx.buf) < MaxMatchingBytes {
 		free := cap(cx.buf) - len(cx.buf)
 		if free >= prefetchChunkSize {
@@ -161,10 +307,13 @@ func (cx *Connection) prefetch() (err error) {
 			cx.buf = append(cx.buf, tmp[:n]...)
 		}
 
-		cx.bytesRead += uint64(n) //nolint:gosec // disable G115
+		cx.countRead(n)
+		if n > 0 {
+			cx.arrivals = append(cx.arrivals, arrival{size: len(cx.buf), at: time.Now()})
+		}
 
 		if err != nil {
-			return err
+			return abortedErr(cx.aborted, err)
 		}
 
 		if cx.Logger.Core().Enabled(zap.DebugLevel) {
@@ -215,6 +364,99 @@ func (cx *Connection) GetVar(key string) any {
 	return varMap[key]
 }
 
+// SetValue stores a typed value in the context's value table with the given
+// key. It overwrites any previous value with the same key. Unlike SetVar,
+// it's meant for structured objects that matchers and handlers share without
+// serializing them, e.g. the parsed first message of a protocol. Packages
+// should use an unexported key type, as with context.WithValue, and provide
+// their own typed accessors.
+//
+// Values live as long as the connection does and are shared with any
+// Connection made by Wrap. Since matchers may run several times while more
+// data is being prefetched, and a matcher may succeed within a matcher set
+// that doesn't, a stored value doesn't imply that any particular route has
+// been matched.
+func (cx *Connection) SetValue(key, value any) {
+	valueMap, ok := cx.Context.Value(ValuesCtxKey).(map[any]any)
+	if !ok {
+		return
+	}
+	valueMap[key] = value
+}
+
+// Value gets a value from the context's value table with
+// the given key. It returns nil if no value was found.
+func (cx *Connection) Value(key any) any {
+	valueMap, ok := cx.Context.Value(ValuesCtxKey).(map[any]any)
+	if !ok {
+		return nil
+	}
+	return valueMap[key]
+}
+
+// ValueOf gets a value of type T from cx's value table with the given key.
+// It returns the value and true if found and of type T; the zero value and
+// false otherwise.
+func ValueOf[T any](cx *Connection, key any) (T, bool) {
+	value, ok := cx.Value(key).(T)
+	return value, ok
+}
+
+// SetProtocol tags the connection with the name of the protocol a matcher
+// has recognized, e.g. "http" or "postgres", so that handlers can respond in
+// a protocol-appropriate way, or connections can be drained selectively (see
+// DrainConnections). The tag is also available as {l4.protocol}.
+// The same caveats as for SetValue apply.
+//
+// All matchers recognizing a protocol tag the connections they match, using
+// the name of the matcher, e.g. "ssh" or "socks5", except for quic_initial
+// and grpc_reflection, which use "quic" and "grpc". Matchers which don't
+// recognize a protocol, e.g. regexp or remote_ip_list, don't tag connections.
+// The names must be registered with RegisterProtocol.
+func (cx *Connection) SetProtocol(name string) {
+	cx.SetValue(protocolKey{}, name)
+	if rc, ok := cx.Context.Value(registeredConnCtxKey).(*registeredConn); ok {
+		rc.protocol.Store(&name)
+	}
+	if repl, ok := cx.Context.Value(ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("l4.protocol", name)
+	}
+}
+
+// Protocol returns the protocol tag set by SetProtocol, or an empty
+// string if the connection hasn't been tagged.
+func (cx *Connection) Protocol() string {
+	name, _ := ValueOf[string](cx, protocolKey{})
+	return name
+}
+
+// protocolKey is the key of the protocol tag in the value table.
+type protocolKey struct{}
+
+// BytesRead returns the number of bytes read from the underlying connection so far, including prefetched ones.
+// Bytes read by connections returned by Wrap are counted separately.
+func (cx *Connection) BytesRead() uint64 {
+	return cx.bytesRead
+}
+
+// BytesWritten returns the number of bytes written to the underlying connection so far.
+// Bytes written by connections returned by Wrap are counted separately.
+func (cx *Connection) BytesWritten() uint64 {
+	return cx.bytesWritten
+}
+
+// PrefetchedAt returns the time at which the first n bytes available for matching (see MatchingBytes) had
+// been prefetched, and true; or false if fewer bytes have been prefetched so far. It allows matchers to tell
+// how fast clients have sent data, regardless of how many times, or how late, the matchers are run.
+func (cx *Connection) PrefetchedAt(n int) (time.Time, bool) {
+	for _, a := range cx.arrivals {
+		if a.size >= cx.offset+n {
+			return a.at, true
+		}
+	}
+	return time.Time{}, false
+}
+
 // MatchingBytes returns all bytes currently available for matching. This is only intended for reading.
 // Do not write into the slice. It's a view of the internal buffer, and you will likely mess up the connection.
 // Use of this for matching purpose should be accompanied by corresponding error value,
@@ -228,6 +470,10 @@ var (
 	// in a Connection's context.
 	VarsCtxKey caddy.CtxKey = "vars"
 
+	// ValuesCtxKey is the key used to store the typed values table
+	// in a Connection's context.
+	ValuesCtxKey caddy.CtxKey = "values"
+
 	// ReplacerCtxKey is the key used to store the replacer.
 	ReplacerCtxKey caddy.CtxKey = "replacer"
 
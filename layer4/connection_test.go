@@ -1,10 +1,15 @@
 package layer4
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"io"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
 )
 
@@ -91,3 +96,175 @@ func TestConnection_FreezeAndUnfreeze(t *testing.T) {
 		t.Fatalf("expected %s but received %s", consumeData, buf)
 	}
 }
+
+func TestConnection_SetValueAndValue(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	defer func() { _ = cx.Close() }()
+
+	type testKey struct{}
+	type testValue struct{ name string }
+
+	if v := cx.Value(testKey{}); v != nil {
+		t.Fatalf("expected no value but got %v", v)
+	}
+	if _, ok := ValueOf[*testValue](cx, testKey{}); ok {
+		t.Fatalf("expected no value of type %T", &testValue{})
+	}
+
+	cx.SetValue(testKey{}, &testValue{name: "foo"})
+
+	v, ok := ValueOf[*testValue](cx, testKey{})
+	if !ok {
+		t.Fatalf("expected a value of type %T", &testValue{})
+	}
+	if v.name != "foo" {
+		t.Fatalf("expected %s but received %s", "foo", v.name)
+	}
+	if _, ok = ValueOf[string](cx, testKey{}); ok {
+		t.Fatalf("expected no value of type string")
+	}
+
+	// values are shared with wrapped connections
+	wrapped := cx.Wrap(in)
+	wrapped.SetValue(testKey{}, &testValue{name: "bar"})
+	if v, _ = ValueOf[*testValue](cx, testKey{}); v == nil || v.name != "bar" {
+		t.Fatalf("expected %s but received %v", "bar", v)
+	}
+
+	// values don't collide with vars
+	cx.SetVar("foo", "bar")
+	if v := cx.Value("foo"); v != nil {
+		t.Fatalf("expected no value but got %v", v)
+	}
+}
+
+func TestConnection_SetProtocol(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	defer func() { _ = cx.Close() }()
+
+	if p := cx.Protocol(); p != "" {
+		t.Fatalf("expected no protocol but got %s", p)
+	}
+
+	cx.SetProtocol("postgres")
+	if p := cx.Protocol(); p != "postgres" {
+		t.Fatalf("expected %s but received %s", "postgres", p)
+	}
+
+	repl := cx.Context.Value(ReplacerCtxKey).(*caddy.Replacer)
+	if p, _ := repl.GetString("l4.protocol"); p != "postgres" {
+		t.Fatalf("expected placeholder %s but received %s", "postgres", p)
+	}
+}
+
+func TestConnection_PrefetchedAt(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+
+	if _, ok := cx.PrefetchedAt(1); ok {
+		t.Fatalf("nothing should have been prefetched yet")
+	}
+
+	go func() {
+		_, _ = in.Write([]byte("foo"))
+		time.Sleep(50 * time.Millisecond)
+		_, _ = in.Write([]byte("bar"))
+	}()
+
+	for range 2 {
+		if err := cx.prefetch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, ok := cx.PrefetchedAt(3)
+	if !ok {
+		t.Fatalf("the first 3 bytes should have been prefetched")
+	}
+	last, ok := cx.PrefetchedAt(4)
+	if !ok {
+		t.Fatalf("the first 4 bytes should have been prefetched")
+	}
+	if d := last.Sub(first); d < 40*time.Millisecond {
+		t.Fatalf("the 4th byte should have been prefetched later than the 3rd one, got %s", d)
+	}
+	if _, ok = cx.PrefetchedAt(7); ok {
+		t.Fatalf("only 6 bytes should have been prefetched")
+	}
+
+	// the bytes consumed by handlers aren't available for matching anymore
+	cx.offset = 3
+	if at, _ := cx.PrefetchedAt(1); !at.Equal(last) {
+		t.Fatalf("the first byte after the consumed ones should have been prefetched with the 4th byte")
+	}
+}
+
+func TestConnection_Peek(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+
+	go func() {
+		_, _ = in.Write([]byte("foo"))
+		_, _ = in.Write([]byte("barbaz"))
+		_, _ = in.Write(bytes.Repeat([]byte{'x'}, MaxMatchingBytes))
+	}()
+
+	if err := cx.prefetch(); err != nil {
+		t.Fatal(err)
+	}
+
+	// in matching mode, only the buffer is peeked at
+	cx.freeze()
+	if b, err := cx.Peek(2); err != nil || string(b) != "fo" {
+		t.Fatalf("expected to peek %q but got %q, %v", "fo", b, err)
+	}
+	if b, err := cx.Peek(6); !errors.Is(err, ErrConsumedAllPrefetchedBytes) || string(b) != "foo" {
+		t.Fatalf("expected to peek %q and %v but got %q, %v", "foo", ErrConsumedAllPrefetchedBytes, b, err)
+	}
+	buf := make([]byte, 1)
+	if _, err := cx.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := cx.Peek(2); err != nil || string(b) != "oo" {
+		t.Fatalf("expected to peek %q after reading but got %q, %v", "oo", b, err)
+	}
+	cx.unfreeze()
+
+	// otherwise, missing bytes are read from the underlying connection, and delivered once by the next reads
+	if b, err := cx.Peek(6); err != nil || string(b) != "foobar" {
+		t.Fatalf("expected to peek %q but got %q, %v", "foobar", b, err)
+	}
+	buf = make([]byte, 9)
+	if n, err := io.ReadFull(cx, buf); err != nil || string(buf[:n]) != "foobarbaz" {
+		t.Fatalf("expected to read %q but got %q, %v", "foobarbaz", buf[:n], err)
+	}
+
+	// peeking at more than MaxMatchingBytes returns that many bytes at most
+	if b, err := cx.Peek(MaxMatchingBytes + 1); !errors.Is(err, ErrMatchingBufferFull) || len(b) != MaxMatchingBytes {
+		t.Fatalf("expected to peek %d bytes and %v but got %d, %v", MaxMatchingBytes, ErrMatchingBufferFull, len(b), err)
+	}
+	if b, err := cx.Peek(-1); !errors.Is(err, bufio.ErrNegativeCount) || b != nil {
+		t.Fatalf("expected %v but got %q, %v", bufio.ErrNegativeCount, b, err)
+	}
+	buf = make([]byte, MaxMatchingBytes)
+	if _, err := io.ReadFull(cx, buf); err != nil || !bytes.Equal(buf, bytes.Repeat([]byte{'x'}, MaxMatchingBytes)) {
+		t.Fatalf("expected to read the peeked bytes, got %v", err)
+	}
+	if cx.BytesRead() != uint64(9+MaxMatchingBytes) {
+		t.Fatalf("expected %d bytes read but got %d", 9+MaxMatchingBytes, cx.BytesRead())
+	}
+}
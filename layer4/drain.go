@@ -0,0 +1,173 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// DrainConnections closes the connections being handled by any server which have been tagged with protocol
+// by a matcher (see Connection.SetProtocol), e.g. "postgres", or all of them if protocol is empty, so that
+// clients reconnect elsewhere, e.g. during maintenance. It returns the number of connections closed, or an
+// error if no matcher has registered protocol (see RegisterProtocol).
+// Note: new connections are still accepted and handled as usual.
+func DrainConnections(protocol string) (int, error) {
+	if len(protocol) > 0 && !isRegisteredProtocol(protocol) {
+		return 0, fmt.Errorf("unknown protocol '%s': no matcher tags connections with it", protocol)
+	}
+	return activeConns.drain(protocol), nil
+}
+
+// RegisterProtocol registers the name of a protocol a matcher tags connections with (see Connection.SetProtocol),
+// so that they can be drained by protocol. Like caddy.RegisterModule, it should be called in init.
+func RegisterProtocol(name string) {
+	protocols.Lock()
+	defer protocols.Unlock()
+	protocols.names[name] = struct{}{}
+}
+
+// isRegisteredProtocol returns true if a matcher has registered the protocol name.
+func isRegisteredProtocol(name string) bool {
+	protocols.RLock()
+	defer protocols.RUnlock()
+	_, ok := protocols.names[name]
+	return ok
+}
+
+// protocols holds the names of the protocols registered by matchers.
+var protocols = struct {
+	sync.RWMutex
+	names map[string]struct{}
+}{names: make(map[string]struct{})}
+
+// connRegistry tracks the connections being handled by all servers, so that they can be drained.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[*registeredConn]struct{}
+}
+
+// registeredConn is a connection tracked by connRegistry. Its protocol tag is set by the handling
+// goroutine and read while draining, so it's stored separately from the connection's value table.
+type registeredConn struct {
+	conn     net.Conn
+	protocol atomic.Pointer[string]
+}
+
+// add tracks cx until the returned function is called. It also exposes the registeredConn to cx's
+// context, so that its protocol tag can be updated.
+func (r *connRegistry) add(cx *Connection) (remove func()) {
+	rc := &registeredConn{conn: cx.Conn}
+	cx.Context = context.WithValue(cx.Context, registeredConnCtxKey, rc)
+
+	r.mu.Lock()
+	r.conns[rc] = struct{}{}
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.conns, rc)
+		r.mu.Unlock()
+	}
+}
+
+// drain closes and stops tracking the connections tagged with protocol, or all of them if protocol is empty.
+func (r *connRegistry) drain(protocol string) int {
+	var conns []net.Conn
+	r.mu.Lock()
+	for rc := range r.conns {
+		if tag := rc.protocol.Load(); protocol == "" || tag != nil && *tag == protocol {
+			conns = append(conns, rc.conn)
+			delete(r.conns, rc)
+		}
+	}
+	r.mu.Unlock()
+
+	// closing packet connections may block until the server loop is notified, so it's done without the lock
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return len(conns)
+}
+
+// activeConns is the global registry of connections, so that connections accepted
+// before a config reload can be drained as well.
+var activeConns = &connRegistry{conns: make(map[*registeredConn]struct{})}
+
+// registeredConnCtxKey is the key used to store the registeredConn of a connection.
+const registeredConnCtxKey caddy.CtxKey = "layer4_registered_conn"
+
+// adminAPI is a module that provides the layer4 endpoints of the admin API:
+//
+//	POST /layer4/drain[?protocol=<name>]
+//
+// drains the connections tagged with the given protocol (or all of them, if omitted)
+// and responds with the number of connections closed, e.g. {"drained": 3}.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.layer4",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for the layer4 app.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/layer4/drain",
+			Handler: caddy.AdminHandlerFunc(a.handleDrain),
+		},
+	}
+}
+
+// handleDrain drains the connections tagged with the protocol given by the query string.
+func (adminAPI) handleDrain(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	drained, err := DrainConnections(r.URL.Query().Get("protocol"))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(struct {
+		Drained int `json:"drained"`
+	}{Drained: drained})
+}
+
+// Interface guard
+var _ caddy.AdminRouter = (*adminAPI)(nil)
@@ -0,0 +1,124 @@
+package layer4
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestConnRegistry_Drain(t *testing.T) {
+	r := &connRegistry{conns: make(map[*registeredConn]struct{})}
+
+	var conns []net.Conn
+	var removes []func()
+	for _, protocol := range []string{"postgres", "http", "postgres", ""} {
+		in, out := net.Pipe()
+		defer func() { _ = in.Close() }()
+		defer func() { _ = out.Close() }()
+
+		cx := WrapConnection(out, []byte{}, zap.NewNop())
+		removes = append(removes, r.add(cx))
+		if protocol != "" {
+			// tags set on wrapped connections apply as well
+			cx.Wrap(cx.Conn).SetProtocol(protocol)
+		}
+		conns = append(conns, out)
+	}
+
+	// connections which are done aren't drained
+	removes[2]()
+
+	// isClosed returns true if conn has been closed, which net.Pipe reports when setting a deadline
+	isClosed := func(conn net.Conn) bool {
+		return errors.Is(conn.SetReadDeadline(time.Time{}), io.ErrClosedPipe)
+	}
+
+	if n := r.drain("postgres"); n != 1 {
+		t.Fatalf("unexpected number of drained connections | got %d, want %d\n", n, 1)
+	}
+	for i, want := range []bool{true, false, false, false} {
+		if isClosed(conns[i]) != want {
+			t.Fatalf("connection %d: unexpected state after draining postgres | closed: %t, want %t\n", i, !want, want)
+		}
+	}
+
+	if n := r.drain("postgres"); n != 0 {
+		t.Fatalf("unexpected number of drained connections | got %d, want %d\n", n, 0)
+	}
+
+	if n := r.drain(""); n != 2 {
+		t.Fatalf("unexpected number of drained connections | got %d, want %d\n", n, 2)
+	}
+	for i, want := range []bool{true, true, false, true} {
+		if isClosed(conns[i]) != want {
+			t.Fatalf("connection %d: unexpected state after draining all | closed: %t, want %t\n", i, !want, want)
+		}
+	}
+
+	for _, remove := range removes {
+		remove()
+	}
+	if len(r.conns) != 0 {
+		t.Fatalf("unexpected number of tracked connections | got %d, want %d\n", len(r.conns), 0)
+	}
+}
+
+func TestAdminAPI_Drain(t *testing.T) {
+	RegisterProtocol("http")
+	RegisterProtocol("postgres")
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	defer activeConns.add(cx)()
+	cx.SetProtocol("postgres")
+
+	handler := adminAPI{}.Routes()[0].Handler
+
+	rec := httptest.NewRecorder()
+	err := handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/layer4/drain", nil))
+	if err == nil {
+		t.Fatalf("GET requests should not be accepted")
+	}
+
+	rec = httptest.NewRecorder()
+	err = handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/layer4/drain?protocol=postgress", nil))
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("draining an unknown protocol should fail with a bad request | got %v", err)
+	}
+
+	for _, tc := range []struct {
+		protocol string
+		drained  int
+	}{
+		{protocol: "http", drained: 0},
+		{protocol: "postgres", drained: 1},
+		{protocol: "postgres", drained: 0},
+	} {
+		rec = httptest.NewRecorder()
+		err = handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/layer4/drain?protocol="+tc.protocol, nil))
+		if err != nil {
+			t.Fatalf("draining %s: unexpected error | %s\n", tc.protocol, err)
+		}
+
+		var resp struct {
+			Drained int `json:"drained"`
+		}
+		if err = json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("draining %s: unexpected response | %s\n", tc.protocol, err)
+		}
+		if resp.Drained != tc.drained {
+			t.Fatalf("draining %s: unexpected number of drained connections | got %d, want %d\n", tc.protocol, resp.Drained, tc.drained)
+		}
+	}
+}
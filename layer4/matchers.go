@@ -40,6 +40,37 @@ type ConnMatcher interface {
 	Match(*Connection) (bool, error)
 }
 
+// ConfidenceMatcher is a ConnMatcher that is also able to tell how strongly a connection
+// resembles its protocol, e.g. for heuristic matchers to report partial matches. It's
+// optional, and only used for diagnostics, e.g. by handlers ranking candidate protocols.
+type ConfidenceMatcher interface {
+	ConnMatcher
+	// MatchConfidence returns true if the given connection matches, like Match,
+	// and the confidence of the match between 0 (no resemblance) and 1 (definitive).
+	// The confidence may be greater than 0 for a connection that doesn't match.
+	MatchConfidence(*Connection) (bool, float64, error)
+}
+
+// MatchConfidence runs m against cx in the matching mode, so that the bytes read by m are rewound
+// afterwards, and returns the confidence of the match. If m isn't a ConfidenceMatcher, the confidence
+// is 1 if the connection matches, and 0 otherwise. Since only prefetched bytes are read, m may return
+// ErrConsumedAllPrefetchedBytes if it needs more of them.
+func MatchConfidence(m ConnMatcher, cx *Connection) (matched bool, confidence float64, err error) {
+	cx.freeze()
+	defer cx.unfreeze()
+
+	if cm, ok := m.(ConfidenceMatcher); ok {
+		matched, confidence, err = cm.MatchConfidence(cx)
+		return matched, min(max(confidence, 0), 1), err
+	}
+
+	matched, err = m.Match(cx)
+	if matched {
+		confidence = 1
+	}
+	return matched, confidence, err
+}
+
 // MatcherSet is a set of matchers which
 // must all match in order for the request
 // to be matched successfully.
@@ -346,7 +377,10 @@ func (m *MatchNot) Provision(ctx caddy.Context) error {
 
 // Match returns true if r matches m. Since this matcher negates
 // the embedded matchers, false is returned if any of its matcher
-// sets return true.
+// sets return true. Errors aren't negated, but returned as is, so
+// that matching is retried with more data if the embedded matchers
+// return ErrConsumedAllPrefetchedBytes, and the bytes read by them
+// are rewound, so that they are available to the next routes.
 func (m *MatchNot) Match(r *Connection) (bool, error) {
 	for _, ms := range m.MatcherSets {
 		match, err := ms.Match(r)
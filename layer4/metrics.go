@@ -0,0 +1,189 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// routeMetrics count how many times the matcher sets of each route have been evaluated to a conclusion
+// and how many times they have matched, so that routes which are often evaluated, but rarely matched,
+// can be found. Routes are labeled by the name of their server and their position in the route list,
+// e.g. "2" for the third route of a server, or "2.0" for the first route of a subroute handler in it.
+// Evaluations requiring more data are only counted once they conclude, i.e. not if matching times out.
+//
+// They also count the bytes read from and written to the connections matched by each route, which are
+// attributed to the last route matching them, including the bytes read before, e.g. for matching.
+var routeMetrics = struct {
+	once           sync.Once
+	matchAttempts  *prometheus.CounterVec
+	matchSuccesses *prometheus.CounterVec
+	bytesRead      *prometheus.CounterVec
+	bytesWritten   *prometheus.CounterVec
+}{}
+
+func initRouteMetrics(registry *prometheus.Registry) {
+	const ns, sub = "caddy", "layer4"
+
+	routeLabels := []string{"server", "route"}
+	routeMetrics.once.Do(func() {
+		routeMetrics.matchAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "route_match_attempts_total",
+			Help:      "Number of times the matchers of a route have been evaluated.",
+		}, routeLabels)
+		routeMetrics.matchSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "route_matches_total",
+			Help:      "Number of times the matchers of a route have matched.",
+		}, routeLabels)
+		routeMetrics.bytesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "route_read_bytes_total",
+			Help:      "Number of bytes read from the connections matched by a route.",
+		}, routeLabels)
+		routeMetrics.bytesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "route_written_bytes_total",
+			Help:      "Number of bytes written to the connections matched by a route.",
+		}, routeLabels)
+	})
+
+	// route lists of all servers and subroute handlers are provisioned with the same registry,
+	// so duplicate registrations are expected and ignored
+	registerMetrics(registry, routeMetrics.matchAttempts, routeMetrics.matchSuccesses,
+		routeMetrics.bytesRead, routeMetrics.bytesWritten)
+}
+
+// matcherMetrics count how many times the matchers of the routes of each server have been evaluated
+// to a conclusion, and either matched or not (or failed), by matcher name, e.g. "tls" or "postgres",
+// so that the connections can be broken down by protocol. Only the matchers of routes are counted,
+// not the matchers nested in other matchers, e.g. not.
+var matcherMetrics = struct {
+	once     sync.Once
+	matches  *prometheus.CounterVec
+	failures *prometheus.CounterVec
+}{}
+
+func initMatcherMetrics(registry *prometheus.Registry) {
+	const ns, sub = "caddy", "layer4"
+
+	matcherLabels := []string{"server", "matcher"}
+	matcherMetrics.once.Do(func() {
+		matcherMetrics.matches = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "matcher_matches_total",
+			Help:      "Number of times a matcher has matched.",
+		}, matcherLabels)
+		matcherMetrics.failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "matcher_failures_total",
+			Help:      "Number of times a matcher hasn't matched, or has failed with an error.",
+		}, matcherLabels)
+	})
+
+	registerMetrics(registry, matcherMetrics.matches, matcherMetrics.failures)
+}
+
+// serverMetrics count the connections being handled by each server.
+var serverMetrics = struct {
+	once        sync.Once
+	activeConns *prometheus.GaugeVec
+}{}
+
+func initServerMetrics(registry *prometheus.Registry) {
+	const ns, sub = "caddy", "layer4"
+
+	serverMetrics.once.Do(func() {
+		serverMetrics.activeConns = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "connections_active",
+			Help:      "Number of connections being handled by a server.",
+		}, []string{"server"})
+	})
+
+	registerMetrics(registry, serverMetrics.activeConns)
+}
+
+// registerMetrics registers collectors with registry, ignoring those registered already.
+func registerMetrics(registry *prometheus.Registry, collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil && !errors.Is(err, prometheus.AlreadyRegisteredError{
+			ExistingCollector: collector,
+			NewCollector:      collector,
+		}) {
+			panic(err)
+		}
+	}
+}
+
+// MetricsRegistryFromContext returns the metrics registry of ctx, or nil if metrics
+// are disabled for the server provisioned with it, i.e. with disable_metrics.
+func MetricsRegistryFromContext(ctx caddy.Context) *prometheus.Registry {
+	if disabled, _ := ctx.Value(metricsDisabledCtxKey).(bool); disabled {
+		return nil
+	}
+	return ctx.GetMetricsRegistry()
+}
+
+// RouteLabelFromContext returns the label of the route provisioned with ctx,
+// or an empty string if there is none, i.e. for top-level route lists.
+func RouteLabelFromContext(ctx caddy.Context) string {
+	label, _ := ctx.Value(routeLabelCtxKey).(string)
+	return label
+}
+
+// RouteMatchersFromContext returns the names of the matcher modules of the route provisioned
+// with ctx, e.g. tls or postgres, or nil if there is none or the route has no matchers.
+func RouteMatchersFromContext(ctx caddy.Context) []string {
+	names, _ := ctx.Value(routeMatchersCtxKey).([]string)
+	return names
+}
+
+// ServerNameFromContext returns the name of the server provisioned with ctx,
+// or an empty string if there is none, e.g. for listener wrappers.
+func ServerNameFromContext(ctx caddy.Context) string {
+	name, _ := ctx.Value(serverNameCtxKey).(string)
+	return name
+}
+
+var (
+	// serverNameCtxKey is the key used to store the name of the
+	// server being provisioned in a provisioning context.
+	serverNameCtxKey caddy.CtxKey = "layer4_server_name"
+
+	// routeLabelCtxKey is the key used to store the label of the
+	// route being provisioned in a provisioning context.
+	routeLabelCtxKey caddy.CtxKey = "layer4_route_label"
+
+	// routeMatchersCtxKey is the key used to store the names of the
+	// matchers of the route being provisioned in a provisioning context.
+	routeMatchersCtxKey caddy.CtxKey = "layer4_route_matchers"
+
+	// metricsDisabledCtxKey is the key used to store whether metrics
+	// are disabled for the server being provisioned in a provisioning context.
+	metricsDisabledCtxKey caddy.CtxKey = "layer4_metrics_disabled"
+)
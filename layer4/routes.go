@@ -15,13 +15,17 @@
 package layer4
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -44,12 +48,22 @@ type Route struct {
 
 	matcherSets MatcherSets
 	middleware  []Middleware
+	label       string
+
+	matchAttempts  prometheus.Counter
+	matchSuccesses prometheus.Counter
+	bytesRead      prometheus.Counter
+	bytesWritten   prometheus.Counter
 }
 
 var ErrMatchingTimeout = errors.New("aborted matching according to timeout")
 
 // Provision sets up a route.
 func (r *Route) Provision(ctx caddy.Context) error {
+	// handlers may log the names of the matchers of their route,
+	// which have to be collected before the raw matchers are cleared
+	matcherNames := r.matcherNames()
+
 	// matchers
 	matchersIface, err := ctx.LoadModule(r, "MatcherSetsRaw")
 	if err != nil {
@@ -59,8 +73,25 @@ func (r *Route) Provision(ctx caddy.Context) error {
 	if err != nil {
 		return err
 	}
+	if registry := MetricsRegistryFromContext(ctx); registry != nil {
+		initMatcherMetrics(registry)
+		server := ServerNameFromContext(ctx)
+		for _, set := range r.matcherSets {
+			for i, m := range set {
+				if mod, ok := m.(caddy.Module); ok {
+					name := mod.CaddyModule().ID.Name()
+					set[i] = &observedMatcher{
+						ConnMatcher: m,
+						matches:     matcherMetrics.matches.WithLabelValues(server, name),
+						failures:    matcherMetrics.failures.WithLabelValues(server, name),
+					}
+				}
+			}
+		}
+	}
 
 	// handlers
+	ctx.Context = context.WithValue(ctx.Context, routeMatchersCtxKey, matcherNames)
 	mods, err := ctx.LoadModule(r, "HandlersRaw")
 	if err != nil {
 		return err
@@ -76,6 +107,54 @@ func (r *Route) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// matcherNames returns the sorted names of the matcher modules of r, without duplicates.
+func (r *Route) matcherNames() []string {
+	var names []string
+	for _, set := range r.MatcherSetsRaw {
+		for name := range set {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// observeMatch counts a conclusive evaluation of r's matchers in the route metrics, if enabled.
+func (r *Route) observeMatch(matched bool) {
+	if r.matchAttempts == nil {
+		return
+	}
+	r.matchAttempts.Inc()
+	if matched {
+		r.matchSuccesses.Inc()
+	}
+}
+
+// observedMatcher counts the conclusive evaluations of a matcher in the matcher metrics.
+type observedMatcher struct {
+	ConnMatcher
+	matches, failures prometheus.Counter
+}
+
+// CaddyModule returns the Caddy module information of the observed matcher.
+func (m *observedMatcher) CaddyModule() caddy.ModuleInfo {
+	return m.ConnMatcher.(caddy.Module).CaddyModule()
+}
+
+// Match returns the result of the observed matcher, and counts it unless more data is required.
+func (m *observedMatcher) Match(cx *Connection) (bool, error) {
+	matched, err := m.ConnMatcher.Match(cx)
+	if errors.Is(err, ErrConsumedAllPrefetchedBytes) {
+		return matched, err
+	}
+	if matched && err == nil {
+		m.matches.Inc()
+	} else {
+		m.failures.Inc()
+	}
+	return matched, err
+}
+
 // RouteList is a list of connection routes that can create
 // a middleware chain. Routes are evaluated in sequential
 // order: for the first route, the matchers will be evaluated,
@@ -85,7 +164,28 @@ type RouteList []*Route
 
 // Provision sets up all the routes.
 func (routes RouteList) Provision(ctx caddy.Context) error {
+	registry := MetricsRegistryFromContext(ctx)
+	if registry != nil {
+		initRouteMetrics(registry)
+	}
+	server, parent := ServerNameFromContext(ctx), RouteLabelFromContext(ctx)
+
+	oldContext := ctx.Context
 	for i, r := range routes {
+		label := strconv.Itoa(i)
+		if parent != "" {
+			label = parent + "." + label
+		}
+		r.label = label
+		if registry != nil {
+			r.matchAttempts = routeMetrics.matchAttempts.WithLabelValues(server, label)
+			r.matchSuccesses = routeMetrics.matchSuccesses.WithLabelValues(server, label)
+			r.bytesRead = routeMetrics.bytesRead.WithLabelValues(server, label)
+			r.bytesWritten = routeMetrics.bytesWritten.WithLabelValues(server, label)
+		}
+
+		// nested route lists, e.g. of subroute handlers, are labeled relative to this route
+		ctx.Context = context.WithValue(oldContext, routeLabelCtxKey, label)
 		err := r.Provision(ctx)
 		if err != nil {
 			return fmt.Errorf("route %d: %v", i, err)
@@ -134,6 +234,8 @@ func (routes RouteList) Compile(logger *zap.Logger, matchingTimeout time.Duratio
 					if errors.Is(err, os.ErrDeadlineExceeded) {
 						err = ErrMatchingTimeout
 						logFunc = logger.Warn
+					} else if errors.Is(err, ErrShuttingDown) {
+						logFunc = logger.Debug
 					}
 					logFunc("matching connection", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err))
 					return nil // return nil so the error does not get logged again
@@ -167,7 +269,9 @@ func (routes RouteList) Compile(logger *zap.Logger, matchingTimeout time.Duratio
 					logger.Error("matching connection", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err))
 					return nil
 				}
+				route.observeMatch(matched)
 				if matched {
+					cx.observeRoute(route)
 					routesStatus[i] = routeMatched
 					lastMatchedRouteIdx = i
 					lastNeedsMoreIdx = i
@@ -201,6 +305,10 @@ func (routes RouteList) Compile(logger *zap.Logger, matchingTimeout time.Duratio
 					if isTerminal {
 						return nil
 					}
+
+					// Restart the matching timeout for the next routes, since the handlers may have made
+					// the client wait, e.g. for a server-first greeting it must reply to before matching.
+					deadline = time.Now().Add(matchingTimeout)
 				} else {
 					routesStatus[i] = routeNotMatched
 				}
@@ -1,12 +1,17 @@
 package layer4
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net"
 	"os"
+	"slices"
 	"testing"
 	"time"
 
@@ -187,3 +192,430 @@ func TestMatchingTimeoutWorksUDP(t *testing.T) {
 		t.Fatalf("timeout takes too long %s", elapsed)
 	}
 }
+
+// used to test the route metrics
+type testPrefixMatcher struct {
+	Prefix string `json:"prefix"`
+}
+
+func (*testPrefixMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.testPrefixMatcher",
+		New: func() caddy.Module { return new(testPrefixMatcher) },
+	}
+}
+
+func (m *testPrefixMatcher) Match(cx *Connection) (bool, error) {
+	buf := make([]byte, len(m.Prefix))
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return false, err
+	}
+	return string(buf) == m.Prefix, nil
+}
+
+func TestRouteMetrics(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	ctx.Context = context.WithValue(ctx.Context, serverNameCtxKey, "metrics_test")
+
+	caddy.RegisterModule(&testPrefixMatcher{})
+
+	routes := RouteList{
+		&Route{
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{
+				caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"SSH-"}`)},
+			},
+		},
+		&Route{}, // no matchers match all
+	}
+
+	err := routes.Provision(ctx)
+	if err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	compiledRoutes := routes.Compile(zap.NewNop(), time.Second,
+		HandlerFunc(func(con *Connection) error {
+			return nil
+		}))
+
+	for _, data := range []string{"SSH-2.0-OpenSSH_9.6\r\n", "GET / HTTP/1.1\r\n\r\n", "\x16\x03\x01\x00\xa5\x01"} {
+		func() {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+			defer func() { _ = out.Close() }()
+
+			cx := WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, _ = in.Write([]byte(data))
+			}()
+
+			err := compiledRoutes.Handle(cx)
+			if err != nil {
+				t.Fatalf("handle failed | %s", err)
+			}
+		}()
+	}
+
+	// the first route is evaluated for every connection, but only matches SSH,
+	// while the second one matches every connection, as the first one isn't terminal
+	for _, want := range []struct {
+		metric string
+		route  string
+		value  float64
+	}{
+		{metric: "caddy_layer4_route_match_attempts_total", route: "0", value: 3},
+		{metric: "caddy_layer4_route_matches_total", route: "0", value: 1},
+		{metric: "caddy_layer4_route_match_attempts_total", route: "1", value: 3},
+		{metric: "caddy_layer4_route_matches_total", route: "1", value: 3},
+	} {
+		if value := gatherRouteMetric(t, ctx, want.metric, "metrics_test", want.route); value != want.value {
+			t.Fatalf("unexpected %s of route %s | got %v, want %v", want.metric, want.route, value, want.value)
+		}
+	}
+}
+
+func TestMatcherAndBytesMetrics(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	ctx.Context = context.WithValue(ctx.Context, serverNameCtxKey, "bytes_test")
+
+	// the modules may have been registered by other tests already
+	if _, err := caddy.GetModule("layer4.matchers.testPrefixMatcher"); err != nil {
+		caddy.RegisterModule(&testPrefixMatcher{})
+	}
+
+	routes := RouteList{
+		&Route{
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{
+				caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"SSH-"}`)},
+			},
+		},
+		&Route{
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{
+				caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"GET "}`)},
+			},
+		},
+	}
+
+	err := routes.Provision(ctx)
+	if err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	// the routes aren't terminal, so that the connections they match are read and written by the next handler
+	response := []byte("bye\r\n")
+	compiledRoutes := routes.Compile(zap.NewNop(), time.Second,
+		HandlerFunc(func(cx *Connection) error {
+			if _, err := io.ReadFull(cx, make([]byte, len(cx.MatchingBytes()))); err != nil {
+				return err
+			}
+			_, err := cx.Write(response)
+			return err
+		}))
+
+	for _, data := range []string{"SSH-2.0-OpenSSH_9.6\r\n", "GET / HTTP/1.1\r\n\r\n", "\x16\x03\x01\x00\xa5\x01"} {
+		func() {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+			defer func() { _ = out.Close() }()
+
+			cx := WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, _ = in.Write([]byte(data))
+				_, _ = io.ReadFull(in, make([]byte, len(response)))
+			}()
+
+			err := compiledRoutes.Handle(cx)
+			if err != nil {
+				t.Fatalf("handle failed | %s", err)
+			}
+		}()
+	}
+
+	// the bytes are attributed to the route matching the connection, or to none,
+	// while the matchers are counted at every conclusive evaluation
+	for _, want := range []struct {
+		metric string
+		route  string
+		value  float64
+	}{
+		{metric: "caddy_layer4_route_read_bytes_total", route: "0", value: 21},
+		{metric: "caddy_layer4_route_written_bytes_total", route: "0", value: 5},
+		{metric: "caddy_layer4_route_read_bytes_total", route: "1", value: 18},
+		{metric: "caddy_layer4_route_written_bytes_total", route: "1", value: 5},
+	} {
+		if value := gatherRouteMetric(t, ctx, want.metric, "bytes_test", want.route); value != want.value {
+			t.Fatalf("unexpected %s of route %s | got %v, want %v", want.metric, want.route, value, want.value)
+		}
+	}
+	for metric, want := range map[string]float64{
+		"caddy_layer4_matcher_matches_total":  2,
+		"caddy_layer4_matcher_failures_total": 4,
+	} {
+		labels := map[string]string{"server": "bytes_test", "matcher": "testPrefixMatcher"}
+		if value := gatherMetric(t, ctx, metric, labels); value != want {
+			t.Fatalf("unexpected %s | got %v, want %v", metric, value, want)
+		}
+	}
+}
+
+// used to test the context handlers are provisioned with
+type testContextHandler struct {
+	matchers []string
+	route    string
+}
+
+func (*testContextHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.testContextHandler",
+		New: func() caddy.Module { return new(testContextHandler) },
+	}
+}
+
+func (h *testContextHandler) Provision(ctx caddy.Context) error {
+	h.matchers, h.route = RouteMatchersFromContext(ctx), RouteLabelFromContext(ctx)
+	provisionedContextHandlers = append(provisionedContextHandlers, h)
+	return nil
+}
+
+func (h *testContextHandler) Handle(cx *Connection, next Handler) error {
+	return next.Handle(cx)
+}
+
+var provisionedContextHandlers []*testContextHandler
+
+func TestRouteMatchersFromContext(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// the modules may have been registered by other tests already
+	for _, mod := range []caddy.Module{&testPrefixMatcher{}, &testIoMatcher{}, &testContextHandler{}} {
+		if _, err := caddy.GetModule(string(mod.CaddyModule().ID)); err != nil {
+			caddy.RegisterModule(mod)
+		}
+	}
+	provisionedContextHandlers = nil
+
+	handler := json.RawMessage(`{"handler":"testContextHandler"}`)
+	routes := RouteList{
+		&Route{
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{
+				caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"SSH-"}`)},
+				caddy.ModuleMap{"testIoMatcher": json.RawMessage(`{}`), "testPrefixMatcher": json.RawMessage(`{"prefix":"GET "}`)},
+			},
+			HandlersRaw: []json.RawMessage{handler},
+		},
+		&Route{HandlersRaw: []json.RawMessage{handler}},
+	}
+
+	err := routes.Provision(ctx)
+	if err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	if len(provisionedContextHandlers) != 2 {
+		t.Fatalf("unexpected number of provisioned handlers | got %d, want 2", len(provisionedContextHandlers))
+	}
+	for i, want := range []struct {
+		matchers []string
+		route    string
+	}{
+		{matchers: []string{"testIoMatcher", "testPrefixMatcher"}, route: "0"},
+		{matchers: nil, route: "1"},
+	} {
+		h := provisionedContextHandlers[i]
+		if !slices.Equal(h.matchers, want.matchers) || h.route != want.route {
+			t.Fatalf("handler %d: unexpected context | got %v and %q, want %v and %q", i, h.matchers, h.route, want.matchers, want.route)
+		}
+	}
+}
+
+// testReadMatcher reads the connection as told by its steps, verifying the bytes read, and returns Matches.
+type testReadMatcher struct {
+	Steps   []string `json:"steps,omitempty"`
+	Matches bool     `json:"matches,omitempty"`
+}
+
+func (*testReadMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.testReadMatcher",
+		New: func() caddy.Module { return new(testReadMatcher) },
+	}
+}
+
+func (m *testReadMatcher) Match(cx *Connection) (bool, error) {
+	if _, err := testRead(cx, m.Steps); err != nil {
+		return false, err
+	}
+	return m.Matches, nil
+}
+
+// testRead reads cx as told by steps, i.e. "read <n>" with io.ReadFull, "peek <n>" with Connection.Peek,
+// or "bufio <n>" with io.ReadFull from a bufio.Reader reading ahead, which can only be the last step,
+// verifying the bytes are those of testStream. It returns the number of bytes read from the start of the stream.
+func testRead(cx *Connection, steps []string) (int, error) {
+	var pos int
+	for _, step := range steps {
+		var (
+			kind string
+			n    int
+			b    []byte
+			err  error
+		)
+		if _, err = fmt.Sscan(step, &kind, &n); err != nil {
+			return pos, err
+		}
+		switch kind {
+		case "read":
+			b = make([]byte, n)
+			_, err = io.ReadFull(cx, b)
+		case "peek":
+			b, err = cx.Peek(n)
+		case "bufio":
+			b = make([]byte, n)
+			_, err = io.ReadFull(bufio.NewReader(cx), b)
+		}
+		if err != nil {
+			return pos, err
+		}
+		if !bytes.Equal(b, testStream[pos:pos+n]) {
+			return pos, fmt.Errorf("step %q: unexpected bytes at %d", step, pos)
+		}
+		if kind != "peek" {
+			pos += n
+		}
+	}
+	return pos, nil
+}
+
+// testStream is sent by the clients of TestRouteDeliversBytesOnce in chunks.
+var testStream = func() []byte {
+	b := make([]byte, 6000)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}()
+
+func TestRouteDeliversBytesOnce(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// the module may have been registered by other tests already
+	if _, err := caddy.GetModule("layer4.matchers.testReadMatcher"); err != nil {
+		caddy.RegisterModule(&testReadMatcher{})
+	}
+
+	// every route but the last one doesn't match, after its matcher read bytes in some way; the bytes
+	// are sent in several chunks, so that matchers need several prefetches; the handler must still
+	// get every byte exactly once, however the matchers and itself read them
+	for i, tc := range []struct {
+		matchers [][]string
+		handler  []string
+	}{
+		{ // consuming reads, like l4postgres
+			matchers: [][]string{{"read 8", "read 3000"}, {"read 5000"}},
+		},
+		{
+			matchers: [][]string{{"peek 4000"}, {"peek 10", "peek 5500"}},
+			handler:  []string{"peek 100", "read 50"},
+		},
+		{ // reads ahead
+			matchers: [][]string{{"bufio 4500"}, {"bufio 1"}},
+			handler:  []string{"read 1"},
+		},
+		{
+			matchers: [][]string{
+				{"peek 100", "read 50", "peek 10", "bufio 3000"},
+				{"read 10", "peek 4000", "read 2000"},
+				{"read 10", "peek 5990", "read 5000", "bufio 10"},
+			},
+			handler: []string{"peek 6000", "read 3000", "peek 1000", "read 1"},
+		},
+	} {
+		var routes RouteList
+		for j, steps := range tc.matchers {
+			raw, _ := json.Marshal(&testReadMatcher{Steps: steps, Matches: j == len(tc.matchers)-1})
+			routes = append(routes, &Route{
+				MatcherSetsRaw: caddyhttp.RawMatcherSets{caddy.ModuleMap{"testReadMatcher": raw}},
+			})
+		}
+		if err := routes.Provision(ctx); err != nil {
+			t.Fatalf("test %d: provision failed | %s", i, err)
+		}
+
+		var handled bool
+		compiledRoutes := routes.Compile(zap.NewNop(), time.Second,
+			HandlerFunc(func(cx *Connection) error {
+				handled = true
+				pos, err := testRead(cx, tc.handler)
+				if err != nil {
+					return err
+				}
+				rest, err := io.ReadAll(cx)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(rest, testStream[pos:]) {
+					return fmt.Errorf("got %d bytes after %d, want %d", len(rest), pos, len(testStream)-pos)
+				}
+				return nil
+			}))
+
+		func() {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+			defer func() { _ = out.Close() }()
+
+			cx := WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				for chunk := range slices.Chunk(testStream, 2000) {
+					_, _ = in.Write(chunk)
+					time.Sleep(20 * time.Millisecond)
+				}
+				_ = in.Close()
+			}()
+
+			if err := compiledRoutes.Handle(cx); err != nil {
+				t.Fatalf("test %d: handle failed | %s", i, err)
+			}
+			if !handled {
+				t.Fatalf("test %d: the last route should have matched", i)
+			}
+		}()
+	}
+}
+
+// gatherRouteMetric returns the value of the route metric with the given labels from ctx's registry.
+func gatherRouteMetric(t *testing.T, ctx caddy.Context, name, server, route string) float64 {
+	t.Helper()
+	return gatherMetric(t, ctx, name, map[string]string{"server": server, "route": route})
+}
+
+// gatherMetric returns the value of the counter or gauge with the given name and labels from ctx's registry.
+func gatherMetric(t *testing.T, ctx caddy.Context, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := ctx.GetMetricsRegistry().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics failed | %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			got := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				got[label.GetName()] = label.GetValue()
+			}
+			if maps.Equal(got, labels) {
+				if metric.GetGauge() != nil {
+					return metric.GetGauge().GetValue()
+				}
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
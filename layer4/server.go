@@ -16,9 +16,11 @@ package layer4
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"sync"
@@ -27,10 +29,14 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
-const MatchingTimeoutDefault = 3 * time.Second
+const (
+	MatchingTimeoutDefault = 3 * time.Second
+	UDPIdleTimeoutDefault  = 30 * time.Second
+)
 
 // Server represents a Caddy layer4 server.
 type Server struct {
@@ -42,12 +48,34 @@ type Server struct {
 	// Routes express composable logic for handling byte streams.
 	Routes RouteList `json:"routes,omitempty"`
 
-	// Maximum time connections have to complete the matching phase (the first terminal handler is matched). Default: 3s.
+	// Maximum time connections have to complete the matching phase (the first terminal handler is matched),
+	// which restarts once the handlers of a matched non-terminal route are done, e.g. after sending a server-first
+	// greeting. Connections not sending enough data in time are closed. Default: the app's matching_timeout, or 3s.
 	MatchingTimeout caddy.Duration `json:"matching_timeout,omitempty"`
 
+	// How long closing TCP connections blocks while unsent data is being sent (SO_LINGER), rounded up
+	// to whole seconds. Zero makes closing discard unsent data and reset connections. Default: OS default.
+	Linger *caddy.Duration `json:"linger,omitempty"`
+
+	// How long closing TCP connections waits for clients to close them too, after the writing side has been
+	// shut down, so that data in flight isn't truncated by connection resets. Default: 0s (close immediately).
+	CloseGrace caddy.Duration `json:"close_grace,omitempty"`
+
+	// How long the datagrams received from a remote address are associated with the same UDP connection once
+	// none is received from or sent to it, so that e.g. the replies of proxied upstreams keep the association
+	// and its upstream sockets alive. All the datagrams of a UDP connection are handled by the route matching
+	// the first ones, without matching them again, and the next datagram after expiry starts a new connection.
+	// Default: 30s.
+	UDPIdleTimeout caddy.Duration `json:"udp_idle_timeout,omitempty"`
+
+	// Disables the metrics of the server and its routes, e.g. to save the overhead of counting bytes.
+	DisableMetrics bool `json:"disable_metrics,omitempty"`
+
 	logger        *zap.Logger
 	listenAddrs   []caddy.NetworkAddress
 	compiledRoute Handler
+	activeConns   prometheus.Gauge
+	shutdownCtx   context.Context // parent of the contexts of connections, see newShutdownContext
 }
 
 // Provision sets up the server.
@@ -68,6 +96,14 @@ func (s *Server) Provision(ctx caddy.Context, logger *zap.Logger) error {
 		s.listenAddrs = append(s.listenAddrs, addr)
 	}
 
+	if s.DisableMetrics {
+		ctx.Context = context.WithValue(ctx.Context, metricsDisabledCtxKey, true)
+	}
+	if registry := MetricsRegistryFromContext(ctx); registry != nil {
+		initServerMetrics(registry)
+		s.activeConns = serverMetrics.activeConns.WithLabelValues(ServerNameFromContext(ctx))
+	}
+
 	err := s.Routes.Provision(ctx)
 	if err != nil {
 		return err
@@ -116,6 +152,11 @@ func (s *Server) servePacket(pc net.PacketConn) error {
 		}
 	}(packets)
 
+	idleTimeout := time.Duration(s.UDPIdleTimeout)
+	if idleTimeout <= 0 {
+		idleTimeout = UDPIdleTimeoutDefault
+	}
+
 	// udpConns tracks active packetConns by downstream address:port. They will
 	// be removed from this map after being closed.
 	udpConns := make(map[string]*packetConn)
@@ -148,10 +189,12 @@ func (s *Server) servePacket(pc net.PacketConn) error {
 				// No existing proxy handler is running for this downstream.
 				// Create one now.
 				conn = &packetConn{
-					PacketConn: pc,
-					readCh:     make(chan *packet, 5),
-					addr:       pkt.addr,
-					closeCh:    closeCh,
+					PacketConn:    pc,
+					readCh:        make(chan *packet, 5),
+					addr:          pkt.addr,
+					closeCh:       closeCh,
+					deadlineTimer: time.NewTimer(math.MaxInt64), // created upfront, so that SetReadDeadline may be called concurrently with Read
+					idleTimeout:   idleTimeout,
 				}
 				udpConns[pkt.addr.String()] = conn
 				go func(conn *packetConn) {
@@ -170,13 +213,23 @@ func (s *Server) servePacket(pc net.PacketConn) error {
 }
 
 func (s *Server) handle(conn net.Conn) {
-	defer func() { _ = conn.Close() }()
+	defer func() { _ = CloseConn(conn, (*time.Duration)(s.Linger), time.Duration(s.CloseGrace)) }()
 
 	buf := bufPool.Get().([]byte)
 	buf = buf[:0]
 	defer bufPool.Put(buf)
 
-	cx := WrapConnection(conn, buf, s.logger)
+	shutdownCtx := s.shutdownCtx
+	if shutdownCtx == nil {
+		shutdownCtx = context.Background() // not provisioned by an app
+	}
+	cx := wrapConnection(shutdownCtx, conn, buf, s.logger)
+	defer activeConns.add(cx)()
+	defer abortOnShutdown(cx)()
+	if s.activeConns != nil {
+		s.activeConns.Inc()
+		defer s.activeConns.Dec()
+	}
 
 	start := time.Now()
 	err := s.compiledRoute.Handle(cx)
@@ -197,6 +250,10 @@ func (s *Server) handle(conn net.Conn) {
 //
 //	<address:port> [<address:port>] {
 //		matching_timeout <duration>
+//		linger <duration>
+//		close_grace <duration>
+//		udp_idle_timeout <duration>
+//		disable_metrics
 //		@a <matcher> [<matcher_args>]
 //		@b {
 //			<matcher> [<matcher_args>]
@@ -221,7 +278,56 @@ func (s *Server) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		s.Listen = append(s.Listen, d.Val())
 	}
 
-	if err := ParseCaddyfileNestedRoutes(d, &s.Routes, &s.MatchingTimeout); err != nil {
+	var hasLinger, hasCloseGrace, hasUDPIdleTimeout, hasDisableMetrics bool
+	parseOption := func(optionName string) (bool, error) {
+		switch optionName {
+		case "disable_metrics":
+			if hasDisableMetrics {
+				return true, d.Errf("duplicate option '%s'", optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return true, d.ArgErr()
+			}
+			s.DisableMetrics, hasDisableMetrics = true, true
+			return true, nil
+		case "linger":
+			if hasLinger {
+				return true, d.Errf("duplicate option '%s'", optionName)
+			}
+		case "close_grace":
+			if hasCloseGrace {
+				return true, d.Errf("duplicate option '%s'", optionName)
+			}
+		case "udp_idle_timeout":
+			if hasUDPIdleTimeout {
+				return true, d.Errf("duplicate option '%s'", optionName)
+			}
+		default:
+			return false, nil
+		}
+		if d.CountRemainingArgs() != 1 {
+			return true, d.ArgErr()
+		}
+		d.NextArg()
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("parsing option '%s' duration: %v", optionName, err)
+		}
+		switch optionName {
+		case "linger":
+			s.Linger, hasLinger = (*caddy.Duration)(&dur), true
+		case "close_grace":
+			s.CloseGrace, hasCloseGrace = caddy.Duration(dur), true
+		default:
+			if dur <= 0 {
+				return true, d.Errf("parsing option '%s' duration: must be positive", optionName)
+			}
+			s.UDPIdleTimeout, hasUDPIdleTimeout = caddy.Duration(dur), true
+		}
+		return true, nil
+	}
+
+	if err := parseCaddyfileNestedRoutes(d, &s.Routes, &s.MatchingTimeout, parseOption); err != nil {
 		return err
 	}
 
@@ -255,22 +361,19 @@ type packetConn struct {
 	deadline      atomic.Int64
 	deadlineTimer *time.Timer
 	idleTimer     *time.Timer
+	idleTimeout   time.Duration
+	// stores time.Time as UnixNano as Write may be called concurrently with Read,
+	// so that sending datagrams keeps the connection from expiring too
+	lastWrite atomic.Int64
 }
 
 // SetReadDeadline sets the deadline to wait for data from the underlying net.PacketConn.
 func (pc *packetConn) SetReadDeadline(t time.Time) error {
 	pc.deadline.Store(t.Unix())
-	if pc.deadlineTimer != nil {
-		pc.deadlineTimer.Reset(time.Until(t))
-	} else {
-		pc.deadlineTimer = time.NewTimer(time.Until(t))
-	}
+	pc.deadlineTimer.Reset(time.Until(t))
 	return nil
 }
 
-// TODO: idle timeout should be configurable per server
-const udpAssociationIdleTimeout = 30 * time.Second
-
 func isDeadlineExceeded(t time.Time) bool {
 	return !t.IsZero() && t.Before(time.Now())
 }
@@ -293,9 +396,9 @@ func (pc *packetConn) Read(b []byte) (n int, err error) {
 	}
 	// set or refresh idle timeout
 	if pc.idleTimer == nil {
-		pc.idleTimer = time.NewTimer(udpAssociationIdleTimeout)
+		pc.idleTimer = time.NewTimer(pc.idleTimeout)
 	} else {
-		pc.idleTimer.Reset(udpAssociationIdleTimeout)
+		pc.idleTimer.Reset(pc.idleTimeout)
 	}
 	var done bool
 	for !done {
@@ -325,6 +428,11 @@ func (pc *packetConn) Read(b []byte) (n int, err error) {
 			}
 			// next loop will run. Don't call Read as that will reset the idle timer.
 		case <-pc.idleTimer.C:
+			// datagrams sent in the meantime, e.g. replies of upstreams, postpone the expiry
+			if idle := time.Since(time.Unix(0, pc.lastWrite.Load())); idle < pc.idleTimeout {
+				pc.idleTimer.Reset(pc.idleTimeout - idle)
+				continue
+			}
 			done = true
 		}
 	}
@@ -340,7 +448,11 @@ func (pc *packetConn) Read(b []byte) (n int, err error) {
 }
 
 func (pc *packetConn) Write(b []byte) (n int, err error) {
-	return pc.WriteTo(b, pc.addr)
+	n, err = pc.WriteTo(b, pc.addr)
+	if n > 0 {
+		pc.lastWrite.Store(time.Now().UnixNano())
+	}
+	return
 }
 
 func (pc *packetConn) Close() error {
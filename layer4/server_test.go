@@ -0,0 +1,336 @@
+package layer4
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	// the modules may have been registered by other tests already
+	if _, err := caddy.GetModule("layer4.matchers.testPrefixMatcher"); err != nil {
+		caddy.RegisterModule(&testPrefixMatcher{})
+	}
+
+	provision := func(name string, disableMetrics bool) (caddy.Context, *Server) {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		ctx.Context = context.WithValue(ctx.Context, serverNameCtxKey, name)
+
+		s := &Server{
+			Routes: RouteList{
+				&Route{
+					MatcherSetsRaw: caddyhttp.RawMatcherSets{
+						caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"SSH-"}`)},
+					},
+				},
+			},
+			DisableMetrics: disableMetrics,
+		}
+		if err := s.Provision(ctx, zap.NewNop()); err != nil {
+			t.Fatalf("provision failed | %s", err)
+		}
+		return ctx, s
+	}
+
+	ctx, s := provision("active_test", false)
+	labels := map[string]string{"server": "active_test"}
+
+	// the connection is active while its matchers wait for data
+	in, out := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handle(out)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for gatherMetric(t, ctx, "caddy_layer4_connections_active", labels) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection isn't counted as active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = in.Close()
+	<-done
+	if value := gatherMetric(t, ctx, "caddy_layer4_connections_active", labels); value != 0 {
+		t.Fatalf("unexpected number of active connections after closing | got %v, want 0", value)
+	}
+
+	// nothing is counted if metrics are disabled
+	_, s = provision("disabled_test", true)
+	if s.activeConns != nil {
+		t.Fatalf("active connections are counted despite disabled metrics")
+	}
+	if route := s.Routes[0]; route.bytesRead != nil || route.bytesWritten != nil {
+		t.Fatalf("bytes are counted despite disabled metrics")
+	}
+	if _, ok := s.Routes[0].matcherSets[0][0].(*observedMatcher); ok {
+		t.Fatalf("matchers are counted despite disabled metrics")
+	}
+}
+
+func TestServer_MatchingTimeout(t *testing.T) {
+	// the modules may have been registered by other tests already
+	if _, err := caddy.GetModule("layer4.matchers.testPrefixMatcher"); err != nil {
+		caddy.RegisterModule(&testPrefixMatcher{})
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// the app's matching timeout applies to the servers not setting their own
+	app := &App{
+		Servers: map[string]*Server{
+			"default": {},
+			"silent": {
+				Routes: RouteList{
+					&Route{
+						MatcherSetsRaw: caddyhttp.RawMatcherSets{
+							caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"SSH-"}`)},
+						},
+					},
+				},
+			},
+			"own": {MatchingTimeout: caddy.Duration(time.Second)},
+		},
+		MatchingTimeout: caddy.Duration(100 * time.Millisecond),
+	}
+	if err := app.Provision(ctx); err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+	for name, want := range map[string]time.Duration{"default": 100 * time.Millisecond, "own": time.Second} {
+		if got := time.Duration(app.Servers[name].MatchingTimeout); got != want {
+			t.Fatalf("unexpected matching timeout of server %s | got %s, want %s", name, got, want)
+		}
+	}
+
+	// a client that never sends data is closed once the matching timeout is over
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	done := make(chan struct{})
+	go func() {
+		app.Servers["silent"].handle(out)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("silent connection isn't closed after the matching timeout")
+	}
+	if _, err := in.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("unexpected read error on the client side of a closed connection | %v", err)
+	}
+}
+
+func TestRouteList_MatchingTimeoutRestart(t *testing.T) {
+	// the modules may have been registered by other tests already
+	if _, err := caddy.GetModule("layer4.matchers.testPrefixMatcher"); err != nil {
+		caddy.RegisterModule(&testPrefixMatcher{})
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	routes := RouteList{
+		&Route{}, // no matchers match all
+		&Route{
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{
+				caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"SSH-"}`)},
+			},
+		},
+	}
+	if err := routes.Provision(ctx); err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	// the first route makes the client wait, like a handler sending a server-first greeting would
+	routes[0].middleware = append(routes[0].middleware, func(next Handler) Handler {
+		return HandlerFunc(func(cx *Connection) error {
+			time.Sleep(150 * time.Millisecond)
+			return next.Handle(cx)
+		})
+	})
+
+	var matched bool
+	compiledRoutes := routes.Compile(zap.NewNop(), 200*time.Millisecond, HandlerFunc(func(cx *Connection) error {
+		matched = true
+		return nil
+	}))
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	// the client replies after the initial matching timeout, but within the restarted one
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		_, _ = in.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	}()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	if err := compiledRoutes.Handle(cx); err != nil {
+		t.Fatalf("handle failed | %s", err)
+	}
+	if !matched {
+		t.Fatalf("matching timeout isn't restarted after the handlers of a non-terminal route")
+	}
+}
+
+// used to test UDP sessions, replying to each datagram with the number of its session and its route,
+// and to PUSH datagrams 5 more times in the background, while waiting for the next datagrams
+type testSessionHandler struct{}
+
+func (*testSessionHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.testSessionHandler",
+		New: func() caddy.Module { return new(testSessionHandler) },
+	}
+}
+
+var testSessions atomic.Int32
+
+func (*testSessionHandler) Handle(cx *Connection, _ Handler) error {
+	session := testSessions.Add(1)
+	buf := make([]byte, 64)
+
+	// connections aren't safe for concurrent writes, so the background ones are serialized
+	var mu sync.Mutex
+	write := func(reply string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := cx.Write([]byte(reply))
+		return err
+	}
+
+	for {
+		n, err := cx.Read(buf)
+		if err != nil {
+			return nil
+		}
+		reply := fmt.Sprintf("%d %s %s", session, cx.MatchedRoute(), buf[:n])
+		if err = write(reply); err != nil {
+			return err
+		}
+		if strings.HasPrefix(string(buf[:n]), "PUSH") {
+			go func() {
+				for range 5 {
+					time.Sleep(100 * time.Millisecond)
+					_ = write(reply)
+				}
+			}()
+		}
+	}
+}
+
+func TestServer_UDPSessions(t *testing.T) {
+	// the modules may have been registered by other tests already
+	for _, mod := range []caddy.Module{&testPrefixMatcher{}, &testSessionHandler{}} {
+		if _, err := caddy.GetModule(string(mod.CaddyModule().ID)); err != nil {
+			caddy.RegisterModule(mod)
+		}
+	}
+	testSessions.Store(0)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s := &Server{
+		Routes: RouteList{
+			&Route{
+				MatcherSetsRaw: caddyhttp.RawMatcherSets{
+					caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"NOPE"}`)},
+				},
+			},
+			&Route{
+				MatcherSetsRaw: caddyhttp.RawMatcherSets{
+					caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"PING"}`)},
+				},
+				HandlersRaw: []json.RawMessage{json.RawMessage(`{"handler":"testSessionHandler"}`)},
+			},
+		},
+		UDPIdleTimeout: caddy.Duration(200 * time.Millisecond),
+	}
+	if err := s.Provision(ctx, zap.NewNop()); err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	defer func() { _ = pc.Close() }()
+	go func() {
+		_ = s.servePacket(pc)
+	}()
+
+	dial := func() net.Conn {
+		client, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("failed to dial | %s", err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+		return client
+	}
+	exchange := func(client net.Conn, datagram, want string) {
+		t.Helper()
+		if _, err := client.Write([]byte(datagram)); err != nil {
+			t.Fatalf("failed to write | %s", err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("failed to read reply to %q | %s", datagram, err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Fatalf("unexpected reply to %q | got %q, want %q", datagram, got, want)
+		}
+	}
+
+	// the datagrams following the first one are handled by the same session without matching them again
+	a, b := dial(), dial()
+	exchange(a, "PING", "1 1 PING")
+	exchange(a, "DATA 1", "1 1 DATA 1")
+	exchange(b, "PING", "2 1 PING")
+	exchange(a, "DATA 2", "1 1 DATA 2")
+	exchange(b, "DATA 1", "2 1 DATA 1")
+
+	// sessions expire once idle, and the next datagram is matched again
+	time.Sleep(400 * time.Millisecond)
+	exchange(a, "PING", "3 1 PING")
+	exchange(a, "DATA 3", "3 1 DATA 3")
+
+	// sending datagrams keeps sessions from expiring, even if none is received
+	exchange(a, "PUSH", "3 1 PUSH")
+	for range 5 {
+		_ = a.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := a.Read(make([]byte, 64)); err != nil || n != len("3 1 PUSH") {
+			t.Fatalf("failed to read pushed datagram | %d bytes, %v", n, err)
+		}
+	}
+	exchange(a, "DATA 4", "3 1 DATA 4")
+
+	if _, err = b.Write([]byte("DATA 2")); err != nil {
+		t.Fatalf("failed to write | %s", err)
+	}
+	_ = b.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := b.Read(make([]byte, 64)); err == nil {
+		t.Fatalf("unexpected reply to a datagram not matching after expiry | %d bytes", n)
+	}
+}
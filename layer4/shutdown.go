@@ -0,0 +1,56 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ErrShuttingDown is returned by the reads of the connections being handled by any server once Caddy is exiting,
+// including the reads which were blocked, e.g. waiting for more data to match or for the client to send more data
+// to proxy, so that handlers return promptly instead of keeping Caddy from exiting until the clients leave.
+var ErrShuttingDown = errors.New("shutting down")
+
+// newShutdownContext returns the parent of the contexts of the connections accepted by the servers of an app
+// provisioned with ctx. It's canceled once Caddy is exiting, but not on config reloads, since the connections
+// being handled outlive the config they were accepted with, as usual. Handlers may use the contexts of
+// connections to abort other blocking operations too.
+func newShutdownContext(ctx caddy.Context) (context.Context, context.CancelFunc) {
+	return context.WithCancel(context.WithoutCancel(ctx.Context))
+}
+
+// abortOnShutdown makes the reads of cx fail with ErrShuttingDown once the context of cx is canceled, including
+// a blocked read, which is interrupted by a read deadline in the past. Call the returned function once cx is handled.
+func abortOnShutdown(cx *Connection) (stop func() bool) {
+	aborted, conn := cx.aborted, cx.Conn
+	return context.AfterFunc(cx.Context, func() {
+		aborted.Store(true)
+		_ = conn.SetReadDeadline(time.Now())
+	})
+}
+
+// abortedErr returns ErrShuttingDown if the reads of a connection have been aborted by abortOnShutdown,
+// e.g. to replace the error returned by a read interrupted by the deadline set to abort it, or err otherwise.
+func abortedErr(aborted *atomic.Bool, err error) error {
+	if aborted != nil && aborted.Load() {
+		return ErrShuttingDown
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package layer4
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestConnection_AbortOnShutdown(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cx := wrapConnection(ctx, out, []byte{}, zap.NewNop())
+	defer abortOnShutdown(cx)()
+
+	// a blocked read returns promptly once the context is canceled
+	done := make(chan error, 1)
+	go func() {
+		_, err := cx.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrShuttingDown) {
+			t.Fatalf("unexpected error of an aborted read | %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("aborting a read took too long | %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("blocked read isn't aborted")
+	}
+	if cx.Context.Err() == nil {
+		t.Fatalf("the context of the connection isn't canceled")
+	}
+
+	// following reads fail as well, even if the deadline is reset, or the connection is wrapped
+	_ = cx.SetReadDeadline(time.Time{})
+	go func() { _, _ = in.Write([]byte("late")) }()
+	for i, c := range []*Connection{cx, cx.Wrap(cx.Conn)} {
+		if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrShuttingDown) {
+			t.Fatalf("test %d: unexpected error of a read after aborting | %v", i, err)
+		}
+	}
+}
+
+func TestServer_AbortOnShutdown(t *testing.T) {
+	// the modules may have been registered by other tests already
+	if _, err := caddy.GetModule("layer4.matchers.testPrefixMatcher"); err != nil {
+		caddy.RegisterModule(&testPrefixMatcher{})
+	}
+
+	ctx, cancelCtx := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancelCtx()
+
+	app := &App{
+		Servers: map[string]*Server{
+			"silent": {
+				Routes: RouteList{
+					&Route{
+						MatcherSetsRaw: caddyhttp.RawMatcherSets{
+							caddy.ModuleMap{"testPrefixMatcher": json.RawMessage(`{"prefix":"SSH-"}`)},
+						},
+					},
+				},
+				MatchingTimeout: caddy.Duration(time.Minute),
+			},
+		},
+	}
+	if err := app.Provision(ctx); err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	// a client that never sends data is waited for until the matching timeout is over
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := wrapConnection(app.Servers["silent"].shutdownCtx, out, []byte{}, zap.NewNop())
+	defer abortOnShutdown(cx)()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Servers["silent"].compiledRoute.Handle(cx)
+	}()
+
+	// stopping the app isn't enough, since connections outlive config reloads
+	time.Sleep(50 * time.Millisecond)
+	if err := app.Stop(); err != nil {
+		t.Fatalf("stop failed | %s", err)
+	}
+	if app.shutdownCtx.Err() != nil {
+		t.Fatalf("shutdown context is canceled by a config reload")
+	}
+	select {
+	case <-done:
+		t.Fatalf("matching is aborted by a config reload")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// but matching is aborted once Caddy is exiting
+	app.cancelShutdown()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error of aborted matching | %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("matching isn't aborted on shutdown")
+	}
+	if _, err := cx.Read(make([]byte, 1)); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("unexpected error of a read after aborted matching | %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4amqp allows the L4 multiplexing of AMQP connections
+package l4amqp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchAMQP{})
+	layer4.RegisterProtocol("amqp")
+}
+
+const headerSize = 8 // Size of protocol header: "AMQP" literal and 4 bytes of protocol id and version
+
+// MatchAMQP is able to match AMQP connections by their protocol header.
+// The matched version (e.g. 0-9-1) is exposed as {l4.amqp.version}.
+type MatchAMQP struct {
+	// Versions is an optional list of protocol versions to match. Supported values are
+	// 0-8, 0-9, 0-9-1, 1-0, 1-0-tls and 1-0-sasl. If empty, any of them is matched.
+	Versions []string `json:"versions,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchAMQP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.amqp",
+		New: func() caddy.Module { return new(MatchAMQP) },
+	}
+}
+
+// Match returns true if the connection starts with an AMQP protocol header.
+func (m *MatchAMQP) Match(cx *layer4.Connection) (bool, error) {
+	// Read protocol header (first 8 bytes)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for AMQP
+		}
+		return false, fmt.Errorf("reading protocol header: %w", err)
+	}
+
+	// Compare against the known headers
+	version, ok := protocolHeaders[[headerSize]byte(header)]
+	if !ok {
+		return false, nil
+	}
+	if len(m.Versions) > 0 && !slices.Contains(m.Versions, version) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.amqp.version", version)
+	cx.SetProtocol("amqp")
+
+	return true, nil
+}
+
+// Provision validates m's versions.
+func (m *MatchAMQP) Provision(_ caddy.Context) error {
+	repl := caddy.NewReplacer()
+	for i, version := range m.Versions {
+		version = repl.ReplaceAll(version, "")
+		if !isKnownVersion(version) {
+			return fmt.Errorf("unknown AMQP version '%s'", version)
+		}
+		m.Versions[i] = version
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchAMQP from Caddyfile tokens. Syntax:
+//
+//	amqp [<versions...>]
+func (m *MatchAMQP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Versions = append(m.Versions, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// isKnownVersion returns true if version is one of the values of protocolHeaders.
+func isKnownVersion(version string) bool {
+	for _, v := range protocolHeaders {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolHeaders maps the known protocol headers to their versions.
+var protocolHeaders = map[[headerSize]byte]string{
+	{'A', 'M', 'Q', 'P', 0x01, 0x01, 0x08, 0x00}: "0-8",
+	{'A', 'M', 'Q', 'P', 0x01, 0x01, 0x00, 0x09}: "0-9",
+	{'A', 'M', 'Q', 'P', 0x00, 0x00, 0x09, 0x01}: "0-9-1",
+	{'A', 'M', 'Q', 'P', 0x00, 0x01, 0x00, 0x00}: "1-0",
+	{'A', 'M', 'Q', 'P', 0x02, 0x01, 0x00, 0x00}: "1-0-tls",
+	{'A', 'M', 'Q', 'P', 0x03, 0x01, 0x00, 0x00}: "1-0-sasl",
+}
+
+// Refs:
+//
+//	https://www.rabbitmq.com/resources/specs/amqp0-9-1.pdf (section 4.2.2)
+//	https://docs.oasis-open.org/amqp/core/v1.0/os/amqp-core-transport-v1.0-os.html#section-version-negotiation
+//	https://docs.oasis-open.org/amqp/core/v1.0/os/amqp-core-security-v1.0-os.html
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchAMQP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchAMQP)(nil)
+	_ layer4.ConnMatcher    = (*MatchAMQP)(nil)
+)
@@ -0,0 +1,99 @@
+package l4amqp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchAMQP(t *testing.T) {
+	tests := []struct {
+		name      string
+		matcher   *MatchAMQP
+		input     []byte
+		wantMatch bool
+		version   string
+	}{
+		{name: "0-9-1", matcher: &MatchAMQP{}, input: []byte("AMQP\x00\x00\x09\x01"), wantMatch: true, version: "0-9-1"},
+		{name: "0-9", matcher: &MatchAMQP{}, input: []byte("AMQP\x01\x01\x00\x09"), wantMatch: true, version: "0-9"},
+		{name: "0-8", matcher: &MatchAMQP{}, input: []byte("AMQP\x01\x01\x08\x00"), wantMatch: true, version: "0-8"},
+		{name: "1-0", matcher: &MatchAMQP{}, input: []byte("AMQP\x00\x01\x00\x00"), wantMatch: true, version: "1-0"},
+		{name: "1-0-sasl", matcher: &MatchAMQP{}, input: []byte("AMQP\x03\x01\x00\x00\x00\x00\x00\x3f\x02\x01\x00\x00"), wantMatch: true, version: "1-0-sasl"},
+		{name: "0-9-1 Allowed", matcher: &MatchAMQP{Versions: []string{"0-9-1"}}, input: []byte("AMQP\x00\x00\x09\x01"), wantMatch: true, version: "0-9-1"},
+		{name: "1-0 Not Allowed", matcher: &MatchAMQP{Versions: []string{"0-9-1"}}, input: []byte("AMQP\x00\x01\x00\x00"), wantMatch: false},
+		{name: "Unknown Version", matcher: &MatchAMQP{}, input: []byte("AMQP\x00\x00\x09\x02"), wantMatch: false},
+		{name: "Truncated", matcher: &MatchAMQP{}, input: []byte("AMQP\x00\x00"), wantMatch: false},
+		{name: "Empty", matcher: &MatchAMQP{}, input: []byte{}, wantMatch: false},
+		{name: "HTTP", matcher: &MatchAMQP{}, input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "Lowercase", matcher: &MatchAMQP{}, input: []byte("amqp\x00\x00\x09\x01"), wantMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			version, _ := repl.GetString("l4.amqp.version")
+			if version != tc.version {
+				t.Fatalf("test %d: unexpected version | got %q, want %q\n", i, version, tc.version)
+			}
+		})
+	}
+}
+
+func TestMatchAMQP_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	if err := (&MatchAMQP{Versions: []string{"0-9-1", "1-0-tls"}}).Provision(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := (&MatchAMQP{Versions: []string{"0-10"}}).Provision(ctx); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4auditstore allows recording connection summaries into an embedded database
+package l4auditstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler is a connection handler that appends a summary of each connection it handles to an embedded
+// bbolt database once the connection is closed: the time it was accepted, the client's address, the server
+// and the route the handler belongs to, the number of bytes read and written, and its duration. The summaries
+// are written asynchronously in batches, so that the data path isn't slowed down. If the database can't keep
+// up, summaries are dropped. Summaries older than the retention period are pruned periodically.
+//
+// A summary is recorded once the following handlers of the route return, so the handler should precede
+// a terminal handler in the same route, e.g. proxy. Otherwise, it only covers the handlers of its route.
+//
+// Summaries are stored as JSON objects in the "connections" bucket, keyed by the time the connection was
+// accepted (8 bytes, big endian UNIX nanoseconds) followed by a sequence number (8 bytes, big endian).
+type Handler struct {
+	// Path is the path of the database file. Defaults to `layer4/audit.db` in Caddy's data directory.
+	// Handlers sharing a path share the database.
+	Path string `json:"path,omitempty"`
+
+	// Retention is how long summaries are kept. Defaults to 72h.
+	Retention caddy.Duration `json:"retention,omitempty"`
+
+	store  *store
+	server string
+	route  string
+	logger *zap.Logger
+	done   chan struct{}
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.audit_store",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+
+	repl := caddy.NewReplacer()
+	h.Path = repl.ReplaceAll(h.Path, "")
+	if len(h.Path) == 0 {
+		h.Path = filepath.Join(caddy.AppDataDir(), defaultPath)
+	}
+	h.Path = filepath.Clean(h.Path)
+
+	if h.Retention < 0 {
+		return fmt.Errorf("retention must be at least 0: %s", time.Duration(h.Retention))
+	}
+	if h.Retention == 0 {
+		h.Retention = caddy.Duration(defaultRetention)
+	}
+
+	val, _, err := stores.LoadOrNew(h.Path, func() (caddy.Destructor, error) {
+		return openStore(h.Path, h.logger)
+	})
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	h.store = val.(*store)
+
+	h.server, h.route = layer4.ServerNameFromContext(ctx), layer4.RouteLabelFromContext(ctx)
+	h.done = make(chan struct{})
+	go h.pruneLoop()
+
+	return nil
+}
+
+// Cleanup stops pruning and releases the database, which is closed
+// once no handler uses it anymore, after writing pending summaries.
+func (h *Handler) Cleanup() error {
+	if h.done != nil {
+		close(h.done)
+	}
+	if h.store != nil {
+		_, err := stores.Delete(h.Path)
+		return err
+	}
+	return nil
+}
+
+// Handle handles the connections.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	start := time.Now()
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	if wrapTime, ok := repl.Get("l4.conn.wrap_time"); ok {
+		if t, ok := wrapTime.(time.Time); ok {
+			start = t
+		}
+	}
+
+	// Count bytes passing through the underlying connection from now on,
+	// since handlers may wrap cx into connections counting them separately
+	counter := &countingConn{Conn: cx.Conn}
+	cx.Conn = counter
+	read, written := cx.BytesRead(), cx.BytesWritten()
+
+	err := next.Handle(cx)
+
+	rec := &record{
+		Time:     start.UTC(),
+		Remote:   cx.RemoteAddr().String(),
+		Server:   h.server,
+		Route:    h.route,
+		Read:     read + counter.read.Load(),
+		Written:  written + counter.written.Load(),
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	h.store.add(rec)
+
+	return err
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	audit_store [<path>] {
+//		path <path>
+//		retention <duration>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line option is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+
+	var hasPath, hasRetention bool
+	if d.NextArg() {
+		h.Path, hasPath = d.Val(), true
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "path":
+			if hasPath {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			h.Path, hasPath = d.Val(), true
+		case "retention":
+			if hasRetention {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.Retention, hasRetention = caddy.Duration(dur), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// pruneLoop prunes summaries older than h.Retention until the handler is cleaned up.
+func (h *Handler) pruneLoop() {
+	ticker := time.NewTicker(min(time.Duration(h.Retention), pruneInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			n, err := h.store.prune(now.Add(-time.Duration(h.Retention)))
+			if err != nil {
+				h.logger.Error("pruning summaries", zap.String("path", h.Path), zap.Error(err))
+			} else if n > 0 {
+				h.logger.Debug("pruned summaries", zap.String("path", h.Path), zap.Int("count", n))
+			}
+		}
+	}
+}
+
+// record is the summary of a connection.
+type record struct {
+	Time     time.Time `json:"ts"`
+	Remote   string    `json:"remote"`
+	Server   string    `json:"server,omitempty"`
+	Route    string    `json:"route,omitempty"`
+	Read     uint64    `json:"read"`
+	Written  uint64    `json:"written"`
+	Duration float64   `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// store writes summaries into a database in batches.
+type store struct {
+	db      *bolt.DB
+	logger  *zap.Logger
+	records chan *record
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// openStore opens the database at path, creating it if necessary, and starts writing summaries into it.
+func openStore(path string, logger *zap.Logger) (*store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s := &store{
+		db:      db,
+		logger:  logger,
+		records: make(chan *record, maxPendingRecords),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.writeLoop()
+	return s, nil
+}
+
+// add queues rec to be written, unless too many summaries are pending or the store is closed.
+func (s *store) add(rec *record) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	select {
+	case s.records <- rec:
+	default:
+		s.logger.Warn("dropping summary", zap.String("remote", rec.Remote), zap.String("reason", "too many pending summaries"))
+	}
+}
+
+// writeLoop writes queued summaries in batches, either once there are enough
+// of them or periodically, until the store is closed.
+func (s *store) writeLoop() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*record, 0, maxBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.write(batch); err != nil {
+			s.logger.Error("writing summaries", zap.Int("count", len(batch)), zap.Error(err))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case rec := <-s.records:
+			batch = append(batch, rec)
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.done:
+			for {
+				select {
+				case rec := <-s.records:
+					batch = append(batch, rec)
+					if len(batch) >= maxBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write appends batch to the database in a single transaction.
+func (s *store) write(batch []*record) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, rec := range batch {
+			val, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err = b.Put(recordKey(rec.Time, seq), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// prune deletes summaries of connections accepted before cutoff and returns their number.
+func (s *store) prune(cutoff time.Time) (int, error) {
+	var n int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		end := recordKey(cutoff, 0)
+
+		// Collect the keys first, since deleting while iterating may skip keys
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// Destruct writes pending summaries and closes the database.
+func (s *store) Destruct() error {
+	s.once.Do(func() { close(s.done) })
+	<-s.stopped
+	return s.db.Close()
+}
+
+// recordKey returns the key of a summary of a connection accepted at t, which sorts chronologically.
+func recordKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(max(t.UnixNano(), 0))) //nolint:gosec // disable G115
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// countingConn counts bytes read from and written to the underlying connection.
+type countingConn struct {
+	net.Conn
+	read, written atomic.Uint64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n)) //nolint:gosec // disable G115
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n)) //nolint:gosec // disable G115
+	return n, err
+}
+
+// stores is the global repository of databases that are currently in use
+// by active configuration(s), so that handlers sharing a path share the
+// database, which stays open through config reloads.
+var stores = caddy.NewUsagePool()
+
+var bucketName = []byte("connections")
+
+const (
+	defaultPath      = "layer4/audit.db"
+	defaultRetention = 72 * time.Hour
+
+	flushInterval     = time.Second
+	maxBatchSize      = 128
+	maxPendingRecords = 4096
+	openTimeout       = 5 * time.Second
+	pruneInterval     = time.Minute
+)
+
+// Interface guards
+var (
+	_ caddy.CleanerUpper    = (*Handler)(nil)
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
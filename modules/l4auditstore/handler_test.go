@@ -0,0 +1,182 @@
+package l4auditstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// testHandler is a terminal connection handler that reads a 5-byte request and writes a 6-byte response.
+type testHandler struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*testHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.test_handler",
+		New: func() caddy.Module { return new(testHandler) },
+	}
+}
+
+// Handle handles the connections.
+func (h *testHandler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return err
+	}
+	_, err := cx.Write([]byte("world!"))
+	return err
+}
+
+func init() {
+	caddy.RegisterModule(&testHandler{})
+}
+
+// readRecords returns all summaries stored in the database at path, in the order of their keys.
+func readRecords(t *testing.T, path string) []*record {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	assertNoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	var records []*record
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).ForEach(func(_, v []byte) error {
+			rec := &record{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	assertNoError(t, err)
+	return records
+}
+
+func TestHandler_Handle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.db")
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	routes := layer4.RouteList{
+		&layer4.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{{"not": json.RawMessage(`[{}]`)}},
+		},
+		&layer4.Route{
+			HandlersRaw: []json.RawMessage{
+				json.RawMessage(`{"handler":"audit_store","path":"` + path + `","retention":"1h"}`),
+				json.RawMessage(`{"handler":"test_handler"}`),
+			},
+		},
+	}
+	err := routes.Provision(ctx)
+	assertNoError(t, err)
+
+	compiledRoute := routes.Compile(zap.NewNop(), 100*time.Millisecond, layer4.HandlerFunc(func(*layer4.Connection) error {
+		return nil
+	}))
+
+	start := time.Now()
+	for _, request := range []string{"hello", "hi"} {
+		in, out := net.Pipe()
+		cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+		go func() {
+			_, _ = in.Write([]byte(request))
+			_, _ = io.Copy(io.Discard, in)
+		}()
+		go func() {
+			// the second request is too short for the test handler
+			time.Sleep(50 * time.Millisecond)
+			_ = in.Close()
+		}()
+
+		err = compiledRoute.Handle(cx)
+		_ = cx.Close()
+		if request == "hello" {
+			assertNoError(t, err)
+		}
+	}
+
+	// pending summaries are written once the database is released
+	cancel()
+
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("unexpected number of summaries | got %d, want %d\n", len(records), 2)
+	}
+	for i, want := range []record{
+		{Remote: "pipe", Route: "1", Read: 5, Written: 6},
+		{Remote: "pipe", Route: "1", Read: 2, Written: 0, Error: "unexpected EOF"},
+	} {
+		rec := records[i]
+		if rec.Remote != want.Remote || rec.Route != want.Route || rec.Read != want.Read ||
+			rec.Written != want.Written || rec.Error != want.Error {
+			t.Fatalf("test %d: unexpected summary | got %+v, want %+v\n", i, rec, want)
+		}
+		if rec.Time.Before(start.Add(-time.Second)) || rec.Time.After(time.Now()) || rec.Duration <= 0 {
+			t.Fatalf("test %d: unexpected summary time | got %s and %fs\n", i, rec.Time, rec.Duration)
+		}
+	}
+}
+
+func TestStore_Prune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.db")
+
+	s, err := openStore(path, zap.NewNop())
+	assertNoError(t, err)
+
+	now := time.Now()
+	err = s.write([]*record{
+		{Time: now.Add(-100 * time.Hour), Remote: "192.0.2.1:1000"},
+		{Time: now.Add(-73 * time.Hour), Remote: "192.0.2.1:1001"},
+		{Time: now.Add(-71 * time.Hour), Remote: "192.0.2.1:1002"},
+		{Time: now.Add(-time.Minute), Remote: "192.0.2.1:1003"},
+	})
+	assertNoError(t, err)
+
+	n, err := s.prune(now.Add(-72 * time.Hour))
+	assertNoError(t, err)
+	if n != 2 {
+		t.Fatalf("unexpected number of pruned summaries | got %d, want %d\n", n, 2)
+	}
+
+	n, err = s.prune(now.Add(-72 * time.Hour))
+	assertNoError(t, err)
+	if n != 0 {
+		t.Fatalf("unexpected number of pruned summaries | got %d, want %d\n", n, 0)
+	}
+
+	err = s.Destruct()
+	assertNoError(t, err)
+
+	records := readRecords(t, path)
+	if len(records) != 2 || records[0].Remote != "192.0.2.1:1002" || records[1].Remote != "192.0.2.1:1003" {
+		t.Fatalf("unexpected summaries after pruning | %+v\n", records)
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{Path: filepath.Join(t.TempDir(), "audit.db"), Retention: -1}
+	if err := h.Provision(ctx); err == nil {
+		t.Fatalf("negative retention should not be accepted")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4beanstalkd allows the L4 multiplexing of Beanstalkd connections
+package l4beanstalkd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchBeanstalkd{})
+	layer4.RegisterProtocol("beanstalkd")
+}
+
+const maxLineLength = 224 // Maximum length of a command line accepted by beanstalkd, including the line ending
+
+// commands contains all the commands of the protocol.
+var commands = []string{
+	"bury", "delete", "ignore", "kick", "kick-job", "list-tube-used", "list-tubes", "list-tubes-watched",
+	"pause-tube", "peek", "peek-buried", "peek-delayed", "peek-ready", "put", "quit", "release", "reserve",
+	"reserve-job", "reserve-with-timeout", "stats", "stats-job", "stats-tube", "touch", "use", "watch",
+}
+
+// MatchBeanstalkd is able to match Beanstalkd connections by their first command, e.g. put or reserve,
+// which must be terminated by CRLF. The command is exposed as {l4.beanstalkd.command}.
+type MatchBeanstalkd struct {
+	// Commands is an optional list of commands to match, e.g. put or reserve.
+	// Any known command is matched if empty.
+	Commands []string `json:"commands,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchBeanstalkd) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.beanstalkd",
+		New: func() caddy.Module { return new(MatchBeanstalkd) },
+	}
+}
+
+// Match returns true if the connection starts with a Beanstalkd command.
+func (m *MatchBeanstalkd) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, maxLineLength), maxLineLength)
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return false, nil // Not enough data for a command line, or a line too long
+		}
+		return false, fmt.Errorf("reading command line: %w", err)
+	}
+
+	line, found := bytes.CutSuffix(line, []byte("\r\n"))
+	if !found {
+		return false, nil
+	}
+	for _, c := range line {
+		if c < 0x20 || c > 0x7E {
+			return false, nil
+		}
+	}
+
+	// Commands are followed by space-separated arguments, if any
+	command, _, _ := bytes.Cut(line, []byte(" "))
+	if !slices.Contains(commands, string(command)) || len(m.Commands) > 0 && !slices.Contains(m.Commands, string(command)) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.beanstalkd.command", string(command))
+	cx.SetProtocol("beanstalkd")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchBeanstalkd) Provision(_ caddy.Context) error {
+	for _, command := range m.Commands {
+		if !slices.Contains(commands, command) {
+			return fmt.Errorf("unsupported command %s", command)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchBeanstalkd from Caddyfile tokens. Syntax:
+//
+//	beanstalkd [<commands...>]
+func (m *MatchBeanstalkd) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Commands = append(m.Commands, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://github.com/beanstalkd/beanstalkd/blob/master/doc/protocol.txt
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchBeanstalkd)(nil)
+	_ caddyfile.Unmarshaler = (*MatchBeanstalkd)(nil)
+	_ layer4.ConnMatcher    = (*MatchBeanstalkd)(nil)
+)
@@ -0,0 +1,103 @@
+package l4beanstalkd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+var put = []byte("put 0 0 120 5\r\nhello\r\n")
+
+func Test_MatchBeanstalkd_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchBeanstalkd
+		data        []byte
+		shouldMatch bool
+		command     string
+	}
+
+	tests := []test{
+		{matcher: &MatchBeanstalkd{}, data: put, shouldMatch: true, command: "put"},
+		{matcher: &MatchBeanstalkd{}, data: []byte("reserve\r\n"), shouldMatch: true, command: "reserve"},
+		{matcher: &MatchBeanstalkd{}, data: []byte("reserve-with-timeout 5\r\n"), shouldMatch: true, command: "reserve-with-timeout"},
+		{matcher: &MatchBeanstalkd{}, data: []byte("use emails\r\nput 0 0 60 2\r\nhi\r\n"), shouldMatch: true, command: "use"},
+		{matcher: &MatchBeanstalkd{Commands: []string{"put"}}, data: put, shouldMatch: true, command: "put"},
+		{matcher: &MatchBeanstalkd{Commands: []string{"reserve", "watch"}}, data: put, shouldMatch: false},
+
+		// the command line must be complete and terminated by CRLF
+		{matcher: &MatchBeanstalkd{}, data: put[:13], shouldMatch: false},
+		{matcher: &MatchBeanstalkd{}, data: []byte("reserve\n"), shouldMatch: false},
+		{matcher: &MatchBeanstalkd{}, data: []byte("put 0 0 120 5\x00\r\n"), shouldMatch: false},
+		{matcher: &MatchBeanstalkd{}, data: append([]byte("use "), append(make([]byte, maxLineLength), '\r', '\n')...), shouldMatch: false},
+
+		// unrelated bytes aren't matched
+		{matcher: &MatchBeanstalkd{}, data: []byte("PUT 0 0 120 5\r\n"), shouldMatch: false},
+		{matcher: &MatchBeanstalkd{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchBeanstalkd{}, data: []byte("set key 0 0 5\r\nhello\r\n"), shouldMatch: false},
+		{matcher: &MatchBeanstalkd{}, data: []byte("\x00REQ\x00\x00\x00\x07\x00\x00\x00\x00"), shouldMatch: false},
+		{matcher: &MatchBeanstalkd{}, data: []byte{}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if got, _ := repl.GetString("l4.beanstalkd.command"); got != tc.command {
+				t.Fatalf("test %d: unexpected command | got %q, want %q\n", i, got, tc.command)
+			}
+		}()
+	}
+}
+
+func Test_MatchBeanstalkd_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchBeanstalkd{Commands: []string{"get"}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported command should not be accepted")
+	}
+}
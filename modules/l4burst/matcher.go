@@ -0,0 +1,196 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4burst allows the L4 multiplexing of connections by how fast clients send their first data
+package l4burst
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchBurst{})
+}
+
+// MatchBurst is able to match connections by the time it takes clients to send their initial burst of data,
+// i.e. a number of bytes or a line, counting from the moment the connection is accepted. It's a behavioral
+// signal: automated clients usually send their handshakes at once, while interactive ones may trickle them.
+// The time is measured when the data is prefetched, so it doesn't depend on how many matchers run before.
+// The time the burst has taken is exposed as {l4.burst.duration}.
+//
+// Note: the whole burst must be received within the matching timeout of the server, so that slower thresholds
+// shouldn't exceed it.
+type MatchBurst struct {
+	// Bytes is the number of bytes making up the burst. It may not exceed layer4.MaxMatchingBytes.
+	Bytes int `json:"bytes,omitempty"`
+
+	// Line makes the burst end with the first line feed instead, e.g. for text protocols.
+	Line bool `json:"line,omitempty"`
+
+	// Faster makes the matcher match if the burst has taken less than this duration.
+	Faster caddy.Duration `json:"faster,omitempty"`
+
+	// Slower makes the matcher match if the burst has taken this duration or more.
+	// If both Faster and Slower are set, the burst must take between Slower and Faster.
+	Slower caddy.Duration `json:"slower,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchBurst) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.burst",
+		New: func() caddy.Module { return new(MatchBurst) },
+	}
+}
+
+// Match returns true if the connection has sent its initial burst within the configured times.
+func (m *MatchBurst) Match(cx *layer4.Connection) (bool, error) {
+	data := cx.MatchingBytes()
+
+	// Find the end of the burst
+	size := m.Bytes
+	if m.Line {
+		size = bytes.IndexByte(data, '\n') + 1
+		if size == 0 {
+			if len(data) >= layer4.MaxMatchingBytes {
+				return false, nil // The line is too long
+			}
+			return false, layer4.ErrConsumedAllPrefetchedBytes
+		}
+	}
+	at, ok := cx.PrefetchedAt(size)
+	if !ok {
+		return false, layer4.ErrConsumedAllPrefetchedBytes
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	start, ok := repl.Get(timeKey)
+	if !ok {
+		return false, nil
+	}
+	elapsed := at.Sub(start.(time.Time))
+	repl.Set("l4.burst.duration", elapsed)
+
+	if m.Faster > 0 && elapsed >= time.Duration(m.Faster) || m.Slower > 0 && elapsed < time.Duration(m.Slower) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchBurst) Provision(_ caddy.Context) error {
+	if m.Line == (m.Bytes > 0) {
+		return fmt.Errorf("either bytes or line must be set")
+	}
+	if m.Bytes < 0 || m.Bytes > layer4.MaxMatchingBytes {
+		return fmt.Errorf("bytes must be between 1 and %d", layer4.MaxMatchingBytes)
+	}
+	if m.Faster < 0 || m.Slower < 0 {
+		return fmt.Errorf("durations must be at least 0")
+	}
+	if m.Faster == 0 && m.Slower == 0 {
+		return fmt.Errorf("either faster or slower must be set")
+	}
+	if m.Faster > 0 && m.Slower >= m.Faster {
+		return fmt.Errorf("slower must be less than faster")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchBurst from Caddyfile tokens. Syntax:
+//
+//	burst {
+//		bytes <n> | line
+//		faster <duration>
+//		slower <duration>
+//	}
+func (m *MatchBurst) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasBytes, hasLine, hasFaster, hasSlower bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "bytes":
+			if hasBytes || hasLine {
+				return d.Errf("duplicate %s option '%s': only one of 'bytes' and 'line' may be set", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 16)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.Bytes, hasBytes = int(val), true
+		case "line":
+			if hasBytes || hasLine {
+				return d.Errf("duplicate %s option '%s': only one of 'bytes' and 'line' may be set", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			m.Line, hasLine = true, true
+		case "faster", "slower":
+			if optionName == "faster" && hasFaster || optionName == "slower" && hasSlower {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			if optionName == "faster" {
+				m.Faster, hasFaster = caddy.Duration(dur), true
+			} else {
+				m.Slower, hasSlower = caddy.Duration(dur), true
+			}
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+const timeKey = "l4.conn.wrap_time"
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchBurst)(nil)
+	_ caddyfile.Unmarshaler = (*MatchBurst)(nil)
+	_ layer4.ConnMatcher    = (*MatchBurst)(nil)
+)
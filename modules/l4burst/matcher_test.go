@@ -0,0 +1,151 @@
+package l4burst
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// testHandler is a connection handler that will set a variable to let us know it was called.
+type testHandler struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*testHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.test_handler",
+		New: func() caddy.Module { return new(testHandler) },
+	}
+}
+
+// Handle handles the connections.
+func (h *testHandler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	cx.SetVar("test_handler_called", true)
+	return next.Handle(cx)
+}
+
+func init() {
+	caddy.RegisterModule(&testHandler{})
+}
+
+// burstMatchTester runs segments through a route with the burst matcher and returns whether it matched
+// along with the value of the duration placeholder. Each segment is written after the given delay.
+func burstMatchTester(t *testing.T, config string, delay time.Duration, segments ...[]byte) (bool, time.Duration) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	go func() {
+		for _, segment := range segments {
+			time.Sleep(delay)
+			if _, err := in.Write(segment); err != nil {
+				return // the connection has been closed once matched or not
+			}
+		}
+	}()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	routes := layer4.RouteList{&layer4.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{
+			{"burst": json.RawMessage(config)},
+		},
+		HandlersRaw: []json.RawMessage{json.RawMessage("{\"handler\":\"test_handler\"}")},
+	}}
+	err := routes.Provision(ctx)
+	assertNoError(t, err)
+
+	matched, duration := false, time.Duration(0)
+	compiledRoute := routes.Compile(zap.NewNop(), time.Second,
+		layer4.HandlerFunc(func(con *layer4.Connection) error {
+			repl := con.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			matched = con.GetVar("test_handler_called") != nil
+			if val, ok := repl.Get("l4.burst.duration"); ok {
+				duration = val.(time.Duration)
+			}
+			return nil
+		}))
+
+	err = compiledRoute.Handle(cx)
+	assertNoError(t, err)
+
+	return matched, duration
+}
+
+func TestMatchBurst(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	trickled := [][]byte{request[:5], request[5:10], request[10:16], request[16:]}
+
+	for _, tc := range []struct {
+		name        string
+		config      string
+		delay       time.Duration
+		segments    [][]byte
+		shouldMatch bool
+		minDuration time.Duration
+	}{
+		{name: "instant-line-faster", config: `{"line":true,"faster":"100ms"}`, segments: [][]byte{request}, shouldMatch: true},
+		{name: "instant-line-slower", config: `{"line":true,"slower":"100ms"}`, segments: [][]byte{request}, shouldMatch: false},
+		{name: "instant-bytes-faster", config: `{"bytes":16,"faster":"100ms"}`, segments: [][]byte{request}, shouldMatch: true},
+		{name: "trickled-line-faster", config: `{"line":true,"faster":"100ms"}`, delay: 50 * time.Millisecond, segments: trickled,
+			shouldMatch: false, minDuration: 150 * time.Millisecond},
+		{name: "trickled-line-slower", config: `{"line":true,"slower":"100ms"}`, delay: 50 * time.Millisecond, segments: trickled,
+			shouldMatch: true, minDuration: 150 * time.Millisecond},
+		{name: "trickled-bytes-between", config: `{"bytes":10,"slower":"50ms","faster":"500ms"}`, delay: 50 * time.Millisecond, segments: trickled,
+			shouldMatch: true, minDuration: 100 * time.Millisecond},
+		// the burst is complete before the rest of the data has been trickled
+		{name: "trickled-bytes-first-segment", config: `{"bytes":5,"faster":"200ms"}`, delay: 50 * time.Millisecond, segments: trickled,
+			shouldMatch: true, minDuration: 50 * time.Millisecond},
+		// the burst is never completed within the matching timeout
+		{name: "incomplete-line", config: `{"line":true,"slower":"10ms"}`, segments: [][]byte{request[:10]}, shouldMatch: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			matched, duration := burstMatchTester(t, tc.config, tc.delay, tc.segments...)
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("matcher did not match | duration %s", duration)
+				} else {
+					t.Fatalf("matcher should not match | duration %s", duration)
+				}
+			}
+			if duration < tc.minDuration {
+				t.Fatalf("unexpected duration | got %s, want at least %s", duration, tc.minDuration)
+			}
+		})
+	}
+}
+
+func TestMatchBurst_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, m := range []*MatchBurst{
+		{Faster: caddy.Duration(time.Second)},
+		{Bytes: 10, Line: true, Faster: caddy.Duration(time.Second)},
+		{Bytes: layer4.MaxMatchingBytes + 1, Faster: caddy.Duration(time.Second)},
+		{Line: true},
+		{Line: true, Faster: caddy.Duration(time.Second), Slower: caddy.Duration(2 * time.Second)},
+		{Line: true, Slower: caddy.Duration(-time.Second)},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("invalid config should not be accepted | %+v", m)
+		}
+	}
+}
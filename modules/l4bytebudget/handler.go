@@ -0,0 +1,201 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4bytebudget allows closing L4 connections which transfer too many bytes
+package l4bytebudget
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// ErrBudgetExceeded is returned by reads and writes of connections once their byte budget is exceeded.
+var ErrBudgetExceeded = errors.New("byte budget exceeded")
+
+// Handler closes connections once more bytes than their budget have been read from them, or written
+// to them, e.g. to guard anonymous ports against abuse. The bytes read and written before, including
+// those read while matching, count towards the budgets. A connection may transfer exactly as many bytes
+// as its budget: the read or write exceeding it is cut at the boundary, the connection is closed, and
+// ErrBudgetExceeded is returned. It wraps the connection, so it should come before the handlers using
+// the connection, e.g. proxy, in a route.
+type Handler struct {
+	// The maximum number of bytes to read from the connection. 0 means unlimited.
+	MaxBytesIn int64 `json:"max_bytes_in,omitempty"`
+
+	// The maximum number of bytes to write to the connection. 0 means unlimited.
+	MaxBytesOut int64 `json:"max_bytes_out,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.byte_budget",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	if h.MaxBytesIn < 0 {
+		return fmt.Errorf("max bytes in must be at least 0: %d", h.MaxBytesIn)
+	}
+	if h.MaxBytesOut < 0 {
+		return fmt.Errorf("max bytes out must be at least 0: %d", h.MaxBytesOut)
+	}
+	if h.MaxBytesIn == 0 && h.MaxBytesOut == 0 {
+		return fmt.Errorf("no budget is set")
+	}
+	return nil
+}
+
+// Handle handles the connection.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	return next.Handle(cx.Wrap(&budgetConn{
+		Conn:     cx.Conn,
+		logger:   h.logger.Named("conn"),
+		maxIn:    h.MaxBytesIn,
+		maxOut:   h.MaxBytesOut,
+		bytesIn:  int64(cx.BytesRead()),    //nolint:gosec // disable G115
+		bytesOut: int64(cx.BytesWritten()), //nolint:gosec // disable G115
+	}))
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	byte_budget {
+//		max_bytes_in <bytes>
+//		max_bytes_out <bytes>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasMaxBytesIn, hasMaxBytesOut bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		var (
+			dst *int64
+			has *bool
+		)
+		switch optionName {
+		case "max_bytes_in":
+			dst, has = &h.MaxBytesIn, &hasMaxBytesIn
+		case "max_bytes_out":
+			dst, has = &h.MaxBytesOut, &hasMaxBytesOut
+		default:
+			return d.ArgErr()
+		}
+		if *has {
+			return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+		}
+		if d.CountRemainingArgs() != 1 {
+			return d.ArgErr()
+		}
+		d.NextArg() // consume option value
+		val, err := strconv.ParseInt(d.Val(), 10, 64)
+		if err != nil {
+			return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+		}
+		*dst, *has = val, true
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// budgetConn tallies the bytes read from and written to the connection,
+// and closes the connection once one of the budgets is exceeded.
+type budgetConn struct {
+	net.Conn
+	logger            *zap.Logger
+	maxIn, maxOut     int64
+	bytesIn, bytesOut int64
+	closeOnce         sync.Once
+}
+
+// Read reads from the connection. If the bytes read exceed the budget,
+// only those within the budget are returned along with ErrBudgetExceeded.
+func (bc *budgetConn) Read(p []byte) (int, error) {
+	if bc.maxIn > 0 && bc.bytesIn >= bc.maxIn {
+		// the budget may be spent with the last bytes of the connection, so try to read one more
+		p = p[:min(len(p), 1)]
+	}
+	n, err := bc.Conn.Read(p)
+	bc.bytesIn += int64(n)
+	if bc.maxIn > 0 && bc.bytesIn > bc.maxIn {
+		n -= int(min(bc.bytesIn-bc.maxIn, int64(n)))
+		bc.closeExceeded("in", bc.maxIn)
+		return n, ErrBudgetExceeded
+	}
+	return n, err
+}
+
+// Write writes to the connection. If p exceeds the budget,
+// only the bytes within the budget are written, and ErrBudgetExceeded is returned.
+func (bc *budgetConn) Write(p []byte) (int, error) {
+	var exceeded bool
+	if bc.maxOut > 0 && bc.bytesOut+int64(len(p)) > bc.maxOut {
+		p, exceeded = p[:max(bc.maxOut-bc.bytesOut, 0)], true
+	}
+	n, err := bc.Conn.Write(p)
+	bc.bytesOut += int64(n)
+	if exceeded && err == nil {
+		bc.closeExceeded("out", bc.maxOut)
+		return n, ErrBudgetExceeded
+	}
+	return n, err
+}
+
+// closeExceeded closes the connection once, after its budget of limit bytes has been exceeded in direction.
+func (bc *budgetConn) closeExceeded(direction string, limit int64) {
+	bc.closeOnce.Do(func() {
+		bc.logger.Info("closing connection exceeding byte budget",
+			zap.String("remote", bc.RemoteAddr().String()),
+			zap.String("direction", direction),
+			zap.Int64("max_bytes", limit),
+		)
+		_ = bc.Conn.Close()
+	})
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
@@ -0,0 +1,143 @@
+package l4bytebudget
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// handle passes a connection wrapping out to h, with a next handler calling fn.
+func handle(t *testing.T, h *Handler, out net.Conn, fn func(cx *layer4.Connection) error) error {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	err := h.Provision(ctx)
+	assertNoError(t, err)
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	return h.Handle(cx, layer4.HandlerFunc(fn))
+}
+
+// assertClosed asserts that the peer of in has been closed, i.e. in reads io.EOF without blocking.
+func assertClosed(t *testing.T, in net.Conn) {
+	t.Helper()
+	_ = in.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := in.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("connection should be closed, got: %v", err)
+	}
+}
+
+func TestHandler_MaxBytesIn(t *testing.T) {
+	for i, tc := range []struct {
+		sent    []string
+		read    string
+		wantErr error
+	}{
+		{sent: []string{"0123456789"}, read: "01234", wantErr: ErrBudgetExceeded},
+		{sent: []string{"012", "34", "5"}, read: "01234", wantErr: ErrBudgetExceeded},
+		{sent: []string{"01234"}, read: "01234"}, // exactly the budget
+		{sent: []string{"012"}, read: "012"},
+	} {
+		func() {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+
+			// the client only hangs up within the budget, so that closing the connection is left to the handler otherwise
+			go func() {
+				for _, s := range tc.sent {
+					if _, err := in.Write([]byte(s)); err != nil {
+						return
+					}
+				}
+				if tc.wantErr == nil {
+					_ = in.Close()
+				}
+			}()
+
+			var read []byte
+			err := handle(t, &Handler{MaxBytesIn: 5}, out, func(cx *layer4.Connection) error {
+				var err error
+				read, err = io.ReadAll(cx)
+				return err
+			})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("test %d: unexpected error | got %v, want %v", i, err, tc.wantErr)
+			}
+			if string(read) != tc.read {
+				t.Fatalf("test %d: unexpected bytes read | got %q, want %q", i, read, tc.read)
+			}
+			if tc.wantErr != nil {
+				assertClosed(t, in)
+			}
+		}()
+	}
+}
+
+func TestHandler_MaxBytesOut(t *testing.T) {
+	for i, tc := range []struct {
+		written []string
+		got     string
+		wantErr error
+	}{
+		{written: []string{"hello world"}, got: "hello", wantErr: ErrBudgetExceeded},
+		{written: []string{"hel", "lo", "!"}, got: "hello", wantErr: ErrBudgetExceeded},
+		{written: []string{"hello"}, got: "hello"}, // exactly the budget
+	} {
+		func() {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+
+			got := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(in)
+				got <- b
+			}()
+
+			err := handle(t, &Handler{MaxBytesOut: 5}, out, func(cx *layer4.Connection) error {
+				for _, s := range tc.written {
+					if _, err := cx.Write([]byte(s)); err != nil {
+						return err
+					}
+				}
+				return cx.Close()
+			})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("test %d: unexpected error | got %v, want %v", i, err, tc.wantErr)
+			}
+			if b := <-got; string(b) != tc.got {
+				t.Fatalf("test %d: unexpected bytes written | got %q, want %q", i, b, tc.got)
+			}
+		}()
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*Handler{
+		{},
+		{MaxBytesIn: -1},
+		{MaxBytesOut: -1},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("test %d: handler should not be provisioned | %+v", i, h)
+		}
+	}
+}
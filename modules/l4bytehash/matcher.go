@@ -0,0 +1,150 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4bytehash allows the L4 multiplexing of connections by a hash of their first bytes
+package l4bytehash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchByteHash{})
+}
+
+// MatchByteHash is able to match connections which first bytes have a known SHA-256 hash.
+// It's a strict integrity gate for closed ecosystems, e.g. to allow only a specific
+// application's handshake, since any difference in the first bytes is rejected.
+type MatchByteHash struct {
+	// Bytes is the number of first bytes to hash. It must be positive and may not exceed layer4.MaxMatchingBytes.
+	Bytes uint16 `json:"bytes,omitempty"`
+	// Allow is a list of hex-encoded SHA-256 hashes of the first Bytes bytes to match.
+	Allow []string `json:"allow,omitempty"`
+
+	allowed map[[sha256.Size]byte]struct{}
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchByteHash) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.byte_hash",
+		New: func() caddy.Module { return new(MatchByteHash) },
+	}
+}
+
+// Match returns true if the hash of the connection's first bytes is allowed.
+func (m *MatchByteHash) Match(cx *layer4.Connection) (bool, error) {
+	// Read a number of bytes
+	buf := make([]byte, m.Bytes)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return false, err
+	}
+
+	// Match the hash of these bytes against the allowed ones
+	_, ok := m.allowed[sha256.Sum256(buf)]
+	return ok, nil
+}
+
+// Provision parses m's hashes.
+func (m *MatchByteHash) Provision(_ caddy.Context) error {
+	if m.Bytes == 0 || int(m.Bytes) > layer4.MaxMatchingBytes {
+		return fmt.Errorf("bytes must be in range 1-%d", layer4.MaxMatchingBytes)
+	}
+	if len(m.Allow) == 0 {
+		return fmt.Errorf("no hashes to allow")
+	}
+
+	repl := caddy.NewReplacer()
+	m.allowed = make(map[[sha256.Size]byte]struct{}, len(m.Allow))
+	for _, s := range m.Allow {
+		s = strings.ToLower(repl.ReplaceAll(s, ""))
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("invalid hash '%s': %v", s, err)
+		}
+		if len(b) != sha256.Size {
+			return fmt.Errorf("invalid hash '%s': expected %d bytes, got %d", s, sha256.Size, len(b))
+		}
+		m.allowed[[sha256.Size]byte(b)] = struct{}{}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchByteHash from Caddyfile tokens. Syntax:
+//
+//	byte_hash {
+//		bytes <n>
+//		allow <hex> [<hex>...]
+//	}
+//
+// Note: multiple 'allow' options are allowed.
+func (m *MatchByteHash) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasBytes bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "bytes":
+			if hasBytes {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 16)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.Bytes, hasBytes = uint16(val), true
+		case "allow":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.Allow = append(m.Allow, d.RemainingArgs()...)
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchByteHash)(nil)
+	_ caddyfile.Unmarshaler = (*MatchByteHash)(nil)
+	_ layer4.ConnMatcher    = (*MatchByteHash)(nil)
+)
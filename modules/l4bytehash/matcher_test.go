@@ -0,0 +1,110 @@
+package l4bytehash
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func hashOf(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func Test_MatchByteHash_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchByteHash
+		data        []byte
+		shouldMatch bool
+	}
+
+	handshake := []byte("APPv1\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0fHELLO")
+	other := []byte("APPv2\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0fHELLO")
+
+	tests := []test{
+		{matcher: &MatchByteHash{Bytes: 16, Allow: []string{hashOf(handshake[:16])}}, data: handshake, shouldMatch: true},
+		{matcher: &MatchByteHash{Bytes: 16, Allow: []string{strings.ToUpper(hashOf(handshake[:16]))}}, data: handshake, shouldMatch: true},
+		{matcher: &MatchByteHash{Bytes: 16, Allow: []string{hashOf(other[:16]), hashOf(handshake[:16])}}, data: handshake, shouldMatch: true},
+		{matcher: &MatchByteHash{Bytes: uint16(len(handshake)), Allow: []string{hashOf(handshake)}}, data: handshake, shouldMatch: true},
+		{matcher: &MatchByteHash{Bytes: 16, Allow: []string{hashOf(handshake[:16])}}, data: other, shouldMatch: false},
+		{matcher: &MatchByteHash{Bytes: 16, Allow: []string{hashOf(handshake[:15])}}, data: handshake, shouldMatch: false},
+		{matcher: &MatchByteHash{Bytes: 16, Allow: []string{hashOf(handshake[:16])}}, data: handshake[:15], shouldMatch: false},
+		{matcher: &MatchByteHash{Bytes: 16, Allow: []string{hashOf(handshake[:16])}}, data: []byte("GET / HTTP/1.1\r\n\r\n"), shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+		}()
+	}
+}
+
+func Test_MatchByteHash_Provision(t *testing.T) {
+	valid := hashOf([]byte("test"))
+	tests := []struct {
+		matcher *MatchByteHash
+		wantErr bool
+	}{
+		{matcher: &MatchByteHash{Bytes: 64, Allow: []string{valid}}, wantErr: false},
+		{matcher: &MatchByteHash{Bytes: 0, Allow: []string{valid}}, wantErr: true},
+		{matcher: &MatchByteHash{Bytes: layer4.MaxMatchingBytes + 1, Allow: []string{valid}}, wantErr: true},
+		{matcher: &MatchByteHash{Bytes: 64}, wantErr: true},
+		{matcher: &MatchByteHash{Bytes: 64, Allow: []string{"not hex"}}, wantErr: true},
+		{matcher: &MatchByteHash{Bytes: 64, Allow: []string{valid[:62]}}, wantErr: true},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		err := tc.matcher.Provision(ctx)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("test %d: unexpected error | %v\n", i, err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4coap allows the L4 multiplexing of CoAP connections
+package l4coap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchCoAP{})
+	layer4.RegisterProtocol("coap")
+}
+
+const (
+	headerLength   = 4    // Size of the fixed header of CoAP messages (bytes)
+	maxTokenLength = 8    // Maximum length of tokens, longer ones are reserved (bytes)
+	payloadMarker  = 0xFF // Byte separating the options from the payload
+
+	version = 1 // The only CoAP version defined
+)
+
+// types contains the names of the message types, indexed by their values.
+var types = []string{"CON", "NON", "ACK", "RST"}
+
+// methods contains the names of the request methods defined by RFC 7252 and RFC 8132, indexed by their code details.
+var methods = []string{"", "GET", "POST", "PUT", "DELETE", "FETCH", "PATCH", "iPATCH"}
+
+// responses contains the codes of the responses registered by RFC 7252, RFC 7959, RFC 8132 and RFC 8516, by class.
+var responses = map[byte][]byte{
+	2: {1, 2, 3, 4, 5, 31},
+	4: {0, 1, 2, 3, 4, 5, 6, 8, 9, 12, 13, 15, 22, 29},
+	5: {0, 1, 2, 3, 4, 5},
+}
+
+// MatchCoAP is able to match CoAP messages over UDP, which have a 4-byte header of version 1, followed by a token,
+// options and an optional payload, and fill the whole datagram. The message type is exposed as {l4.coap.type},
+// e.g. CON, the code as {l4.coap.code}, e.g. 0.01, and the method name of requests as {l4.coap.method}, e.g. GET.
+// Empty messages, e.g. CoAP pings, and responses are matched too, unless methods are set.
+type MatchCoAP struct {
+	// Methods is a list of request methods to match, e.g. GET or POST.
+	// Any request, response or empty message is matched if empty.
+	Methods []string `json:"methods,omitempty"`
+
+	// Types is a list of message types to match: CON, NON, ACK or RST. Any type is matched if empty.
+	Types []string `json:"types,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchCoAP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.coap",
+		New: func() caddy.Module { return new(MatchCoAP) },
+	}
+}
+
+// Match returns true if the connection looks like CoAP.
+func (m *MatchCoAP) Match(cx *layer4.Connection) (bool, error) {
+	// Read the whole datagram, as far as it can be matched
+	buf := make([]byte, layer4.MaxMatchingBytes)
+	n, err := readDatagram(cx, buf)
+	if err != nil {
+		return false, fmt.Errorf("reading datagram: %w", err)
+	}
+	if n < headerLength {
+		return false, nil
+	}
+	buf = buf[:n]
+
+	// Validate Version, Type and Token Length
+	ver, typ, tokenLength := buf[0]>>6, buf[0]>>4&0x03, int(buf[0]&0x0F)
+	if ver != version || tokenLength > maxTokenLength || headerLength+tokenLength > len(buf) {
+		return false, nil
+	}
+
+	// Validate Code, which is made of a 3-bit class and a 5-bit detail
+	class, detail := buf[1]>>5, buf[1]&0x1F
+	var method string
+	switch {
+	case class == 0 && detail == 0:
+		// Empty messages consist of the header only, and aren't sent as NON
+		if tokenLength > 0 || len(buf) > headerLength || types[typ] == "NON" {
+			return false, nil
+		}
+	case types[typ] == "RST":
+		return false, nil // Resets are empty messages
+	case class == 0:
+		if int(detail) >= len(methods) {
+			return false, nil
+		}
+		method = methods[detail]
+	default:
+		if !slices.Contains(responses[class], detail) {
+			return false, nil
+		}
+	}
+
+	if len(m.Methods) > 0 && !slices.Contains(m.Methods, method) || len(m.Types) > 0 && !slices.Contains(m.Types, types[typ]) {
+		return false, nil
+	}
+
+	// Validate options and payload
+	if !validOptions(buf[headerLength+tokenLength:]) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.coap.type", types[typ])
+	repl.Set("l4.coap.code", fmt.Sprintf("%d.%02d", class, detail))
+	repl.Set("l4.coap.method", method)
+	cx.SetProtocol("coap")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchCoAP) Provision(_ caddy.Context) error {
+	for _, method := range m.Methods {
+		if method == "" || !slices.Contains(methods, method) {
+			return fmt.Errorf("unsupported method '%s'", method)
+		}
+	}
+	for _, typ := range m.Types {
+		if !slices.Contains(types, typ) {
+			return fmt.Errorf("unsupported type '%s'", typ)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchCoAP from Caddyfile tokens. Syntax:
+//
+//	coap [<methods...>] {
+//		types <CON|NON|ACK|RST...>
+//	}
+func (m *MatchCoAP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Methods = append(m.Methods, d.RemainingArgs()...)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "types":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.Types = append(m.Types, d.RemainingArgs()...)
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// validOptions returns true if b, i.e. the bytes following the token, consists of options, each having a 4-bit
+// Option Delta and a 4-bit Option Length, possibly extended by 1 or 2 bytes, followed by the Option Value, then
+// by an optional payload marker and a non-empty payload.
+func validOptions(b []byte) bool {
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			return len(b) > 1
+		}
+		delta, length := b[0]>>4, b[0]&0x0F
+		b = b[1:]
+
+		var ok bool
+		if _, b, ok = extendedValue(b, delta); !ok {
+			return false
+		}
+		var n int
+		if n, b, ok = extendedValue(b, length); !ok || n > len(b) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// extendedValue returns the value of an Option Delta or Option Length nibble, which is extended by the following
+// byte if 13 and by the following 2 bytes if 14, and the remaining bytes of b. It returns false if nibble is 15,
+// which is reserved for the payload marker, or if b is too short.
+func extendedValue(b []byte, nibble byte) (int, []byte, bool) {
+	switch nibble {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, false
+		}
+		return int(b[0]) + 13, b[1:], true
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, false
+		}
+		return (int(b[0])<<8 | int(b[1])) + 269, b[2:], true
+	case 15:
+		return 0, nil, false
+	default:
+		return int(nibble), b, true
+	}
+}
+
+// readDatagram reads from cx into buf until it's full or no bytes remain, and returns the number of bytes read.
+// Since CoAP is UDP-based, all the bytes of a datagram are available at once, so nothing is waited for.
+func readDatagram(cx *layer4.Connection, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		nn, err := cx.Read(buf[n:])
+		n += nn
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+				break
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc7252#section-3
+//	https://www.rfc-editor.org/rfc/rfc7252#section-12.1
+//	https://www.rfc-editor.org/rfc/rfc8132#section-6
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchCoAP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchCoAP)(nil)
+	_ layer4.ConnMatcher    = (*MatchCoAP)(nil)
+)
@@ -0,0 +1,153 @@
+package l4coap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// CON GET request with a 2-byte token and a Uri-Path option of "temperature"
+var getRequest = []byte{
+	0x42, 0x01, 0x12, 0x34, // Ver 1, CON, TKL 2, 0.01 GET, Message ID
+	0xab, 0xcd, // Token
+	0xbb, 't', 'e', 'm', 'p', 'e', 'r', 'a', 't', 'u', 'r', 'e', // Uri-Path (11)
+}
+
+// NON POST request with a Uri-Path option of 20 bytes, i.e. an extended length, and a payload
+var postRequest = []byte{
+	0x50, 0x02, 0x00, 0x01, // Ver 1, NON, TKL 0, 0.02 POST, Message ID
+	0xbd, 0x07, 's', 'e', 'n', 's', 'o', 'r', 's', '-', 'b', 'u', 'i', 'l', 'd', 'i', 'n', 'g', '-', 'o', 'n', 'e', // Uri-Path (11)
+	0xff, '2', '2', '.', '5', // Payload
+}
+
+// ACK 2.05 Content response with a Content-Format option and a payload
+var contentResponse = []byte{
+	0x62, 0x45, 0x12, 0x34, // Ver 1, ACK, TKL 2, 2.05 Content, Message ID
+	0xab, 0xcd, // Token
+	0xc0,                     // Content-Format (12), text/plain
+	0xff, '2', '2', '.', '5', // Payload
+}
+
+// CON empty message, i.e. a CoAP ping
+var ping = []byte{0x40, 0x00, 0x00, 0x07}
+
+func Test_MatchCoAP_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchCoAP
+		data        []byte
+		shouldMatch bool
+		typ         string
+		code        string
+		method      string
+	}
+
+	tests := []test{
+		{matcher: &MatchCoAP{}, data: getRequest, shouldMatch: true, typ: "CON", code: "0.01", method: "GET"},
+		{matcher: &MatchCoAP{}, data: postRequest, shouldMatch: true, typ: "NON", code: "0.02", method: "POST"},
+		{matcher: &MatchCoAP{}, data: contentResponse, shouldMatch: true, typ: "ACK", code: "2.05"},
+		{matcher: &MatchCoAP{}, data: ping, shouldMatch: true, typ: "CON", code: "0.00"},
+		{matcher: &MatchCoAP{}, data: getRequest[:headerLength+2], shouldMatch: true, typ: "CON", code: "0.01", method: "GET"},
+
+		{matcher: &MatchCoAP{Methods: []string{"GET"}}, data: getRequest, shouldMatch: true, typ: "CON", code: "0.01", method: "GET"},
+		{matcher: &MatchCoAP{Methods: []string{"GET"}}, data: postRequest, shouldMatch: false},
+		{matcher: &MatchCoAP{Methods: []string{"GET"}}, data: contentResponse, shouldMatch: false},
+		{matcher: &MatchCoAP{Types: []string{"CON"}}, data: getRequest, shouldMatch: true, typ: "CON", code: "0.01", method: "GET"},
+		{matcher: &MatchCoAP{Types: []string{"CON"}}, data: postRequest, shouldMatch: false},
+
+		// the token length must be valid and fit in the datagram
+		{matcher: &MatchCoAP{}, data: getRequest[:headerLength+1], shouldMatch: false},
+		{matcher: &MatchCoAP{}, data: []byte{0x49, 0x01, 0x12, 0x34, 0, 0, 0, 0, 0, 0, 0, 0, 0}, shouldMatch: false},
+		// the options must fit in the datagram
+		{matcher: &MatchCoAP{}, data: getRequest[:len(getRequest)-1], shouldMatch: false},
+		{matcher: &MatchCoAP{}, data: postRequest[:headerLength+1], shouldMatch: false},
+		// the payload marker must be followed by a payload
+		{matcher: &MatchCoAP{}, data: contentResponse[:len(contentResponse)-4], shouldMatch: false},
+		// the version must be 1
+		{matcher: &MatchCoAP{}, data: append([]byte{0x82}, getRequest[1:]...), shouldMatch: false},
+		// the code must be a known method or response
+		{matcher: &MatchCoAP{}, data: append([]byte{0x42, 0x08}, getRequest[2:]...), shouldMatch: false},
+		{matcher: &MatchCoAP{}, data: append([]byte{0x42, 0x65}, getRequest[2:]...), shouldMatch: false},
+		// empty messages must be empty, and resets too
+		{matcher: &MatchCoAP{}, data: append(append([]byte{}, ping...), 0xff, 'x'), shouldMatch: false},
+		{matcher: &MatchCoAP{}, data: []byte{0x50, 0x00, 0x00, 0x07}, shouldMatch: false},
+		{matcher: &MatchCoAP{}, data: append([]byte{0x72}, getRequest[1:]...), shouldMatch: false},
+
+		{matcher: &MatchCoAP{}, data: []byte{}, shouldMatch: false},
+		{matcher: &MatchCoAP{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\nAccept: */*\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchCoAP{}, data: []byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range map[string]string{
+				"l4.coap.type":   tc.typ,
+				"l4.coap.code":   tc.code,
+				"l4.coap.method": tc.method,
+			} {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
+		}()
+	}
+}
+
+func Test_MatchCoAP_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchCoAP{
+		{Methods: []string{"HEAD"}},
+		{Methods: []string{""}},
+		{Types: []string{"ACKNOWLEDGEMENT"}},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: matcher should not be provisioned | %+v", i, m)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4confidence allows ranking the protocols L4 connections resemble for diagnostics
+package l4confidence
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler runs a number of candidate matchers against the connection, and logs the protocols
+// they stand for ranked by the confidence of their matches, e.g. to tune configs where several
+// heuristic matchers could apply. Matchers implementing layer4.ConfidenceMatcher report how
+// strongly the connection resembles their protocol, even if it doesn't match; any other matcher
+// scores 1 if it matches, and 0 otherwise. The best candidate and its confidence are exposed as
+// {l4.confidence.protocol} and {l4.confidence.score}. Only the bytes prefetched during routing
+// are available to the matchers, and they are rewound, so that the next handlers get all of them.
+type Handler struct {
+	// Matchers is the set of candidate matchers, keyed by their names, e.g. http or ssh.
+	MatchersRaw caddy.ModuleMap `json:"matchers,omitempty" caddy:"namespace=layer4.matchers"`
+
+	matchers map[string]layer4.ConnMatcher
+	logger   *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.confidence",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	if len(h.MatchersRaw) == 0 {
+		return fmt.Errorf("no candidate matchers")
+	}
+	mods, err := ctx.LoadModule(h, "MatchersRaw")
+	if err != nil {
+		return fmt.Errorf("loading candidate matchers: %v", err)
+	}
+	h.matchers = make(map[string]layer4.ConnMatcher)
+	for name, modIface := range mods.(map[string]any) {
+		h.matchers[name] = modIface.(layer4.ConnMatcher)
+	}
+	return nil
+}
+
+// Handle handles the connection.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	scores := h.rank(cx)
+
+	ranking := make([]string, 0, len(scores))
+	for _, s := range scores {
+		ranking = append(ranking, s.String())
+	}
+	h.logger.Info("protocol confidence",
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.String("matched_route", cx.MatchedRoute()),
+		zap.Strings("ranking", ranking),
+	)
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	if len(scores) > 0 && scores[0].confidence > 0 {
+		repl.Set("l4.confidence.protocol", scores[0].protocol)
+		repl.Set("l4.confidence.score", strconv.FormatFloat(scores[0].confidence, 'f', 2, 64))
+	}
+
+	return next.Handle(cx)
+}
+
+// rank runs all the candidate matchers against cx, and returns their scores
+// ordered by descending confidence, and by protocol name if equal.
+func (h *Handler) rank(cx *layer4.Connection) []score {
+	scores := make([]score, 0, len(h.matchers))
+	for name, m := range h.matchers {
+		matched, confidence, err := layer4.MatchConfidence(m, cx)
+		if err != nil && !errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+			h.logger.Debug("matching candidate",
+				zap.String("remote", cx.RemoteAddr().String()),
+				zap.String("protocol", name),
+				zap.Error(err),
+			)
+			matched, confidence = false, 0
+		}
+		scores = append(scores, score{protocol: name, confidence: confidence, matched: matched})
+	}
+	slices.SortFunc(scores, func(a, b score) int {
+		if a.confidence != b.confidence {
+			if a.confidence > b.confidence {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.protocol, b.protocol)
+	})
+	return scores
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	confidence {
+//		<matcher> [<args...>]
+//		<matcher> {
+//			<submatcher> [<args...>]
+//		}
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume wrapper name
+
+	matchers, err := layer4.ParseCaddyfileNestedMatcherSet(d)
+	if err != nil {
+		return err
+	}
+	h.MatchersRaw = matchers
+
+	return nil
+}
+
+// score is the confidence of a candidate matcher for a connection.
+type score struct {
+	protocol   string
+	confidence float64
+	matched    bool
+}
+
+// String returns the protocol and the confidence, with an asterisk if the matcher has matched, e.g. ssh=1.00*.
+func (s score) String() string {
+	str := s.protocol + "=" + strconv.FormatFloat(s.confidence, 'f', 2, 64)
+	if s.matched {
+		str += "*"
+	}
+	return str
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
@@ -0,0 +1,145 @@
+package l4confidence
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// prefixMatcher matches connections starting with prefix, and reports
+// the share of prefix the connection starts with as the confidence.
+type prefixMatcher struct {
+	prefix string
+}
+
+func (m *prefixMatcher) Match(cx *layer4.Connection) (bool, error) {
+	matched, _, err := m.MatchConfidence(cx)
+	return matched, err
+}
+
+func (m *prefixMatcher) MatchConfidence(cx *layer4.Connection) (bool, float64, error) {
+	buf := make([]byte, len(m.prefix))
+	n, err := io.ReadFull(cx, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+		return false, 0, err
+	}
+	var common int
+	for common < n && buf[common] == m.prefix[common] {
+		common++
+	}
+	return common == len(m.prefix), float64(common) / float64(len(m.prefix)), nil
+}
+
+// plainMatcher matches connections starting with prefix, without reporting any confidence.
+type plainMatcher struct {
+	prefix string
+}
+
+func (m *plainMatcher) Match(cx *layer4.Connection) (bool, error) {
+	buf := make([]byte, len(m.prefix))
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return false, err
+	}
+	return string(buf) == m.prefix, nil
+}
+
+func TestHandler_Rank(t *testing.T) {
+	// The data partially resembles both an SSH identification string and an HTTP request line
+	data := []byte("SSH-2.0 HTTP/1.1\r\n")
+
+	h := &Handler{
+		logger: zap.NewNop(),
+		matchers: map[string]layer4.ConnMatcher{
+			"ssh":   &prefixMatcher{prefix: "SSH-2.0-"},
+			"http":  &prefixMatcher{prefix: "SSH-2.0 HTTP/1.0"},
+			"tls":   &prefixMatcher{prefix: "\x16\x03"},
+			"plain": &plainMatcher{prefix: "SSH-"},
+			"other": &plainMatcher{prefix: "QUIT"},
+		},
+	}
+
+	in, out := net.Pipe()
+	defer func() {
+		_ = in.Close()
+		_ = out.Close()
+	}()
+
+	cx := layer4.WrapConnection(out, data, zap.NewNop())
+	var got []string
+	for _, s := range h.rank(cx) {
+		got = append(got, s.String())
+	}
+
+	want := []string{"plain=1.00*", "http=0.94", "ssh=0.88", "other=0.00", "tls=0.00"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected ranking | got %v, want %v", got, want)
+	}
+}
+
+func TestHandler_Handle(t *testing.T) {
+	data := []byte("SSH-2.0 HTTP/1.1\r\n")
+
+	h := &Handler{
+		logger: zap.NewNop(),
+		matchers: map[string]layer4.ConnMatcher{
+			"ssh":  &prefixMatcher{prefix: "SSH-2.0-"},
+			"http": &prefixMatcher{prefix: "SSH-2.0 HTTP/1.0"},
+		},
+	}
+
+	in, out := net.Pipe()
+	defer func() {
+		_ = in.Close()
+		_ = out.Close()
+	}()
+
+	cx := layer4.WrapConnection(out, data, zap.NewNop())
+	var received []byte
+	err := h.Handle(cx, layer4.HandlerFunc(func(cx *layer4.Connection) error {
+		// all the bytes read by the candidate matchers must have been rewound
+		received = make([]byte, len(data))
+		_, err := io.ReadFull(cx, received)
+		return err
+	}))
+	assertNoError(t, err)
+
+	if !bytes.Equal(received, data) {
+		t.Fatalf("unexpected bytes read by the next handler | got %q, want %q", received, data)
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	for name, want := range map[string]string{
+		"l4.confidence.protocol": "http",
+		"l4.confidence.score":    "0.94",
+	} {
+		if got, _ := repl.GetString(name); got != want {
+			t.Fatalf("unexpected %s | got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{}
+	if err := h.Provision(ctx); err == nil {
+		t.Fatalf("handler without candidate matchers should not be provisioned")
+	}
+}
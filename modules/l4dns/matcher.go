@@ -17,9 +17,11 @@ package l4dns
 import (
 	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
@@ -31,6 +33,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchDNS{})
+	layer4.RegisterProtocol("dns")
 }
 
 // MatchDNS is able to match connections that look like DNS protocol.
@@ -38,6 +41,7 @@ func init() {
 // it has to proxy DNS messages to TCP upstreams only. The same is true for UDP. No TCP/UDP mixing is allowed.
 // However, it's technically possible: an intermediary handler is required to add/strip 2 bytes before/after proxy.
 // Please open a feature request and describe your use case if you need TCP/UDP mixing.
+// The domain name of the first question of a matched message is exposed as {l4.dns.qname} in lower case.
 type MatchDNS struct {
 	// Allow contains an optional list of rules to match the question section of the DNS request message against.
 	// The matcher returns false if not matched by any of them (in the absence of any deny rules).
@@ -52,6 +56,10 @@ type MatchDNS struct {
 	// If PreferAllow is true, DNS request messages that have been matched by both allow and deny rules are allowed.
 	// The default action is deny. Use it to make the filter less restrictive when the rules are mutually exclusive.
 	PreferAllow bool `json:"prefer_allow,omitempty"`
+
+	// MaxBytes is the maximum size of a DNS request message to be read, excluding the 2-byte length prefix
+	// of messages sent via TCP. Larger messages aren't matched. Defaults to 65535 (dns.MaxMsgSize).
+	MaxBytes uint16 `json:"max_bytes,omitempty"`
 }
 
 // CaddyModule returns the Caddy module information.
@@ -77,7 +85,7 @@ func (m *MatchDNS) Match(cx *layer4.Connection) (bool, error) {
 		// Note: these 2 bytes represent the length of the remaining part of the packet
 		// as a big endian uint16 number.
 		err := binary.Read(cx, binary.BigEndian, &msgBytes)
-		if err != nil || msgBytes < dnsHeaderBytes || msgBytes > dns.MaxMsgSize {
+		if err != nil || msgBytes < dnsHeaderBytes || msgBytes > m.maxBytes() {
 			return false, err
 		}
 
@@ -107,12 +115,12 @@ func (m *MatchDNS) Match(cx *layer4.Connection) (bool, error) {
 		// Read the remaining bytes and validate their length
 		var nn int
 		tmpBuf := make([]byte, dns.MinMsgSize)
-		for err == nil {
+		for err == nil && n <= int(m.maxBytes()) {
 			nn, err = io.ReadAtLeast(cx, tmpBuf, 1)
 			msgBuf = append(msgBuf, tmpBuf[:nn]...)
 			n += nn
 		}
-		if n > dns.MaxMsgSize {
+		if n > int(m.maxBytes()) {
 			return false, nil
 		}
 		msgBytes = uint16(n) //nolint:gosec // disable G115
@@ -135,6 +143,11 @@ func (m *MatchDNS) Match(cx *layer4.Connection) (bool, error) {
 		return false, nil
 	}
 
+	// Filter out DNS request messages with unknown opcodes
+	if _, opcodeFound := dns.OpcodeToString[msg.Opcode]; !opcodeFound {
+		return false, nil
+	}
+
 	// Apply the allow and deny rules to the question section of the DNS request message
 	hasNoAllow, hasNoDeny := len(m.Allow) == 0, len(m.Deny) == 0
 	if !hasNoAllow || !hasNoDeny {
@@ -183,11 +196,19 @@ func (m *MatchDNS) Match(cx *layer4.Connection) (bool, error) {
 	// Append the current DNS message to the messages list (it might be useful for other matchers or handlers)
 	appendMessage(cx, msg)
 
+	// Also add the domain name of the first question to the replacer
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.dns.qname", strings.ToLower(msg.Question[0].Name))
+	cx.SetProtocol("dns")
+
 	return true, nil
 }
 
 // Provision prepares m's allow and deny rules.
 func (m *MatchDNS) Provision(cx caddy.Context) error {
+	if m.MaxBytes > 0 && m.MaxBytes < dnsHeaderBytes {
+		return fmt.Errorf("max_bytes must be at least %d", dnsHeaderBytes)
+	}
 	err := m.Allow.Provision(cx)
 	if err != nil {
 		return err
@@ -206,6 +227,7 @@ func (m *MatchDNS) Provision(cx caddy.Context) error {
 //		<allow_regexp|deny_regexp> <*|name_pattern> [<*|type_pattern> [<*|class_pattern>]]
 //		default_deny
 //		prefer_allow
+//		max_bytes <n>
 //	}
 //	dns
 //
@@ -221,7 +243,7 @@ func (m *MatchDNS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		return d.ArgErr()
 	}
 
-	var hasDefaultDeny, hasPreferAllow bool
+	var hasDefaultDeny, hasPreferAllow, hasMaxBytes bool
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		optionName := d.Val()
 		switch optionName {
@@ -280,6 +302,19 @@ func (m *MatchDNS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			m.PreferAllow, hasPreferAllow = true, true
+		case "max_bytes":
+			if hasMaxBytes {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 16)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.MaxBytes, hasMaxBytes = uint16(val), true
 		default:
 			return d.ArgErr()
 		}
@@ -402,6 +437,14 @@ const (
 	dnsSpecialAny         = "*"
 )
 
+// maxBytes returns m.MaxBytes or its default value.
+func (m *MatchDNS) maxBytes() uint16 {
+	if m.MaxBytes > 0 {
+		return m.MaxBytes
+	}
+	return dns.MaxMsgSize
+}
+
 func appendMessage(cx *layer4.Connection, msg *dns.Msg) {
 	var messages []*dns.Msg
 	if val := cx.GetVar(dnsMessagesKey); val != nil {
@@ -140,6 +140,67 @@ func Test_MatchDNS_Match(t *testing.T) {
 	}
 }
 
+func Test_MatchDNS_QName(t *testing.T) {
+	type test struct {
+		matcher     *MatchDNS
+		data        []byte
+		shouldMatch bool
+		qname       string
+	}
+
+	tests := []test{
+		{matcher: &MatchDNS{}, data: tcpPacketExampleComA, shouldMatch: true, qname: "example.com."},
+		{matcher: &MatchDNS{}, data: tcpPacketMixedCaseComA, shouldMatch: true, qname: "example.com."},
+		{matcher: &MatchDNS{}, data: tcpPacketExampleComAXFR, shouldMatch: true, qname: "example.com."},
+		{matcher: &MatchDNS{}, data: tcpPacketDotNS, shouldMatch: true, qname: "."},
+
+		{matcher: &MatchDNS{MaxBytes: 28}, data: tcpPacketExampleComA, shouldMatch: false},
+		{matcher: &MatchDNS{MaxBytes: 29}, data: tcpPacketExampleComA, shouldMatch: true, qname: "example.com."},
+		{matcher: &MatchDNS{}, data: tcpPacketExampleComAOpcode3, shouldMatch: false},
+		{matcher: &MatchDNS{}, data: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(&fakeTCPConn{Conn: out}, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			qname, _ := repl.GetString("l4.dns.qname")
+			if qname != tc.qname {
+				t.Fatalf("test %d: unexpected qname | got %q, want %q\n", i, qname, tc.qname)
+			}
+		}()
+	}
+}
+
 type fakeTCPConn struct {
 	net.Conn
 }
@@ -185,3 +246,21 @@ var tcpPacketDotNS = []byte{
 	213, 147, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0,
 	0, 0, 2, 0, 1, // . (NS, IN)
 }
+
+var tcpPacketMixedCaseComA = []byte{
+	0, 29,
+	101, 3, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	7, 69, 120, 65, 109, 80, 108, 69, 3, 67, 111, 77, 0, 0, 1, 0, 1, // ExAmPlE.CoM. (A, IN)
+}
+
+var tcpPacketExampleComAXFR = []byte{
+	0, 29,
+	18, 52, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	7, 101, 120, 97, 109, 112, 108, 101, 3, 99, 111, 109, 0, 0, 252, 0, 1, // example.com. (AXFR, IN)
+}
+
+var tcpPacketExampleComAOpcode3 = []byte{
+	0, 29,
+	101, 3, 25, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	7, 101, 120, 97, 109, 112, 108, 101, 3, 99, 111, 109, 0, 0, 1, 0, 1, // example.com. (A, IN), unassigned opcode 3
+}
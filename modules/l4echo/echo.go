@@ -15,7 +15,12 @@
 package l4echo
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -27,8 +32,15 @@ func init() {
 	caddy.RegisterModule(&Handler{})
 }
 
-// Handler is a simple handler that writes what it reads.
-type Handler struct{}
+// Handler is a simple handler that writes what it reads, until the client stops sending or a limit is reached,
+// e.g. to check which route a raw client connection has matched.
+type Handler struct {
+	// MaxBytes is the maximum number of bytes to echo. Unlimited if 0.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// Timeout is the maximum duration of echoing. Unlimited if 0.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
 
 // CaddyModule returns the Caddy module information.
 func (*Handler) CaddyModule() caddy.ModuleInfo {
@@ -38,15 +50,43 @@ func (*Handler) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision validates h.
+func (h *Handler) Provision(_ caddy.Context) error {
+	if h.MaxBytes < 0 {
+		return fmt.Errorf("max bytes must be at least 0: %d", h.MaxBytes)
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("timeout must be at least 0: %s", time.Duration(h.Timeout))
+	}
+	return nil
+}
+
 // Handle handles the connection.
-func (*Handler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
-	_, err := io.Copy(cx, cx)
+func (h *Handler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
+	if h.Timeout > 0 {
+		if err := cx.SetDeadline(time.Now().Add(time.Duration(h.Timeout))); err != nil {
+			return err
+		}
+	}
+
+	var r io.Reader = cx
+	if h.MaxBytes > 0 {
+		r = io.LimitReader(cx, h.MaxBytes)
+	}
+
+	_, err := io.Copy(cx, r)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil // The time limit has been reached
+	}
 	return err
 }
 
 // UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
 //
-//	echo
+//	echo {
+//		max_bytes <n>
+//		timeout <duration>
+//	}
 func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	_, wrapper := d.Next(), d.Val() // consume wrapper name
 
@@ -55,9 +95,44 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		return d.ArgErr()
 	}
 
-	// No blocks are supported
-	if d.NextBlock(d.Nesting()) {
-		return d.Errf("malformed layer4 connection handler '%s': blocks are not supported", wrapper)
+	var hasMaxBytes, hasTimeout bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "max_bytes":
+			if hasMaxBytes {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil || val < 0 {
+				return d.Errf("parsing %s option '%s': invalid number of bytes '%s'", wrapper, optionName, d.Val())
+			}
+			h.MaxBytes, hasMaxBytes = val, true
+		case "timeout":
+			if hasTimeout {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.Timeout, hasTimeout = caddy.Duration(dur), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
 	}
 
 	return nil
@@ -65,6 +140,7 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 // Interface guards
 var (
+	_ caddy.Provisioner     = (*Handler)(nil)
 	_ caddyfile.Unmarshaler = (*Handler)(nil)
 	_ layer4.NextHandler    = (*Handler)(nil)
 )
@@ -0,0 +1,94 @@
+package l4echo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestHandler_Handle(t *testing.T) {
+	type test struct {
+		handler *Handler
+		data    []byte
+		echoed  []byte
+	}
+
+	data := []byte("\x00\x00\x00\x08\x04\xd2\x16\x2fhello, world!\r\n\xff")
+
+	tests := []test{
+		{handler: &Handler{}, data: data, echoed: data},
+		{handler: &Handler{MaxBytes: 8}, data: data, echoed: data[:8]},
+		{handler: &Handler{MaxBytes: int64(len(data))}, data: data, echoed: data},
+		{handler: &Handler{Timeout: caddy.Duration(50 * time.Millisecond)}, data: data, echoed: data},
+		{handler: &Handler{Timeout: caddy.Duration(50 * time.Millisecond)}, data: []byte{}, echoed: []byte{}},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.handler.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+
+			echoed := make(chan []byte, 1)
+			go func() {
+				// the bytes written beyond a limit are never read
+				go func() { _, _ = in.Write(tc.data) }()
+				buf := make([]byte, len(tc.echoed))
+				_, err := io.ReadFull(in, buf)
+				assertNoError(t, err)
+				echoed <- buf
+				if tc.handler.Timeout == 0 && tc.handler.MaxBytes == 0 {
+					_ = in.Close() // nothing but EOF stops an unlimited echo
+				}
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			done := make(chan error, 1)
+			go func() { done <- tc.handler.Handle(cx, nil) }()
+
+			select {
+			case err = <-done:
+				assertNoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("test %d: handler didn't return", i)
+			}
+			_ = cx.Close()
+
+			if got := <-echoed; !bytes.Equal(got, tc.echoed) {
+				t.Fatalf("test %d: unexpected bytes echoed | got %x, want %x\n", i, got, tc.echoed)
+			}
+		}()
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, h := range []*Handler{{MaxBytes: -1}, {Timeout: -1}} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("invalid handler should not be accepted | %+v\n", h)
+		}
+	}
+}
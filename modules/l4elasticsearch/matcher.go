@@ -0,0 +1,197 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4elasticsearch allows the L4 multiplexing of Elasticsearch and OpenSearch transport connections
+package l4elasticsearch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchTransport{})
+	layer4.RegisterProtocol("es_transport")
+}
+
+// MatchTransport is able to match the binary transport protocol Elasticsearch and OpenSearch
+// nodes and clients use to talk to each other (usually on port 9300), as opposed to the HTTP
+// REST interface. A transport connection starts with a handshake request which version is
+// exposed as {l4.es_transport.version} (e.g. 7.17.0) and {l4.es_transport.version_id}.
+type MatchTransport struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchTransport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.es_transport",
+		New: func() caddy.Module { return new(MatchTransport) },
+	}
+}
+
+// Match returns true if the connection looks like the Elasticsearch transport protocol.
+func (m *MatchTransport) Match(cx *layer4.Connection) (bool, error) {
+	// Read a number of bytes
+	buf := make([]byte, HeaderBytesMin)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return false, err
+	}
+
+	// Parse Header
+	h := &Header{}
+	if err := h.FromBytes(buf); err != nil {
+		return false, nil
+	}
+
+	// Validate Header
+	if !bytes.Equal(h.Marker[:], headerMarker) {
+		return false, nil
+	}
+	if h.Size < HeaderBytesMin-MarkerAndSizeBytes || h.Size > MessageSizeMax {
+		return false, nil
+	}
+	if h.Status&StatusResponse != 0 || h.Status&StatusHandshake == 0 {
+		return false, nil
+	}
+	if h.Version == 0 {
+		return false, nil
+	}
+
+	// Set variables
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.es_transport.version", h.VersionString())
+	repl.Set("l4.es_transport.version_id", strconv.FormatUint(uint64(h.Version), 10))
+	cx.SetProtocol("es_transport")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchTransport from Caddyfile tokens. Syntax:
+//
+//	es_transport
+func (m *MatchTransport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Header is the fixed part of the header every transport message starts with.
+// Since 7.6 it's followed by a variable header which size is given in the next 4 bytes.
+type Header struct {
+	Marker    [2]uint8
+	Size      uint32
+	RequestID uint64
+	Status    uint8
+	Version   uint32
+}
+
+func (h *Header) FromBytes(src []byte) error {
+	buf := bytes.NewBuffer(src)
+	if err := binary.Read(buf, MessageBytesOrder, &h.Marker); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, MessageBytesOrder, &h.Size); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, MessageBytesOrder, &h.RequestID); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, MessageBytesOrder, &h.Status); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, MessageBytesOrder, &h.Version); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *Header) ToBytes() ([]byte, error) {
+	dst := bytes.NewBuffer(make([]byte, 0, HeaderBytesMin))
+	if err := binary.Write(dst, MessageBytesOrder, &h.Marker); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(dst, MessageBytesOrder, &h.Size); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(dst, MessageBytesOrder, &h.RequestID); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(dst, MessageBytesOrder, &h.Status); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(dst, MessageBytesOrder, &h.Version); err != nil {
+		return nil, err
+	}
+	return dst.Bytes(), nil
+}
+
+// VersionString formats h.Version as major.minor.revision. Version ids are
+// composed as major*1000000 + minor*10000 + revision*100 + build, and
+// OpenSearch additionally flips a mask bit to tell its versions apart.
+func (h *Header) VersionString() string {
+	id := h.Version
+	if id&OpenSearchVersionMask != 0 {
+		id ^= OpenSearchVersionMask
+	}
+	return fmt.Sprintf("%d.%d.%d", id/1000000, id/10000%100, id/100%100)
+}
+
+var headerMarker = []byte("ES")
+
+const (
+	MarkerAndSizeBytes = 2 + 4
+	HeaderBytesMin     = MarkerAndSizeBytes + 8 + 1 + 4
+
+	// MessageSizeMax is a sanity limit for the size of a handshake request,
+	// which is much smaller in practice.
+	MessageSizeMax = 1 << 20
+
+	StatusResponse  uint8 = 1 << 0
+	StatusError     uint8 = 1 << 1
+	StatusCompress  uint8 = 1 << 2
+	StatusHandshake uint8 = 1 << 3
+
+	OpenSearchVersionMask uint32 = 0x08000000
+)
+
+var MessageBytesOrder = binary.BigEndian
+
+// Refs:
+//
+//	https://github.com/elastic/elasticsearch/blob/main/server/src/main/java/org/elasticsearch/transport/TcpHeader.java
+//	https://github.com/elastic/elasticsearch/blob/main/server/src/main/java/org/elasticsearch/transport/TransportStatus.java
+//	https://github.com/opensearch-project/OpenSearch/blob/main/server/src/main/java/org/opensearch/transport/TcpHeader.java
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchTransport)(nil)
+	_ layer4.ConnMatcher    = (*MatchTransport)(nil)
+)
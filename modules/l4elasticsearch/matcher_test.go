@@ -0,0 +1,175 @@
+package l4elasticsearch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func Test_MatchTransport_ProcessHeader(t *testing.T) {
+	p := [][]byte{
+		packetHandshake7[:HeaderBytesMin],
+		packetHandshakeOpenSearch2[:HeaderBytesMin],
+		packetResponse[:HeaderBytesMin],
+	}
+	for _, b := range p {
+		func() {
+			s := &Header{}
+			errFrom := s.FromBytes(b)
+			assertNoError(t, errFrom)
+			sb, errTo := s.ToBytes()
+			assertNoError(t, errTo)
+			if !bytes.Equal(b, sb) {
+				t.Fatalf("test %T bytes processing: resulting bytes [% x] don't match original bytes [% x]", *s, b, sb)
+			}
+		}()
+	}
+}
+
+func Test_MatchTransport_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchTransport
+		data        []byte
+		shouldMatch bool
+		version     string
+		versionID   string
+	}
+
+	tests := []test{
+		{matcher: &MatchTransport{}, data: packetHandshake7, shouldMatch: true, version: "7.17.0", versionID: "7170099"},
+		{matcher: &MatchTransport{}, data: packetHandshake6, shouldMatch: true, version: "6.8.0", versionID: "6080099"},
+		{matcher: &MatchTransport{}, data: packetHandshakeOpenSearch2, shouldMatch: true, version: "2.11.0", versionID: "136327827"},
+		{matcher: &MatchTransport{}, data: packetTooShort, shouldMatch: false},
+		{matcher: &MatchTransport{}, data: packetPing, shouldMatch: false},
+		{matcher: &MatchTransport{}, data: packetResponse, shouldMatch: false},
+		{matcher: &MatchTransport{}, data: packetNotHandshake, shouldMatch: false},
+		{matcher: &MatchTransport{}, data: packetTooLarge, shouldMatch: false},
+		{matcher: &MatchTransport{}, data: packetHTTP, shouldMatch: false},
+	}
+
+	for i, tc := range tests {
+		func() {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			version, _ := repl.GetString("l4.es_transport.version")
+			versionID, _ := repl.GetString("l4.es_transport.version_id")
+			if version != tc.version || versionID != tc.versionID {
+				t.Fatalf("test %d: unexpected version | %s (%s)\n", i, version, versionID)
+			}
+		}()
+	}
+}
+
+// Packet examples
+var packetHandshake7 = []byte{
+	0x45, 0x53, // Marker
+	0x00, 0x00, 0x00, 0x2B, // Size
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // RequestID
+	0x08,                   // Status (handshake request)
+	0x00, 0x6D, 0x68, 0x33, // Version (7170099)
+	0x00, 0x00, 0x00, 0x1A, // Variable header size (1/2)
+	0x00, 0x00, 0x00, // Variable header (2/2): no thread context
+	0x16, 0x69, 0x6E, 0x74, 0x65, 0x72, 0x6E, 0x61, 0x6C, 0x3A, 0x74, 0x63, 0x70, // Action name (1/2)
+	0x2F, 0x68, 0x61, 0x6E, 0x64, 0x73, 0x68, 0x61, 0x6B, 0x65, // Action name (2/2)
+}
+
+var packetHandshake6 = []byte{
+	0x45, 0x53, // Marker
+	0x00, 0x00, 0x00, 0x2C, // Size
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, // RequestID
+	0x08,                   // Status (handshake request)
+	0x00, 0x5C, 0xC6, 0x63, // Version (6080099)
+	0x00, 0x00, // Thread context
+	0x16, 0x69, 0x6E, 0x74, 0x65, 0x72, 0x6E, 0x61, 0x6C, 0x3A, 0x74, 0x63, 0x70, // Action name (1/2)
+	0x2F, 0x68, 0x61, 0x6E, 0x64, 0x73, 0x68, 0x61, 0x6B, 0x65, // Action name (2/2)
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Payload
+}
+
+var packetHandshakeOpenSearch2 = []byte{
+	0x45, 0x53, // Marker
+	0x00, 0x00, 0x00, 0x2B, // Size
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, // RequestID
+	0x08,                   // Status (handshake request)
+	0x08, 0x20, 0x32, 0x93, // Version (2110099 ^ 0x08000000)
+	0x00, 0x00, 0x00, 0x1A, // Variable header size (1/2)
+	0x00, 0x00, 0x00, // Variable header (2/2): no thread context
+	0x16, 0x69, 0x6E, 0x74, 0x65, 0x72, 0x6E, 0x61, 0x6C, 0x3A, 0x74, 0x63, 0x70, // Action name (1/2)
+	0x2F, 0x68, 0x61, 0x6E, 0x64, 0x73, 0x68, 0x61, 0x6B, 0x65, // Action name (2/2)
+}
+
+var packetTooShort = []byte{
+	0x45, 0x53, // Marker
+	0x00, 0x00, 0x00, 0x1F, // Size
+	0x00, 0x00, 0x00, 0x00, // RequestID (partial)
+}
+
+var packetPing = []byte{
+	0x45, 0x53, // Marker
+	0xFF, 0xFF, 0xFF, 0xFF, // Size (-1 for a ping)
+}
+
+var packetResponse = []byte{
+	0x45, 0x53, // Marker
+	0x00, 0x00, 0x00, 0x11, // Size
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // RequestID
+	0x09,                   // Status (handshake response)
+	0x00, 0x6D, 0x68, 0x33, // Version (7170099)
+	0x00, 0x00, 0x00, 0x00, // Variable header size
+}
+
+var packetNotHandshake = []byte{
+	0x45, 0x53, // Marker
+	0x00, 0x00, 0x00, 0x11, // Size
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // RequestID
+	0x00,                   // Status (request)
+	0x00, 0x6D, 0x68, 0x33, // Version (7170099)
+	0x00, 0x00, 0x00, 0x00, // Variable header size
+}
+
+var packetTooLarge = []byte{
+	0x45, 0x53, // Marker
+	0x7F, 0x00, 0x00, 0x00, // Size
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // RequestID
+	0x08,                   // Status (handshake request)
+	0x00, 0x6D, 0x68, 0x33, // Version (7170099)
+	0x00, 0x00, 0x00, 0x00, // Variable header size
+}
+
+var packetHTTP = []byte("GET /_cluster/health HTTP/1.1\r\nHost: localhost:9200\r\nUser-Agent: curl/8.5.0\r\nAccept: */*\r\n\r\n")
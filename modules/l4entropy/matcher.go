@@ -0,0 +1,188 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4entropy allows the L4 multiplexing of connections by the entropy of their first bytes
+package l4entropy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchEntropy{})
+}
+
+const (
+	defaultBytes     = 128 // Default number of first bytes to measure the entropy of
+	defaultThreshold = 6.0 // Default entropy in bits per byte above which to match
+)
+
+// MatchEntropy is able to match connections which first bytes have a high Shannon entropy,
+// i.e. connections that look like encrypted or obfuscated traffic lacking any recognizable
+// header, e.g. obfs4 or other look-like-nothing transports. It's a heuristic, so it should
+// be used as a last-resort branch after the matchers of any expected protocols. Note that
+// the entropy of N bytes can't exceed log2(N) bits per byte, so the threshold must be lower.
+// The measured entropy is exposed as {l4.entropy.value}.
+type MatchEntropy struct {
+	// Bytes is the number of first bytes to measure the entropy of. It defaults to 128
+	// and may not exceed layer4.MaxMatchingBytes. Connections sending fewer bytes don't match.
+	Bytes uint16 `json:"bytes,omitempty"`
+	// Threshold is the entropy in bits per byte the first bytes must exceed. It defaults to 6.0,
+	// which random 128 bytes practically always exceed, and must be lower than log2(Bytes).
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchEntropy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.entropy",
+		New: func() caddy.Module { return new(MatchEntropy) },
+	}
+}
+
+// Match returns true if the entropy of the connection's first bytes exceeds the threshold.
+func (m *MatchEntropy) Match(cx *layer4.Connection) (bool, error) {
+	// Read a number of bytes
+	buf := make([]byte, m.Bytes)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data to measure
+		}
+		return false, fmt.Errorf("reading first bytes: %w", err)
+	}
+
+	value := entropy(buf)
+	if value <= m.Threshold {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.entropy.value", strconv.FormatFloat(value, 'f', 3, 64))
+
+	return true, nil
+}
+
+// Provision sets m's defaults and validates them.
+func (m *MatchEntropy) Provision(_ caddy.Context) error {
+	if m.Bytes == 0 {
+		m.Bytes = defaultBytes
+	}
+	if int(m.Bytes) > layer4.MaxMatchingBytes {
+		return fmt.Errorf("bytes may not exceed %d", layer4.MaxMatchingBytes)
+	}
+	if m.Threshold == 0 {
+		m.Threshold = defaultThreshold
+	}
+	if m.Threshold < 0 || m.Threshold >= math.Log2(float64(m.Bytes)) {
+		return fmt.Errorf("threshold must be in range 0-%.3f for %d bytes", math.Log2(float64(m.Bytes)), m.Bytes)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchEntropy from Caddyfile tokens. Syntax:
+//
+//	entropy {
+//		bytes <n>
+//		threshold <bits_per_byte>
+//	}
+//	entropy
+func (m *MatchEntropy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasBytes, hasThreshold bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "bytes":
+			if hasBytes {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 16)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.Bytes, hasBytes = uint16(val), true
+		case "threshold":
+			if hasThreshold {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.Threshold, hasThreshold = val, true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	var h float64
+	n := float64(len(b))
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// Refs:
+//
+//	https://en.wikipedia.org/wiki/Entropy_(information_theory)
+//	https://gitlab.com/yawning/obfs4/-/blob/master/doc/obfs4-spec.txt
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchEntropy)(nil)
+	_ caddyfile.Unmarshaler = (*MatchEntropy)(nil)
+	_ layer4.ConnMatcher    = (*MatchEntropy)(nil)
+)
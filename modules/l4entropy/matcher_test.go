@@ -0,0 +1,111 @@
+package l4entropy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func Test_MatchEntropy_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchEntropy
+		data        []byte
+		shouldMatch bool
+	}
+
+	httpRequest := []byte("GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: Mozilla/5.0 (X11; Linux x86_64)\r\n" +
+		"Accept: text/html,application/xhtml+xml\r\nAccept-Language: en-US,en;q=0.5\r\nConnection: keep-alive\r\n\r\n")
+	sshBanner := []byte("SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13.5\r\n" + strings.Repeat("\x00\x00\x05\xdc\x07\x14", 20))
+	postgresStartup := append([]byte{0x00, 0x00, 0x00, 0x54, 0x00, 0x03, 0x00, 0x00},
+		[]byte("user\x00postgres\x00database\x00postgres\x00application_name\x00psql\x00client_encoding\x00UTF8\x00\x00"+
+			strings.Repeat("\x00", 64))...)
+
+	tests := []test{
+		{matcher: &MatchEntropy{}, data: randomBytes(1, 128), shouldMatch: true},
+		{matcher: &MatchEntropy{}, data: randomBytes(2, 4096), shouldMatch: true},
+		{matcher: &MatchEntropy{Bytes: 256, Threshold: 7.0}, data: randomBytes(3, 512), shouldMatch: true},
+		{matcher: &MatchEntropy{Bytes: 32, Threshold: 4.5}, data: randomBytes(4, 32), shouldMatch: true},
+		{matcher: &MatchEntropy{}, data: randomBytes(5, 127), shouldMatch: false},
+		{matcher: &MatchEntropy{}, data: httpRequest, shouldMatch: false},
+		{matcher: &MatchEntropy{}, data: sshBanner, shouldMatch: false},
+		{matcher: &MatchEntropy{}, data: postgresStartup, shouldMatch: false},
+		{matcher: &MatchEntropy{}, data: make([]byte, 128), shouldMatch: false},
+		{matcher: &MatchEntropy{Bytes: 256, Threshold: 7.9}, data: randomBytes(6, 256), shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if value, _ := repl.GetString("l4.entropy.value"); (len(value) > 0) != tc.shouldMatch {
+				t.Fatalf("test %d: unexpected entropy value | %q\n", i, value)
+			}
+		}()
+	}
+}
+
+func Test_MatchEntropy_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchEntropy{
+		{Bytes: layer4.MaxMatchingBytes + 1},
+		{Bytes: 64, Threshold: 6.0},
+		{Threshold: -1},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid matcher should not be provisioned | %+v\n", i, m)
+		}
+	}
+}
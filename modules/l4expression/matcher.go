@@ -0,0 +1,229 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4expression allows the L4 multiplexing of connections with CEL expressions
+package l4expression
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/ext"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchExpression{})
+}
+
+const (
+	connectionVarName   = "connection"
+	localIPVarName      = "local_ip"
+	placeholderFuncName = "ph"
+	remoteIPVarName     = "remote_ip"
+)
+
+// MatchExpression is able to match connections with a boolean CEL (Common Expression Language) expression,
+// e.g. to combine the values set by other matchers without writing new Go code. The expression may use:
+//
+//   - remote_ip and local_ip: the remote and local IP addresses of the connection as strings;
+//   - {placeholder} or ph(connection, "placeholder"): the value of any placeholder, e.g. {l4.tls.server_name}
+//     or {l4.postgres.database}, which is an empty string if the placeholder isn't set.
+//
+// Since placeholders are set by matchers as they match, this matcher should usually follow the matchers
+// setting the placeholders it uses, e.g. within the same matcher set. The standard CEL functions and
+// the string extensions are available, e.g. {l4.tls.server_name}.endsWith(".example.com") && remote_ip
+// == "10.0.0.1".
+type MatchExpression struct {
+	// Expr is the CEL expression to evaluate. It must return a bool.
+	Expr string `json:"expr,omitempty"`
+
+	expandedExpr string
+	prg          cel.Program
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchExpression) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.expression",
+		New: func() caddy.Module { return new(MatchExpression) },
+	}
+}
+
+// Match returns true if the connection satisfies the expression.
+func (m *MatchExpression) Match(cx *layer4.Connection) (bool, error) {
+	out, _, err := m.prg.Eval(map[string]any{
+		connectionVarName: celConnection{cx},
+		remoteIPVarName:   hostOf(cx.RemoteAddr()),
+		localIPVarName:    hostOf(cx.LocalAddr()),
+	})
+	if err != nil {
+		return false, fmt.Errorf("evaluating expression: %w", err)
+	}
+	matched, _ := out.Value().(bool)
+	return matched, nil
+}
+
+// Provision compiles the expression.
+func (m *MatchExpression) Provision(_ caddy.Context) error {
+	if m.Expr == "" {
+		return fmt.Errorf("no expression is set")
+	}
+
+	// Replace the placeholders with calls to the placeholder function
+	m.expandedExpr = placeholderRegexp.ReplaceAllString(m.Expr, placeholderExpansion)
+
+	env, err := cel.NewEnv(
+		cel.Function(placeholderFuncName, cel.Overload(
+			placeholderFuncName+"_connection_string",
+			[]*cel.Type{connectionCELType, cel.StringType},
+			cel.DynType,
+			cel.BinaryBinding(placeholderFunc),
+		)),
+		cel.Variable(connectionVarName, connectionCELType),
+		cel.Variable(remoteIPVarName, cel.StringType),
+		cel.Variable(localIPVarName, cel.StringType),
+		ext.Strings(),
+	)
+	if err != nil {
+		return fmt.Errorf("setting up CEL environment: %w", err)
+	}
+
+	checked, issues := env.Compile(m.expandedExpr)
+	if issues.Err() != nil {
+		return fmt.Errorf("compiling expression: %s", issues.Err())
+	}
+	if checked.OutputType() != cel.BoolType {
+		return fmt.Errorf("expression must return a bool, not %s", checked.OutputType())
+	}
+
+	m.prg, err = env.Program(checked, cel.EvalOptions(cel.OptOptimize))
+	if err != nil {
+		return fmt.Errorf("compiling expression: %w", err)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchExpression from Caddyfile tokens. Syntax:
+//
+//	expression <expr>
+//
+// The expression may either be a single token, e.g. enclosed in backticks, or span all the remaining arguments.
+func (m *MatchExpression) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Exactly one expression must be provided, which may consist of several tokens
+	if d.CountRemainingArgs() > 1 {
+		m.Expr = strings.Join(d.RemainingArgsRaw(), " ")
+	} else if d.NextArg() {
+		m.Expr = d.Val()
+	} else {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// placeholderFunc returns the value of the placeholder named by rhs for the connection held by lhs.
+func placeholderFunc(lhs, rhs ref.Val) ref.Val {
+	conn, ok := lhs.(celConnection)
+	if !ok {
+		return types.NewErr("invalid connection of type '%v' to %s(connection, placeholder)", lhs.Type(), placeholderFuncName)
+	}
+	name, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("invalid placeholder of type '%v' to %s(connection, placeholder)", rhs.Type(), placeholderFuncName)
+	}
+
+	repl := conn.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	val, found := repl.Get(string(name))
+	if !found || val == nil {
+		return types.String("")
+	}
+
+	// Values of other types, e.g. net.Addr, are converted to strings
+	if v := types.DefaultTypeAdapter.NativeToValue(val); !types.IsError(v) {
+		return v
+	}
+	return types.String(fmt.Sprint(val))
+}
+
+// hostOf returns the host of addr without the port, if any.
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String() // OK; probably didn't have a port
+	}
+	return host
+}
+
+// connectionCELType is the type of the connection variable.
+var connectionCELType = cel.ObjectType("layer4.Connection", traits.ReceiverType)
+
+// celConnection wraps a layer4 connection so that it can be passed to the placeholder function.
+type celConnection struct{ *layer4.Connection }
+
+func (cc celConnection) ConvertToNative(_ reflect.Type) (any, error) {
+	return cc.Connection, nil
+}
+
+func (cc celConnection) ConvertToType(_ ref.Type) ref.Val {
+	return types.NewErr("connections can't be converted")
+}
+
+func (cc celConnection) Equal(other ref.Val) ref.Val {
+	if o, ok := other.Value().(celConnection); ok {
+		return types.Bool(o.Connection == cc.Connection)
+	}
+	return types.ValOrErr(other, "%v is not comparable type", other)
+}
+
+func (celConnection) Type() ref.Type { return connectionCELType }
+
+func (cc celConnection) Value() any { return cc }
+
+var (
+	// placeholderRegexp matches placeholders, e.g. {l4.tls.server_name}, unless their brace is escaped
+	placeholderRegexp    = regexp.MustCompile(`([^\\]|^){([a-zA-Z][\w.-]+)}`)
+	placeholderExpansion = `${1}` + placeholderFuncName + `(` + connectionVarName + `, "${2}")`
+)
+
+// Refs:
+//
+//	https://github.com/google/cel-spec/blob/master/doc/langdef.md
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchExpression)(nil)
+	_ caddyfile.Unmarshaler = (*MatchExpression)(nil)
+	_ layer4.ConnMatcher    = (*MatchExpression)(nil)
+)
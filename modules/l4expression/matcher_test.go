@@ -0,0 +1,123 @@
+package l4expression
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+type dummyAddr string
+
+func (da dummyAddr) Network() string { return "tcp" }
+func (da dummyAddr) String() string  { return string(da) }
+
+type dummyConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (dc *dummyConn) RemoteAddr() net.Addr { return dc.remoteAddr }
+func (dc *dummyConn) LocalAddr() net.Addr  { return dummyAddr("10.0.0.1:5432") }
+
+func Test_MatchExpression_Match(t *testing.T) {
+	type test struct {
+		expr         string
+		remoteAddr   string
+		placeholders map[string]any
+		shouldMatch  bool
+	}
+
+	vars := map[string]any{
+		"l4.tls.server_name":   "db.example.com",
+		"l4.postgres.database": "billing",
+		"l4.postgres.user":     "reporting",
+		"l4.ntp.version":       4,
+	}
+
+	tests := []test{
+		{expr: `remote_ip == "192.168.1.10"`, remoteAddr: "192.168.1.10:50000", shouldMatch: true},
+		{expr: `remote_ip == "192.168.1.10"`, remoteAddr: "192.168.1.11:50000", shouldMatch: false},
+		{expr: `remote_ip.startsWith("192.168.") && local_ip == "10.0.0.1"`, remoteAddr: "192.168.1.10:50000", shouldMatch: true},
+		{expr: `{l4.tls.server_name}.endsWith(".example.com") && {l4.postgres.database} == "billing"`,
+			remoteAddr: "192.168.1.10:50000", placeholders: vars, shouldMatch: true},
+		{expr: `{l4.tls.server_name}.endsWith(".example.com") && {l4.postgres.database} == "orders"`,
+			remoteAddr: "192.168.1.10:50000", placeholders: vars, shouldMatch: false},
+		{expr: `{l4.postgres.user} in ["admin", "reporting"] || remote_ip == "127.0.0.1"`,
+			remoteAddr: "192.168.1.10:50000", placeholders: vars, shouldMatch: true},
+		{expr: `ph(connection, "l4.postgres.user") == "admin" || remote_ip == "127.0.0.1"`,
+			remoteAddr: "127.0.0.1:50000", placeholders: vars, shouldMatch: true},
+		{expr: `{l4.ntp.version} >= 4 && !{l4.postgres.database}.contains("test")`,
+			remoteAddr: "192.168.1.10:50000", placeholders: vars, shouldMatch: true},
+		{expr: `{l4.conn.remote_addr} == "192.168.1.10:50000"`, remoteAddr: "192.168.1.10:50000", shouldMatch: true},
+
+		// unset placeholders are empty strings
+		{expr: `{l4.tls.server_name} == ""`, remoteAddr: "192.168.1.10:50000", shouldMatch: true},
+		{expr: `{l4.tls.server_name}.endsWith(".example.com")`, remoteAddr: "192.168.1.10:50000", shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			m := &MatchExpression{Expr: tc.expr}
+			err := m.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_ = in.Close()
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(&dummyConn{Conn: out, remoteAddr: dummyAddr(tc.remoteAddr)}, []byte{}, zap.NewNop())
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, value := range tc.placeholders {
+				repl.Set(name, value)
+			}
+
+			matched, err := m.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.expr)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.expr)
+				}
+			}
+		}()
+	}
+}
+
+func Test_MatchExpression_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, expr := range []string{
+		``,
+		`remote_ip ==`,
+		`unknown_var == "x"`,
+		`remote_ip`,
+		`{l4.tls.server_name}.size()`,
+	} {
+		m := &MatchExpression{Expr: expr}
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("invalid expression should not be accepted: %q", expr)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4extauthz allows the L4 multiplexing of connections based on decisions of an external policy service
+package l4extauthz
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchExtAuthz{})
+}
+
+// MatchExtAuthz is able to match connections allowed by an external policy service. For each connection,
+// it POSTs a JSON object with the client's and the server's IP and port, the client's SNI (if a tls matcher
+// has already set {l4.tls.server_name}) and the configured vars to the endpoint. The connection is allowed,
+// i.e. matched, if the service responds with any 2xx status code, and denied if it responds with 401 or 403.
+// Any other status code, as well as a timeout or a connection failure, is an error handled according to OnError.
+//
+// The request body looks like this:
+//
+//	{
+//		"remote_ip": "192.0.2.1",
+//		"remote_port": 51234,
+//		"local_ip": "198.51.100.1",
+//		"local_port": 443,
+//		"server_name": "example.com",
+//		"vars": {"l4.http.host": "example.com"}
+//	}
+type MatchExtAuthz struct {
+	// Endpoint is the HTTP or HTTPS URL of the policy service.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Timeout is how long to wait for a decision. Defaults to 1s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// OnError is the decision made when the policy service fails: allow or deny. Defaults to deny.
+	OnError string `json:"on_error,omitempty"`
+
+	// CacheTTL is how long decisions are cached for connections having the same metadata.
+	// Decisions aren't cached by default. Errors are never cached.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// Vars is a list of placeholders, e.g. l4.http.host, which values are sent
+	// to the policy service. Placeholders without a value are omitted.
+	Vars []string `json:"vars,omitempty"`
+
+	allowOnError bool
+	client       *http.Client
+	logger       *zap.Logger
+
+	mu    sync.Mutex
+	cache map[string]cachedDecision
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchExtAuthz) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.ext_authz",
+		New: func() caddy.Module { return new(MatchExtAuthz) },
+	}
+}
+
+// Match returns true if the connection is allowed by the policy service.
+func (m *MatchExtAuthz) Match(cx *layer4.Connection) (bool, error) {
+	body, err := json.Marshal(m.buildRequest(cx))
+	if err != nil {
+		return false, fmt.Errorf("encoding request: %w", err)
+	}
+
+	key := string(body)
+	if allow, ok := m.getCachedDecision(key); ok {
+		return allow, nil
+	}
+
+	allow, err := m.requestDecision(cx, body)
+	if err != nil {
+		m.logger.Error("requesting decision",
+			zap.String("remote", cx.RemoteAddr().String()),
+			zap.Error(err),
+			zap.Bool("allow", m.allowOnError),
+		)
+		return m.allowOnError, nil
+	}
+
+	m.setCachedDecision(key, allow)
+	return allow, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchExtAuthz) Provision(ctx caddy.Context) error {
+	if len(m.Endpoint) == 0 {
+		return errors.New("no endpoint")
+	}
+	u, err := url.Parse(m.Endpoint)
+	if err != nil {
+		return fmt.Errorf("parsing endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+		return fmt.Errorf("invalid endpoint '%s': an absolute HTTP or HTTPS URL is required", m.Endpoint)
+	}
+
+	switch m.OnError {
+	case "", onErrorDeny:
+		m.allowOnError = false
+	case onErrorAllow:
+		m.allowOnError = true
+	default:
+		return fmt.Errorf("invalid on_error value '%s'", m.OnError)
+	}
+
+	if m.Timeout < 0 || m.CacheTTL < 0 {
+		return errors.New("negative durations are not supported")
+	}
+	if m.Timeout == 0 {
+		m.Timeout = caddy.Duration(defaultTimeout)
+	}
+
+	m.client = &http.Client{Timeout: time.Duration(m.Timeout)}
+	m.cache = make(map[string]cachedDecision)
+	m.logger = ctx.Logger(m)
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchExtAuthz from Caddyfile tokens. Syntax:
+//
+//	ext_authz [<endpoint>] {
+//		endpoint <url>
+//		timeout <duration>
+//		on_error <allow|deny>
+//		cache_ttl <duration>
+//		vars <placeholders...>
+//	}
+//
+// Note: 'vars' option may be repeated.
+func (m *MatchExtAuthz) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line option is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+
+	var hasEndpoint, hasTimeout, hasOnError, hasCacheTTL bool
+	if d.NextArg() {
+		m.Endpoint, hasEndpoint = d.Val(), true
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "endpoint":
+			if hasEndpoint {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			m.Endpoint, hasEndpoint = d.Val(), true
+		case "timeout":
+			if hasTimeout {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			m.Timeout, hasTimeout = caddy.Duration(dur), true
+		case "cache_ttl":
+			if hasCacheTTL {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			m.CacheTTL, hasCacheTTL = caddy.Duration(dur), true
+		case "on_error":
+			if hasOnError {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			if d.Val() != onErrorAllow && d.Val() != onErrorDeny {
+				return d.Errf("invalid %s option '%s' value '%s'", wrapper, optionName, d.Val())
+			}
+			m.OnError, hasOnError = d.Val(), true
+		case "vars":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.Vars = append(m.Vars, d.RemainingArgs()...)
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// buildRequest returns the metadata of cx sent to the policy service.
+func (m *MatchExtAuthz) buildRequest(cx *layer4.Connection) *request {
+	req := &request{}
+	req.RemoteIP, req.RemotePort = splitAddr(cx.RemoteAddr())
+	req.LocalIP, req.LocalPort = splitAddr(cx.LocalAddr())
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	req.ServerName, _ = repl.GetString("l4.tls.server_name")
+	for _, name := range m.Vars {
+		if val, ok := repl.GetString(name); ok {
+			if req.Vars == nil {
+				req.Vars = make(map[string]string, len(m.Vars))
+			}
+			req.Vars[name] = val
+		}
+	}
+
+	return req
+}
+
+// requestDecision sends body to the policy service and returns true if the connection is allowed.
+func (m *MatchExtAuthz) requestDecision(cx *layer4.Connection, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(cx.Context, http.MethodPost, m.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxDiscardedBytes))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
+
+// getCachedDecision returns the decision cached for key, if it hasn't expired yet.
+func (m *MatchExtAuthz) getCachedDecision(key string) (allow bool, ok bool) {
+	if m.CacheTTL == 0 {
+		return false, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+	return entry.allow, true
+}
+
+// setCachedDecision caches allow for key. Once the cache grows too large,
+// expired decisions are purged, and all of them if none has expired.
+func (m *MatchExtAuthz) setCachedDecision(key string, allow bool) {
+	if m.CacheTTL == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if len(m.cache) >= maxCachedDecisions {
+		for k, entry := range m.cache {
+			if now.After(entry.expires) {
+				delete(m.cache, k)
+			}
+		}
+		if len(m.cache) >= maxCachedDecisions {
+			clear(m.cache)
+		}
+	}
+	m.cache[key] = cachedDecision{allow: allow, expires: now.Add(time.Duration(m.CacheTTL))}
+}
+
+// splitAddr returns the IP and port of addr, or zero values if it has none.
+func splitAddr(addr net.Addr) (string, int) {
+	if addr == nil {
+		return "", 0
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// request is the JSON object sent to the policy service.
+type request struct {
+	RemoteIP   string            `json:"remote_ip"`
+	RemotePort int               `json:"remote_port"`
+	LocalIP    string            `json:"local_ip"`
+	LocalPort  int               `json:"local_port"`
+	ServerName string            `json:"server_name,omitempty"`
+	Vars       map[string]string `json:"vars,omitempty"`
+}
+
+// cachedDecision is a decision of the policy service cached until it expires.
+type cachedDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+const (
+	onErrorAllow = "allow"
+	onErrorDeny  = "deny"
+
+	defaultTimeout     = time.Second
+	maxCachedDecisions = 10000
+	maxDiscardedBytes  = 4096
+)
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchExtAuthz)(nil)
+	_ caddyfile.Unmarshaler = (*MatchExtAuthz)(nil)
+	_ layer4.ConnMatcher    = (*MatchExtAuthz)(nil)
+)
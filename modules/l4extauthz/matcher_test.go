@@ -0,0 +1,187 @@
+package l4extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// newPolicyServer returns a fake policy service deciding by the value of the l4.test.decision var,
+// and a counter of the requests it has received.
+func newPolicyServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	requests := &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var req request
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Vars["l4.test.decision"] {
+		case "allow":
+			w.WriteHeader(http.StatusNoContent)
+		case "deny":
+			w.WriteHeader(http.StatusForbidden)
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+// provisionExtAuthz provisions m and returns it.
+func provisionExtAuthz(t *testing.T, m *MatchExtAuthz) *MatchExtAuthz {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	err := m.Provision(ctx)
+	assertNoError(t, err)
+	return m
+}
+
+// matchExtAuthz matches a connection having the given decision var with a provisioned m.
+func matchExtAuthz(t *testing.T, m *MatchExtAuthz, decision string) bool {
+	in, out := net.Pipe()
+	defer func() {
+		_ = in.Close()
+		_ = out.Close()
+	}()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.test.decision", decision)
+
+	matched, err := m.Match(cx)
+	assertNoError(t, err)
+	return matched
+}
+
+func Test_MatchExtAuthz_Match(t *testing.T) {
+	srv, _ := newPolicyServer(t)
+
+	type test struct {
+		matcher     *MatchExtAuthz
+		decision    string
+		shouldMatch bool
+	}
+
+	tests := []test{
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}}, decision: "allow", shouldMatch: true},
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}}, decision: "deny", shouldMatch: false},
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}}, decision: "error", shouldMatch: false},
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}, OnError: onErrorDeny}, decision: "error", shouldMatch: false},
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}, OnError: onErrorAllow}, decision: "error", shouldMatch: true},
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}, OnError: onErrorAllow}, decision: "deny", shouldMatch: false},
+
+		// timeouts are errors
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}, Timeout: caddy.Duration(50 * time.Millisecond)}, decision: "slow", shouldMatch: false},
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}, Timeout: caddy.Duration(50 * time.Millisecond), OnError: onErrorAllow}, decision: "slow", shouldMatch: true},
+
+		// the decision var isn't sent if it isn't configured
+		{matcher: &MatchExtAuthz{Endpoint: srv.URL}, decision: "allow", shouldMatch: false},
+	}
+
+	for i, tc := range tests {
+		if matched := matchExtAuthz(t, provisionExtAuthz(t, tc.matcher), tc.decision); matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+			}
+		}
+	}
+}
+
+func Test_MatchExtAuthz_Match_Unreachable(t *testing.T) {
+	srv, _ := newPolicyServer(t)
+	srv.Close()
+
+	if matchExtAuthz(t, provisionExtAuthz(t, &MatchExtAuthz{Endpoint: srv.URL}), "allow") {
+		t.Fatalf("matcher should not match when the policy service is unreachable")
+	}
+	if !matchExtAuthz(t, provisionExtAuthz(t, &MatchExtAuthz{Endpoint: srv.URL, OnError: onErrorAllow}), "deny") {
+		t.Fatalf("matcher did not match when the policy service is unreachable")
+	}
+}
+
+func Test_MatchExtAuthz_Match_Cache(t *testing.T) {
+	srv, requests := newPolicyServer(t)
+
+	// decisions are cached
+	m := provisionExtAuthz(t, &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}, CacheTTL: caddy.Duration(time.Minute)})
+	for range 3 {
+		if !matchExtAuthz(t, m, "allow") {
+			t.Fatalf("matcher did not match")
+		}
+		if matchExtAuthz(t, m, "deny") {
+			t.Fatalf("matcher should not match")
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("unexpected number of requests | got %d, want %d\n", n, 2)
+	}
+
+	// errors aren't cached
+	requests.Store(0)
+	for range 3 {
+		if matchExtAuthz(t, m, "error") {
+			t.Fatalf("matcher should not match")
+		}
+	}
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("unexpected number of requests | got %d, want %d\n", n, 3)
+	}
+
+	// decisions expire
+	requests.Store(0)
+	m = provisionExtAuthz(t, &MatchExtAuthz{Endpoint: srv.URL, Vars: []string{"l4.test.decision"}, CacheTTL: caddy.Duration(time.Millisecond)})
+	for range 2 {
+		if !matchExtAuthz(t, m, "allow") {
+			t.Fatalf("matcher did not match")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("unexpected number of requests | got %d, want %d\n", n, 2)
+	}
+}
+
+func Test_MatchExtAuthz_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchExtAuthz{
+		{},
+		{Endpoint: "policy.machine.local:8080"},
+		{Endpoint: "ftp://policy.machine.local/"},
+		{Endpoint: "http://policy.machine.local/", OnError: "ignore"},
+		{Endpoint: "http://policy.machine.local/", Timeout: -1},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid config should not be accepted | %+v\n", i, m)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4gearman allows the L4 multiplexing of Gearman connections
+package l4gearman
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchGearman{})
+	layer4.RegisterProtocol("gearman")
+}
+
+const headerLength = 12 // Size of Magic, Type and Size fields (bytes)
+
+// magicRequest is the magic code of packets sent by clients and workers.
+var magicRequest = []byte("\x00REQ")
+
+// requestTypes maps the types of packets sent by clients and workers to their names.
+var requestTypes = map[uint32]string{
+	1:  "CAN_DO",
+	2:  "CANT_DO",
+	3:  "RESET_ABILITIES",
+	4:  "PRE_SLEEP",
+	7:  "SUBMIT_JOB",
+	9:  "GRAB_JOB",
+	12: "WORK_STATUS",
+	13: "WORK_COMPLETE",
+	14: "WORK_FAIL",
+	15: "GET_STATUS",
+	16: "ECHO_REQ",
+	18: "SUBMIT_JOB_BG",
+	21: "SUBMIT_JOB_HIGH",
+	22: "SET_CLIENT_ID",
+	23: "CAN_DO_TIMEOUT",
+	24: "ALL_YOURS",
+	25: "WORK_EXCEPTION",
+	26: "OPTION_REQ",
+	28: "WORK_DATA",
+	29: "WORK_WARNING",
+	30: "GRAB_JOB_UNIQ",
+	32: "SUBMIT_JOB_HIGH_BG",
+	33: "SUBMIT_JOB_LOW",
+	34: "SUBMIT_JOB_LOW_BG",
+	35: "SUBMIT_JOB_SCHED",
+	36: "SUBMIT_JOB_EPOCH",
+	37: "SUBMIT_REDUCE_JOB",
+	38: "SUBMIT_REDUCE_JOB_BACKGROUND",
+	39: "GRAB_JOB_ALL",
+	41: "GET_STATUS_UNIQUE",
+}
+
+// MatchGearman is able to match Gearman connections of clients and workers by the header of their first
+// packet, i.e. the \0REQ magic code followed by a known request type. The name of the request type,
+// e.g. SUBMIT_JOB or CAN_DO, is exposed as {l4.gearman.type}. Note: the administrative text protocol
+// sharing the port isn't matched.
+type MatchGearman struct {
+	// Types is an optional list of request type names to match, e.g. SUBMIT_JOB or CAN_DO.
+	// Any request type is matched if empty.
+	Types []string `json:"types,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchGearman) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.gearman",
+		New: func() caddy.Module { return new(MatchGearman) },
+	}
+}
+
+// Match returns true if the connection starts with a Gearman request packet.
+func (m *MatchGearman) Match(cx *layer4.Connection) (bool, error) {
+	// Read the packet header
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for Gearman
+		}
+		return false, fmt.Errorf("reading packet header: %w", err)
+	}
+
+	// Validate Magic and Type; Size is arbitrary, since jobs may carry any data
+	if !bytes.Equal(header[:4], magicRequest) {
+		return false, nil
+	}
+	name, ok := requestTypes[binary.BigEndian.Uint32(header[4:8])]
+	if !ok || len(m.Types) > 0 && !slices.Contains(m.Types, name) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.gearman.type", name)
+	cx.SetProtocol("gearman")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchGearman) Provision(_ caddy.Context) error {
+	for _, name := range m.Types {
+		if !isKnownType(name) {
+			return fmt.Errorf("unsupported request type %s", name)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchGearman from Caddyfile tokens. Syntax:
+//
+//	gearman [<types...>]
+func (m *MatchGearman) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Types = append(m.Types, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// isKnownType returns true if name is one of the values of requestTypes.
+func isKnownType(name string) bool {
+	for _, n := range requestTypes {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Refs:
+//
+//	https://gearman.org/protocol/
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchGearman)(nil)
+	_ caddyfile.Unmarshaler = (*MatchGearman)(nil)
+	_ layer4.ConnMatcher    = (*MatchGearman)(nil)
+)
@@ -0,0 +1,109 @@
+package l4gearman
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// submitJob is a SUBMIT_JOB request for the reverse function with an empty unique ID and "hello" as data.
+var submitJob = []byte("\x00REQ\x00\x00\x00\x07\x00\x00\x00\x0Dreverse\x00\x00hello")
+
+// canDo is a CAN_DO request for the reverse function.
+var canDo = []byte("\x00REQ\x00\x00\x00\x01\x00\x00\x00\x07reverse")
+
+func Test_MatchGearman_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchGearman
+		data        []byte
+		shouldMatch bool
+		packetType  string
+	}
+
+	tests := []test{
+		{matcher: &MatchGearman{}, data: submitJob, shouldMatch: true, packetType: "SUBMIT_JOB"},
+		{matcher: &MatchGearman{}, data: canDo, shouldMatch: true, packetType: "CAN_DO"},
+		{matcher: &MatchGearman{}, data: []byte("\x00REQ\x00\x00\x00\x10\x00\x00\x00\x00"), shouldMatch: true, packetType: "ECHO_REQ"},
+		{matcher: &MatchGearman{Types: []string{"SUBMIT_JOB", "SUBMIT_JOB_BG"}}, data: submitJob, shouldMatch: true, packetType: "SUBMIT_JOB"},
+		{matcher: &MatchGearman{Types: []string{"SUBMIT_JOB"}}, data: canDo, shouldMatch: false},
+
+		// the header is enough to match, but it must be complete
+		{matcher: &MatchGearman{}, data: submitJob[:headerLength], shouldMatch: true, packetType: "SUBMIT_JOB"},
+		{matcher: &MatchGearman{}, data: submitJob[:headerLength-1], shouldMatch: false},
+
+		// responses and unknown request types aren't matched
+		{matcher: &MatchGearman{}, data: []byte("\x00RES\x00\x00\x00\x08\x00\x00\x00\x04H:01"), shouldMatch: false},
+		{matcher: &MatchGearman{}, data: []byte("\x00REQ\x00\x00\x00\x05\x00\x00\x00\x00"), shouldMatch: false},
+		{matcher: &MatchGearman{}, data: []byte("\x00REQ\x00\x00\x00\x08\x00\x00\x00\x00"), shouldMatch: false},
+		{matcher: &MatchGearman{}, data: []byte("\x00REQ\x00\x00\x01\x07\x00\x00\x00\x00"), shouldMatch: false},
+
+		// unrelated bytes aren't matched
+		{matcher: &MatchGearman{}, data: []byte("put 0 0 120 5\r\nhello\r\n"), shouldMatch: false},
+		{matcher: &MatchGearman{}, data: []byte("status\n"), shouldMatch: false},
+		{matcher: &MatchGearman{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchGearman{}, data: []byte{}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if got, _ := repl.GetString("l4.gearman.type"); got != tc.packetType {
+				t.Fatalf("test %d: unexpected type | got %q, want %q\n", i, got, tc.packetType)
+			}
+		}()
+	}
+}
+
+func Test_MatchGearman_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchGearman{Types: []string{"JOB_CREATED"}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported request type should not be accepted")
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4geoblock allows rejecting connections from denied countries with a protocol-appropriate response
+package l4geoblock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler is a connection handler that enforces geofencing. Connections from denied countries
+// receive a block response matching the protocol the connection has been tagged with by a matcher
+// (see layer4.Connection.SetProtocol) and are closed; all other connections are passed on to the
+// next handler. Currently, an ErrorResponse is sent to PostgreSQL clients and a 403 response to
+// HTTP/1.x clients. Connections of any other protocol are closed without a response.
+//
+// The handler doesn't resolve countries itself: it reads the client's ISO 3166-1 alpha-2 country
+// code from a placeholder which must be populated by a GeoIP module earlier in the chain.
+type Handler struct {
+	// Deny is a list of ISO 3166-1 alpha-2 country codes, e.g. RU or CN.
+	Deny []string `json:"deny,omitempty"`
+
+	// Country is the placeholder holding the client's country code, e.g.
+	// `{l4.geoip.country_code}`, depending on the GeoIP module. Required.
+	// Connections with an empty or unknown country code are never blocked.
+	Country string `json:"country,omitempty"`
+
+	// Message is included in the block response where the protocol allows it.
+	// Defaults to "access denied".
+	Message string `json:"message,omitempty"`
+
+	deny   map[string]struct{}
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.geoblock",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the module.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	if len(h.Deny) == 0 {
+		return errors.New("no denied countries")
+	}
+
+	repl := caddy.NewReplacer()
+	h.deny = make(map[string]struct{}, len(h.Deny))
+	for _, country := range h.Deny {
+		country = strings.ToUpper(repl.ReplaceAll(country, ""))
+		if !isCountryCode(country) {
+			return fmt.Errorf("invalid country code '%s'", country)
+		}
+		h.deny[country] = struct{}{}
+	}
+
+	if len(h.Country) == 0 {
+		return errors.New("no country placeholder")
+	}
+	if len(h.Message) == 0 {
+		h.Message = defaultMessage
+	}
+
+	h.logger = ctx.Logger(h)
+	return nil
+}
+
+// Handle handles the connections.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	country := strings.ToUpper(repl.ReplaceAll(h.Country, ""))
+	if _, denied := h.deny[country]; !denied {
+		return next.Handle(cx)
+	}
+
+	protocol := cx.Protocol()
+	h.logger.Debug("blocked",
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.String("country", country),
+		zap.String("protocol", protocol),
+	)
+
+	var response []byte
+	switch protocol {
+	case "http":
+		response = httpForbidden(h.Message)
+	case "postgres":
+		response = postgresErrorResponse(h.Message)
+	}
+	if len(response) > 0 {
+		if _, err := cx.Write(response); err != nil {
+			return fmt.Errorf("writing block response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	geoblock {
+//		deny <countries...>
+//		country <placeholder>
+//		message <text>
+//	}
+//
+// Note: 'deny' option may be repeated.
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasCountry, hasMessage bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "deny":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			h.Deny = append(h.Deny, d.RemainingArgs()...)
+		case "country":
+			if hasCountry {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			h.Country, hasCountry = d.Val(), true
+		case "message":
+			if hasMessage {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			h.Message, hasMessage = d.Val(), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// httpForbidden returns an HTTP/1.1 403 response with the given message as its body.
+func httpForbidden(message string) []byte {
+	body := message + "\n"
+	return []byte("HTTP/1.1 403 Forbidden\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n" +
+		"\r\n" + body)
+}
+
+// postgresErrorResponse returns a FATAL ErrorResponse message with the given message and
+// SQLSTATE 28000 (invalid_authorization_specification). Clients accept it both in reply to
+// a StartupMessage and to an SSLRequest.
+func postgresErrorResponse(message string) []byte {
+	var fields []byte
+	for _, field := range [][2]string{
+		{"S", "FATAL"},
+		{"V", "FATAL"},
+		{"C", "28000"},
+		{"M", message},
+	} {
+		fields = append(fields, field[0][0])
+		fields = append(fields, field[1]...)
+		fields = append(fields, 0)
+	}
+	fields = append(fields, 0)
+
+	response := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(response[1:], uint32(4+len(fields)))
+	return append(response, fields...)
+}
+
+// isCountryCode returns true if s consists of 2 upper case ASCII letters.
+func isCountryCode(s string) bool {
+	return len(s) == 2 && s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
+
+const (
+	defaultMessage = "access denied"
+)
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
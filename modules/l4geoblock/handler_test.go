@@ -0,0 +1,177 @@
+package l4geoblock
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+	_ "github.com/mholt/caddy-l4/modules/l4http"
+	_ "github.com/mholt/caddy-l4/modules/l4postgres"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func buildStartupMessage(params map[string]string) []byte {
+	payload := []byte{0x00, 0x03, 0x00, 0x00}
+	for k, v := range params {
+		payload = append(payload, k...)
+		payload = append(payload, 0)
+		payload = append(payload, v...)
+		payload = append(payload, 0)
+	}
+	payload = append(payload, 0)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(4+len(payload))), payload...)
+}
+
+func TestHandler(t *testing.T) {
+	startup := buildStartupMessage(map[string]string{"user": "test"})
+	sslRequest := []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}
+	request := []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	pgErrorResponse := []byte("E\x00\x00\x00\x29SFATAL\x00VFATAL\x00C28000\x00Maccess denied\x00\x00")
+	httpForbiddenResponse := []byte("HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: 14\r\nConnection: close\r\n\r\naccess denied\n")
+
+	tests := []struct {
+		name         string
+		matcher      caddy.ModuleMap
+		country      string
+		input        []byte
+		wantResponse []byte
+		wantNext     bool
+	}{
+		{
+			name:         "Postgres, Denied",
+			matcher:      caddy.ModuleMap{"postgres": json.RawMessage("{}")},
+			country:      "RU",
+			input:        startup,
+			wantResponse: pgErrorResponse,
+		},
+		{
+			name:         "Postgres SSLRequest, Denied",
+			matcher:      caddy.ModuleMap{"postgres": json.RawMessage("{}")},
+			country:      "CN",
+			input:        sslRequest,
+			wantResponse: pgErrorResponse,
+		},
+		{
+			name:         "Postgres, Allowed",
+			matcher:      caddy.ModuleMap{"postgres": json.RawMessage("{}")},
+			country:      "DE",
+			input:        startup,
+			wantResponse: []byte{},
+			wantNext:     true,
+		},
+		{
+			name:         "HTTP, Denied",
+			matcher:      caddy.ModuleMap{"http": json.RawMessage("[]")},
+			country:      "cn",
+			input:        request,
+			wantResponse: httpForbiddenResponse,
+		},
+		{
+			name:         "HTTP, Allowed",
+			matcher:      caddy.ModuleMap{"http": json.RawMessage("[]")},
+			country:      "US",
+			input:        request,
+			wantResponse: []byte{},
+			wantNext:     true,
+		},
+		{
+			name:         "Untagged, Denied",
+			matcher:      caddy.ModuleMap{},
+			country:      "RU",
+			input:        []byte("SSH-2.0-OpenSSH_9.6\r\n"),
+			wantResponse: []byte{},
+		},
+		{
+			name:         "Unknown Country",
+			matcher:      caddy.ModuleMap{"postgres": json.RawMessage("{}")},
+			country:      "",
+			input:        startup,
+			wantResponse: []byte{},
+			wantNext:     true,
+		},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			repl.Set("l4.geoip.country_code", tc.country)
+
+			received := make(chan []byte, 1)
+			go func() {
+				// the write fails if the connection is closed before all of the input is read
+				_, _ = in.Write(tc.input)
+				data, _ := io.ReadAll(in)
+				received <- data
+			}()
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			routes := layer4.RouteList{&layer4.Route{
+				MatcherSetsRaw: []caddy.ModuleMap{tc.matcher},
+				HandlersRaw:    []json.RawMessage{json.RawMessage(`{"handler":"geoblock","deny":["RU","CN"],"country":"{l4.geoip.country_code}"}`)},
+			}}
+			err := routes.Provision(ctx)
+			assertNoError(t, err)
+
+			var nextCalled bool
+			compiledRoute := routes.Compile(zap.NewNop(), 100*time.Millisecond,
+				layer4.HandlerFunc(func(con *layer4.Connection) error {
+					nextCalled = true
+					return nil
+				}))
+
+			err = compiledRoute.Handle(cx)
+			assertNoError(t, err)
+			_ = cx.Close()
+
+			if nextCalled != tc.wantNext {
+				t.Fatalf("test %d: unexpected next handler call | got %t, want %t\n", i, nextCalled, tc.wantNext)
+			}
+
+			if response := <-received; !bytes.Equal(response, tc.wantResponse) {
+				t.Fatalf("test %d: unexpected response | got %q, want %q\n", i, response, tc.wantResponse)
+			}
+		})
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	const country = "{l4.geoip.country_code}"
+	if err := (&Handler{Deny: []string{"ru", "CN"}, Country: country}).Provision(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, deny := range [][]string{nil, {"RUS"}, {"R1"}} {
+		if err := (&Handler{Deny: deny, Country: country}).Provision(ctx); err == nil {
+			t.Fatalf("expected an error for %v", deny)
+		}
+	}
+	if err := (&Handler{Deny: []string{"RU"}}).Provision(ctx); err == nil {
+		t.Fatalf("expected an error without a country placeholder")
+	}
+}
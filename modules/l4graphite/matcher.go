@@ -0,0 +1,216 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4graphite allows the L4 multiplexing of Graphite (Carbon) connections
+package l4graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchGraphite{})
+	layer4.RegisterProtocol("graphite")
+}
+
+const (
+	protocolPlaintext = "plaintext"
+	protocolPickle    = "pickle"
+
+	maxLineLength          = 4096    // Maximum length of a plaintext metric line, including the line ending
+	pickleHeaderLen        = 4       // Length of the length prefix of pickle frames
+	minPickleLength        = 3       // Length of the smallest pickle stream, e.g. an empty list: ].
+	maxPickleLength        = 1 << 20 // Maximum length of pickle frames accepted by Carbon
+	maxCheckedPickleLength = 4096    // Maximum length of pickle frames read entirely to check their end
+	pickleProto            = 0x80    // Opcode of the protocol version of pickle streams (protocol 2+)
+	pickleMark             = '('     // Opcode starting protocol 0 lists
+	pickleEmptyList        = ']'     // Opcode starting protocol 1 lists
+	pickleStop             = '.'     // Opcode ending pickle streams
+)
+
+// MatchGraphite is able to match Graphite connections, i.e. metrics sent to Carbon with either the plaintext
+// protocol, which consists of lines like "metric.path value timestamp", or the pickle protocol, which consists
+// of frames made of a 4-byte length prefix and a pickled list of metrics. The former is recognized by a valid
+// metric line, the latter by a plausible length and the opening of a pickle stream, and short frames must end
+// with the pickle STOP opcode too. The matched protocol (plaintext or pickle) is exposed as {l4.graphite.protocol}.
+type MatchGraphite struct {
+	// Protocols is an optional list of protocols to match: plaintext or pickle. If empty, both are matched.
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchGraphite) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.graphite",
+		New: func() caddy.Module { return new(MatchGraphite) },
+	}
+}
+
+// Match returns true if the connection starts with a Graphite plaintext line or pickle frame.
+func (m *MatchGraphite) Match(cx *layer4.Connection) (bool, error) {
+	// Read the first byte to tell the protocols apart: pickle frames are much shorter than 16 MiB,
+	// so their length prefix starts with a zero byte, unlike plaintext lines
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(cx, first); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for Graphite
+		}
+		return false, fmt.Errorf("reading first byte: %w", err)
+	}
+
+	protocol := protocolPlaintext
+	if first[0] == 0x00 {
+		protocol = protocolPickle
+	}
+	if len(m.Protocols) > 0 && !slices.Contains(m.Protocols, protocol) {
+		return false, nil
+	}
+
+	var matched bool
+	var err error
+	if protocol == protocolPickle {
+		matched, err = matchPickle(cx, first)
+	} else {
+		matched, err = matchPlaintext(cx, first)
+	}
+	if err != nil || !matched {
+		return false, err
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.graphite.protocol", protocol)
+	cx.SetProtocol("graphite")
+
+	return true, nil
+}
+
+// Provision validates m's protocols.
+func (m *MatchGraphite) Provision(_ caddy.Context) error {
+	for _, protocol := range m.Protocols {
+		if protocol != protocolPlaintext && protocol != protocolPickle {
+			return fmt.Errorf("unsupported protocol '%s'", protocol)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchGraphite from Caddyfile tokens. Syntax:
+//
+//	graphite [<plaintext|pickle>]
+func (m *MatchGraphite) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Protocols = append(m.Protocols, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// matchPlaintext returns true if the connection continues with a metric line: a path, a value and a timestamp
+// separated by whitespace and terminated by LF (or CRLF).
+func matchPlaintext(cx *layer4.Connection, first []byte) (bool, error) {
+	r := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(first), io.LimitReader(cx, maxLineLength-1)), maxLineLength)
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return false, nil // Not enough data for a metric line, or a line too long
+		}
+		return false, fmt.Errorf("reading metric line: %w", err)
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	for _, c := range line {
+		if (c < 0x20 || c > 0x7E) && c != '\t' {
+			return false, nil
+		}
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return false, nil
+	}
+	if _, err = strconv.ParseFloat(string(fields[1]), 64); err != nil {
+		return false, nil
+	}
+	if _, err = strconv.ParseFloat(string(fields[2]), 64); err != nil {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// matchPickle returns true if the connection continues with a pickle frame of a plausible length, which
+// opens a pickle stream. Frames short enough are read entirely, and must end with the STOP opcode.
+func matchPickle(cx *layer4.Connection, first []byte) (bool, error) {
+	header := make([]byte, pickleHeaderLen+2)
+	copy(header, first)
+	if _, err := io.ReadFull(cx, header[len(first):]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for the frame header
+		}
+		return false, fmt.Errorf("reading frame header: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length < minPickleLength || length > maxPickleLength {
+		return false, nil
+	}
+
+	// Protocols 2+ start with the PROTO opcode and the version, which is 5 at most,
+	// protocols 0 and 1 with the opening of the list of metrics
+	opcode, version := header[pickleHeaderLen], header[pickleHeaderLen+1]
+	if !(opcode == pickleProto && version >= 2 && version <= 5 || opcode == pickleMark || opcode == pickleEmptyList) {
+		return false, nil
+	}
+
+	if length > maxCheckedPickleLength {
+		return true, nil
+	}
+	rest := make([]byte, length-2)
+	if _, err := io.ReadFull(cx, rest); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for the frame
+		}
+		return false, fmt.Errorf("reading frame: %w", err)
+	}
+	return rest[len(rest)-1] == pickleStop, nil
+}
+
+// Refs:
+//
+//	https://graphite.readthedocs.io/en/latest/feeding-carbon.html
+//	https://github.com/python/cpython/blob/main/Lib/pickletools.py
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchGraphite)(nil)
+	_ caddyfile.Unmarshaler = (*MatchGraphite)(nil)
+	_ layer4.ConnMatcher    = (*MatchGraphite)(nil)
+)
@@ -0,0 +1,123 @@
+package l4graphite
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// pickled metrics, i.e. pickle.dumps([("servers.web01.cpu", (1700000000, 1.5))], protocol=2)
+var pickle2 = []byte("\x80\x02\x5d\x71\x00\x58\x11\x00\x00\x00servers.web01.cpu\x71\x01\x4a\x00\xf1\x53\x65" +
+	"\x47\x3f\xf8\x00\x00\x00\x00\x00\x00\x86\x71\x02\x86\x71\x03\x61\x2e")
+
+// the same metrics pickled with protocol 0
+var pickle0 = []byte("(lp0\n(Vservers.web01.cpu\np1\n(I1700000000\nF1.5\ntp2\ntp3\na.")
+
+// frame prefixes data with its length, or with length if not zero.
+func frame(data []byte, length uint32) []byte {
+	if length == 0 {
+		length = uint32(len(data)) //nolint:gosec // disable G115
+	}
+	return append(binary.BigEndian.AppendUint32(nil, length), data...)
+}
+
+func TestMatchGraphite(t *testing.T) {
+	tests := []struct {
+		name      string
+		matcher   *MatchGraphite
+		input     []byte
+		wantMatch bool
+		protocol  string
+	}{
+		{name: "Plaintext", matcher: &MatchGraphite{}, input: []byte("servers.web01.cpu 1.5 1700000000\n"), wantMatch: true, protocol: "plaintext"},
+		{name: "Plaintext CRLF", matcher: &MatchGraphite{}, input: []byte("servers.web01.cpu 42 1700000000\r\n"), wantMatch: true, protocol: "plaintext"},
+		{name: "Plaintext Tagged", matcher: &MatchGraphite{}, input: []byte("cpu;host=web01 -0.5 -1\nmem;host=web01 3e9 -1\n"), wantMatch: true, protocol: "plaintext"},
+		{name: "Plaintext Allowed", matcher: &MatchGraphite{Protocols: []string{"plaintext"}}, input: []byte("a.b 1 1700000000\n"), wantMatch: true, protocol: "plaintext"},
+		{name: "Plaintext Not Allowed", matcher: &MatchGraphite{Protocols: []string{"pickle"}}, input: []byte("a.b 1 1700000000\n"), wantMatch: false},
+		{name: "Plaintext Truncated", matcher: &MatchGraphite{}, input: []byte("servers.web01.cpu 1.5 1700000000"), wantMatch: false},
+		{name: "Plaintext Missing Timestamp", matcher: &MatchGraphite{}, input: []byte("servers.web01.cpu 1.5\n"), wantMatch: false},
+		{name: "Plaintext Invalid Value", matcher: &MatchGraphite{}, input: []byte("servers.web01.cpu high 1700000000\n"), wantMatch: false},
+		{name: "Plaintext Control Characters", matcher: &MatchGraphite{}, input: []byte("servers.web01\x01cpu 1.5 1700000000\n"), wantMatch: false},
+		{name: "Pickle Protocol 2", matcher: &MatchGraphite{}, input: frame(pickle2, 0), wantMatch: true, protocol: "pickle"},
+		{name: "Pickle Protocol 0", matcher: &MatchGraphite{}, input: frame(pickle0, 0), wantMatch: true, protocol: "pickle"},
+		{name: "Pickle Allowed", matcher: &MatchGraphite{Protocols: []string{"pickle"}}, input: frame(pickle2, 0), wantMatch: true, protocol: "pickle"},
+		{name: "Pickle Not Allowed", matcher: &MatchGraphite{Protocols: []string{"plaintext"}}, input: frame(pickle2, 0), wantMatch: false},
+		{name: "Pickle Large Frame Header", matcher: &MatchGraphite{}, input: frame(pickle2, 64*1024), wantMatch: true, protocol: "pickle"},
+		{name: "Pickle Truncated Frame", matcher: &MatchGraphite{}, input: frame(pickle2[:20], uint32(len(pickle2))), wantMatch: false},
+		{name: "Pickle Missing Stop", matcher: &MatchGraphite{}, input: frame(pickle2[:len(pickle2)-1], 0), wantMatch: false},
+		{name: "Pickle Frame Too Large", matcher: &MatchGraphite{}, input: frame(pickle2, 2<<20), wantMatch: false},
+		{name: "Pickle Frame Too Short", matcher: &MatchGraphite{}, input: frame([]byte("]."), 0), wantMatch: false},
+		{name: "Pickle Unknown Version", matcher: &MatchGraphite{}, input: frame(append([]byte{0x80, 0x06}, pickle2[2:]...), 0), wantMatch: false},
+		{name: "Pickle Not A List", matcher: &MatchGraphite{}, input: frame([]byte("K\x01."), 0), wantMatch: false},
+		{name: "HTTP", matcher: &MatchGraphite{}, input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "Garbage", matcher: &MatchGraphite{}, input: []byte{0x16, 0x03, 0x01, 0x00, 0xa5, 0x01, 0x00, 0x00}, wantMatch: false},
+		{name: "Empty", matcher: &MatchGraphite{}, input: []byte{}, wantMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if protocol, _ := repl.GetString("l4.graphite.protocol"); protocol != tc.protocol {
+				t.Fatalf("test %d: unexpected protocol | got %q, want %q\n", i, protocol, tc.protocol)
+			}
+		})
+	}
+}
+
+func TestMatchGraphite_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchGraphite{Protocols: []string{"protobuf"}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported protocol should not be accepted")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4grpc allows the L4 multiplexing of gRPC connections
+package l4grpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchGRPC{})
+	layer4.RegisterProtocol("grpc")
+}
+
+const (
+	contentType     = "application/grpc" // Content type of gRPC requests, optionally followed by "+proto", "+json", etc.
+	headerTableSize = 4096               // Initial size of the HPACK dynamic table according to RFC 9113
+	maxFrames       = 10                 // Maximum number of frames read to find the first HEADERS frame
+)
+
+// MatchGRPC is able to match gRPC requests made over cleartext HTTP/2 with prior knowledge, i.e. connections
+// starting with the HTTP/2 connection preface and a HEADERS frame of a POST request with a content-type of
+// application/grpc. The path of the request, e.g. /helloworld.Greeter/SayHello, is exposed as {l4.grpc.path},
+// and its service and method parts as {l4.grpc.service} and {l4.grpc.method}. Whether the request is made to
+// the server reflection service is exposed as {l4.grpc.reflection}. Note: gRPC requests over TLS can be
+// matched after the TLS handler has terminated TLS.
+type MatchGRPC struct {
+	// Services is an optional list of fully qualified service names to match, e.g. helloworld.Greeter.
+	// If empty, any service is matched.
+	Services []string `json:"services,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchGRPC) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.grpc",
+		New: func() caddy.Module { return new(MatchGRPC) },
+	}
+}
+
+// Match returns true if the connection starts with a gRPC request.
+func (m *MatchGRPC) Match(cx *layer4.Connection) (bool, error) {
+	req, err := readRequest(cx)
+	if req == nil || err != nil {
+		return false, err
+	}
+	if len(m.Services) > 0 && !slices.Contains(m.Services, req.service) {
+		return false, nil
+	}
+
+	req.expose(cx)
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchGRPC from Caddyfile tokens. Syntax:
+//
+//	grpc [<services...>]
+func (m *MatchGRPC) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Services = append(m.Services, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// request holds the parts of a gRPC request exposed by the matchers.
+type request struct {
+	path    string // e.g. /helloworld.Greeter/SayHello
+	service string // e.g. helloworld.Greeter
+	method  string // e.g. SayHello
+}
+
+// expose tags cx as gRPC and sets the placeholders of req.
+func (req *request) expose(cx *layer4.Connection) {
+	cx.SetProtocol("grpc")
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.grpc.path", req.path)
+	repl.Set("l4.grpc.service", req.service)
+	repl.Set("l4.grpc.method", req.method)
+	repl.Set("l4.grpc.reflection", slices.Contains(reflectionServices, req.service))
+}
+
+// readRequest reads the connection preface and the first HEADERS frame from cx and returns the gRPC request
+// they make, or nil if they don't make one.
+func readRequest(cx *layer4.Connection) (*request, error) {
+	// Read the connection preface
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(cx, preface); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil // Not enough data for HTTP/2
+		}
+		return nil, fmt.Errorf("reading connection preface: %w", err)
+	}
+	if !bytes.Equal(preface, []byte(http2.ClientPreface)) {
+		return nil, nil
+	}
+
+	// Read the frames following the preface until the first HEADERS frame (and its CONTINUATION frames) is
+	// decoded, skipping SETTINGS, WINDOW_UPDATE and PRIORITY frames. Since HPACK is stateful, a fresh decoder
+	// is used, which is valid as long as the HEADERS frame is the first one of the connection.
+	framer := http2.NewFramer(io.Discard, io.LimitReader(cx, layer4.MaxMatchingBytes))
+	framer.ReadMetaHeaders = hpack.NewDecoder(headerTableSize, nil)
+	framer.MaxHeaderListSize = layer4.MaxMatchingBytes
+
+	var headers *http2.MetaHeadersFrame
+	for i := 0; i < maxFrames && headers == nil; i++ {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			if errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+				return nil, fmt.Errorf("reading frame: %w", err)
+			}
+			return nil, nil // Not enough data for a HEADERS frame, or an invalid frame
+		}
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			headers = f
+		case *http2.SettingsFrame, *http2.WindowUpdateFrame, *http2.PriorityFrame:
+			continue
+		default:
+			return nil, nil
+		}
+	}
+	if headers == nil || headers.Truncated {
+		return nil, nil
+	}
+
+	// Validate the method and the content type, and parse the path, i.e. /<service>/<method>
+	path := headers.PseudoValue("path")
+	service, method, found := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if headers.PseudoValue("method") != "POST" || !isGRPCContentType(headers.Fields) ||
+		!strings.HasPrefix(path, "/") || !found || service == "" || method == "" || strings.Contains(method, "/") {
+		return nil, nil
+	}
+
+	return &request{path: path, service: service, method: method}, nil
+}
+
+// isGRPCContentType returns true if fields contain a content-type header of application/grpc
+// or one of its subtypes, e.g. application/grpc+proto.
+func isGRPCContentType(fields []hpack.HeaderField) bool {
+	for _, f := range fields {
+		if f.Name != "content-type" {
+			continue
+		}
+		subtype, found := strings.CutPrefix(strings.ToLower(f.Value), contentType)
+		return found && (subtype == "" || subtype[0] == '+' || subtype[0] == ';')
+	}
+	return false
+}
+
+// Refs:
+//
+//	https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+//	https://www.rfc-editor.org/rfc/rfc9113#section-3.4
+//	https://www.rfc-editor.org/rfc/rfc7541
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchGRPC)(nil)
+	_ layer4.ConnMatcher    = (*MatchGRPC)(nil)
+)
@@ -0,0 +1,216 @@
+package l4grpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// buildRequest returns the connection preface followed by the frames sent by grpc-go before the first
+// request, i.e. SETTINGS and WINDOW_UPDATE, and a HEADERS frame with the given fields. If split is true,
+// the header block is split into a HEADERS frame and a CONTINUATION frame.
+func buildRequest(t *testing.T, split bool, fields ...string) []byte {
+	t.Helper()
+
+	block := &bytes.Buffer{}
+	encoder := hpack.NewEncoder(block)
+	for i := 0; i < len(fields); i += 2 {
+		assertNoError(t, encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]}))
+	}
+
+	b := bytes.NewBufferString(http2.ClientPreface)
+	framer := http2.NewFramer(b, nil)
+	assertNoError(t, framer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 4194304}))
+	assertNoError(t, framer.WriteWindowUpdate(0, 4128769))
+	if split {
+		assertNoError(t, framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes()[:10]}))
+		assertNoError(t, framer.WriteContinuation(1, true, block.Bytes()[10:]))
+	} else {
+		assertNoError(t, framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true}))
+	}
+	return b.Bytes()
+}
+
+func TestMatchGRPC(t *testing.T) {
+	grpcFields := []string{
+		":method", "POST",
+		":scheme", "http",
+		":path", "/helloworld.Greeter/SayHello",
+		":authority", "localhost:50051",
+		"content-type", "application/grpc",
+		"user-agent", "grpc-go/1.64.0",
+		"te", "trailers",
+	}
+	grpcRequest := buildRequest(t, false, grpcFields...)
+
+	tests := []struct {
+		name      string
+		matcher   *MatchGRPC
+		input     []byte
+		wantMatch bool
+		path      string
+		service   string
+		method    string
+	}{
+		{name: "gRPC", matcher: &MatchGRPC{}, input: grpcRequest, wantMatch: true,
+			path: "/helloworld.Greeter/SayHello", service: "helloworld.Greeter", method: "SayHello"},
+		{name: "gRPC Continuation", matcher: &MatchGRPC{}, input: buildRequest(t, true, grpcFields...), wantMatch: true,
+			path: "/helloworld.Greeter/SayHello", service: "helloworld.Greeter", method: "SayHello"},
+		{name: "gRPC Proto", matcher: &MatchGRPC{}, input: buildRequest(t, false,
+			":method", "POST", ":scheme", "http", ":path", "/grpc.health.v1.Health/Check", "content-type", "application/grpc+proto"),
+			wantMatch: true, path: "/grpc.health.v1.Health/Check", service: "grpc.health.v1.Health", method: "Check"},
+		{name: "gRPC Service Allowed", matcher: &MatchGRPC{Services: []string{"helloworld.Greeter"}}, input: grpcRequest, wantMatch: true,
+			path: "/helloworld.Greeter/SayHello", service: "helloworld.Greeter", method: "SayHello"},
+		{name: "gRPC Service Not Allowed", matcher: &MatchGRPC{Services: []string{"grpc.health.v1.Health"}}, input: grpcRequest, wantMatch: false},
+		{name: "gRPC-Web", matcher: &MatchGRPC{}, input: buildRequest(t, false,
+			":method", "POST", ":scheme", "http", ":path", "/helloworld.Greeter/SayHello", "content-type", "application/grpc-web"), wantMatch: false},
+		{name: "gRPC Invalid Path", matcher: &MatchGRPC{}, input: buildRequest(t, false,
+			":method", "POST", ":scheme", "http", ":path", "/helloworld.Greeter", "content-type", "application/grpc"), wantMatch: false},
+		{name: "HTTP/2 GET", matcher: &MatchGRPC{}, input: buildRequest(t, false,
+			":method", "GET", ":scheme", "http", ":path", "/index.html", ":authority", "localhost"), wantMatch: false},
+		{name: "HTTP/2 POST JSON", matcher: &MatchGRPC{}, input: buildRequest(t, false,
+			":method", "POST", ":scheme", "http", ":path", "/api/v1/items", "content-type", "application/json"), wantMatch: false},
+		{name: "Preface Only", matcher: &MatchGRPC{}, input: []byte(http2.ClientPreface), wantMatch: false},
+		{name: "Truncated", matcher: &MatchGRPC{}, input: grpcRequest[:len(grpcRequest)-1], wantMatch: false},
+		{name: "HTTP/1.1", matcher: &MatchGRPC{}, input: []byte("POST /helloworld.Greeter/SayHello HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/grpc\r\n\r\n"), wantMatch: false},
+		{name: "Empty", matcher: &MatchGRPC{}, input: []byte{}, wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			reflection := ""
+			if tc.wantMatch {
+				reflection = "false"
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range map[string]string{
+				"l4.grpc.path":       tc.path,
+				"l4.grpc.service":    tc.service,
+				"l4.grpc.method":     tc.method,
+				"l4.grpc.reflection": reflection,
+			} {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchGRPCReflection(t *testing.T) {
+	// buildReflectionRequest returns a request to the given path made by grpcurl
+	buildReflectionRequest := func(path string) []byte {
+		return buildRequest(t, false,
+			":method", "POST",
+			":scheme", "http",
+			":path", path,
+			":authority", "localhost:50051",
+			"content-type", "application/grpc",
+			"user-agent", "grpcurl/v1.9.1 grpc-go/1.61.0",
+			"te", "trailers",
+		)
+	}
+
+	tests := []struct {
+		name       string
+		matcher    layer4.ConnMatcher
+		input      []byte
+		wantMatch  bool
+		reflection string
+	}{
+		{name: "Reflection v1", matcher: &MatchGRPCReflection{},
+			input: buildReflectionRequest("/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"), wantMatch: true, reflection: "true"},
+		{name: "Reflection v1alpha", matcher: &MatchGRPCReflection{},
+			input: buildReflectionRequest("/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"), wantMatch: true, reflection: "true"},
+		{name: "Method", matcher: &MatchGRPCReflection{},
+			input: buildReflectionRequest("/helloworld.Greeter/SayHello"), wantMatch: false},
+		{name: "Lookalike", matcher: &MatchGRPCReflection{},
+			input: buildReflectionRequest("/grpc.reflection.v2.ServerReflection/ServerReflectionInfo"), wantMatch: false},
+		{name: "HTTP/1.1", matcher: &MatchGRPCReflection{},
+			input: []byte("POST /grpc.reflection.v1.ServerReflection/ServerReflectionInfo HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "gRPC Reflection", matcher: &MatchGRPC{},
+			input: buildReflectionRequest("/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"), wantMatch: true, reflection: "true"},
+		{name: "gRPC Method", matcher: &MatchGRPC{},
+			input: buildReflectionRequest("/helloworld.Greeter/SayHello"), wantMatch: true, reflection: "false"},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if reflection, _ := repl.GetString("l4.grpc.reflection"); reflection != tc.reflection {
+				t.Fatalf("test %d: unexpected reflection | got %q, want %q\n", i, reflection, tc.reflection)
+			}
+		})
+	}
+}
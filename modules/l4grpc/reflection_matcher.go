@@ -0,0 +1,89 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4grpc
+
+import (
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchGRPCReflection{})
+}
+
+// reflectionServices contains the names of the gRPC server reflection service, which is used
+// by clients like grpcurl to discover the services and message types of a server.
+var reflectionServices = []string{"grpc.reflection.v1.ServerReflection", "grpc.reflection.v1alpha.ServerReflection"}
+
+// MatchGRPCReflection is able to match gRPC requests to the server reflection service, e.g. to allow or deny
+// schema discovery separately from other gRPC traffic. It sets the same placeholders as the grpc matcher.
+type MatchGRPCReflection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchGRPCReflection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.grpc_reflection",
+		New: func() caddy.Module { return new(MatchGRPCReflection) },
+	}
+}
+
+// Match returns true if the connection starts with a gRPC request to the server reflection service.
+func (m *MatchGRPCReflection) Match(cx *layer4.Connection) (bool, error) {
+	req, err := readRequest(cx)
+	if req == nil || err != nil {
+		return false, err
+	}
+	if !slices.Contains(reflectionServices, req.service) {
+		return false, nil
+	}
+
+	req.expose(cx)
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchGRPCReflection from Caddyfile tokens. Syntax:
+//
+//	grpc_reflection
+func (m *MatchGRPCReflection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://github.com/grpc/grpc/blob/master/doc/server-reflection.md
+//	https://github.com/grpc/grpc-proto/blob/master/grpc/reflection/v1/reflection.proto
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchGRPCReflection)(nil)
+	_ layer4.ConnMatcher    = (*MatchGRPCReflection)(nil)
+)
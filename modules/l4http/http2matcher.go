@@ -0,0 +1,88 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.org/x/net/http2"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchHTTP2{})
+	layer4.RegisterProtocol("http2")
+}
+
+// MatchHTTP2 is able to match cleartext HTTP/2 (h2c) connections made with prior knowledge, which start
+// with the 24-byte connection preface, i.e. "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n". Unlike MatchHTTP, it only
+// compares the preface and doesn't parse the request following it, so it's cheaper, e.g. to route h2c
+// gRPC separately from HTTP/1.1, but it can't match on request properties, such as the host or path.
+type MatchHTTP2 struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchHTTP2) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.http2",
+		New: func() caddy.Module { return new(MatchHTTP2) },
+	}
+}
+
+// Match returns true if the connection starts with the HTTP/2 connection preface.
+func (m *MatchHTTP2) Match(cx *layer4.Connection) (bool, error) {
+	buf := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for the connection preface
+		}
+		return false, fmt.Errorf("reading connection preface: %w", err)
+	}
+
+	if string(buf) != http2.ClientPreface {
+		return false, nil
+	}
+	cx.SetProtocol("http2")
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchHTTP2 from Caddyfile tokens. Syntax:
+//
+//	http2
+func (m *MatchHTTP2) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchHTTP2)(nil)
+	_ layer4.ConnMatcher    = (*MatchHTTP2)(nil)
+)
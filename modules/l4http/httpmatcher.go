@@ -35,6 +35,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchHTTP{})
+	layer4.RegisterProtocol("http")
 }
 
 // MatchHTTP is able to match HTTP connections. The auto-generated
@@ -120,6 +121,7 @@ func (m *MatchHTTP) Match(cx *layer4.Connection) (bool, error) {
 
 		// remember this for future use
 		cx.SetVar("http_request", req)
+		cx.SetProtocol("http")
 
 		// also add values to the replacer (TODO: we could probably find a way to use the http app's replacer values)
 		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
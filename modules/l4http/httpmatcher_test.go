@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
 
 	"github.com/mholt/caddy-l4/layer4"
 )
@@ -321,3 +323,39 @@ func TestMatchHTTP_isHttp(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchHTTP2(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		data        []byte
+		shouldMatch bool
+	}{
+		{name: "preface", data: []byte(http2.ClientPreface), shouldMatch: true},
+		{name: "preface-and-frames", data: append([]byte(http2.ClientPreface), 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00), shouldMatch: true},
+		{name: "http/1.1", data: []byte("GET /foo/bar?aaa=bbb HTTP/1.1\r\nHost: localhost:10443\r\n\r\n"), shouldMatch: false},
+		{name: "preface-without-body", data: []byte("PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n"), shouldMatch: false},
+		{name: "short-preface", data: []byte(http2.ClientPreface[:len(http2.ClientPreface)-1]), shouldMatch: false},
+		{name: "empty", data: []byte{}, shouldMatch: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := (&MatchHTTP2{}).Match(cx)
+			assertNoError(t, err)
+			if matched != tc.shouldMatch {
+				t.Fatalf("test %v | matched: %v != shouldMatch: %v", tc.name, matched, tc.shouldMatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4idletimeout allows closing L4 connections which stay idle for too long
+package l4idletimeout
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler closes connections once no bytes have been read from them for ReadTimeout, or once writing
+// to them has been blocked for WriteTimeout, e.g. because the peer stopped reading. The deadlines are
+// pushed back on each read or write, so it should come before the handlers using the connection,
+// e.g. proxy, in a route. Note that the timeouts are independent: with a read timeout, a connection
+// is closed while the client only downloads data, even if bytes are being written to it.
+type Handler struct {
+	// How long to wait for bytes to be read from the connection before closing it.
+	ReadTimeout caddy.Duration `json:"read_timeout,omitempty"`
+
+	// How long to wait for bytes to be written to the connection before closing it.
+	WriteTimeout caddy.Duration `json:"write_timeout,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.idle_timeout",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	if h.ReadTimeout < 0 {
+		return fmt.Errorf("read timeout must be at least 0: %s", time.Duration(h.ReadTimeout))
+	}
+	if h.WriteTimeout < 0 {
+		return fmt.Errorf("write timeout must be at least 0: %s", time.Duration(h.WriteTimeout))
+	}
+	if h.ReadTimeout == 0 && h.WriteTimeout == 0 {
+		return fmt.Errorf("no timeout is set")
+	}
+	return nil
+}
+
+// Handle handles the connection.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	return next.Handle(cx.Wrap(&idleConn{
+		Conn:         cx.Conn,
+		logger:       h.logger.Named("conn"),
+		readTimeout:  time.Duration(h.ReadTimeout),
+		writeTimeout: time.Duration(h.WriteTimeout),
+	}))
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	idle_timeout {
+//		read_timeout <duration>
+//		write_timeout <duration>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasReadTimeout, hasWriteTimeout bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "read_timeout":
+			if hasReadTimeout {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg() // consume option value
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.ReadTimeout, hasReadTimeout = caddy.Duration(dur), true
+		case "write_timeout":
+			if hasWriteTimeout {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg() // consume option value
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.WriteTimeout, hasWriteTimeout = caddy.Duration(dur), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// idleConn pushes the read and write deadlines of the connection back before each read and write,
+// and closes the connection once one of them is exceeded.
+type idleConn struct {
+	net.Conn
+	logger                    *zap.Logger
+	readTimeout, writeTimeout time.Duration
+	closeOnce                 sync.Once
+}
+
+// Read reads from the connection. If no bytes are read within the read timeout, the connection
+// is closed, and io.EOF is returned, so that the handlers copying it treat it as a regular close.
+func (ic *idleConn) Read(p []byte) (int, error) {
+	if ic.readTimeout > 0 {
+		if err := ic.Conn.SetReadDeadline(time.Now().Add(ic.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := ic.Conn.Read(p)
+	if err != nil && n == 0 && ic.readTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+		ic.closeIdle("read", ic.readTimeout)
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// Write writes to the connection. If the bytes can't be written within the write timeout,
+// the connection is closed.
+func (ic *idleConn) Write(p []byte) (int, error) {
+	if ic.writeTimeout > 0 {
+		if err := ic.Conn.SetWriteDeadline(time.Now().Add(ic.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := ic.Conn.Write(p)
+	if err != nil && ic.writeTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+		ic.closeIdle("write", ic.writeTimeout)
+	}
+	return n, err
+}
+
+// closeIdle closes the connection once, after it has been idle for timeout while doing op.
+func (ic *idleConn) closeIdle(op string, timeout time.Duration) {
+	ic.closeOnce.Do(func() {
+		ic.logger.Debug("closing idle connection",
+			zap.String("remote", ic.RemoteAddr().String()),
+			zap.String("op", op),
+			zap.Duration("timeout", timeout),
+		)
+		_ = ic.Conn.Close()
+	})
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
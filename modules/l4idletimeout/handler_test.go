@@ -0,0 +1,136 @@
+package l4idletimeout
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// handle passes a connection wrapping out to h, with a next handler calling fn.
+func handle(t *testing.T, h *Handler, out net.Conn, fn func(cx *layer4.Connection) error) error {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	err := h.Provision(ctx)
+	assertNoError(t, err)
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	return h.Handle(cx, layer4.HandlerFunc(fn))
+}
+
+// assertClosed asserts that the peer of in has been closed, i.e. in reads io.EOF without blocking.
+func assertClosed(t *testing.T, in net.Conn) {
+	t.Helper()
+	_ = in.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := in.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("connection should be closed, got: %v", err)
+	}
+}
+
+func TestHandler_ReadTimeout(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	// The client sends a few bytes, then stalls
+	go func() {
+		_, _ = in.Write([]byte("hello"))
+	}()
+
+	var read []byte
+	start := time.Now()
+	err := handle(t, &Handler{ReadTimeout: caddy.Duration(100 * time.Millisecond)}, out, func(cx *layer4.Connection) error {
+		var err error
+		read, err = io.ReadAll(cx)
+		return err
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("idle connection should be closed cleanly, got: %v", err)
+	}
+	if string(read) != "hello" {
+		t.Fatalf("unexpected bytes read | got %q, want %q", read, "hello")
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("connection should be closed after the read timeout, got: %s", elapsed)
+	}
+	assertClosed(t, in)
+}
+
+func TestHandler_ReadTimeoutReset(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	// The client sends a byte more often than the timeout, then stalls
+	go func() {
+		for range 5 {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := in.Write([]byte{'x'}); err != nil {
+				return
+			}
+		}
+	}()
+
+	var read []byte
+	err := handle(t, &Handler{ReadTimeout: caddy.Duration(150 * time.Millisecond)}, out, func(cx *layer4.Connection) error {
+		var err error
+		read, err = io.ReadAll(cx)
+		return err
+	})
+	assertNoError(t, err)
+	if len(read) != 5 {
+		t.Fatalf("connection should be kept open while bytes are read, got %d bytes", len(read))
+	}
+	assertClosed(t, in)
+}
+
+func TestHandler_WriteTimeout(t *testing.T) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	// The client never reads, so that writing blocks
+	start := time.Now()
+	err := handle(t, &Handler{WriteTimeout: caddy.Duration(100 * time.Millisecond)}, out, func(cx *layer4.Connection) error {
+		_, err := cx.Write([]byte("hello"))
+		return err
+	})
+	elapsed := time.Since(start)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("writing to a stalled connection should time out, got: %v", err)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("connection should be closed after the write timeout, got: %s", elapsed)
+	}
+	assertClosed(t, in)
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*Handler{
+		{},
+		{ReadTimeout: caddy.Duration(-time.Second)},
+		{WriteTimeout: caddy.Duration(-time.Second)},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("test %d: handler should not be provisioned | %+v", i, h)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4imap allows the L4 multiplexing of IMAP connections
+package l4imap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchIMAP{})
+	layer4.RegisterProtocol("imap")
+}
+
+const maxLineLength = 1024 // Maximum length of a greeting or command line, including the line ending
+
+// MatchIMAP is able to match IMAP connections. Since IMAP is server-first, the matcher first tries
+// the server's untagged greeting, e.g. * OK IMAP4rev1 Service Ready, which is useful where the connecting
+// peer is an IMAP server, e.g. with reverse tunnels. The greeting text following OK or PREAUTH is exposed
+// as {l4.imap.banner}. Otherwise, it falls back to the client's first tagged command, e.g. a001 LOGIN,
+// which a client only sends once it has received a greeting, e.g. from a negotiate handler. Only the
+// commands valid before authentication are matched, and the command is exposed as {l4.imap.command}.
+// Commands are matched case-insensitively, and lines may end with CRLF or a bare LF.
+type MatchIMAP struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchIMAP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.imap",
+		New: func() caddy.Module { return new(MatchIMAP) },
+	}
+}
+
+// Match returns true if the connection starts with an IMAP greeting or a tagged IMAP command.
+func (m *MatchIMAP) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, maxLineLength), maxLineLength)
+
+	line, err := byteparser.ReadLine(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return false, nil // Not enough data for IMAP, or a line too long
+		}
+		return false, fmt.Errorf("reading line: %w", err)
+	}
+	if !byteparser.IsPrintable(line) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+
+	// Match the greeting, e.g. * OK [CAPABILITY IMAP4rev1 STARTTLS] ready, or * PREAUTH ready
+	if rest, ok := bytes.CutPrefix(line, []byte("* ")); ok {
+		status, text, _ := bytes.Cut(rest, []byte(" "))
+		if !bytes.EqualFold(status, []byte("OK")) && !bytes.EqualFold(status, []byte("PREAUTH")) {
+			return false, nil
+		}
+		repl.Set("l4.imap.banner", string(bytes.TrimSpace(text)))
+		cx.SetProtocol("imap")
+		return true, nil
+	}
+
+	// Match the command, e.g. a001 LOGIN alice secret, or A1 CAPABILITY
+	tag, rest, _ := bytes.Cut(line, []byte(" "))
+	command, _, _ := bytes.Cut(rest, []byte(" "))
+	command = bytes.ToUpper(command)
+	if !isTag(tag) || !isPreAuthCommand(command) {
+		return false, nil
+	}
+	repl.Set("l4.imap.command", string(command))
+	cx.SetProtocol("imap")
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchIMAP from Caddyfile tokens. Syntax:
+//
+//	imap
+func (m *MatchIMAP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// isPreAuthCommand returns true if c is an IMAP command valid before authentication, in upper case.
+func isPreAuthCommand(c []byte) bool {
+	switch string(c) {
+	case "CAPABILITY", "NOOP", "LOGOUT", "STARTTLS", "AUTHENTICATE", "LOGIN", "ID":
+		return true
+	}
+	return false
+}
+
+// isTag returns true if b is a valid IMAP tag, i.e. ASTRING-CHARs except "+".
+func isTag(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		switch c {
+		case '(', ')', '{', ' ', '%', '*', '"', '\\', '+':
+			return false
+		}
+	}
+	return true
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc9051#section-7.1
+//	https://www.rfc-editor.org/rfc/rfc9051#section-9
+//	https://www.rfc-editor.org/rfc/rfc2971
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchIMAP)(nil)
+	_ layer4.ConnMatcher    = (*MatchIMAP)(nil)
+)
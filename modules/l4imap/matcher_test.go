@@ -0,0 +1,95 @@
+package l4imap
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchIMAP(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantMatch bool
+		command   string
+		banner    string
+	}{
+		{name: "Greeting", input: "* OK IMAP4rev1 Service Ready\r\n", wantMatch: true, banner: "IMAP4rev1 Service Ready"},
+		{name: "Greeting With Capabilities", input: "* OK [CAPABILITY IMAP4rev1 STARTTLS AUTH=PLAIN] Dovecot ready.\r\n", wantMatch: true, banner: "[CAPABILITY IMAP4rev1 STARTTLS AUTH=PLAIN] Dovecot ready."},
+		{name: "Preauthenticated Greeting", input: "* PREAUTH IMAP4rev2 server logged in as Smith\n", wantMatch: true, banner: "IMAP4rev2 server logged in as Smith"},
+		{name: "Bye Greeting", input: "* BYE Autologout; idle for too long\r\n", wantMatch: false},
+		{name: "Login", input: "a001 LOGIN alice secret\r\n", wantMatch: true, command: "LOGIN"},
+		{name: "Capability, Lower Case, Bare LF", input: "A1 capability\n", wantMatch: true, command: "CAPABILITY"},
+		{name: "StartTLS", input: "x STARTTLS\r\n", wantMatch: true, command: "STARTTLS"},
+		{name: "Authenticate", input: "tag.1 AUTHENTICATE PLAIN\r\n", wantMatch: true, command: "AUTHENTICATE"},
+		{name: "ID", input: "a023 ID (\"name\" \"sodr\")\r\n", wantMatch: true, command: "ID"},
+		{name: "Command After Authentication", input: "a002 SELECT INBOX\r\n", wantMatch: false},
+		{name: "No Tag", input: "LOGIN alice secret\r\n", wantMatch: false},
+		{name: "Invalid Tag", input: "a+1 LOGIN alice secret\r\n", wantMatch: false},
+		{name: "Continuation", input: "+ Ready for additional command text\r\n", wantMatch: false},
+		{name: "Incomplete Line", input: "a001 LOGIN alice secret", wantMatch: false},
+		{name: "Line Too Long", input: "a001 LOGIN " + strings.Repeat("a", maxLineLength) + "\r\n", wantMatch: false},
+		{name: "POP3 Greeting", input: "+OK POP3 server ready\r\n", wantMatch: false},
+		{name: "POP3 Command", input: "USER alice\r\n", wantMatch: false},
+		{name: "POP3 Auth", input: "AUTH PLAIN\r\n", wantMatch: false},
+		{name: "SMTP Greeting", input: "220 mx.example.com ESMTP Postfix\r\n", wantMatch: false},
+		{name: "Empty", input: "", wantMatch: false},
+		{name: "HTTP", input: "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", wantMatch: false},
+		{name: "TLS", input: "\x16\x03\x01\x00\xf4\x01\x00\x00\xf0\x03\x03\n", wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write([]byte(tc.input))
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := (&MatchIMAP{}).Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			command, _ := repl.GetString("l4.imap.command")
+			banner, _ := repl.GetString("l4.imap.banner")
+			if command != tc.command || banner != tc.banner {
+				t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n", i, command, banner, tc.command, tc.banner)
+			}
+			if protocol := cx.Protocol(); (protocol == "imap") != tc.wantMatch {
+				t.Fatalf("test %d: unexpected protocol | %q\n", i, protocol)
+			}
+		})
+	}
+}
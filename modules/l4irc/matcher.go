@@ -0,0 +1,228 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4irc allows the L4 multiplexing of IRC connections
+package l4irc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchIRC{})
+	layer4.RegisterProtocol("irc")
+}
+
+const (
+	maxLineLength  = 512  // Maximum length of a message, including the CRLF
+	maxBurstLength = 2048 // Maximum length of the registration burst read to find NICK
+	maxNickLength  = 64   // Maximum length of a nickname, which is longer than most servers' NICKLEN
+)
+
+// MatchIRC is able to match IRC connections by the first command of the client's registration, i.e. one of
+// CAP LS, PASS, NICK or USER, which must be a CRLF-terminated line. Clients usually send their registration
+// burst at once, e.g. CAP LS 302, NICK and USER, so the following lines are searched for NICK, whose nickname
+// is exposed as {l4.irc.nick} if it's seen. A lone NICK is matched as well.
+type MatchIRC struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchIRC) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.irc",
+		New: func() caddy.Module { return new(MatchIRC) },
+	}
+}
+
+// Match returns true if the connection starts with an IRC registration command.
+func (m *MatchIRC) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, maxBurstLength), maxLineLength)
+
+	line, err := readLine(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) ||
+			errors.Is(err, errBareLF) {
+			return false, nil // Not enough data for IRC, or a line too long or not terminated by CRLF
+		}
+		return false, fmt.Errorf("reading line: %w", err)
+	}
+
+	command, params, ok := parseRegistration(line)
+	if !ok {
+		return false, nil
+	}
+
+	// Search the rest of the registration burst for NICK, if not seen yet
+	var nick string
+	for {
+		if command == "NICK" {
+			nick = params[0]
+			break
+		}
+
+		line, err = readLine(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) ||
+				errors.Is(err, errBareLF) || errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+				break // The burst is over or incomplete, but the first command is enough to match
+			}
+			return false, fmt.Errorf("reading line: %w", err)
+		}
+		if command, params, ok = parseRegistration(line); !ok {
+			break // This isn't part of the registration
+		}
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.irc.nick", nick)
+	cx.SetProtocol("irc")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchIRC from Caddyfile tokens. Syntax:
+//
+//	irc
+func (m *MatchIRC) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// errBareLF is returned by readLine for lines terminated by a bare LF, which IRC doesn't allow.
+var errBareLF = errors.New("line terminated by a bare LF")
+
+// readLine reads a line terminated by CRLF from r and returns it without the terminator.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errBareLF
+	}
+	return line[:len(line)-2], nil
+}
+
+// parseRegistration returns the command and the parameters of line if it's a valid registration command,
+// i.e. CAP LS [<version>], PASS <password>, NICK <nickname> or USER <user> <mode> <unused> <realname>.
+// Commands are case-insensitive, but since clients don't send tags or a source before registering,
+// lines starting with them aren't registration commands.
+func parseRegistration(line []byte) (string, []string, bool) {
+	if len(line) == 0 || !isText(line) {
+		return "", nil, false
+	}
+
+	command, rest, _ := bytes.Cut(line, []byte(" "))
+	params := parseParams(rest)
+
+	switch name := string(bytes.ToUpper(command)); name {
+	case "CAP":
+		if len(params) == 0 || len(params) > 2 || params[0] != "LS" {
+			return "", nil, false
+		}
+		return name, params, true
+	case "PASS":
+		if len(params) != 1 || len(params[0]) == 0 {
+			return "", nil, false
+		}
+		return name, params, true
+	case "NICK":
+		// Some clients append the hopcount of RFC 1459 to NICK
+		if len(params) == 0 || len(params) > 2 || !isNick(params[0]) {
+			return "", nil, false
+		}
+		return name, params, true
+	case "USER":
+		if len(params) != 4 || len(params[0]) == 0 {
+			return "", nil, false
+		}
+		return name, params, true
+	default:
+		return "", nil, false
+	}
+}
+
+// parseParams splits b into space-separated parameters, the last of which may be a trailing
+// one starting with a colon, which contains the rest of b, including spaces.
+func parseParams(b []byte) []string {
+	var params []string
+	for len(b) > 0 {
+		if b[0] == ' ' {
+			b = b[1:]
+			continue
+		}
+		if b[0] == ':' {
+			params = append(params, string(b[1:]))
+			break
+		}
+		var param []byte
+		param, b, _ = bytes.Cut(b, []byte(" "))
+		params = append(params, string(param))
+	}
+	return params
+}
+
+// isNick returns true if s is a valid nickname, i.e. a letter or a special character
+// followed by letters, digits, special characters or hyphens.
+func isNick(s string) bool {
+	if len(s) == 0 || len(s) > maxNickLength {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', bytes.IndexByte([]byte("[]\\`_^{|}"), c) >= 0:
+		case i > 0 && ('0' <= c && c <= '9' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isText returns true if b doesn't contain NUL, CR or LF, which aren't allowed in IRC messages.
+func isText(b []byte) bool {
+	return bytes.IndexAny(b, "\x00\r\n") < 0
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc2812#section-3.1
+//	https://modern.ircdocs.horse/#connection-registration
+//	https://ircv3.net/specs/extensions/capability-negotiation
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchIRC)(nil)
+	_ layer4.ConnMatcher    = (*MatchIRC)(nil)
+)
@@ -0,0 +1,108 @@
+package l4irc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+var registration = []byte("CAP LS 302\r\n" +
+	"PASS :s3cr3t pass\r\n" +
+	"NICK alice\r\n" +
+	"USER alice 0 * :Alice Liddell\r\n")
+
+var registrationWithoutCap = []byte("NICK [bob]\r\n" +
+	"USER bob 8 * :Bob\r\n")
+
+var passFirst = []byte("PASS secret\r\n" +
+	"nick carol_2\r\n" +
+	"user carol 0 * :Carol\r\n")
+
+func Test_MatchIRC_Match(t *testing.T) {
+	type test struct {
+		data        []byte
+		shouldMatch bool
+		nick        string
+	}
+
+	tests := []test{
+		{data: registration, shouldMatch: true, nick: "alice"},
+		{data: registrationWithoutCap, shouldMatch: true, nick: "[bob]"},
+		{data: passFirst, shouldMatch: true, nick: "carol_2"},
+		{data: []byte("NICK dave\r\n"), shouldMatch: true, nick: "dave"},
+		{data: []byte("NICK :dave\r\n"), shouldMatch: true, nick: "dave"},
+		{data: []byte("NICK dave 1\r\n"), shouldMatch: true, nick: "dave"},
+
+		// the first command is enough to match, even if NICK isn't seen
+		{data: []byte("CAP LS\r\n"), shouldMatch: true},
+		{data: []byte("USER eve 0 * :Eve\r\nPING :x\r\nNICK eve\r\n"), shouldMatch: true},
+		{data: registration[:20], shouldMatch: true},
+
+		// lines must be complete and terminated by CRLF
+		{data: []byte("NICK alice"), shouldMatch: false},
+		{data: []byte("NICK alice\n"), shouldMatch: false},
+
+		// invalid registration commands aren't matched
+		{data: []byte("NICK 1alice\r\n"), shouldMatch: false},
+		{data: []byte("NICK\r\n"), shouldMatch: false},
+		{data: []byte("USER alice 0 *\r\n"), shouldMatch: false},
+		{data: []byte("CAP REQ :sasl\r\n"), shouldMatch: false},
+		{data: []byte("PRIVMSG #chan :hi\r\n"), shouldMatch: false},
+		{data: []byte(":server NICK alice\r\n"), shouldMatch: false},
+
+		// other protocols aren't matched
+		{data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{data: []byte("EHLO client.example.com\r\n"), shouldMatch: false},
+		{data: []byte("SSH-2.0-OpenSSH_9.6\r\n"), shouldMatch: false},
+		{data: []byte{0x16, 0x03, 0x01, 0x00, 0xa5, 0x01, 0x00, 0x00, 0xa1, 0x03, 0x03}, shouldMatch: false},
+		{data: []byte{}, shouldMatch: false},
+	}
+
+	for i, tc := range tests {
+		func() {
+			matcher := &MatchIRC{}
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %q\n", i, tc.data)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %q\n", i, tc.data)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if nick, _ := repl.GetString("l4.irc.nick"); nick != tc.nick {
+				t.Fatalf("test %d: unexpected nick | got %q, want %q\n", i, nick, tc.nick)
+			}
+		}()
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4kafka allows the L4 multiplexing of Kafka connections
+package l4kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchKafka{})
+	layer4.RegisterProtocol("kafka")
+}
+
+const (
+	sizeFieldSize   = 4         // Size of request size field (bytes)
+	headerSize      = 10        // Size of request header up to the client id: api key, api version, correlation id and client id length
+	defaultMaxSize  = 100 << 20 // Default maximum request size, equals the broker's default socket.request.max.bytes (100 MB)
+	maxAPIKey       = 74        // Highest api key known, see https://kafka.apache.org/protocol#protocol_api_keys
+	maxAPIVersion   = 32        // Maximum reasonable api version
+	maxClientIDSize = 1024      // Maximum reasonable client id size (1 KB)
+)
+
+// MatchKafka is able to match Kafka connections by their first request. The api key (e.g. 0 for Produce,
+// 1 for Fetch or 18 for ApiVersions), the api version and the client id of the request are exposed as
+// {l4.kafka.api_key}, {l4.kafka.api_version} and {l4.kafka.client_id}.
+type MatchKafka struct {
+	// MaxSize is the maximum size of a request, excluding the size field itself, to be matched.
+	// It defaults to 104857600 (100 MB), the broker's default value of socket.request.max.bytes.
+	// Note: only the request header is read for matching, no matter how large the request is.
+	MaxSize uint32 `json:"max_size,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchKafka) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.kafka",
+		New: func() caddy.Module { return new(MatchKafka) },
+	}
+}
+
+// Match returns true if the connection starts with a Kafka request.
+func (m *MatchKafka) Match(cx *layer4.Connection) (bool, error) {
+	// Read request size and header up to the client id
+	buf := make([]byte, sizeFieldSize+headerSize)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for Kafka
+		}
+		return false, fmt.Errorf("reading request header: %w", err)
+	}
+
+	// Validate request size
+	size := binary.BigEndian.Uint32(buf[:sizeFieldSize])
+	if size < headerSize || size > m.MaxSize {
+		return false, nil
+	}
+
+	// Validate api key and api version
+	header := buf[sizeFieldSize:]
+	apiKey := int16(binary.BigEndian.Uint16(header[0:2]))      //nolint:gosec // disable G115
+	apiVersion := int16(binary.BigEndian.Uint16(header[2:4]))  //nolint:gosec // disable G115
+	clientIDSize := int16(binary.BigEndian.Uint16(header[8:])) //nolint:gosec // disable G115
+	if apiKey < 0 || apiKey > maxAPIKey || apiVersion < 0 || apiVersion > maxAPIVersion {
+		return false, nil
+	}
+
+	// Read the client id, a nullable string
+	var clientID []byte
+	if clientIDSize != -1 {
+		if clientIDSize < 0 || clientIDSize > maxClientIDSize || uint32(clientIDSize) > size-headerSize {
+			return false, nil
+		}
+		clientID = make([]byte, clientIDSize)
+		if _, err := io.ReadFull(cx, clientID); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return false, nil // Incomplete request
+			}
+			return false, fmt.Errorf("reading client id: %w", err)
+		}
+		if !byteparser.IsPrintable(clientID) {
+			return false, nil
+		}
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.kafka.api_key", strconv.Itoa(int(apiKey)))
+	repl.Set("l4.kafka.api_version", strconv.Itoa(int(apiVersion)))
+	repl.Set("l4.kafka.client_id", string(clientID))
+	cx.SetProtocol("kafka")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchKafka) Provision(_ caddy.Context) error {
+	if m.MaxSize == 0 {
+		m.MaxSize = defaultMaxSize
+	}
+	if m.MaxSize < headerSize {
+		return fmt.Errorf("max_size must be at least %d", headerSize)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchKafka from Caddyfile tokens. Syntax:
+//
+//	kafka {
+//		max_size <n>
+//	}
+//	kafka
+func (m *MatchKafka) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasMaxSize bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "max_size":
+			if hasMaxSize {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.MaxSize, hasMaxSize = uint32(val), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://kafka.apache.org/protocol#protocol_messages
+//	https://kafka.apache.org/protocol#protocol_api_keys
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchKafka)(nil)
+	_ caddyfile.Unmarshaler = (*MatchKafka)(nil)
+	_ layer4.ConnMatcher    = (*MatchKafka)(nil)
+)
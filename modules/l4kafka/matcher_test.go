@@ -0,0 +1,117 @@
+package l4kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// buildRequest returns a Kafka request with the given header fields and body.
+// A negative clientIDSize is written as is, with clientID omitted.
+func buildRequest(apiKey, apiVersion int16, correlationID int32, clientID string, clientIDSize int16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(apiKey))
+	b = binary.BigEndian.AppendUint16(b, uint16(apiVersion))
+	b = binary.BigEndian.AppendUint32(b, uint32(correlationID))
+	b = binary.BigEndian.AppendUint16(b, uint16(clientIDSize))
+	if clientIDSize >= 0 {
+		b = append(b, clientID...)
+	}
+	b = append(b, body...)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+func TestMatchKafka(t *testing.T) {
+	// ApiVersions v3 as sent by librdkafka: empty tagged fields, then compact client software name and version
+	apiVersions := buildRequest(18, 3, 1, "rdkafka", 7, append(append([]byte{0x00, 0x0b}, "librdkafka"...), append([]byte{0x06}, "2.3.0"...)...))
+	// Produce v9 with an arbitrary body
+	produce := buildRequest(0, 9, 42, "producer-1", 10, []byte{0x00, 0x00, 0xff, 0xff, 0x00, 0x00, 0x75, 0x30, 0x01, 0x00})
+	// Fetch v4 with a null client id
+	fetch := buildRequest(1, 4, 7, "", -1, []byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x01, 0xf4})
+
+	tests := []struct {
+		name       string
+		matcher    *MatchKafka
+		input      []byte
+		wantMatch  bool
+		apiKey     string
+		apiVersion string
+		clientID   string
+	}{
+		{name: "ApiVersions", matcher: &MatchKafka{}, input: apiVersions, wantMatch: true, apiKey: "18", apiVersion: "3", clientID: "rdkafka"},
+		{name: "Produce", matcher: &MatchKafka{}, input: produce, wantMatch: true, apiKey: "0", apiVersion: "9", clientID: "producer-1"},
+		{name: "Fetch, Null Client ID", matcher: &MatchKafka{}, input: fetch, wantMatch: true, apiKey: "1", apiVersion: "4", clientID: ""},
+		{name: "Header Only", matcher: &MatchKafka{}, input: produce[:sizeFieldSize+headerSize+10], wantMatch: true, apiKey: "0", apiVersion: "9", clientID: "producer-1"},
+		{name: "Larger than Max Size", matcher: &MatchKafka{MaxSize: 16}, input: produce, wantMatch: false},
+		{name: "Unknown API Key", matcher: &MatchKafka{}, input: buildRequest(1000, 0, 1, "a", 1, nil), wantMatch: false},
+		{name: "Negative API Version", matcher: &MatchKafka{}, input: buildRequest(18, -1, 1, "a", 1, nil), wantMatch: false},
+		{name: "Client ID Exceeding Request", matcher: &MatchKafka{}, input: buildRequest(18, 3, 1, "abc", 30, nil), wantMatch: false},
+		{name: "Invalid Client ID Size", matcher: &MatchKafka{}, input: buildRequest(18, 3, 1, "", -2, nil), wantMatch: false},
+		{name: "Non-Printable Client ID", matcher: &MatchKafka{}, input: buildRequest(18, 3, 1, "a\x00b", 3, nil), wantMatch: false},
+		{name: "Truncated", matcher: &MatchKafka{}, input: apiVersions[:8], wantMatch: false},
+		{name: "Empty", matcher: &MatchKafka{}, input: []byte{}, wantMatch: false},
+		{name: "HTTP", matcher: &MatchKafka{}, input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "TLS", matcher: &MatchKafka{}, input: []byte{0x16, 0x03, 0x01, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xf0, 0x03, 0x03, 0x00, 0x00, 0x00}, wantMatch: false},
+		{name: "Noise", matcher: &MatchKafka{}, input: []byte{0x00, 0x00, 0x00, 0x0e, 0x7f, 0xff, 0x80, 0x00, 0xde, 0xad, 0xbe, 0xef, 0x00, 0x00}, wantMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			apiKey, _ := repl.GetString("l4.kafka.api_key")
+			apiVersion, _ := repl.GetString("l4.kafka.api_version")
+			clientID, _ := repl.GetString("l4.kafka.client_id")
+			if apiKey != tc.apiKey || apiVersion != tc.apiVersion || clientID != tc.clientID {
+				t.Fatalf("test %d: unexpected vars | got %q, %q and %q, want %q, %q and %q\n",
+					i, apiKey, apiVersion, clientID, tc.apiKey, tc.apiVersion, tc.clientID)
+			}
+		})
+	}
+}
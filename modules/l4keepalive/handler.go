@@ -0,0 +1,246 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4keepalive allows keeping idle L4 connections open by injecting keepalive probes
+package l4keepalive
+
+import (
+	"fmt"
+	weakrand "math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler writes keepalive probes to connections once no bytes have been read from or written to them
+// for Interval, e.g. to keep the mappings of NATs with aggressive timeouts open during long idle sessions.
+// Probes are repeated every Interval while the connection stays idle, and suppressed as soon as any bytes
+// flow again. Probes are written as is to the client between the writes of the next handlers, so they
+// must be something the client ignores, e.g. a no-op of the protocol; only use it when that's the case.
+// It wraps the connection, so it should come before the handlers using it, e.g. proxy, in a route.
+type Handler struct {
+	// How long the connection must stay idle before a probe is written. Required.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// A random duration of up to Jitter is added to or subtracted from each interval,
+	// so that the probes of many connections don't all fire at once. Must be less than Interval.
+	Jitter caddy.Duration `json:"jitter,omitempty"`
+
+	// The bytes written as a probe, e.g. a single space for XMPP,
+	// which ignores whitespace between stanzas. Required.
+	Data string `json:"data,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.keepalive_inject",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	if h.Interval <= 0 {
+		return fmt.Errorf("interval must be greater than 0: %s", time.Duration(h.Interval))
+	}
+	if h.Jitter < 0 || h.Jitter >= h.Interval {
+		return fmt.Errorf("jitter must be at least 0 and less than the interval: %s", time.Duration(h.Jitter))
+	}
+	if len(h.Data) == 0 {
+		return fmt.Errorf("no data to write as a probe")
+	}
+	return nil
+}
+
+// Handle handles the connection.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	kc := &keepaliveConn{
+		Conn:     cx.Conn,
+		logger:   h.logger.Named("conn"),
+		interval: time.Duration(h.Interval),
+		jitter:   time.Duration(h.Jitter),
+		data:     []byte(h.Data),
+		done:     make(chan struct{}),
+	}
+	kc.lastActive.Store(time.Now().UnixNano())
+
+	go kc.probe()
+	defer close(kc.done)
+
+	return next.Handle(cx.Wrap(kc))
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	keepalive_inject {
+//		interval <duration>
+//		jitter <duration>
+//		data <string>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasInterval, hasJitter, hasData bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "interval":
+			if hasInterval {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg() // consume option value
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.Interval, hasInterval = caddy.Duration(dur), true
+		case "jitter":
+			if hasJitter {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg() // consume option value
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.Jitter, hasJitter = caddy.Duration(dur), true
+		case "data":
+			if hasData {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			_, h.Data, hasData = d.NextArg(), d.Val(), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// keepaliveConn records when bytes were last read from or written to the connection,
+// and writes probes to it while it stays idle.
+type keepaliveConn struct {
+	net.Conn
+	logger           *zap.Logger
+	interval, jitter time.Duration
+	data             []byte
+	done             chan struct{}
+	lastActive       atomic.Int64 // unix nano time of the last read or write, probes excluded
+	writeMu          sync.Mutex   // keeps probes from being interleaved with other writes
+}
+
+// Read reads from the connection.
+func (kc *keepaliveConn) Read(p []byte) (int, error) {
+	n, err := kc.Conn.Read(p)
+	if n > 0 {
+		kc.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Write writes to the connection.
+func (kc *keepaliveConn) Write(p []byte) (int, error) {
+	kc.writeMu.Lock()
+	defer kc.writeMu.Unlock()
+	n, err := kc.Conn.Write(p)
+	if n > 0 {
+		kc.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// probe writes a probe each time the connection has been idle for a jittered interval,
+// until done is closed or a probe can't be written.
+func (kc *keepaliveConn) probe() {
+	wait := kc.nextInterval()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-kc.done:
+			return
+		case <-timer.C:
+		}
+
+		// the interval is counted from the last activity, so wait for the rest of it
+		if idle := time.Since(time.Unix(0, kc.lastActive.Load())); idle < wait {
+			timer.Reset(wait - idle)
+			continue
+		}
+
+		kc.writeMu.Lock()
+		_, err := kc.Conn.Write(kc.data)
+		kc.writeMu.Unlock()
+		if err != nil {
+			kc.logger.Debug("writing keepalive probe",
+				zap.String("remote", kc.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			return
+		}
+
+		wait = kc.nextInterval()
+		timer.Reset(wait)
+	}
+}
+
+// nextInterval returns the interval, with a random duration of up to the jitter added or subtracted.
+func (kc *keepaliveConn) nextInterval() time.Duration {
+	if kc.jitter <= 0 {
+		return kc.interval
+	}
+	return kc.interval - kc.jitter + time.Duration(weakrand.Int63n(2*int64(kc.jitter)+1))
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
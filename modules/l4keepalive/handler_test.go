@@ -0,0 +1,112 @@
+package l4keepalive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// handle passes a connection wrapping out to h, with a next handler calling fn, and returns
+// all the bytes the client has received until the connection is closed.
+func handle(t *testing.T, h *Handler, fn func(cx *layer4.Connection) error) []byte {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	err := h.Provision(ctx)
+	assertNoError(t, err)
+
+	in, out := net.Pipe()
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(in)
+		received <- b
+	}()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	err = h.Handle(cx, layer4.HandlerFunc(fn))
+	assertNoError(t, err)
+
+	// Probes must not be written once the handler has returned
+	time.Sleep(2 * time.Duration(h.Interval))
+	_ = out.Close()
+	return <-received
+}
+
+func TestHandler_ProbesWhileIdle(t *testing.T) {
+	h := &Handler{
+		Interval: caddy.Duration(50 * time.Millisecond),
+		Jitter:   caddy.Duration(10 * time.Millisecond),
+		Data:     "\x00",
+	}
+	received := handle(t, h, func(cx *layer4.Connection) error {
+		_, err := cx.Write([]byte("hello"))
+		if err != nil {
+			return err
+		}
+		time.Sleep(330 * time.Millisecond)
+		_, err = cx.Write([]byte("bye"))
+		return err
+	})
+
+	// 330ms of idleness make 5 to 8 probes, depending on the jitter, and one less is tolerated for slow runs
+	probes := bytes.Count(received, []byte{0})
+	if !bytes.HasPrefix(received, []byte("hello")) || !bytes.HasSuffix(received, []byte("bye")) {
+		t.Fatalf("probes should be written between the bytes of the next handler | got %q", received)
+	}
+	if probes < 4 || probes > 8 {
+		t.Fatalf("unexpected number of probes | got %d, want 5 to 8 | %q", probes, received)
+	}
+}
+
+func TestHandler_SuppressedWhileActive(t *testing.T) {
+	h := &Handler{
+		Interval: caddy.Duration(100 * time.Millisecond),
+		Data:     "\x00",
+	}
+	received := handle(t, h, func(cx *layer4.Connection) error {
+		for range 10 {
+			if _, err := cx.Write([]byte{'x'}); err != nil {
+				return err
+			}
+			time.Sleep(40 * time.Millisecond)
+		}
+		return nil
+	})
+
+	if !bytes.Equal(received, bytes.Repeat([]byte{'x'}, 10)) {
+		t.Fatalf("probes should not be written while bytes flow | got %q", received)
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*Handler{
+		{Data: "\x00"},
+		{Interval: caddy.Duration(time.Second)},
+		{Interval: caddy.Duration(time.Second), Jitter: caddy.Duration(-time.Second), Data: "\x00"},
+		{Interval: caddy.Duration(time.Second), Jitter: caddy.Duration(time.Second), Data: "\x00"},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid handler should not be provisioned | %+v\n", i, h)
+		}
+	}
+}
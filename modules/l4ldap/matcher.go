@@ -0,0 +1,304 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4ldap allows the L4 multiplexing of LDAP connections
+package l4ldap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchLDAP{})
+	layer4.RegisterProtocol("ldap")
+}
+
+const (
+	tagSequence      = 0x30 // Universal, constructed SEQUENCE: an LDAPMessage
+	tagInteger       = 0x02 // Universal, primitive INTEGER: a messageID or a version
+	tagOctetString   = 0x04 // Universal, primitive OCTET STRING: an LDAPDN
+	tagBindRequest   = 0x60 // Application 0, constructed: a BindRequest
+	tagSearchRequest = 0x63 // Application 3, constructed: a SearchRequest
+	tagAuthSimple    = 0x80 // Context-specific 0, primitive: simple authentication
+	tagAuthSASL      = 0xA3 // Context-specific 3, constructed: SASL authentication
+	tagControls      = 0xA0 // Context-specific 0, constructed: the optional controls of an LDAPMessage
+
+	lengthSizeMax      = 4         // Maximum number of subsequent length bytes in the long form
+	minMessageLength   = 5         // Smallest valid LDAPMessage content: a messageID and an empty protocol op
+	defaultMaxLength   = 16384     // Default maximum size of an LDAPMessage content to be matched (16 KB)
+	maxMessageID       = 1<<31 - 1 // Highest messageID allowed
+	maxProtocolVersion = 127       // Highest protocol version allowed
+)
+
+// MatchLDAP is able to match LDAP connections by their first message, which must be a BindRequest
+// or a SearchRequest, e.g. a rootDSE query. The operation ("bind" or "search") is exposed as
+// {l4.ldap.operation}. For a BindRequest, the protocol version and the bind DN, which is empty for
+// anonymous binds, are exposed as {l4.ldap.version} and {l4.ldap.bind_dn}.
+type MatchLDAP struct {
+	// MaxLength is the maximum length of the first LDAPMessage, excluding its tag and length octets,
+	// to be matched. Longer messages aren't matched. It defaults to 16384 (16 KB).
+	MaxLength uint32 `json:"max_length,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchLDAP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.ldap",
+		New: func() caddy.Module { return new(MatchLDAP) },
+	}
+}
+
+// Match returns true if the connection starts with an LDAP BindRequest or SearchRequest.
+func (m *MatchLDAP) Match(cx *layer4.Connection) (bool, error) {
+	// Read the SEQUENCE tag and the first length byte
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for LDAP
+		}
+		return false, fmt.Errorf("reading message header: %w", err)
+	}
+	if header[0] != tagSequence {
+		return false, nil
+	}
+
+	// Read the subsequent length bytes in the long form
+	lengthBytes := header[1:]
+	if header[1]&0x80 != 0 {
+		n := int(header[1] & 0x7F)
+		if n == 0 || n > lengthSizeMax {
+			return false, nil // Indefinite or too long length
+		}
+		lengthBytes = make([]byte, 1+n)
+		lengthBytes[0] = header[1]
+		if _, err := io.ReadFull(cx, lengthBytes[1:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return false, nil // Incomplete message
+			}
+			return false, fmt.Errorf("reading message length: %w", err)
+		}
+	}
+	length, n, ok := decodeLength(lengthBytes)
+	if !ok || n != len(lengthBytes) || length < minMessageLength || uint64(length) > uint64(m.MaxLength) {
+		return false, nil
+	}
+
+	// Read the message content
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(cx, msg); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Incomplete message
+		}
+		return false, fmt.Errorf("reading message: %w", err)
+	}
+
+	// Check the messageID, which must be positive
+	tag, messageID, pos, ok := readElement(msg, 0)
+	if !ok || tag != tagInteger {
+		return false, nil
+	}
+	if id, ok := decodeInteger(messageID); !ok || id <= 0 || id > maxMessageID {
+		return false, nil
+	}
+
+	// Check the protocol op, which may only be followed by controls
+	tag, op, pos, ok := readElement(msg, pos)
+	if !ok {
+		return false, nil
+	}
+	if pos != len(msg) {
+		if controlsTag, _, end, ok := readElement(msg, pos); !ok || controlsTag != tagControls || end != len(msg) {
+			return false, nil
+		}
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	switch tag {
+	case tagBindRequest:
+		version, dn, ok := parseBindRequest(op)
+		if !ok {
+			return false, nil
+		}
+		repl.Set("l4.ldap.operation", "bind")
+		repl.Set("l4.ldap.version", strconv.Itoa(version))
+		repl.Set("l4.ldap.bind_dn", dn)
+	case tagSearchRequest:
+		// The baseObject is the first field of a SearchRequest
+		tag, baseObject, _, ok := readElement(op, 0)
+		if !ok || tag != tagOctetString || !utf8.Valid(baseObject) {
+			return false, nil
+		}
+		repl.Set("l4.ldap.operation", "search")
+	default:
+		return false, nil
+	}
+
+	cx.SetProtocol("ldap")
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchLDAP) Provision(_ caddy.Context) error {
+	if m.MaxLength == 0 {
+		m.MaxLength = defaultMaxLength
+	}
+	if m.MaxLength < minMessageLength {
+		return fmt.Errorf("max_length must be at least %d", minMessageLength)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchLDAP from Caddyfile tokens. Syntax:
+//
+//	ldap {
+//		max_length <n>
+//	}
+//	ldap
+func (m *MatchLDAP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasMaxLength bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "max_length":
+			if hasMaxLength {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.MaxLength, hasMaxLength = uint32(val), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// parseBindRequest parses the content of a BindRequest. It returns the protocol version,
+// the bind DN and true, or false if b isn't a valid BindRequest.
+func parseBindRequest(b []byte) (int, string, bool) {
+	tag, version, pos, ok := readElement(b, 0)
+	if !ok || tag != tagInteger {
+		return 0, "", false
+	}
+	v, ok := decodeInteger(version)
+	if !ok || v < 1 || v > maxProtocolVersion {
+		return 0, "", false
+	}
+
+	tag, dn, pos, ok := readElement(b, pos)
+	if !ok || tag != tagOctetString || !utf8.Valid(dn) {
+		return 0, "", false
+	}
+
+	tag, _, pos, ok = readElement(b, pos)
+	if !ok || (tag != tagAuthSimple && tag != tagAuthSASL) || pos != len(b) {
+		return 0, "", false
+	}
+
+	return int(v), string(dn), true
+}
+
+// readElement reads a BER element from b at pos. It returns its tag, its content, the position
+// following it and true, or false if b doesn't contain a complete element at pos. Only single-byte
+// tags and definite lengths are supported, which is all LDAP needs.
+func readElement(b []byte, pos int) (byte, []byte, int, bool) {
+	if pos+2 > len(b) || b[pos]&0x1F == 0x1F {
+		return 0, nil, 0, false
+	}
+	length, n, ok := decodeLength(b[pos+1:])
+	if !ok {
+		return 0, nil, 0, false
+	}
+	start := pos + 1 + n
+	if uint64(length) > uint64(len(b)-start) {
+		return 0, nil, 0, false
+	}
+	end := start + int(length)
+	return b[pos], b[start:end], end, true
+}
+
+// decodeLength decodes a BER definite length from the beginning of b. It returns the length,
+// the number of bytes used and true, or false if b doesn't start with a valid length.
+func decodeLength(b []byte) (uint32, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	if b[0]&0x80 == 0 {
+		return uint32(b[0]), 1, true // Short form
+	}
+	n := int(b[0] & 0x7F)
+	if n == 0 || n > lengthSizeMax || 1+n > len(b) {
+		return 0, 0, false // Indefinite, too long or incomplete length
+	}
+	var length uint32
+	for _, c := range b[1 : 1+n] {
+		length = length<<8 | uint32(c)
+	}
+	return length, 1 + n, true
+}
+
+// decodeInteger decodes the content of a BER INTEGER of up to 4 bytes.
+// It returns the value and true, or false if b isn't a valid INTEGER.
+func decodeInteger(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 4 {
+		return 0, false
+	}
+	value := int64(int8(b[0])) //nolint:gosec // disable G115
+	for _, c := range b[1:] {
+		value = value<<8 | int64(c)
+	}
+	return value, true
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc4511#section-4.1
+//	https://www.rfc-editor.org/rfc/rfc4511#section-4.2
+//	https://www.rfc-editor.org/rfc/rfc4511#section-4.5.1
+//	https://www.itu.int/rec/T-REC-X.690
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchLDAP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchLDAP)(nil)
+	_ layer4.ConnMatcher    = (*MatchLDAP)(nil)
+)
@@ -0,0 +1,166 @@
+package l4ldap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// element returns a BER element with the given tag and content, using the long form of length if needed.
+func element(tag byte, content ...[]byte) []byte {
+	c := bytes.Join(content, nil)
+	b := []byte{tag}
+	switch {
+	case len(c) < 0x80:
+		b = append(b, byte(len(c)))
+	case len(c) <= 0xFF:
+		b = append(b, 0x81, byte(len(c)))
+	default:
+		b = append(b, 0x82, byte(len(c)>>8), byte(len(c)))
+	}
+	return append(b, c...)
+}
+
+// bindRequest returns an LDAPMessage with a simple BindRequest.
+func bindRequest(messageID byte, dn, password string) []byte {
+	return element(tagSequence,
+		element(tagInteger, []byte{messageID}),
+		element(tagBindRequest,
+			element(tagInteger, []byte{3}),
+			element(tagOctetString, []byte(dn)),
+			element(tagAuthSimple, []byte(password)),
+		),
+	)
+}
+
+func TestMatchLDAP(t *testing.T) {
+	simpleBind := bindRequest(1, "cn=admin,dc=example,dc=org", "secret")
+	anonymousBind := bindRequest(1, "", "")
+	// SASL bind with the EXTERNAL mechanism, as sent by ldapwhoami -Y EXTERNAL
+	saslBind := element(tagSequence,
+		element(tagInteger, []byte{1}),
+		element(tagBindRequest,
+			element(tagInteger, []byte{3}),
+			element(tagOctetString),
+			element(tagAuthSASL, element(tagOctetString, []byte("EXTERNAL"))),
+		),
+	)
+	// Root DSE search: base object "", scope baseObject, filter (objectClass=*)
+	rootDSESearch := element(tagSequence,
+		element(tagInteger, []byte{1}),
+		element(tagSearchRequest,
+			element(tagOctetString),
+			element(0x0A, []byte{0}), element(0x0A, []byte{0}),
+			element(tagInteger, []byte{0}), element(tagInteger, []byte{0}),
+			element(0x01, []byte{0}),
+			element(0x87, []byte("objectClass")),
+			element(tagSequence),
+		),
+	)
+	// Simple bind with a large DN, requiring the long form of length
+	longDN := "cn=" + string(bytes.Repeat([]byte("a"), 300)) + ",dc=example,dc=org"
+	longBind := bindRequest(2, longDN, "secret")
+	// Simple bind followed by controls
+	controlsBind := element(tagSequence,
+		element(tagInteger, []byte{5}),
+		element(tagBindRequest,
+			element(tagInteger, []byte{3}),
+			element(tagOctetString, []byte("cn=admin")),
+			element(tagAuthSimple, []byte("secret")),
+		),
+		element(tagControls, element(tagSequence, element(tagOctetString, []byte("1.2.840.113556.1.4.319")))),
+	)
+	// Unbind request, a valid LDAPMessage that isn't matched
+	unbind := element(tagSequence, element(tagInteger, []byte{1}), element(0x42))
+	// TLS ClientHello, as in LDAPS or after StartTLS
+	clientHello := []byte{
+		0x16, 0x03, 0x01, 0x00, 0x2f, 0x01, 0x00, 0x00, 0x2b, 0x03, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x13, 0x01,
+		0x01, 0x00,
+	}
+
+	tests := []struct {
+		name      string
+		matcher   *MatchLDAP
+		input     []byte
+		wantMatch bool
+		operation string
+		bindDN    string
+	}{
+		{name: "Simple Bind", matcher: &MatchLDAP{}, input: simpleBind, wantMatch: true, operation: "bind", bindDN: "cn=admin,dc=example,dc=org"},
+		{name: "Anonymous Bind", matcher: &MatchLDAP{}, input: anonymousBind, wantMatch: true, operation: "bind", bindDN: ""},
+		{name: "SASL Bind", matcher: &MatchLDAP{}, input: saslBind, wantMatch: true, operation: "bind", bindDN: ""},
+		{name: "Root DSE Search", matcher: &MatchLDAP{}, input: rootDSESearch, wantMatch: true, operation: "search"},
+		{name: "Long Form Length", matcher: &MatchLDAP{}, input: longBind, wantMatch: true, operation: "bind", bindDN: longDN},
+		{name: "Bind With Controls", matcher: &MatchLDAP{}, input: controlsBind, wantMatch: true, operation: "bind", bindDN: "cn=admin"},
+		{name: "Longer than Max Length", matcher: &MatchLDAP{MaxLength: 64}, input: longBind, wantMatch: false},
+		{name: "Unbind", matcher: &MatchLDAP{}, input: unbind, wantMatch: false},
+		{name: "Zero Message ID", matcher: &MatchLDAP{}, input: bindRequest(0, "cn=admin", "secret"), wantMatch: false},
+		{name: "Trailing Garbage", matcher: &MatchLDAP{}, input: element(tagSequence, simpleBind[2:], []byte{0x00, 0x00}), wantMatch: false},
+		{name: "Truncated", matcher: &MatchLDAP{}, input: simpleBind[:len(simpleBind)-4], wantMatch: false},
+		{name: "Empty", matcher: &MatchLDAP{}, input: []byte{}, wantMatch: false},
+		{name: "TLS ClientHello", matcher: &MatchLDAP{}, input: clientHello, wantMatch: false},
+		{name: "HTTP", matcher: &MatchLDAP{}, input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			operation, _ := repl.GetString("l4.ldap.operation")
+			bindDN, _ := repl.GetString("l4.ldap.bind_dn")
+			if operation != tc.operation || bindDN != tc.bindDN {
+				t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n",
+					i, operation, bindDN, tc.operation, tc.bindDN)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4log allows logging a structured summary of each L4 connection
+package l4log
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler is a connection handler that logs a structured line once a connection is closed, containing its remote
+// and local addresses, the number of bytes read and written, its duration, the server and the route the handler
+// belongs to, the names of the matchers of this route, the protocol recognized by them, if any, and the values of
+// the configured placeholders, e.g. {l4.tls.server_name}, so that they can be set by any matcher or handler.
+//
+// A line is logged once the following handlers of the route return, so the handler should precede a terminal
+// handler in the same route, e.g. proxy. Otherwise, it only covers the handlers of its route.
+type Handler struct {
+	// Vars is a list of placeholders to include in the log line, with or without braces, e.g. l4.tls.server_name.
+	// They are logged as strings, and empty if unset.
+	Vars []string `json:"vars,omitempty"`
+
+	server   string
+	route    string
+	matchers []string
+	logger   *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.log",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	for i, name := range h.Vars {
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+		if len(name) == 0 {
+			return fmt.Errorf("var %d: empty placeholder", i)
+		}
+		h.Vars[i] = name
+	}
+	h.server, h.route = layer4.ServerNameFromContext(ctx), layer4.RouteLabelFromContext(ctx)
+	h.matchers = layer4.RouteMatchersFromContext(ctx)
+	return nil
+}
+
+// Handle handles the connection.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	start := time.Now()
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	if wrapTime, ok := repl.Get("l4.conn.wrap_time"); ok {
+		if t, ok := wrapTime.(time.Time); ok {
+			start = t
+		}
+	}
+
+	// Count bytes passing through the underlying connection from now on,
+	// since handlers may wrap cx into connections counting them separately
+	counter := &countingConn{Conn: cx.Conn}
+	cx.Conn = counter
+	read, written := cx.BytesRead(), cx.BytesWritten()
+
+	err := next.Handle(cx)
+
+	fields := []zap.Field{
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.String("local", cx.LocalAddr().String()),
+		zap.Uint64("bytes_read", read+counter.read.Load()),
+		zap.Uint64("bytes_written", written+counter.written.Load()),
+		zap.Duration("duration", time.Since(start)),
+		zap.String("server", h.server),
+		zap.String("route", h.route),
+		zap.Strings("matchers", h.matchers),
+		zap.String("protocol", cx.Protocol()),
+	}
+	if len(h.Vars) > 0 {
+		fields = append(fields, zap.Object("vars", vars{names: h.Vars, repl: repl}))
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	h.logger.Info("connection closed", fields...)
+
+	return err
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	log [<vars...>] {
+//		vars <vars...>
+//	}
+//
+// Note: 'vars' option may be repeated.
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	h.Vars = append(h.Vars, d.RemainingArgs()...)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "vars":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			h.Vars = append(h.Vars, d.RemainingArgs()...)
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// vars marshals the values of the placeholders with the given names as a log object.
+type vars struct {
+	names []string
+	repl  *caddy.Replacer
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler.
+func (v vars) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, name := range v.names {
+		value, _ := v.repl.GetString(name)
+		enc.AddString(name, value)
+	}
+	return nil
+}
+
+type countingConn struct {
+	net.Conn
+	read, written atomic.Uint64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n)) //nolint:gosec // disable G115
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n)) //nolint:gosec // disable G115
+	return n, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner       = (*Handler)(nil)
+	_ caddyfile.Unmarshaler   = (*Handler)(nil)
+	_ layer4.NextHandler      = (*Handler)(nil)
+	_ zapcore.ObjectMarshaler = vars{}
+)
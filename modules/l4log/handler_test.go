@@ -0,0 +1,106 @@
+package l4log
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestHandler_Handle(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{Vars: []string{"{l4.mongo.database}", "l4.tls.server_name"}}
+	err := h.Provision(ctx)
+	assertNoError(t, err)
+	core, logs := observer.New(zapcore.InfoLevel)
+	h.logger = zap.New(core)
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	// The client sends 5 bytes and reads the 3-byte response
+	go func() {
+		_, err := in.Write([]byte("hello"))
+		assertNoError(t, err)
+		_, err = io.ReadFull(in, make([]byte, 3))
+		assertNoError(t, err)
+	}()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	cx.SetProtocol("mongo")
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.mongo.database", "app")
+
+	handlerErr := errors.New("upstream unavailable")
+	err = h.Handle(cx, layer4.HandlerFunc(func(cx *layer4.Connection) error {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(cx, buf); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+		if _, err := cx.Write([]byte("bye")); err != nil {
+			return err
+		}
+		_ = cx.Close()
+		return handlerErr
+	}))
+	if !errors.Is(err, handlerErr) {
+		t.Fatalf("unexpected error | got %v, want %v", err, handlerErr)
+	}
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("unexpected number of log lines | got %d, want 1", len(entries))
+	}
+	if entries[0].Message != "connection closed" {
+		t.Fatalf("unexpected message | got %q", entries[0].Message)
+	}
+	fields := entries[0].ContextMap()
+	for name, want := range map[string]any{
+		"remote":        "pipe",
+		"local":         "pipe",
+		"bytes_read":    uint64(5),
+		"bytes_written": uint64(3),
+		"protocol":      "mongo",
+		"error":         handlerErr.Error(),
+	} {
+		if got := fields[name]; got != want {
+			t.Fatalf("unexpected %s | got %v (%T), want %v (%T)", name, got, got, want, want)
+		}
+	}
+	if d, _ := fields["duration"].(time.Duration); d < 10*time.Millisecond {
+		t.Fatalf("unexpected duration | got %v", fields["duration"])
+	}
+	vars, _ := fields["vars"].(map[string]any)
+	if vars["l4.mongo.database"] != "app" || vars["l4.tls.server_name"] != "" {
+		t.Fatalf("unexpected vars | got %v", fields["vars"])
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{Vars: []string{"{}"}}
+	if err := h.Provision(ctx); err == nil {
+		t.Fatalf("empty placeholder should not be accepted")
+	}
+}
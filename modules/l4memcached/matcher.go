@@ -0,0 +1,204 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4memcached allows the L4 multiplexing of memcached connections
+package l4memcached
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchMemcached{})
+	layer4.RegisterProtocol("memcached")
+}
+
+const (
+	protocolBinary = "binary"
+	protocolText   = "text"
+
+	binaryHeaderLen    = 24   // Length of the binary protocol request header
+	binaryRequestMagic = 0x80 // Magic byte of the binary protocol requests
+	maxLineLength      = 2048 // Maximum length of a text protocol command line, including the line ending
+)
+
+// MatchMemcached is able to match memcached connections using either the binary or the text protocol.
+// The binary protocol is recognized by the request header (the 0x80 magic byte and a known opcode),
+// the text protocol by a command line starting with a known command, e.g. get, set or stats, and
+// terminated by CRLF. The matched protocol (binary or text) is exposed as {l4.memcached.protocol}.
+type MatchMemcached struct {
+	// Protocols is an optional list of protocols to match: binary or text. If empty, both are matched.
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchMemcached) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.memcached",
+		New: func() caddy.Module { return new(MatchMemcached) },
+	}
+}
+
+// Match returns true if the connection starts with a memcached request.
+func (m *MatchMemcached) Match(cx *layer4.Connection) (bool, error) {
+	// Read the first byte to tell the protocols apart
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(cx, first); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for memcached
+		}
+		return false, fmt.Errorf("reading first byte: %w", err)
+	}
+
+	var protocol string
+	var matched bool
+	var err error
+	switch {
+	case first[0] == binaryRequestMagic:
+		protocol = protocolBinary
+		if len(m.Protocols) > 0 && !slices.Contains(m.Protocols, protocol) {
+			return false, nil
+		}
+		matched, err = matchBinary(cx, first)
+	case first[0] >= 'a' && first[0] <= 'z':
+		protocol = protocolText
+		if len(m.Protocols) > 0 && !slices.Contains(m.Protocols, protocol) {
+			return false, nil
+		}
+		matched, err = matchText(cx, first)
+	}
+	if err != nil || !matched {
+		return false, err
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.memcached.protocol", protocol)
+	cx.SetProtocol("memcached")
+
+	return true, nil
+}
+
+// Provision validates m's protocols.
+func (m *MatchMemcached) Provision(_ caddy.Context) error {
+	for _, protocol := range m.Protocols {
+		if protocol != protocolBinary && protocol != protocolText {
+			return fmt.Errorf("unsupported protocol '%s'", protocol)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchMemcached from Caddyfile tokens. Syntax:
+//
+//	memcached [<binary|text>]
+func (m *MatchMemcached) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Protocols = append(m.Protocols, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// matchBinary returns true if the connection continues with a valid binary protocol request header.
+func matchBinary(cx *layer4.Connection, first []byte) (bool, error) {
+	header := make([]byte, binaryHeaderLen)
+	copy(header, first)
+	if _, err := io.ReadFull(cx, header[len(first):]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for the header
+		}
+		return false, fmt.Errorf("reading request header: %w", err)
+	}
+
+	opcode := header[1]
+	keyLength := binary.BigEndian.Uint16(header[2:4])
+	extrasLength := header[4]
+	dataType := header[5]
+	totalBodyLength := binary.BigEndian.Uint32(header[8:12])
+
+	// The data type is reserved for future use and must be raw bytes, and the body must hold the key and extras
+	if !isKnownOpcode(opcode) || dataType != 0x00 || uint32(keyLength)+uint32(extrasLength) > totalBodyLength {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// matchText returns true if the connection continues with a known text protocol command terminated by CRLF.
+func matchText(cx *layer4.Connection, first []byte) (bool, error) {
+	r := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(first), io.LimitReader(cx, maxLineLength-1)), maxLineLength)
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return false, nil // Not enough data for a command line, or a line too long
+		}
+		return false, fmt.Errorf("reading command line: %w", err)
+	}
+
+	line, found := bytes.CutSuffix(line, []byte("\r\n"))
+	if !found {
+		return false, nil
+	}
+	for _, c := range line {
+		if c < 0x20 || c > 0x7E {
+			return false, nil
+		}
+	}
+
+	verb, _, _ := bytes.Cut(line, []byte(" "))
+	return slices.Contains(commands, string(verb)), nil
+}
+
+// isKnownOpcode returns true if opcode is a request opcode defined by the binary protocol.
+func isKnownOpcode(opcode byte) bool {
+	return opcode <= 0x1e || // Get to GATQ
+		opcode >= 0x20 && opcode <= 0x22 || // SASL
+		opcode >= 0x30 && opcode <= 0x3c // Range operations and TAP
+}
+
+// commands contains the commands of the text protocol, including the meta commands.
+var commands = []string{
+	"add", "append", "cas", "decr", "delete", "flush_all", "gat", "gats", "get", "gets", "incr", "prepend",
+	"quit", "replace", "set", "stats", "touch", "verbosity", "version",
+	"cache_memlimit", "lru", "lru_crawler", "misbehave", "shutdown", "slabs", "watch",
+	"ma", "md", "me", "mg", "mn", "ms",
+}
+
+// Refs:
+//
+//	https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+//	https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchMemcached)(nil)
+	_ caddyfile.Unmarshaler = (*MatchMemcached)(nil)
+	_ layer4.ConnMatcher    = (*MatchMemcached)(nil)
+)
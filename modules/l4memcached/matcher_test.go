@@ -0,0 +1,115 @@
+package l4memcached
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// binaryGet is a binary protocol Get request for the key "Hello".
+var binaryGet = []byte{
+	0x80, 0x00, 0x00, 0x05, // magic, opcode, key length
+	0x00, 0x00, 0x00, 0x00, // extras length, data type, vbucket id
+	0x00, 0x00, 0x00, 0x05, // total body length
+	0x00, 0x00, 0x00, 0x00, // opaque
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // CAS
+	'H', 'e', 'l', 'l', 'o',
+}
+
+func TestMatchMemcached(t *testing.T) {
+	tests := []struct {
+		name      string
+		matcher   *MatchMemcached
+		input     []byte
+		wantMatch bool
+		protocol  string
+	}{
+		{name: "Binary Get", matcher: &MatchMemcached{}, input: binaryGet, wantMatch: true, protocol: "binary"},
+		{name: "Binary Get Allowed", matcher: &MatchMemcached{Protocols: []string{"binary"}}, input: binaryGet, wantMatch: true, protocol: "binary"},
+		{name: "Binary Get Not Allowed", matcher: &MatchMemcached{Protocols: []string{"text"}}, input: binaryGet, wantMatch: false},
+		{name: "Binary Unknown Opcode", matcher: &MatchMemcached{}, input: append([]byte{0x80, 0x1f}, binaryGet[2:]...), wantMatch: false},
+		{name: "Binary Non-Raw Data Type", matcher: &MatchMemcached{}, input: append(append([]byte{}, binaryGet[:5]...), append([]byte{0x01}, binaryGet[6:]...)...), wantMatch: false},
+		{name: "Binary Short Body", matcher: &MatchMemcached{}, input: append(append([]byte{}, binaryGet[:11]...), append([]byte{0x04}, binaryGet[12:]...)...), wantMatch: false},
+		{name: "Binary Response", matcher: &MatchMemcached{}, input: append([]byte{0x81}, binaryGet[1:]...), wantMatch: false},
+		{name: "Binary Truncated", matcher: &MatchMemcached{}, input: binaryGet[:20], wantMatch: false},
+		{name: "Text Stats", matcher: &MatchMemcached{}, input: []byte("stats\r\n"), wantMatch: true, protocol: "text"},
+		{name: "Text Get", matcher: &MatchMemcached{}, input: []byte("get foo bar\r\n"), wantMatch: true, protocol: "text"},
+		{name: "Text Set", matcher: &MatchMemcached{}, input: []byte("set foo 0 0 3\r\nbar\r\n"), wantMatch: true, protocol: "text"},
+		{name: "Text Meta Get", matcher: &MatchMemcached{}, input: []byte("mg foo v\r\n"), wantMatch: true, protocol: "text"},
+		{name: "Text Stats Allowed", matcher: &MatchMemcached{Protocols: []string{"text"}}, input: []byte("stats\r\n"), wantMatch: true, protocol: "text"},
+		{name: "Text Stats Not Allowed", matcher: &MatchMemcached{Protocols: []string{"binary"}}, input: []byte("stats\r\n"), wantMatch: false},
+		{name: "Text Bare LF", matcher: &MatchMemcached{}, input: []byte("stats\n"), wantMatch: false},
+		{name: "Text Unknown Command", matcher: &MatchMemcached{}, input: []byte("hello\r\n"), wantMatch: false},
+		{name: "Text Uppercase", matcher: &MatchMemcached{}, input: []byte("STATS\r\n"), wantMatch: false},
+		{name: "Text Truncated", matcher: &MatchMemcached{}, input: []byte("stats"), wantMatch: false},
+		{name: "HTTP", matcher: &MatchMemcached{}, input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "Garbage", matcher: &MatchMemcached{}, input: []byte{0x16, 0x03, 0x01, 0x00, 0xa5, 0x01, 0x00, 0x00}, wantMatch: false},
+		{name: "Empty", matcher: &MatchMemcached{}, input: []byte{}, wantMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if protocol, _ := repl.GetString("l4.memcached.protocol"); protocol != tc.protocol {
+				t.Fatalf("test %d: unexpected protocol | got %q, want %q\n", i, protocol, tc.protocol)
+			}
+		})
+	}
+}
+
+func TestMatchMemcached_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchMemcached{Protocols: []string{"udp"}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported protocol should not be accepted")
+	}
+}
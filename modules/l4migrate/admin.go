@@ -0,0 +1,130 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// MigrateSessions migrates the sessions handled by any migrate handler which are connected to upstream,
+// or all of them if upstream is empty, to other upstreams. It returns the number of sessions migrated
+// and the number of sessions which couldn't be, e.g. because they weren't idle or no other upstream
+// was reachable. The latter are left untouched, so that they may be migrated later.
+func MigrateSessions(upstream string) (migrated, failed int) {
+	for _, s := range sessions.list() {
+		if !s.connectedTo(upstream) {
+			continue
+		}
+		if err := s.migrate(); err != nil {
+			s.handler.logger.Debug("migrating session", zap.String("remote", s.client.RemoteAddr().String()), zap.Error(err))
+			failed++
+			continue
+		}
+		migrated++
+	}
+	return migrated, failed
+}
+
+// sessionRegistry tracks the sessions being handled by all migrate handlers, so that they can be migrated.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+}
+
+// add tracks s until the returned function is called.
+func (r *sessionRegistry) add(s *session) (remove func()) {
+	r.mu.Lock()
+	r.sessions[s] = struct{}{}
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.sessions, s)
+		r.mu.Unlock()
+	}
+}
+
+// list returns the sessions being tracked.
+func (r *sessionRegistry) list() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*session, 0, len(r.sessions))
+	for s := range r.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// sessions is the global registry of sessions, so that sessions established
+// before a config reload can be migrated as well.
+var sessions = &sessionRegistry{sessions: make(map[*session]struct{})}
+
+// adminAPI is a module that provides the migration endpoint of the admin API:
+//
+//	POST /layer4/migrate[?upstream=<address>]
+//
+// migrates the sessions connected to the given upstream (or all of them, if omitted), and responds
+// with the number of sessions migrated and not migrated, e.g. {"migrated": 3, "failed": 1}.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.layer4_migrate",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for session migration.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/layer4/migrate",
+			Handler: caddy.AdminHandlerFunc(a.handleMigrate),
+		},
+	}
+}
+
+// handleMigrate migrates the sessions connected to the upstream given by the query string.
+func (adminAPI) handleMigrate(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	migrated, failed := MigrateSessions(r.URL.Query().Get("upstream"))
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(struct {
+		Migrated int `json:"migrated"`
+		Failed   int `json:"failed"`
+	}{Migrated: migrated, Failed: failed})
+}
+
+// Interface guard
+var _ caddy.AdminRouter = (*adminAPI)(nil)
@@ -0,0 +1,230 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4migrate allows the migration of sessions between upstreams without closing the client connections
+package l4migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler is a terminal handler that proxies connections to upstreams, and can migrate their sessions to other
+// upstreams on demand, e.g. for zero-downtime maintenance of a backend, without closing the client connections.
+// Migrations are triggered with the admin API (see MigrateSessions) and performed by pausing the client, opening
+// a connection to another upstream, replaying the state the session has established so far, e.g. its handshake,
+// and resuming the client on the new connection. Since this is only safe for protocols whose sessions can be
+// resumed, and only at times they allow, e.g. between transactions, the protocol must be provided by a module
+// of the layer4.migrate namespace, which observes the bytes exchanged to capture the state to be replayed.
+type Handler struct {
+	// Upstreams are the addresses of the upstreams, e.g. localhost:5432. Sessions are established with
+	// the first reachable one, and migrated to the next reachable one following their current upstream.
+	Upstreams []string `json:"upstreams,omitempty"`
+
+	// ProtocolRaw is the protocol of the sessions, which captures the state needed to migrate them.
+	ProtocolRaw json.RawMessage `json:"protocol,omitempty" caddy:"namespace=layer4.migrate inline_key=protocol"`
+
+	// DialTimeout is how long dialing an upstream, and replaying a session on it, may take. Default: 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	protocol Protocol
+	addrs    []caddy.NetworkAddress
+	logger   *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.migrate",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+
+	if len(h.Upstreams) == 0 {
+		return errors.New("no upstreams are set")
+	}
+	repl := caddy.NewReplacer()
+	for _, upstream := range h.Upstreams {
+		addr, err := caddy.ParseNetworkAddress(repl.ReplaceAll(upstream, ""))
+		if err != nil {
+			return fmt.Errorf("parsing upstream '%s': %v", upstream, err)
+		}
+		if addr.PortRangeSize() != 1 {
+			return fmt.Errorf("upstream '%s' must have a single port", upstream)
+		}
+		h.addrs = append(h.addrs, addr)
+	}
+
+	if h.ProtocolRaw == nil {
+		return errors.New("no protocol is set")
+	}
+	mod, err := ctx.LoadModule(h, "ProtocolRaw")
+	if err != nil {
+		return fmt.Errorf("loading protocol module: %v", err)
+	}
+	h.protocol = mod.(Protocol)
+
+	if h.DialTimeout <= 0 {
+		h.DialTimeout = caddy.Duration(defaultDialTimeout)
+	}
+
+	return nil
+}
+
+// Handle handles the connection.
+func (h *Handler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
+	upstream, index, err := h.dial(-1, nil)
+	if err != nil {
+		return err
+	}
+
+	s := &session{
+		handler:  h,
+		client:   cx,
+		state:    h.protocol.NewSession(),
+		upstream: upstream,
+		index:    index,
+	}
+	defer sessions.add(s)()
+
+	return s.run()
+}
+
+// dial connects to the first reachable upstream following the one at index skip, or to the first
+// reachable one if skip is negative, and replays a session on it with replay, if not nil. It returns
+// the connection and the index of the upstream.
+func (h *Handler) dial(skip int, replay func(conn net.Conn) error) (net.Conn, int, error) {
+	var errs []error
+	for i := range h.addrs {
+		index := (skip + 1 + i) % len(h.addrs)
+		if index == skip {
+			continue
+		}
+		addr := h.addrs[index]
+
+		conn, err := net.DialTimeout(addr.Network, addr.JoinHostPort(0), time.Duration(h.DialTimeout))
+		if err == nil && replay != nil {
+			if err = conn.SetDeadline(time.Now().Add(time.Duration(h.DialTimeout))); err == nil {
+				if err = replay(conn); err == nil {
+					err = conn.SetDeadline(time.Time{})
+				}
+			}
+			if err != nil {
+				_ = conn.Close()
+			}
+		}
+		if err != nil {
+			h.logger.Debug("dialing upstream", zap.String("upstream", h.Upstreams[index]), zap.Error(err))
+			errs = append(errs, fmt.Errorf("upstream %s: %w", h.Upstreams[index], err))
+			continue
+		}
+		return conn, index, nil
+	}
+	return nil, -1, errors.Join(errs...)
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	migrate <upstreams...> {
+//		protocol <name> [<args...>]
+//		dial_timeout <duration>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// At least one same-line option must be provided
+	if d.CountRemainingArgs() == 0 {
+		return d.ArgErr()
+	}
+	h.Upstreams = append(h.Upstreams, d.RemainingArgs()...)
+
+	var hasProtocol, hasDialTimeout bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "protocol":
+			if hasProtocol {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			protocolName := d.Val()
+
+			unm, err := caddyfile.UnmarshalModule(d, "layer4.migrate."+protocolName)
+			if err != nil {
+				return err
+			}
+			p, ok := unm.(Protocol)
+			if !ok {
+				return d.Errf("protocol module '%s' is not a migration protocol", protocolName)
+			}
+			protocolRaw, err := layer4.SetModuleNameInline("protocol", protocolName, caddyconfig.JSON(p, nil))
+			if err != nil {
+				return d.Errf("re-encoding module '%s' configuration: %v", protocolName, err)
+			}
+			h.ProtocolRaw, hasProtocol = protocolRaw, true
+			continue // the protocol module has consumed its block, if any
+		case "dial_timeout":
+			if hasDialTimeout {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.DialTimeout, hasDialTimeout = caddy.Duration(dur), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+const defaultDialTimeout = 10 * time.Second
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
@@ -0,0 +1,261 @@
+package l4migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	if _, err := caddy.GetModule("layer4.migrate.mock"); err != nil {
+		caddy.RegisterModule(&mockProtocol{})
+	}
+}
+
+// mockProtocol is a line-based protocol: a session starts with a HELLO handshake, then each request
+// line gets a reply line. Sessions are migratable between transactions, i.e. BEGIN and COMMIT requests,
+// when no request is outstanding.
+type mockProtocol struct {
+	replaying chan struct{} // notified when a replay starts, if not nil
+}
+
+func (*mockProtocol) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.migrate.mock",
+		New: func() caddy.Module { return new(mockProtocol) },
+	}
+}
+
+func (p *mockProtocol) NewSession() Session {
+	return &mockSession{replaying: p.replaying}
+}
+
+type mockSession struct {
+	replaying chan struct{}
+	hello     string // handshake line
+	partial   string // incomplete client line
+	pending   int    // requests without reply
+	inTx      bool
+}
+
+func (s *mockSession) ObserveClient(b []byte) {
+	s.partial += string(b)
+	for {
+		line, rest, found := strings.Cut(s.partial, "\n")
+		if !found {
+			return
+		}
+		s.partial = rest
+		if s.hello == "" {
+			s.hello = line + "\n"
+		}
+		switch line {
+		case "BEGIN":
+			s.inTx = true
+		case "COMMIT":
+			s.inTx = false
+		}
+		s.pending++
+	}
+}
+
+func (s *mockSession) ObserveUpstream(b []byte) {
+	s.pending -= strings.Count(string(b), "\n")
+}
+
+func (s *mockSession) Migratable() error {
+	switch {
+	case s.hello == "":
+		return errors.New("no handshake")
+	case s.pending > 0:
+		return errors.New("requests are outstanding")
+	case s.inTx:
+		return errors.New("a transaction is open")
+	}
+	return nil
+}
+
+func (s *mockSession) Replay(upstream net.Conn) error {
+	if s.replaying != nil {
+		s.replaying <- struct{}{}
+		<-s.replaying
+	}
+	if _, err := upstream.Write([]byte(s.hello)); err != nil {
+		return err
+	}
+	// read the reply byte by byte, so that no byte meant for the client is consumed
+	var reply []byte
+	buf := make([]byte, 1)
+	for len(reply) == 0 || reply[len(reply)-1] != '\n' {
+		if _, err := upstream.Read(buf); err != nil {
+			return err
+		}
+		reply = append(reply, buf[0])
+	}
+	if !strings.HasPrefix(string(reply), "WELCOME ") {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
+
+// startBackend starts a server of the mock protocol, which replies with its name.
+func startBackend(t *testing.T, name string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s\n", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					reply := "OK"
+					switch line = strings.TrimSuffix(line, "\n"); {
+					case strings.HasPrefix(line, "HELLO "):
+						reply = "WELCOME"
+					case line == "PING":
+						reply = "PONG"
+					}
+					_, _ = fmt.Fprintf(conn, "%s %s\n", reply, name)
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestHandler_Migrate(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	a, b := startBackend(t, "a"), startBackend(t, "b")
+	defer func() { _ = b.Close() }()
+
+	h := &Handler{
+		Upstreams:   []string{a.Addr().String(), b.Addr().String()},
+		ProtocolRaw: json.RawMessage(`{"protocol":"mock"}`),
+	}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatalf("provisioning: %s\n", err)
+	}
+	replaying := make(chan struct{})
+	h.protocol = &mockProtocol{replaying: replaying}
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(cx, nil)
+	}()
+
+	r := bufio.NewReader(in)
+	request := func(line, want string) {
+		t.Helper()
+		if _, err := in.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("writing %s: %s\n", line, err)
+		}
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading reply to %s: %s\n", line, err)
+		}
+		if got != want+"\n" {
+			t.Fatalf("unexpected reply to %s | got %q, want %q\n", line, got, want)
+		}
+	}
+	migrate := func(upstream string, wantMigrated, wantFailed int) {
+		t.Helper()
+		migrated, failed := MigrateSessions(upstream)
+		if migrated != wantMigrated || failed != wantFailed {
+			t.Fatalf("unexpected migration result | got %d migrated and %d failed, want %d and %d\n",
+				migrated, failed, wantMigrated, wantFailed)
+		}
+	}
+
+	request("HELLO test", "WELCOME a")
+	request("PING", "PONG a")
+
+	// sessions aren't migrated while their state doesn't allow it
+	request("BEGIN", "OK a")
+	migrate(a.Addr().String(), 0, 1)
+	request("COMMIT", "OK a")
+
+	// sessions connected to other upstreams aren't migrated
+	migrate(b.Addr().String(), 0, 0)
+
+	// the client is paused while the session is replayed, and resumed on the new upstream,
+	// without seeing the replies to the replay
+	result := make(chan [2]int, 1)
+	go func() {
+		migrated, failed := MigrateSessions(a.Addr().String())
+		result <- [2]int{migrated, failed}
+	}()
+	<-replaying
+	written := make(chan error, 1)
+	go func() {
+		_, err := in.Write([]byte("PING\n"))
+		written <- err
+	}()
+	if err := <-written; err != nil {
+		t.Fatalf("writing during migration: %s\n", err)
+	}
+	replaying <- struct{}{}
+	if got := <-result; got != [2]int{1, 0} {
+		t.Fatalf("unexpected migration result | got %d migrated and %d failed, want 1 and 0\n", got[0], got[1])
+	}
+	if got, err := r.ReadString('\n'); err != nil || got != "PONG b\n" {
+		t.Fatalf("unexpected reply to PING written during migration | got %q (%v), want %q\n", got, err, "PONG b\n")
+	}
+	request("PING", "PONG b")
+
+	// sessions stay on their upstream if no other one is reachable
+	h.protocol.(*mockProtocol).replaying = nil
+	_ = a.Close()
+	migrate(b.Addr().String(), 0, 1)
+	request("PING", "PONG b")
+
+	_ = in.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error | %s\n", err)
+	}
+	if n := len(sessions.list()); n != 0 {
+		t.Fatalf("unexpected number of tracked sessions | got %d, want %d\n", n, 0)
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*Handler{
+		{ProtocolRaw: json.RawMessage(`{"protocol":"mock"}`)},
+		{Upstreams: []string{"localhost:5432"}},
+		{Upstreams: []string{"localhost:5432-5433"}, ProtocolRaw: json.RawMessage(`{"protocol":"mock"}`)},
+		{Upstreams: []string{"localhost:5432"}, ProtocolRaw: json.RawMessage(`{"protocol":"unknown"}`)},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid handler should not be provisioned | %+v\n", i, h)
+		}
+	}
+}
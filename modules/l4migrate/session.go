@@ -0,0 +1,183 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4migrate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Protocol is implemented by the modules of the layer4.migrate namespace, which make the sessions
+// of a protocol migratable, e.g. layer4.migrate.postgres.
+type Protocol interface {
+	// NewSession returns the state of a new session.
+	NewSession() Session
+}
+
+// Session captures the state of a session needed to migrate it. Its methods are never called concurrently.
+type Session interface {
+	// ObserveClient is called with the bytes sent by the client, before they're written to the upstream.
+	ObserveClient(b []byte)
+
+	// ObserveUpstream is called with the bytes sent by the upstream, before they're written to the client.
+	ObserveUpstream(b []byte)
+
+	// Migratable returns nil if the session can be migrated now, e.g. because it's idle between
+	// transactions, or an error explaining why it can't.
+	Migratable() error
+
+	// Replay establishes the session on a new upstream, e.g. by replaying the handshake captured earlier,
+	// and consumes the upstream's replies, which the client doesn't expect. The client is paused meanwhile.
+	Replay(upstream net.Conn) error
+}
+
+// session is a client connection proxied to an upstream, which may be replaced by another one.
+type session struct {
+	handler *Handler
+	client  net.Conn
+
+	// mu is held while writing to the upstream, and while migrating, which pauses the client.
+	mu       sync.Mutex
+	upstream net.Conn
+	index    int // index of the upstream in handler's upstreams
+
+	stateMu sync.Mutex // serializes the calls to state
+	state   Session
+
+	writeMu sync.Mutex // serializes the writes to the client, which may come from the old and the new upstream
+}
+
+// run proxies the session until either the client or the current upstream closes its connection.
+func (s *session) run() error {
+	s.mu.Lock()
+	go s.pumpUpstream(s.upstream)
+	s.mu.Unlock()
+
+	err := s.pumpClient()
+
+	s.mu.Lock()
+	_ = s.upstream.Close()
+	s.mu.Unlock()
+
+	return err
+}
+
+// pumpClient copies the bytes sent by the client to the current upstream.
+func (s *session) pumpClient() error {
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := s.client.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			s.stateMu.Lock()
+			s.state.ObserveClient(buf[:n])
+			s.stateMu.Unlock()
+			_, werr := s.upstream.Write(buf[:n])
+			s.mu.Unlock()
+			if werr != nil {
+				if errors.Is(werr, net.ErrClosed) {
+					return nil // The upstream has closed the session
+				}
+				return fmt.Errorf("writing to upstream: %w", werr)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("reading from client: %w", err)
+		}
+	}
+}
+
+// pumpUpstream copies the bytes sent by upstream to the client. Once upstream is closed, it closes
+// the client as well, unless the session has been migrated to another upstream.
+func (s *session) pumpUpstream(upstream net.Conn) {
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := upstream.Read(buf)
+		if n > 0 {
+			s.stateMu.Lock()
+			s.state.ObserveUpstream(buf[:n])
+			s.stateMu.Unlock()
+			s.writeMu.Lock()
+			_, werr := s.client.Write(buf[:n])
+			s.writeMu.Unlock()
+			if werr != nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			s.mu.Lock()
+			current := s.upstream == upstream
+			s.mu.Unlock()
+			if current {
+				_ = s.client.Close()
+			}
+			return
+		}
+	}
+}
+
+// migrate moves s to the next reachable upstream following the current one, if its state allows it.
+func (s *session) migrate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	if err := s.state.Migratable(); err != nil {
+		return fmt.Errorf("%w: %w", ErrNotMigratable, err)
+	}
+
+	upstream, index, err := s.handler.dial(s.index, s.state.Replay)
+	if err != nil {
+		return err
+	}
+
+	from := s.handler.Upstreams[s.index]
+	_ = s.upstream.Close()
+	s.upstream, s.index = upstream, index
+	go s.pumpUpstream(upstream)
+
+	s.handler.logger.Info("migrated session",
+		zap.String("remote", s.client.RemoteAddr().String()),
+		zap.String("from", from),
+		zap.String("to", s.handler.Upstreams[index]),
+	)
+	return nil
+}
+
+// connectedTo returns true if s is connected to upstream, or if upstream is empty.
+func (s *session) connectedTo(upstream string) bool {
+	if upstream == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handler.Upstreams[s.index] == upstream
+}
+
+// ErrNotMigratable is returned when the state of a session doesn't allow migrating it.
+var ErrNotMigratable = errors.New("session isn't migratable")
+
+// bufferSize is the size of the buffers used to copy bytes between the client and the upstream.
+const bufferSize = 32 * 1024
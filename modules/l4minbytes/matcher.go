@@ -0,0 +1,116 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4minbytes allows the L4 multiplexing of connections by the size of their first payload
+package l4minbytes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchMinBytes{})
+}
+
+const defaultMinBytes = 16 // Default number of bytes the first payload must have
+
+// MatchMinBytes is able to match connections which first payload has at least a number of bytes, e.g. a full
+// TLS ClientHello, but not the tiny probes of scanners. It peeks at the bytes without consuming them, and decides
+// as soon as the first bytes have been received, without waiting for more, so it's a cheap first-line filter:
+// the routes of heavier matchers may be nested in a subroute of a route matching min_bytes, so that probes
+// match no route and are closed. Note that clients sending their first message in small writes may not match.
+type MatchMinBytes struct {
+	// MinBytes is the number of bytes the first payload must have. It defaults to 16
+	// and may not exceed layer4.MaxMatchingBytes.
+	MinBytes uint16 `json:"min_bytes,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchMinBytes) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.min_bytes",
+		New: func() caddy.Module { return new(MatchMinBytes) },
+	}
+}
+
+// Match returns true if the first payload of the connection has at least MinBytes bytes.
+func (m *MatchMinBytes) Match(cx *layer4.Connection) (bool, error) {
+	buf, err := cx.Peek(int(m.MinBytes))
+	switch {
+	case len(buf) >= int(m.MinBytes):
+		return true, nil
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return false, nil // Closed before sending enough bytes
+	case errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes):
+		if len(buf) == 0 {
+			return false, err // Wait for the first bytes
+		}
+		return false, nil // The first payload is too small
+	default:
+		return false, fmt.Errorf("peeking first bytes: %w", err)
+	}
+}
+
+// Provision sets m's defaults and validates them.
+func (m *MatchMinBytes) Provision(_ caddy.Context) error {
+	if m.MinBytes == 0 {
+		m.MinBytes = defaultMinBytes
+	}
+	if int(m.MinBytes) > layer4.MaxMatchingBytes {
+		return fmt.Errorf("min bytes may not exceed %d", layer4.MaxMatchingBytes)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchMinBytes from Caddyfile tokens. Syntax:
+//
+//	min_bytes [<n>]
+func (m *MatchMinBytes) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line option is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+
+	if d.NextArg() {
+		val, err := strconv.ParseUint(d.Val(), 10, 16)
+		if err != nil {
+			return d.Errf("parsing %s number of bytes: %v", wrapper, err)
+		}
+		m.MinBytes = uint16(val)
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchMinBytes)(nil)
+	_ caddyfile.Unmarshaler = (*MatchMinBytes)(nil)
+	_ layer4.ConnMatcher    = (*MatchMinBytes)(nil)
+)
@@ -0,0 +1,122 @@
+package l4minbytes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// clientHello returns the first TLS record sent by a crypto/tls client, i.e. a full ClientHello.
+func clientHello(t *testing.T) []byte {
+	t.Helper()
+	in, out := net.Pipe()
+	defer func() { _ = out.Close() }()
+
+	go func() {
+		_ = tls.Client(in, &tls.Config{ServerName: "example.com"}).Handshake()
+		_ = in.Close()
+	}()
+
+	header := make([]byte, 5)
+	_, err := io.ReadFull(out, header)
+	assertNoError(t, err)
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:5])))
+	copy(record, header)
+	_, err = io.ReadFull(out, record[5:])
+	assertNoError(t, err)
+	return record
+}
+
+func Test_MatchMinBytes_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchMinBytes
+		data        []byte
+		shouldMatch bool
+	}
+
+	hello := clientHello(t)
+
+	tests := []test{
+		{matcher: &MatchMinBytes{}, data: hello, shouldMatch: true},
+		{matcher: &MatchMinBytes{MinBytes: 128}, data: hello, shouldMatch: true},
+		{matcher: &MatchMinBytes{MinBytes: 16}, data: []byte("GET / HTTP/1.1\r\n\r\n"), shouldMatch: true},
+		{matcher: &MatchMinBytes{MinBytes: 4}, data: []byte{0x16, 0x03, 0x01, 0x00}, shouldMatch: true},
+		{matcher: &MatchMinBytes{}, data: []byte{0x16, 0x03, 0x01, 0x00}, shouldMatch: false},
+		{matcher: &MatchMinBytes{}, data: []byte("\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchMinBytes{MinBytes: 16}, data: bytes.Repeat([]byte{'x'}, 15), shouldMatch: false},
+		{matcher: &MatchMinBytes{MinBytes: 1024}, data: hello[:min(len(hello), 1023)], shouldMatch: false},
+		{matcher: &MatchMinBytes{}, data: []byte{}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() { _ = out.Close() }()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			// The peeked bytes must not be consumed
+			read, err := io.ReadAll(cx)
+			assertNoError(t, err)
+			if !bytes.Equal(read, tc.data) {
+				t.Fatalf("test %d: matcher should not consume bytes | got %d, want %d\n", i, len(read), len(tc.data))
+			}
+		}()
+	}
+}
+
+func Test_MatchMinBytes_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchMinBytes{}
+	err := m.Provision(ctx)
+	assertNoError(t, err)
+	if m.MinBytes != defaultMinBytes {
+		t.Fatalf("unexpected default min bytes | got %d, want %d\n", m.MinBytes, defaultMinBytes)
+	}
+
+	m = &MatchMinBytes{MinBytes: layer4.MaxMatchingBytes + 1}
+	if err = m.Provision(ctx); err == nil {
+		t.Fatalf("invalid matcher should not be provisioned | %+v\n", m)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4modbus allows the L4 multiplexing of Modbus/TCP connections
+package l4modbus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchModbus{})
+	layer4.RegisterProtocol("modbus")
+}
+
+const (
+	headerLength    = 7   // Length of the MBAP header, including the unit identifier (bytes)
+	minLength       = 2   // Minimum value of the length field: the unit identifier and the function code
+	maxLength       = 254 // Maximum value of the length field: the unit identifier and a PDU of up to 253 bytes
+	protocolModbus  = 0   // Protocol identifier of Modbus
+	fixedPDULength  = 5   // Length of the PDU of requests with an address and a quantity or value (bytes)
+	exceptionOffset = 0x80
+)
+
+// MatchModbus is able to match Modbus/TCP connections, which start with a request of the client:
+// an MBAP header (transaction identifier, protocol identifier 0, length and unit identifier) followed
+// by a PDU beginning with a public or user-defined function code. The function code is exposed as
+// {l4.modbus.function_code}, e.g. 3 for Read Holding Registers, and the unit identifier as
+// {l4.modbus.unit_id}.
+type MatchModbus struct{}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchModbus) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.modbus",
+		New: func() caddy.Module { return new(MatchModbus) },
+	}
+}
+
+// Match returns true if the connection looks like Modbus/TCP.
+func (m *MatchModbus) Match(cx *layer4.Connection) (bool, error) {
+	// Read the MBAP header
+	buf := make([]byte, headerLength)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for Modbus/TCP
+		}
+		return false, fmt.Errorf("reading MBAP header: %w", err)
+	}
+
+	// Validate the protocol identifier and the length, which counts the unit identifier and the PDU
+	r := byteparser.NewReader(buf)
+	r.Skip(2) // transaction identifier
+	protocol, length, unitID := r.ReadUint16(), int(r.ReadUint16()), r.ReadUint8()
+	if protocol != protocolModbus || length < minLength || length > maxLength {
+		return false, nil
+	}
+
+	// Read the PDU, which must be as long as the length field says
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(cx, pdu); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for the PDU
+		}
+		return false, fmt.Errorf("reading PDU: %w", err)
+	}
+
+	// Validate the function code, and the length of the PDU of requests having a fixed length
+	functionCode := pdu[0]
+	if !isValidFunctionCode(functionCode) {
+		return false, nil
+	}
+	if functionCode <= functionWriteSingleRegister && len(pdu) != fixedPDULength {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.modbus.function_code", strconv.Itoa(int(functionCode)))
+	repl.Set("l4.modbus.unit_id", strconv.Itoa(int(unitID)))
+	cx.SetProtocol("modbus")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchModbus from Caddyfile tokens. Syntax:
+//
+//	modbus
+func (m *MatchModbus) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// isValidFunctionCode returns true if c is a public or user-defined function code of a request.
+// Exception responses have the highest bit set, so they are excluded.
+func isValidFunctionCode(c uint8) bool {
+	if c == 0 || c >= exceptionOffset {
+		return false
+	}
+	if (c >= 65 && c <= 72) || (c >= 100 && c <= 110) {
+		return true // user-defined
+	}
+	switch c {
+	case 1, 2, 3, 4, 5, 6, 7, 8, 11, 12, 15, 16, 17, 20, 21, 22, 23, 24, 43:
+		return true
+	}
+	return false
+}
+
+// Modbus function codes
+const (
+	functionReadHoldingRegisters uint8 = 3
+	functionWriteSingleRegister  uint8 = 6
+)
+
+// Refs:
+//
+//	https://www.modbus.org/docs/Modbus_Messaging_Implementation_Guide_V1_0b.pdf
+//	https://www.modbus.org/docs/Modbus_Application_Protocol_V1_1b3.pdf
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchModbus)(nil)
+	_ layer4.ConnMatcher    = (*MatchModbus)(nil)
+)
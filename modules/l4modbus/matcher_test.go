@@ -0,0 +1,108 @@
+package l4modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// request returns a Modbus/TCP request with the given protocol identifier, unit identifier and PDU.
+func request(protocol uint16, unitID uint8, pdu ...byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, 0x0001) // transaction identifier
+	b = binary.BigEndian.AppendUint16(b, protocol)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(pdu)+1)) //nolint:gosec // disable G115
+	b = append(b, unitID)
+	return append(b, pdu...)
+}
+
+func Test_MatchModbus_Match(t *testing.T) {
+	type test struct {
+		data         []byte
+		shouldMatch  bool
+		functionCode string
+		unitID       string
+	}
+
+	// Read 10 holding registers starting at 0x006B
+	readHoldingRegisters := request(protocolModbus, 17, functionReadHoldingRegisters, 0x00, 0x6B, 0x00, 0x0A)
+
+	// Write 2 registers starting at 0x0001
+	writeMultipleRegisters := request(protocolModbus, 1, 16, 0x00, 0x01, 0x00, 0x02, 0x04, 0x00, 0x0A, 0x01, 0x02)
+
+	tooLong := request(protocolModbus, 17, functionReadHoldingRegisters, 0x00, 0x6B, 0x00, 0x0A)
+	binary.BigEndian.PutUint16(tooLong[4:6], 0xFFFF)
+
+	tests := []test{
+		{data: readHoldingRegisters, shouldMatch: true, functionCode: "3", unitID: "17"},
+		{data: writeMultipleRegisters, shouldMatch: true, functionCode: "16", unitID: "1"},
+		{data: request(protocolModbus, 255, 100, 0x01), shouldMatch: true, functionCode: "100", unitID: "255"},
+
+		{data: request(1, 17, functionReadHoldingRegisters, 0x00, 0x6B, 0x00, 0x0A), shouldMatch: false},
+		{data: request(protocolModbus, 17, functionReadHoldingRegisters, 0x00, 0x6B, 0x00), shouldMatch: false},
+		{data: request(protocolModbus, 17, 0x83, 0x02), shouldMatch: false},
+		{data: request(protocolModbus, 17, 0x00, 0x00, 0x6B, 0x00, 0x0A), shouldMatch: false},
+		{data: request(protocolModbus, 17, 9, 0x00, 0x6B, 0x00, 0x0A), shouldMatch: false},
+		{data: request(protocolModbus, 17), shouldMatch: false},
+		{data: tooLong, shouldMatch: false},
+		{data: readHoldingRegisters[:len(readHoldingRegisters)-1], shouldMatch: false},
+		{data: readHoldingRegisters[:headerLength-1], shouldMatch: false},
+		{data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{data: []byte("SSH-2.0-OpenSSH_9.6\r\n"), shouldMatch: false},
+		{data: []byte{0x16, 0x03, 0x01, 0x00, 0xa5, 0x01, 0x00, 0x00, 0xa1, 0x03, 0x03, 0x00}, shouldMatch: false},
+		{data: []byte{}, shouldMatch: false},
+	}
+
+	for i, tc := range tests {
+		func() {
+			matcher := &MatchModbus{}
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.data)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.data)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range map[string]string{
+				"l4.modbus.function_code": tc.functionCode,
+				"l4.modbus.unit_id":       tc.unitID,
+			} {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
+		}()
+	}
+}
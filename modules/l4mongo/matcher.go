@@ -0,0 +1,195 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4mongo allows the L4 multiplexing of MongoDB connections
+package l4mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchMongo{})
+	layer4.RegisterProtocol("mongo")
+}
+
+const (
+	headerSize         = 16       // Size of message header: messageLength, requestID, responseTo and opCode
+	maxMessageSize     = 48000000 // Maximum message size accepted by MongoDB servers (maxMessageSizeBytes)
+	maxNamespaceSize   = 256      // Maximum reasonable fullCollectionName size (including the null terminator)
+	minDocumentSize    = 5        // Smallest valid BSON document: int32 length and a null terminator
+	opMsgPrefixSize    = 4 + 1    // flagBits and the kind of the first section
+	opCompressedPrefix = 4 + 4 + 1
+
+	opCodeQuery      = 2004
+	opCodeCompressed = 2012
+	opCodeMsg        = 2013
+
+	// Known OP_MSG flagBits: checksumPresent, moreToCome and exhaustAllowed
+	opMsgKnownFlags = 1<<0 | 1<<1 | 1<<16
+	// Known compressor ids: noop, snappy, zlib and zstd
+	maxCompressorID = 3
+)
+
+// MatchMongo is able to match MongoDB connections by their opening message, which is either
+// an OP_MSG, an OP_QUERY (used by drivers for the legacy handshake) or an OP_COMPRESSED wrapping
+// one of them. For OP_QUERY, the database portion of fullCollectionName (e.g. admin for
+// admin.$cmd) is exposed as {l4.mongo.database}.
+type MatchMongo struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchMongo) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.mongo",
+		New: func() caddy.Module { return new(MatchMongo) },
+	}
+}
+
+// Match returns true if the connection looks like the MongoDB wire protocol.
+func (m *MatchMongo) Match(cx *layer4.Connection) (bool, error) {
+	// Read message header (first 16 bytes)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for MongoDB
+		}
+		return false, fmt.Errorf("reading message header: %w", err)
+	}
+
+	// Parse and validate message header
+	msgLen := binary.LittleEndian.Uint32(header[0:4])
+	responseTo := binary.LittleEndian.Uint32(header[8:12])
+	opCode := binary.LittleEndian.Uint32(header[12:16])
+	if msgLen > maxMessageSize {
+		return false, nil // Too large, reject to prevent DoS
+	}
+	if responseTo != 0 {
+		return false, nil // An opening message can't be a reply
+	}
+
+	switch opCode {
+	case opCodeMsg:
+		if msgLen < headerSize+opMsgPrefixSize+minDocumentSize {
+			return false, nil
+		}
+		prefix, err := readPrefix(cx, opMsgPrefixSize)
+		if err != nil || prefix == nil {
+			return false, err
+		}
+		flags := binary.LittleEndian.Uint32(prefix[0:4])
+		kind := prefix[4]
+		if flags&^opMsgKnownFlags != 0 || kind > 1 {
+			return false, nil
+		}
+		cx.SetProtocol("mongo")
+		return true, nil
+
+	case opCodeQuery:
+		// flags, fullCollectionName, numberToSkip, numberToReturn and query
+		if msgLen < headerSize+4+2+4+4+minDocumentSize {
+			return false, nil
+		}
+		n := min(int(msgLen)-headerSize, 4+maxNamespaceSize)
+		prefix, err := readPrefix(cx, n)
+		if err != nil || prefix == nil {
+			return false, err
+		}
+		end := bytes.IndexByte(prefix[4:], 0)
+		if end <= 0 {
+			return false, nil // Missing or empty fullCollectionName
+		}
+		database, _, found := bytes.Cut(prefix[4:4+end], []byte("."))
+		if !found || len(database) == 0 || !byteparser.IsPrintable(prefix[4:4+end]) {
+			return false, nil
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		repl.Set("l4.mongo.database", string(database))
+		cx.SetProtocol("mongo")
+		return true, nil
+
+	case opCodeCompressed:
+		if msgLen < headerSize+opCompressedPrefix {
+			return false, nil
+		}
+		prefix, err := readPrefix(cx, opCompressedPrefix)
+		if err != nil || prefix == nil {
+			return false, err
+		}
+		originalOpCode := binary.LittleEndian.Uint32(prefix[0:4])
+		compressorID := prefix[8]
+		if originalOpCode != opCodeMsg && originalOpCode != opCodeQuery || compressorID > maxCompressorID {
+			return false, nil
+		}
+		cx.SetProtocol("mongo")
+		return true, nil
+
+	default:
+		return false, nil
+	}
+}
+
+// readPrefix reads n bytes following the message header. It returns nil
+// without an error if the connection doesn't have enough data.
+func readPrefix(cx *layer4.Connection, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil // Incomplete message
+		}
+		return nil, fmt.Errorf("reading message body: %w", err)
+	}
+	return buf, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchMongo from Caddyfile tokens. Syntax:
+//
+//	mongo
+func (m *MatchMongo) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://www.mongodb.com/docs/manual/reference/mongodb-wire-protocol/
+//	https://github.com/mongodb/specifications/blob/master/source/message/OP_MSG.md
+//	https://github.com/mongodb/specifications/blob/master/source/compression/OP_COMPRESSED.md
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchMongo)(nil)
+	_ layer4.ConnMatcher    = (*MatchMongo)(nil)
+)
@@ -0,0 +1,138 @@
+package l4mongo
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchMongo(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		wantMatch bool
+		database  string
+	}{
+		{name: "OP_MSG hello", input: packetOpMsgHello, wantMatch: true},
+		{name: "OP_QUERY isMaster", input: packetOpQueryIsMaster, wantMatch: true, database: "admin"},
+		{name: "OP_COMPRESSED", input: packetOpCompressed, wantMatch: true},
+		{name: "Empty", input: []byte{}, wantMatch: false},
+		{name: "Header Only", input: packetOpMsgHello[:headerSize], wantMatch: false},
+		{name: "OP_MSG Unknown Flags", input: withUint32(packetOpMsgHello, 16, 1<<4), wantMatch: false},
+		{name: "OP_MSG Unknown Section Kind", input: withByte(packetOpMsgHello, 20, 0x02), wantMatch: false},
+		{name: "OP_MSG Too Short", input: withUint32(packetOpMsgHello, 0, 20), wantMatch: false},
+		{name: "OP_MSG Too Large", input: withUint32(packetOpMsgHello, 0, maxMessageSize+1), wantMatch: false},
+		{name: "Reply", input: withUint32(packetOpMsgHello, 8, 1), wantMatch: false},
+		{name: "Unknown OpCode", input: withUint32(packetOpMsgHello, 12, 2014), wantMatch: false},
+		{name: "OP_REPLY", input: withUint32(packetOpMsgHello, 12, 1), wantMatch: false},
+		{name: "OP_QUERY Without Dot", input: withByte(packetOpQueryIsMaster, 25, '_'), wantMatch: false},
+		{name: "OP_QUERY Unterminated Namespace", input: packetOpQueryIsMaster[:28], wantMatch: false},
+		{name: "OP_COMPRESSED Unknown Compressor", input: withByte(packetOpCompressed, 24, 0x09), wantMatch: false},
+		{name: "OP_COMPRESSED Unknown Original OpCode", input: withUint32(packetOpCompressed, 16, 2010), wantMatch: false},
+		{name: "HTTP", input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "SSH", input: []byte("SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n"), wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matcher := &MatchMongo{}
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			if protocol := cx.Protocol(); tc.wantMatch != (protocol == "mongo") {
+				t.Fatalf("test %d: unexpected protocol tag | got %q\n", i, protocol)
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			database, _ := repl.GetString("l4.mongo.database")
+			if database != tc.database {
+				t.Fatalf("test %d: unexpected database | got %q, want %q\n", i, database, tc.database)
+			}
+		})
+	}
+}
+
+func withByte(b []byte, i int, v byte) []byte {
+	c := append([]byte{}, b...)
+	c[i] = v
+	return c
+}
+
+func withUint32(b []byte, i int, v uint32) []byte {
+	c := append([]byte{}, b...)
+	binary.LittleEndian.PutUint32(c[i:], v)
+	return c
+}
+
+// Packet examples
+
+// packetOpMsgHello is an OP_MSG with the following body: {hello: 1, helloOk: true, $db: "admin"}
+var packetOpMsgHello = []byte{
+	0x3E, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xDD, 0x07, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x29, 0x00, 0x00, 0x00, 0x10, 0x68, 0x65, 0x6C, 0x6C, 0x6F, 0x00,
+	0x01, 0x00, 0x00, 0x00, 0x08, 0x68, 0x65, 0x6C, 0x6C, 0x6F, 0x4F, 0x6B, 0x00, 0x01, 0x02, 0x24,
+	0x64, 0x62, 0x00, 0x06, 0x00, 0x00, 0x00, 0x61, 0x64, 0x6D, 0x69, 0x6E, 0x00, 0x00,
+}
+
+// packetOpQueryIsMaster is an OP_QUERY to admin.$cmd with the following query:
+// {isMaster: 1, helloOk: true, client: {driver: {name: "nodejs", version: "6.3.0"}}}
+var packetOpQueryIsMaster = []byte{
+	0x82, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xD4, 0x07, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x61, 0x64, 0x6D, 0x69, 0x6E, 0x2E, 0x24, 0x63, 0x6D, 0x64, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0x5B, 0x00, 0x00, 0x00, 0x10, 0x69, 0x73, 0x4D, 0x61,
+	0x73, 0x74, 0x65, 0x72, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08, 0x68, 0x65, 0x6C, 0x6C, 0x6F, 0x4F,
+	0x6B, 0x00, 0x01, 0x03, 0x63, 0x6C, 0x69, 0x65, 0x6E, 0x74, 0x00, 0x36, 0x00, 0x00, 0x00, 0x03,
+	0x64, 0x72, 0x69, 0x76, 0x65, 0x72, 0x00, 0x29, 0x00, 0x00, 0x00, 0x02, 0x6E, 0x61, 0x6D, 0x65,
+	0x00, 0x07, 0x00, 0x00, 0x00, 0x6E, 0x6F, 0x64, 0x65, 0x6A, 0x73, 0x00, 0x02, 0x76, 0x65, 0x72,
+	0x73, 0x69, 0x6F, 0x6E, 0x00, 0x06, 0x00, 0x00, 0x00, 0x36, 0x2E, 0x33, 0x2E, 0x30, 0x00, 0x00,
+	0x00, 0x00,
+}
+
+// packetOpCompressed is an OP_COMPRESSED wrapping an OP_MSG with snappy
+var packetOpCompressed = []byte{
+	0x32, 0x00, 0x00, 0x00, // messageLength (50)
+	0x03, 0x00, 0x00, 0x00, // requestID
+	0x00, 0x00, 0x00, 0x00, // responseTo
+	0xDC, 0x07, 0x00, 0x00, // opCode (OP_COMPRESSED)
+	0xDD, 0x07, 0x00, 0x00, // originalOpcode (OP_MSG)
+	0x2E, 0x00, 0x00, 0x00, // uncompressedSize (46)
+	0x01,                                                                                           // compressorId (snappy)
+	0x2E, 0xB4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1D, 0x00, 0x00, 0x00, 0x10, 0x70, 0x69, 0x6E, 0x67, // compressedMessage (1/2)
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x24, 0x64, 0x62, // compressedMessage (2/2)
+}
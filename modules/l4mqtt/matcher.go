@@ -0,0 +1,209 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4mqtt allows the L4 multiplexing of MQTT connections
+package l4mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchMQTT{})
+	layer4.RegisterProtocol("mqtt")
+}
+
+const (
+	packetTypeConnect   = 0x10 // First byte of a CONNECT packet: control packet type 1 and zero flags
+	varIntSizeMax       = 4    // Maximum size of a variable byte integer
+	minRemainingLength  = 12   // Smallest valid CONNECT: protocol name "MQTT", level, flags, keep alive, empty client id
+	maxPayloadSize      = 4096 // Maximum number of bytes of the variable header and payload to be parsed (4 KB)
+	connectFlagReserved = 0x01 // Reserved bit of connect flags, must be zero
+)
+
+// MatchMQTT is able to match MQTT connections by their CONNECT packet. MQTT 3.1, 3.1.1 and 5.0
+// are supported. The protocol level (3, 4 or 5 respectively) and the client identifier of a
+// matched packet are exposed as {l4.mqtt.protocol_level} and {l4.mqtt.client_id}.
+type MatchMQTT struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchMQTT) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.mqtt",
+		New: func() caddy.Module { return new(MatchMQTT) },
+	}
+}
+
+// Match returns true if the connection starts with an MQTT CONNECT packet.
+func (m *MatchMQTT) Match(cx *layer4.Connection) (bool, error) {
+	// Read packet type and flags (first byte)
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for MQTT
+		}
+		return false, fmt.Errorf("reading packet type: %w", err)
+	}
+	if header[0] != packetTypeConnect {
+		return false, nil
+	}
+
+	// Read remaining length byte by byte, as its size is only known once decoded
+	var lengthBytes []byte
+	for {
+		if _, err := io.ReadFull(cx, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return false, nil // Incomplete packet
+			}
+			return false, fmt.Errorf("reading remaining length: %w", err)
+		}
+		lengthBytes = append(lengthBytes, header[0])
+		if header[0]&0x80 == 0 {
+			break
+		}
+		if len(lengthBytes) == varIntSizeMax {
+			return false, nil // Variable byte integer is too long
+		}
+	}
+	remainingLength, n, ok := decodeVarInt(lengthBytes)
+	if !ok || n != len(lengthBytes) || remainingLength < minRemainingLength {
+		return false, nil
+	}
+
+	// Read the variable header and the beginning of the payload
+	payload := make([]byte, min(remainingLength, maxPayloadSize))
+	if _, err := io.ReadFull(cx, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Incomplete packet
+		}
+		return false, fmt.Errorf("reading payload: %w", err)
+	}
+
+	// Check protocol name and level
+	name, pos, ok := readString(payload, 0)
+	if !ok || pos+4 > len(payload) {
+		return false, nil
+	}
+	level := payload[pos]
+	switch {
+	case bytes.Equal(name, []byte("MQTT")) && (level == 4 || level == 5):
+	case bytes.Equal(name, []byte("MQIsdp")) && level == 3:
+	default:
+		return false, nil
+	}
+
+	// Check connect flags, skip keep alive
+	if payload[pos+1]&connectFlagReserved != 0 {
+		return false, nil
+	}
+	pos += 4
+
+	// Skip properties (MQTT 5.0 only)
+	if level == 5 {
+		propertiesLength, n, ok := decodeVarInt(payload[pos:])
+		if !ok || pos+n+propertiesLength > len(payload) {
+			return false, nil
+		}
+		pos += n + propertiesLength
+	}
+
+	// Read client identifier, the first field of the payload
+	clientID, _, ok := readString(payload, pos)
+	if !ok {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.mqtt.protocol_level", strconv.Itoa(int(level)))
+	repl.Set("l4.mqtt.client_id", string(clientID))
+	cx.SetProtocol("mqtt")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchMQTT from Caddyfile tokens. Syntax:
+//
+//	mqtt
+func (m *MatchMQTT) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// decodeVarInt decodes a variable byte integer from the beginning of b. It returns the value,
+// the number of bytes used and true, or false if b doesn't start with a valid encoding.
+// Encodings longer than 4 bytes or using more bytes than necessary are considered invalid.
+func decodeVarInt(b []byte) (int, int, bool) {
+	var value, multiplier int = 0, 1
+	for i := 0; i < len(b) && i < varIntSizeMax; i++ {
+		value += int(b[i]&0x7F) * multiplier
+		if b[i]&0x80 == 0 {
+			if i > 0 && b[i] == 0 {
+				return 0, 0, false // Non-minimal encoding
+			}
+			return value, i + 1, true
+		}
+		multiplier <<= 7
+	}
+	return 0, 0, false
+}
+
+// readString reads a length-prefixed UTF-8 string from b at pos. It returns the string,
+// the position following it and true, or false if b doesn't contain a valid string at pos.
+func readString(b []byte, pos int) ([]byte, int, bool) {
+	if pos+2 > len(b) {
+		return nil, 0, false
+	}
+	end := pos + 2 + int(binary.BigEndian.Uint16(b[pos:pos+2]))
+	if end > len(b) {
+		return nil, 0, false
+	}
+	s := b[pos+2 : end]
+	if !utf8.Valid(s) || bytes.IndexByte(s, 0) >= 0 {
+		return nil, 0, false
+	}
+	return s, end, true
+}
+
+// Refs:
+//
+//	https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html#_Toc398718028
+//	https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901033
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchMQTT)(nil)
+	_ layer4.ConnMatcher    = (*MatchMQTT)(nil)
+)
@@ -0,0 +1,149 @@
+package l4mqtt
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func encodeVarInt(value int) []byte {
+	var b []byte
+	for {
+		c := byte(value & 0x7F)
+		value >>= 7
+		if value > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if value == 0 {
+			return b
+		}
+	}
+}
+
+func encodeString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// buildConnect returns a CONNECT packet with clean session set, a keep alive of 60 seconds
+// and the given properties (MQTT 5.0 only) and client identifier.
+func buildConnect(name string, level byte, properties []byte, clientID string) []byte {
+	variable := append(encodeString(name), level, 0x02, 0x00, 0x3C)
+	if level == 5 {
+		variable = append(append(variable, encodeVarInt(len(properties))...), properties...)
+	}
+	variable = append(variable, encodeString(clientID)...)
+	return append(append([]byte{packetTypeConnect}, encodeVarInt(len(variable))...), variable...)
+}
+
+func TestMatchMQTT(t *testing.T) {
+	longClientID := strings.Repeat("x", 200)
+	sessionExpiry := []byte{0x11, 0x00, 0x00, 0x00, 0x0A}
+
+	tests := []struct {
+		name      string
+		input     []byte
+		wantMatch bool
+		level     string
+		clientID  string
+	}{
+		{name: "v3.1.1", input: buildConnect("MQTT", 4, nil, "sensor-42"), wantMatch: true, level: "4", clientID: "sensor-42"},
+		{name: "v3.1.1, Empty Client ID", input: buildConnect("MQTT", 4, nil, ""), wantMatch: true, level: "4", clientID: ""},
+		{name: "v3.1.1, 2-Byte Remaining Length", input: buildConnect("MQTT", 4, nil, longClientID), wantMatch: true, level: "4", clientID: longClientID},
+		{name: "v5.0", input: buildConnect("MQTT", 5, sessionExpiry, "fw-2.1.0"), wantMatch: true, level: "5", clientID: "fw-2.1.0"},
+		{name: "v5.0, No Properties", input: buildConnect("MQTT", 5, nil, "fw-2.1.0"), wantMatch: true, level: "5", clientID: "fw-2.1.0"},
+		{name: "v3.1", input: buildConnect("MQIsdp", 3, nil, "legacy"), wantMatch: true, level: "3", clientID: "legacy"},
+		{name: "Followed by Data", input: append(buildConnect("MQTT", 4, nil, "a"), 0xC0, 0x00), wantMatch: true, level: "4", clientID: "a"},
+		{name: "Wrong Level", input: buildConnect("MQTT", 3, nil, "a"), wantMatch: false},
+		{name: "Wrong Name", input: buildConnect("MQTX", 4, nil, "a"), wantMatch: false},
+		{name: "Properties Exceeding Packet", input: []byte{packetTypeConnect, 0x10, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3C, 0x0A, 0x11, 0x00, 0x00, 0x00, 0x0A}, wantMatch: false},
+		{name: "Reserved Flag", input: func() []byte { b := buildConnect("MQTT", 4, nil, "a"); b[9] |= 0x01; return b }(), wantMatch: false},
+		{name: "Not CONNECT", input: []byte{0x20, 0x02, 0x00, 0x00}, wantMatch: false},
+		{name: "Remaining Length Too Long", input: []byte{packetTypeConnect, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, wantMatch: false},
+		{name: "Remaining Length Non-Minimal", input: append([]byte{packetTypeConnect, 0x8D, 0x00}, buildConnect("MQTT", 4, nil, "a")[2:]...), wantMatch: false},
+		{name: "Remaining Length Too Small", input: []byte{packetTypeConnect, 0x02, 0x00, 0x00}, wantMatch: false},
+		{name: "Remaining Length Truncated", input: []byte{packetTypeConnect, 0x80}, wantMatch: false},
+		{name: "Truncated", input: buildConnect("MQTT", 4, nil, "sensor-42")[:10], wantMatch: false},
+		{name: "Empty", input: []byte{}, wantMatch: false},
+		{name: "HTTP", input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matcher := &MatchMQTT{}
+			matched, err := matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			level, _ := repl.GetString("l4.mqtt.protocol_level")
+			clientID, _ := repl.GetString("l4.mqtt.client_id")
+			if level != tc.level || clientID != tc.clientID {
+				t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n", i, level, clientID, tc.level, tc.clientID)
+			}
+		})
+	}
+}
+
+func TestDecodeVarInt(t *testing.T) {
+	tests := []struct {
+		input []byte
+		value int
+		n     int
+		ok    bool
+	}{
+		{input: []byte{0x00}, value: 0, n: 1, ok: true},
+		{input: []byte{0x7F}, value: 127, n: 1, ok: true},
+		{input: []byte{0x80, 0x01}, value: 128, n: 2, ok: true},
+		{input: []byte{0xFF, 0x7F}, value: 16383, n: 2, ok: true},
+		{input: []byte{0xFF, 0xFF, 0xFF, 0x7F, 0x00}, value: 268435455, n: 4, ok: true},
+		{input: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, ok: false},
+		{input: []byte{0x80, 0x00}, ok: false},
+		{input: []byte{0x80}, ok: false},
+		{input: []byte{}, ok: false},
+	}
+
+	for i, tc := range tests {
+		value, n, ok := decodeVarInt(tc.input)
+		if value != tc.value || n != tc.n || ok != tc.ok {
+			t.Fatalf("test %d: unexpected result | got %d, %d, %t, want %d, %d, %t\n", i, value, n, ok, tc.value, tc.n, tc.ok)
+		}
+	}
+}
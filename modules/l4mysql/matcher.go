@@ -0,0 +1,145 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4mysql allows the L4 multiplexing of MySQL and MariaDB connections
+package l4mysql
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchMySQL{})
+	layer4.RegisterProtocol("mysql")
+}
+
+const (
+	headerSize          = 4    // Size of packet header: 3 bytes of length and 1 byte of sequence id
+	minPayloadSize      = 17   // Smallest valid greeting: protocol version, empty server version, thread id, auth data, filler, capabilities
+	maxPayloadSize      = 4096 // Maximum reasonable greeting size (4 KB)
+	protocolVersion10   = 10   // Protocol version sent by all supported servers
+	authPluginDataSize1 = 8    // Size of the first part of auth plugin data
+)
+
+// MatchMySQL is able to match MySQL and MariaDB connections by their initial handshake packet.
+// Unlike most protocols, MySQL is server-first: the server sends a greeting, and the client
+// stays silent until it receives one. So, this matcher is useful where the connecting peer is
+// a MySQL server, e.g. with reverse tunnels or servers dialing out, while ordinary clients will
+// never be matched. The server version of a matched greeting is exposed as {l4.mysql.server_version}.
+type MatchMySQL struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchMySQL) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.mysql",
+		New: func() caddy.Module { return new(MatchMySQL) },
+	}
+}
+
+// Match returns true if the connection starts with a MySQL initial handshake packet.
+func (m *MatchMySQL) Match(cx *layer4.Connection) (bool, error) {
+	// Read packet header (first 4 bytes)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for MySQL
+		}
+		return false, fmt.Errorf("reading packet header: %w", err)
+	}
+
+	// Parse and validate payload length (3 bytes, little-endian) and sequence id
+	payloadLen := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if payloadLen < minPayloadSize || payloadLen > maxPayloadSize {
+		return false, nil // Too small or too large to be a greeting, reject to prevent DoS
+	}
+	if header[3] != 0 {
+		return false, nil // Greeting is always the first packet of a sequence
+	}
+
+	// Read the payload
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(cx, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Incomplete packet
+		}
+		return false, fmt.Errorf("reading payload: %w", err)
+	}
+
+	// Check protocol version
+	if payload[0] != protocolVersion10 {
+		return false, nil
+	}
+
+	// Find the null-terminated server version
+	versionEnd := bytes.IndexByte(payload[1:], 0)
+	if versionEnd < 0 {
+		return false, nil
+	}
+	serverVersion := payload[1 : 1+versionEnd]
+	if !byteparser.IsPrintable(serverVersion) {
+		return false, nil
+	}
+
+	// Check the fixed part following the server version: thread id, auth plugin data and filler
+	pos := 1 + versionEnd + 1 + 4 + authPluginDataSize1
+	if pos+1+2 > len(payload) || payload[pos] != 0 {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.mysql.server_version", string(serverVersion))
+	cx.SetProtocol("mysql")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchMySQL from Caddyfile tokens. Syntax:
+//
+//	mysql
+func (m *MatchMySQL) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_packets.html
+//	https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_connection_phase_packets_protocol_handshake_v10.html
+//	https://mariadb.com/kb/en/connection/#initial-handshake-packet
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchMySQL)(nil)
+	_ layer4.ConnMatcher    = (*MatchMySQL)(nil)
+)
@@ -0,0 +1,167 @@
+package l4mysql
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchMySQL(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         []byte
+		wantMatch     bool
+		serverVersion string
+	}{
+		{name: "MySQL 8.0", input: greetingMySQL80, wantMatch: true, serverVersion: "8.0.36"},
+		{name: "MySQL 5.7", input: greetingMySQL57, wantMatch: true, serverVersion: "5.7.44-log"},
+		{name: "MariaDB 10.11", input: greetingMariaDB1011, wantMatch: true, serverVersion: "5.5.5-10.11.6-MariaDB-0+deb12u1"},
+		{name: "Empty", input: []byte{}, wantMatch: false},
+		{name: "Header Only", input: greetingMySQL80[:headerSize], wantMatch: false},
+		{name: "Truncated", input: greetingMySQL80[:40], wantMatch: false},
+		{name: "Wrong Sequence ID", input: withByte(greetingMySQL80, 3, 0x01), wantMatch: false},
+		{name: "Wrong Protocol Version", input: withByte(greetingMySQL80, 4, 0x09), wantMatch: false},
+		{name: "Non-Zero Filler", input: withByte(greetingMySQL80, 4+1+7+4+8, 0x01), wantMatch: false},
+		{name: "Unterminated Server Version", input: greetingUnterminated, wantMatch: false},
+		{name: "Error Packet", input: errorPacket, wantMatch: false},
+		{name: "Too Large", input: []byte{0xFF, 0xFF, 0xFF, 0x00, 0x0A}, wantMatch: false},
+		{name: "HTTP", input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "SSH", input: []byte("SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n"), wantMatch: false},
+		{name: "Random", input: []byte{0x8F, 0x3A, 0x11, 0xD2, 0x47, 0x00, 0xB9, 0x6C, 0x2E, 0xF1, 0x93, 0x58, 0x0D, 0xA4, 0x7B, 0xE6, 0x15, 0xC0, 0x29, 0x84}, wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matcher := &MatchMySQL{}
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			serverVersion, _ := repl.GetString("l4.mysql.server_version")
+			if serverVersion != tc.serverVersion {
+				t.Fatalf("test %d: unexpected server version | got %q, want %q\n", i, serverVersion, tc.serverVersion)
+			}
+		})
+	}
+}
+
+func withByte(b []byte, i int, v byte) []byte {
+	c := append([]byte{}, b...)
+	c[i] = v
+	return c
+}
+
+// Packet examples
+var greetingMySQL80 = []byte{
+	0x4A, 0x00, 0x00, // Payload length (74)
+	0x00,                                     // Sequence ID
+	0x0A,                                     // Protocol version
+	0x38, 0x2E, 0x30, 0x2E, 0x33, 0x36, 0x00, // Server version (8.0.36)
+	0x0B, 0x00, 0x00, 0x00, // Thread ID
+	0x5C, 0x1A, 0x37, 0x47, 0x3E, 0x22, 0x55, 0x1F, // Auth plugin data (part 1)
+	0x00,       // Filler
+	0xFF, 0xFF, // Capability flags (lower)
+	0xFF,       // Character set (utf8mb4_0900_ai_ci)
+	0x02, 0x00, // Status flags
+	0xFF, 0xDF, // Capability flags (upper)
+	0x15,                                                       // Auth plugin data length
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Reserved
+	0x0E, 0x52, 0x2D, 0x6B, 0x13, 0x61, 0x72, 0x0C, 0x4F, 0x01, 0x10, 0x3D, 0x00, // Auth plugin data (part 2)
+	0x63, 0x61, 0x63, 0x68, 0x69, 0x6E, 0x67, 0x5F, 0x73, 0x68, 0x61, 0x32, 0x5F, // Auth plugin name (1/2)
+	0x70, 0x61, 0x73, 0x73, 0x77, 0x6F, 0x72, 0x64, 0x00, // Auth plugin name (2/2)
+}
+
+var greetingMySQL57 = []byte{
+	0x4E, 0x00, 0x00, // Payload length (78)
+	0x00,                                                             // Sequence ID
+	0x0A,                                                             // Protocol version
+	0x35, 0x2E, 0x37, 0x2E, 0x34, 0x34, 0x2D, 0x6C, 0x6F, 0x67, 0x00, // Server version (5.7.44-log)
+	0x03, 0x00, 0x00, 0x00, // Thread ID
+	0x28, 0x4B, 0x0E, 0x7A, 0x1C, 0x39, 0x63, 0x5D, // Auth plugin data (part 1)
+	0x00,       // Filler
+	0xFF, 0xF7, // Capability flags (lower)
+	0x21,       // Character set (utf8_general_ci)
+	0x02, 0x00, // Status flags
+	0xFF, 0x81, // Capability flags (upper)
+	0x15,                                                       // Auth plugin data length
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Reserved
+	0x2A, 0x19, 0x58, 0x44, 0x3F, 0x6E, 0x11, 0x7C, 0x05, 0x60, 0x1B, 0x34, 0x00, // Auth plugin data (part 2)
+	0x6D, 0x79, 0x73, 0x71, 0x6C, 0x5F, 0x6E, 0x61, 0x74, 0x69, 0x76, 0x65, 0x5F, // Auth plugin name (1/2)
+	0x70, 0x61, 0x73, 0x73, 0x77, 0x6F, 0x72, 0x64, 0x00, // Auth plugin name (2/2)
+}
+
+var greetingMariaDB1011 = []byte{
+	0x63, 0x00, 0x00, // Payload length (99)
+	0x00,                                                                   // Sequence ID
+	0x0A,                                                                   // Protocol version
+	0x35, 0x2E, 0x35, 0x2E, 0x35, 0x2D, 0x31, 0x30, 0x2E, 0x31, 0x31, 0x2E, // Server version (1/3)
+	0x36, 0x2D, 0x4D, 0x61, 0x72, 0x69, 0x61, 0x44, 0x42, 0x2D, 0x30, 0x2B, // Server version (2/3)
+	0x64, 0x65, 0x62, 0x31, 0x32, 0x75, 0x31, 0x00, // Server version (3/3) (5.5.5-10.11.6-MariaDB-0+deb12u1)
+	0x1F, 0x00, 0x00, 0x00, // Thread ID
+	0x3C, 0x6F, 0x2B, 0x58, 0x7E, 0x57, 0x33, 0x4A, // Auth plugin data (part 1)
+	0x00,       // Filler
+	0xFE, 0xF7, // Capability flags (lower)
+	0x2D,       // Character set (utf8mb4_general_ci)
+	0x02, 0x00, // Status flags
+	0xFF, 0x81, // Capability flags (upper)
+	0x15,                               // Auth plugin data length
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Filler
+	0x1D, 0x00, 0x00, 0x00, // MariaDB extended capabilities
+	0x5E, 0x41, 0x32, 0x27, 0x6A, 0x3B, 0x70, 0x4C, 0x62, 0x2C, 0x55, 0x34, 0x00, // Auth plugin data (part 2)
+	0x6D, 0x79, 0x73, 0x71, 0x6C, 0x5F, 0x6E, 0x61, 0x74, 0x69, 0x76, 0x65, 0x5F, // Auth plugin name (1/2)
+	0x70, 0x61, 0x73, 0x73, 0x77, 0x6F, 0x72, 0x64, 0x00, // Auth plugin name (2/2)
+}
+
+var greetingUnterminated = []byte{
+	0x12, 0x00, 0x00, // Payload length (18)
+	0x00,                                                                   // Sequence ID
+	0x0A,                                                                   // Protocol version
+	0x38, 0x2E, 0x30, 0x2E, 0x33, 0x36, 0x2E, 0x30, 0x2E, 0x33, 0x36, 0x2E, // Server version (1/2)
+	0x30, 0x2E, 0x33, 0x36, 0x2E, // Server version (2/2), no null terminator
+}
+
+var errorPacket = []byte{
+	0x43, 0x00, 0x00, // Payload length (67)
+	0x00,       // Sequence ID
+	0xFF,       // Error packet header
+	0x6A, 0x04, // Error code (1130)
+	0x48, 0x6F, 0x73, 0x74, 0x20, 0x27, 0x31, 0x37, 0x32, 0x2E, 0x31, 0x37, 0x2E, 0x30, 0x2E, 0x31, // Error message (1/4)
+	0x27, 0x20, 0x69, 0x73, 0x20, 0x6E, 0x6F, 0x74, 0x20, 0x61, 0x6C, 0x6C, 0x6F, 0x77, 0x65, 0x64, // Error message (2/4)
+	0x20, 0x74, 0x6F, 0x20, 0x63, 0x6F, 0x6E, 0x6E, 0x65, 0x63, 0x74, 0x20, 0x74, 0x6F, 0x20, 0x74, // Error message (3/4)
+	0x68, 0x69, 0x73, 0x20, 0x4D, 0x79, 0x53, 0x51, 0x4C, 0x20, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, // Error message (4/4)
+}
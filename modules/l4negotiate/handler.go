@@ -0,0 +1,227 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4negotiate allows scripting an ordered protocol negotiation before handing connections off
+package l4negotiate
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler is a connection handler that walks a connection through a scripted sequence of steps,
+// e.g. greeting, then auth, then command, and only calls the next handler once all of them have
+// succeeded. The bytes received from the client during the negotiation are replayed to the next
+// handler, so that a proxy delivers the client's requests to the upstream intact. Any mismatch
+// or timeout results in an error, and the connection is closed.
+type Handler struct {
+	// Steps are performed in order. Each of them either sends data to the client or expects data from it.
+	Steps []*Step `json:"steps,omitempty"`
+
+	// How long the whole negotiation may take. Defaults to 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	logger *zap.Logger
+}
+
+// Step is a single negotiation step. Exactly one of Send and Expect must be set.
+type Step struct {
+	// Send is written to the client as is.
+	Send string `json:"send,omitempty"`
+
+	// Expect is a regular expression a line received from the client must match.
+	// Lines are read up to and including LF, with a trailing CRLF or LF trimmed
+	// before matching, and may not exceed layer4.MaxMatchingBytes.
+	Expect string `json:"expect,omitempty"`
+
+	compiled *regexp.Regexp
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.negotiate",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the module.
+func (h *Handler) Provision(ctx caddy.Context) (err error) {
+	if len(h.Steps) == 0 {
+		return errors.New("no steps")
+	}
+
+	repl := caddy.NewReplacer()
+	for i, step := range h.Steps {
+		if (len(step.Send) > 0) == (len(step.Expect) > 0) {
+			return fmt.Errorf("step %d: exactly one of send and expect must be set", i)
+		}
+		if len(step.Expect) > 0 {
+			step.compiled, err = regexp.Compile(repl.ReplaceAll(step.Expect, ""))
+			if err != nil {
+				return fmt.Errorf("step %d: compiling expect: %v", i, err)
+			}
+		}
+	}
+
+	if h.Timeout <= 0 {
+		h.Timeout = caddy.Duration(defaultTimeout)
+	}
+
+	h.logger = ctx.Logger(h)
+	return nil
+}
+
+// Handle handles the connections.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	if err := cx.SetDeadline(time.Now().Add(time.Duration(h.Timeout))); err != nil {
+		return err
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	r := bufio.NewReaderSize(cx, layer4.MaxMatchingBytes)
+	var received bytes.Buffer
+
+	for i, step := range h.Steps {
+		if len(step.Send) > 0 {
+			if _, err := io.WriteString(cx, repl.ReplaceAll(step.Send, "")); err != nil {
+				return fmt.Errorf("negotiation step %d: sending: %v", i, err)
+			}
+			continue
+		}
+
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return fmt.Errorf("negotiation step %d: receiving: %v", i, err)
+		}
+		received.Write(line)
+
+		if !step.compiled.Match(bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))) {
+			return fmt.Errorf("negotiation step %d: received data doesn't match '%s'", i, step.Expect)
+		}
+	}
+
+	if err := cx.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	h.logger.Debug("negotiated",
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.Int("steps", len(h.Steps)),
+		zap.Int("replayed", received.Len()+r.Buffered()),
+	)
+
+	// Replay the received bytes, including those buffered beyond the last step
+	return next.Handle(cx.Wrap(&replayConn{Conn: cx, r: io.MultiReader(&received, r)}))
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	negotiate {
+//		send <text>
+//		expect <regexp>
+//		timeout <duration>
+//	}
+//
+// Note: 'send' and 'expect' options may be repeated and are performed in order.
+// Escape sequences in 'send' values, e.g. \r\n, are interpreted as in Go strings.
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasTimeout bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "send":
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.Unquote(`"` + d.Val() + `"`)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			h.Steps = append(h.Steps, &Step{Send: val})
+		case "expect":
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			h.Steps = append(h.Steps, &Step{Expect: d.Val()})
+		case "timeout":
+			if hasTimeout {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.Timeout, hasTimeout = caddy.Duration(dur), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// replayConn is a net.Conn that reads from r instead of the embedded net.Conn.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+const defaultTimeout = 10 * time.Second
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
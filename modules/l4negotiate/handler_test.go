@@ -0,0 +1,173 @@
+package l4negotiate
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// runClient plays the client side of a negotiation: it reads a line for each
+// of the expected server lines before writing the corresponding client data.
+func runClient(t *testing.T, conn net.Conn, serverLines []string, clientData []string) []string {
+	t.Helper()
+	r := bufio.NewReader(conn)
+	var got []string
+	for i, data := range clientData {
+		if i < len(serverLines) {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return got
+			}
+			got = append(got, line)
+		}
+		if _, err := io.WriteString(conn, data); err != nil {
+			return got
+		}
+	}
+	return got
+}
+
+func TestNegotiateHandle(t *testing.T) {
+	h := &Handler{
+		Steps: []*Step{
+			{Send: "+OK ready\r\n"},
+			{Expect: "^AUTH \\S+$"},
+			{Send: "+OK authenticated\r\n"},
+			{Expect: "^(?i)select \\d+$"},
+		},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := layer4.WrapConnection(in, []byte{}, zap.NewNop())
+
+	// the client pipelines a command after the last expected line, which must be replayed as well
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	var serverLines []string
+	go func() {
+		defer wg.Done()
+		serverLines = runClient(t, out, []string{"+OK ready\r\n", "+OK authenticated\r\n"},
+			[]string{"AUTH secret\r\n", "SELECT 1\r\nPING\r\n"})
+		_ = out.Close()
+	}()
+
+	var replayed []byte
+	err := h.Handle(cx, layer4.HandlerFunc(func(c *layer4.Connection) error {
+		var err error
+		replayed, err = io.ReadAll(c)
+		return err
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wg.Wait()
+
+	if len(serverLines) != 2 || serverLines[0] != "+OK ready\r\n" || serverLines[1] != "+OK authenticated\r\n" {
+		t.Fatalf("unexpected lines sent to client: %q", serverLines)
+	}
+	if string(replayed) != "AUTH secret\r\nSELECT 1\r\nPING\r\n" {
+		t.Fatalf("unexpected bytes replayed to next handler: %q", replayed)
+	}
+}
+
+func TestNegotiateHandleMismatch(t *testing.T) {
+	h := &Handler{
+		Steps: []*Step{
+			{Send: "+OK ready\r\n"},
+			{Expect: "^AUTH \\S+$"},
+		},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := layer4.WrapConnection(in, []byte{}, zap.NewNop())
+
+	go func() {
+		_ = runClient(t, out, []string{"+OK ready\r\n"}, []string{"GET / HTTP/1.1\r\n"})
+	}()
+
+	called := false
+	err := h.Handle(cx, layer4.HandlerFunc(func(c *layer4.Connection) error {
+		called = true
+		return nil
+	}))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if called {
+		t.Fatalf("handler should not call next")
+	}
+}
+
+func TestNegotiateHandleTimeout(t *testing.T) {
+	h := &Handler{
+		Steps:   []*Step{{Expect: "^HELLO$"}},
+		Timeout: caddy.Duration(50 * time.Millisecond),
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := layer4.WrapConnection(in, []byte{}, zap.NewNop())
+
+	called := false
+	err := h.Handle(cx, layer4.HandlerFunc(func(c *layer4.Connection) error {
+		called = true
+		return nil
+	}))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if called {
+		t.Fatalf("handler should not call next")
+	}
+}
+
+func TestNegotiateProvision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*Handler{
+		{},
+		{Steps: []*Step{{}}},
+		{Steps: []*Step{{Send: "a", Expect: "b"}}},
+		{Steps: []*Step{{Expect: "("}}},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("test %d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4nsq allows the L4 multiplexing of NSQ connections
+package l4nsq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchNSQ{})
+	layer4.RegisterProtocol("nsq")
+}
+
+// MatchNSQ is able to match NSQ connections by the protocol magic sent by clients
+// before any command, i.e. two spaces followed by the protocol version, e.g. "  V2".
+// The matched version (e.g. V2) is exposed as {l4.nsq.version}.
+type MatchNSQ struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchNSQ) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.nsq",
+		New: func() caddy.Module { return new(MatchNSQ) },
+	}
+}
+
+// Match returns true if the connection starts with the NSQ protocol magic.
+func (m *MatchNSQ) Match(cx *layer4.Connection) (bool, error) {
+	// Read the protocol magic (first 4 bytes)
+	magic := make([]byte, len(magicV2))
+	if _, err := io.ReadFull(cx, magic); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for NSQ
+		}
+		return false, fmt.Errorf("reading protocol magic: %w", err)
+	}
+
+	// V2 is the only protocol version supported by nsqd
+	if !bytes.Equal(magic, magicV2) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.nsq.version", string(magic[2:]))
+	cx.SetProtocol("nsq")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchNSQ from Caddyfile tokens. Syntax:
+//
+//	nsq
+func (m *MatchNSQ) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+var magicV2 = []byte("  V2")
+
+// Refs:
+//
+//	https://nsq.io/clients/tcp_protocol_spec.html
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchNSQ)(nil)
+	_ layer4.ConnMatcher    = (*MatchNSQ)(nil)
+)
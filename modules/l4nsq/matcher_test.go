@@ -0,0 +1,77 @@
+package l4nsq
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchNSQ(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		wantMatch bool
+		version   string
+	}{
+		{name: "V2", input: []byte("  V2"), wantMatch: true, version: "V2"},
+		{name: "V2 IDENTIFY", input: []byte("  V2IDENTIFY\n\x00\x00\x00\x02{}"), wantMatch: true, version: "V2"},
+		{name: "V1", input: []byte("  V1"), wantMatch: false},
+		{name: "Lowercase", input: []byte("  v2"), wantMatch: false},
+		{name: "Single Space", input: []byte(" V2 "), wantMatch: false},
+		{name: "Truncated", input: []byte("  V"), wantMatch: false},
+		{name: "Empty", input: []byte{}, wantMatch: false},
+		{name: "HTTP", input: []byte("GET /ping HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "Redis", input: []byte("*1\r\n$4\r\nPING\r\n"), wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher := &MatchNSQ{}
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if version, _ := repl.GetString("l4.nsq.version"); version != tc.version {
+				t.Fatalf("test %d: unexpected version | got %q, want %q\n", i, version, tc.version)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4ntp allows the L4 multiplexing of NTP connections
+package l4ntp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchNTP{})
+	layer4.RegisterProtocol("ntp")
+}
+
+const (
+	headerLength       = 48   // Size of the fixed part of NTP packets (bytes)
+	minExtensionLength = 16   // Minimum size of NTPv4 extension fields according to RFC 7822 (bytes)
+	maxPacketLength    = 2048 // Maximum packet length accepted, which leaves room for NTS extension fields
+
+	ModeSymmetricActive  = 1 // Mode of packets sent by symmetric peers
+	ModeSymmetricPassive = 2 // Mode of packets sent by symmetric peers in response
+	ModeClient           = 3 // Mode of packets sent by clients
+	ModeServer           = 4 // Mode of packets sent by servers
+	ModeBroadcast        = 5 // Mode of packets broadcast by servers
+)
+
+// MatchNTP is able to match NTP and SNTP packets of version 3 or 4, which consist of a 48-byte header optionally
+// followed by NTPv4 extension fields and a MAC, and fill the whole datagram. The packet Mode is exposed as
+// {l4.ntp.mode}, e.g. 3 for client packets, and its Version Number as {l4.ntp.version}.
+type MatchNTP struct {
+	// Modes is a list of packet modes to match. It defaults to client (3). Supported values are symmetric
+	// active (1), symmetric passive (2), client (3), server (4) and broadcast (5).
+	Modes []uint16 `json:"modes,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchNTP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.ntp",
+		New: func() caddy.Module { return new(MatchNTP) },
+	}
+}
+
+// Match returns true if the connection looks like NTP.
+func (m *MatchNTP) Match(cx *layer4.Connection) (bool, error) {
+	// Read the whole datagram, but no more than a packet of the maximum length and a byte
+	buf := make([]byte, maxPacketLength+1)
+	n, err := readDatagram(cx, buf)
+	if err != nil {
+		return false, fmt.Errorf("reading datagram: %w", err)
+	}
+	if n < headerLength || n > maxPacketLength {
+		return false, nil
+	}
+	buf = buf[:n]
+
+	// Validate Version Number and Mode, which follow the 2-bit Leap Indicator
+	version, mode := (buf[0]>>3)&0x07, buf[0]&0x07
+	if version != 3 && version != 4 || !slices.Contains(m.Modes, uint16(mode)) {
+		return false, nil
+	}
+
+	// Validate extension fields and MAC, if any
+	if !validTrailer(buf[headerLength:], version) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.ntp.mode", strconv.Itoa(int(mode)))
+	repl.Set("l4.ntp.version", strconv.Itoa(int(version)))
+	cx.SetProtocol("ntp")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchNTP) Provision(_ caddy.Context) error {
+	if len(m.Modes) == 0 {
+		m.Modes = []uint16{ModeClient}
+	}
+	for _, mode := range m.Modes {
+		if mode < ModeSymmetricActive || mode > ModeBroadcast {
+			return fmt.Errorf("unsupported mode %d", mode)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchNTP from Caddyfile tokens. Syntax:
+//
+//	ntp [<modes...>]
+func (m *MatchNTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	for d.NextArg() {
+		mode, err := strconv.ParseUint(d.Val(), 10, 8)
+		if err != nil {
+			return d.Errf("parsing %s mode: %v", wrapper, err)
+		}
+		m.Modes = append(m.Modes, uint16(mode))
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s option: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// validTrailer returns true if b, i.e. the bytes following the header, consists of extension fields
+// (NTPv4 only), each having a 2-byte Field Type and a 2-byte Length, followed by an optional MAC of
+// a 4-byte Key Identifier and a 16-byte (MD5, AES-CMAC) or a 20-byte (SHA-1) digest.
+func validTrailer(b []byte, version byte) bool {
+	for len(b) > 0 {
+		if len(b) == 20 || len(b) == 24 {
+			return true // This is a MAC
+		}
+		if version < 4 || len(b) < minExtensionLength {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if length < minExtensionLength || length%4 != 0 || length > len(b) {
+			return false
+		}
+		b = b[length:]
+	}
+	return true
+}
+
+// readDatagram reads from cx into buf until it's full or no bytes remain, and returns the number of bytes read.
+// Since NTP is UDP-based, all the bytes of a datagram are available at once, so nothing is waited for.
+func readDatagram(cx *layer4.Connection, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		nn, err := cx.Read(buf[n:])
+		n += nn
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+				break
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc5905#section-7.3
+//	https://www.rfc-editor.org/rfc/rfc7822#section-3
+//	https://www.rfc-editor.org/rfc/rfc4330#section-4
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchNTP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchNTP)(nil)
+	_ layer4.ConnMatcher    = (*MatchNTP)(nil)
+)
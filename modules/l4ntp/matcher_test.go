@@ -0,0 +1,128 @@
+package l4ntp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// buildPacket returns a packet with the given leap indicator, version and mode, followed by trailer.
+func buildPacket(li, version, mode byte, trailer ...byte) []byte {
+	b := make([]byte, headerLength)
+	b[0] = li<<6 | version<<3 | mode
+	// Transmit Timestamp, the only field set by SNTP clients
+	copy(b[40:], []byte{0xea, 0x5b, 0x1e, 0x2f, 0x6d, 0x3c, 0x00, 0x00})
+	return append(b, trailer...)
+}
+
+func Test_MatchNTP_Match(t *testing.T) {
+	// NTPv4 client packet
+	clientV4 := buildPacket(0, 4, ModeClient)
+	// NTPv3 client packet with leap indicator set to "alarm condition"
+	clientV3 := buildPacket(3, 3, ModeClient)
+	// NTPv4 server packet
+	serverV4 := buildPacket(0, 4, ModeServer)
+	// NTPv4 client packet with a 20-byte MAC (MD5)
+	clientV4MAC := buildPacket(0, 4, ModeClient, make([]byte, 20)...)
+	// NTPv4 client packet with an NTS Unique Identifier extension field of 36 bytes and a 24-byte MAC (SHA-1)
+	uniqueIdentifier := append([]byte{0x01, 0x04, 0x00, 0x24}, make([]byte, 32)...)
+	clientV4Extension := buildPacket(0, 4, ModeClient, append(uniqueIdentifier, make([]byte, 24)...)...)
+	// NTPv3 client packet with an extension field, which are only defined for NTPv4
+	clientV3Extension := buildPacket(0, 3, ModeClient, uniqueIdentifier...)
+	// NTPv4 client packet with an extension field exceeding the datagram
+	extensionOverflow := buildPacket(0, 4, ModeClient, append([]byte{0x01, 0x04, 0x00, 0x28}, make([]byte, 32)...)...)
+	// NTPv4 client packet with a datagram larger than any packet
+	oversized := buildPacket(0, 4, ModeClient, make([]byte, maxPacketLength)...)
+
+	type test struct {
+		matcher     *MatchNTP
+		data        []byte
+		shouldMatch bool
+		mode        string
+		version     string
+	}
+
+	tests := []test{
+		{matcher: &MatchNTP{}, data: clientV4, shouldMatch: true, mode: "3", version: "4"},
+		{matcher: &MatchNTP{}, data: clientV3, shouldMatch: true, mode: "3", version: "3"},
+		{matcher: &MatchNTP{}, data: clientV4MAC, shouldMatch: true, mode: "3", version: "4"},
+		{matcher: &MatchNTP{}, data: clientV4Extension, shouldMatch: true, mode: "3", version: "4"},
+		{matcher: &MatchNTP{}, data: serverV4, shouldMatch: false},
+		{matcher: &MatchNTP{Modes: []uint16{ModeServer}}, data: serverV4, shouldMatch: true, mode: "4", version: "4"},
+		{matcher: &MatchNTP{Modes: []uint16{ModeServer}}, data: clientV4, shouldMatch: false},
+		{matcher: &MatchNTP{}, data: buildPacket(0, 2, ModeClient), shouldMatch: false},
+		{matcher: &MatchNTP{}, data: buildPacket(0, 5, ModeClient), shouldMatch: false},
+		{matcher: &MatchNTP{}, data: clientV3Extension, shouldMatch: false},
+		{matcher: &MatchNTP{}, data: extensionOverflow, shouldMatch: false},
+		{matcher: &MatchNTP{}, data: oversized, shouldMatch: false},
+		{matcher: &MatchNTP{}, data: clientV4[:headerLength-1], shouldMatch: false},
+		{matcher: &MatchNTP{}, data: append(append([]byte{}, clientV4...), 0x00), shouldMatch: false},
+		{matcher: &MatchNTP{}, data: []byte{}, shouldMatch: false},
+		{matcher: &MatchNTP{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\nAccept: */*\r\n\r\n"), shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			mode, _ := repl.GetString("l4.ntp.mode")
+			version, _ := repl.GetString("l4.ntp.version")
+			if mode != tc.mode || version != tc.version {
+				t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n", i, mode, version, tc.mode, tc.version)
+			}
+		}()
+	}
+}
+
+func Test_MatchNTP_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchNTP{Modes: []uint16{6}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported mode should not be accepted")
+	}
+}
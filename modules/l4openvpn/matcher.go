@@ -29,6 +29,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchOpenVPN{})
+	layer4.RegisterProtocol("openvpn")
 }
 
 // MatchOpenVPN is able to match OpenVPN connections.
@@ -51,6 +52,17 @@ type MatchOpenVPN struct {
 	// If the list is empty, MatchOpenVPN will consider all modes as accepted and try them one by one.
 	Modes []string `json:"modes,omitempty"`
 
+	// Transport defines how OpenVPN messages are framed and may contain one of the following values:
+	//
+	//	- `tcp` means each message is preceded by a 2-byte length, as OpenVPN does over TCP;
+	//
+	//	- `udp` means each message is a datagram without any length prefix, as OpenVPN does over UDP.
+	//
+	// Notes: Values are case-insensitive. If no value is specified, the transport is derived from the local
+	// address of the connection, which may need to be overridden, e.g. when UDP datagrams are tunneled over
+	// a TCP connection or the connection has been wrapped.
+	Transport string `json:"transport,omitempty"`
+
 	/*
 	 *	Fields relevant to the auth, crypt and crypt2 modes:
 	 */
@@ -171,6 +183,8 @@ type MatchOpenVPN struct {
 	acceptCrypt2 bool
 	acceptPlain  bool
 
+	transport string
+
 	groupKeyAuth  *StaticKey
 	groupKeyCrypt *StaticKey
 
@@ -198,7 +212,10 @@ func (m *MatchOpenVPN) Match(cx *layer4.Connection) (bool, error) {
 	buf := make([]byte, LengthBytesTotal+OpcodeKeyIDBytesTotal)
 
 	// Do TCP-specific reads and checks
-	_, isTCP := cx.LocalAddr().(*net.TCPAddr)
+	isTCP := m.transport == TransportTCP
+	if len(m.transport) == 0 {
+		_, isTCP = cx.LocalAddr().(*net.TCPAddr)
+	}
 	if isTCP {
 		// Read 2 bytes containing the remaining bytes length
 		_, err = io.ReadFull(cx, buf[:LengthBytesTotal])
@@ -259,6 +276,7 @@ func (m *MatchOpenVPN) Match(cx *layer4.Connection) (bool, error) {
 			mp = &MessagePlain{}
 			err = mp.FromBytesHeadless(buf[:n], hdr)
 			if err == nil && mp.Match() {
+				cx.SetProtocol("openvpn")
 				return true, nil
 			}
 		}
@@ -269,6 +287,7 @@ func (m *MatchOpenVPN) Match(cx *layer4.Connection) (bool, error) {
 			err = ma.FromBytesHeadless(buf[:n], hdr)
 			if err == nil && ma.Match(m.IgnoreTimestamp, m.IgnoreCrypto, m.authDigest, m.groupKeyAuth) {
 				m.lastDigest = ma.Digest
+				cx.SetProtocol("openvpn")
 				return true, nil
 			}
 		}
@@ -278,6 +297,7 @@ func (m *MatchOpenVPN) Match(cx *layer4.Connection) (bool, error) {
 			mc = &MessageCrypt{}
 			err = mc.FromBytesHeadless(buf[:n], hdr)
 			if err == nil && mc.Match(m.IgnoreTimestamp, m.IgnoreCrypto, nil, m.groupKeyCrypt) {
+				cx.SetProtocol("openvpn")
 				return true, nil
 			}
 		}
@@ -306,6 +326,7 @@ func (m *MatchOpenVPN) Match(cx *layer4.Connection) (bool, error) {
 		mr = &MessageCrypt2{}
 		err = mr.FromBytesHeadless(buf[:n], hdr)
 		if err == nil && mr.Match(m.IgnoreTimestamp, m.IgnoreCrypto, nil, m.serverKey, m.clientKeys) {
+			cx.SetProtocol("openvpn")
 			return true, nil
 		}
 	}
@@ -337,6 +358,15 @@ func (m *MatchOpenVPN) Provision(_ caddy.Context) error {
 		m.acceptAuth, m.acceptCrypt, m.acceptCrypt2, m.acceptPlain = true, true, true, true
 	}
 
+	if len(m.Transport) > 0 {
+		m.transport = strings.ToLower(repl.ReplaceAll(m.Transport, ""))
+		switch m.transport {
+		case TransportTCP, TransportUDP:
+		default:
+			return ErrInvalidTransport
+		}
+	}
+
 	var gkdBidi, gkdInverse bool
 	m.GroupKeyDirection = strings.ToLower(repl.ReplaceAll(m.GroupKeyDirection, ""))
 	if len(m.GroupKeyDirection) > 0 {
@@ -451,6 +481,7 @@ func (m *MatchOpenVPN) Provision(_ caddy.Context) error {
 //
 //	openvpn {
 //		modes <plain|auth|crypt|crypt2> [<...>]
+//		transport <tcp|udp>
 //
 //		ignore_crypto
 //		ignore_timestamp
@@ -491,7 +522,7 @@ func (m *MatchOpenVPN) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	}
 
 	var hasAuthDigest, hasGroupKey, hasGroupKeyDirection, hasGroupKeyFile, hasIgnoreCrypto, hasIgnoreTimestamp,
-		hasModes, hasServerKey, hasServerKeyFile bool
+		hasModes, hasServerKey, hasServerKeyFile, hasTransport bool
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		optionName := d.Val()
 		switch optionName {
@@ -503,6 +534,14 @@ func (m *MatchOpenVPN) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			m.Modes, hasModes = append(m.Modes, d.RemainingArgs()...), true
+		case "transport":
+			if hasTransport {
+				return errDuplicate(optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			_, m.Transport, hasTransport = d.NextArg(), d.Val(), true
 		case "ignore_crypto":
 			if hasIgnoreCrypto {
 				return errDuplicate(optionName)
@@ -616,6 +655,7 @@ var (
 	ErrInvalidGroupKeyDirection = errors.New("invalid group key direction")
 	ErrInvalidMode              = errors.New("invalid mode")
 	ErrInvalidServerKey         = errors.New("invalid server key")
+	ErrInvalidTransport         = errors.New("invalid transport")
 )
 
 const (
@@ -628,4 +668,7 @@ const (
 	ModeCrypt  = "crypt"
 	ModeCrypt2 = "crypt2"
 	ModePlain  = "plain"
+
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
 )
@@ -390,8 +390,32 @@ func Test_MatchOpenVPN_Match(t *testing.T) {
 		return tests
 	}()
 
+	testsTransport := func() []test {
+		m0 := &MatchOpenVPN{Transport: "tcp"}
+		m1 := &MatchOpenVPN{Transport: "UDP"}
+		tests := make([]test, 0, 2*3*2)
+		for _, packet := range [][]byte{
+			plainPacket1, plainPacket2,
+		} {
+			prefixed := append([]byte{0, byte(len(packet))}, packet...)
+			tests = append(tests,
+				test{matcher: m0, data: prefixed, shouldMatch: true},
+				test{matcher: m0, data: packet, shouldMatch: false},
+				test{matcher: m1, data: prefixed, shouldMatch: false},
+				test{matcher: m1, data: packet, shouldMatch: true},
+			)
+		}
+		clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x2f, 0x01, 0x00, 0x00, 0x2b, 0x03, 0x03, 0x00, 0x00, 0x00}
+		tests = append(tests,
+			test{matcher: m0, data: clientHello, shouldMatch: false},
+			test{matcher: m1, data: clientHello, shouldMatch: false},
+		)
+		return tests
+	}()
+
 	tests := make([]test, 0, len(testsPlain)+len(testsKnownKeyAuth)+len(testsUnknownKeyAuth)+
-		len(testsUnsupportedDigestsAuth)+len(testsKnownKeyCrypt)+len(testsUnknownKeyCrypt)+len(testsKnownKeyCrypt2))
+		len(testsUnsupportedDigestsAuth)+len(testsKnownKeyCrypt)+len(testsUnknownKeyCrypt)+len(testsKnownKeyCrypt2)+
+		len(testsTransport))
 	tests = append(tests, testsPlain...)
 	tests = append(tests, testsKnownKeyAuth...)
 	tests = append(tests, testsUnknownKeyAuth...)
@@ -399,6 +423,7 @@ func Test_MatchOpenVPN_Match(t *testing.T) {
 	tests = append(tests, testsKnownKeyCrypt...)
 	tests = append(tests, testsUnknownKeyCrypt...)
 	tests = append(tests, testsKnownKeyCrypt2...)
+	tests = append(tests, testsTransport...)
 
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
 	defer cancel()
@@ -435,6 +460,20 @@ func Test_MatchOpenVPN_Match(t *testing.T) {
 	}
 }
 
+func Test_MatchOpenVPN_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchOpenVPN{
+		{Modes: []string{"tls"}},
+		{Transport: "quic"},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("Test %d: invalid matcher should not be provisioned | %+v\n", i, m)
+		}
+	}
+}
+
 // https://github.com/OpenVPN/openvpn/blob/master/sample/sample-keys/ta.key
 var groupKey12Hex = "" +
 	"21d94830510107f8753d3b6f3145e01d" +
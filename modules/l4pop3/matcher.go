@@ -0,0 +1,158 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4pop3 allows the L4 multiplexing of POP3 connections
+package l4pop3
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchPOP3{})
+	layer4.RegisterProtocol("pop3")
+}
+
+const (
+	maxLineLength     = 512 // Maximum length of a greeting line, including the line ending
+	maxCommandLength  = 255 // Maximum length of a command line, including the line ending
+	maxArgumentLength = 40  // Maximum length of a command argument
+)
+
+// MatchPOP3 is able to match POP3 connections. Since POP3 is server-first, the matcher first tries
+// the server's greeting, e.g. +OK POP3 server ready, which is useful where the connecting peer is
+// a POP3 server, e.g. with reverse tunnels. The greeting text following +OK is exposed as
+// {l4.pop3.banner}. Otherwise, it falls back to the client's first command, e.g. USER alice, which
+// a client only sends once it has received a greeting, e.g. from a negotiate handler. Only the
+// commands valid in the AUTHORIZATION state are matched, and the command is exposed as
+// {l4.pop3.command}. Commands are matched case-insensitively, and lines may end with CRLF or a bare LF.
+type MatchPOP3 struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchPOP3) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.pop3",
+		New: func() caddy.Module { return new(MatchPOP3) },
+	}
+}
+
+// Match returns true if the connection starts with a POP3 greeting or a POP3 command.
+func (m *MatchPOP3) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, maxLineLength), maxLineLength)
+
+	line, err := byteparser.ReadLine(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return false, nil // Not enough data for POP3, or a line too long
+		}
+		return false, fmt.Errorf("reading line: %w", err)
+	}
+	if !byteparser.IsPrintable(line) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+
+	// Match the greeting, e.g. +OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>
+	if rest, ok := bytes.CutPrefix(line, []byte("+OK")); ok {
+		if len(rest) > 0 && rest[0] != ' ' {
+			return false, nil
+		}
+		repl.Set("l4.pop3.banner", string(bytes.TrimSpace(rest)))
+		cx.SetProtocol("pop3")
+		return true, nil
+	}
+
+	// Match the command, e.g. USER alice, or APOP alice c4c9334bac560ecc979e58001b3e22fb
+	if len(line)+2 > maxCommandLength {
+		return false, nil
+	}
+	keyword, rest, _ := bytes.Cut(line, []byte(" "))
+	keyword = bytes.ToUpper(keyword)
+	var args [][]byte
+	if len(rest) > 0 {
+		args = bytes.Split(rest, []byte(" "))
+	}
+	for _, arg := range args {
+		if len(arg) == 0 || len(arg) > maxArgumentLength {
+			return false, nil
+		}
+	}
+	minArgs, maxArgs, ok := commandArgs(keyword)
+	if !ok || len(args) < minArgs || len(args) > maxArgs {
+		return false, nil
+	}
+	repl.Set("l4.pop3.command", string(keyword))
+	cx.SetProtocol("pop3")
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchPOP3 from Caddyfile tokens. Syntax:
+//
+//	pop3
+func (m *MatchPOP3) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// commandArgs returns the minimum and maximum numbers of arguments of keyword, a command valid
+// in the AUTHORIZATION state in upper case, and true; or false if keyword is any other command.
+func commandArgs(keyword []byte) (int, int, bool) {
+	switch string(keyword) {
+	case "USER":
+		return 1, 1, true
+	case "PASS":
+		return 1, maxCommandLength, true // Servers may treat spaces as part of the password
+	case "APOP":
+		return 2, 2, true
+	case "AUTH":
+		return 0, 2, true // Mechanism and optional initial response
+	case "CAPA", "STLS", "QUIT":
+		return 0, 0, true
+	}
+	return 0, 0, false
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc1939
+//	https://www.rfc-editor.org/rfc/rfc2449
+//	https://www.rfc-editor.org/rfc/rfc5034
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchPOP3)(nil)
+	_ layer4.ConnMatcher    = (*MatchPOP3)(nil)
+)
@@ -0,0 +1,98 @@
+package l4pop3
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchPOP3(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantMatch bool
+		command   string
+		banner    string
+	}{
+		{name: "Greeting", input: "+OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>\r\n", wantMatch: true, banner: "POP3 server ready <1896.697170952@dbc.mtview.ca.us>"},
+		{name: "Bare Greeting, Bare LF", input: "+OK\n", wantMatch: true, banner: ""},
+		{name: "Error Greeting", input: "-ERR server unavailable\r\n", wantMatch: false},
+		{name: "Invalid Greeting", input: "+OKAY ready\r\n", wantMatch: false},
+		{name: "User", input: "USER alice\r\n", wantMatch: true, command: "USER"},
+		{name: "Pass With Spaces", input: "PASS correct horse battery staple\r\n", wantMatch: true, command: "PASS"},
+		{name: "Apop, Lower Case", input: "apop mrose c4c9334bac560ecc979e58001b3e22fb\n", wantMatch: true, command: "APOP"},
+		{name: "Capa", input: "CAPA\r\n", wantMatch: true, command: "CAPA"},
+		{name: "Stls", input: "STLS\r\n", wantMatch: true, command: "STLS"},
+		{name: "Auth", input: "AUTH PLAIN dGVzdAB0ZXN0AHRlc3Q=\r\n", wantMatch: true, command: "AUTH"},
+		{name: "User Without Name", input: "USER\r\n", wantMatch: false},
+		{name: "User With Two Names", input: "USER alice bob\r\n", wantMatch: false},
+		{name: "Argument Too Long", input: "USER " + strings.Repeat("a", maxArgumentLength+1) + "\r\n", wantMatch: false},
+		{name: "Command Too Long", input: "PASS" + strings.Repeat(" "+strings.Repeat("a", maxArgumentLength), 7) + "\r\n", wantMatch: false},
+		{name: "Capa With Argument", input: "CAPA all\r\n", wantMatch: false},
+		{name: "Command After Authorization", input: "RETR 1\r\n", wantMatch: false},
+		{name: "Incomplete Line", input: "USER alice", wantMatch: false},
+		{name: "Line Too Long", input: "+OK " + strings.Repeat("a", maxLineLength) + "\r\n", wantMatch: false},
+		{name: "IMAP Greeting", input: "* OK IMAP4rev1 Service Ready\r\n", wantMatch: false},
+		{name: "IMAP Login", input: "a001 LOGIN alice secret\r\n", wantMatch: false},
+		{name: "IMAP Capability", input: "a001 CAPABILITY\r\n", wantMatch: false},
+		{name: "SMTP Greeting", input: "220 mx.example.com ESMTP Postfix\r\n", wantMatch: false},
+		{name: "Empty", input: "", wantMatch: false},
+		{name: "HTTP", input: "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", wantMatch: false},
+		{name: "TLS", input: "\x16\x03\x01\x00\xf4\x01\x00\x00\xf0\x03\x03\n", wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write([]byte(tc.input))
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := (&MatchPOP3{}).Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			command, _ := repl.GetString("l4.pop3.command")
+			banner, _ := repl.GetString("l4.pop3.banner")
+			if command != tc.command || banner != tc.banner {
+				t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n", i, command, banner, tc.command, tc.banner)
+			}
+			if protocol := cx.Protocol(); (protocol == "pop3") != tc.wantMatch {
+				t.Fatalf("test %d: unexpected protocol | %q\n", i, protocol)
+			}
+		})
+	}
+}
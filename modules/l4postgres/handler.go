@@ -0,0 +1,401 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&HandleVersion{})
+}
+
+const (
+	negotiateProtocolVersionType = 'v'              // Type of NegotiateProtocolVersion messages
+	protocolOptionPrefix         = "_pq_."          // Prefix of protocol option parameters
+	minProtocolVersion           = 3 << 16          // Protocol version 3.0, supported by all backends
+	probeRequestVersion          = 3<<16 | 0xFFFF   // Protocol version requested when probing the backend
+	probeUser                    = "caddy-l4"       // User name sent when probing the backend
+	probeTimeout                 = 5 * time.Second  // Time the backend has to reply to a probe
+	probeRetryInterval           = 10 * time.Second // Time a failed probe is remembered before probing again
+)
+
+// HandleVersion is a connection handler that makes the protocol version requested by a client agree with
+// the one supported by the backend before the connection is proxied. It must follow the postgres matcher,
+// which exposes the requested protocol version. If the client requests a newer minor version than the
+// backend supports, or any protocol options (i.e. parameters starting with _pq_.) the backend doesn't
+// recognize, a NegotiateProtocolVersion message carrying the newest supported minor version and the
+// unrecognized options is sent to the client, and the StartupMessage is rewritten accordingly, so that
+// the backend receives a request it supports. Any other connections are passed through unchanged.
+type HandleVersion struct {
+	// Version is the newest protocol version (in major.minor format, e.g. 3.0) the backend supports.
+	// Exactly one of Version and Probe must be set.
+	Version string `json:"version,omitempty"`
+
+	// Probe is the network address of the backend to ask for the newest protocol version it supports.
+	// It's probed once the first connection needs to be handled, and again if probing has failed, though
+	// not more often than every 10 seconds: connections handled in the meantime fail with the same error.
+	Probe string `json:"probe,omitempty"`
+
+	// Options are the protocol options (e.g. _pq_.some_option) the backend recognizes.
+	Options []string `json:"options,omitempty"`
+
+	version  uint32
+	probed   bool
+	probing  chan struct{} // closed once the probe in flight is done
+	probeErr error
+	retryAt  time.Time
+	mu       sync.Mutex
+	logger   *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*HandleVersion) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.postgres_version",
+		New: func() caddy.Module { return new(HandleVersion) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *HandleVersion) Provision(ctx caddy.Context) (err error) {
+	h.logger = ctx.Logger()
+
+	repl := caddy.NewReplacer()
+	h.Version, h.Probe = repl.ReplaceAll(h.Version, ""), repl.ReplaceAll(h.Probe, "")
+	if (len(h.Version) > 0) == (len(h.Probe) > 0) {
+		return errors.New("exactly one of version and probe must be set")
+	}
+	if h.version, err = parseProtocolVersion(h.Version); err != nil {
+		return fmt.Errorf("parsing version: %v", err)
+	}
+	if len(h.Version) > 0 && h.version>>16 != 3 {
+		return fmt.Errorf("unsupported version %s: only protocol version 3 is supported", h.Version)
+	}
+	for _, option := range h.Options {
+		if !strings.HasPrefix(option, protocolOptionPrefix) {
+			return fmt.Errorf("invalid option '%s': protocol options must start with %s", option, protocolOptionPrefix)
+		}
+	}
+	return nil
+}
+
+// Handle handles the connections.
+func (h *HandleVersion) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	info, ok := GetStartupInfo(cx)
+	if !ok || info.SSLRequest || info.GSSENCRequest || info.CancelRequest {
+		return next.Handle(cx)
+	}
+
+	supported, err := h.supportedVersion()
+	if err != nil {
+		return fmt.Errorf("probing backend: %v", err)
+	}
+
+	// Find the protocol options the backend doesn't recognize
+	var unrecognized []string
+	for name := range info.Parameters {
+		if strings.HasPrefix(name, protocolOptionPrefix) && !slices.Contains(h.Options, name) {
+			unrecognized = append(unrecognized, name)
+		}
+	}
+	slices.Sort(unrecognized)
+
+	if info.ProtocolVersion <= supported && len(unrecognized) == 0 {
+		return next.Handle(cx)
+	}
+
+	// Read the StartupMessage the matcher has already seen, and rewrite it
+	message, err := readStartupMessage(cx)
+	if err != nil {
+		return fmt.Errorf("reading startup message: %v", err)
+	}
+	version := min(info.ProtocolVersion, supported)
+	message = rewriteStartupMessage(message, version, unrecognized)
+
+	// Take over any bytes buffered beyond the StartupMessage, since a wrapped connection would read them first
+	buffered := make([]byte, len(cx.MatchingBytes()))
+	if _, err = io.ReadFull(cx, buffered); err != nil {
+		return fmt.Errorf("reading buffered bytes: %v", err)
+	}
+
+	if _, err = cx.Write(buildNegotiateProtocolVersion(version, unrecognized)); err != nil {
+		return fmt.Errorf("writing NegotiateProtocolVersion: %v", err)
+	}
+
+	h.logger.Debug("negotiated protocol version",
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.String("requested", formatProtocolVersion(info.ProtocolVersion)),
+		zap.String("negotiated", formatProtocolVersion(version)),
+		zap.Strings("unrecognized_options", unrecognized),
+	)
+
+	info.ProtocolVersion = version
+	for _, name := range unrecognized {
+		delete(info.Parameters, name)
+	}
+
+	// Replay the rewritten StartupMessage followed by anything else received from the client
+	return next.Handle(cx.Wrap(&replayConn{Conn: cx, r: io.MultiReader(bytes.NewReader(message), bytes.NewReader(buffered), cx)}))
+}
+
+// supportedVersion returns the newest protocol version the backend supports, probing it if necessary.
+// Only one probe is in flight at a time, which concurrent connections wait for without holding h.mu.
+func (h *HandleVersion) supportedVersion() (uint32, error) {
+	if len(h.Probe) == 0 {
+		return h.version, nil
+	}
+
+	h.mu.Lock()
+	for !h.probed {
+		if h.probeErr != nil && time.Now().Before(h.retryAt) {
+			err := h.probeErr
+			h.mu.Unlock()
+			return 0, err
+		}
+		if h.probing == nil {
+			return h.probeVersion()
+		}
+		probing := h.probing
+		h.mu.Unlock()
+		<-probing
+		h.mu.Lock()
+	}
+	version := h.version
+	h.mu.Unlock()
+	return version, nil
+}
+
+// probeVersion probes the backend for the newest protocol version it supports, and remembers the
+// result. It must be called with h.mu locked, which it unlocks while probing.
+func (h *HandleVersion) probeVersion() (uint32, error) {
+	probing := make(chan struct{})
+	h.probing = probing
+	h.mu.Unlock()
+
+	version, err := probeBackendVersion(h.Probe, probeTimeout)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probing = nil
+	close(probing)
+	if err != nil {
+		h.probeErr, h.retryAt = err, time.Now().Add(probeRetryInterval)
+		return 0, err
+	}
+	h.version, h.probed, h.probeErr = version, true, nil
+	h.logger.Debug("probed protocol version",
+		zap.String("backend", h.Probe),
+		zap.String("version", formatProtocolVersion(version)),
+	)
+	return version, nil
+}
+
+// UnmarshalCaddyfile sets up the HandleVersion from Caddyfile tokens. Syntax:
+//
+//	postgres_version [<version>] {
+//		options <options...>
+//		probe <address>
+//	}
+//	postgres_version <version>
+//
+// Note: multiple 'options' options are allowed.
+func (h *HandleVersion) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line argument is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		h.Version = d.Val()
+	}
+
+	var hasProbe bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "options":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			h.Options = append(h.Options, d.RemainingArgs()...)
+		case "probe":
+			if hasProbe {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			_, h.Probe, hasProbe = d.NextArg(), d.Val(), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// probeBackendVersion connects to a Postgres backend at address and returns the newest protocol version it supports.
+// It requests the newest possible minor version, so that backends supporting protocol version negotiation
+// reply with a NegotiateProtocolVersion message. Backends rejecting the request are assumed to support 3.0.
+func probeBackendVersion(address string, timeout time.Duration) (uint32, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	if _, err = conn.Write(encodeStartupMessage(probeRequestVersion, "user", probeUser)); err != nil {
+		return 0, fmt.Errorf("writing startup message: %w", err)
+	}
+
+	// Read the type and the length of the reply
+	header := make([]byte, 1+lenFieldSize)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return 0, fmt.Errorf("reading reply: %w", err)
+	}
+	if header[0] != negotiateProtocolVersionType {
+		return minProtocolVersion, nil // Most likely an ErrorResponse
+	}
+
+	// Read the newest minor version supported
+	msgLen := binary.BigEndian.Uint32(header[1:])
+	if msgLen < 3*lenFieldSize || msgLen > maxPayloadSize {
+		return 0, fmt.Errorf("invalid NegotiateProtocolVersion length: %d", msgLen)
+	}
+	minor := make([]byte, lenFieldSize)
+	if _, err = io.ReadFull(conn, minor); err != nil {
+		return 0, fmt.Errorf("reading NegotiateProtocolVersion: %w", err)
+	}
+	return minProtocolVersion | binary.BigEndian.Uint32(minor)&0xFFFF, nil
+}
+
+// readStartupMessage reads a whole StartupMessage from r, including its length.
+func readStartupMessage(r io.Reader) ([]byte, error) {
+	lenBytes := make([]byte, lenFieldSize)
+	if _, err := io.ReadFull(r, lenBytes); err != nil {
+		return nil, err
+	}
+	msgLen := binary.BigEndian.Uint32(lenBytes)
+	if msgLen < minMessageLen || msgLen-lenFieldSize > maxPayloadSize {
+		return nil, fmt.Errorf("invalid message length: %d", msgLen)
+	}
+	message := make([]byte, msgLen)
+	copy(message, lenBytes)
+	if _, err := io.ReadFull(r, message[lenFieldSize:]); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// rewriteStartupMessage returns a copy of a StartupMessage validated by the matcher
+// with the given protocol version and without the parameters named in omit.
+func rewriteStartupMessage(message []byte, version uint32, omit []string) []byte {
+	fields := startupParameters(message)
+	var params []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		if !slices.Contains(omit, fields[i]) {
+			params = append(params, fields[i], fields[i+1])
+		}
+	}
+	return encodeStartupMessage(version, params...)
+}
+
+// startupParameters returns the parameters of a StartupMessage validated by the matcher
+// as alternating names and values, in the order they were sent.
+func startupParameters(message []byte) []string {
+	if len(message) <= 2*lenFieldSize+1 {
+		return nil
+	}
+	return strings.Split(string(message[2*lenFieldSize:len(message)-2]), "\x00")
+}
+
+// encodeStartupMessage returns a StartupMessage with the given protocol version and parameters,
+// which are given as alternating names and values.
+func encodeStartupMessage(version uint32, params ...string) []byte {
+	b := make([]byte, 2*lenFieldSize, minMessageLen+1)
+	binary.BigEndian.PutUint32(b[lenFieldSize:], version)
+	for _, param := range params {
+		b = append(append(b, param...), 0)
+	}
+	b = append(b, 0)
+	binary.BigEndian.PutUint32(b, uint32(len(b))) //nolint:gosec // disable G115
+	return b
+}
+
+// buildNegotiateProtocolVersion returns a NegotiateProtocolVersion message carrying
+// the newest minor version supported and the names of the unrecognized options.
+func buildNegotiateProtocolVersion(version uint32, unrecognized []string) []byte {
+	b := make([]byte, 1+3*lenFieldSize)
+	b[0] = negotiateProtocolVersionType
+	binary.BigEndian.PutUint32(b[1+lenFieldSize:], version&0xFFFF)
+	binary.BigEndian.PutUint32(b[1+2*lenFieldSize:], uint32(len(unrecognized))) //nolint:gosec // disable G115
+	for _, option := range unrecognized {
+		b = append(append(b, option...), 0)
+	}
+	binary.BigEndian.PutUint32(b[1:], uint32(len(b)-1)) //nolint:gosec // disable G115
+	return b
+}
+
+// formatProtocolVersion converts a protocol version from its wire representation into major.minor format.
+func formatProtocolVersion(version uint32) string {
+	return fmt.Sprintf("%d.%d", version>>16, version&0xFFFF)
+}
+
+// replayConn is a net.Conn that reads from r instead of the embedded net.Conn.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Refs:
+//
+//	https://www.postgresql.org/docs/current/protocol-overview.html#PROTOCOL-VERSIONS
+//	https://www.postgresql.org/docs/current/protocol-message-formats.html#PROTOCOL-MESSAGE-FORMATS-NEGOTIATEPROTOCOLVERSION
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*HandleVersion)(nil)
+	_ caddyfile.Unmarshaler = (*HandleVersion)(nil)
+	_ layer4.NextHandler    = (*HandleVersion)(nil)
+)
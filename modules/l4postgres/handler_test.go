@@ -0,0 +1,312 @@
+package l4postgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// startupTester runs input through a route with the postgres matcher and a handler configured with config,
+// e.g. postgres_version. It returns the bytes sent to the client and those replayed to the next handler.
+func startupTester(t *testing.T, config string, input []byte) ([]byte, []byte) {
+	in, out := net.Pipe()
+	defer func() { _ = out.Close() }()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+	// the client reads whatever is sent to it for a while before closing the connection
+	sentCh := make(chan []byte, 1)
+	go func() {
+		_, err := in.Write(input)
+		assertNoError(t, err)
+		_ = in.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		sent, _ := io.ReadAll(in)
+		_ = in.Close()
+		sentCh <- sent
+	}()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	routes := layer4.RouteList{&layer4.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{{"postgres": json.RawMessage("{}")}},
+		HandlersRaw:    []json.RawMessage{json.RawMessage(config)},
+	}}
+	err := routes.Provision(ctx)
+	if err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	var replayed []byte
+	compiledRoute := routes.Compile(zap.NewNop(), 100*time.Millisecond,
+		layer4.HandlerFunc(func(con *layer4.Connection) error {
+			var err error
+			replayed, err = io.ReadAll(con)
+			return err
+		}))
+
+	err = compiledRoute.Handle(cx)
+	if err != nil {
+		t.Fatalf("handle failed | %s", err)
+	}
+
+	return <-sentCh, replayed
+}
+
+// decodeNegotiateProtocolVersion decodes a NegotiateProtocolVersion message into
+// the newest minor version supported and the names of the unrecognized options.
+func decodeNegotiateProtocolVersion(t *testing.T, b []byte) (uint32, []string) {
+	t.Helper()
+	if len(b) < 1+3*lenFieldSize || b[0] != 'v' {
+		t.Fatalf("not a NegotiateProtocolVersion message: %x", b)
+	}
+	if msgLen := binary.BigEndian.Uint32(b[1:5]); int(msgLen) != len(b)-1 {
+		t.Fatalf("unexpected NegotiateProtocolVersion length: got %d, want %d", msgLen, len(b)-1)
+	}
+	minor := binary.BigEndian.Uint32(b[5:9])
+	count := binary.BigEndian.Uint32(b[9:13])
+	var options []string
+	if len(b) > 13 {
+		options = strings.Split(strings.TrimSuffix(string(b[13:]), "\x00"), "\x00")
+	}
+	if int(count) != len(options) {
+		t.Fatalf("unexpected number of options: got %d, want %d", count, len(options))
+	}
+	return minor, options
+}
+
+func TestHandleVersion(t *testing.T) {
+	query := append([]byte{'Q', 0x00, 0x00, 0x00, 0x0D}, []byte("SELECT 1;\x00")...)
+
+	tests := []struct {
+		name        string
+		config      string
+		input       []byte
+		wantMinor   uint32
+		wantOptions []string
+		wantReplay  []byte
+	}{
+		{
+			name:       "Newer Minor Version",
+			config:     `{"handler":"postgres_version","version":"3.0"}`,
+			input:      buildStartupMessage(0x00030002, map[string]string{"user": "test"}),
+			wantMinor:  0,
+			wantReplay: buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+		},
+		{
+			name:        "Unrecognized Options",
+			config:      `{"handler":"postgres_version","version":"3.2","options":["_pq_.known"]}`,
+			input:       append(encodeStartupMessage(0x00030002, "user", "test", "_pq_.unknown", "on", "database", "db", "_pq_.known", "1", "_pq_.another", "x"), query...),
+			wantMinor:   2,
+			wantOptions: []string{"_pq_.another", "_pq_.unknown"},
+			wantReplay:  append(encodeStartupMessage(0x00030002, "user", "test", "database", "db", "_pq_.known", "1"), query...),
+		},
+		{
+			name:        "Newer Minor Version and Options",
+			config:      `{"handler":"postgres_version","version":"3.0"}`,
+			input:       encodeStartupMessage(0x00030002, "_pq_.unknown", "on", "user", "test"),
+			wantMinor:   0,
+			wantOptions: []string{"_pq_.unknown"},
+			wantReplay:  buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+		},
+		{
+			name:       "Agreed Version",
+			config:     `{"handler":"postgres_version","version":"3.2"}`,
+			input:      append(buildStartupMessage(0x00030000, map[string]string{"user": "test"}), query...),
+			wantReplay: append(buildStartupMessage(0x00030000, map[string]string{"user": "test"}), query...),
+		},
+		{
+			name:       "SSLRequest",
+			config:     `{"handler":"postgres_version","version":"3.0"}`,
+			input:      buildSSLRequest(),
+			wantReplay: buildSSLRequest(),
+		},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sent, replayed := startupTester(t, tc.config, tc.input)
+
+			if !bytes.Equal(replayed, tc.wantReplay) {
+				t.Fatalf("test %d: unexpected bytes replayed | got %x, want %x\n", i, replayed, tc.wantReplay)
+			}
+
+			negotiated := !bytes.Equal(tc.input, tc.wantReplay)
+			if !negotiated {
+				if len(sent) > 0 {
+					t.Fatalf("test %d: unexpected bytes sent to client | %x\n", i, sent)
+				}
+				return
+			}
+
+			minor, options := decodeNegotiateProtocolVersion(t, sent)
+			if minor != tc.wantMinor || !reflect.DeepEqual(options, tc.wantOptions) {
+				t.Fatalf("test %d: unexpected NegotiateProtocolVersion | got %d and %q, want %d and %q\n",
+					i, minor, options, tc.wantMinor, tc.wantOptions)
+			}
+		})
+	}
+}
+
+// fakeBackend accepts a single connection, reads a StartupMessage and replies with reply.
+func fakeBackend(t *testing.T, reply []byte) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		message, err := readStartupMessage(conn)
+		if err != nil || binary.BigEndian.Uint32(message[4:8]) != probeRequestVersion {
+			return
+		}
+		_, _ = conn.Write(reply)
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestHandleVersion_Probe(t *testing.T) {
+	errorResponse := append([]byte{'E', 0x00, 0x00, 0x00, 0x1A}, []byte("SFATAL\x00C0A000\x00Mbad\x00\x00")...)
+
+	tests := []struct {
+		name      string
+		reply     []byte
+		wantMinor uint32
+	}{
+		{name: "Negotiation Supported", reply: buildNegotiateProtocolVersion(0x00030001, nil), wantMinor: 1},
+		{name: "Negotiation Not Supported", reply: errorResponse, wantMinor: 0},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			address := fakeBackend(t, tc.reply)
+			config := `{"handler":"postgres_version","probe":"` + address + `"}`
+			sent, replayed := startupTester(t, config, buildStartupMessage(0x00030002, map[string]string{"user": "test"}))
+
+			if want := buildStartupMessage(0x00030000|tc.wantMinor, map[string]string{"user": "test"}); !bytes.Equal(replayed, want) {
+				t.Fatalf("test %d: unexpected bytes replayed | got %x, want %x\n", i, replayed, want)
+			}
+			if minor, options := decodeNegotiateProtocolVersion(t, sent); minor != tc.wantMinor || len(options) > 0 {
+				t.Fatalf("test %d: unexpected NegotiateProtocolVersion | got %d and %q, want %d\n", i, minor, options, tc.wantMinor)
+			}
+		})
+	}
+}
+
+func TestHandleVersion_ProbeOnce(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	// the backend replies slowly, so that concurrent connections wait for the same probe,
+	// until it's told to fail by closing connections right away
+	var probes atomic.Int32
+	var failing atomic.Bool
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			probes.Add(1)
+			if failing.Load() {
+				_ = conn.Close()
+				continue
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				if _, err := readStartupMessage(conn); err != nil {
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+				_, _ = conn.Write(buildNegotiateProtocolVersion(0x00030001, nil))
+			}()
+		}
+	}()
+
+	probe := func(h *HandleVersion, n int) []error {
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var version uint32
+				version, errs[i] = h.supportedVersion()
+				if errs[i] == nil && version != 0x00030001 {
+					errs[i] = fmt.Errorf("unexpected version %x", version)
+				}
+			}()
+		}
+		wg.Wait()
+		return errs
+	}
+
+	h := &HandleVersion{Probe: ln.Addr().String(), logger: zap.NewNop()}
+	for i, err := range probe(h, 10) {
+		if err != nil {
+			t.Fatalf("connection %d: probing failed | %s", i, err)
+		}
+	}
+	if n := probes.Load(); n != 1 {
+		t.Fatalf("unexpected number of probes | got %d, want 1", n)
+	}
+
+	// a failed probe is remembered, so that the backend isn't probed again right away
+	failing.Store(true)
+	probes.Store(0)
+	h = &HandleVersion{Probe: ln.Addr().String(), logger: zap.NewNop()}
+	for i, err := range probe(h, 10) {
+		if err == nil {
+			t.Fatalf("connection %d: probing should have failed", i)
+		}
+	}
+	if _, err = h.supportedVersion(); err == nil {
+		t.Fatalf("probing should have failed")
+	}
+	if n := probes.Load(); n != 1 {
+		t.Fatalf("unexpected number of probes after failure | got %d, want 1", n)
+	}
+}
+
+func TestHandleVersion_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*HandleVersion{
+		{},
+		{Version: "3.0", Probe: "localhost:5432"},
+		{Version: "2.0"},
+		{Version: "3"},
+		{Version: "3.0", Options: []string{"unknown"}},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid handler should not be provisioned | %+v\n", i, h)
+		}
+	}
+}
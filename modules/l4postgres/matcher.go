@@ -20,27 +20,90 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 
+	"github.com/mholt/caddy-l4/internal/byteparser"
 	"github.com/mholt/caddy-l4/layer4"
 )
 
 func init() {
 	caddy.RegisterModule(&MatchPostgres{})
+	layer4.RegisterProtocol("postgres")
 }
 
 const (
 	sslRequestCode    = 80877103  // Code for SSL request
+	gssEncRequestCode = 80877104  // Code for GSSAPI encryption request
 	cancelRequestCode = 80877102  // Code for cancellation request
 	lenFieldSize      = 4         // Size of message length field (bytes)
 	minMessageLen     = 8         // Smallest valid message: SSLRequest (8 bytes)
 	maxPayloadSize    = 16 * 1024 // Maximum reasonable payload size (16 KB)
 )
 
-// MatchPostgres is able to match Postgres connections.
-type MatchPostgres struct{}
+// StartupInfo describes the first message of a Postgres connection. It's deposited
+// by MatchPostgres into the connection once matched and may be retrieved by later
+// matchers and handlers with GetStartupInfo.
+type StartupInfo struct {
+	// SSLRequest is true if the client requested a TLS upgrade.
+	SSLRequest bool
+	// GSSENCRequest is true if the client requested a GSSAPI encryption upgrade.
+	GSSENCRequest bool
+	// CancelRequest is true if the client requested to cancel a query.
+	CancelRequest bool
+	// ProtocolVersion is the protocol version requested by a StartupMessage (major<<16 | minor).
+	ProtocolVersion uint32
+	// Parameters contains the parameters of a StartupMessage, e.g. user and database.
+	Parameters map[string]string
+	// Options contains the run-time parameters (GUCs) set by the options parameter of a StartupMessage,
+	// e.g. statement_timeout for "-c statement_timeout=5000", if any.
+	Options map[string]string
+}
+
+// startupInfoKey is the key used to store StartupInfo in a connection.
+type startupInfoKey struct{}
+
+// GetStartupInfo returns the StartupInfo deposited into cx by MatchPostgres, if any.
+func GetStartupInfo(cx *layer4.Connection) (*StartupInfo, bool) {
+	return layer4.ValueOf[*StartupInfo](cx, startupInfoKey{})
+}
+
+// MatchPostgres is able to match Postgres connections. The user and database of a StartupMessage are
+// exposed as {l4.postgres.user} and {l4.postgres.database}, which defaults to the user as in Postgres, e.g.
+// to make connections to the same database stick to the same upstream. The run-time parameters (GUCs) set
+// by the options parameter, e.g. "-c password_encryption=md5", are exposed as {l4.postgres.option.<key>}.
+type MatchPostgres struct {
+	// MinVersion is an optional lowest protocol version (in major.minor format, e.g. 3.0)
+	// a StartupMessage may request to be matched. SSLRequest and CancelRequest messages
+	// carry no protocol version, so they aren't affected.
+	MinVersion string `json:"min_version,omitempty"`
+	// MaxVersion is an optional highest protocol version (in major.minor format, e.g. 3.2)
+	// a StartupMessage may request to be matched. SSLRequest and CancelRequest messages
+	// carry no protocol version, so they aren't affected.
+	MaxVersion string `json:"max_version,omitempty"`
+	// Strict controls how SSLRequest messages are validated. If true (default), only canonical
+	// 8-byte SSLRequest messages are matched. If false, any message starting with the SSLRequest
+	// code is matched regardless of trailing bytes, which tolerates some proxies and poolers
+	// producing non-canonical framing at the cost of a slightly higher false positive rate.
+	Strict *bool `json:"strict,omitempty"`
+	// Options is an optional map of run-time parameters (GUCs) the options parameter of a StartupMessage
+	// must set to the given values to be matched, e.g. password_encryption to md5. SSLRequest and
+	// CancelRequest messages carry no options, so they aren't affected.
+	Options map[string]string `json:"options,omitempty"`
+	// RequireEncryption makes the matcher only match SSLRequest and GSSENCRequest messages, i.e. clients
+	// negotiating encryption first, so that plaintext StartupMessages and CancelRequests fall through to
+	// other routes, e.g. one closing them. It can't be combined with versions or options, since they only
+	// apply to StartupMessages.
+	RequireEncryption bool `json:"require_encryption,omitempty"`
+
+	minVersion uint32
+	maxVersion uint32
+	options    map[string]string
+}
 
 // CaddyModule returns the Caddy module information.
 func (*MatchPostgres) CaddyModule() caddy.ModuleInfo {
@@ -51,6 +114,10 @@ func (*MatchPostgres) CaddyModule() caddy.ModuleInfo {
 }
 
 // Match returns true if the connection looks like the Postgres protocol.
+// Since matchers are run in matching mode, all reads below are served from
+// the prefetched buffer and rewound afterward, so the handlers (e.g. proxy)
+// receive the startup message intact. If the buffer is exhausted, the wrapped
+// ErrConsumedAllPrefetchedBytes makes the routes prefetch more data.
 func (m *MatchPostgres) Match(cx *layer4.Connection) (bool, error) {
 	// Read message length (first 4 bytes)
 	lenBytes := make([]byte, lenFieldSize)
@@ -83,88 +150,301 @@ func (m *MatchPostgres) Match(cx *layer4.Connection) (bool, error) {
 	}
 
 	// Check the first 4 bytes (code or protocol version)
-	code := binary.BigEndian.Uint32(payload[:4])
+	r := byteparser.NewReader(payload)
+	code := r.ReadUint32()
 
 	// Check for special message types
 	switch code {
-	case sslRequestCode:
-		// SSLRequest is exactly 8 bytes (4 for length + 4 for code)
-		return len(payload) == 4, nil
+	case sslRequestCode, gssEncRequestCode:
+		// SSLRequest and GSSENCRequest are exactly 8 bytes (4 for length + 4 for code), unless strict matching is disabled
+		if (m.Strict == nil || *m.Strict) && r.Len() != 0 {
+			return false, nil
+		}
+		cx.SetValue(startupInfoKey{}, &StartupInfo{SSLRequest: code == sslRequestCode, GSSENCRequest: code == gssEncRequestCode})
+		cx.SetProtocol("postgres")
+		return true, nil
 
 	case cancelRequestCode:
+		if m.RequireEncryption {
+			return false, nil // Plaintext CancelRequest
+		}
+
 		// CancelRequest is 16 bytes (4 for length + 4 for code + 4 for pid + 4 for secret key)
-		return len(payload) == 12, nil
+		if r.Len() != 8 {
+			return false, nil
+		}
+		cx.SetValue(startupInfoKey{}, &StartupInfo{CancelRequest: true})
+		cx.SetProtocol("postgres")
+		return true, nil
 
 	default:
+		if m.RequireEncryption {
+			return false, nil // Plaintext StartupMessage or anything else
+		}
+
 		// Check if it's a startup message (protocol version)
 		majorVersion := code >> 16
 		if majorVersion != 3 {
 			return false, nil // Only support protocol version 3
 		}
 
-		// Basic validation of parameters format
-		return validateStartupMessageFormat(payload[4:]), nil
-	}
-}
+		// Check if the protocol version is within the configured range
+		if (m.minVersion > 0 && code < m.minVersion) || (m.maxVersion > 0 && code > m.maxVersion) {
+			return false, nil
+		}
 
-// validateStartupMessageFormat checks if the payload has valid Postgres startup format
-// using the same approach as handleStartupMessage
-func validateStartupMessageFormat(data []byte) bool {
-	pos := 0
-	for pos < len(data) {
-		// Read key
-		keyEnd := pos
-		for keyEnd < len(data) && data[keyEnd] != 0 {
-			keyEnd++
+		// Basic validation of parameters format
+		params, ok := parseStartupParameters(r)
+		if !ok {
+			return false, nil
 		}
 
-		// Check if we've reached the end without finding null terminator
-		if keyEnd >= len(data) {
-			return false
+		// Check if the options parameter sets the configured run-time parameters
+		var options map[string]string
+		if value, ok := params["options"]; ok {
+			options = parseOptions(value)
+		}
+		for key, value := range m.options {
+			if actual, ok := options[key]; !ok || actual != value {
+				return false, nil
+			}
 		}
 
-		// Empty key means end of parameters
-		if keyEnd == pos {
-			// This should be the final null byte
-			return pos == len(data)-1
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		database := params["database"]
+		if len(database) == 0 {
+			database = params["user"]
+		}
+		repl.Set("l4.postgres.user", params["user"])
+		repl.Set("l4.postgres.database", database)
+		for key, value := range options {
+			repl.Set("l4.postgres.option."+key, value)
 		}
 
-		// Skip the null terminator
-		pos = keyEnd + 1
+		cx.SetValue(startupInfoKey{}, &StartupInfo{
+			ProtocolVersion: code,
+			Parameters:      params,
+			Options:         options,
+		})
+		cx.SetProtocol("postgres")
+		return true, nil
+	}
+}
 
-		// Read value
-		valEnd := pos
-		for valEnd < len(data) && data[valEnd] != 0 {
-			valEnd++
+// parseStartupParameters reads the parameters of a StartupMessage from r, i.e. pairs of null-terminated
+// names and values followed by a null byte, which must end the message. It returns false if they're malformed.
+func parseStartupParameters(r *byteparser.Reader) (map[string]string, bool) {
+	params := make(map[string]string)
+	for {
+		name := r.ReadCString()
+		if r.Err() != nil {
+			return nil, false
+		}
+		if len(name) == 0 {
+			// An empty name is the final null byte
+			return params, r.Len() == 0
+		}
+		value := r.ReadCString()
+		if r.Err() != nil {
+			return nil, false
 		}
+		params[name] = value
+	}
+}
 
-		// Check if we've reached the end without finding null terminator
-		if valEnd >= len(data) {
-			return false
+// parseOptions returns the run-time parameters set by the value of the options parameter of a StartupMessage,
+// i.e. "-c key=value", "-ckey=value" or "--key=value" arguments separated by spaces, which may be escaped with
+// backslashes. Keys are case-insensitive, and dashes in keys stand for underscores, so they're normalized.
+// Other arguments are ignored.
+func parseOptions(s string) map[string]string {
+	// Split the arguments like the backend does, see pg_split_opts
+	var args []string
+	var arg strings.Builder
+	var escaped, inArg bool
+	for _, c := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped, inArg = true, true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
 		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
 
-		// Skip the null terminator
-		pos = valEnd + 1
+	options := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		var setting string
+		switch {
+		case args[i] == "-c":
+			if i+1 == len(args) {
+				continue
+			}
+			i++
+			setting = args[i]
+		case strings.HasPrefix(args[i], "-c"):
+			setting = args[i][2:]
+		case strings.HasPrefix(args[i], "--"):
+			setting = args[i][2:]
+		default:
+			continue
+		}
+		key, value, found := strings.Cut(setting, "=")
+		if !found || len(key) == 0 {
+			continue
+		}
+		options[normalizeOptionKey(key)] = value
 	}
-	return false
+	return options
 }
 
-func (m *MatchPostgres) Provision(ctx caddy.Context) error {
+// normalizeOptionKey returns the canonical form of the key of a run-time parameter.
+func normalizeOptionKey(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "-", "_"))
+}
+
+// Provision parses m's protocol versions and normalizes the keys of m's options.
+func (m *MatchPostgres) Provision(_ caddy.Context) (err error) {
+	repl := caddy.NewReplacer()
+	if m.minVersion, err = parseProtocolVersion(repl.ReplaceAll(m.MinVersion, "")); err != nil {
+		return fmt.Errorf("parsing min_version: %v", err)
+	}
+	if m.maxVersion, err = parseProtocolVersion(repl.ReplaceAll(m.MaxVersion, "")); err != nil {
+		return fmt.Errorf("parsing max_version: %v", err)
+	}
+	if m.minVersion > 0 && m.maxVersion > 0 && m.minVersion > m.maxVersion {
+		return fmt.Errorf("min_version %s is greater than max_version %s", m.MinVersion, m.MaxVersion)
+	}
+	if m.RequireEncryption && (m.minVersion > 0 || m.maxVersion > 0 || len(m.Options) > 0) {
+		return errors.New("require_encryption can't be combined with versions or options")
+	}
+	m.options = make(map[string]string, len(m.Options))
+	for key, value := range m.Options {
+		if len(key) == 0 {
+			return fmt.Errorf("empty option key")
+		}
+		m.options[normalizeOptionKey(key)] = value
+	}
 	return nil
 }
 
-// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens.
+// UnmarshalCaddyfile sets up the MatchPostgres from Caddyfile tokens. Syntax:
+//
+//	postgres {
+//		option <key> <value>
+//		require_encryption
+//		strict [true|false]
+//		version <min> [<max>]
+//	}
+//	postgres
+//
+// Note: multiple 'option' options are allowed.
 func (m *MatchPostgres) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
 	if d.CountRemainingArgs() > 0 {
 		return d.ArgErr()
 	}
-	if d.NextBlock(d.Nesting()) {
-		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+
+	var hasStrict, hasVersion bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "option":
+			if d.CountRemainingArgs() != 2 {
+				return d.ArgErr()
+			}
+			_, key := d.NextArg(), normalizeOptionKey(d.Val())
+			if _, ok := m.Options[key]; ok {
+				return d.Errf("duplicate %s option '%s %s'", wrapper, optionName, key)
+			}
+			if m.Options == nil {
+				m.Options = make(map[string]string)
+			}
+			_, m.Options[key] = d.NextArg(), d.Val()
+		case "require_encryption":
+			if m.RequireEncryption {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			m.RequireEncryption = true
+		case "strict":
+			if hasStrict {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 1 {
+				return d.ArgErr()
+			}
+			strict := true
+			if d.NextArg() {
+				val, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+				}
+				strict = val
+			}
+			m.Strict, hasStrict = &strict, true
+		case "version":
+			if hasVersion {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() == 0 || d.CountRemainingArgs() > 2 {
+				return d.ArgErr()
+			}
+			_, m.MinVersion = d.NextArg(), d.Val()
+			if d.NextArg() {
+				m.MaxVersion = d.Val()
+			}
+			hasVersion = true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
 	}
+
 	return nil
 }
 
+// parseProtocolVersion converts a protocol version in major.minor format
+// into its wire representation, i.e. major<<16 | minor. It returns 0 for
+// an empty string.
+func parseProtocolVersion(s string) (uint32, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	major, minor, found := strings.Cut(s, ".")
+	if !found {
+		return 0, fmt.Errorf("invalid protocol version '%s': expected major.minor format", s)
+	}
+	majorVal, err := strconv.ParseUint(major, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol version '%s': %v", s, err)
+	}
+	minorVal, err := strconv.ParseUint(minor, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol version '%s': %v", s, err)
+	}
+	return uint32(majorVal)<<16 | uint32(minorVal), nil
+}
+
 //Refs
 //
 // https://github.com/mholt/caddy-l4/blob/master/modules/l4ssh/matcher.go
@@ -173,9 +453,11 @@ func (m *MatchPostgres) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 // https://ivdl.co.za/2024/03/02/pretending-to-be-postgresql-part-one-1/
 // https://www.postgresql.org/docs/current/protocol-message-formats.html#PROTOCOL-MESSAGE-FORMATS-STARTUPMESSAGE
 // https://www.postgresql.org/docs/current/protocol-message-formats.html#PROTOCOL-MESSAGE-FORMATS-SSLREQUEST
+// https://www.postgresql.org/docs/current/protocol-message-formats.html#PROTOCOL-MESSAGE-FORMATS-GSSENCREQUEST
 
 // Interface guards
 var (
-	_ layer4.ConnMatcher    = (*MatchPostgres)(nil)
+	_ caddy.Provisioner     = (*MatchPostgres)(nil)
 	_ caddyfile.Unmarshaler = (*MatchPostgres)(nil)
+	_ layer4.ConnMatcher    = (*MatchPostgres)(nil)
 )
@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/mholt/caddy-l4/layer4"
+	_ "github.com/mholt/caddy-l4/modules/l4echo"
+	"github.com/mholt/caddy-l4/modules/l4proxy"
 	"go.uber.org/zap"
 )
 
@@ -59,6 +65,27 @@ func buildSSLRequest() []byte {
 	return message.Bytes()
 }
 
+func buildGSSENCRequest() []byte {
+	var message bytes.Buffer
+	totalLen := uint32(8) // 4 bytes length, 4 bytes code
+
+	binary.Write(&message, binary.BigEndian, totalLen)                  // Message Length (8)
+	binary.Write(&message, binary.BigEndian, uint32(gssEncRequestCode)) // GSSENCRequest Code
+
+	return message.Bytes()
+}
+
+func buildPaddedSSLRequest(padding []byte) []byte {
+	var message bytes.Buffer
+	totalLen := uint32(8 + len(padding)) // 4 bytes length, 4 bytes code, trailing bytes
+
+	binary.Write(&message, binary.BigEndian, totalLen)               // Message Length (8 + padding)
+	binary.Write(&message, binary.BigEndian, uint32(sslRequestCode)) // SSLRequest Code
+	message.Write(padding)                                           // Trailing bytes
+
+	return message.Bytes()
+}
+
 func buildCancelRequest(pid, secretKey uint32) []byte {
 	var message bytes.Buffer
 	totalLen := uint32(16) // 4 bytes length, 4 bytes code, 4 bytes pid, 4 bytes key
@@ -386,3 +413,751 @@ func TestMatchPostgres(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchPostgres_VersionRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		matcher   *MatchPostgres
+		input     []byte
+		wantMatch bool
+	}{
+		{
+			name:      "No Range, V3.0",
+			matcher:   &MatchPostgres{},
+			input:     buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+			wantMatch: true,
+		},
+		{
+			name:      "Min V3.0 Max V3.2, V3.0",
+			matcher:   &MatchPostgres{MinVersion: "3.0", MaxVersion: "3.2"},
+			input:     buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+			wantMatch: true,
+		},
+		{
+			name:      "Min V3.0 Max V3.2, V3.2",
+			matcher:   &MatchPostgres{MinVersion: "3.0", MaxVersion: "3.2"},
+			input:     buildStartupMessage(0x00030002, map[string]string{"user": "test"}),
+			wantMatch: true,
+		},
+		{
+			name:      "Min V3.2, V3.0",
+			matcher:   &MatchPostgres{MinVersion: "3.2"},
+			input:     buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+			wantMatch: false,
+		},
+		{
+			name:      "Min V3.2, V3.2",
+			matcher:   &MatchPostgres{MinVersion: "3.2"},
+			input:     buildStartupMessage(0x00030002, map[string]string{"user": "test"}),
+			wantMatch: true,
+		},
+		{
+			name:      "Max V3.0, V3.2",
+			matcher:   &MatchPostgres{MaxVersion: "3.0"},
+			input:     buildStartupMessage(0x00030002, map[string]string{"user": "test"}),
+			wantMatch: false,
+		},
+		{
+			name:      "Max V3.0, SSLRequest",
+			matcher:   &MatchPostgres{MaxVersion: "3.0"},
+			input:     buildSSLRequest(),
+			wantMatch: true,
+		},
+		{
+			name:      "Min V3.2, CancelRequest",
+			matcher:   &MatchPostgres{MinVersion: "3.2"},
+			input:     buildCancelRequest(12345, 67890),
+			wantMatch: true,
+		},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchPostgres_Strict(t *testing.T) {
+	strict, lenient := true, false
+	tests := []struct {
+		name      string
+		matcher   *MatchPostgres
+		input     []byte
+		wantMatch bool
+	}{
+		{
+			name:      "Default, SSLRequest",
+			matcher:   &MatchPostgres{},
+			input:     buildSSLRequest(),
+			wantMatch: true,
+		},
+		{
+			name:      "Default, Padded SSLRequest",
+			matcher:   &MatchPostgres{},
+			input:     buildPaddedSSLRequest([]byte{0x00, 0x00, 0x00, 0x00}),
+			wantMatch: false,
+		},
+		{
+			name:      "Strict, SSLRequest",
+			matcher:   &MatchPostgres{Strict: &strict},
+			input:     buildSSLRequest(),
+			wantMatch: true,
+		},
+		{
+			name:      "Strict, Padded SSLRequest",
+			matcher:   &MatchPostgres{Strict: &strict},
+			input:     buildPaddedSSLRequest([]byte{0x00, 0x00, 0x00, 0x00}),
+			wantMatch: false,
+		},
+		{
+			name:      "Lenient, SSLRequest",
+			matcher:   &MatchPostgres{Strict: &lenient},
+			input:     buildSSLRequest(),
+			wantMatch: true,
+		},
+		{
+			name:      "Lenient, Padded SSLRequest",
+			matcher:   &MatchPostgres{Strict: &lenient},
+			input:     buildPaddedSSLRequest([]byte{0x00, 0x00, 0x00, 0x00}),
+			wantMatch: true,
+		},
+		{
+			name:      "Lenient, Padded SSLRequest, Odd Length",
+			matcher:   &MatchPostgres{Strict: &lenient},
+			input:     buildPaddedSSLRequest([]byte{0x01, 0x02, 0x03}),
+			wantMatch: true,
+		},
+		{
+			name:      "Lenient, Truncated SSLRequest",
+			matcher:   &MatchPostgres{Strict: &lenient},
+			input:     buildPaddedSSLRequest([]byte{0x00, 0x00, 0x00, 0x00})[:10],
+			wantMatch: false,
+		},
+		{
+			name:      "Lenient, CancelRequest with Wrong Length",
+			matcher:   &MatchPostgres{Strict: &lenient},
+			input:     buildCancelRequest(12345, 67890)[:12],
+			wantMatch: false,
+		},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchPostgres_RequireEncryption(t *testing.T) {
+	tests := []struct {
+		name      string
+		matcher   *MatchPostgres
+		input     []byte
+		wantMatch bool
+	}{
+		{
+			name:      "Default, StartupMessage",
+			matcher:   &MatchPostgres{},
+			input:     buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+			wantMatch: true,
+		},
+		{
+			name:      "Default, GSSENCRequest",
+			matcher:   &MatchPostgres{},
+			input:     buildGSSENCRequest(),
+			wantMatch: true,
+		},
+		{
+			name:      "Required, SSLRequest",
+			matcher:   &MatchPostgres{RequireEncryption: true},
+			input:     buildSSLRequest(),
+			wantMatch: true,
+		},
+		{
+			name:      "Required, GSSENCRequest",
+			matcher:   &MatchPostgres{RequireEncryption: true},
+			input:     buildGSSENCRequest(),
+			wantMatch: true,
+		},
+		{
+			name:      "Required, SSLRequest Followed by TLS",
+			matcher:   &MatchPostgres{RequireEncryption: true},
+			input:     append(buildSSLRequest(), 0x16, 0x03, 0x01, 0x00, 0xf4, 0x01),
+			wantMatch: true,
+		},
+		{
+			name:      "Required, StartupMessage",
+			matcher:   &MatchPostgres{RequireEncryption: true},
+			input:     buildStartupMessage(0x00030000, map[string]string{"user": "test", "database": "db"}),
+			wantMatch: false,
+		},
+		{
+			name:      "Required, StartupMessage V3.2",
+			matcher:   &MatchPostgres{RequireEncryption: true},
+			input:     buildStartupMessage(0x00030002, map[string]string{"user": "test"}),
+			wantMatch: false,
+		},
+		{
+			name:      "Required, CancelRequest",
+			matcher:   &MatchPostgres{RequireEncryption: true},
+			input:     buildCancelRequest(12345, 67890),
+			wantMatch: false,
+		},
+		{
+			name:      "Required, Padded SSLRequest",
+			matcher:   &MatchPostgres{RequireEncryption: true},
+			input:     buildPaddedSSLRequest([]byte{0x00, 0x00, 0x00, 0x00}),
+			wantMatch: false,
+		},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+		})
+	}
+
+	for i, m := range []*MatchPostgres{
+		{RequireEncryption: true, MinVersion: "3.0"},
+		{RequireEncryption: true, MaxVersion: "3.2"},
+		{RequireEncryption: true, Options: map[string]string{"password_encryption": "md5"}},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid matcher should not be provisioned | %+v\n", i, m)
+		}
+	}
+}
+
+func TestMatchPostgres_StartupInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		matcher  json.RawMessage
+		input    []byte
+		wantInfo *StartupInfo
+	}{
+		{
+			name:     "StartupMessage",
+			matcher:  json.RawMessage("{}"),
+			input:    buildStartupMessage(0x00030000, map[string]string{"user": "test", "database": "db"}),
+			wantInfo: &StartupInfo{ProtocolVersion: 0x00030000, Parameters: map[string]string{"user": "test", "database": "db"}},
+		},
+		{
+			name:     "StartupMessage, No Parameters",
+			matcher:  json.RawMessage("{}"),
+			input:    buildStartupMessage(0x00030002, map[string]string{}),
+			wantInfo: &StartupInfo{ProtocolVersion: 0x00030002, Parameters: map[string]string{}},
+		},
+		{
+			name:     "SSLRequest",
+			matcher:  json.RawMessage("{}"),
+			input:    buildSSLRequest(),
+			wantInfo: &StartupInfo{SSLRequest: true},
+		},
+		{
+			name:     "GSSENCRequest",
+			matcher:  json.RawMessage("{}"),
+			input:    buildGSSENCRequest(),
+			wantInfo: &StartupInfo{GSSENCRequest: true},
+		},
+		{
+			name:     "Lenient, Padded SSLRequest",
+			matcher:  json.RawMessage("{\"strict\":false}"),
+			input:    buildPaddedSSLRequest([]byte{0x00, 0x00, 0x00, 0x00}),
+			wantInfo: &StartupInfo{SSLRequest: true},
+		},
+		{
+			name:     "CancelRequest",
+			matcher:  json.RawMessage("{}"),
+			input:    buildCancelRequest(12345, 67890),
+			wantInfo: &StartupInfo{CancelRequest: true},
+		},
+		{
+			name:     "StartupMessage, Options",
+			matcher:  json.RawMessage("{}"),
+			input:    buildStartupMessage(0x00030000, map[string]string{"user": "test", "options": "-c statement_timeout=5000"}),
+			wantInfo: &StartupInfo{ProtocolVersion: 0x00030000, Parameters: map[string]string{"user": "test", "options": "-c statement_timeout=5000"}, Options: map[string]string{"statement_timeout": "5000"}},
+		},
+		{
+			name:     "Not Matched",
+			matcher:  json.RawMessage("{\"min_version\":\"3.2\"}"),
+			input:    buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+			wantInfo: nil,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+			defer func() { _ = in.Close() }()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+			}()
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			routes := layer4.RouteList{&layer4.Route{
+				MatcherSetsRaw: []caddy.ModuleMap{{"postgres": tc.matcher}},
+			}}
+			err := routes.Provision(ctx)
+			assertNoError(t, err)
+
+			// retrieve the typed object downstream of the matcher
+			var info *StartupInfo
+			compiledRoute := routes.Compile(zap.NewNop(), 100*time.Millisecond,
+				layer4.HandlerFunc(func(con *layer4.Connection) error {
+					info, _ = GetStartupInfo(con)
+					return nil
+				}))
+
+			err = compiledRoute.Handle(cx)
+			assertNoError(t, err)
+
+			if !reflect.DeepEqual(info, tc.wantInfo) {
+				t.Fatalf("test %d: unexpected startup info | got %+v, want %+v\n", i, info, tc.wantInfo)
+			}
+		})
+	}
+}
+
+func TestMatchPostgres_PreservesPrefetchedBytes(t *testing.T) {
+	startup := buildStartupMessage(0x00030000, map[string]string{"user": "test", "database": "db"})
+	query := append([]byte{'Q', 0x00, 0x00, 0x00, 0x0D}, []byte("SELECT 1;\x00")...)
+	large := buildStartupMessage(0x00030000, map[string]string{"user": "test", "options": string(bytes.Repeat([]byte{'x'}, 3000))})
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "StartupMessage", input: startup},
+		{name: "StartupMessage, Followed by Query", input: append(append([]byte{}, startup...), query...)},
+		{name: "StartupMessage, Larger than Prefetch Chunk", input: large},
+		{name: "SSLRequest", input: buildSSLRequest()},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+			defer func() { _ = out.Close() }()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+			}()
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			routes := layer4.RouteList{&layer4.Route{
+				MatcherSetsRaw: []caddy.ModuleMap{{"postgres": json.RawMessage("{}")}},
+			}}
+			err := routes.Provision(ctx)
+			assertNoError(t, err)
+
+			// the downstream handler relays the matched connection to an upstream over a loopback pipe
+			var received []byte
+			compiledRoute := routes.Compile(zap.NewNop(), 100*time.Millisecond,
+				layer4.HandlerFunc(func(con *layer4.Connection) error {
+					if _, ok := GetStartupInfo(con); !ok {
+						t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+					}
+
+					upClient, upServer := net.Pipe()
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						received, _ = io.ReadAll(upServer)
+					}()
+
+					// the client stays connected, so the handler relays as many bytes as it has sent, or times out if any are lost
+					_ = con.SetReadDeadline(time.Now().Add(time.Second))
+					_, err := io.CopyN(upClient, con, int64(len(tc.input)))
+					_ = upClient.Close()
+					<-done
+					return err
+				}))
+
+			err = compiledRoute.Handle(cx)
+			assertNoError(t, err)
+
+			if !bytes.Equal(received, tc.input) {
+				t.Fatalf("test %d: upstream received different bytes | got %d bytes, want %d bytes\n", i, len(received), len(tc.input))
+			}
+		})
+	}
+}
+
+func TestMatchPostgres_HashSelection(t *testing.T) {
+	pool := l4proxy.UpstreamPool{
+		{Dial: []string{"10.0.0.1:5432"}},
+		{Dial: []string{"10.0.0.2:5432"}},
+		{Dial: []string{"10.0.0.3:5432"}},
+		{Dial: []string{"10.0.0.4:5432"}},
+	}
+	policy := &l4proxy.HashSelection{Key: "{l4.postgres.database}"}
+
+	// selectUpstream matches a StartupMessage with the given parameters, then selects an upstream for it
+	selectUpstream := func(params map[string]string) (*l4proxy.Upstream, string, string) {
+		in, out := net.Pipe()
+		defer func() { _ = in.Close() }()
+		defer func() { _ = out.Close() }()
+
+		cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+		go func() {
+			_, err := in.Write(buildStartupMessage(0x00030000, params))
+			assertNoError(t, err)
+		}()
+
+		matched, err := (&MatchPostgres{}).Match(cx)
+		assertNoError(t, err)
+		if !matched {
+			t.Fatalf("matcher did not match | %v\n", params)
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		user, _ := repl.GetString("l4.postgres.user")
+		database, _ := repl.GetString("l4.postgres.database")
+		return policy.Select(pool, cx), user, database
+	}
+
+	// connections to the same database stick to the same upstream, whoever the user is
+	selected := make(map[*l4proxy.Upstream]bool)
+	for i := range 20 {
+		database := fmt.Sprintf("db%d", i)
+		first, user, got := selectUpstream(map[string]string{"user": "alice", "database": database})
+		if user != "alice" || got != database {
+			t.Fatalf("unexpected placeholders | got user %q and database %q, want alice and %s\n", user, got, database)
+		}
+		for _, user := range []string{"alice", "bob"} {
+			if upstream, _, _ := selectUpstream(map[string]string{"user": user, "database": database}); upstream != first {
+				t.Fatalf("database %s should stick to %s, got %s for %s\n", database, first, upstream, user)
+			}
+		}
+		selected[first] = true
+	}
+	if len(selected) < 2 {
+		t.Fatalf("databases should be spread across upstreams, got %d of %d\n", len(selected), len(pool))
+	}
+
+	// the database defaults to the user, as in Postgres
+	first, _, database := selectUpstream(map[string]string{"user": "carol"})
+	if database != "carol" {
+		t.Fatalf("unexpected database placeholder | got %q, want carol\n", database)
+	}
+	if upstream, _, _ := selectUpstream(map[string]string{"user": "carol", "database": "carol"}); upstream != first {
+		t.Fatalf("default database should stick to %s, got %s\n", first, upstream)
+	}
+}
+
+func TestMatchNotPostgres(t *testing.T) {
+	startup := buildStartupMessage(0x00030000, map[string]string{"user": "test", "database": "db"})
+	httpRequest := []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	tests := []struct {
+		name        string
+		input       []byte
+		shouldMatch bool
+		fallback    bool
+	}{
+		{name: "HTTP Request", input: httpRequest, shouldMatch: true},
+		{name: "StartupMessage", input: startup, shouldMatch: false, fallback: true},
+		{name: "SSLRequest", input: buildSSLRequest(), shouldMatch: false, fallback: true},
+		// an incomplete message isn't negated into a match, since the postgres matcher needs more data until it times out
+		{name: "Incomplete StartupMessage", input: startup[:6], shouldMatch: false, fallback: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			// the matched connections are echoed back, so that the client receives all the bytes it has sent
+			echoed := make(chan []byte, 1)
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				buf := make([]byte, len(tc.input))
+				n, _ := io.ReadFull(in, buf)
+				_ = in.Close()
+				echoed <- buf[:n]
+			}()
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			routes := layer4.RouteList{&layer4.Route{
+				MatcherSetsRaw: []caddy.ModuleMap{{"not": json.RawMessage(`[{"postgres":{}}]`)}},
+				HandlersRaw:    []json.RawMessage{json.RawMessage(`{"handler":"echo"}`)},
+			}}
+			err := routes.Provision(ctx)
+			assertNoError(t, err)
+
+			// the fallback handler is only called if the route doesn't match, and must receive all the bytes as well
+			var fallback []byte
+			var fallbackCalled bool
+			compiledRoute := routes.Compile(zap.NewNop(), 100*time.Millisecond,
+				layer4.HandlerFunc(func(con *layer4.Connection) error {
+					fallback, fallbackCalled = append([]byte{}, con.MatchingBytes()...), true
+					return nil
+				}))
+
+			err = compiledRoute.Handle(cx)
+			assertNoError(t, err)
+			_ = out.Close()
+
+			received := <-echoed
+			if matched := len(received) > 0; matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+			if tc.shouldMatch && !bytes.Equal(received, tc.input) {
+				t.Fatalf("test %d: client received different bytes | got %d bytes, want %d bytes\n", i, len(received), len(tc.input))
+			}
+			if fallbackCalled != tc.fallback {
+				t.Fatalf("test %d: unexpected fallback | got %t, want %t\n", i, fallbackCalled, tc.fallback)
+			}
+			if tc.fallback && !bytes.Equal(fallback, tc.input) {
+				t.Fatalf("test %d: fallback received different bytes | got %d bytes, want %d bytes\n", i, len(fallback), len(tc.input))
+			}
+		})
+	}
+}
+
+func TestParseProtocolVersion(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    uint32
+		wantErr bool
+	}{
+		{input: "", want: 0},
+		{input: "3.0", want: 0x00030000},
+		{input: "3.2", want: 0x00030002},
+		{input: "1234.5679", want: 0x04d2162f},
+		{input: "3", wantErr: true},
+		{input: "3.x", wantErr: true},
+		{input: "70000.0", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseProtocolVersion(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("parsing '%s': unexpected error state: %v", tc.input, err)
+		}
+		if got != tc.want {
+			t.Fatalf("parsing '%s': got 0x%08x, want 0x%08x", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestMatchPostgres_Options(t *testing.T) {
+	tests := []struct {
+		name        string
+		matcher     *MatchPostgres
+		input       []byte
+		wantMatch   bool
+		wantOptions map[string]string
+	}{
+		{
+			name:        "Single Option",
+			matcher:     &MatchPostgres{},
+			input:       buildStartupMessage(0x00030000, map[string]string{"user": "test", "options": "-c statement_timeout=5000"}),
+			wantMatch:   true,
+			wantOptions: map[string]string{"statement_timeout": "5000"},
+		},
+		{
+			name:    "Multiple Options",
+			matcher: &MatchPostgres{},
+			input: buildStartupMessage(0x00030000, map[string]string{"user": "test",
+				"options": "-c statement_timeout=5000  -cpassword_encryption=md5 --search-path=my\\ schema -d 1 -c"}),
+			wantMatch: true,
+			wantOptions: map[string]string{
+				"statement_timeout":   "5000",
+				"password_encryption": "md5",
+				"search_path":         "my schema",
+			},
+		},
+		{
+			name:        "No Options",
+			matcher:     &MatchPostgres{},
+			input:       buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+			wantMatch:   true,
+			wantOptions: map[string]string{},
+		},
+		{
+			name:        "Required Option",
+			matcher:     &MatchPostgres{Options: map[string]string{"Password-Encryption": "md5"}},
+			input:       buildStartupMessage(0x00030000, map[string]string{"user": "test", "options": "-c statement_timeout=5000 -c password_encryption=md5"}),
+			wantMatch:   true,
+			wantOptions: map[string]string{"statement_timeout": "5000", "password_encryption": "md5"},
+		},
+		{
+			name:      "Required Option, Other Value",
+			matcher:   &MatchPostgres{Options: map[string]string{"password_encryption": "md5"}},
+			input:     buildStartupMessage(0x00030000, map[string]string{"user": "test", "options": "-c password_encryption=scram-sha-256"}),
+			wantMatch: false,
+		},
+		{
+			name:      "Required Option, Missing",
+			matcher:   &MatchPostgres{Options: map[string]string{"password_encryption": "md5"}},
+			input:     buildStartupMessage(0x00030000, map[string]string{"user": "test"}),
+			wantMatch: false,
+		},
+		{
+			name:        "Required Option, SSLRequest",
+			matcher:     &MatchPostgres{Options: map[string]string{"password_encryption": "md5"}},
+			input:       buildSSLRequest(),
+			wantMatch:   true,
+			wantOptions: map[string]string{},
+		},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for key, want := range tc.wantOptions {
+				if got, _ := repl.GetString("l4.postgres.option." + key); got != want {
+					t.Fatalf("test %d: unexpected option %s | got %q, want %q\n", i, key, got, want)
+				}
+			}
+			for _, key := range []string{"d", "c", "search-path"} {
+				if value, ok := repl.Get("l4.postgres.option." + key); ok {
+					t.Fatalf("test %d: unexpected option %s | %v\n", i, key, value)
+				}
+			}
+		})
+	}
+}
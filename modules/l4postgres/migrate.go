@@ -0,0 +1,278 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4postgres
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/modules/l4migrate"
+)
+
+func init() {
+	caddy.RegisterModule(&MigratePostgres{})
+}
+
+const (
+	authenticationType      = 'R' // Type of Authentication* messages
+	authenticationOk        = 0   // Authentication code of AuthenticationOk messages
+	errorResponseType       = 'E' // Type of ErrorResponse messages
+	readyForQueryType       = 'Z' // Type of ReadyForQuery messages
+	queryType               = 'Q' // Type of Query messages
+	syncType                = 'S' // Type of Sync messages
+	terminateType           = 'X' // Type of Terminate messages
+	transactionStatusIdle   = 'I' // Transaction status of ReadyForQuery messages outside a transaction block
+	maxReplayedMessageCount = 256 // Maximum number of messages read from the backend during a replay
+)
+
+// MigratePostgres makes Postgres sessions migratable by the migrate handler. This is a stub implementation,
+// which supports the simplest sessions only: the StartupMessage of the client is captured and replayed on
+// the new backend, which must accept it without a password, e.g. with trust authentication, and sessions
+// are migratable when idle, i.e. the backend is ready for a query outside any transaction block and no
+// query of the client is outstanding. Any session state set afterwards, e.g. with SET or PREPARE, isn't
+// replayed, the backend key data sent by the new backend is dropped, so that cancel requests of the client
+// still target the previous backend, and encrypted sessions are never migratable.
+type MigratePostgres struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MigratePostgres) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.migrate.postgres",
+		New: func() caddy.Module { return new(MigratePostgres) },
+	}
+}
+
+// NewSession returns the state of a new Postgres session.
+func (*MigratePostgres) NewSession() l4migrate.Session {
+	return &migrateSession{}
+}
+
+// UnmarshalCaddyfile sets up the MigratePostgres from Caddyfile tokens. Syntax:
+//
+//	postgres
+func (m *MigratePostgres) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s option: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// migrateSession tracks the state of a Postgres session.
+type migrateSession struct {
+	startup  []byte        // StartupMessage of the client, once complete
+	client   messageFramer // Framer of the messages sent by the client after the StartupMessage
+	upstream messageFramer // Framer of the messages sent by the backend
+	status   byte          // Transaction status of the last ReadyForQuery message, 0 before the first one
+	pending  int           // Number of ReadyForQuery messages expected from the backend
+	extended bool          // True if the client has sent extended query messages not followed by a Sync yet
+	err      error         // Reason why the session will never be migratable
+}
+
+// ObserveClient captures the StartupMessage and tracks the messages sent by the client.
+func (s *migrateSession) ObserveClient(b []byte) {
+	if s.err != nil {
+		return
+	}
+	if s.startup == nil {
+		b = s.observeStartup(b)
+	}
+	if s.err == nil && len(b) > 0 {
+		s.err = s.client.feed(b, func(typ, _ byte) {
+			switch typ {
+			case queryType, syncType:
+				s.pending++
+				s.extended = false
+			case terminateType:
+			default:
+				s.extended = true
+			}
+		})
+	}
+}
+
+// observeStartup accumulates the first message of the client in s.client's buffer, and returns
+// the bytes following it, if any. The session isn't migratable unless it's a StartupMessage.
+func (s *migrateSession) observeStartup(b []byte) []byte {
+	buf := append(s.client.buf, b...)
+	if len(buf) < minMessageLen {
+		s.client.buf = buf
+		return nil
+	}
+	msgLen := binary.BigEndian.Uint32(buf)
+	if msgLen < minMessageLen || msgLen-lenFieldSize > maxPayloadSize {
+		s.err = fmt.Errorf("invalid message length: %d", msgLen)
+		return nil
+	}
+	if uint32(len(buf)) < msgLen { //nolint:gosec // disable G115
+		s.client.buf = buf
+		return nil
+	}
+	s.client.buf = nil
+
+	r := byteparser.NewReader(buf[lenFieldSize:msgLen])
+	switch code := r.ReadUint32(); code {
+	case sslRequestCode, gssEncRequestCode:
+		s.err = errors.New("encrypted sessions can't be replayed")
+	case cancelRequestCode:
+		s.err = errors.New("cancel requests aren't sessions")
+	default:
+		s.startup = buf[:msgLen:msgLen]
+		s.pending++
+	}
+	return buf[msgLen:]
+}
+
+// ObserveUpstream tracks the transaction status of the session.
+func (s *migrateSession) ObserveUpstream(b []byte) {
+	if s.err != nil {
+		return
+	}
+	s.err = s.upstream.feed(b, func(typ, first byte) {
+		if typ == readyForQueryType {
+			s.status, s.pending = first, max(s.pending-1, 0)
+		}
+	})
+}
+
+// Migratable returns nil if the session is idle.
+func (s *migrateSession) Migratable() error {
+	switch {
+	case s.err != nil:
+		return s.err
+	case s.startup == nil || s.status == 0:
+		return errors.New("the session isn't established")
+	case s.pending > 0 || s.extended || s.client.inMessage() || s.upstream.inMessage():
+		return errors.New("a message is being exchanged")
+	case s.status != transactionStatusIdle:
+		return errors.New("a transaction block is open")
+	}
+	return nil
+}
+
+// Replay sends the StartupMessage to the new backend and reads its replies until it's ready for a query.
+func (s *migrateSession) Replay(upstream net.Conn) error {
+	if _, err := upstream.Write(s.startup); err != nil {
+		return fmt.Errorf("writing startup message: %w", err)
+	}
+
+	for range maxReplayedMessageCount {
+		typ, payload, err := readMessage(upstream)
+		if err != nil {
+			return fmt.Errorf("reading reply: %w", err)
+		}
+		r := byteparser.NewReader(payload)
+		switch typ {
+		case authenticationType:
+			if code := r.ReadUint32(); r.Err() != nil || code != authenticationOk {
+				return fmt.Errorf("unsupported authentication request: %d", code)
+			}
+		case errorResponseType:
+			return errors.New("startup rejected by backend")
+		case readyForQueryType:
+			if status := r.ReadUint8(); status != transactionStatusIdle {
+				return fmt.Errorf("unexpected transaction status: %q", status)
+			}
+			return nil
+		}
+		// Other messages, e.g. ParameterStatus and BackendKeyData, aren't needed by the client
+	}
+	return errors.New("too many replies")
+}
+
+// readMessage reads a whole typed message from r and returns its type and its payload.
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 1+lenFieldSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	msgLen := binary.BigEndian.Uint32(header[1:])
+	if msgLen < lenFieldSize || msgLen-lenFieldSize > maxPayloadSize {
+		return 0, nil, fmt.Errorf("invalid message length: %d", msgLen)
+	}
+	payload := make([]byte, msgLen-lenFieldSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// messageFramer splits a stream of typed messages, without buffering their payloads.
+type messageFramer struct {
+	buf       []byte // Bytes of the current message's header read so far
+	remaining uint32 // Bytes of the current message's payload not read yet
+	first     byte   // First byte of the current message's payload, if read
+	started   bool   // True if the current message's payload has been partially read
+}
+
+// feed consumes b, calling fn with the type and the first payload byte (or 0) of each complete message.
+func (f *messageFramer) feed(b []byte, fn func(typ, first byte)) error {
+	for len(b) > 0 {
+		if len(f.buf) < 1+lenFieldSize {
+			n := min(len(b), 1+lenFieldSize-len(f.buf))
+			f.buf, b = append(f.buf, b[:n]...), b[n:]
+			if len(f.buf) < 1+lenFieldSize {
+				return nil
+			}
+			msgLen := binary.BigEndian.Uint32(f.buf[1:])
+			if msgLen < lenFieldSize {
+				return fmt.Errorf("invalid message length: %d", msgLen)
+			}
+			f.remaining, f.first, f.started = msgLen-lenFieldSize, 0, false
+		} else {
+			if !f.started {
+				f.first, f.started = b[0], true
+			}
+			n := min(uint32(len(b)), f.remaining) //nolint:gosec // disable G115
+			f.remaining, b = f.remaining-n, b[n:]
+		}
+		if f.remaining == 0 {
+			fn(f.buf[0], f.first)
+			f.buf = f.buf[:0]
+		}
+	}
+	return nil
+}
+
+// inMessage returns true if f is within a message.
+func (f *messageFramer) inMessage() bool {
+	return len(f.buf) > 0
+}
+
+// Refs:
+//
+//	https://www.postgresql.org/docs/current/protocol-flow.html#PROTOCOL-FLOW-START-UP
+//	https://www.postgresql.org/docs/current/protocol-message-formats.html
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MigratePostgres)(nil)
+	_ l4migrate.Protocol    = (*MigratePostgres)(nil)
+)
@@ -0,0 +1,159 @@
+package l4postgres
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// typedMessage returns a message of the given type with the given payload.
+func typedMessage(typ byte, payload ...byte) []byte {
+	b := make([]byte, 1+lenFieldSize, 1+lenFieldSize+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], uint32(lenFieldSize+len(payload))) //nolint:gosec // disable G115
+	return append(b, payload...)
+}
+
+func TestMigrateSession_Migratable(t *testing.T) {
+	startup := encodeStartupMessage(minProtocolVersion, "user", "app", "database", "app")
+	authOk := typedMessage(authenticationType, 0, 0, 0, 0)
+	query := typedMessage('Q', []byte("SELECT 1\x00")...)
+	ready := func(status byte) []byte { return typedMessage(readyForQueryType, status) }
+
+	type step struct {
+		client     []byte
+		upstream   []byte
+		migratable bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "idle", steps: []step{
+			{client: startup[:3]},
+			{client: startup[3:]},
+			{upstream: append(authOk, ready(transactionStatusIdle)...), migratable: true},
+			{client: query},
+			{upstream: typedMessage('C', []byte("SELECT 1\x00")...)},
+			{upstream: ready(transactionStatusIdle)[:2]},
+			{upstream: ready(transactionStatusIdle)[2:], migratable: true},
+		}},
+		{name: "transaction block", steps: []step{
+			{client: startup},
+			{upstream: append(authOk, ready(transactionStatusIdle)...), migratable: true},
+			{client: typedMessage('Q', []byte("BEGIN\x00")...)},
+			{upstream: ready('T')},
+			{client: typedMessage('Q', []byte("COMMIT\x00")...)},
+			{upstream: ready(transactionStatusIdle), migratable: true},
+		}},
+		{name: "asynchronous message", steps: []step{
+			{client: startup},
+			{upstream: append(authOk, ready(transactionStatusIdle)...), migratable: true},
+			{upstream: typedMessage('A', 0, 0, 0, 1)[:3]},
+			{upstream: typedMessage('A', 0, 0, 0, 1)[3:], migratable: true},
+		}},
+		{name: "pipelined query", steps: []step{
+			{client: append(startup, query...)},
+			{upstream: append(authOk, ready(transactionStatusIdle)...)},
+			{upstream: ready(transactionStatusIdle), migratable: true},
+		}},
+		{name: "extended query", steps: []step{
+			{client: startup},
+			{upstream: append(authOk, ready(transactionStatusIdle)...), migratable: true},
+			{client: typedMessage('P', []byte("\x00SELECT 1\x00\x00\x00")...)},
+			{upstream: typedMessage('1')},
+			{client: typedMessage(syncType)},
+			{upstream: ready(transactionStatusIdle), migratable: true},
+		}},
+		{name: "ssl request", steps: []step{
+			{client: []byte{0, 0, 0, 8, 0x04, 0xD2, 0x16, 0x2F}},
+			{upstream: []byte("N")},
+		}},
+		{name: "invalid length", steps: []step{
+			{client: []byte{0, 0, 0, 2, 0, 0, 0, 0}},
+		}},
+	}
+
+	for _, tc := range tests {
+		s := (&MigratePostgres{}).NewSession()
+		for i, st := range tc.steps {
+			if st.client != nil {
+				s.ObserveClient(st.client)
+			}
+			if st.upstream != nil {
+				s.ObserveUpstream(st.upstream)
+			}
+			if err := s.Migratable(); (err == nil) != st.migratable {
+				t.Fatalf("%s: step %d: unexpected state | migratable: %t (%v), want %t\n", tc.name, i, err == nil, err, st.migratable)
+			}
+		}
+	}
+}
+
+func TestMigrateSession_Replay(t *testing.T) {
+	startup := encodeStartupMessage(minProtocolVersion, "user", "app")
+
+	tests := []struct {
+		name    string
+		replies [][]byte
+		success bool
+	}{
+		{name: "trust", replies: [][]byte{
+			typedMessage(authenticationType, 0, 0, 0, 0),
+			typedMessage('S', []byte("TimeZone\x00UTC\x00")...),
+			typedMessage('K', 0, 0, 0, 1, 0, 0, 0, 2),
+			typedMessage(readyForQueryType, transactionStatusIdle),
+		}, success: true},
+		{name: "password", replies: [][]byte{
+			typedMessage(authenticationType, 0, 0, 0, 3),
+		}},
+		{name: "error", replies: [][]byte{
+			typedMessage(errorResponseType, []byte("SFATAL\x00\x00")...),
+		}},
+		{name: "closed", replies: [][]byte{
+			typedMessage(authenticationType, 0, 0, 0, 0),
+		}},
+	}
+
+	for _, tc := range tests {
+		func() {
+			s := (&MigratePostgres{}).NewSession()
+			s.ObserveClient(startup)
+
+			client, backend := net.Pipe()
+			defer func() { _ = client.Close() }()
+
+			received := make(chan []byte, 1)
+			go func() {
+				defer func() { _ = backend.Close() }()
+				message, err := readStartupMessage(backend)
+				received <- message
+				if err != nil {
+					return
+				}
+				for _, reply := range tc.replies {
+					if _, err = backend.Write(reply); err != nil {
+						return
+					}
+				}
+				// the client doesn't expect the following bytes, which must not be consumed
+				_, _ = backend.Write(typedMessage('N'))
+			}()
+
+			err := s.Replay(client)
+			if (err == nil) != tc.success {
+				t.Fatalf("%s: unexpected result | error: %v, want success: %t\n", tc.name, err, tc.success)
+			}
+			if got := <-received; string(got) != string(startup) {
+				t.Fatalf("%s: unexpected startup message | got %x, want %x\n", tc.name, got, startup)
+			}
+			if tc.success {
+				if typ, _, err := readMessage(client); err != nil || typ != 'N' {
+					t.Fatalf("%s: unexpected message after replay | got %q (%v)\n", tc.name, typ, err)
+				}
+			}
+			_, _ = io.Copy(io.Discard, client)
+		}()
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4postgres
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&HandleParams{})
+}
+
+// HandleParams is a connection handler that rewrites the parameters of the StartupMessage sent by a client
+// before the connection is proxied, e.g. to force the database of a tenant, or to set run-time parameters
+// such as search_path. It must follow the postgres matcher, which parses the StartupMessage. Parameters are
+// set in place if present, appended otherwise, and the others are preserved. Any other connections, e.g.
+// starting with an SSLRequest, are passed through unchanged.
+type HandleParams struct {
+	// Set maps the names of parameters to set to their values, which may contain placeholders.
+	Set map[string]string `json:"set,omitempty"`
+
+	// Strip is a list of parameters to remove, e.g. options.
+	Strip []string `json:"strip,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*HandleParams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.postgres_params",
+		New: func() caddy.Module { return new(HandleParams) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *HandleParams) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger()
+
+	if len(h.Set) == 0 && len(h.Strip) == 0 {
+		return fmt.Errorf("no parameters to set or strip")
+	}
+	for name := range h.Set {
+		if len(name) == 0 || strings.ContainsRune(name, 0) {
+			return fmt.Errorf("invalid parameter name '%s'", name)
+		}
+		if slices.Contains(h.Strip, name) {
+			return fmt.Errorf("parameter '%s' can't be both set and stripped", name)
+		}
+	}
+	for _, name := range h.Strip {
+		if name == "user" {
+			return fmt.Errorf("parameter 'user' can't be stripped, since it's required")
+		}
+	}
+	return nil
+}
+
+// Handle handles the connections.
+func (h *HandleParams) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	info, ok := GetStartupInfo(cx)
+	if !ok || info.SSLRequest || info.GSSENCRequest || info.CancelRequest {
+		return next.Handle(cx)
+	}
+
+	// Replace the placeholders of the values to set
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	set := make(map[string]string, len(h.Set))
+	for name, value := range h.Set {
+		value = repl.ReplaceAll(value, "")
+		if strings.ContainsRune(value, 0) {
+			return fmt.Errorf("invalid value of parameter '%s': contains a null byte", name)
+		}
+		set[name] = value
+	}
+
+	// Read the StartupMessage the matcher has already seen, and rewrite it
+	message, err := readStartupMessage(cx)
+	if err != nil {
+		return fmt.Errorf("reading startup message: %v", err)
+	}
+	params := startupParameters(message)
+	var rewritten, stripped []string
+	for i := 0; i+1 < len(params); i += 2 {
+		name, value := params[i], params[i+1]
+		if slices.Contains(h.Strip, name) {
+			stripped = append(stripped, name)
+			continue
+		}
+		if v, ok := set[name]; ok {
+			value = v
+			delete(set, name)
+		}
+		rewritten = append(rewritten, name, value)
+	}
+	for _, name := range slices.Sorted(maps.Keys(set)) {
+		rewritten = append(rewritten, name, set[name])
+	}
+	message = encodeStartupMessage(info.ProtocolVersion, rewritten...)
+	if len(message)-lenFieldSize > maxPayloadSize {
+		return fmt.Errorf("rewritten startup message too long: %d bytes", len(message))
+	}
+
+	// Take over any bytes buffered beyond the StartupMessage, since a wrapped connection would read them first
+	buffered := make([]byte, len(cx.MatchingBytes()))
+	if _, err = io.ReadFull(cx, buffered); err != nil {
+		return fmt.Errorf("reading buffered bytes: %v", err)
+	}
+
+	h.logger.Debug("rewrote startup parameters",
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.Strings("set", slices.Sorted(maps.Keys(h.Set))),
+		zap.Strings("stripped", stripped),
+	)
+
+	info.Parameters = make(map[string]string, len(rewritten)/2)
+	for i := 0; i+1 < len(rewritten); i += 2 {
+		info.Parameters[rewritten[i]] = rewritten[i+1]
+	}
+	info.Options = nil
+	if options, ok := info.Parameters["options"]; ok {
+		info.Options = parseOptions(options)
+	}
+
+	// Replay the rewritten StartupMessage followed by anything else received from the client
+	return next.Handle(cx.Wrap(&replayConn{Conn: cx, r: io.MultiReader(bytes.NewReader(message), bytes.NewReader(buffered), cx)}))
+}
+
+// UnmarshalCaddyfile sets up the HandleParams from Caddyfile tokens. Syntax:
+//
+//	postgres_params {
+//		set_param <name> <value>
+//		strip_param <names...>
+//	}
+//
+// Note: multiple 'set_param' and 'strip_param' options are allowed.
+func (h *HandleParams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "set_param":
+			if d.CountRemainingArgs() != 2 {
+				return d.ArgErr()
+			}
+			_, name := d.NextArg(), d.Val()
+			if _, ok := h.Set[name]; ok {
+				return d.Errf("duplicate %s option '%s %s'", wrapper, optionName, name)
+			}
+			if h.Set == nil {
+				h.Set = make(map[string]string)
+			}
+			_, h.Set[name] = d.NextArg(), d.Val()
+		case "strip_param":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			h.Strip = append(h.Strip, d.RemainingArgs()...)
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*HandleParams)(nil)
+	_ caddyfile.Unmarshaler = (*HandleParams)(nil)
+	_ layer4.NextHandler    = (*HandleParams)(nil)
+)
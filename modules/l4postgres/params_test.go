@@ -0,0 +1,86 @@
+package l4postgres
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHandleParams(t *testing.T) {
+	query := append([]byte{'Q', 0x00, 0x00, 0x00, 0x0D}, []byte("SELECT 1;\x00")...)
+
+	tests := []struct {
+		name       string
+		config     string
+		input      []byte
+		wantReplay []byte
+	}{
+		{
+			name:       "Override Database",
+			config:     `{"handler":"postgres_params","set":{"database":"tenant42"}}`,
+			input:      append(encodeStartupMessage(0x00030000, "user", "alice", "database", "postgres", "application_name", "psql"), query...),
+			wantReplay: append(encodeStartupMessage(0x00030000, "user", "alice", "database", "tenant42", "application_name", "psql"), query...),
+		},
+		{
+			name:       "Add Parameters",
+			config:     `{"handler":"postgres_params","set":{"search_path":"tenant42,public","database":"tenant42"}}`,
+			input:      encodeStartupMessage(0x00030002, "user", "alice"),
+			wantReplay: encodeStartupMessage(0x00030002, "user", "alice", "database", "tenant42", "search_path", "tenant42,public"),
+		},
+		{
+			name:       "Strip Parameters",
+			config:     `{"handler":"postgres_params","set":{"database":"tenant42"},"strip":["options","replication"]}`,
+			input:      encodeStartupMessage(0x00030000, "options", "-c search_path=evil", "user", "alice", "database", "other"),
+			wantReplay: encodeStartupMessage(0x00030000, "user", "alice", "database", "tenant42"),
+		},
+		{
+			name:       "Placeholders",
+			config:     `{"handler":"postgres_params","set":{"database":"{l4.conn.remote_addr}"}}`,
+			input:      encodeStartupMessage(0x00030000, "user", "alice", "database", ""),
+			wantReplay: encodeStartupMessage(0x00030000, "user", "alice", "database", "pipe"),
+		},
+		{
+			name:       "SSLRequest",
+			config:     `{"handler":"postgres_params","set":{"database":"tenant42"}}`,
+			input:      buildSSLRequest(),
+			wantReplay: buildSSLRequest(),
+		},
+		{
+			name:       "CancelRequest",
+			config:     `{"handler":"postgres_params","set":{"database":"tenant42"}}`,
+			input:      buildCancelRequest(12345, 67890),
+			wantReplay: buildCancelRequest(12345, 67890),
+		},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sent, replayed := startupTester(t, tc.config, tc.input)
+
+			if !bytes.Equal(replayed, tc.wantReplay) {
+				t.Fatalf("test %d: unexpected bytes replayed | got %q, want %q\n", i, replayed, tc.wantReplay)
+			}
+			if len(sent) > 0 {
+				t.Fatalf("test %d: unexpected bytes sent to client | %x\n", i, sent)
+			}
+		})
+	}
+}
+
+func TestHandleParams_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*HandleParams{
+		{},
+		{Set: map[string]string{"": "x"}},
+		{Set: map[string]string{"database": "x"}, Strip: []string{"database"}},
+		{Strip: []string{"user"}},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid handler should not be provisioned | %+v\n", i, h)
+		}
+	}
+}
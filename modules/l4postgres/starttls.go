@@ -0,0 +1,94 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4postgres
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/modules/l4proxy"
+)
+
+func init() {
+	caddy.RegisterModule(&StartTLS{})
+}
+
+// StartTLS is a STARTTLS negotiator of the proxy handler, which asks a Postgres server to start TLS by
+// sending an SSLRequest before the TLS handshake, so that plaintext clients can be bridged to TLS-only
+// servers. The StartupMessage of the client is then replayed over the upgraded connection.
+type StartTLS struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*StartTLS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.starttls.postgres",
+		New: func() caddy.Module { return new(StartTLS) },
+	}
+}
+
+// NegotiateStartTLS sends an SSLRequest to a Postgres server over conn and reads the server's reply.
+// It returns true if the server is willing to perform a TLS handshake ('S') and false if it isn't ('N').
+func (s *StartTLS) NegotiateStartTLS(conn net.Conn) (bool, error) {
+	request := make([]byte, minMessageLen)
+	binary.BigEndian.PutUint32(request[:lenFieldSize], minMessageLen)
+	binary.BigEndian.PutUint32(request[lenFieldSize:], sslRequestCode)
+	if _, err := conn.Write(request); err != nil {
+		return false, fmt.Errorf("writing SSLRequest: %w", err)
+	}
+
+	// Read exactly one byte, as anything following 'S' belongs to the TLS handshake
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return false, fmt.Errorf("reading SSLRequest reply: %w", err)
+	}
+	switch reply[0] {
+	case 'S':
+		return true, nil
+	case 'N':
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected SSLRequest reply: 0x%02x", reply[0])
+	}
+}
+
+// UnmarshalCaddyfile sets up the StartTLS from Caddyfile tokens. Syntax:
+//
+//	starttls postgres
+func (s *StartTLS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s starttls negotiator: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler      = (*StartTLS)(nil)
+	_ l4proxy.StartTLSNegotiator = (*StartTLS)(nil)
+)
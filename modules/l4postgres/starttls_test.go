@@ -0,0 +1,50 @@
+package l4postgres
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestStartTLS_NegotiateStartTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantOK  bool
+		wantErr bool
+	}{
+		{name: "S", reply: []byte{'S'}, wantOK: true},
+		{name: "N", reply: []byte{'N'}, wantOK: false},
+		{name: "ErrorResponse", reply: []byte{'E'}, wantErr: true},
+		{name: "No Reply", reply: []byte{}, wantErr: true},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer func() { _ = client.Close() }()
+
+			// the backend expects an SSLRequest, and replies without reading any further
+			requests := make(chan []byte, 1)
+			go func() {
+				defer func() { _ = server.Close() }()
+				request := make([]byte, minMessageLen)
+				_, _ = io.ReadFull(server, request)
+				requests <- request
+				_, _ = server.Write(tc.reply)
+			}()
+
+			ok, err := (&StartTLS{}).NegotiateStartTLS(client)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("test %d: unexpected error | got %v, want error %t\n", i, err, tc.wantErr)
+			}
+			if ok != tc.wantOK {
+				t.Fatalf("test %d: unexpected result | got %t, want %t\n", i, ok, tc.wantOK)
+			}
+			if request := <-requests; !bytes.Equal(request, buildSSLRequest()) {
+				t.Fatalf("test %d: backend received %v instead of an SSLRequest\n", i, request)
+			}
+		})
+	}
+}
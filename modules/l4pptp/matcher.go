@@ -0,0 +1,141 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4pptp allows the L4 multiplexing of PPTP connections
+package l4pptp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchPPTP{})
+	layer4.RegisterProtocol("pptp")
+}
+
+const (
+	headerLength = 12  // Length, PPTP Message Type, Magic Cookie, Control Message Type and Reserved0 (bytes)
+	sccrqLength  = 156 // Length of Start-Control-Connection-Request messages (bytes)
+	nameLength   = 64  // Length of the Host Name and Vendor String fields (bytes)
+
+	magicCookie                   uint32 = 0x1A2B3C4D
+	messageTypeControl            uint16 = 1
+	startControlConnectionRequest uint16 = 1
+)
+
+// MatchPPTP is able to match PPTP control connections, which start with a Start-Control-Connection-Request
+// (SCCRQ) message of the client, usually on TCP port 1723. The tunneled PPP frames are carried by GRE packets,
+// which can't be proxied by layer4. The requested protocol version is exposed as {l4.pptp.version}, e.g. 1.0,
+// and the Host Name and Vendor String fields as {l4.pptp.hostname} and {l4.pptp.vendor}, if printable.
+type MatchPPTP struct{}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchPPTP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.pptp",
+		New: func() caddy.Module { return new(MatchPPTP) },
+	}
+}
+
+// Match returns true if the connection looks like PPTP.
+func (m *MatchPPTP) Match(cx *layer4.Connection) (bool, error) {
+	// Read the header, so that other protocols are rejected early
+	buf := make([]byte, sccrqLength)
+	if _, err := io.ReadFull(cx, buf[:headerLength]); err != nil {
+		return false, err
+	}
+
+	// Validate Length, PPTP Message Type, Magic Cookie, Control Message Type and Reserved0
+	r := byteparser.NewReader(buf)
+	if r.ReadUint16() != sccrqLength ||
+		r.ReadUint16() != messageTypeControl ||
+		r.ReadUint32() != magicCookie ||
+		r.ReadUint16() != startControlConnectionRequest ||
+		r.ReadUint16() != 0 {
+		return false, nil
+	}
+
+	// Read the rest of the message
+	if _, err := io.ReadFull(cx, buf[headerLength:]); err != nil {
+		return false, err
+	}
+
+	// Validate Protocol Version, which is followed by Reserved1
+	major, minor := r.ReadUint8(), r.ReadUint8()
+	if major == 0 || r.ReadUint16() != 0 {
+		return false, nil
+	}
+
+	// Skip Framing Capabilities, Bearer Capabilities, Maximum Channels and Firmware Revision
+	r.Skip(12)
+	hostname, vendor := r.ReadBytes(nameLength), r.ReadBytes(nameLength)
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.pptp.version", fmt.Sprintf("%d.%d", major, minor))
+	repl.Set("l4.pptp.hostname", printableName(hostname))
+	repl.Set("l4.pptp.vendor", printableName(vendor))
+	cx.SetProtocol("pptp")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchPPTP from Caddyfile tokens. Syntax:
+//
+//	pptp
+func (m *MatchPPTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// printableName returns b up to the first NUL byte, or an empty string if it contains non-printable characters.
+func printableName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7E {
+			return ""
+		}
+	}
+	return string(b)
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc2637#section-2.1
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchPPTP)(nil)
+	_ layer4.ConnMatcher    = (*MatchPPTP)(nil)
+)
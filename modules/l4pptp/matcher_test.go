@@ -0,0 +1,125 @@
+package l4pptp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// sccrq returns a Start-Control-Connection-Request message with the given protocol version, host name and vendor.
+func sccrq(version uint16, hostname, vendor string) []byte {
+	b := make([]byte, sccrqLength)
+	binary.BigEndian.PutUint16(b[0:2], sccrqLength)
+	binary.BigEndian.PutUint16(b[2:4], messageTypeControl)
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	binary.BigEndian.PutUint16(b[8:10], startControlConnectionRequest)
+	binary.BigEndian.PutUint16(b[12:14], version)
+	binary.BigEndian.PutUint32(b[16:20], 0x00000001) // Framing Capabilities: asynchronous
+	binary.BigEndian.PutUint32(b[20:24], 0x00000001) // Bearer Capabilities: analog
+	binary.BigEndian.PutUint16(b[24:26], 0)          // Maximum Channels
+	binary.BigEndian.PutUint16(b[26:28], 0x0a28)     // Firmware Revision
+	copy(b[28:92], hostname)
+	copy(b[92:156], vendor)
+	return b
+}
+
+func Test_MatchPPTP_Match(t *testing.T) {
+	type test struct {
+		data        []byte
+		shouldMatch bool
+		version     string
+		hostname    string
+		vendor      string
+	}
+
+	valid := sccrq(0x0100, "vpn-client", "Microsoft")
+
+	badMagic := sccrq(0x0100, "", "")
+	badMagic[7] ^= 0xFF
+
+	badLength := sccrq(0x0100, "", "")
+	binary.BigEndian.PutUint16(badLength[0:2], 168)
+
+	badMessageType := sccrq(0x0100, "", "")
+	binary.BigEndian.PutUint16(badMessageType[2:4], 2)
+
+	reply := sccrq(0x0100, "", "")
+	binary.BigEndian.PutUint16(reply[8:10], 2) // Start-Control-Connection-Reply
+
+	badReserved := sccrq(0x0100, "", "")
+	badReserved[14] = 1
+
+	tests := []test{
+		{data: valid, shouldMatch: true, version: "1.0", hostname: "vpn-client", vendor: "Microsoft"},
+		{data: sccrq(0x0100, "", "linux\x01"), shouldMatch: true, version: "1.0"},
+		{data: sccrq(0x0201, "host", ""), shouldMatch: true, version: "2.1", hostname: "host"},
+		{data: append(valid, 0x00, 0x9c, 0x00, 0x01), shouldMatch: true, version: "1.0", hostname: "vpn-client", vendor: "Microsoft"},
+
+		{data: sccrq(0x0000, "", ""), shouldMatch: false},
+		{data: badMagic, shouldMatch: false},
+		{data: badLength, shouldMatch: false},
+		{data: badMessageType, shouldMatch: false},
+		{data: reply, shouldMatch: false},
+		{data: badReserved, shouldMatch: false},
+		{data: valid[:headerLength], shouldMatch: false},
+		{data: valid[:sccrqLength-1], shouldMatch: false},
+		{data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{data: []byte{0x16, 0x03, 0x01, 0x00, 0x9c, 0x01, 0x00, 0x00, 0x98, 0x03, 0x03, 0x00}, shouldMatch: false},
+		{data: []byte{}, shouldMatch: false},
+	}
+
+	for i, tc := range tests {
+		func() {
+			matcher := &MatchPPTP{}
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.data)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.data)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range map[string]string{
+				"l4.pptp.version":  tc.version,
+				"l4.pptp.hostname": tc.hostname,
+				"l4.pptp.vendor":   tc.vendor,
+			} {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
+		}()
+	}
+}
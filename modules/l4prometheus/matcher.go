@@ -0,0 +1,139 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4prometheus allows the L4 multiplexing of Prometheus remote write requests
+package l4prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchRemoteWrite{})
+	layer4.RegisterProtocol("prometheus_remote_write")
+}
+
+// MatchRemoteWrite is able to match Prometheus remote write requests, i.e. HTTP/1.x POST
+// requests to /api/v1/write with snappy-compressed protobuf bodies. If the request has a
+// tenant header, its value is exposed as {l4.prometheus.tenant}.
+type MatchRemoteWrite struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchRemoteWrite) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.prometheus_remote_write",
+		New: func() caddy.Module { return new(MatchRemoteWrite) },
+	}
+}
+
+// Match returns true if the connection looks like a Prometheus remote write request.
+func (m *MatchRemoteWrite) Match(cx *layer4.Connection) (bool, error) {
+	data := cx.MatchingBytes()
+
+	// Reject early if the request line doesn't start with the expected method
+	if !bytes.HasPrefix(data, methodPrefix[:min(len(data), len(methodPrefix))]) {
+		return false, nil
+	}
+
+	// Wait for the whole header section to be prefetched
+	end := headerEnd(data)
+	if end < 0 {
+		if len(data) >= layer4.MaxMatchingBytes {
+			return false, layer4.ErrMatchingBufferFull
+		}
+		return false, layer4.ErrConsumedAllPrefetchedBytes
+	}
+
+	// Parse the header section only, leaving the body alone
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data[:end])))
+	if err != nil {
+		return false, nil
+	}
+
+	if req.Method != http.MethodPost || req.URL.Path != remoteWritePath ||
+		!strings.EqualFold(req.Header.Get("Content-Encoding"), remoteWriteEncoding) {
+		return false, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != remoteWriteContentType {
+		return false, nil
+	}
+
+	if tenant := req.Header.Get(tenantHeader); len(tenant) > 0 {
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		repl.Set("l4.prometheus.tenant", tenant)
+	}
+
+	cx.SetProtocol("prometheus_remote_write")
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchRemoteWrite from Caddyfile tokens. Syntax:
+//
+//	prometheus_remote_write
+func (m *MatchRemoteWrite) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// headerEnd returns the length of the header section including the empty line terminating it,
+// or -1 if the terminator hasn't been found. Bare LF line endings are tolerated as net/http does.
+func headerEnd(data []byte) int {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return i + 4
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		return i + 2
+	}
+	return -1
+}
+
+var methodPrefix = []byte(http.MethodPost + " ")
+
+// Refs:
+//
+//	https://prometheus.io/docs/specs/remote_write_spec/
+//	https://grafana.com/docs/mimir/latest/references/http-api/#remote-write
+const (
+	remoteWritePath        = "/api/v1/write"
+	remoteWriteEncoding    = "snappy"
+	remoteWriteContentType = "application/x-protobuf"
+	tenantHeader           = "X-Scope-OrgID"
+)
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchRemoteWrite)(nil)
+	_ layer4.ConnMatcher    = (*MatchRemoteWrite)(nil)
+)
@@ -0,0 +1,167 @@
+package l4prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// testHandler is a connection handler that will set a variable to let us know it was called.
+type testHandler struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*testHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.test_handler",
+		New: func() caddy.Module { return new(testHandler) },
+	}
+}
+
+// Handle handles the connections.
+func (h *testHandler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	cx.SetVar("test_handler_called", true)
+	return next.Handle(cx)
+}
+
+func init() {
+	caddy.RegisterModule(&testHandler{})
+}
+
+// remoteWriteMatchTester runs data through a route with the remote write matcher
+// and returns whether it matched along with the value of the tenant placeholder.
+func remoteWriteMatchTester(t *testing.T, data []byte) (bool, string) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	go func() {
+		_, err := in.Write(data)
+		assertNoError(t, err)
+	}()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	routes := layer4.RouteList{&layer4.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{
+			{"prometheus_remote_write": json.RawMessage("{}")},
+		},
+		HandlersRaw: []json.RawMessage{json.RawMessage("{\"handler\":\"test_handler\"}")},
+	}}
+	err := routes.Provision(ctx)
+	assertNoError(t, err)
+
+	matched, tenant := false, ""
+	compiledRoute := routes.Compile(zap.NewNop(), 100*time.Millisecond,
+		layer4.HandlerFunc(func(con *layer4.Connection) error {
+			repl := con.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			matched = con.GetVar("test_handler_called") != nil
+			tenant, _ = repl.GetString("l4.prometheus.tenant")
+			return nil
+		}))
+
+	err = compiledRoute.Handle(cx)
+	assertNoError(t, err)
+
+	return matched, tenant
+}
+
+func TestMatchRemoteWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		data        []byte
+		shouldMatch bool
+		tenant      string
+	}{
+		{name: "remote-write", data: remoteWriteRequest, shouldMatch: true},
+		{name: "remote-write-with-tenant", data: remoteWriteRequestWithTenant, shouldMatch: true, tenant: "team-a"},
+		{name: "remote-write-lf-only", data: remoteWriteRequestLFOnly, shouldMatch: true},
+		{name: "remote-write-body-pending", data: remoteWriteRequest[:len(remoteWriteRequest)-len(remoteWriteBody)], shouldMatch: true},
+		{name: "http-get", data: []byte("GET /api/v1/write HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{name: "http-json-post", data: httpJSONRequest, shouldMatch: false},
+		{name: "wrong-path", data: wrongPathRequest, shouldMatch: false},
+		{name: "no-snappy", data: noSnappyRequest, shouldMatch: false},
+		{name: "not-http", data: []byte("\x16\x03\x01\x00\xa5\x01\x00\x00\xa1\x03\x03"), shouldMatch: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			matched, tenant := remoteWriteMatchTester(t, tc.data)
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("matcher did not match")
+				} else {
+					t.Fatalf("matcher should not match")
+				}
+			}
+			if tenant != tc.tenant {
+				t.Fatalf("unexpected tenant: got %q, want %q", tenant, tc.tenant)
+			}
+		})
+	}
+}
+
+// remoteWriteBody is a snappy-compressed protobuf WriteRequest carrying a single sample of up{job="test"}
+var remoteWriteBody = []byte{
+	0x2c, 0x2c, 0x0a, 0x2a, 0x0a, 0x0c, 0x0a, 0x08, 0x5f, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x5f, 0x5f,
+	0x12, 0x02, 0x75, 0x70, 0x0a, 0x0b, 0x0a, 0x03, 0x6a, 0x6f, 0x62, 0x12, 0x04, 0x74, 0x65, 0x73,
+	0x74, 0x12, 0x0d, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f, 0x10, 0xe8, 0x07,
+}
+
+var remoteWriteRequest = append([]byte("POST /api/v1/write HTTP/1.1\r\n"+
+	"Host: localhost:9090\r\n"+
+	"User-Agent: Prometheus/2.53.0\r\n"+
+	"Content-Length: 47\r\n"+
+	"Content-Encoding: snappy\r\n"+
+	"Content-Type: application/x-protobuf\r\n"+
+	"X-Prometheus-Remote-Write-Version: 0.1.0\r\n"+
+	"\r\n"), remoteWriteBody...)
+
+var remoteWriteRequestWithTenant = append([]byte("POST /api/v1/write HTTP/1.1\r\n"+
+	"Host: mimir:8080\r\n"+
+	"Content-Length: 47\r\n"+
+	"Content-Encoding: snappy\r\n"+
+	"Content-Type: application/x-protobuf;proto=prometheus.WriteRequest\r\n"+
+	"X-Scope-OrgID: team-a\r\n"+
+	"\r\n"), remoteWriteBody...)
+
+var remoteWriteRequestLFOnly = append([]byte("POST /api/v1/write HTTP/1.1\n"+
+	"Host: localhost:9090\n"+
+	"Content-Length: 47\n"+
+	"Content-Encoding: snappy\n"+
+	"Content-Type: application/x-protobuf\n"+
+	"\n"), remoteWriteBody...)
+
+var httpJSONRequest = []byte("POST /api/v1/write HTTP/1.1\r\n" +
+	"Host: localhost:9090\r\n" +
+	"Content-Length: 2\r\n" +
+	"Content-Type: application/json\r\n" +
+	"\r\n{}")
+
+var wrongPathRequest = append([]byte("POST /api/v1/push HTTP/1.1\r\n"+
+	"Host: localhost:9090\r\n"+
+	"Content-Length: 47\r\n"+
+	"Content-Encoding: snappy\r\n"+
+	"Content-Type: application/x-protobuf\r\n"+
+	"\r\n"), remoteWriteBody...)
+
+var noSnappyRequest = append([]byte("POST /api/v1/write HTTP/1.1\r\n"+
+	"Host: localhost:9090\r\n"+
+	"Content-Length: 47\r\n"+
+	"Content-Type: application/x-protobuf\r\n"+
+	"\r\n"), remoteWriteBody...)
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"regexp"
 	"runtime/debug"
 	"time"
 
@@ -50,10 +51,50 @@ type ActiveHealthChecks struct {
 	Interval caddy.Duration `json:"interval,omitempty"`
 
 	// How long to wait for a connection to be established with
-	// peer before considering it unhealthy (default 5s).
+	// peer before considering it unhealthy (default 5s). If the
+	// banner is read, it must be received within this timeout too.
 	Timeout caddy.Duration `json:"timeout,omitempty"`
 
-	logger *zap.Logger
+	// If true, the peer is considered unhealthy unless it sends some
+	// bytes after the connection is established, without anything
+	// being sent to it, e.g. for server-first protocols like SMTP or
+	// MySQL, whose servers greet clients with a banner.
+	ReadBanner bool `json:"read_banner,omitempty"`
+
+	// A regular expression the banner sent by the peer must match, e.g.
+	// ^220 for SMTP, for the peer to be considered healthy. The banner
+	// is read until it matches, up to 1 KiB. Implies read_banner.
+	ExpectRegex string `json:"expect_regex,omitempty"`
+
+	logger       *zap.Logger
+	expectRegexp *regexp.Regexp
+}
+
+// maxBannerLength is the maximum number of bytes read from peers sending a banner.
+const maxBannerLength = 1024
+
+// checkBanner reads the banner sent by the peer over conn, and returns an error
+// if none is received before the timeout or if it doesn't match the expected one.
+func (a *ActiveHealthChecks) checkBanner(conn net.Conn) error {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Duration(a.Timeout))); err != nil {
+		return fmt.Errorf("setting read deadline: %v", err)
+	}
+
+	buf := make([]byte, maxBannerLength)
+	var n int
+	for {
+		nn, err := conn.Read(buf[n:])
+		n += nn
+		if n > 0 && (a.expectRegexp == nil || a.expectRegexp.Match(buf[:n])) {
+			return nil
+		}
+		if n == 0 && err != nil {
+			return fmt.Errorf("reading banner: %v", err)
+		}
+		if err != nil || n == len(buf) {
+			return fmt.Errorf("unexpected banner: %q", buf[:n])
+		}
+	}
 }
 
 // PassiveHealthChecks holds configuration related to passive
@@ -66,7 +107,9 @@ type PassiveHealthChecks struct {
 
 	// The number of failed connections within the FailDuration window to
 	// consider a backend as "down". Must be >= 1; default is 1. Requires
-	// that FailDuration be > 0.
+	// that FailDuration be > 0. A backend which is down receives no new
+	// connections until its failures are forgotten, i.e. it's brought
+	// back up at most FailDuration after its last failure.
 	MaxFails int `json:"max_fails,omitempty"`
 
 	// Limits the number of simultaneous connections to a backend by
@@ -141,23 +184,33 @@ func (h *Handler) doActiveHealthCheck(p *peer) error {
 	timeout := time.Duration(h.HealthChecks.Active.Timeout)
 
 	conn, err := net.DialTimeout(addr.Network, hostPort, timeout)
+	if err == nil {
+		// the connection succeeded, but the peer may have to send a banner
+		if h.HealthChecks.Active.ReadBanner || h.HealthChecks.Active.expectRegexp != nil {
+			err = h.HealthChecks.Active.checkBanner(conn)
+		}
+		_ = conn.Close()
+	}
 	if err != nil {
 		h.HealthChecks.Active.logger.Info("host is down",
 			zap.String("address", addr.String()),
 			zap.Duration("timeout", timeout),
 			zap.Error(err))
-		_, err2 := p.setHealthy(false)
+		swapped, err2 := p.setHealthy(false)
 		if err2 != nil {
 			return fmt.Errorf("marking unhealthy: %v (original error: %v)", err2, err)
 		}
+		if swapped {
+			h.reportHealth(p)
+		}
 		return nil
 	}
-	_ = conn.Close()
 
-	// connection succeeded, so mark as healthy
+	// connection succeeded (and banner matched), so mark as healthy
 	swapped, err := p.setHealthy(true)
 	if swapped {
 		h.HealthChecks.Active.logger.Info("host is up", zap.String("address", addr.String()))
+		h.reportHealth(p)
 	}
 	if err != nil {
 		return fmt.Errorf("marking healthy: %v", err)
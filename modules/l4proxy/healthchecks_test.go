@@ -0,0 +1,251 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func TestPassiveHealthChecks(t *testing.T) {
+	const failDuration = 300 * time.Millisecond
+
+	// the live backend accepts and closes connections, while the dead one refuses them
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed | %s", err)
+	}
+	defer func() { _ = live.Close() }()
+	go func() {
+		for {
+			conn, err := live.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed | %s", err)
+	}
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{
+		Upstreams: UpstreamPool{
+			{Dial: []string{deadAddr}},
+			{Dial: []string{live.Addr().String()}},
+		},
+		HealthChecks: &HealthChecks{
+			Passive: &PassiveHealthChecks{FailDuration: caddy.Duration(failDuration), MaxFails: 2},
+		},
+		LoadBalancing: &LoadBalancing{SelectionPolicy: &RoundRobinSelection{}},
+	}
+	if err = h.Provision(ctx); err != nil {
+		t.Fatalf("provisioning failed | %s", err)
+	}
+	defer func() { _ = h.Cleanup() }()
+
+	in, out := net.Pipe()
+	defer func() {
+		_ = in.Close()
+		_ = out.Close()
+	}()
+	down := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	repl := down.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+
+	// dial the selected upstream a few times, returning the number of failures
+	dial := func(times int) (fails int) {
+		for range times {
+			upstream := h.LoadBalancing.SelectionPolicy.Select(h.Upstreams, down)
+			if upstream == nil {
+				t.Fatalf("no upstream selected")
+			}
+			upConns, err := h.dialPeers(upstream, repl, down)
+			if err != nil {
+				fails++
+				continue
+			}
+			for _, conn := range upConns {
+				_ = conn.Close()
+				_ = upstream.peers[0].countConn(-1)
+			}
+		}
+		return fails
+	}
+
+	if value := gatherHealthMetric(t, ctx, deadAddr); value != 1 {
+		t.Fatalf("dead upstream should be reported healthy before any failure, got %v", value)
+	}
+
+	// the dead upstream is ejected after 2 failures, so that it isn't selected anymore
+	if fails := dial(4); fails != 2 {
+		t.Fatalf("unexpected number of failures before ejection | got %d, want 2", fails)
+	}
+	if h.Upstreams[0].available() {
+		t.Fatalf("dead upstream should have been ejected")
+	}
+	if value := gatherHealthMetric(t, ctx, deadAddr); value != 0 {
+		t.Fatalf("dead upstream should be reported unhealthy, got %v", value)
+	}
+	if fails := dial(10); fails != 0 {
+		t.Fatalf("ejected upstream should not be selected | got %d failures", fails)
+	}
+
+	// it's reintroduced once its failures are forgotten
+	time.Sleep(failDuration + 200*time.Millisecond)
+	if !h.Upstreams[0].available() {
+		t.Fatalf("dead upstream should have been reintroduced")
+	}
+	if value := gatherHealthMetric(t, ctx, deadAddr); value != 1 {
+		t.Fatalf("reintroduced upstream should be reported healthy, got %v", value)
+	}
+	if fails := dial(2); fails != 1 {
+		t.Fatalf("reintroduced upstream should be selected again | got %d failures, want 1", fails)
+	}
+}
+
+func TestActiveHealthChecks_Banner(t *testing.T) {
+	// serve starts a backend sending banner to each client, and returns its address
+	serve := func(banner string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listening failed | %s", err)
+		}
+		t.Cleanup(func() { _ = ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = conn.Write([]byte(banner))
+					time.Sleep(500 * time.Millisecond)
+					_ = conn.Close()
+				}()
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	smtp := serve("220 mail.example.com ESMTP Postfix\r\n")
+	// MySQL greeting: 3-byte length, sequence number, protocol version 10, server version
+	mysql := serve("\x4a\x00\x00\x00\x0a8.0.36\x00")
+	silent := serve("")
+	busy := serve("421 mail.example.com Service not available\r\n")
+
+	tests := []struct {
+		active  *ActiveHealthChecks
+		address string
+		healthy bool
+	}{
+		{active: &ActiveHealthChecks{}, address: silent, healthy: true},
+		{active: &ActiveHealthChecks{ReadBanner: true}, address: smtp, healthy: true},
+		{active: &ActiveHealthChecks{ReadBanner: true}, address: silent, healthy: false},
+		{active: &ActiveHealthChecks{ExpectRegex: "^220 "}, address: smtp, healthy: true},
+		{active: &ActiveHealthChecks{ExpectRegex: "^220 "}, address: busy, healthy: false},
+		{active: &ActiveHealthChecks{ExpectRegex: "^220 "}, address: silent, healthy: false},
+		{active: &ActiveHealthChecks{ExpectRegex: "^(?s).{4}\\x0a[0-9]"}, address: mysql, healthy: true},
+		{active: &ActiveHealthChecks{ExpectRegex: "^(?s).{4}\\x0a[0-9]"}, address: smtp, healthy: false},
+	}
+
+	for i, tc := range tests {
+		func() {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			tc.active.Interval = caddy.Duration(time.Hour)
+			tc.active.Timeout = caddy.Duration(200 * time.Millisecond)
+			h := &Handler{
+				Upstreams:    UpstreamPool{{Dial: []string{tc.address}}},
+				HealthChecks: &HealthChecks{Active: tc.active},
+			}
+			if err := h.Provision(ctx); err != nil {
+				t.Fatalf("test %d: provisioning failed | %s", i, err)
+			}
+			defer func() { _ = h.Cleanup() }()
+
+			p := h.Upstreams[0].peers[0]
+			if err := h.doActiveHealthCheck(p); err != nil {
+				t.Fatalf("test %d: health check failed | %s", i, err)
+			}
+			if p.healthy() != tc.healthy {
+				t.Fatalf("test %d: unexpected health | got %t, want %t", i, p.healthy(), tc.healthy)
+			}
+		}()
+	}
+}
+
+func TestHealthMetrics_Disabled(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// the metric is registered by another server, so that it would be gathered if reported
+	initUpstreamMetrics(ctx.GetMetricsRegistry())
+
+	const upstream = "127.0.0.1:65533"
+	s := &layer4.Server{
+		Routes: layer4.RouteList{
+			&layer4.Route{
+				HandlersRaw: []json.RawMessage{
+					json.RawMessage(`{"handler":"proxy","upstreams":[{"dial":["` + upstream + `"]}]}`),
+				},
+			},
+		},
+		DisableMetrics: true,
+	}
+	if err := s.Provision(ctx, zap.NewNop()); err != nil {
+		t.Fatalf("provisioning failed | %s", err)
+	}
+
+	if value := gatherHealthMetric(t, ctx, upstream); value != -1 {
+		t.Fatalf("upstream health is reported despite disabled metrics, got %v", value)
+	}
+}
+
+// gatherHealthMetric returns the value of the upstream health metric of the given upstream from ctx's registry.
+func gatherHealthMetric(t *testing.T, ctx caddy.Context, upstream string) float64 {
+	t.Helper()
+	families, err := ctx.GetMetricsRegistry().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics failed | %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "caddy_layer4_proxy_upstream_healthy" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "upstream" && label.GetValue() == upstream {
+					return metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return -1
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/cespare/xxhash/v2"
 
 	"github.com/mholt/caddy-l4/layer4"
 )
@@ -48,6 +49,13 @@ type LoadBalancing struct {
 	// CPU to spin if all backends are down and latency is very low.
 	TryInterval caddy.Duration `json:"try_interval,omitempty"`
 
+	// How long to ramp up the load of a backend once it has recovered, i.e.
+	// once it has become healthy again after having been marked as down by
+	// health checks. Its share of connections grows linearly from 0 to full
+	// over this window. Only the random and round_robin selection policies
+	// honor it. By default, recovered backends receive their full load at once.
+	SlowStart caddy.Duration `json:"slow_start,omitempty"`
+
 	SelectionPolicy Selector `json:"-"`
 }
 
@@ -80,9 +88,11 @@ func init() {
 	caddy.RegisterModule(&RandomSelection{})
 	caddy.RegisterModule(&RandomChoiceSelection{})
 	caddy.RegisterModule(&LeastConnSelection{})
+	caddy.RegisterModule(&PowerOfTwoChoicesSelection{})
 	caddy.RegisterModule(&RoundRobinSelection{})
 	caddy.RegisterModule(&FirstSelection{})
 	caddy.RegisterModule(&IPHashSelection{})
+	caddy.RegisterModule(&HashSelection{})
 }
 
 // RandomSelection is a policy that selects
@@ -101,20 +111,30 @@ func (*RandomSelection) CaddyModule() caddy.ModuleInfo {
 func (r *RandomSelection) Select(pool UpstreamPool, _ *layer4.Connection) *Upstream {
 	// use reservoir sampling because the number of available
 	// hosts isn't known: https://en.wikipedia.org/wiki/Reservoir_sampling
-	var randomHost *Upstream
-	var count int
+	var randomHost, firstHost *Upstream
+	var totalWeight float64
 	for _, upstream := range pool {
 		if !upstream.available() {
 			continue
 		}
-		// (n % 1 == 0) holds for all n, therefore an
-		// upstream will always be chosen if there is at
-		// least one available
-		count++
-		if (weakrand.Int() % count) == 0 {
+		if firstHost == nil {
+			firstHost = upstream
+		}
+		// hosts are chosen proportionally to their weight, which
+		// is less than 1 only for hosts in slow start
+		weight := upstream.weight()
+		if weight == 0 {
+			continue
+		}
+		totalWeight += weight
+		if weakrand.Float64()*totalWeight < weight {
 			randomHost = upstream
 		}
 	}
+	if randomHost == nil {
+		// all available hosts have just recovered
+		return firstHost
+	}
 	return randomHost
 }
 
@@ -277,6 +297,64 @@ func (r *LeastConnSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// PowerOfTwoChoicesSelection is a policy that samples two
+// distinct available hosts at random and selects the one with
+// the fewer active connections relative to its weight. It
+// spreads the load almost as evenly as least_conn, but doesn't
+// make all the connections pile up on the same least loaded
+// host, e.g. right after it has been added or recovered.
+type PowerOfTwoChoicesSelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*PowerOfTwoChoicesSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.selection_policies.p2c",
+		New: func() caddy.Module { return new(PowerOfTwoChoicesSelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (*PowerOfTwoChoicesSelection) Select(pool UpstreamPool, _ *layer4.Connection) *Upstream {
+	available := make([]*Upstream, 0, len(pool))
+	for _, upstream := range pool {
+		if upstream.available() {
+			available = append(available, upstream)
+		}
+	}
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+
+	i := weakrand.Intn(len(available))
+	j := weakrand.Intn(len(available) - 1)
+	if j >= i {
+		j++
+	}
+	return lessLoaded(available[i], available[j])
+}
+
+// UnmarshalCaddyfile sets up the PowerOfTwoChoicesSelection from Caddyfile tokens. Syntax:
+//
+//	p2c
+func (r *PowerOfTwoChoicesSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s selection policy: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
 // RoundRobinSelection is a policy that selects
 // a host based on round-robin ordering.
 type RoundRobinSelection struct {
@@ -297,14 +375,23 @@ func (r *RoundRobinSelection) Select(pool UpstreamPool, _ *layer4.Connection) *U
 	if n == 0 {
 		return nil
 	}
+	var firstHost *Upstream
 	for range n {
 		atomic.AddUint32(&r.robin, 1)
 		host := pool[r.robin%n]
-		if host.available() {
-			return host
+		if !host.available() {
+			continue
 		}
+		// hosts in slow start only take their turn as often as their weight says
+		if weight := host.weight(); weight < 1 && weakrand.Float64() >= weight {
+			if firstHost == nil {
+				firstHost = host
+			}
+			continue
+		}
+		return host
 	}
-	return nil
+	return firstHost
 }
 
 // UnmarshalCaddyfile sets up the RoundRobinSelection from Caddyfile tokens. Syntax:
@@ -408,6 +495,64 @@ func (r *IPHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// HashSelection is a policy that selects a host based on hashing the value
+// of a placeholder, e.g. {l4.postgres.database}, so that connections with
+// the same value stick to the same host. Hosts are chosen by rendezvous
+// hashing, so adding or removing a host only moves the values it wins or
+// loses. Connections with an empty value are distributed by round-robin.
+type HashSelection struct {
+	// Key is the placeholder or value to hash.
+	Key string `json:"key,omitempty"`
+
+	fallback RoundRobinSelection
+}
+
+// CaddyModule returns the Caddy module information.
+func (*HashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.selection_policies.hash",
+		New: func() caddy.Module { return new(HashSelection) },
+	}
+}
+
+// Validate ensures that r's configuration is valid.
+func (r *HashSelection) Validate() error {
+	if len(r.Key) == 0 {
+		return fmt.Errorf("no key")
+	}
+	return nil
+}
+
+// Select returns an available host, if any.
+func (r *HashSelection) Select(pool UpstreamPool, conn *layer4.Connection) *Upstream {
+	repl := conn.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	key := repl.ReplaceAll(r.Key, "")
+	if len(key) == 0 {
+		return r.fallback.Select(pool, conn)
+	}
+	return hostByRendezvousHashing(pool, key, xxhash.Sum64String)
+}
+
+// UnmarshalCaddyfile sets up the HashSelection from Caddyfile tokens. Syntax:
+//
+//	hash <key>
+func (r *HashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Exactly one same-line option must be provided
+	if d.CountRemainingArgs() != 1 {
+		return d.ArgErr()
+	}
+	_, r.Key = d.NextArg(), d.Val()
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s selection policy: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
 // leastConns returns the upstream with the
 // least number of active connections to it.
 // If more than one upstream has the same
@@ -435,17 +580,44 @@ func leastConns(upstreams []*Upstream) *Upstream {
 	return best[weakrand.Intn(len(best))]
 }
 
+// lessLoaded returns the upstream of a and b with the
+// fewer active connections relative to its weight, so
+// that hosts in slow start are considered more loaded.
+// Hosts with no weight are only returned if both have
+// none. Ties are broken in favor of a.
+func lessLoaded(a, b *Upstream) *Upstream {
+	wa, wb := a.weight(), b.weight()
+	if wa == 0 || wb == 0 {
+		if wa == 0 && wb > 0 {
+			return b
+		}
+		return a
+	}
+	// compare (conns+1)/weight without dividing; one is added,
+	// so that idle hosts are compared by their weight as well
+	if float64(b.totalConns()+1)*wa < float64(a.totalConns()+1)*wb {
+		return b
+	}
+	return a
+}
+
 // hostByHashing returns an available host
 // from pool based on a hashable string s.
 func hostByHashing(pool []*Upstream, s string) *Upstream {
+	return hostByRendezvousHashing(pool, s, func(s string) uint64 { return uint64(hash(s)) })
+}
+
+// hostByRendezvousHashing returns the available host of pool
+// with the highest hash of its address and s, computed by hashFn.
+func hostByRendezvousHashing(pool []*Upstream, s string, hashFn func(string) uint64) *Upstream {
 	// HRW hash (copy from caddy's code)
-	var highestHash uint32
+	var highestHash uint64
 	var upstream *Upstream
 	for _, up := range pool {
 		if !up.available() {
 			continue
 		}
-		h := hash(up.String() + s) // important to hash key and server together
+		h := hashFn(up.String() + s) // important to hash key and server together
 		if h > highestHash {
 			highestHash = h
 			upstream = up
@@ -466,17 +638,22 @@ var (
 	_ Selector = (*RandomSelection)(nil)
 	_ Selector = (*RandomChoiceSelection)(nil)
 	_ Selector = (*LeastConnSelection)(nil)
+	_ Selector = (*PowerOfTwoChoicesSelection)(nil)
 	_ Selector = (*RoundRobinSelection)(nil)
 	_ Selector = (*FirstSelection)(nil)
 	_ Selector = (*IPHashSelection)(nil)
+	_ Selector = (*HashSelection)(nil)
 
 	_ caddy.Validator   = (*RandomChoiceSelection)(nil)
+	_ caddy.Validator   = (*HashSelection)(nil)
 	_ caddy.Provisioner = (*RandomChoiceSelection)(nil)
 
 	_ caddyfile.Unmarshaler = (*RandomSelection)(nil)
 	_ caddyfile.Unmarshaler = (*RandomChoiceSelection)(nil)
 	_ caddyfile.Unmarshaler = (*LeastConnSelection)(nil)
+	_ caddyfile.Unmarshaler = (*PowerOfTwoChoicesSelection)(nil)
 	_ caddyfile.Unmarshaler = (*RoundRobinSelection)(nil)
 	_ caddyfile.Unmarshaler = (*FirstSelection)(nil)
 	_ caddyfile.Unmarshaler = (*IPHashSelection)(nil)
+	_ caddyfile.Unmarshaler = (*HashSelection)(nil)
 )
@@ -19,7 +19,14 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
 )
 
 func TestHostByHashing(t *testing.T) {
@@ -72,3 +79,208 @@ func TestHostByHashing(t *testing.T) {
 		}
 	}
 }
+
+func TestSlowStart(t *testing.T) {
+	const slowStart = 10 * time.Second
+	const selections = 10000
+
+	steady := &Upstream{Dial: []string{"192.168.0.1:8001"}, peers: []*peer{{}}, slowStart: slowStart}
+	recovering := &Upstream{Dial: []string{"192.168.0.2:8001"}, peers: []*peer{{}}, slowStart: slowStart}
+	pool := UpstreamPool{steady, recovering}
+
+	if w := recovering.weight(); w != 1 {
+		t.Fatalf("upstream that never recovered should have full weight, got %f", w)
+	}
+
+	// take the upstream down and bring it back up
+	p := recovering.peers[0]
+	_, _ = p.setHealthy(false)
+	if (&RoundRobinSelection{}).Select(pool, nil) != steady {
+		t.Fatalf("unhealthy upstream should not be selected")
+	}
+	_, _ = p.setHealthy(true)
+	if w := recovering.weight(); w > 0.01 {
+		t.Fatalf("upstream that just recovered should have no weight, got %f", w)
+	}
+
+	for _, policy := range []Selector{&RandomSelection{}, &RoundRobinSelection{}} {
+		prevShare := -1.0
+		for _, elapsed := range []time.Duration{0, slowStart / 4, slowStart / 2, slowStart * 3 / 4, slowStart, 2 * slowStart} {
+			atomic.StoreInt64(&p.recovered, time.Now().Add(-elapsed).UnixNano())
+
+			var count int
+			for range selections {
+				if policy.Select(pool, nil) == recovering {
+					count++
+				}
+			}
+			share := float64(count) / selections
+			t.Logf("[%T] %s after recovery: %.3f", policy, elapsed, share)
+
+			if elapsed == 0 && share > 0.01 {
+				t.Fatalf("[%T] upstream that just recovered got %.3f of connections", policy, share)
+			}
+			if elapsed >= slowStart && (share < 0.45 || share > 0.55) {
+				t.Fatalf("[%T] upstream past slow start got %.3f of connections", policy, share)
+			}
+			if share < prevShare-0.03 {
+				t.Fatalf("[%T] share of upstream in slow start decreased from %.3f to %.3f", policy, prevShare, share)
+			}
+			prevShare = share
+		}
+	}
+
+	// hosts in slow start are still selected if nothing else is available
+	_, _ = steady.peers[0].setHealthy(false)
+	atomic.StoreInt64(&p.recovered, time.Now().UnixNano())
+	for _, policy := range []Selector{&RandomSelection{}, &RoundRobinSelection{}} {
+		if policy.Select(pool, nil) != recovering {
+			t.Fatalf("[%T] upstream in slow start should be selected if it is the only one available", policy)
+		}
+	}
+}
+
+func TestPowerOfTwoChoicesSelection(t *testing.T) {
+	const selections = 10000
+
+	policy := &PowerOfTwoChoicesSelection{}
+	newPool := func(n int) UpstreamPool {
+		pool := make(UpstreamPool, 0, n)
+		for i := range n {
+			pool = append(pool, &Upstream{Dial: []string{fmt.Sprintf("192.168.0.%d:8001", i+1)}, peers: []*peer{{}}})
+		}
+		return pool
+	}
+
+	// the less loaded of the two sampled upstreams is selected
+	pool := newPool(2)
+	_ = pool[0].peers[0].countConn(5)
+	_ = pool[1].peers[0].countConn(1)
+	for range 100 {
+		if policy.Select(pool, nil) != pool[1] {
+			t.Fatalf("less loaded upstream should be selected")
+		}
+	}
+
+	// the most loaded upstream is never selected, since it's always compared with a less loaded one
+	pool = newPool(3)
+	_ = pool[1].peers[0].countConn(5)
+	_ = pool[2].peers[0].countConn(10)
+	counts := make(map[*Upstream]int)
+	for range selections {
+		counts[policy.Select(pool, nil)]++
+	}
+	if counts[pool[2]] > 0 {
+		t.Fatalf("most loaded upstream got %d of %d connections", counts[pool[2]], selections)
+	}
+	if share := float64(counts[pool[0]]) / selections; share < 0.6 || share > 0.73 {
+		t.Fatalf("least loaded upstream got %.3f of connections, expected about 2/3", share)
+	}
+
+	// connections are spread evenly across upstreams
+	pool = newPool(10)
+	for range selections {
+		upstream := policy.Select(pool, nil)
+		_ = upstream.peers[0].countConn(1)
+		// close a random connection from time to time
+		if victim := pool[rand.Intn(len(pool))]; rand.Intn(4) == 0 && victim.totalConns() > 0 {
+			_ = victim.peers[0].countConn(-1)
+		}
+	}
+	least, most := pool[0].totalConns(), pool[0].totalConns()
+	for _, upstream := range pool {
+		least, most = min(least, upstream.totalConns()), max(most, upstream.totalConns())
+	}
+	t.Logf("connections per upstream: %d to %d", least, most)
+	if most-least > 10 {
+		t.Fatalf("connections are spread unevenly: %d to %d per upstream", least, most)
+	}
+
+	// unavailable upstreams are skipped
+	_, _ = pool[0].peers[0].setHealthy(false)
+	for _, upstream := range pool[2:] {
+		_, _ = upstream.peers[0].setHealthy(false)
+	}
+	for range 100 {
+		if policy.Select(pool, nil) != pool[1] {
+			t.Fatalf("only available upstream should be selected")
+		}
+	}
+	_, _ = pool[1].peers[0].setHealthy(false)
+	if upstream := policy.Select(pool, nil); upstream != nil {
+		t.Fatalf("no upstream should be selected if none is available, got %s", upstream)
+	}
+}
+
+func TestHashSelection(t *testing.T) {
+	const keys = 6000
+
+	policy := &HashSelection{Key: "{test.database}"}
+	newPool := func(n int) UpstreamPool {
+		pool := make(UpstreamPool, 0, n)
+		for i := range n {
+			pool = append(pool, &Upstream{Dial: []string{fmt.Sprintf("192.168.0.%d:5432", i+1)}, peers: []*peer{{}}})
+		}
+		return pool
+	}
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	selectFor := func(pool UpstreamPool, database string) *Upstream {
+		repl.Set("test.database", database)
+		return policy.Select(pool, cx)
+	}
+
+	// the same value always selects the same upstream
+	pool := newPool(5)
+	for _, database := range []string{"billing", "orders", "users"} {
+		first := selectFor(pool, database)
+		for range 100 {
+			if selectFor(pool, database) != first {
+				t.Fatalf("database %s should stick to %s", database, first)
+			}
+		}
+	}
+
+	// values are spread evenly across upstreams
+	selected := make(map[string]*Upstream, keys)
+	counts := make(map[*Upstream]int)
+	for i := range keys {
+		database := fmt.Sprintf("db%d", i)
+		selected[database] = selectFor(pool, database)
+		counts[selected[database]]++
+	}
+	for _, upstream := range pool {
+		if share := float64(counts[upstream]) / keys; share < 0.16 || share > 0.24 {
+			t.Fatalf("upstream %s got %.3f of databases, expected about 1/5", upstream, share)
+		}
+	}
+
+	// adding an upstream only moves the values it wins
+	pool = append(pool, newPool(6)[5])
+	var moved int
+	for database, previous := range selected {
+		if upstream := selectFor(pool, database); upstream != previous {
+			if upstream != pool[5] {
+				t.Fatalf("database %s moved from %s to %s instead of the new upstream", database, previous, upstream)
+			}
+			moved++
+		}
+	}
+	if share := float64(moved) / keys; share < 0.13 || share > 0.2 {
+		t.Fatalf("%.3f of databases moved, expected about 1/6", share)
+	}
+
+	// an empty value falls back to round-robin
+	counts = make(map[*Upstream]int)
+	for range 60 {
+		counts[selectFor(pool, "")]++
+	}
+	for _, upstream := range pool {
+		if counts[upstream] != 10 {
+			t.Fatalf("upstream %s got %d of 60 connections without a value, expected 10", upstream, counts[upstream])
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var upstreamMetrics = struct {
+	once    sync.Once
+	healthy *prometheus.GaugeVec
+}{}
+
+func initUpstreamMetrics(registry *prometheus.Registry) {
+	const ns, sub = "caddy", "layer4"
+
+	upstreamMetrics.once.Do(func() {
+		upstreamMetrics.healthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "proxy_upstream_healthy",
+			Help:      "Health status of a proxy upstream peer, i.e. 1 if it can receive connections, 0 if it has been taken down by health checks.",
+		}, []string{"upstream"})
+	})
+
+	// all proxy handlers are provisioned with the same registry,
+	// so duplicate registrations are expected and ignored
+	if err := registry.Register(upstreamMetrics.healthy); err != nil && !errors.Is(err, prometheus.AlreadyRegisteredError{
+		ExistingCollector: upstreamMetrics.healthy,
+		NewCollector:      upstreamMetrics.healthy,
+	}) {
+		panic(err)
+	}
+}
+
+// reportHealth updates the health metric of p according to the health checks of h,
+// unless metrics are disabled for the server h is provisioned in.
+func (h *Handler) reportHealth(p *peer) {
+	if !h.reportsHealth {
+		return
+	}
+	healthy := p.healthy()
+	if h.HealthChecks != nil && h.HealthChecks.Passive != nil && h.HealthChecks.Passive.MaxFails > 0 &&
+		atomic.LoadInt32(&p.fails) >= int32(h.HealthChecks.Passive.MaxFails) { //nolint:gosec // disable G115
+		healthy = false
+	}
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	upstreamMetrics.healthy.WithLabelValues(p.address.String()).Set(value)
+}
+
+// forgetHealth removes the health metric of p, once it's no longer used by any configuration.
+func forgetHealth(p *peer) {
+	if upstreamMetrics.healthy == nil {
+		return
+	}
+	upstreamMetrics.healthy.DeleteLabelValues(p.address.String())
+}
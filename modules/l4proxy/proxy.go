@@ -17,10 +17,12 @@ package l4proxy
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"regexp"
 	"runtime/debug"
 	"strconv"
 	"sync"
@@ -54,11 +56,22 @@ type Handler struct {
 	// Load balancing distributes load/connections between backends.
 	LoadBalancing *LoadBalancing `json:"load_balancing,omitempty"`
 
-	// Specifies the version of the Proxy Protocol header to add, either "v1" or "v2".
+	// Specifies the version of the Proxy Protocol header to add, either "v1" or "v2". The header carries
+	// the client address, i.e. the one received by a preceding proxy_protocol handler, if any. Only v2
+	// supports UDP, and is sent in every datagram to UDP upstreams.
 	// Ref: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
 	ProxyProtocol string `json:"proxy_protocol,omitempty"`
 
+	// How long closing TCP upstream connections blocks while unsent data is being sent (SO_LINGER), rounded up
+	// to whole seconds. Zero makes closing discard unsent data and reset connections. Default: OS default.
+	Linger *caddy.Duration `json:"linger,omitempty"`
+
+	// How long closing TCP upstream connections waits for upstreams to close them too, after the writing side
+	// has been shut down, so that data in flight isn't truncated by connection resets. Default: 0s.
+	CloseGrace caddy.Duration `json:"close_grace,omitempty"`
+
 	proxyProtocolVersion uint8
+	reportsHealth        bool
 
 	ctx    caddy.Context
 	logger *zap.Logger
@@ -126,11 +139,29 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 			if h.HealthChecks.Active.Interval == 0 {
 				h.HealthChecks.Active.Interval = caddy.Duration(30 * time.Second)
 			}
+			if h.HealthChecks.Active.ExpectRegex != "" {
+				re, err := regexp.Compile(h.HealthChecks.Active.ExpectRegex)
+				if err != nil {
+					return fmt.Errorf("compiling health check expect_regex: %v", err)
+				}
+				h.HealthChecks.Active.expectRegexp = re
+			}
 
 			go h.activeHealthChecker()
 		}
 	}
 
+	// report the initial health of the upstreams
+	if registry := layer4.MetricsRegistryFromContext(ctx); registry != nil {
+		initUpstreamMetrics(registry)
+		h.reportsHealth = true
+		for _, ups := range h.Upstreams {
+			for _, p := range ups.peers {
+				h.reportHealth(p)
+			}
+		}
+	}
+
 	// set up load balancing; it must not be nil, even if there's just one backend
 	if h.LoadBalancing == nil {
 		h.LoadBalancing = new(LoadBalancing)
@@ -187,7 +218,7 @@ func (h *Handler) Handle(down *layer4.Connection, _ layer4.Handler) error {
 	// make sure upstream connections all get closed
 	defer func() {
 		for _, conn := range upConns {
-			_ = conn.Close()
+			_ = layer4.CloseConn(conn, (*time.Duration)(h.Linger), time.Duration(h.CloseGrace))
 		}
 	}()
 
@@ -227,6 +258,12 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 
 		if upstream.TLS == nil {
 			up, err = net.Dial(p.address.Network, hostPort)
+		} else if upstream.startTLS != nil {
+			// the connection starts in plaintext and is upgraded to TLS in-band
+			up, err = net.Dial(p.address.Network, hostPort)
+			if err == nil {
+				up, err = upstream.upgradeTLS(up, hostPort)
+			}
 		} else {
 			// the prepared config could be nil if user enabled but did not customize TLS,
 			// in which case we adopt the downstream client's TLS ClientHello for ours;
@@ -247,18 +284,7 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 
 		// Send the PROXY protocol header.
 		if err == nil {
-			downConn := l4proxyprotocol.GetConn(down)
-			var header io.WriterTo
-			switch h.proxyProtocolVersion {
-			case 1:
-				var h proxyprotocol.HeaderV1
-				h.FromConn(downConn, false)
-				header = h
-			case 2:
-				var h proxyprotocol.HeaderV2
-				h.FromConn(downConn, false)
-				header = h
-			}
+			header := proxyProtocolHeader(h.proxyProtocolVersion, l4proxyprotocol.GetConn(down))
 
 			// Only write the PROXY protocol header if it's not nil
 			if header != nil {
@@ -266,19 +292,6 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 				// unix connections always implement this interface while not necessarily in datagram mode
 				// ignore it unless the unix socket is in datagram mode
 				if _, ok := up.(net.PacketConn); ok && (!caddy.IsUnixNetwork(p.address.Network) || p.address.Network == "unixgram") {
-					// only v2 supports UDP addresses
-					if v2, ok := header.(proxyprotocol.HeaderV2); ok {
-						la, _ := v2.Dest.(*net.UDPAddr)
-						ra, _ := v2.Src.(*net.UDPAddr)
-						// for UDP, local address maybe net.IPv6zero or net.IPv4zero if listener address is not specified
-						if la != nil && ra != nil && la.IP.IsUnspecified() {
-							// TODO: extract real local address using golang.org/x/net
-							la = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: la.Port, Zone: la.Zone}
-							v2.Dest = la
-							// header is not updated automatically, a value not a pointer
-							header = v2
-						}
-					}
 					up = &packetProxyProtocolConn{
 						Conn:   up,
 						header: header,
@@ -311,6 +324,36 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 	return upConns, nil
 }
 
+// proxyProtocolHeader returns the PROXY protocol header of the given version carrying the remote
+// (source) and local (destination) addresses of conn, or nil if no PROXY protocol header is to be sent.
+// Addresses which can't be represented, e.g. of mismatched families, make v1 headers UNKNOWN and v2
+// headers UNSPEC, so that upstreams use the addresses of the connection itself. UDP addresses are
+// only supported by v2.
+func proxyProtocolHeader(version uint8, conn net.Conn) io.WriterTo {
+	switch version {
+	case 1:
+		var h proxyprotocol.HeaderV1
+		h.FromConn(conn, false)
+		return h
+	case 2:
+		var h proxyprotocol.HeaderV2
+		h.FromConn(conn, false)
+		la, _ := h.Dest.(*net.UDPAddr)
+		ra, _ := h.Src.(*net.UDPAddr)
+		// for UDP, local address maybe net.IPv6zero or net.IPv4zero if listener address is not specified
+		if la != nil && ra != nil && la.IP.IsUnspecified() {
+			// TODO: extract real local address using golang.org/x/net
+			ip := net.IPv6loopback
+			if ra.IP.To4() != nil {
+				ip = net.IP{127, 0, 0, 1}
+			}
+			h.Dest = &net.UDPAddr{IP: ip, Port: la.Port, Zone: la.Zone}
+		}
+		return h
+	}
+	return nil
+}
+
 // proxy proxies the downstream connection to all upstream connections.
 func (h *Handler) proxy(down *layer4.Connection, upConns []net.Conn) {
 	// every time we read from downstream, we write
@@ -350,7 +393,7 @@ func (h *Handler) proxy(down *layer4.Connection, upConns []net.Conn) {
 	go func() {
 		// read from downstream until connection is closed;
 		// TODO: this pumps the reader, but writing into discard is a weird way to do it; could be avoided if we used io.Pipe - see _gitignore/oldtee.go.txt
-		_, _ = io.Copy(io.Discard, downTee)
+		_, err := io.Copy(io.Discard, downTee)
 		downConnClosedCh <- struct{}{}
 
 		// Shut down the writing side of all upstream connections, in case
@@ -360,10 +403,13 @@ func (h *Handler) proxy(down *layer4.Connection, upConns []net.Conn) {
 		// to ensure io.Copy() in the per-upstream goroutines (above) returns,
 		// we need to close the socket.  This will cause io.Copy() return an
 		// error, which in this particular case is expected, so we signal the
-		// intentional closure by setting this flag.
+		// intentional closure by setting this flag. The upstream connections
+		// are closed as well if Caddy is exiting, so that we don't wait for
+		// the upstreams to close them.
 		downClosed.Store(true)
+		shuttingDown := errors.Is(err, layer4.ErrShuttingDown)
 		for _, up := range upConns {
-			if conn, ok := up.(closeWriter); ok {
+			if conn, ok := up.(closeWriter); ok && !shuttingDown {
 				_ = conn.CloseWrite()
 			} else {
 				_ = up.Close()
@@ -400,7 +446,7 @@ func (h *Handler) countFailure(p *peer) {
 	}
 
 	// count failure immediately
-	err := p.countFail(1)
+	fails, err := p.countFail(1)
 	if err != nil {
 		h.HealthChecks.Passive.logger.Error("could not count failure",
 			zap.String("peer_address", p.address.String()),
@@ -408,6 +454,16 @@ func (h *Handler) countFailure(p *peer) {
 		return
 	}
 
+	// the peer is ejected once it reaches max fails;
+	// only the goroutine making this transition observes it
+	if fails == int32(h.HealthChecks.Passive.MaxFails) { //nolint:gosec // disable G115
+		h.HealthChecks.Passive.logger.Info("host is down",
+			zap.String("address", p.address.String()),
+			zap.Int("max_fails", h.HealthChecks.Passive.MaxFails),
+			zap.Duration("fail_duration", failDuration))
+		h.reportHealth(p)
+	}
+
 	// forget it later
 	go func(failDuration time.Duration) {
 		defer func() {
@@ -416,11 +472,19 @@ func (h *Handler) countFailure(p *peer) {
 			}
 		}()
 		time.Sleep(failDuration)
-		err := p.countFail(-1)
+		fails, err := p.countFail(-1)
 		if err != nil {
 			h.HealthChecks.Passive.logger.Error("could not forget failure",
 				zap.String("peer_address", p.address.String()),
 				zap.Error(err))
+			return
+		}
+		// the peer is healthy again once it falls below max fails;
+		// only the goroutine making this transition observes it
+		if fails == int32(h.HealthChecks.Passive.MaxFails-1) { //nolint:gosec // disable G115
+			p.setRecovered()
+			h.HealthChecks.Passive.logger.Info("host is up", zap.String("address", p.address.String()))
+			h.reportHealth(p)
 		}
 	}(failDuration)
 }
@@ -429,8 +493,11 @@ func (h *Handler) countFailure(p *peer) {
 func (h *Handler) Cleanup() error {
 	// remove hosts from our config from the pool
 	for _, upstream := range h.Upstreams {
-		for _, dialAddr := range upstream.Dial {
-			_, _ = peers.Delete(dialAddr)
+		for i, dialAddr := range upstream.Dial {
+			deleted, _ := peers.Delete(dialAddr)
+			if deleted && i < len(upstream.peers) {
+				forgetHealth(upstream.peers[i])
+			}
 		}
 	}
 	return nil
@@ -443,19 +510,28 @@ func (h *Handler) Cleanup() error {
 //		health_interval <duration>
 //		health_port <int>
 //		health_timeout <duration>
+//		health_read_banner
+//		health_expect_regex <pattern>
 //
 //		# passive health check options
 //		fail_duration <duration>
 //		max_fails <int>
+//		health_passive_duration <duration> # alias of fail_duration
+//		health_fails <int>                 # alias of max_fails
 //		unhealthy_connection_count <int>
 //
 //		# load balancing options
 //		lb_policy <name> [<args...>]
 //		lb_try_duration <duration>
 //		lb_try_interval <duration>
+//		slow_start <duration>
 //
 //		proxy_protocol <v1|v2>
 //
+//		# connection close options
+//		linger <duration>
+//		close_grace <duration>
+//
 //		# multiple upstream options are supported
 //		upstream [<args...>] {
 //			...
@@ -472,9 +548,11 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	var (
 		hasHealthInterval, hasHealthPort, hasHealthTimeout  bool // active health check options
+		hasHealthReadBanner, hasHealthExpectRegex           bool
 		hasFailDuration, hasMaxFails, hasUnhealthyConnCount bool // passive health check options
 		hasLBPolicy, hasLBTryDuration, hasLBTryInterval     bool // load balancing options
-		hasProxyProtocol                                    bool
+		hasSlowStart, hasProxyProtocol                      bool
+		hasLinger, hasCloseGrace                            bool
 	)
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		optionName := d.Val()
@@ -533,7 +611,37 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				h.HealthChecks.Active = &ActiveHealthChecks{}
 			}
 			h.HealthChecks.Active.Timeout, hasHealthTimeout = caddy.Duration(dur), true
-		case "fail_duration":
+		case "health_read_banner":
+			if hasHealthReadBanner {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			if h.HealthChecks == nil {
+				h.HealthChecks = &HealthChecks{Active: &ActiveHealthChecks{}}
+			} else if h.HealthChecks.Active == nil {
+				h.HealthChecks.Active = &ActiveHealthChecks{}
+			}
+			h.HealthChecks.Active.ReadBanner, hasHealthReadBanner = true, true
+		case "health_expect_regex":
+			if hasHealthExpectRegex {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			if _, err := regexp.Compile(d.Val()); err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			if h.HealthChecks == nil {
+				h.HealthChecks = &HealthChecks{Active: &ActiveHealthChecks{}}
+			} else if h.HealthChecks.Active == nil {
+				h.HealthChecks.Active = &ActiveHealthChecks{}
+			}
+			h.HealthChecks.Active.ExpectRegex, hasHealthExpectRegex = d.Val(), true
+		case "fail_duration", "health_passive_duration":
 			if hasFailDuration {
 				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
 			}
@@ -551,7 +659,7 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				h.HealthChecks.Passive = &PassiveHealthChecks{}
 			}
 			h.HealthChecks.Passive.FailDuration, hasFailDuration = caddy.Duration(dur), true
-		case "max_fails":
+		case "max_fails", "health_fails":
 			if hasMaxFails {
 				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
 			}
@@ -646,11 +754,53 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				h.LoadBalancing = &LoadBalancing{}
 			}
 			h.LoadBalancing.TryInterval, hasLBTryInterval = caddy.Duration(dur), true
+		case "slow_start":
+			if hasSlowStart {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			if h.LoadBalancing == nil {
+				h.LoadBalancing = &LoadBalancing{}
+			}
+			h.LoadBalancing.SlowStart, hasSlowStart = caddy.Duration(dur), true
 		case "proxy_protocol":
 			if hasProxyProtocol {
 				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
 			}
 			_, h.ProxyProtocol, hasProxyProtocol = d.NextArg(), d.Val(), true
+		case "linger":
+			if hasLinger {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.Linger, hasLinger = (*caddy.Duration)(&dur), true
+		case "close_grace":
+			if hasCloseGrace {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.CloseGrace, hasCloseGrace = caddy.Duration(dur), true
 		case "upstream":
 			u := &Upstream{}
 			if err := u.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
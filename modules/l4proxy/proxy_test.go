@@ -0,0 +1,237 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// addrConn is a connection with the given addresses.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestProxyProtocolHeader(t *testing.T) {
+	const sigV2 = "\r\n\r\n\x00\r\nQUIT\n"
+
+	tcp4Remote := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000}
+	tcp4Local := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432}
+	tcp6Remote := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 50000}
+	tcp6Local := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5432}
+	udp4Remote := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000}
+	udp6Remote := &net.UDPAddr{IP: net.ParseIP("2001:db8::10"), Port: 50000}
+
+	tests := []struct {
+		name    string
+		version uint8
+		remote  net.Addr
+		local   net.Addr
+		want    string
+	}{
+		{name: "v1 IPv4", version: 1, remote: tcp4Remote, local: tcp4Local,
+			want: "PROXY TCP4 192.168.1.10 10.0.0.1 50000 5432\r\n"},
+		{name: "v1 IPv6", version: 1, remote: tcp6Remote, local: tcp6Local,
+			want: "PROXY TCP6 2001:db8::10 2001:db8::1 50000 5432\r\n"},
+		{name: "v1 mismatched families", version: 1, remote: tcp4Remote, local: tcp6Local,
+			want: "PROXY UNKNOWN\r\n"},
+		{name: "v1 unix", version: 1, remote: &net.UnixAddr{Name: "@", Net: "unix"}, local: &net.UnixAddr{Name: "/run/l4.sock", Net: "unix"},
+			want: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UDP", version: 1, remote: udp4Remote, local: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53},
+			want: "PROXY UNKNOWN\r\n"},
+
+		{name: "v2 IPv4", version: 2, remote: tcp4Remote, local: tcp4Local,
+			want: sigV2 + "\x21\x11\x00\x0c" + "\xc0\xa8\x01\x0a" + "\x0a\x00\x00\x01" + "\xc3\x50" + "\x15\x38"},
+		{name: "v2 IPv6", version: 2, remote: tcp6Remote, local: tcp6Local,
+			want: sigV2 + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x10" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xc3\x50" + "\x15\x38"},
+		{name: "v2 UDP IPv4", version: 2, remote: udp4Remote, local: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53},
+			want: sigV2 + "\x21\x12\x00\x0c" + "\xc0\xa8\x01\x0a" + "\x0a\x00\x00\x01" + "\xc3\x50" + "\x00\x35"},
+		{name: "v2 UDP IPv4 unspecified local", version: 2, remote: udp4Remote, local: &net.UDPAddr{IP: net.IPv4zero, Port: 53},
+			want: sigV2 + "\x21\x12\x00\x0c" + "\xc0\xa8\x01\x0a" + "\x7f\x00\x00\x01" + "\xc3\x50" + "\x00\x35"},
+		{name: "v2 UDP IPv6 unspecified local", version: 2, remote: udp6Remote, local: &net.UDPAddr{IP: net.IPv6zero, Port: 53},
+			want: sigV2 + "\x21\x22\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x10" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xc3\x50" + "\x00\x35"},
+		{name: "v2 mismatched families", version: 2, remote: tcp4Remote, local: tcp6Local,
+			want: sigV2 + "\x21\x00\x00\x00"},
+		{name: "v2 unknown", version: 2, remote: pipeAddr{}, local: pipeAddr{},
+			want: sigV2 + "\x21\x00\x00\x00"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := proxyProtocolHeader(tc.version, addrConn{local: tc.local, remote: tc.remote})
+			if header == nil {
+				t.Fatalf("no header returned")
+			}
+			var buf bytes.Buffer
+			if _, err := header.WriteTo(&buf); err != nil {
+				t.Fatalf("writing header failed | %s", err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Fatalf("unexpected header | got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if header := proxyProtocolHeader(0, addrConn{local: tcp4Local, remote: tcp4Remote}); header != nil {
+		t.Fatalf("no header should be returned without a version")
+	}
+}
+
+// pipeAddr is an address of neither TCP, UDP nor unix sockets.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// shuttingDownConn is a connection whose reads fail as if Caddy was exiting.
+type shuttingDownConn struct {
+	net.Conn
+}
+
+func (c shuttingDownConn) Read([]byte) (int, error) { return 0, layer4.ErrShuttingDown }
+
+func TestProxy_ShuttingDown(t *testing.T) {
+	// an upstream which never closes the connection, nor sends anything
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-accepted:
+			_ = conn.Close()
+		default:
+		}
+	}()
+
+	up, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = up.Close() }()
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	down := layer4.WrapConnection(shuttingDownConn{Conn: out}, []byte{}, zap.NewNop())
+
+	h := &Handler{logger: zap.NewNop()}
+	done := make(chan struct{})
+	go func() {
+		h.proxy(down, []net.Conn{up})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("proxying isn't aborted on shutdown")
+	}
+}
+
+func TestProxy_UDPSession(t *testing.T) {
+	// an upstream replying to each datagram with the datagram itself, prefixed by its source address
+	up, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = up.Close() }()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := up.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = up.WriteTo([]byte(addr.String()+" "+string(buf[:n])), addr)
+		}
+	}()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{Upstreams: UpstreamPool{&Upstream{Dial: []string{"udp/" + up.LocalAddr().String()}}}}
+	if err = h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// every downstream connection stands for the UDP session of a client, and each write for a datagram
+	session := func() net.Conn {
+		in, out := net.Pipe()
+		down := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+		go func() {
+			_ = h.Handle(down, nil)
+			_ = out.Close()
+		}()
+		t.Cleanup(func() { _ = in.Close() })
+		return in
+	}
+	exchange := func(client net.Conn, datagram string) (source string) {
+		t.Helper()
+		if _, err := client.Write([]byte(datagram)); err != nil {
+			t.Fatalf("failed to write | %s", err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("failed to read reply to %q | %s", datagram, err)
+		}
+		source, payload, _ := strings.Cut(string(buf[:n]), " ")
+		if payload != datagram {
+			t.Fatalf("reply routed to the wrong client | got %q, want %q", payload, datagram)
+		}
+		return source
+	}
+
+	// the datagrams of a session reuse the same upstream socket, and the replies are routed back to its client
+	a, b := session(), session()
+	a1 := exchange(a, "a1")
+	b1 := exchange(b, "b1")
+	a2 := exchange(a, "a2")
+	b2 := exchange(b, "b2")
+	if a1 != a2 || b1 != b2 {
+		t.Fatalf("datagrams of a session sent from different upstream sockets | %s %s, %s %s", a1, a2, b1, b2)
+	}
+	if a1 == b1 {
+		t.Fatalf("datagrams of different sessions sent from the same upstream socket | %s", a1)
+	}
+}
@@ -15,11 +15,15 @@
 package l4proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -33,6 +37,13 @@ import (
 // UpstreamPool is a collection of upstreams.
 type UpstreamPool []*Upstream
 
+// StartTLSNegotiator asks an upstream to start TLS by means of a protocol's in-band negotiation.
+type StartTLSNegotiator interface {
+	// NegotiateStartTLS performs the negotiation over conn, and returns true if the upstream
+	// is willing to perform a TLS handshake, and false if it wants to continue in plaintext.
+	NegotiateStartTLS(conn net.Conn) (bool, error)
+}
+
 // Upstream represents a proxy upstream.
 type Upstream struct {
 	// The network addresses to dial. Supports placeholders, but not port
@@ -42,13 +53,26 @@ type Upstream struct {
 	// Set this field to enable TLS to the upstream.
 	TLS *reverseproxy.TLSConfig `json:"tls,omitempty"`
 
+	// Set this field to upgrade the connection to the upstream to TLS by
+	// means of a protocol's in-band negotiation, instead of starting with
+	// a TLS handshake, so that plaintext clients can be bridged to TLS-only
+	// servers. Requires TLS to be set. The negotiation is performed by the
+	// module of the protocol, e.g. `postgres` sends an SSLRequest.
+	StartTLSRaw json.RawMessage `json:"starttls,omitempty" caddy:"namespace=layer4.proxy.starttls inline_key=protocol"`
+
+	// If true, the connection to the upstream continues in plaintext if the
+	// upstream refuses to start TLS. By default, such a connection fails.
+	StartTLSFallback bool `json:"starttls_fallback,omitempty"`
+
 	// How many connections this upstream is allowed to
 	// have before being marked as unhealthy (if > 0).
 	MaxConnections int `json:"max_connections,omitempty"`
 
 	peers             []*peer
 	tlsConfig         *tls.Config
+	startTLS          StartTLSNegotiator
 	healthCheckPolicy *PassiveHealthChecks
+	slowStart         time.Duration
 }
 
 func (u *Upstream) String() string {
@@ -90,6 +114,20 @@ func (u *Upstream) provision(ctx caddy.Context, h *Handler) error {
 		}
 	}
 
+	// set up STARTTLS
+	if u.StartTLSRaw != nil {
+		if u.TLS == nil {
+			return fmt.Errorf("starttls requires tls to be enabled")
+		}
+		mod, err := ctx.LoadModule(u, "StartTLSRaw")
+		if err != nil {
+			return fmt.Errorf("loading starttls module: %v", err)
+		}
+		u.startTLS = mod.(StartTLSNegotiator)
+	} else if u.StartTLSFallback {
+		return fmt.Errorf("starttls_fallback requires starttls to be set")
+	}
+
 	// if the passive health checker has a non-zero UnhealthyConnectionCount
 	// but the upstream has no MaxConnections set (they are the same thing,
 	// but the passive health checker is a default value for upstreams
@@ -111,6 +149,12 @@ func (u *Upstream) provision(ctx caddy.Context, h *Handler) error {
 		u.healthCheckPolicy = h.HealthChecks.Passive
 	}
 
+	// the same goes for the slow start window, which
+	// selection policies consult through weight
+	if h.LoadBalancing != nil {
+		u.slowStart = time.Duration(h.LoadBalancing.SlowStart)
+	}
+
 	return nil
 }
 
@@ -156,6 +200,26 @@ func (u *Upstream) full() bool {
 	return false
 }
 
+// weight returns the share of its full load the upstream should
+// receive, from 0 right after any of its peers has recovered to 1
+// once the slow start window has passed since. Without slow start,
+// it is always 1.
+func (u *Upstream) weight() float64 {
+	if u.slowStart <= 0 {
+		return 1
+	}
+	weight := 1.0
+	now := time.Now().UnixNano()
+	for _, p := range u.peers {
+		recovered := atomic.LoadInt64(&p.recovered)
+		if recovered == 0 {
+			continue
+		}
+		weight = min(weight, float64(now-recovered)/float64(u.slowStart))
+	}
+	return max(weight, 0)
+}
+
 // totalConns returns the total number of active connections
 // to this upstream (across all peers).
 func (u *Upstream) totalConns() int {
@@ -166,12 +230,55 @@ func (u *Upstream) totalConns() int {
 	return totalConns
 }
 
+// upgradeTLS upgrades up to TLS by means of u's STARTTLS module. If the upstream refuses to start
+// TLS, up is returned as is if u.StartTLSFallback is true. On error, up is closed.
+func (u *Upstream) upgradeTLS(up net.Conn, hostPort string) (net.Conn, error) {
+	ok, err := u.startTLS.NegotiateStartTLS(up)
+	if err == nil && !ok {
+		if u.StartTLSFallback {
+			return up, nil
+		}
+		err = fmt.Errorf("upstream refused to start TLS")
+	}
+	if err != nil {
+		_ = up.Close()
+		return nil, fmt.Errorf("starttls: %v", err)
+	}
+
+	// the prepared config could be nil if user enabled but did not customize TLS;
+	// unlike tls.Dial, tls.Client doesn't infer the server name from the address
+	tlsCfg := new(tls.Config)
+	if u.tlsConfig != nil {
+		tlsCfg = u.tlsConfig.Clone()
+	}
+	if len(tlsCfg.ServerName) == 0 {
+		tlsCfg.ServerName, _, _ = net.SplitHostPort(hostPort)
+	}
+
+	ctx := context.Background()
+	if u.TLS.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(u.TLS.HandshakeTimeout))
+		defer cancel()
+	}
+
+	tlsConn := tls.Client(up, tlsCfg)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = up.Close()
+		return nil, fmt.Errorf("starttls: TLS handshake: %v", err)
+	}
+	return tlsConn, nil
+}
+
 // UnmarshalCaddyfile sets up the Upstream from Caddyfile tokens. Syntax:
 //
 //	upstream [<address:port>] {
 //		dial <address:port> [<address:port>]
 //		max_connections <int>
 //
+//		starttls <protocol> [<args...>]
+//		starttls_fallback
+//
 //		tls
 //		tls_client_auth <automate_name> | <cert_file> <key_file>
 //		tls_curves <curves...>
@@ -191,6 +298,7 @@ func (u *Upstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	var (
 		hasMaxConnections, hasTLS               bool
+		hasStartTLS, hasStartTLSFallback        bool
 		hasTLSTrustPool, hasTLSClientAuth       bool
 		hasTLSInsecureSkipVerify, hasTLSTimeout bool
 		hasTLSRenegotiation, hasTLSServerName   bool
@@ -216,6 +324,39 @@ func (u *Upstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
 			}
 			u.MaxConnections, hasMaxConnections = int(val), true
+		case "starttls":
+			if hasStartTLS {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			protocol := d.Val()
+
+			unm, err := caddyfile.UnmarshalModule(d, "layer4.proxy.starttls."+protocol)
+			if err != nil {
+				return err
+			}
+			if _, ok := unm.(StartTLSNegotiator); !ok {
+				return d.Errf("starttls module '%s' is not a STARTTLS negotiator", protocol)
+			}
+
+			u.StartTLSRaw, err = layer4.SetModuleNameInline("protocol", protocol, caddyconfig.JSON(unm, nil))
+			if err != nil {
+				return d.Errf("re-encoding module '%s' configuration: %v", protocol, err)
+			}
+			hasStartTLS = true
+			if u.TLS == nil {
+				u.TLS = &reverseproxy.TLSConfig{}
+			}
+		case "starttls_fallback":
+			if hasStartTLSFallback {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			u.StartTLSFallback, hasStartTLSFallback = true, true
 		case "tls":
 			if hasTLS {
 				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
@@ -367,6 +508,7 @@ type peer struct {
 	numConns  int32
 	unhealthy int32
 	fails     int32
+	recovered int64 // unix nano time of the last transition to healthy
 	address   caddy.NetworkAddress
 }
 
@@ -391,13 +533,14 @@ func (p *peer) countConn(delta int32) error {
 }
 
 // countFail mutates the recent failures count by
-// delta. It returns an error if the adjustment fails.
-func (p *peer) countFail(delta int32) error {
+// delta. It returns the new count, or an error if
+// the adjustment fails.
+func (p *peer) countFail(delta int32) (int32, error) {
 	result := atomic.AddInt32(&p.fails, delta)
 	if result < 0 {
-		return fmt.Errorf("count below 0: %d", result)
+		return result, fmt.Errorf("count below 0: %d", result)
 	}
-	return nil
+	return result, nil
 }
 
 // setHealthy sets the upstream has healthy or unhealthy
@@ -408,8 +551,16 @@ func (p *peer) setHealthy(healthy bool) (bool, error) {
 		unhealthy, compare = 0, 1
 	}
 	swapped := atomic.CompareAndSwapInt32(&p.unhealthy, compare, unhealthy)
+	if swapped && healthy {
+		p.setRecovered()
+	}
 	return swapped, nil
 }
 
+// setRecovered remembers that the peer has just become healthy again.
+func (p *peer) setRecovered() {
+	atomic.StoreInt64(&p.recovered, time.Now().UnixNano())
+}
+
 // Interface guard
 var _ caddyfile.Unmarshaler = (*Upstream)(nil)
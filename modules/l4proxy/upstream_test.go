@@ -0,0 +1,191 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// selfSignedCertificate returns a certificate for the given host name.
+func selfSignedCertificate(t *testing.T, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testStartTLS is a STARTTLS negotiator that sends a STARTTLS line and expects a reply of one byte,
+// 'S' if the upstream is willing to start TLS, or 'N' if it isn't.
+type testStartTLS struct{}
+
+// NegotiateStartTLS performs the negotiation over conn.
+func (*testStartTLS) NegotiateStartTLS(conn net.Conn) (bool, error) {
+	if _, err := conn.Write([]byte("STARTTLS\n")); err != nil {
+		return false, err
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return false, err
+	}
+	switch reply[0] {
+	case 'S':
+		return true, nil
+	case 'N':
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected reply: 0x%02x", reply[0])
+	}
+}
+
+// fakeStartTLSBackend reads a STARTTLS line from conn, replies with reply and, if it's 'S', performs
+// a TLS handshake. It then reads a message of the given length and returns it through received.
+func fakeStartTLSBackend(conn net.Conn, reply byte, cert tls.Certificate, messageLen int, received chan<- []byte) {
+	defer func() { _ = conn.Close() }()
+	var r io.Reader = conn
+
+	request := make([]byte, len("STARTTLS\n"))
+	if _, err := io.ReadFull(conn, request); err != nil || string(request) != "STARTTLS\n" {
+		received <- nil
+		return
+	}
+	if _, err := conn.Write([]byte{reply}); err != nil {
+		received <- nil
+		return
+	}
+
+	if reply == 'S' {
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := tlsConn.Handshake(); err != nil {
+			received <- nil
+			return
+		}
+		r = tlsConn
+	}
+
+	message := make([]byte, messageLen)
+	if _, err := io.ReadFull(r, message); err != nil {
+		received <- nil
+		return
+	}
+	received <- message
+}
+
+func TestUpstream_StartTLS(t *testing.T) {
+	cert := selfSignedCertificate(t, "db.example.com")
+	roots := x509.NewCertPool()
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots.AddCert(leaf)
+
+	message := []byte("HELLO\n")
+
+	tests := []struct {
+		name      string
+		reply     byte
+		fallback  bool
+		wantErr   bool
+		wantTLS   bool
+		wantBytes []byte
+	}{
+		{name: "S", reply: 'S', wantTLS: true, wantBytes: message},
+		{name: "S, Fallback", reply: 'S', fallback: true, wantTLS: true, wantBytes: message},
+		{name: "N", reply: 'N', wantErr: true},
+		{name: "N, Fallback", reply: 'N', fallback: true, wantBytes: message},
+		{name: "Unexpected Reply", reply: 'E', fallback: true, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &Upstream{
+				StartTLSFallback: tc.fallback,
+				TLS:              &reverseproxy.TLSConfig{},
+				tlsConfig:        &tls.Config{RootCAs: roots},
+				startTLS:         &testStartTLS{},
+			}
+
+			client, server := net.Pipe()
+			received := make(chan []byte, 1)
+			go fakeStartTLSBackend(server, tc.reply, cert, len(message), received)
+
+			up, err := u.upgradeTLS(client, "db.example.com:5432")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer func() { _ = up.Close() }()
+
+			if _, isTLS := up.(*tls.Conn); isTLS != tc.wantTLS {
+				t.Fatalf("unexpected connection type %T", up)
+			}
+
+			// the client's first message is replayed over the upgraded connection
+			if _, err = up.Write(message); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if message := <-received; !bytes.Equal(message, tc.wantBytes) {
+				t.Fatalf("unexpected message | got %v, want %v", message, tc.wantBytes)
+			}
+		})
+	}
+}
+
+func TestUpstream_StartTLS_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, u := range []*Upstream{
+		{Dial: []string{"localhost:5432"}, StartTLSRaw: json.RawMessage(`{"protocol":"unknown"}`), TLS: &reverseproxy.TLSConfig{}},
+		{Dial: []string{"localhost:5432"}, StartTLSRaw: json.RawMessage(`{"protocol":"postgres"}`)},
+		{Dial: []string{"localhost:5432"}, StartTLSFallback: true},
+	} {
+		if err := u.provision(ctx, &Handler{}); err == nil {
+			t.Fatalf("expected an error for %+v", u)
+		}
+	}
+}
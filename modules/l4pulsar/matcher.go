@@ -0,0 +1,222 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4pulsar allows the L4 multiplexing of Apache Pulsar connections
+package l4pulsar
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchPulsar{})
+	layer4.RegisterProtocol("pulsar")
+}
+
+const (
+	frameHeaderSize      = 8    // Size of total size and command size fields (bytes)
+	minCommandSize       = 4    // Smallest valid CONNECT: type and an empty connect field
+	maxCommandSize       = 4096 // Maximum reasonable CONNECT command size (4 KB)
+	maxClientVersionSize = 256  // Maximum reasonable client version size
+	commandTypeConnect   = 2    // BaseCommand.Type of CONNECT
+
+	fieldBaseCommandType        = 1 // BaseCommand.type, an enum
+	fieldBaseCommandConnect     = 2 // BaseCommand.connect, a CommandConnect message
+	fieldConnectClientVersion   = 1 // CommandConnect.client_version, a string
+	fieldConnectProtocolVersion = 4 // CommandConnect.protocol_version, an int32
+
+	wireTypeVarint          = 0         // Protobuf wire type of int32, uint64, enum, etc.
+	wireTypeFixed64         = 1         // Protobuf wire type of fixed64, double, etc.
+	wireTypeLengthDelimited = 2         // Protobuf wire type of string, bytes and messages
+	wireTypeFixed32         = 5         // Protobuf wire type of fixed32, float, etc.
+	maxFieldNumber          = 1<<29 - 1 // Highest protobuf field number
+)
+
+// MatchPulsar is able to match Apache Pulsar binary protocol connections by their CONNECT command.
+// The client version (e.g. "Pulsar-Java-v3.2.0") and the protocol version of a matched command
+// are exposed as {l4.pulsar.client_version} and {l4.pulsar.protocol_version}.
+type MatchPulsar struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchPulsar) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.pulsar",
+		New: func() caddy.Module { return new(MatchPulsar) },
+	}
+}
+
+// Match returns true if the connection starts with a Pulsar CONNECT command.
+func (m *MatchPulsar) Match(cx *layer4.Connection) (bool, error) {
+	// Read total size and command size
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for Pulsar
+		}
+		return false, fmt.Errorf("reading frame header: %w", err)
+	}
+
+	// Validate sizes: CONNECT is a simple command, so the frame consists of the command only
+	totalSize := binary.BigEndian.Uint32(header[:4])
+	commandSize := binary.BigEndian.Uint32(header[4:])
+	if commandSize < minCommandSize || commandSize > maxCommandSize || totalSize != commandSize+4 {
+		return false, nil
+	}
+
+	// Read the command
+	command := make([]byte, commandSize)
+	if _, err := io.ReadFull(cx, command); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Incomplete frame
+		}
+		return false, fmt.Errorf("reading command: %w", err)
+	}
+
+	// Check the BaseCommand for type CONNECT and a connect field
+	var commandType uint64
+	var connect []byte
+	var hasConnect bool
+	if !readFields(command, func(num int, wireType int, varint uint64, data []byte) bool {
+		switch {
+		case num == fieldBaseCommandType && wireType == wireTypeVarint:
+			commandType = varint
+		case num == fieldBaseCommandConnect && wireType == wireTypeLengthDelimited:
+			connect, hasConnect = data, true
+		case num == fieldBaseCommandType || num == fieldBaseCommandConnect:
+			return false // Unexpected wire type
+		}
+		return true
+	}) || commandType != commandTypeConnect || !hasConnect {
+		return false, nil
+	}
+
+	// Check the CommandConnect for a client version, its only required field
+	var clientVersion []byte
+	var hasClientVersion bool
+	var protocolVersion uint64
+	if !readFields(connect, func(num int, wireType int, varint uint64, data []byte) bool {
+		switch {
+		case num == fieldConnectClientVersion && wireType == wireTypeLengthDelimited:
+			clientVersion, hasClientVersion = data, true
+		case num == fieldConnectProtocolVersion && wireType == wireTypeVarint:
+			protocolVersion = varint
+		case num == fieldConnectClientVersion || num == fieldConnectProtocolVersion:
+			return false // Unexpected wire type
+		}
+		return true
+	}) || !hasClientVersion {
+		return false, nil
+	}
+	if len(clientVersion) > maxClientVersionSize || !utf8.Valid(clientVersion) || protocolVersion > 1<<31-1 {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.pulsar.client_version", string(clientVersion))
+	repl.Set("l4.pulsar.protocol_version", strconv.FormatUint(protocolVersion, 10))
+	cx.SetProtocol("pulsar")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchPulsar from Caddyfile tokens. Syntax:
+//
+//	pulsar
+func (m *MatchPulsar) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// readFields reads the protobuf fields of message b and calls fn for each of them with its field number,
+// wire type and either its value (for varints) or its data (for length-delimited fields). It returns true
+// if b is a valid message and fn returned true for all of its fields, or false otherwise. Groups aren't
+// supported, since they are deprecated and not used by Pulsar.
+func readFields(b []byte, fn func(num int, wireType int, varint uint64, data []byte) bool) bool {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return false
+		}
+		b = b[n:]
+		num, wireType := key>>3, int(key&0x07)
+		if num == 0 || num > maxFieldNumber {
+			return false
+		}
+
+		var varint uint64
+		var data []byte
+		switch wireType {
+		case wireTypeVarint:
+			if varint, n = binary.Uvarint(b); n <= 0 {
+				return false
+			}
+			b = b[n:]
+		case wireTypeFixed64:
+			if len(b) < 8 {
+				return false
+			}
+			b = b[8:]
+		case wireTypeLengthDelimited:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return false
+			}
+			data, b = b[n:n+int(length)], b[n+int(length):]
+		case wireTypeFixed32:
+			if len(b) < 4 {
+				return false
+			}
+			b = b[4:]
+		default:
+			return false
+		}
+
+		if !fn(int(num), wireType, varint, data) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refs:
+//
+//	https://pulsar.apache.org/docs/next/developing-binary-protocol/
+//	https://github.com/apache/pulsar/blob/master/pulsar-common/src/main/proto/PulsarApi.proto
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchPulsar)(nil)
+	_ layer4.ConnMatcher    = (*MatchPulsar)(nil)
+)
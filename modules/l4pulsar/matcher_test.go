@@ -0,0 +1,141 @@
+package l4pulsar
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// varintField returns a protobuf varint field.
+func varintField(num int, value uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(num)<<3|wireTypeVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+// bytesField returns a protobuf length-delimited field.
+func bytesField(num int, data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(num)<<3|wireTypeLengthDelimited)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// buildFrame returns a simple command frame with the given BaseCommand.
+func buildFrame(command ...[]byte) []byte {
+	var c []byte
+	for _, field := range command {
+		c = append(c, field...)
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(c)+4))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(c)))
+	return append(b, c...)
+}
+
+func TestMatchPulsar(t *testing.T) {
+	// CONNECT as sent by the Java client: client version, protocol version and feature flags
+	connect := buildFrame(
+		varintField(fieldBaseCommandType, commandTypeConnect),
+		bytesField(fieldBaseCommandConnect, append(append(
+			bytesField(fieldConnectClientVersion, []byte("Pulsar-Java-v3.2.0")),
+			varintField(fieldConnectProtocolVersion, 21)...),
+			bytesField(10, varintField(1, 1))...)),
+	)
+	// CONNECT with token authentication and fields in reverse order
+	connectAuth := buildFrame(
+		bytesField(fieldBaseCommandConnect, append(append(append(
+			varintField(fieldConnectProtocolVersion, 19),
+			bytesField(5, []byte("token"))...),
+			bytesField(3, []byte("eyJhbGciOiJIUzI1NiJ9"))...),
+			bytesField(fieldConnectClientVersion, []byte("Pulsar Go 0.12.0"))...)),
+		varintField(fieldBaseCommandType, commandTypeConnect),
+	)
+	// PING, a valid command that isn't matched
+	ping := buildFrame(varintField(fieldBaseCommandType, 18), bytesField(19, nil))
+	// CONNECT missing the required client version
+	noClientVersion := buildFrame(
+		varintField(fieldBaseCommandType, commandTypeConnect),
+		bytesField(fieldBaseCommandConnect, varintField(fieldConnectProtocolVersion, 21)),
+	)
+	// CONNECT with a connect field exceeding the command
+	overflow := buildFrame(
+		varintField(fieldBaseCommandType, commandTypeConnect),
+		[]byte{fieldBaseCommandConnect<<3 | wireTypeLengthDelimited, 0x7f, 0x0a, 0x01, 0x61},
+	)
+	// CONNECT with a frame size that doesn't fit the command size
+	badSize := append([]byte{}, connect...)
+	binary.BigEndian.PutUint32(badSize, uint32(len(connect)))
+
+	tests := []struct {
+		name            string
+		input           []byte
+		wantMatch       bool
+		clientVersion   string
+		protocolVersion string
+	}{
+		{name: "Connect", input: connect, wantMatch: true, clientVersion: "Pulsar-Java-v3.2.0", protocolVersion: "21"},
+		{name: "Connect With Auth", input: connectAuth, wantMatch: true, clientVersion: "Pulsar Go 0.12.0", protocolVersion: "19"},
+		{name: "Ping", input: ping, wantMatch: false},
+		{name: "No Client Version", input: noClientVersion, wantMatch: false},
+		{name: "Connect Field Overflow", input: overflow, wantMatch: false},
+		{name: "Bad Frame Size", input: badSize, wantMatch: false},
+		{name: "Too Large", input: binary.BigEndian.AppendUint32([]byte{0x00, 0x01, 0x00, 0x04}, 0x00010000), wantMatch: false},
+		{name: "Truncated", input: connect[:len(connect)-3], wantMatch: false},
+		{name: "Empty", input: []byte{}, wantMatch: false},
+		{name: "HTTP", input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "Kafka", input: []byte{0x00, 0x00, 0x00, 0x0e, 0x00, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x02, 0x61, 0x62, 0x00, 0x00}, wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher := &MatchPulsar{}
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			clientVersion, _ := repl.GetString("l4.pulsar.client_version")
+			protocolVersion, _ := repl.GetString("l4.pulsar.protocol_version")
+			if clientVersion != tc.clientVersion || protocolVersion != tc.protocolVersion {
+				t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n",
+					i, clientVersion, protocolVersion, tc.clientVersion, tc.protocolVersion)
+			}
+		})
+	}
+}
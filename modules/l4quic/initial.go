@@ -0,0 +1,227 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4quic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/quic-go/quic-go"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchQUICInitial{})
+}
+
+// MatchQUICInitial is able to match QUIC connections by the long header of the Initial packet
+// the client starts with, without decrypting it, unlike MatchQUIC. It's therefore much cheaper,
+// but can't match on TLS-specific properties, such as ServerName (SNI). The version of the
+// packet is exposed as {l4.quic.version}, e.g. v1.
+type MatchQUICInitial struct {
+	// Versions is a list of QUIC versions to match: `v1`, `v2`, `draft-29`, or any other
+	// version as a hexadecimal number, e.g. 0xff00001d. By default, v1 and v2 are matched.
+	Versions []string `json:"versions,omitempty"`
+
+	versions []uint32
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchQUICInitial) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.quic_initial",
+		New: func() caddy.Module { return new(MatchQUICInitial) },
+	}
+}
+
+// Match returns true if the connection looks like QUIC.
+func (m *MatchQUICInitial) Match(cx *layer4.Connection) (bool, error) {
+	// Read the whole datagram, one byte more than a QUIC packet may have
+	buf := make([]byte, QUICPacketBytesMax+1)
+	n, err := readDatagram(cx, buf)
+	if err != nil {
+		return false, fmt.Errorf("reading datagram: %w", err)
+	}
+
+	// Client Initial packets must be padded to at least 1200 bytes
+	if n < QUICPacketBytesMin || n > QUICPacketBytesMax {
+		return false, nil
+	}
+	buf = buf[:n]
+
+	// Ensure the packet has a long header with the fixed bit set
+	if buf[0]&QUICLongHeaderBitValue == 0 || buf[0]&QUICMagicBitValue == 0 {
+		return false, nil
+	}
+
+	// Ensure the version is allowed, which excludes version negotiation packets (version 0)
+	version := binary.BigEndian.Uint32(buf[1:5])
+	if !slices.Contains(m.versions, version) {
+		return false, nil
+	}
+
+	// Ensure this is an Initial packet, whose type is encoded differently in QUIC v2
+	packetType := (buf[0] & 0x30) >> 4
+	if version == uint32(quic.Version2) {
+		packetType = (packetType + 3) & 0x03
+	}
+	if packetType != quicPacketTypeInitial {
+		return false, nil
+	}
+
+	// Validate the lengths of the connection IDs; an Initial DCID has at least 8 bytes
+	offset := 5
+	dcidLength := int(buf[offset])
+	if dcidLength < quicInitialDCIDBytesMin || dcidLength > quicConnectionIDBytesMax {
+		return false, nil
+	}
+	offset += 1 + dcidLength
+	scidLength := int(buf[offset])
+	if scidLength > quicConnectionIDBytesMax {
+		return false, nil
+	}
+	offset += 1 + scidLength
+
+	// Skip the token, and ensure the length of the rest of the packet fits the datagram
+	tokenLength, l := readVarInt(buf[offset:])
+	if l == 0 || tokenLength > uint64(n-offset-l) { //nolint:gosec // disable G115
+		return false, nil
+	}
+	offset += l + int(tokenLength) //nolint:gosec // disable G115
+	length, l := readVarInt(buf[offset:])
+	if l == 0 || length == 0 || length > uint64(n-offset-l) { //nolint:gosec // disable G115
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.quic.version", quic.Version(version).String())
+	cx.SetProtocol("quic")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchQUICInitial) Provision(_ caddy.Context) error {
+	if len(m.Versions) == 0 {
+		m.versions = []uint32{uint32(quic.Version1), uint32(quic.Version2)}
+		return nil
+	}
+	for _, name := range m.Versions {
+		version, err := parseVersion(name)
+		if err != nil {
+			return err
+		}
+		m.versions = append(m.versions, version)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchQUICInitial from Caddyfile tokens. Syntax:
+//
+//	quic_initial [<versions...>]
+func (m *MatchQUICInitial) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Versions = append(m.Versions, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// parseVersion returns the QUIC version named s, i.e. v1, v2, draft-29, or a hexadecimal number.
+func parseVersion(s string) (uint32, error) {
+	switch strings.ToLower(s) {
+	case "v1":
+		return uint32(quic.Version1), nil
+	case "v2":
+		return uint32(quic.Version2), nil
+	case "draft-29":
+		return quicVersionDraft29, nil
+	}
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return 0, fmt.Errorf("invalid QUIC version '%s'", s)
+	}
+	version, err := strconv.ParseUint(s[2:], 16, 32)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("invalid QUIC version '%s'", s)
+	}
+	return uint32(version), nil
+}
+
+// readVarInt reads a variable-length integer from b, and returns it with the number of bytes read,
+// which is 0 if b is too short.
+func readVarInt(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	l := 1 << (b[0] >> 6)
+	if len(b) < l {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:l] {
+		v = v<<8 | uint64(c)
+	}
+	return v, l
+}
+
+// readDatagram reads from cx into buf until it's full or no bytes remain, and returns the number of bytes read.
+// Since QUIC is UDP-based, all the bytes of a datagram are available at once, so nothing is waited for.
+func readDatagram(cx *layer4.Connection, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		nn, err := cx.Read(buf[n:])
+		n += nn
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+				break
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc9000.html#name-long-header-packets
+//	https://www.rfc-editor.org/rfc/rfc9000.html#name-initial-packet
+//	https://www.rfc-editor.org/rfc/rfc9369.html#name-long-header-packet-types
+const (
+	quicPacketTypeInitial    uint8 = 0
+	quicInitialDCIDBytesMin        = 8
+	quicConnectionIDBytesMax       = 20
+
+	quicVersionDraft29 uint32 = 0xff00001d
+)
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchQUICInitial)(nil)
+	_ caddyfile.Unmarshaler = (*MatchQUICInitial)(nil)
+	_ layer4.ConnMatcher    = (*MatchQUICInitial)(nil)
+)
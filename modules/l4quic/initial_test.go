@@ -0,0 +1,120 @@
+package l4quic
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func Test_MatchQUICInitial_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchQUICInitial
+		data        []byte
+		shouldMatch bool
+		version     string
+	}
+
+	// A v2 Initial packet has the packet type 0b01 and another version
+	packetV2 := append([]byte{}, packet1...)
+	packetV2[0] = packetV2[0]&^0x30 | 0x10
+	binary.BigEndian.PutUint32(packetV2[1:5], 0x6b3343cf)
+
+	// A version negotiation packet has the version 0 and lists the versions supported by the server
+	negotiation := []byte{0xc0, 0x00, 0x00, 0x00, 0x00, 0x08, 1, 2, 3, 4, 5, 6, 7, 8, 0x08, 8, 7, 6, 5, 4, 3, 2, 1}
+	negotiation = append(negotiation, 0x00, 0x00, 0x00, 0x01, 0x6b, 0x33, 0x43, 0xcf)
+	negotiation = append(negotiation, make([]byte, QUICPacketBytesMin-len(negotiation))...)
+
+	// A Handshake packet has the packet type 0b10
+	handshake := append([]byte{}, packet1...)
+	handshake[0] = handshake[0]&^0x30 | 0x20
+
+	// A short header packet has the first bit unset
+	short := append([]byte{}, packet1...)
+	short[0] &^= QUICLongHeaderBitValue
+
+	random := make([]byte, QUICPacketBytesMin)
+	_, _ = rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []test{
+		{matcher: &MatchQUICInitial{}, data: packet1, shouldMatch: true, version: "v1"},
+		{matcher: &MatchQUICInitial{}, data: packet2, shouldMatch: true, version: "v1"},
+		{matcher: &MatchQUICInitial{}, data: packet3, shouldMatch: true, version: "v1"},
+		{matcher: &MatchQUICInitial{}, data: packetV2, shouldMatch: true, version: "v2"},
+		{matcher: &MatchQUICInitial{Versions: []string{"V1"}}, data: packet1, shouldMatch: true, version: "v1"},
+		{matcher: &MatchQUICInitial{Versions: []string{"0x00000001"}}, data: packet1, shouldMatch: true, version: "v1"},
+
+		{matcher: &MatchQUICInitial{Versions: []string{"v2"}}, data: packet1, shouldMatch: false},
+		{matcher: &MatchQUICInitial{Versions: []string{"v1"}}, data: packetV2, shouldMatch: false},
+		{matcher: &MatchQUICInitial{}, data: negotiation, shouldMatch: false},
+		{matcher: &MatchQUICInitial{}, data: handshake, shouldMatch: false},
+		{matcher: &MatchQUICInitial{}, data: short, shouldMatch: false},
+		{matcher: &MatchQUICInitial{}, data: random, shouldMatch: false},
+		{matcher: &MatchQUICInitial{}, data: packet3[:len(packet3)-1], shouldMatch: false},
+		{matcher: &MatchQUICInitial{}, data: append(append([]byte{}, packet1...), make([]byte, QUICPacketBytesMax)...), shouldMatch: false},
+		{matcher: &MatchQUICInitial{}, data: []byte{}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if version, _ := repl.GetString("l4.quic.version"); version != tc.version {
+				t.Fatalf("test %d: unexpected version | got %q, want %q\n", i, version, tc.version)
+			}
+		}()
+	}
+}
+
+func Test_MatchQUICInitial_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchQUICInitial{
+		{Versions: []string{"v3"}},
+		{Versions: []string{"1"}},
+		{Versions: []string{"0x"}},
+		{Versions: []string{"0x0"}},
+		{Versions: []string{"0x100000000"}},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid matcher should not be provisioned | %+v\n", i, m)
+		}
+	}
+}
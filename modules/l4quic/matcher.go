@@ -41,6 +41,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchQUIC{})
+	layer4.RegisterProtocol("quic")
 }
 
 // MatchQUIC is able to match QUIC connections. Its structure
@@ -190,6 +191,7 @@ func (m *MatchQUIC) Match(cx *layer4.Connection) (bool, error) {
 		}
 	}
 
+	cx.SetProtocol("quic")
 	return true, nil
 }
 
@@ -0,0 +1,159 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4radius allows the L4 multiplexing of RADIUS connections
+package l4radius
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchRADIUS{})
+	layer4.RegisterProtocol("radius")
+}
+
+const (
+	headerLength    = 20   // Size of Code, Identifier, Length and Authenticator fields (bytes)
+	maxPacketLength = 4096 // Maximum packet length according to RFC 2865
+
+	CodeAccessRequest     = 1 // Code of Access-Request packets
+	CodeAccountingRequest = 4 // Code of Accounting-Request packets
+)
+
+// MatchRADIUS is able to match RADIUS packets sent by clients, i.e. Access-Request and Accounting-Request
+// packets, which Length must equal the length of the datagram. The packet Code is exposed as {l4.radius.code},
+// e.g. 1 for Access-Request or 4 for Accounting-Request, and its Identifier as {l4.radius.identifier}.
+type MatchRADIUS struct {
+	// Codes is a list of packet codes to match. It defaults to Access-Request (1) and Accounting-Request (4),
+	// which are the only ones supported.
+	Codes []uint16 `json:"codes,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchRADIUS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.radius",
+		New: func() caddy.Module { return new(MatchRADIUS) },
+	}
+}
+
+// Match returns true if the connection looks like RADIUS.
+func (m *MatchRADIUS) Match(cx *layer4.Connection) (bool, error) {
+	// Read the whole datagram, but no more than a packet of the maximum length and a byte
+	buf := make([]byte, maxPacketLength+1)
+	n, err := readDatagram(cx, buf)
+	if err != nil {
+		return false, fmt.Errorf("reading datagram: %w", err)
+	}
+	if n < headerLength || n > maxPacketLength {
+		return false, nil
+	}
+	buf = buf[:n]
+
+	// Validate Code and Length
+	code := buf[0]
+	if !slices.Contains(m.Codes, uint16(code)) || int(binary.BigEndian.Uint16(buf[2:4])) != n {
+		return false, nil
+	}
+
+	// Validate Attributes, each consisting of Type, Length and Value
+	for attrs := buf[headerLength:]; len(attrs) > 0; {
+		if len(attrs) < 2 || attrs[0] == 0 || attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return false, nil
+		}
+		attrs = attrs[attrs[1]:]
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.radius.code", strconv.Itoa(int(code)))
+	repl.Set("l4.radius.identifier", strconv.Itoa(int(buf[1])))
+	cx.SetProtocol("radius")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchRADIUS) Provision(_ caddy.Context) error {
+	if len(m.Codes) == 0 {
+		m.Codes = []uint16{CodeAccessRequest, CodeAccountingRequest}
+	}
+	for _, code := range m.Codes {
+		if code != CodeAccessRequest && code != CodeAccountingRequest {
+			return fmt.Errorf("unsupported code %d", code)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchRADIUS from Caddyfile tokens. Syntax:
+//
+//	radius [<codes...>]
+func (m *MatchRADIUS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	for d.NextArg() {
+		code, err := strconv.ParseUint(d.Val(), 10, 8)
+		if err != nil {
+			return d.Errf("parsing %s code: %v", wrapper, err)
+		}
+		m.Codes = append(m.Codes, uint16(code))
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s option: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// readDatagram reads from cx into buf until it's full or no bytes remain, and returns the number of bytes read.
+// Since RADIUS is UDP-based, all the bytes of a datagram are available at once, so nothing is waited for.
+func readDatagram(cx *layer4.Connection, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		nn, err := cx.Read(buf[n:])
+		n += nn
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+				break
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc2865#section-3
+//	https://www.rfc-editor.org/rfc/rfc2866#section-3
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchRADIUS)(nil)
+	_ caddyfile.Unmarshaler = (*MatchRADIUS)(nil)
+	_ layer4.ConnMatcher    = (*MatchRADIUS)(nil)
+)
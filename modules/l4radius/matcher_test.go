@@ -0,0 +1,134 @@
+package l4radius
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// buildPacket returns a packet with the given code, identifier and attributes, each given as type and value.
+func buildPacket(code, identifier byte, attrs ...[]byte) []byte {
+	b := []byte{code, identifier, 0x00, 0x00}
+	b = append(b, 0x0f, 0x40, 0x3f, 0x94, 0x73, 0x97, 0x80, 0x57, 0xbd, 0x83, 0xd5, 0xcb, 0x98, 0xf4, 0x22, 0x7a)
+	for _, attr := range attrs {
+		b = append(b, attr[0], byte(len(attr)+1))
+		b = append(b, attr[1:]...)
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b
+}
+
+func Test_MatchRADIUS_Match(t *testing.T) {
+	// Access-Request with User-Name, User-Password, NAS-IP-Address and NAS-Port
+	accessRequest := buildPacket(CodeAccessRequest, 0xd0,
+		append([]byte{1}, "nemo"...),
+		[]byte{2, 0x0d, 0xbe, 0x70, 0x8d, 0x93, 0xd4, 0x13, 0xce, 0x31, 0x96, 0xe4, 0x3f, 0x78, 0x2a, 0x0a, 0xee},
+		[]byte{4, 0xc0, 0xa8, 0x01, 0x10},
+		[]byte{5, 0x00, 0x00, 0x00, 0x03},
+	)
+	// Accounting-Request with Acct-Status-Type Start, User-Name and Acct-Session-Id
+	accountingRequest := buildPacket(CodeAccountingRequest, 0x2a,
+		[]byte{40, 0x00, 0x00, 0x00, 0x01},
+		append([]byte{1}, "nemo"...),
+		append([]byte{44}, "0000002a"...),
+	)
+	// Access-Accept, a packet sent by servers
+	accessAccept := buildPacket(2, 0xd0, []byte{6, 0x00, 0x00, 0x00, 0x02})
+	// Access-Request which Length exceeds the datagram
+	lengthTooLarge := append([]byte{}, accessRequest...)
+	binary.BigEndian.PutUint16(lengthTooLarge[2:4], uint16(len(accessRequest)+1))
+	// Access-Request with an attribute exceeding the packet
+	attributeOverflow := append(append([]byte{}, accessRequest...), 0x01, 0x10, 0x61)
+	binary.BigEndian.PutUint16(attributeOverflow[2:4], uint16(len(attributeOverflow)))
+
+	type test struct {
+		matcher     *MatchRADIUS
+		data        []byte
+		shouldMatch bool
+		code        string
+		identifier  string
+	}
+
+	tests := []test{
+		{matcher: &MatchRADIUS{}, data: accessRequest, shouldMatch: true, code: "1", identifier: "208"},
+		{matcher: &MatchRADIUS{}, data: accountingRequest, shouldMatch: true, code: "4", identifier: "42"},
+		{matcher: &MatchRADIUS{}, data: buildPacket(CodeAccessRequest, 0x01), shouldMatch: true, code: "1", identifier: "1"},
+		{matcher: &MatchRADIUS{Codes: []uint16{CodeAccessRequest}}, data: accessRequest, shouldMatch: true, code: "1", identifier: "208"},
+		{matcher: &MatchRADIUS{Codes: []uint16{CodeAccessRequest}}, data: accountingRequest, shouldMatch: false},
+		{matcher: &MatchRADIUS{Codes: []uint16{CodeAccountingRequest}}, data: accountingRequest, shouldMatch: true, code: "4", identifier: "42"},
+		{matcher: &MatchRADIUS{}, data: accessAccept, shouldMatch: false},
+		{matcher: &MatchRADIUS{}, data: accessRequest[:headerLength-1], shouldMatch: false},
+		{matcher: &MatchRADIUS{}, data: accessRequest[:len(accessRequest)-1], shouldMatch: false},
+		{matcher: &MatchRADIUS{}, data: append(append([]byte{}, accessRequest...), 0x00), shouldMatch: false},
+		{matcher: &MatchRADIUS{}, data: lengthTooLarge, shouldMatch: false},
+		{matcher: &MatchRADIUS{}, data: attributeOverflow, shouldMatch: false},
+		{matcher: &MatchRADIUS{}, data: []byte{}, shouldMatch: false},
+		{matcher: &MatchRADIUS{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			code, _ := repl.GetString("l4.radius.code")
+			identifier, _ := repl.GetString("l4.radius.identifier")
+			if code != tc.code || identifier != tc.identifier {
+				t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n", i, code, identifier, tc.code, tc.identifier)
+			}
+		}()
+	}
+}
+
+func Test_MatchRADIUS_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchRADIUS{Codes: []uint16{2}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported code should not be accepted")
+	}
+}
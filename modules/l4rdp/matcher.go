@@ -35,9 +35,11 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchRDP{})
+	layer4.RegisterProtocol("rdp")
 }
 
-// MatchRDP is able to match RDP connections.
+// MatchRDP is able to match RDP connections. The username of the routing cookie (mstshash), if any,
+// is exposed as {l4.rdp.cookie_hash}, e.g. to be used as a key for session affinity by load balancers.
 type MatchRDP struct {
 	CookieHash       string   `json:"cookie_hash,omitempty"`
 	CookieHashRegexp string   `json:"cookie_hash_regexp,omitempty"`
@@ -340,6 +342,7 @@ func (m *MatchRDP) Match(cx *layer4.Connection) (bool, error) {
 	// and all the validations above have passed, we can reasonably treat the protocol in question as RDP.
 	// This behaviour may be changed in the future if there are many false positive matches.
 	if RDPNegReqBytesStart == payloadBytesTotal {
+		cx.SetProtocol("rdp")
 		return true, nil
 	}
 
@@ -371,6 +374,7 @@ func (m *MatchRDP) Match(cx *layer4.Connection) (bool, error) {
 		if RDPNegReqBytesStart+RDPNegReqBytesTotal < payloadBytesTotal {
 			return false, nil
 		} else {
+			cx.SetProtocol("rdp")
 			return true, nil
 		}
 	}
@@ -413,6 +417,7 @@ func (m *MatchRDP) Match(cx *layer4.Connection) (bool, error) {
 		}
 	}
 
+	cx.SetProtocol("rdp")
 	return true, nil
 }
 
@@ -231,6 +231,60 @@ func Test_MatchRDP_Match(t *testing.T) {
 	}
 }
 
+func Test_MatchRDP_CookieHash(t *testing.T) {
+	type test struct {
+		data        []byte
+		shouldMatch bool
+		cookieHash  string
+	}
+
+	tests := []test{
+		{data: packetValid3, shouldMatch: true, cookieHash: "a0123"},
+		{data: packetValid1, shouldMatch: true, cookieHash: ""},
+		{data: packetInvalid2, shouldMatch: false, cookieHash: ""},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			matcher := &MatchRDP{}
+			err := matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.data)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.data)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if cookieHash, _ := repl.GetString("l4.rdp.cookie_hash"); cookieHash != tc.cookieHash {
+				t.Fatalf("test %d: unexpected cookie hash | got %q, want %q\n", i, cookieHash, tc.cookieHash)
+			}
+		}()
+	}
+}
+
 // Packet examples
 var packetTooShort = []byte{
 	0x00, 0x00, 0x00, 0x00, // TPKTHeader
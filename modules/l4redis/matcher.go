@@ -0,0 +1,243 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4redis allows the L4 multiplexing of Redis connections
+package l4redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchRedis{})
+	layer4.RegisterProtocol("redis")
+}
+
+const (
+	defaultMaxBytes = 1024    // Default number of bytes to read at most
+	maxArrayLen     = 1 << 20 // Maximum reasonable number of command arguments
+)
+
+// MatchRedis is able to match Redis connections speaking RESP. The first command
+// may be sent as a RESP array of bulk strings, or inline for a few commands clients
+// usually start with (e.g. PING, AUTH, HELLO). Its verb is exposed in upper case
+// as {l4.redis.command}.
+type MatchRedis struct {
+	// MaxBytes is the number of bytes to read at most in order to find the first command.
+	// It defaults to 1024 and may not exceed layer4.MaxMatchingBytes.
+	MaxBytes uint16 `json:"max_bytes,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchRedis) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.redis",
+		New: func() caddy.Module { return new(MatchRedis) },
+	}
+}
+
+// Match returns true if the connection looks like the Redis protocol.
+func (m *MatchRedis) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, int64(m.MaxBytes)), int(m.MaxBytes))
+
+	verb, err := readCommand(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errNotRedis) {
+			return false, nil // Not enough data within the limit, or not Redis
+		}
+		return false, err
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.redis.command", string(verb))
+	cx.SetProtocol("redis")
+
+	return true, nil
+}
+
+// readCommand reads the first command from r and returns its upper case verb.
+func readCommand(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inline command, e.g. PING\r\n
+	if b[0] != '*' {
+		if !(b[0] >= 'A' && b[0] <= 'Z' || b[0] >= 'a' && b[0] <= 'z') {
+			return nil, errNotRedis
+		}
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		verb, _, _ := bytes.Cut(line, []byte(" "))
+		verb = bytes.ToUpper(verb)
+		if _, ok := inlineCommands[string(verb)]; !ok {
+			return nil, errNotRedis
+		}
+		return verb, nil
+	}
+
+	// RESP array of bulk strings, e.g. *1\r\n$4\r\nPING\r\n
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 1 || n > maxArrayLen {
+		return nil, errNotRedis
+	}
+
+	line, err = readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[0] != '$' {
+		return nil, errNotRedis
+	}
+	size, err := strconv.Atoi(string(line[1:]))
+	if err != nil || size < 1 || size > r.Size() {
+		return nil, errNotRedis
+	}
+
+	verb := make([]byte, size+2)
+	if _, err = io.ReadFull(r, verb); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(verb, crlf) || !isVerb(verb[:size]) {
+		return nil, errNotRedis
+	}
+	return bytes.ToUpper(verb[:size]), nil
+}
+
+// readLine reads a CRLF-terminated line from r and returns it without the terminator.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, errNotRedis
+		}
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, crlf) {
+		return nil, errNotRedis
+	}
+	return line[:len(line)-len(crlf)], nil
+}
+
+// isVerb returns true if b looks like a command name, including module commands (e.g. JSON.SET).
+func isVerb(b []byte) bool {
+	for _, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-' || c == '|') {
+			return false
+		}
+	}
+	return true
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchRedis) Provision(_ caddy.Context) error {
+	if m.MaxBytes == 0 {
+		m.MaxBytes = defaultMaxBytes
+	}
+	if int(m.MaxBytes) > layer4.MaxMatchingBytes {
+		return fmt.Errorf("max_bytes may not exceed %d", layer4.MaxMatchingBytes)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchRedis from Caddyfile tokens. Syntax:
+//
+//	redis {
+//		max_bytes <n>
+//	}
+//	redis
+func (m *MatchRedis) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasMaxBytes bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "max_bytes":
+			if hasMaxBytes {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 16)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.MaxBytes, hasMaxBytes = uint16(val), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+var (
+	crlf = []byte("\r\n")
+
+	errNotRedis = errors.New("not redis")
+
+	// inlineCommands are the commands accepted in the inline form. Other commands
+	// are rarely sent first, and some of them (e.g. GET) would collide with HTTP.
+	inlineCommands = map[string]struct{}{
+		"AUTH":   {},
+		"ECHO":   {},
+		"HELLO":  {},
+		"INFO":   {},
+		"PING":   {},
+		"QUIT":   {},
+		"SELECT": {},
+	}
+)
+
+// Refs:
+//
+//	https://redis.io/docs/latest/develop/reference/protocol-spec/
+//	https://redis.io/docs/latest/develop/reference/protocol-spec/#inline-commands
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchRedis)(nil)
+	_ caddyfile.Unmarshaler = (*MatchRedis)(nil)
+	_ layer4.ConnMatcher    = (*MatchRedis)(nil)
+)
@@ -0,0 +1,103 @@
+package l4redis
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func Test_MatchRedis_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchRedis
+		data        []byte
+		shouldMatch bool
+		command     string
+	}
+
+	tests := []test{
+		// RESP2 arrays
+		{matcher: &MatchRedis{}, data: []byte("*1\r\n$4\r\nPING\r\n"), shouldMatch: true, command: "PING"},
+		{matcher: &MatchRedis{}, data: []byte("*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n"), shouldMatch: true, command: "AUTH"},
+		{matcher: &MatchRedis{}, data: []byte("*3\r\n$4\r\nAUTH\r\n$7\r\ndefault\r\n$6\r\nsecret\r\n"), shouldMatch: true, command: "AUTH"},
+		{matcher: &MatchRedis{}, data: []byte("*2\r\n$5\r\nhello\r\n$1\r\n3\r\n"), shouldMatch: true, command: "HELLO"},
+		{matcher: &MatchRedis{}, data: []byte("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"), shouldMatch: true, command: "SET"},
+		{matcher: &MatchRedis{}, data: []byte("*3\r\n$8\r\nJSON.GET\r\n$3\r\nfoo\r\n$1\r\n$\r\n"), shouldMatch: true, command: "JSON.GET"},
+		{matcher: &MatchRedis{}, data: []byte("*1\r\n$4\r\nPI"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("*0\r\n"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("*x\r\n$4\r\nPING\r\n"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("*1\r\n+PING\r\n"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("*1\r\n$4\r\nPINGXX"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("*1\n$4\nPING\n"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("*1\r\n$4\r\nP NG\r\n"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("*1\r\n$99999\r\nPING\r\n"), shouldMatch: false},
+		// inline commands
+		{matcher: &MatchRedis{}, data: []byte("PING\r\n"), shouldMatch: true, command: "PING"},
+		{matcher: &MatchRedis{}, data: []byte("ping\r\n"), shouldMatch: true, command: "PING"},
+		{matcher: &MatchRedis{}, data: []byte("AUTH default secret\r\n"), shouldMatch: true, command: "AUTH"},
+		{matcher: &MatchRedis{}, data: []byte("HELLO 3\r\n"), shouldMatch: true, command: "HELLO"},
+		{matcher: &MatchRedis{}, data: []byte("PING"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("GET foo\r\n"), shouldMatch: false},
+		// limits
+		{matcher: &MatchRedis{MaxBytes: 16}, data: []byte("*1\r\n$4\r\nPING\r\n"), shouldMatch: true, command: "PING"},
+		{matcher: &MatchRedis{MaxBytes: 16}, data: []byte("AUTH default secret\r\n"), shouldMatch: false},
+		// non-Redis garbage
+		{matcher: &MatchRedis{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte("SSH-2.0-OpenSSH_9.6\r\n"), shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte{0x16, 0x03, 0x01, 0x00, 0xA5, 0x01, 0x00, 0x00, 0xA1, 0x03, 0x03}, shouldMatch: false},
+		{matcher: &MatchRedis{}, data: []byte{}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			command, _ := repl.GetString("l4.redis.command")
+			if command != tc.command {
+				t.Fatalf("test %d: unexpected command | got %q, want %q\n", i, command, tc.command)
+			}
+		}()
+	}
+}
@@ -15,6 +15,8 @@
 package l4regexp
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"regexp"
 	"strconv"
@@ -29,8 +31,15 @@ func init() {
 	caddy.RegisterModule(&MatchRegexp{})
 }
 
-// MatchRegexp is able to match any connections with regular expressions.
+// MatchRegexp is able to match any connections with regular expressions, e.g. those of protocols without
+// a dedicated matcher. The pattern is matched against the first bytes of the connection, up to a count,
+// as soon as the bytes available match, or once the count is reached, or the client has stopped sending.
+// Each byte is treated as a Latin-1 character, so that binary protocols can be matched, e.g. \x80 matches
+// the 0x80 byte rather than a UTF-8 encoded U+0080. The values of named capture groups are exposed as
+// {l4.regexp.<name>}, e.g. {l4.regexp.verb} for (?P<verb>[A-Z]+).
 type MatchRegexp struct {
+	// Count is the maximum number of bytes to match the pattern against. Default: 1024.
+	// It may not exceed layer4.MaxMatchingBytes.
 	Count   uint16 `json:"count,omitempty"`
 	Pattern string `json:"pattern,omitempty"`
 
@@ -47,22 +56,47 @@ func (m *MatchRegexp) CaddyModule() caddy.ModuleInfo {
 
 // Match returns true if the connection bytes match the regular expression.
 func (m *MatchRegexp) Match(cx *layer4.Connection) (bool, error) {
-	// Read a number of bytes
+	// Read up to count bytes
 	buf := make([]byte, m.Count)
 	n, err := io.ReadFull(cx, buf)
-	if err != nil || n < int(m.Count) {
+	needMore := errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes)
+	if err != nil && !needMore && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
 		return false, err
 	}
 
 	// Match these bytes against the regular expression
-	return m.compiled.Match(buf), nil
+	input := latin1ToString(buf[:n])
+	loc := m.compiled.FindStringSubmatchIndex(input)
+	if loc == nil {
+		if needMore {
+			return false, err // More bytes may match
+		}
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	for i, name := range m.compiled.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		var value string
+		if loc[2*i] >= 0 {
+			value = stringToLatin1(input[loc[2*i]:loc[2*i+1]])
+		}
+		repl.Set("l4.regexp."+name, value)
+	}
+
+	return true, nil
 }
 
 // Provision parses m's regular expression and sets m's minimum read bytes count.
 func (m *MatchRegexp) Provision(_ caddy.Context) (err error) {
 	repl := caddy.NewReplacer()
 	if m.Count == 0 {
-		m.Count = minCount
+		m.Count = defaultCount
+	}
+	if m.Count > layer4.MaxMatchingBytes {
+		return fmt.Errorf("count %d exceeds %d bytes", m.Count, layer4.MaxMatchingBytes)
 	}
 	m.compiled, err = regexp.Compile(repl.ReplaceAll(m.Pattern, ""))
 	if err != nil {
@@ -99,6 +133,24 @@ func (m *MatchRegexp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// latin1ToString returns b decoded as Latin-1, i.e. with each byte converted into the rune of the same value.
+func latin1ToString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// stringToLatin1 reverts latin1ToString, i.e. it returns the bytes of the runes of s.
+func stringToLatin1(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = append(b, byte(r)) //nolint:gosec // disable G115
+	}
+	return string(b)
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner     = (*MatchRegexp)(nil)
@@ -107,5 +159,5 @@ var (
 )
 
 const (
-	minCount uint16 = 4 // by default, read this many bytes to match against
+	defaultCount uint16 = 1024 // by default, read up to this many bytes to match against
 )
@@ -39,6 +39,7 @@ func Test_MatchRegexp_Match(t *testing.T) {
 		matcher     *MatchRegexp
 		data        []byte
 		shouldMatch bool
+		vars        map[string]string
 	}
 
 	tests := []test{
@@ -47,11 +48,26 @@ func Test_MatchRegexp_Match(t *testing.T) {
 		{matcher: &MatchRegexp{Pattern: "12"}, data: packet0123, shouldMatch: true},
 		{matcher: &MatchRegexp{Pattern: "^0123$"}, data: packet0123, shouldMatch: true},
 		{matcher: &MatchRegexp{Pattern: "^012$"}, data: packet0123, shouldMatch: false},
-		{matcher: &MatchRegexp{Pattern: "^0123$", Count: 5}, data: packet0123, shouldMatch: false},
+		{matcher: &MatchRegexp{Pattern: "^0123$", Count: 5}, data: packet0123, shouldMatch: true}, // fewer bytes are matched once the stream ends
 		{matcher: &MatchRegexp{Pattern: "^012$", Count: 3}, data: packet0123, shouldMatch: true},
+		{matcher: &MatchRegexp{Pattern: "^0123$", Count: 3}, data: packet0123, shouldMatch: false},
 		{matcher: &MatchRegexp{Pattern: "^\\d+$"}, data: packet0123, shouldMatch: true},
 		{matcher: &MatchRegexp{Pattern: "^\\d+$", Count: 0}, data: packet0123, shouldMatch: true},
 		{matcher: &MatchRegexp{Pattern: "^\x30\x31\x32(\x33|\x34)$", Count: 0}, data: packet0123, shouldMatch: true},
+
+		// named capture groups are exposed as placeholders
+		{matcher: &MatchRegexp{Pattern: "^(?P<verb>[A-Z]+) (?P<path>\\S+) HTTP/1\\.[01]\r\n"}, data: packetHTTP, shouldMatch: true,
+			vars: map[string]string{"l4.regexp.verb": "GET", "l4.regexp.path": "/index.html"}},
+		{matcher: &MatchRegexp{Pattern: "^(?P<verb>[A-Z]+) (?P<path>\\S+) RTSP/1\\.0\r\n"}, data: packetHTTP, shouldMatch: false},
+		{matcher: &MatchRegexp{Pattern: "^(?P<verb>[A-Z]+) ", Count: 2}, data: packetHTTP, shouldMatch: false},
+		{matcher: &MatchRegexp{Pattern: "Host: (?P<host>[^\\r]+)|Server: (?P<server>[^\\r]+)"}, data: packetHTTP, shouldMatch: true,
+			vars: map[string]string{"l4.regexp.host": "example.com", "l4.regexp.server": ""}},
+
+		// binary input is matched byte by byte
+		{matcher: &MatchRegexp{Pattern: "^\\x16\\x03(?P<minor>[\\x00-\\x04])\\x00(?P<length>[\\x80-\\xff])"}, data: packetBinary, shouldMatch: true,
+			vars: map[string]string{"l4.regexp.minor": "\x01", "l4.regexp.length": "\xa5"}},
+		{matcher: &MatchRegexp{Pattern: "^\\x16\\x03[\\x00-\\x04]\\x00\\xc2\\xa5"}, data: packetBinary, shouldMatch: false},
+		{matcher: &MatchRegexp{Pattern: "\\xff\\x00$"}, data: packetBinary, shouldMatch: true},
 	}
 
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
@@ -85,8 +101,34 @@ func Test_MatchRegexp_Match(t *testing.T) {
 					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
 				}
 			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range tc.vars {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
 		}()
 	}
 }
 
+func Test_MatchRegexp_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchRegexp{}
+	if err := m.Provision(ctx); err != nil || m.Count != defaultCount {
+		t.Fatalf("unexpected count %d or error: %v", m.Count, err)
+	}
+
+	m = &MatchRegexp{Count: layer4.MaxMatchingBytes + 1}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("count exceeding %d bytes should not be accepted", layer4.MaxMatchingBytes)
+	}
+}
+
 var packet0123 = []byte{0x30, 0x31, 0x32, 0x33}
+
+var packetHTTP = []byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n")
+
+var packetBinary = []byte{0x16, 0x03, 0x01, 0x00, 0xa5, 0x01, 0xff, 0x00}
@@ -0,0 +1,165 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4riemann allows the L4 multiplexing of Riemann connections
+package l4riemann
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchRiemann{})
+	layer4.RegisterProtocol("riemann")
+}
+
+const (
+	headerSize     = 4        // Size of frame header: the length of the message (big-endian)
+	minMessageSize = 2        // Smallest valid request: an empty query or event
+	maxMessageSize = 16 << 20 // Maximum reasonable message size (16 MB)
+	maxInspectSize = 512      // Maximum number of bytes of the message to inspect
+
+	// Fields of the Msg message
+	fieldOK     = 2
+	fieldError  = 3
+	fieldStates = 4
+	fieldQuery  = 5
+	fieldEvents = 6
+
+	// Protobuf wire types
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// MatchRiemann is able to match Riemann connections, which start with a frame of the client:
+// the length of a message as a 4-byte big-endian integer, followed by a protobuf-encoded Msg
+// carrying events or a query. The fields of the Msg are validated as far as they are inspected.
+type MatchRiemann struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchRiemann) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.riemann",
+		New: func() caddy.Module { return new(MatchRiemann) },
+	}
+}
+
+// Match returns true if the connection looks like the Riemann protocol.
+func (m *MatchRiemann) Match(cx *layer4.Connection) (bool, error) {
+	// Read frame header (first 4 bytes)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for Riemann
+		}
+		return false, fmt.Errorf("reading frame header: %w", err)
+	}
+
+	msgLen := int(byteparser.NewReader(header).ReadUint32())
+	if msgLen < minMessageSize || msgLen > maxMessageSize {
+		return false, nil // Too small or too large, reject to prevent DoS
+	}
+
+	// Read the beginning of the message, or all of it if it's short
+	msg := make([]byte, min(msgLen, maxInspectSize))
+	if _, err := io.ReadFull(cx, msg); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Incomplete message
+		}
+		return false, fmt.Errorf("reading message: %w", err)
+	}
+
+	if !isRequest(msg, msgLen) {
+		return false, nil
+	}
+	cx.SetProtocol("riemann")
+	return true, nil
+}
+
+// isRequest returns true if msg, the first bytes of a message of msgLen bytes, only consists of
+// fields of the Msg message, and carries events or a query. If msg is the whole message, the last
+// field must end with it; otherwise, the last field may be truncated.
+func isRequest(msg []byte, msgLen int) bool {
+	complete := len(msg) == msgLen
+	var hasRequest bool
+	for offset := 0; offset < len(msg); {
+		// Read the key and the value of the field; a varint is a value itself, or the size of a value of bytes
+		key, n := binary.Uvarint(msg[offset:])
+		if n > 0 {
+			offset += n
+			var value uint64
+			value, n = binary.Uvarint(msg[offset:])
+			offset += max(n, 0)
+
+			field, wireType := key>>3, key&7
+			switch {
+			case field == fieldOK && wireType == wireVarint:
+			case (field == fieldError || field == fieldStates || field == fieldQuery || field == fieldEvents) && wireType == wireBytes:
+				if value > uint64(msgLen-offset) { //nolint:gosec // disable G115
+					return false // The field exceeds the message
+				}
+				offset += int(value) //nolint:gosec // disable G115
+				hasRequest = hasRequest || field == fieldQuery || field == fieldEvents
+			default:
+				return false // Unknown field or mismatched wire type
+			}
+		}
+		if n < 0 || (n == 0 && complete) {
+			return false // Overflowing or truncated varint
+		}
+		if n == 0 {
+			break // Truncated by the inspected bytes
+		}
+	}
+	return hasRequest
+}
+
+// UnmarshalCaddyfile sets up the MatchRiemann from Caddyfile tokens. Syntax:
+//
+//	riemann
+func (m *MatchRiemann) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://riemann.io/concepts.html
+//	https://github.com/riemann/riemann-java-client/blob/master/riemann-java-client/src/main/proto/riemann/proto.proto
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchRiemann)(nil)
+	_ layer4.ConnMatcher    = (*MatchRiemann)(nil)
+)
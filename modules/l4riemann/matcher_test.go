@@ -0,0 +1,104 @@
+package l4riemann
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// field returns a protobuf field of the given number with a value of bytes.
+func field(number uint64, value []byte) []byte {
+	b := binary.AppendUvarint(nil, number<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// frame returns msg prefixed by its length.
+func frame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...) //nolint:gosec // disable G115
+}
+
+func Test_MatchRiemann_Match(t *testing.T) {
+	type test struct {
+		data        []byte
+		shouldMatch bool
+	}
+
+	// An event with time (1), service (3), host (4) and metric_f (15)
+	event := binary.AppendUvarint([]byte{1<<3 | wireVarint}, 1700000000)
+	event = append(event, field(3, []byte("cpu"))...)
+	event = append(event, field(4, []byte("web-1"))...)
+	event = binary.LittleEndian.AppendUint32(append(event, 15<<3|5), math.Float32bits(0.42))
+
+	events := append(field(fieldEvents, event), field(fieldEvents, event)...)
+	query := field(fieldQuery, field(1, []byte(`service = "cpu"`)))
+
+	// A large message, of which only the beginning is inspected
+	large := field(fieldEvents, append(field(4, make([]byte, 2*maxInspectSize)), event...))
+
+	tooLong := frame(events)
+	binary.BigEndian.PutUint32(tooLong, maxMessageSize+1)
+
+	tests := []test{
+		{data: frame(events), shouldMatch: true},
+		{data: frame(query), shouldMatch: true},
+		{data: frame(field(fieldQuery, nil)), shouldMatch: true},
+		{data: frame(large)[:headerSize+maxInspectSize], shouldMatch: true},
+
+		{data: frame([]byte{fieldOK<<3 | wireVarint, 1}), shouldMatch: false},
+		{data: frame(append(events, fieldEvents<<3|wireVarint, 1)), shouldMatch: false},
+		{data: frame(append(events, 7<<3|wireBytes, 0)), shouldMatch: false},
+		{data: frame(events[:len(events)-1]), shouldMatch: false},
+		{data: frame(events)[:len(events)], shouldMatch: false},
+		{data: frame([]byte{fieldEvents<<3 | wireBytes}), shouldMatch: false},
+		{data: tooLong, shouldMatch: false},
+		{data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{data: []byte("SSH-2.0-OpenSSH_9.6\r\n"), shouldMatch: false},
+		{data: []byte{0x16, 0x03, 0x01, 0x00, 0xa5, 0x01, 0x00, 0x00, 0xa1, 0x03, 0x03, 0x00}, shouldMatch: false},
+		{data: []byte{}, shouldMatch: false},
+	}
+
+	for i, tc := range tests {
+		func() {
+			matcher := &MatchRiemann{}
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.data)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.data)
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4rtsp allows the L4 multiplexing of RTSP connections
+package l4rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchRTSP{})
+	layer4.RegisterProtocol("rtsp")
+}
+
+const (
+	maxLineLength   = 1024 // Maximum length of a request line or header line, including the line ending
+	maxHeaderLength = 4096 // Maximum length of the request line and the headers read to find CSeq
+)
+
+// methods contains all the methods defined by RFC 2326 and RFC 7826.
+var methods = []string{
+	"ANNOUNCE", "DESCRIBE", "GET_PARAMETER", "OPTIONS", "PAUSE", "PLAY", "PLAY_NOTIFY",
+	"RECORD", "REDIRECT", "SET_PARAMETER", "SETUP", "TEARDOWN",
+}
+
+// versions contains all the supported protocol versions.
+var versions = []string{"RTSP/1.0", "RTSP/2.0"}
+
+// MatchRTSP is able to match RTSP requests, e.g. DESCRIBE rtsp://media.example.com/stream RTSP/1.0.
+// Unlike HTTP requests, they must have an RTSP version and a method known to RTSP, so that requests
+// with methods shared with HTTP, e.g. OPTIONS or GET_PARAMETER, aren't confused. The request method
+// is exposed as {l4.rtsp.method}, the request URL as {l4.rtsp.url}, and the CSeq header value as
+// {l4.rtsp.cseq}, provided this header is found within the first 4 KiB.
+type MatchRTSP struct {
+	// Methods is a list of request methods to match, e.g. DESCRIBE or SETUP.
+	// Any known method is matched if empty.
+	Methods []string `json:"methods,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchRTSP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.rtsp",
+		New: func() caddy.Module { return new(MatchRTSP) },
+	}
+}
+
+// Match returns true if the connection starts with an RTSP request.
+func (m *MatchRTSP) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, maxHeaderLength), maxLineLength)
+
+	line, err := byteparser.ReadLine(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return false, nil // Not enough data for RTSP, or a line too long
+		}
+		return false, fmt.Errorf("reading request line: %w", err)
+	}
+
+	// Parse the request line, i.e. Method SP Request-URI SP RTSP-Version
+	method, rest, _ := bytes.Cut(line, []byte(" "))
+	url, version, _ := bytes.Cut(rest, []byte(" "))
+	if !slices.Contains(methods, string(method)) || len(m.Methods) > 0 && !slices.Contains(m.Methods, string(method)) ||
+		!isURL(url) && !bytes.Equal(url, []byte("*")) || !slices.Contains(versions, string(version)) {
+		return false, nil
+	}
+
+	// Find the CSeq header
+	var cseq string
+	for {
+		line, err = byteparser.ReadLine(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+				break // The headers are incomplete or too long, but the request line is enough to match
+			}
+			return false, fmt.Errorf("reading header: %w", err)
+		}
+		if len(line) == 0 {
+			break // This is the end of the headers
+		}
+
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if found && bytes.EqualFold(bytes.TrimSpace(name), []byte("CSeq")) {
+			value = bytes.TrimSpace(value)
+			if byteparser.IsPrintable(value) {
+				cseq = string(value)
+			}
+			break
+		}
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.rtsp.method", string(method))
+	repl.Set("l4.rtsp.url", string(url))
+	repl.Set("l4.rtsp.cseq", cseq)
+	cx.SetProtocol("rtsp")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchRTSP) Provision(_ caddy.Context) error {
+	for _, method := range m.Methods {
+		if !slices.Contains(methods, method) {
+			return fmt.Errorf("unsupported method %s", method)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchRTSP from Caddyfile tokens. Syntax:
+//
+//	rtsp [<methods...>]
+func (m *MatchRTSP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Methods = append(m.Methods, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s option: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// isURL returns true if b looks like an absolute RTSP URL, e.g. rtsp://media.example.com:554/stream.
+func isURL(b []byte) bool {
+	scheme, rest, found := bytes.Cut(b, []byte("://"))
+	if !found || len(rest) == 0 || !byteparser.IsPrintable(rest) {
+		return false
+	}
+	scheme = bytes.ToLower(scheme)
+	return bytes.Equal(scheme, []byte("rtsp")) || bytes.Equal(scheme, []byte("rtsps")) || bytes.Equal(scheme, []byte("rtspu"))
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc2326#section-6
+//	https://www.rfc-editor.org/rfc/rfc7826#section-7
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchRTSP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchRTSP)(nil)
+	_ layer4.ConnMatcher    = (*MatchRTSP)(nil)
+)
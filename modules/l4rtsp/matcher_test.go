@@ -0,0 +1,132 @@
+package l4rtsp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+var describe = []byte("DESCRIBE rtsp://media.example.com:554/live/cam1 RTSP/1.0\r\n" +
+	"CSeq: 2\r\n" +
+	"User-Agent: LibVLC/3.0.20 (LIVE555 Streaming Media v2016.11.28)\r\n" +
+	"Accept: application/sdp\r\n" +
+	"\r\n")
+
+var setup = []byte("SETUP rtsp://media.example.com/live/cam1/trackID=1 RTSP/1.0\r\n" +
+	"Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n" +
+	"cseq: 3\r\n" +
+	"Session: 12345678\r\n" +
+	"\r\n")
+
+var options = []byte("OPTIONS * RTSP/2.0\n" +
+	"CSeq: 1\n" +
+	"\n")
+
+var play = []byte("PLAY rtsps://media.example.com/live/cam1 RTSP/1.0\r\n" +
+	"Range: npt=0.000-\r\n" +
+	"\r\n")
+
+func Test_MatchRTSP_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchRTSP
+		data        []byte
+		shouldMatch bool
+		method      string
+		url         string
+		cseq        string
+	}
+
+	tests := []test{
+		{matcher: &MatchRTSP{}, data: describe, shouldMatch: true, method: "DESCRIBE", url: "rtsp://media.example.com:554/live/cam1", cseq: "2"},
+		{matcher: &MatchRTSP{}, data: setup, shouldMatch: true, method: "SETUP", url: "rtsp://media.example.com/live/cam1/trackID=1", cseq: "3"},
+		{matcher: &MatchRTSP{}, data: options, shouldMatch: true, method: "OPTIONS", url: "*", cseq: "1"},
+		{matcher: &MatchRTSP{}, data: play, shouldMatch: true, method: "PLAY", url: "rtsps://media.example.com/live/cam1"},
+		{matcher: &MatchRTSP{Methods: []string{"DESCRIBE"}}, data: describe, shouldMatch: true, method: "DESCRIBE", url: "rtsp://media.example.com:554/live/cam1", cseq: "2"},
+		{matcher: &MatchRTSP{Methods: []string{"DESCRIBE"}}, data: setup, shouldMatch: false},
+		{matcher: &MatchRTSP{Methods: []string{"DESCRIBE", "SETUP"}}, data: setup, shouldMatch: true, method: "SETUP", url: "rtsp://media.example.com/live/cam1/trackID=1", cseq: "3"},
+
+		// the request line is enough to match, but it must be complete
+		{matcher: &MatchRTSP{}, data: describe[:58], shouldMatch: true, method: "DESCRIBE", url: "rtsp://media.example.com:554/live/cam1"},
+		{matcher: &MatchRTSP{}, data: describe[:57], shouldMatch: false},
+		{matcher: &MatchRTSP{}, data: describe[:20], shouldMatch: false},
+
+		// HTTP requests aren't matched, even with methods or URLs shared with RTSP
+		{matcher: &MatchRTSP{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchRTSP{}, data: []byte("OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchRTSP{}, data: []byte("GET rtsp://media.example.com/live/cam1 RTSP/1.0\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchRTSP{}, data: []byte("DESCRIBE http://media.example.com/live/cam1 RTSP/1.0\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchRTSP{}, data: []byte("describe rtsp://media.example.com/live/cam1 RTSP/1.0\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchRTSP{}, data: []byte("DESCRIBE rtsp://media.example.com/live/cam1 RTSP/3.0\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchRTSP{}, data: []byte("RTSP/1.0 200 OK\r\nCSeq: 2\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchRTSP{}, data: []byte{}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range map[string]string{
+				"l4.rtsp.method": tc.method,
+				"l4.rtsp.url":    tc.url,
+				"l4.rtsp.cseq":   tc.cseq,
+			} {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
+		}()
+	}
+}
+
+func Test_MatchRTSP_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchRTSP{Methods: []string{"GET"}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported method should not be accepted")
+	}
+}
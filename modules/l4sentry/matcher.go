@@ -0,0 +1,170 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4sentry allows the L4 multiplexing of Sentry envelopes
+package l4sentry
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSentry{})
+	layer4.RegisterProtocol("sentry")
+}
+
+// MatchSentry is able to match connections carrying Sentry envelopes, which start with a line of envelope
+// headers in JSON, e.g. {"event_id":"...","dsn":"..."}, followed by a line of item headers in JSON, which
+// include the item type, e.g. {"type":"event","length":42}. The type of the first item is exposed as
+// {l4.sentry.item_type}.
+type MatchSentry struct{}
+
+// envelopeHeaders are the envelope headers validated by MatchSentry, others are ignored.
+type envelopeHeaders struct {
+	EventID *string `json:"event_id"`
+	DSN     *string `json:"dsn"`
+}
+
+// itemHeaders are the item headers validated by MatchSentry, others are ignored.
+type itemHeaders struct {
+	Type   string `json:"type"`
+	Length *int64 `json:"length"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchSentry) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.sentry",
+		New: func() caddy.Module { return new(MatchSentry) },
+	}
+}
+
+// Match returns true if the connection starts with a Sentry envelope.
+func (m *MatchSentry) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, layer4.MaxMatchingBytes), layer4.MaxMatchingBytes)
+
+	// Read and validate the envelope headers
+	line, err := readLine(r)
+	if err != nil || line == nil {
+		return false, err
+	}
+	var envelope envelopeHeaders
+	if !unmarshalObject(line, &envelope) {
+		return false, nil
+	}
+	if envelope.EventID != nil && !validEventID(*envelope.EventID) ||
+		envelope.DSN != nil && !strings.HasPrefix(*envelope.DSN, "http://") && !strings.HasPrefix(*envelope.DSN, "https://") {
+		return false, nil
+	}
+
+	// Read and validate the headers of the first item
+	line, err = readLine(r)
+	if err != nil || line == nil {
+		return false, err
+	}
+	var item itemHeaders
+	if !unmarshalObject(line, &item) || !validItemType(item.Type) || item.Length != nil && *item.Length < 0 {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.sentry.item_type", item.Type)
+	cx.SetProtocol("sentry")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchSentry from Caddyfile tokens. Syntax:
+//
+//	sentry
+func (m *MatchSentry) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// readLine returns the next line of r without the line ending, or nil if there is no complete line.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return nil, nil // Not enough data for a line, or a line too long
+		}
+		return nil, fmt.Errorf("reading line: %w", err)
+	}
+	return line[:len(line)-1], nil
+}
+
+// unmarshalObject returns true if line is a JSON object, which is unmarshaled into v.
+func unmarshalObject(line []byte, v any) bool {
+	if len(line) < 2 || line[0] != '{' {
+		return false
+	}
+	return json.Unmarshal(line, v) == nil
+}
+
+// validEventID returns true if id is a UUID, with or without dashes.
+func validEventID(id string) bool {
+	id = strings.ReplaceAll(id, "-", "")
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// validItemType returns true if typ looks like an item type, e.g. event, transaction or client_report.
+func validItemType(typ string) bool {
+	if typ == "" {
+		return false
+	}
+	for _, c := range typ {
+		if (c < 'a' || c > 'z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// Refs:
+//
+//	https://develop.sentry.dev/sdk/data-model/envelopes/
+//	https://develop.sentry.dev/sdk/data-model/envelope-items/
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchSentry)(nil)
+	_ layer4.ConnMatcher    = (*MatchSentry)(nil)
+)
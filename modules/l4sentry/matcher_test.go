@@ -0,0 +1,99 @@
+package l4sentry
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchSentry(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		wantMatch bool
+		itemType  string
+	}{
+		{
+			name: "Event",
+			input: []byte(`{"event_id":"9ec79c33ec9942ab8353589fcb2e04dc","dsn":"https://e12d836b15bb49d7bbf99e64295d995b@sentry.io/42"}` + "\n" +
+				`{"type":"event","length":41,"content_type":"application/json"}` + "\n" +
+				`{"message":"hello world","level":"error"}` + "\n"),
+			wantMatch: true,
+			itemType:  "event",
+		},
+		{
+			name:      "Empty Headers",
+			input:     []byte("{}\n" + `{"type":"client_report"}` + "\n" + `{"timestamp":1700000000}`),
+			wantMatch: true,
+			itemType:  "client_report",
+		},
+		{
+			name:      "Dashed Event ID",
+			input:     []byte(`{"event_id":"9ec79c33-ec99-42ab-8353-589fcb2e04dc"}` + "\n" + `{"type":"attachment","length":0}` + "\n\n"),
+			wantMatch: true,
+			itemType:  "attachment",
+		},
+		{name: "Invalid Event ID", input: []byte(`{"event_id":"42"}` + "\n" + `{"type":"event"}` + "\n"), wantMatch: false},
+		{name: "Invalid DSN", input: []byte(`{"dsn":"sentry.io"}` + "\n" + `{"type":"event"}` + "\n"), wantMatch: false},
+		{name: "Missing Item Type", input: []byte("{}\n" + `{"length":2}` + "\n{}"), wantMatch: false},
+		{name: "Invalid Item Type", input: []byte("{}\n" + `{"type":42}` + "\n{}"), wantMatch: false},
+		{name: "Negative Length", input: []byte("{}\n" + `{"type":"event","length":-1}` + "\n{}"), wantMatch: false},
+		{name: "Headers Only", input: []byte("{}\n"), wantMatch: false},
+		{name: "Not An Object", input: []byte("[]\n" + `{"type":"event"}` + "\n"), wantMatch: false},
+		{name: "JSON Body", input: []byte(`{"message":"hello world","level":"error"}`), wantMatch: false},
+		{name: "StatsD", input: []byte("page.views:1|c\n"), wantMatch: false},
+		{name: "HTTP", input: []byte("POST /api/42/envelope/ HTTP/1.1\r\nHost: sentry.io\r\n\r\n"), wantMatch: false},
+		{name: "Empty", input: []byte{}, wantMatch: false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher := &MatchSentry{}
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if itemType, _ := repl.GetString("l4.sentry.item_type"); itemType != tc.itemType {
+				t.Fatalf("test %d: unexpected item type | got %q, want %q\n", i, itemType, tc.itemType)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4sip allows the L4 multiplexing of SIP connections
+package l4sip
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSIP{})
+	layer4.RegisterProtocol("sip")
+}
+
+const (
+	maxLineLength   = 1024 // Maximum length of a start line or header line, including the line ending
+	maxHeaderLength = 4096 // Maximum length of the start line and the headers read to find To and From
+
+	sipVersion = "SIP/2.0"
+)
+
+// methods contains all the methods defined by RFC 3261 and its extensions.
+var methods = []string{
+	"ACK", "BYE", "CANCEL", "INFO", "INVITE", "MESSAGE", "NOTIFY",
+	"OPTIONS", "PRACK", "PUBLISH", "REFER", "REGISTER", "SUBSCRIBE", "UPDATE",
+}
+
+// MatchSIP is able to match SIP requests, e.g. INVITE sip:bob@biloxi.example.com SIP/2.0, and responses,
+// e.g. SIP/2.0 200 OK, sent over TCP or UDP. The request method is exposed as {l4.sip.method}, or the
+// response status code as {l4.sip.status_code}. The user parts of the To and From URIs, if any, are exposed
+// as {l4.sip.to_user} and {l4.sip.from_user}, provided these headers are found within the first 4 KiB.
+type MatchSIP struct {
+	// Methods is a list of request methods to match, e.g. INVITE or REGISTER.
+	// If empty, any request with a known method and any response are matched.
+	// Otherwise, responses aren't matched.
+	Methods []string `json:"methods,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchSIP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.sip",
+		New: func() caddy.Module { return new(MatchSIP) },
+	}
+}
+
+// Match returns true if the connection starts with a SIP request or response.
+func (m *MatchSIP) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, maxHeaderLength), maxLineLength)
+
+	line, err := byteparser.ReadLine(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return false, nil // Not enough data for SIP, or a line too long
+		}
+		return false, fmt.Errorf("reading start line: %w", err)
+	}
+
+	// Parse the start line, i.e. Method SP Request-URI SP SIP-Version or SIP-Version SP Status-Code SP Reason-Phrase
+	first, rest, _ := bytes.Cut(line, []byte(" "))
+	second, third, _ := bytes.Cut(rest, []byte(" "))
+	var method, statusCode string
+	if bytes.Equal(first, []byte(sipVersion)) {
+		if len(m.Methods) > 0 || !isStatusCode(second) || !byteparser.IsPrintable(third) {
+			return false, nil
+		}
+		statusCode = string(second)
+	} else {
+		method = string(first)
+		if !slices.Contains(methods, method) || len(m.Methods) > 0 && !slices.Contains(m.Methods, method) ||
+			!isURI(second) || !bytes.Equal(third, []byte(sipVersion)) {
+			return false, nil
+		}
+	}
+
+	// Find the To and From headers, including their compact forms
+	var toUser, fromUser string
+	var hasTo, hasFrom bool
+	for !hasTo || !hasFrom {
+		line, err = byteparser.ReadLine(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+				break // The headers are incomplete or too long, but the start line is enough to match
+			}
+			return false, fmt.Errorf("reading header: %w", err)
+		}
+		if len(line) == 0 {
+			break // This is the end of the headers
+		}
+
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if !found {
+			continue
+		}
+		switch string(bytes.ToLower(bytes.TrimSpace(name))) {
+		case "to", "t":
+			toUser, hasTo = uriUser(value), true
+		case "from", "f":
+			fromUser, hasFrom = uriUser(value), true
+		}
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	if len(method) > 0 {
+		repl.Set("l4.sip.method", method)
+	} else {
+		repl.Set("l4.sip.status_code", statusCode)
+	}
+	repl.Set("l4.sip.to_user", toUser)
+	repl.Set("l4.sip.from_user", fromUser)
+	cx.SetProtocol("sip")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchSIP) Provision(_ caddy.Context) error {
+	for _, method := range m.Methods {
+		if !slices.Contains(methods, method) {
+			return fmt.Errorf("unsupported method %s", method)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchSIP from Caddyfile tokens. Syntax:
+//
+//	sip [<methods...>]
+func (m *MatchSIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Methods = append(m.Methods, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s option: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// isStatusCode returns true if b consists of 3 digits, the first one being 1 to 6.
+func isStatusCode(b []byte) bool {
+	return len(b) == 3 && b[0] >= '1' && b[0] <= '6' && isDigit(b[1]) && isDigit(b[2])
+}
+
+// isURI returns true if b looks like a SIP, SIPS or TEL URI.
+func isURI(b []byte) bool {
+	scheme, rest, found := bytes.Cut(b, []byte(":"))
+	if !found || len(rest) == 0 || !byteparser.IsPrintable(rest) {
+		return false
+	}
+	scheme = bytes.ToLower(scheme)
+	return bytes.Equal(scheme, []byte("sip")) || bytes.Equal(scheme, []byte("sips")) || bytes.Equal(scheme, []byte("tel"))
+}
+
+// uriUser returns the user part of the URI of a To or From header value, e.g. "Bob" <sip:bob@biloxi.example.com>;tag=a6c85cf
+// or sip:bob@biloxi.example.com;tag=a6c85cf, or an empty string if there is none.
+func uriUser(value []byte) string {
+	value = bytes.TrimSpace(value)
+	if start := bytes.IndexByte(value, '<'); start >= 0 {
+		value = value[start+1:]
+		if end := bytes.IndexByte(value, '>'); end >= 0 {
+			value = value[:end]
+		}
+	} else {
+		value, _, _ = bytes.Cut(value, []byte(";"))
+	}
+
+	_, value, found := bytes.Cut(value, []byte(":"))
+	if !found {
+		return ""
+	}
+	userinfo, _, found := bytes.Cut(value, []byte("@"))
+	if !found {
+		return ""
+	}
+	user, _, _ := bytes.Cut(userinfo, []byte(":"))
+	if !byteparser.IsPrintable(user) {
+		return ""
+	}
+	return string(user)
+}
+
+// isDigit returns true if c is an ASCII digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc3261#section-7
+//	https://www.rfc-editor.org/rfc/rfc3261#section-20.20
+//	https://www.rfc-editor.org/rfc/rfc3261#section-20.39
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchSIP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchSIP)(nil)
+	_ layer4.ConnMatcher    = (*MatchSIP)(nil)
+)
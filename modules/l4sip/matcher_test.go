@@ -0,0 +1,147 @@
+package l4sip
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+var invite = []byte("INVITE sip:bob@biloxi.example.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP pc33.atlanta.example.com;branch=z9hG4bK776asdhds\r\n" +
+	"Max-Forwards: 70\r\n" +
+	"To: Bob <sip:bob@biloxi.example.com>\r\n" +
+	"From: \"Alice\" <sip:alice:secret@atlanta.example.com>;tag=1928301774\r\n" +
+	"Call-ID: a84b4c76e66710@pc33.atlanta.example.com\r\n" +
+	"CSeq: 314159 INVITE\r\n" +
+	"Contact: <sip:alice@pc33.atlanta.example.com>\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n")
+
+var register = []byte("REGISTER sips:registrar.biloxi.example.com SIP/2.0\r\n" +
+	"v: SIP/2.0/TLS bobspc.biloxi.example.com:5061;branch=z9hG4bKnashds7\r\n" +
+	"t: sips:bob@biloxi.example.com\r\n" +
+	"f: sips:bob@biloxi.example.com;tag=456248\r\n" +
+	"i: 843817637684230@998sdasdh09\r\n" +
+	"CSeq: 1826 REGISTER\r\n" +
+	"l: 0\r\n" +
+	"\r\n")
+
+var ok = []byte("SIP/2.0 200 OK\r\n" +
+	"Via: SIP/2.0/UDP server10.biloxi.example.com;branch=z9hG4bKnashds8;received=192.0.2.3\r\n" +
+	"To: Bob <sip:bob@biloxi.example.com>;tag=a6c85cf\r\n" +
+	"From: Alice <sip:alice@atlanta.example.com>;tag=1928301774\r\n" +
+	"Call-ID: a84b4c76e66710\r\n" +
+	"CSeq: 314159 INVITE\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n")
+
+var options = []byte("OPTIONS sip:carol@chicago.example.com SIP/2.0\n" +
+	"To: <tel:+1-212-555-0100>\n" +
+	"\n")
+
+func Test_MatchSIP_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchSIP
+		data        []byte
+		shouldMatch bool
+		method      string
+		statusCode  string
+		toUser      string
+		fromUser    string
+	}
+
+	tests := []test{
+		{matcher: &MatchSIP{}, data: invite, shouldMatch: true, method: "INVITE", toUser: "bob", fromUser: "alice"},
+		{matcher: &MatchSIP{}, data: register, shouldMatch: true, method: "REGISTER", toUser: "bob", fromUser: "bob"},
+		{matcher: &MatchSIP{}, data: ok, shouldMatch: true, statusCode: "200", toUser: "bob", fromUser: "alice"},
+		{matcher: &MatchSIP{}, data: options, shouldMatch: true, method: "OPTIONS"},
+		{matcher: &MatchSIP{Methods: []string{"INVITE"}}, data: invite, shouldMatch: true, method: "INVITE", toUser: "bob", fromUser: "alice"},
+		{matcher: &MatchSIP{Methods: []string{"INVITE"}}, data: register, shouldMatch: false},
+		{matcher: &MatchSIP{Methods: []string{"INVITE", "REGISTER"}}, data: register, shouldMatch: true, method: "REGISTER", toUser: "bob", fromUser: "bob"},
+		{matcher: &MatchSIP{Methods: []string{"INVITE"}}, data: ok, shouldMatch: false},
+
+		// the start line is enough to match
+		{matcher: &MatchSIP{}, data: invite[:43], shouldMatch: true, method: "INVITE"},
+		{matcher: &MatchSIP{}, data: invite[:42], shouldMatch: false},
+
+		{matcher: &MatchSIP{}, data: []byte("invite sip:bob@biloxi.example.com SIP/2.0\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchSIP{}, data: []byte("INVITE http://biloxi.example.com/ SIP/2.0\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchSIP{}, data: []byte("INVITE sip:bob@biloxi.example.com SIP/3.0\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchSIP{}, data: []byte("SIP/2.0 OK\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchSIP{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchSIP{}, data: []byte("HTTP/1.1 200 OK\r\n\r\n"), shouldMatch: false},
+		{matcher: &MatchSIP{}, data: []byte("Hello World\r\n"), shouldMatch: false},
+		{matcher: &MatchSIP{}, data: []byte{}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range map[string]string{
+				"l4.sip.method":      tc.method,
+				"l4.sip.status_code": tc.statusCode,
+				"l4.sip.to_user":     tc.toUser,
+				"l4.sip.from_user":   tc.fromUser,
+			} {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
+		}()
+	}
+}
+
+func Test_MatchSIP_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchSIP{Methods: []string{"invite"}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported method should not be accepted")
+	}
+}
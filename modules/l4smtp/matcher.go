@@ -0,0 +1,190 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4smtp allows the L4 multiplexing of SMTP connections
+package l4smtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSMTP{})
+	layer4.RegisterProtocol("smtp")
+}
+
+const maxLineLength = 512 // Maximum length of a command or reply line, including the line ending
+
+// MatchSMTP is able to match SMTP connections. Since SMTP is server-first, a client only sends
+// its EHLO or HELO command once it has received the server's greeting, so something has to send
+// the greeting first, e.g. a negotiate handler. The command and the client's hostname are exposed
+// as {l4.smtp.command} and {l4.smtp.hostname}. Alternatively, the matcher can match the server's
+// greeting itself, which is useful where the connecting peer is an SMTP server, e.g. with reverse
+// tunnels. In this case, the greeting text following the 220 reply code is exposed as {l4.smtp.banner}.
+// Commands are matched case-insensitively, and lines may end with CRLF or a bare LF.
+type MatchSMTP struct {
+	// Banner makes the matcher match the server's 220 greeting instead of the client's EHLO or HELO.
+	Banner bool `json:"banner,omitempty"`
+
+	// RequireStartTLS makes the matcher only match clients starting with EHLO immediately followed
+	// by STARTTLS. It requires the client's EHLO to have been replied to with the STARTTLS extension,
+	// e.g. by a negotiate handler. It can't be combined with Banner.
+	RequireStartTLS bool `json:"require_starttls,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchSMTP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.smtp",
+		New: func() caddy.Module { return new(MatchSMTP) },
+	}
+}
+
+// Match returns true if the connection starts with an SMTP EHLO or HELO command,
+// or with an SMTP greeting if m.Banner is true.
+func (m *MatchSMTP) Match(cx *layer4.Connection) (bool, error) {
+	r := bufio.NewReaderSize(io.LimitReader(cx, 2*maxLineLength), maxLineLength)
+
+	line, err := byteparser.ReadLine(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return false, nil // Not enough data for SMTP, or a line too long
+		}
+		return false, fmt.Errorf("reading line: %w", err)
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+
+	// Match the greeting, e.g. 220 mx.example.com ESMTP ready, or its first line if multiline
+	if m.Banner {
+		if len(line) < 3 || !bytes.Equal(line[:3], []byte("220")) ||
+			len(line) > 3 && line[3] != ' ' && line[3] != '-' || !byteparser.IsPrintable(line) {
+			return false, nil
+		}
+		repl.Set("l4.smtp.banner", string(bytes.TrimSpace(bytes.TrimPrefix(line[3:], []byte("-")))))
+		cx.SetProtocol("smtp")
+		return true, nil
+	}
+
+	// Match the command, e.g. EHLO client.example.com or HELO [192.0.2.1]
+	verb, hostname, _ := bytes.Cut(line, []byte(" "))
+	verb = bytes.ToUpper(verb)
+	hostname, _, _ = bytes.Cut(hostname, []byte(" "))
+	if !bytes.Equal(verb, []byte("EHLO")) && !bytes.Equal(verb, []byte("HELO")) ||
+		len(hostname) == 0 || !byteparser.IsPrintable(hostname) {
+		return false, nil
+	}
+
+	// Match STARTTLS following EHLO
+	if m.RequireStartTLS {
+		if !bytes.Equal(verb, []byte("EHLO")) {
+			return false, nil
+		}
+		hostname = bytes.Clone(hostname) // Reading the next line overwrites the buffer
+		line, err = byteparser.ReadLine(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrBufferFull) {
+				return false, nil // Not enough data for STARTTLS, or a line too long
+			}
+			return false, fmt.Errorf("reading line: %w", err)
+		}
+		if !bytes.EqualFold(bytes.TrimRight(line, " "), []byte("STARTTLS")) {
+			return false, nil
+		}
+	}
+
+	repl.Set("l4.smtp.command", string(verb))
+	repl.Set("l4.smtp.hostname", string(hostname))
+	cx.SetProtocol("smtp")
+
+	return true, nil
+}
+
+// Provision validates m.
+func (m *MatchSMTP) Provision(_ caddy.Context) error {
+	if m.Banner && m.RequireStartTLS {
+		return errors.New("banner and require_starttls can't be combined")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchSMTP from Caddyfile tokens. Syntax:
+//
+//	smtp {
+//		banner
+//		require_starttls
+//	}
+//	smtp
+func (m *MatchSMTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "banner":
+			if m.Banner {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			m.Banner = true
+		case "require_starttls":
+			if m.RequireStartTLS {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			m.RequireStartTLS = true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc5321#section-4.1.1.1
+//	https://www.rfc-editor.org/rfc/rfc5321#section-4.2
+//	https://www.rfc-editor.org/rfc/rfc3207
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchSMTP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchSMTP)(nil)
+	_ layer4.ConnMatcher    = (*MatchSMTP)(nil)
+)
@@ -0,0 +1,113 @@
+package l4smtp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchSMTP(t *testing.T) {
+	tests := []struct {
+		name      string
+		matcher   *MatchSMTP
+		input     string
+		wantMatch bool
+		command   string
+		hostname  string
+		banner    string
+	}{
+		{name: "EHLO", matcher: &MatchSMTP{}, input: "EHLO client.example.com\r\n", wantMatch: true, command: "EHLO", hostname: "client.example.com"},
+		{name: "HELO", matcher: &MatchSMTP{}, input: "HELO client.example.com\r\n", wantMatch: true, command: "HELO", hostname: "client.example.com"},
+		{name: "Lower Case, Bare LF", matcher: &MatchSMTP{}, input: "ehlo client.example.com\n", wantMatch: true, command: "EHLO", hostname: "client.example.com"},
+		{name: "Address Literal", matcher: &MatchSMTP{}, input: "EHLO [192.0.2.1]\r\n", wantMatch: true, command: "EHLO", hostname: "[192.0.2.1]"},
+		{name: "No Hostname", matcher: &MatchSMTP{}, input: "EHLO\r\n", wantMatch: false},
+		{name: "Other Command", matcher: &MatchSMTP{}, input: "MAIL FROM:<alice@example.com>\r\n", wantMatch: false},
+		{name: "Incomplete Line", matcher: &MatchSMTP{}, input: "EHLO client.example.com", wantMatch: false},
+		{name: "Line Too Long", matcher: &MatchSMTP{}, input: "EHLO " + strings.Repeat("a", maxLineLength) + "\r\n", wantMatch: false},
+		{name: "Banner as Client", matcher: &MatchSMTP{}, input: "220 mx.example.com ESMTP Postfix\r\n", wantMatch: false},
+		{name: "STARTTLS", matcher: &MatchSMTP{RequireStartTLS: true}, input: "EHLO client.example.com\r\nSTARTTLS\r\n", wantMatch: true, command: "EHLO", hostname: "client.example.com"},
+		{name: "STARTTLS, Bare LF", matcher: &MatchSMTP{RequireStartTLS: true}, input: "EHLO client.example.com\nstarttls\n", wantMatch: true, command: "EHLO", hostname: "client.example.com"},
+		{name: "No STARTTLS", matcher: &MatchSMTP{RequireStartTLS: true}, input: "EHLO client.example.com\r\nMAIL FROM:<alice@example.com>\r\n", wantMatch: false},
+		{name: "STARTTLS After HELO", matcher: &MatchSMTP{RequireStartTLS: true}, input: "HELO client.example.com\r\nSTARTTLS\r\n", wantMatch: false},
+		{name: "Banner", matcher: &MatchSMTP{Banner: true}, input: "220 mx.example.com ESMTP Postfix\r\n", wantMatch: true, banner: "mx.example.com ESMTP Postfix"},
+		{name: "Multiline Banner", matcher: &MatchSMTP{Banner: true}, input: "220-mx.example.com ESMTP\n220 ready\n", wantMatch: true, banner: "mx.example.com ESMTP"},
+		{name: "Bare Banner", matcher: &MatchSMTP{Banner: true}, input: "220\r\n", wantMatch: true, banner: ""},
+		{name: "Service Not Available", matcher: &MatchSMTP{Banner: true}, input: "421 mx.example.com Service not available\r\n", wantMatch: false},
+		{name: "Other Reply Code", matcher: &MatchSMTP{Banner: true}, input: "2200 mx.example.com\r\n", wantMatch: false},
+		{name: "EHLO as Banner", matcher: &MatchSMTP{Banner: true}, input: "EHLO client.example.com\r\n", wantMatch: false},
+		{name: "Empty", matcher: &MatchSMTP{}, input: "", wantMatch: false},
+		{name: "HTTP", matcher: &MatchSMTP{}, input: "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", wantMatch: false},
+		{name: "TLS", matcher: &MatchSMTP{}, input: "\x16\x03\x01\x00\xf4\x01\x00\x00\xf0\x03\x03\n", wantMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write([]byte(tc.input))
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			command, _ := repl.GetString("l4.smtp.command")
+			hostname, _ := repl.GetString("l4.smtp.hostname")
+			banner, _ := repl.GetString("l4.smtp.banner")
+			if command != tc.command || hostname != tc.hostname || banner != tc.banner {
+				t.Fatalf("test %d: unexpected vars | got %q, %q and %q, want %q, %q and %q\n",
+					i, command, hostname, banner, tc.command, tc.hostname, tc.banner)
+			}
+		})
+	}
+}
+
+func TestMatchSMTP_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchSMTP{Banner: true, RequireStartTLS: true}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("banner and require_starttls should not be accepted together")
+	}
+}
@@ -18,6 +18,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&Socks4Matcher{})
+	layer4.RegisterProtocol("socks4")
 }
 
 // Socks4Matcher matches SOCKSv4 connections according to https://www.openssh.com/txt/socks4.protocol.
@@ -111,6 +112,7 @@ func (m *Socks4Matcher) Match(cx *layer4.Connection) (bool, error) {
 		}
 	}
 
+	cx.SetProtocol("socks4")
 	return true, nil
 }
 
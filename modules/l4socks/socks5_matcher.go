@@ -1,6 +1,7 @@
 package l4socks
 
 import (
+	"errors"
 	"io"
 	"slices"
 	"strconv"
@@ -13,14 +14,23 @@ import (
 
 func init() {
 	caddy.RegisterModule(&Socks5Matcher{})
+	layer4.RegisterProtocol("socks5")
 }
 
 // Socks5Matcher matches SOCKSv5 connections according to RFC 1928 (https://www.rfc-editor.org/rfc/rfc1928.html).
 // Since the SOCKSv5 header is very short it could produce a lot of false positives,
 // use AuthMethods to exactly specify which METHODS you expect your clients to send.
 // By default, only the most common methods are matched NO AUTH, GSSAPI & USERNAME/PASSWORD.
+//
+// If the client offers USERNAME/PASSWORD and the username/password sub-negotiation according to
+// RFC 1929 (https://www.rfc-editor.org/rfc/rfc1929.html) follows the greeting, the username is
+// exposed as {l4.socks.username}. Since clients only send it once the server has selected this
+// method, a handler replying to the greeting is required, e.g. negotiate. Connections lacking it,
+// e.g. those using NO AUTH, still match unless Usernames are specified.
 type Socks5Matcher struct {
 	AuthMethods []uint16 `json:"auth_methods,omitempty"`
+	// Usernames, if not empty, restricts matching to connections authenticating with one of these usernames.
+	Usernames []string `json:"usernames,omitempty"`
 }
 
 func (*Socks5Matcher) CaddyModule() caddy.ModuleInfo {
@@ -67,6 +77,35 @@ func (m *Socks5Matcher) Match(cx *layer4.Connection) (bool, error) {
 		}
 	}
 
+	// read the username/password sub-negotiation if the client offered this method and sent anything else
+	var username []byte
+	if slices.Contains(methods, socks5MethodUsernamePassword) {
+		_, err = io.ReadFull(cx, buf)
+		switch {
+		case err == nil && buf[0] == socks5UsernamePasswordVersion:
+			if username, err = readSocks5Username(cx); err != nil {
+				return false, err
+			}
+			if username == nil {
+				return false, nil
+			}
+		case err != nil && (len(m.Usernames) > 0 ||
+			!errors.Is(err, io.EOF) && !errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes)):
+			return false, err
+		}
+	}
+
+	// match usernames
+	if len(m.Usernames) > 0 && !slices.Contains(m.Usernames, string(username)) {
+		return false, nil
+	}
+
+	if username != nil {
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		repl.Set("l4.socks.username", string(username))
+	}
+
+	cx.SetProtocol("socks5")
 	return true, nil
 }
 
@@ -74,9 +113,12 @@ func (m *Socks5Matcher) Match(cx *layer4.Connection) (bool, error) {
 //
 //	socks5 {
 //		auth_methods <auth_methods...>
+//		usernames <usernames...>
 //	}
 //
 // socks5
+//
+// Note: multiple usernames options are supported.
 func (m *Socks5Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	_, wrapper := d.Next(), d.Val() // consume wrapper name
 
@@ -99,6 +141,11 @@ func (m *Socks5Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 				m.AuthMethods = append(m.AuthMethods, uint16(authMethod))
 			}
+		case "usernames":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.Usernames = append(m.Usernames, d.RemainingArgs()...)
 		default:
 			return d.ArgErr()
 		}
@@ -112,6 +159,38 @@ func (m *Socks5Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// readSocks5Username reads the rest of the username/password sub-negotiation following its version byte
+// and returns the username, or nil if the sub-negotiation is malformed.
+func readSocks5Username(cx *layer4.Connection) ([]byte, error) {
+	// read username length and username
+	buf := []byte{0}
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] == 0 {
+		return nil, nil
+	}
+	username := make([]byte, buf[0])
+	if _, err := io.ReadFull(cx, username); err != nil {
+		return nil, err
+	}
+
+	// read password length and password, so that the sub-negotiation is known to be complete
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(cx, make([]byte, buf[0])); err != nil {
+		return nil, err
+	}
+
+	return username, nil
+}
+
+const (
+	socks5MethodUsernamePassword  = 2 // USERNAME/PASSWORD auth method
+	socks5UsernamePasswordVersion = 1 // version of the username/password sub-negotiation
+)
+
 var (
 	_ layer4.ConnMatcher    = (*Socks5Matcher)(nil)
 	_ caddy.Provisioner     = (*Socks5Matcher)(nil)
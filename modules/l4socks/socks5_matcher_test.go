@@ -2,6 +2,7 @@ package l4socks
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"testing"
@@ -75,3 +76,78 @@ func TestSocks5Matcher_Match(t *testing.T) {
 		}()
 	}
 }
+
+func TestSocks5Matcher_Match_Username(t *testing.T) {
+	noAuth := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x50}
+	userPass := []byte{0x05, 0x02, 0x00, 0x02, 0x01, 0x05, 'a', 'l', 'i', 'c', 'e', 0x06, 's', 'e', 'c', 'r', 'e', 't'}
+	userPassGreetingOnly := userPass[:4]
+	userPassTruncated := userPass[:12]
+	userPassEmptyUsername := []byte{0x05, 0x01, 0x02, 0x01, 0x00, 0x06, 's', 'e', 'c', 'r', 'e', 't'}
+	userPassBadVersion := []byte{0x05, 0x01, 0x02, 0x05, 0x05, 'a', 'l', 'i', 'c', 'e', 0x00}
+
+	type test struct {
+		matcher     *Socks5Matcher
+		data        []byte
+		shouldMatch bool
+		username    string
+	}
+
+	tests := []test{
+		// match with defaults, exposing the username if available
+		{matcher: &Socks5Matcher{}, data: noAuth, shouldMatch: true},
+		{matcher: &Socks5Matcher{}, data: userPass, shouldMatch: true, username: "alice"},
+		{matcher: &Socks5Matcher{}, data: userPassGreetingOnly, shouldMatch: true},
+		{matcher: &Socks5Matcher{}, data: userPassTruncated, shouldMatch: false},
+		{matcher: &Socks5Matcher{}, data: userPassEmptyUsername, shouldMatch: false},
+		{matcher: &Socks5Matcher{}, data: userPassBadVersion, shouldMatch: true},
+
+		// match allowed usernames only
+		{matcher: &Socks5Matcher{Usernames: []string{"bob", "alice"}}, data: userPass, shouldMatch: true, username: "alice"},
+		{matcher: &Socks5Matcher{Usernames: []string{"bob"}}, data: userPass, shouldMatch: false},
+		{matcher: &Socks5Matcher{Usernames: []string{"alice"}}, data: noAuth, shouldMatch: false},
+		{matcher: &Socks5Matcher{Usernames: []string{"alice"}}, data: userPassGreetingOnly, shouldMatch: false},
+		{matcher: &Socks5Matcher{Usernames: []string{"alice"}}, data: userPassBadVersion, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			// truncated sub-negotiations are waited for, so reading them fails here
+			matched, err := tc.matcher.Match(cx)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if username, _ := repl.GetString("l4.socks.username"); username != tc.username {
+				t.Fatalf("test %d: unexpected username | got %q, want %q\n", i, username, tc.username)
+			}
+		}()
+	}
+}
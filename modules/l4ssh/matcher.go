@@ -26,6 +26,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchSSH{})
+	layer4.RegisterProtocol("ssh")
 }
 
 // MatchSSH is able to match SSH connections.
@@ -46,7 +47,11 @@ func (m *MatchSSH) Match(cx *layer4.Connection) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return bytes.Equal(p, sshPrefix), nil
+	if !bytes.Equal(p, sshPrefix) {
+		return false, nil
+	}
+	cx.SetProtocol("ssh")
+	return true, nil
 }
 
 var sshPrefix = []byte("SSH-")
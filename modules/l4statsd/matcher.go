@@ -0,0 +1,219 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4statsd allows the L4 multiplexing of StatsD connections
+package l4statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchStatsD{})
+	layer4.RegisterProtocol("statsd")
+}
+
+// types are the metric types of StatsD: counters, gauges, timers, histograms, sets and distributions (DogStatsD).
+var types = []string{"c", "g", "ms", "h", "s", "d"}
+
+// MatchStatsD is able to match StatsD connections, i.e. datagrams made of one or more metric lines like
+// "name:value|type", optionally followed by a sample rate (|@0.1), tags (|#key:value,...) and other
+// DogStatsD fields. All lines of the datagram must be valid. The type of the first metric (c, g, ms, h,
+// s or d) is exposed as {l4.statsd.type}.
+type MatchStatsD struct {
+	// Types is an optional list of metric types the first metric must have to be matched.
+	// Any type is matched if empty.
+	Types []string `json:"types,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchStatsD) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.statsd",
+		New: func() caddy.Module { return new(MatchStatsD) },
+	}
+}
+
+// Match returns true if the connection looks like StatsD.
+func (m *MatchStatsD) Match(cx *layer4.Connection) (bool, error) {
+	// Read the whole datagram, as far as it can be matched
+	buf := make([]byte, layer4.MaxMatchingBytes)
+	n, err := readDatagram(cx, buf)
+	if err != nil {
+		return false, fmt.Errorf("reading datagram: %w", err)
+	}
+	buf = buf[:n]
+
+	var first string
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			continue
+		}
+		typ, ok := parseMetric(line)
+		if !ok {
+			return false, nil
+		}
+		if first == "" {
+			first = typ
+		}
+	}
+	if first == "" || len(m.Types) > 0 && !slices.Contains(m.Types, first) {
+		return false, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.statsd.type", first)
+	cx.SetProtocol("statsd")
+
+	return true, nil
+}
+
+// Provision validates m's types.
+func (m *MatchStatsD) Provision(_ caddy.Context) error {
+	for _, typ := range m.Types {
+		if !slices.Contains(types, typ) {
+			return fmt.Errorf("unsupported type '%s'", typ)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchStatsD from Caddyfile tokens. Syntax:
+//
+//	statsd [<c|g|ms|h|s|d...>]
+func (m *MatchStatsD) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Types = append(m.Types, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// parseMetric returns the type of a metric line and true if it's valid.
+func parseMetric(line []byte) (string, bool) {
+	name, rest, ok := bytes.Cut(line, []byte(":"))
+	if !ok || !validName(name) {
+		return "", false
+	}
+
+	fields := bytes.Split(rest, []byte("|"))
+	if len(fields) < 2 {
+		return "", false
+	}
+	typ := string(fields[1])
+	if !slices.Contains(types, typ) {
+		return "", false
+	}
+
+	// DogStatsD allows several values in one line, sets have a single value of any kind
+	values := bytes.Split(fields[0], []byte(":"))
+	if typ == "s" {
+		if len(values) != 1 || !validName(values[0]) {
+			return "", false
+		}
+	} else {
+		for _, value := range values {
+			if _, err := strconv.ParseFloat(string(value), 64); err != nil {
+				return "", false
+			}
+		}
+	}
+
+	for _, field := range fields[2:] {
+		if !validField(field) {
+			return "", false
+		}
+	}
+
+	return typ, true
+}
+
+// validField returns true if field is a sample rate, tags, a container ID or a timestamp.
+func validField(field []byte) bool {
+	switch {
+	case bytes.HasPrefix(field, []byte("@")):
+		rate, err := strconv.ParseFloat(string(field[1:]), 64)
+		return err == nil && rate > 0 && rate <= 1
+	case bytes.HasPrefix(field, []byte("#")):
+		return len(field) > 1 && printable(field[1:])
+	case bytes.HasPrefix(field, []byte("c:")):
+		return len(field) > 2 && printable(field[2:])
+	case bytes.HasPrefix(field, []byte("T")):
+		_, err := strconv.ParseUint(string(field[1:]), 10, 64)
+		return err == nil
+	default:
+		return false
+	}
+}
+
+// validName returns true if b is a non-empty metric name or set value, i.e. made of printable characters
+// other than spaces and the separators of metric lines.
+func validName(b []byte) bool {
+	return len(b) > 0 && printable(b) && bytes.IndexAny(b, " :|") < 0
+}
+
+// printable returns true if b is made of printable ASCII characters only.
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// readDatagram reads from cx into buf until it's full or no bytes remain, and returns the number of bytes read.
+// Since StatsD is UDP-based, all the bytes of a datagram are available at once, so nothing is waited for.
+func readDatagram(cx *layer4.Connection, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		nn, err := cx.Read(buf[n:])
+		n += nn
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+				break
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Refs:
+//
+//	https://github.com/statsd/statsd/blob/master/docs/metric_types.md
+//	https://docs.datadoghq.com/developers/dogstatsd/datagram_shell/
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchStatsD)(nil)
+	_ caddyfile.Unmarshaler = (*MatchStatsD)(nil)
+	_ layer4.ConnMatcher    = (*MatchStatsD)(nil)
+)
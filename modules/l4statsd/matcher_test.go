@@ -0,0 +1,103 @@
+package l4statsd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestMatchStatsD(t *testing.T) {
+	tests := []struct {
+		name      string
+		matcher   *MatchStatsD
+		input     []byte
+		wantMatch bool
+		typ       string
+	}{
+		{name: "Counter", matcher: &MatchStatsD{}, input: []byte("page.views:1|c"), wantMatch: true, typ: "c"},
+		{name: "Counter Sampled", matcher: &MatchStatsD{}, input: []byte("page.views:1|c|@0.1\n"), wantMatch: true, typ: "c"},
+		{name: "Timing", matcher: &MatchStatsD{}, input: []byte("request.duration:320|ms"), wantMatch: true, typ: "ms"},
+		{name: "Gauge Delta", matcher: &MatchStatsD{}, input: []byte("queue.size:-10|g"), wantMatch: true, typ: "g"},
+		{name: "Set", matcher: &MatchStatsD{}, input: []byte("users.unique:user-42|s"), wantMatch: true, typ: "s"},
+		{name: "DogStatsD", matcher: &MatchStatsD{}, input: []byte("request.size:1:2.5:3|d|#env:prod,region:eu|c:83a1b2|T1700000000"), wantMatch: true, typ: "d"},
+		{name: "Several Lines", matcher: &MatchStatsD{}, input: []byte("request.duration:320|ms\npage.views:1|c\n"), wantMatch: true, typ: "ms"},
+		{name: "Type Allowed", matcher: &MatchStatsD{Types: []string{"ms", "h"}}, input: []byte("request.duration:320|ms"), wantMatch: true, typ: "ms"},
+		{name: "Type Not Allowed", matcher: &MatchStatsD{Types: []string{"c"}}, input: []byte("request.duration:320|ms"), wantMatch: false},
+		{name: "Unknown Type", matcher: &MatchStatsD{}, input: []byte("page.views:1|x"), wantMatch: false},
+		{name: "Missing Type", matcher: &MatchStatsD{}, input: []byte("page.views:1"), wantMatch: false},
+		{name: "Invalid Value", matcher: &MatchStatsD{}, input: []byte("page.views:many|c"), wantMatch: false},
+		{name: "Invalid Sample Rate", matcher: &MatchStatsD{}, input: []byte("page.views:1|c|@2"), wantMatch: false},
+		{name: "Unknown Field", matcher: &MatchStatsD{}, input: []byte("page.views:1|c|x"), wantMatch: false},
+		{name: "Invalid Second Line", matcher: &MatchStatsD{}, input: []byte("page.views:1|c\nhello"), wantMatch: false},
+		{name: "Graphite", matcher: &MatchStatsD{}, input: []byte("servers.web01.cpu 1.5 1700000000\n"), wantMatch: false},
+		{name: "HTTP", matcher: &MatchStatsD{}, input: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantMatch: false},
+		{name: "DNS", matcher: &MatchStatsD{}, input: []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, wantMatch: false},
+		{name: "Empty", matcher: &MatchStatsD{}, input: []byte{}, wantMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+			go func() {
+				_, err := in.Write(tc.input)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+
+			if matched != tc.wantMatch {
+				if tc.wantMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.name)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.name)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if typ, _ := repl.GetString("l4.statsd.type"); typ != tc.typ {
+				t.Fatalf("test %d: unexpected type | got %q, want %q\n", i, typ, tc.typ)
+			}
+		})
+	}
+}
+
+func TestMatchStatsD_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchStatsD{Types: []string{"counter"}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported type should not be accepted")
+	}
+}
@@ -0,0 +1,316 @@
+package l4streamevents
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// testHandler is a terminal connection handler that reads a 5-byte request and writes a 6-byte response.
+type testHandler struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*testHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.test_handler",
+		New: func() caddy.Module { return new(testHandler) },
+	}
+}
+
+// Handle handles the connections.
+func (h *testHandler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return err
+	}
+	_, err := cx.Write([]byte("world!"))
+	return err
+}
+
+func init() {
+	caddy.RegisterModule(&testHandler{})
+}
+
+// natsMessage is a message published to a natsSink.
+type natsMessage struct {
+	subject string
+	payload []byte
+}
+
+// natsSink is an in-process NATS server accepting published messages.
+type natsSink struct {
+	ln       net.Listener
+	messages chan natsMessage
+	connects chan string
+}
+
+// newNATSSink starts a natsSink listening on a random local port, which requires a password if pass isn't empty.
+func newNATSSink(t *testing.T, pass string) *natsSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	s := &natsSink{ln: ln, messages: make(chan natsMessage, 100), connects: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, pass)
+		}
+	}()
+	return s
+}
+
+// serve speaks the server side of the NATS protocol with conn.
+func (s *natsSink) serve(conn net.Conn, pass string) {
+	defer func() { _ = conn.Close() }()
+
+	_, _ = fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"auth_required\":%t,\"max_payload\":1024}\r\n", len(pass) > 0)
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op, args, _ := strings.Cut(line, " ")
+		switch op {
+		case "CONNECT":
+			s.connects <- args
+			if len(pass) > 0 && !strings.Contains(args, `"pass":"`+pass+`"`) {
+				_, _ = conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+				return
+			}
+		case "PING":
+			_, _ = conn.Write([]byte("PONG\r\n"))
+		case "PUB":
+			subject, size, _ := strings.Cut(args, " ")
+			n, err := strconv.Atoi(size)
+			if err != nil {
+				return
+			}
+			payload := make([]byte, n+2)
+			if _, err = io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.messages <- natsMessage{subject: subject, payload: payload[:n]}
+		}
+	}
+}
+
+// next returns the next message published to s, or fails if none is published in time.
+func (s *natsSink) next(t *testing.T) (string, *event) {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		ev := &event{}
+		if err := json.Unmarshal(msg.payload, ev); err != nil {
+			t.Fatalf("unexpected payload %q: %v", msg.payload, err)
+		}
+		return msg.subject, ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message published")
+		return "", nil
+	}
+}
+
+func TestHandler_Handle(t *testing.T) {
+	sink := newNATSSink(t, "secret")
+	to := "nats://caddy:secret@" + sink.ln.Addr().String()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	routes := layer4.RouteList{
+		&layer4.Route{
+			HandlersRaw: []json.RawMessage{
+				json.RawMessage(`{"handler":"stream_events","to":"` + to + `","subject":"audit.l4"}`),
+				json.RawMessage(`{"handler":"test_handler"}`),
+			},
+		},
+	}
+	err := routes.Provision(ctx)
+	assertNoError(t, err)
+
+	compiledRoute := routes.Compile(zap.NewNop(), 100*time.Millisecond, layer4.HandlerFunc(func(*layer4.Connection) error {
+		return nil
+	}))
+
+	for _, request := range []string{"hello", "hi"} {
+		in, out := net.Pipe()
+		cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+		go func() {
+			_, _ = in.Write([]byte(request))
+			_, _ = io.Copy(io.Discard, in)
+		}()
+		go func() {
+			// the second request is too short for the test handler
+			time.Sleep(50 * time.Millisecond)
+			_ = in.Close()
+		}()
+
+		err = compiledRoute.Handle(cx)
+		_ = cx.Close()
+		if request == "hello" {
+			assertNoError(t, err)
+		}
+	}
+
+	if connect := <-sink.connects; !strings.Contains(connect, `"user":"caddy"`) || !strings.Contains(connect, `"verbose":false`) {
+		t.Fatalf("unexpected CONNECT | %s\n", connect)
+	}
+
+	var ids []string
+	for i, want := range []event{
+		{Type: eventOpen, Remote: "pipe", Local: "pipe", Route: "0"},
+		{Type: eventClose, Remote: "pipe", Local: "pipe", Route: "0", Read: 5, Written: 6},
+		{Type: eventOpen, Remote: "pipe", Local: "pipe", Route: "0"},
+		{Type: eventClose, Remote: "pipe", Local: "pipe", Route: "0", Read: 2, Error: "unexpected EOF"},
+	} {
+		subject, ev := sink.next(t)
+		if subject != "audit.l4" {
+			t.Fatalf("test %d: unexpected subject | got %s, want %s\n", i, subject, "audit.l4")
+		}
+		if ev.Type != want.Type || ev.Remote != want.Remote || ev.Local != want.Local || ev.Route != want.Route ||
+			ev.Read != want.Read || ev.Written != want.Written || ev.Error != want.Error || len(ev.ID) == 0 {
+			t.Fatalf("test %d: unexpected event | got %+v, want %+v\n", i, ev, want)
+		}
+		if ev.Type == eventClose && (ev.Duration <= 0 || ev.ID != ids[len(ids)-1]) {
+			t.Fatalf("test %d: unexpected close event | %+v\n", i, ev)
+		}
+		ids = append(ids, ev.ID)
+	}
+	if ids[0] == ids[2] {
+		t.Fatalf("events of different connections share an ID | %s\n", ids[0])
+	}
+}
+
+func TestNATSPublisher_AuthorizationViolation(t *testing.T) {
+	sink := newNATSSink(t, "secret")
+	u, err := url.Parse("nats://caddy:wrong@" + sink.ln.Addr().String())
+	assertNoError(t, err)
+
+	p, err := newNATSPublisher(u, zap.NewNop())
+	assertNoError(t, err)
+	defer func() { _ = p.Close() }()
+
+	err = p.Publish("l4.events", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("unexpected error | %v\n", err)
+	}
+
+	// the publisher backs off before connecting again
+	if err = p.Publish("l4.events", []byte("{}")); !errors.Is(err, errNATSNotConnected) {
+		t.Fatalf("unexpected error | %v\n", err)
+	}
+}
+
+// blockingPublisher is a publisher that blocks until released, like a message bus which can't keep up.
+type blockingPublisher struct {
+	release   chan struct{}
+	mu        sync.Mutex
+	published int
+}
+
+func (p *blockingPublisher) Publish(string, []byte) error {
+	<-p.release
+	p.mu.Lock()
+	p.published++
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *blockingPublisher) Flush() error { return nil }
+
+func (p *blockingPublisher) Close() error { return nil }
+
+func TestStream_DropsWhenFull(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	initEventMetrics(ctx.GetMetricsRegistry())
+
+	// the counter is global, so only its increase counts
+	droppedEvents := func() float64 {
+		families, err := ctx.GetMetricsRegistry().Gather()
+		assertNoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "caddy_layer4_stream_events_dropped_total" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				if metric.GetLabel()[0].GetValue() == "test_drops" {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+	droppedBefore := droppedEvents()
+
+	p := &blockingPublisher{release: make(chan struct{})}
+	s := newStream(p, "test://", zap.NewNop())
+
+	// adding never blocks, even though nothing is published
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range maxPendingEvents + 10 {
+			s.add(&message{subject: "l4.events", server: "test_drops", payload: []byte("{}")})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("adding events blocked")
+	}
+
+	close(p.release)
+	err := s.Destruct()
+	assertNoError(t, err)
+
+	// one event may have been taken by the publisher before the queue was full
+	dropped := droppedEvents() - droppedBefore
+	if dropped != 9 && dropped != 10 || p.published+int(dropped) != maxPendingEvents+10 {
+		t.Fatalf("unexpected number of events | %d published, %f dropped\n", p.published, dropped)
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, h := range []*Handler{
+		{},
+		{To: "kafka://127.0.0.1:9092"},
+		{To: "nats://"},
+		{To: "nats://127.0.0.1:4222", Subject: "l4 events"},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("invalid handler should not be accepted | %+v\n", h)
+		}
+	}
+}
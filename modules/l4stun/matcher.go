@@ -0,0 +1,207 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4stun allows the L4 multiplexing of STUN connections
+package l4stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSTUN{})
+	layer4.RegisterProtocol("stun")
+}
+
+const (
+	headerLength = 20         // Size of Type, Length, Magic Cookie and Transaction ID fields (bytes)
+	magicCookie  = 0x2112A442 // Fixed value of Magic Cookie field
+	maxMethod    = 0x0FFF     // Maximum value of a method, which has 12 bits
+
+	ClassRequest         = "request"
+	ClassIndication      = "indication"
+	ClassSuccessResponse = "success_response"
+	ClassErrorResponse   = "error_response"
+
+	MethodBinding  = 0x001 // Method of Binding messages
+	MethodAllocate = 0x003 // Method of Allocate messages (TURN)
+)
+
+// classes contains message classes indexed by the value of their C1 and C0 bits.
+var classes = [4]string{ClassRequest, ClassIndication, ClassSuccessResponse, ClassErrorResponse}
+
+// MatchSTUN is able to match STUN messages, e.g. Binding requests sent by WebRTC peers or Allocate requests
+// sent by TURN clients, over both UDP and TCP. The message class is exposed as {l4.stun.class}, i.e. one of
+// request, indication, success_response or error_response, and the message method as {l4.stun.method},
+// e.g. 1 for Binding or 3 for Allocate.
+type MatchSTUN struct {
+	// Classes is a list of message classes to match: request, indication, success_response or error_response.
+	// Any class is matched if empty.
+	Classes []string `json:"classes,omitempty"`
+	// Methods is a list of message methods to match, e.g. 1 for Binding or 3 for Allocate.
+	// Any method is matched if empty.
+	Methods []uint16 `json:"methods,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchSTUN) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.stun",
+		New: func() caddy.Module { return new(MatchSTUN) },
+	}
+}
+
+// Match returns true if the connection looks like STUN.
+func (m *MatchSTUN) Match(cx *layer4.Connection) (bool, error) {
+	// Read a number of bytes to parse the header
+	buf := make([]byte, headerLength)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, fmt.Errorf("reading header: %w", err)
+	}
+
+	// Validate the two most significant bits, Length and Magic Cookie
+	msgType, length := binary.BigEndian.Uint16(buf[0:2]), binary.BigEndian.Uint16(buf[2:4])
+	if msgType&0xC000 != 0 || length%4 != 0 || binary.BigEndian.Uint32(buf[4:8]) != magicCookie {
+		return false, nil
+	}
+	if headerLength+int(length) > layer4.MaxMatchingBytes {
+		return false, nil
+	}
+
+	// Split Type into Class (C1 and C0 bits) and Method (the remaining 12 bits)
+	class := classes[(msgType>>7)&0x2|(msgType>>4)&0x1]
+	method := msgType&0x000F | (msgType>>1)&0x0070 | (msgType>>2)&0x0F80
+	if len(m.Classes) > 0 && !slices.Contains(m.Classes, class) {
+		return false, nil
+	}
+	if len(m.Methods) > 0 && !slices.Contains(m.Methods, method) {
+		return false, nil
+	}
+
+	// Read the attributes
+	attrs := make([]byte, length)
+	if _, err := io.ReadFull(cx, attrs); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, fmt.Errorf("reading attributes: %w", err)
+	}
+
+	// Validate the attributes, each consisting of Type, Length and Value padded to a multiple of 4 bytes
+	for len(attrs) > 0 {
+		if len(attrs) < 4 {
+			return false, nil
+		}
+		attrLength := (int(binary.BigEndian.Uint16(attrs[2:4])) + 3) &^ 3
+		if 4+attrLength > len(attrs) {
+			return false, nil
+		}
+		attrs = attrs[4+attrLength:]
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.stun.class", class)
+	repl.Set("l4.stun.method", strconv.Itoa(int(method)))
+	cx.SetProtocol("stun")
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchSTUN) Provision(_ caddy.Context) error {
+	for _, class := range m.Classes {
+		if !slices.Contains(classes[:], class) {
+			return fmt.Errorf("unsupported class %s", class)
+		}
+	}
+	for _, method := range m.Methods {
+		if method > maxMethod {
+			return fmt.Errorf("unsupported method %d", method)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchSTUN from Caddyfile tokens. Syntax:
+//
+//	stun {
+//		classes <request|indication|success_response|error_response...>
+//		methods <values...>
+//	}
+//	stun
+func (m *MatchSTUN) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "classes":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.Classes = append(m.Classes, d.RemainingArgs()...)
+		case "methods":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			for d.NextArg() {
+				method, err := strconv.ParseUint(d.Val(), 10, 16)
+				if err != nil {
+					return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+				}
+				m.Methods = append(m.Methods, uint16(method))
+			}
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc5389#section-6
+//	https://www.rfc-editor.org/rfc/rfc5389#section-15
+//	https://www.rfc-editor.org/rfc/rfc5766#section-13
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchSTUN)(nil)
+	_ caddyfile.Unmarshaler = (*MatchSTUN)(nil)
+	_ layer4.ConnMatcher    = (*MatchSTUN)(nil)
+)
@@ -0,0 +1,170 @@
+package l4stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// buildMessage returns a message with the given type and attributes, each given as type and value.
+func buildMessage(msgType uint16, attrs ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, msgType)
+	b = append(b, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42)
+	b = append(b, 0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae)
+	for _, attr := range attrs {
+		b = append(b, attr[0], attr[1])
+		b = binary.BigEndian.AppendUint16(b, uint16(len(attr)-2))
+		b = append(b, attr[2:]...)
+		for len(b)%4 != 0 {
+			b = append(b, 0x00)
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLength))
+	return b
+}
+
+func Test_MatchSTUN_Match(t *testing.T) {
+	// Binding request sent by a WebRTC peer with USERNAME, ICE-CONTROLLING, PRIORITY and FINGERPRINT
+	bindingRequest := buildMessage(0x0001,
+		append([]byte{0x00, 0x06}, "bR7c:Yp1w"...),
+		[]byte{0x80, 0x2a, 0x6e, 0x1a, 0x9c, 0x4f, 0x03, 0xd2, 0x77, 0x10},
+		[]byte{0x00, 0x24, 0x6e, 0x7f, 0x1e, 0xff},
+		[]byte{0x80, 0x28, 0x5a, 0x2e, 0x6c, 0x81},
+	)
+	// Binding success response with XOR-MAPPED-ADDRESS
+	bindingResponse := buildMessage(0x0101, []byte{0x00, 0x20, 0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43})
+	// Binding indication without attributes
+	bindingIndication := buildMessage(0x0011)
+	// Allocate request sent by a TURN client with REQUESTED-TRANSPORT (UDP) and LIFETIME
+	allocateRequest := buildMessage(0x0003,
+		[]byte{0x00, 0x19, 0x11, 0x00, 0x00, 0x00},
+		[]byte{0x00, 0x0d, 0x00, 0x00, 0x02, 0x58},
+	)
+	// Allocate error response with ERROR-CODE 401 and a reason phrase
+	allocateError := buildMessage(0x0113, append([]byte{0x00, 0x09, 0x00, 0x00, 0x04, 0x01}, "Unauthorized"...))
+	// Binding request with the two most significant bits set
+	bindingRequestHighBits := append([]byte{}, bindingRequest...)
+	bindingRequestHighBits[0] |= 0xc0
+	// Binding request with a wrong Magic Cookie, like those of RFC 3489
+	bindingRequestNoCookie := append([]byte{}, bindingRequest...)
+	bindingRequestNoCookie[4] = 0x00
+	// Binding request which Length isn't a multiple of 4
+	bindingRequestOddLength := append(append([]byte{}, bindingRequest...), 0x00, 0x00)
+	binary.BigEndian.PutUint16(bindingRequestOddLength[2:4], uint16(len(bindingRequestOddLength)-headerLength))
+	// Binding request with an attribute exceeding the message
+	attributeOverflow := append(append([]byte{}, bindingRequest...), 0x00, 0x06, 0x00, 0x10)
+	binary.BigEndian.PutUint16(attributeOverflow[2:4], uint16(len(attributeOverflow)-headerLength))
+
+	// Random UDP noise
+	noise := make([]byte, 256)
+	rand.New(rand.NewSource(5389)).Read(noise)
+
+	type test struct {
+		matcher     *MatchSTUN
+		data        []byte
+		shouldMatch bool
+		class       string
+		method      string
+	}
+
+	tests := []test{
+		{matcher: &MatchSTUN{}, data: bindingRequest, shouldMatch: true, class: ClassRequest, method: "1"},
+		{matcher: &MatchSTUN{}, data: bindingResponse, shouldMatch: true, class: ClassSuccessResponse, method: "1"},
+		{matcher: &MatchSTUN{}, data: bindingIndication, shouldMatch: true, class: ClassIndication, method: "1"},
+		{matcher: &MatchSTUN{}, data: allocateRequest, shouldMatch: true, class: ClassRequest, method: "3"},
+		{matcher: &MatchSTUN{}, data: allocateError, shouldMatch: true, class: ClassErrorResponse, method: "3"},
+		{matcher: &MatchSTUN{Classes: []string{ClassRequest}}, data: bindingRequest, shouldMatch: true, class: ClassRequest, method: "1"},
+		{matcher: &MatchSTUN{Classes: []string{ClassRequest}}, data: bindingResponse, shouldMatch: false},
+		{matcher: &MatchSTUN{Methods: []uint16{MethodBinding}}, data: bindingRequest, shouldMatch: true, class: ClassRequest, method: "1"},
+		{matcher: &MatchSTUN{Methods: []uint16{MethodBinding}}, data: allocateRequest, shouldMatch: false},
+		{matcher: &MatchSTUN{Classes: []string{ClassRequest}, Methods: []uint16{MethodAllocate}}, data: allocateRequest, shouldMatch: true, class: ClassRequest, method: "3"},
+		{matcher: &MatchSTUN{Classes: []string{ClassRequest}, Methods: []uint16{MethodAllocate}}, data: allocateError, shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: bindingRequestHighBits, shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: bindingRequestNoCookie, shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: bindingRequestOddLength, shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: attributeOverflow, shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: bindingRequest[:headerLength-1], shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: bindingRequest[:len(bindingRequest)-4], shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: noise, shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: []byte{}, shouldMatch: false},
+		{matcher: &MatchSTUN{}, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				// write the header and the attributes separately, as they may arrive over TCP
+				data := tc.data
+				if len(data) > headerLength {
+					_, err := in.Write(data[:headerLength])
+					assertNoError(t, err)
+					data = data[headerLength:]
+				}
+				_, err := in.Write(data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			class, _ := repl.GetString("l4.stun.class")
+			method, _ := repl.GetString("l4.stun.method")
+			if class != tc.class || method != tc.method {
+				t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n", i, class, method, tc.class, tc.method)
+			}
+		}()
+	}
+}
+
+func Test_MatchSTUN_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchSTUN{
+		{Classes: []string{"response"}},
+		{Methods: []uint16{0x1000}},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid config should not be accepted | %+v\n", i, m)
+		}
+	}
+}
@@ -32,7 +32,10 @@ func init() {
 // Handler implements a handler that compiles and executes routes.
 // This is useful for a batch of routes that all inherit the same
 // matchers, or for multiple routes that should be treated as a
-// single route.
+// single route. Since its routes are matched against the connection
+// it's given, they may also match the stream transformed by preceding
+// handlers, e.g. the decrypted stream once the tls handler has
+// terminated TLS.
 type Handler struct {
 	// The primary list of routes to compile and execute.
 	Routes layer4.RouteList `json:"routes,omitempty"`
@@ -0,0 +1,167 @@
+package l4subroute
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+	_ "github.com/mholt/caddy-l4/modules/l4http"
+	_ "github.com/mholt/caddy-l4/modules/l4postgres"
+	_ "github.com/mholt/caddy-l4/modules/l4tls"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// testCertificate is the certificate used by testTLSHandler.
+var testCertificate tls.Certificate
+
+// testTLSHandler terminates TLS like the tls handler, but without depending on the tls app.
+type testTLSHandler struct{}
+
+func (*testTLSHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.subroute_test_tls",
+		New: func() caddy.Module { return new(testTLSHandler) },
+	}
+}
+
+func (*testTLSHandler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	tlsConn := tls.Server(cx, &tls.Config{Certificates: []tls.Certificate{testCertificate}})
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return next.Handle(cx.Wrap(tlsConn))
+}
+
+// testReplyHandler replies with its name followed by the first bytes it reads.
+type testReplyHandler struct {
+	Name string `json:"name"`
+}
+
+func (*testReplyHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.subroute_test_reply",
+		New: func() caddy.Module { return new(testReplyHandler) },
+	}
+}
+
+func (h *testReplyHandler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
+	buf := make([]byte, 1024)
+	n, err := cx.Read(buf)
+	if err != nil {
+		return err
+	}
+	_, err = cx.Write(append([]byte(h.Name+":"), buf[:n]...))
+	return err
+}
+
+func TestHandler_AfterTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assertNoError(t, err)
+	testCertificate = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	for _, mod := range []caddy.Module{&testTLSHandler{}, &testReplyHandler{}} {
+		if _, err := caddy.GetModule(string(mod.CaddyModule().ID)); err != nil {
+			caddy.RegisterModule(mod)
+		}
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// match TLS, terminate it, then match the decrypted stream against the routes of a subroute handler
+	routes := layer4.RouteList{
+		&layer4.Route{
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{
+				caddy.ModuleMap{"tls": json.RawMessage(`{}`)},
+			},
+			HandlersRaw: []json.RawMessage{
+				json.RawMessage(`{"handler":"subroute_test_tls"}`),
+				json.RawMessage(`{"handler":"subroute","routes":[` +
+					`{"match":[{"postgres":{}}],"handle":[{"handler":"subroute_test_reply","name":"postgres"}]},` +
+					`{"match":[{"http":[]}],"handle":[{"handler":"subroute_test_reply","name":"http"}]}` +
+					`]}`),
+			},
+		},
+	}
+	err = routes.Provision(ctx)
+	assertNoError(t, err)
+
+	postgres := []byte("\x00\x00\x00\x13\x00\x03\x00\x00user\x00test\x00\x00")
+	http := []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	type test struct {
+		data  []byte
+		reply []byte
+	}
+
+	tests := []test{
+		{data: postgres, reply: append([]byte("postgres:"), postgres...)},
+		{data: http, reply: append([]byte("http:"), http...)},
+		{data: []byte("SSH-2.0-OpenSSH_9.6\r\n"), reply: []byte{}},
+	}
+
+	for i, tc := range tests {
+		func() {
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+
+			replied := make(chan []byte, 1)
+			go func() {
+				client := tls.Client(in, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+				_, err := client.Write(tc.data)
+				assertNoError(t, err)
+				b, _ := io.ReadAll(client)
+				replied <- b
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			handler := routes.Compile(zap.NewNop(), time.Second, layer4.HandlerFunc(func(*layer4.Connection) error {
+				return nil
+			}))
+			err := handler.Handle(cx)
+			assertNoError(t, err)
+			_ = cx.Close()
+
+			select {
+			case b := <-replied:
+				if !bytes.Equal(b, tc.reply) {
+					t.Fatalf("test %d: unexpected reply | got %q, want %q\n", i, b, tc.reply)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("test %d: no reply", i)
+			}
+		}()
+	}
+}
@@ -16,8 +16,13 @@ package l4tee
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -36,6 +41,15 @@ func init() {
 // avoid buffering: if one of the branches (including the main
 // handler chain) stops reading from the connection, it will
 // block all branches.
+//
+// It can also mirror the bytes read from the connection to an
+// upstream, e.g. a shadow database for analysis, without
+// affecting the main handler chain: the mirror is dialed and
+// written to concurrently, the bytes it sends back are discarded,
+// and its errors are only logged. The bytes pending to be written
+// to the mirror are buffered up to a limit; if the mirror can't
+// keep up, mirroring the connection is given up, since dropping
+// bytes would garble the stream anyway.
 type Handler struct {
 	// Handlers is the list of handlers that constitute this
 	// concurrent branch. Any handlers that do connection
@@ -44,7 +58,16 @@ type Handler struct {
 	// matching before teeing.
 	HandlersRaw []json.RawMessage `json:"branch,omitempty" caddy:"namespace=layer4.handlers inline_key=handler"`
 
+	// Mirror is the address of an upstream to mirror
+	// the bytes read from the connection to.
+	Mirror string `json:"mirror,omitempty"`
+
+	// MirrorBuffer is the maximum number of bytes pending
+	// to be written to the mirror. Default: 1 MiB.
+	MirrorBuffer int `json:"mirror_buffer,omitempty"`
+
 	compiledChain layer4.Handler
+	mirrorAddr    caddy.NetworkAddress
 	logger        *zap.Logger
 }
 
@@ -60,22 +83,66 @@ func (*Handler) CaddyModule() caddy.ModuleInfo {
 func (t *Handler) Provision(ctx caddy.Context) error {
 	t.logger = ctx.Logger(t)
 
+	if len(t.HandlersRaw) == 0 && len(t.Mirror) == 0 {
+		return errors.New("neither a branch nor a mirror is set")
+	}
+
 	// set up the handler chain
-	mods, err := ctx.LoadModule(t, "HandlersRaw")
-	if err != nil {
-		return err
+	if len(t.HandlersRaw) > 0 {
+		mods, err := ctx.LoadModule(t, "HandlersRaw")
+		if err != nil {
+			return err
+		}
+		handlers := make(layer4.Handlers, 0)
+		for _, mod := range mods.([]any) {
+			handlers = append(handlers, mod.(layer4.NextHandler))
+		}
+		t.compiledChain = handlers.Compile()
+	}
+
+	// set up the mirror
+	if len(t.Mirror) > 0 {
+		repl := caddy.NewReplacer()
+		addr, err := caddy.ParseNetworkAddress(repl.ReplaceAll(t.Mirror, ""))
+		if err != nil {
+			return fmt.Errorf("parsing mirror '%s': %v", t.Mirror, err)
+		}
+		if addr.PortRangeSize() != 1 || addr.StartPort == 0 {
+			return fmt.Errorf("mirror '%s' must have a single port", t.Mirror)
+		}
+		t.mirrorAddr = addr
+	}
+	if t.MirrorBuffer < 0 {
+		return fmt.Errorf("mirror buffer must be at least 0: %d", t.MirrorBuffer)
 	}
-	handlers := make(layer4.Handlers, 0)
-	for _, mod := range mods.([]any) {
-		handlers = append(handlers, mod.(layer4.NextHandler))
+	if t.MirrorBuffer == 0 {
+		t.MirrorBuffer = defaultMirrorBuffer
 	}
-	t.compiledChain = handlers.Compile()
 
 	return nil
 }
 
 // Handle handles the connection.
 func (t *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	if len(t.Mirror) > 0 {
+		// what is read by the next handler (and the branch)
+		// is also written into the buffer of the mirror,
+		// which never blocks
+		m := &mirror{max: t.MirrorBuffer, notify: make(chan struct{}, 1)}
+		go m.run(t.mirrorAddr, cx.RemoteAddr().String(), t.logger)
+		defer m.close()
+
+		mirrorc := *cx
+		mirrorc.Conn = teeConn{
+			Conn:   cx,
+			Reader: io.TeeReader(cx, m),
+		}
+		cx = &mirrorc
+	}
+	if t.compiledChain == nil {
+		return next.Handle(cx)
+	}
+
 	// what is read by the next handler will also be
 	// read by the branch handlers; this is done by
 	// writing conn's reads into a pipe, and having
@@ -114,18 +181,29 @@ func (t *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
 
 // UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
 //
-//	tee {
+//	tee [<mirror> [<mirror_buffer>]] {
 //		<handler>
 //		<handler> [<args>]
 //	}
 func (t *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // consume wrapper name
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
 
-	// No same-line options are supported
-	if d.CountRemainingArgs() > 0 {
+	// Only two same-line options are supported
+	if d.CountRemainingArgs() > 2 {
 		return d.ArgErr()
 	}
 
+	if d.NextArg() {
+		t.Mirror = d.Val()
+	}
+	if d.NextArg() {
+		val, err := strconv.ParseUint(d.Val(), 10, 31)
+		if err != nil {
+			return d.Errf("parsing %s mirror buffer: %v", wrapper, err)
+		}
+		t.MirrorBuffer = int(val)
+	}
+
 	if err := layer4.ParseCaddyfileNestedHandlers(d, &t.HandlersRaw); err != nil {
 		return err
 	}
@@ -161,8 +239,145 @@ func (nc nextConn) Read(p []byte) (n int, err error) {
 	return
 }
 
+// mirror writes the bytes read from a connection to an upstream. The bytes are buffered up to a limit,
+// so that writing them never blocks; mirroring fails if the limit is exceeded.
+type mirror struct {
+	max    int
+	notify chan struct{}
+
+	mu     sync.Mutex
+	buf    []byte
+	conn   net.Conn
+	closed bool
+	failed bool
+}
+
+// Write appends p to the buffer, unless mirroring has failed. It never fails, so that the reader isn't affected.
+func (m *mirror) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failed || len(p) == 0 {
+		return len(p), nil
+	}
+	if len(m.buf)+len(p) > m.max {
+		m.fail()
+		return len(p), nil
+	}
+	m.buf = append(m.buf, p...)
+	m.signal()
+	return len(p), nil
+}
+
+// close makes run return once the buffered bytes are written.
+func (m *mirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.signal()
+}
+
+// run dials the mirror and writes the buffered bytes to it until the mirror is closed or fails.
+func (m *mirror) run(addr caddy.NetworkAddress, remote string, logger *zap.Logger) {
+	conn, err := net.DialTimeout(addr.Network, addr.JoinHostPort(0), mirrorDialTimeout)
+	if err != nil {
+		logger.Error("dialing mirror", zap.String("remote", remote), zap.String("mirror", addr.String()), zap.Error(err))
+		m.mu.Lock()
+		m.fail()
+		m.mu.Unlock()
+		return
+	}
+
+	m.mu.Lock()
+	m.conn = conn
+	m.mu.Unlock()
+
+	// discard what the mirror sends back, so that it doesn't block
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	// close the connection once the mirror has closed its side, since closing it
+	// with unread bytes would reset it, and the mirror could lose the last bytes
+	defer func() {
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(mirrorDrainTimeout))
+		<-drained
+		_ = conn.Close()
+	}()
+
+	var buf []byte
+	for range m.notify {
+		m.mu.Lock()
+		buf, m.buf = m.buf, buf[:0]
+		closed, failed := m.closed, m.failed
+		m.mu.Unlock()
+
+		if failed {
+			logger.Warn("giving up mirroring", zap.String("remote", remote), zap.String("mirror", addr.String()),
+				zap.String("reason", "mirror buffer exceeded"))
+			return
+		}
+		if len(buf) > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+			if _, err = conn.Write(buf); err != nil {
+				m.mu.Lock()
+				failed = m.failed // the connection is closed if the buffer is exceeded during the write
+				m.fail()
+				m.mu.Unlock()
+				if failed {
+					logger.Warn("giving up mirroring", zap.String("remote", remote), zap.String("mirror", addr.String()),
+						zap.String("reason", "mirror buffer exceeded"))
+				} else {
+					logger.Error("writing to mirror", zap.String("remote", remote), zap.String("mirror", addr.String()), zap.Error(err))
+				}
+				return
+			}
+		}
+		if closed {
+			m.mu.Lock()
+			pending := len(m.buf) > 0
+			m.mu.Unlock()
+			if !pending {
+				return
+			}
+			m.signal()
+		}
+	}
+}
+
+// fail gives up mirroring and releases the buffer. It must be called with m.mu held.
+func (m *mirror) fail() {
+	m.failed, m.buf = true, nil
+	if m.conn != nil {
+		_ = m.conn.Close() // unblock a pending write
+	}
+	m.signal()
+}
+
+// signal notifies run that there is something to do, without blocking.
+func (m *mirror) signal() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+const (
+	defaultMirrorBuffer = 1 << 20
+	mirrorDialTimeout   = 5 * time.Second
+	mirrorDrainTimeout  = 5 * time.Second
+	mirrorWriteTimeout  = 10 * time.Second
+)
+
 // Interface guards
 var (
+	_ caddy.Provisioner     = (*Handler)(nil)
 	_ caddyfile.Unmarshaler = (*Handler)(nil)
 	_ layer4.NextHandler    = (*Handler)(nil)
 )
@@ -0,0 +1,158 @@
+package l4tee
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// handleMirrored makes h handle a connection from which data is read, and returns what the next handler has read.
+func handleMirrored(t *testing.T, h *Handler, data []byte) []byte {
+	t.Helper()
+
+	in, out := net.Pipe()
+	go func() {
+		_, err := in.Write(data)
+		assertNoError(t, err)
+		_ = in.Close()
+	}()
+
+	var read []byte
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(cx, layer4.HandlerFunc(func(cx *layer4.Connection) error {
+			var err error
+			read, err = io.ReadAll(cx)
+			return err
+		}))
+	}()
+
+	select {
+	case err := <-done:
+		assertNoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("handler didn't return")
+	}
+	_ = cx.Close()
+	return read
+}
+
+func TestHandler_Mirror(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	mirrored := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = conn.Write([]byte("ignored reply"))
+		b, _ := io.ReadAll(conn)
+		mirrored <- b
+	}()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{Mirror: ln.Addr().String()}
+	err = h.Provision(ctx)
+	assertNoError(t, err)
+
+	data := make([]byte, 256*1024)
+	_, _ = rand.Read(data)
+	if read := handleMirrored(t, h, data); !bytes.Equal(read, data) {
+		t.Fatalf("the next handler read %d unexpected bytes\n", len(read))
+	}
+
+	select {
+	case b := <-mirrored:
+		if !bytes.Equal(b, data) {
+			t.Fatalf("the mirror received %d unexpected bytes\n", len(b))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the mirror received nothing")
+	}
+}
+
+func TestHandler_FailingMirror(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// a mirror refusing connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	refusing := ln.Addr().String()
+	_ = ln.Close()
+
+	// a mirror which never reads
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	defer func() { _ = ln.Close() }()
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		stalled <- conn
+	}()
+	defer func() {
+		select {
+		case conn := <-stalled:
+			_ = conn.Close()
+		default:
+		}
+	}()
+
+	data := make([]byte, 16*1024*1024)
+	_, _ = rand.Read(data)
+
+	for i, h := range []*Handler{
+		{Mirror: refusing},
+		{Mirror: ln.Addr().String(), MirrorBuffer: 64 * 1024},
+	} {
+		err = h.Provision(ctx)
+		assertNoError(t, err)
+
+		if read := handleMirrored(t, h, data); !bytes.Equal(read, data) {
+			t.Fatalf("test %d: the next handler read %d unexpected bytes\n", i, len(read))
+		}
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, h := range []*Handler{
+		{},
+		{Mirror: "localhost"},
+		{Mirror: "localhost:5432-5433"},
+		{Mirror: "localhost:5432", MirrorBuffer: -1},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("invalid handler should not be accepted | %+v\n", h)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4tenantquota allows limiting the number of concurrent connections per tenant
+package l4tenantquota
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler is a connection handler that limits the number of concurrent connections per tenant, where the tenant
+// is identified by a placeholder populated by a matcher or a handler earlier in the chain, e.g. the server name
+// of TLS connections. Connections exceeding the quota of their tenant receive a rejection response matching the
+// protocol the connection has been tagged with by a matcher (see layer4.Connection.SetProtocol) and are closed.
+// Currently, an ErrorResponse is sent to PostgreSQL clients and a 503 response to HTTP/1.x clients. Connections
+// of any other protocol are closed without a response. Connections with an empty tenant are never limited.
+//
+// A connection counts towards the quota of its tenant until the following handlers of the route return, so the
+// handler should precede a terminal handler in the same route, e.g. proxy. The number of tenants with connections
+// is bounded: once it's reached, connections of other tenants are rejected until some of them are closed.
+type Handler struct {
+	// Key is the placeholder or value identifying the tenant, e.g. `{l4.tls.server_name}`.
+	Key string `json:"key,omitempty"`
+
+	// Max is the maximum number of concurrent connections per tenant.
+	Max int `json:"max,omitempty"`
+
+	// Message is included in the rejection response where the protocol allows it.
+	// Defaults to "too many connections".
+	Message string `json:"message,omitempty"`
+
+	tenants *tenants
+	logger  *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.tenant_quota",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the module.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	if len(h.Key) == 0 {
+		return errors.New("no key")
+	}
+	if h.Max <= 0 {
+		return fmt.Errorf("max must be greater than 0: %d", h.Max)
+	}
+	if len(h.Message) == 0 {
+		h.Message = defaultMessage
+	}
+
+	h.tenants = &tenants{counts: make(map[string]int)}
+	h.logger = ctx.Logger(h)
+	return nil
+}
+
+// Handle handles the connections.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	tenant := repl.ReplaceAll(h.Key, "")
+	if len(tenant) == 0 {
+		return next.Handle(cx)
+	}
+
+	if h.tenants.acquire(tenant, h.Max) {
+		defer h.tenants.release(tenant)
+		return next.Handle(cx)
+	}
+
+	protocol := cx.Protocol()
+	h.logger.Debug("rejected",
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.String("tenant", tenant),
+		zap.String("protocol", protocol),
+	)
+
+	var response []byte
+	switch protocol {
+	case "http":
+		response = httpServiceUnavailable(h.Message)
+	case "postgres":
+		response = postgresErrorResponse(h.Message)
+	}
+	if len(response) > 0 {
+		if _, err := cx.Write(response); err != nil {
+			return fmt.Errorf("writing rejection response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	tenant_quota [<key>] {
+//		key <placeholder>
+//		max <int>
+//		message <text>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line option is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+
+	var hasKey, hasMax, hasMessage bool
+	if d.NextArg() {
+		h.Key, hasKey = d.Val(), true
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "key":
+			if hasKey {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			h.Key, hasKey = d.Val(), true
+		case "max":
+			if hasMax {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseInt(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			h.Max, hasMax = int(val), true
+		case "message":
+			if hasMessage {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			h.Message, hasMessage = d.Val(), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// tenants counts the connections of each tenant having any.
+type tenants struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// acquire counts a connection of tenant, and returns false without counting it
+// if the tenant already has maxConns connections or too many tenants have some.
+func (t *tenants) acquire(tenant string, maxConns int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count, ok := t.counts[tenant]
+	if !ok && len(t.counts) >= maxTenants || count >= maxConns {
+		return false
+	}
+	t.counts[tenant] = count + 1
+	return true
+}
+
+// release forgets a connection of tenant, and the tenant itself once it has none left.
+func (t *tenants) release(tenant string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.counts[tenant] <= 1 {
+		delete(t.counts, tenant)
+	} else {
+		t.counts[tenant]--
+	}
+}
+
+// httpServiceUnavailable returns an HTTP/1.1 503 response with the given message as its body.
+func httpServiceUnavailable(message string) []byte {
+	body := message + "\n"
+	return []byte("HTTP/1.1 503 Service Unavailable\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n" +
+		"\r\n" + body)
+}
+
+// postgresErrorResponse returns a FATAL ErrorResponse message with the given message and
+// SQLSTATE 53300 (too_many_connections), which PostgreSQL itself sends when max_connections
+// is reached. Clients accept it both in reply to a StartupMessage and to an SSLRequest.
+func postgresErrorResponse(message string) []byte {
+	var fields []byte
+	for _, field := range [][2]string{
+		{"S", "FATAL"},
+		{"V", "FATAL"},
+		{"C", "53300"},
+		{"M", message},
+	} {
+		fields = append(fields, field[0][0])
+		fields = append(fields, field[1]...)
+		fields = append(fields, 0)
+	}
+	fields = append(fields, 0)
+
+	response := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(response[1:], uint32(4+len(fields)))
+	return append(response, fields...)
+}
+
+const (
+	defaultMessage = "too many connections"
+
+	maxTenants = 65536 // Maximum number of tenants having connections at once
+)
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
@@ -0,0 +1,121 @@
+package l4tenantquota
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{Key: "{l4.test.tenant}", Max: 2}
+	err := h.Provision(ctx)
+	assertNoError(t, err)
+
+	pgErrorResponse := []byte("E\x00\x00\x00\x30SFATAL\x00VFATAL\x00C53300\x00Mtoo many connections\x00\x00")
+
+	// the next handler holds connections until they are released
+	release := make(chan struct{})
+	entered := make(chan struct{}, 10)
+	next := layer4.HandlerFunc(func(_ *layer4.Connection) error {
+		entered <- struct{}{}
+		<-release
+		return nil
+	})
+
+	// handle passes a PostgreSQL connection of tenant to h, and returns a channel receiving the
+	// response sent to the client once the connection is closed, and whether it was handled
+	type result struct {
+		response []byte
+		handled  bool
+	}
+	handle := func(tenant string) <-chan result {
+		in, out := net.Pipe()
+		cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+		cx.SetProtocol("postgres")
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		repl.Set("l4.test.tenant", tenant)
+
+		var handled bool
+		next := layer4.HandlerFunc(func(cx *layer4.Connection) error {
+			handled = true
+			return next.Handle(cx)
+		})
+		go func() {
+			err := h.Handle(cx, next)
+			assertNoError(t, err)
+			_ = out.Close()
+		}()
+
+		results := make(chan result, 1)
+		go func() {
+			response, err := io.ReadAll(in)
+			assertNoError(t, err)
+			results <- result{response: response, handled: handled}
+		}()
+		return results
+	}
+
+	// tenant a saturates its quota, so that its next connection is rejected
+	held := []<-chan result{handle("a"), handle("a")}
+	<-entered
+	<-entered
+	res := <-handle("a")
+	if res.handled {
+		t.Fatalf("connection exceeding the quota should not be handled")
+	}
+	if !bytes.Equal(res.response, pgErrorResponse) {
+		t.Fatalf("unexpected response | got %q, want %q", res.response, pgErrorResponse)
+	}
+
+	// tenant b and connections without a tenant aren't affected
+	held = append(held, handle("b"), handle(""))
+	<-entered
+	<-entered
+
+	// tenant a gets connections again once its connections are closed
+	close(release)
+	for _, results := range held {
+		if res := <-results; !res.handled {
+			t.Fatalf("connection within the quota should be handled")
+		}
+	}
+	if res := <-handle("a"); !res.handled {
+		t.Fatalf("connection within the quota should be handled after others are closed")
+	}
+	if len(h.tenants.counts) != 0 {
+		t.Fatalf("tenants without connections should be forgotten | got %v", h.tenants.counts)
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*Handler{
+		{Max: 10},
+		{Key: "{l4.tls.server_name}"},
+		{Key: "{l4.tls.server_name}", Max: -1},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("test %d: handler should not be provisioned | %+v", i, h)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4throttle
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&RateLimit{})
+}
+
+const (
+	keyRemoteIP = "remote_ip"
+
+	gcInterval = time.Minute // How often idle buckets are forgotten
+)
+
+// RateLimit limits the rate of new connections per client using token buckets: each client may open Rate
+// connections per Window, and up to Burst connections at once. The connections exceeding the rate are closed
+// before the next handlers are called. Buckets are kept in memory, and forgotten once they are full again,
+// i.e. when the client has been idle for long enough, so that memory doesn't grow with the number of clients.
+type RateLimit struct {
+	// The key identifying clients. Only remote_ip, i.e. the IP address of the remote address, is supported (default).
+	Key string `json:"key,omitempty"`
+
+	// The number of connections allowed per window and per client.
+	Rate int `json:"rate,omitempty"`
+
+	// The duration of the window. Default: 1s.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// The maximum number of connections allowed at once per client. Default: rate.
+	Burst int `json:"burst,omitempty"`
+
+	logger  *zap.Logger
+	buckets *buckets
+	done    chan struct{}
+}
+
+// CaddyModule returns the Caddy module information.
+func (*RateLimit) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.rate_limit",
+		New: func() caddy.Module { return new(RateLimit) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *RateLimit) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	if h.Key == "" {
+		h.Key = keyRemoteIP
+	}
+	if h.Key != keyRemoteIP {
+		return fmt.Errorf("unsupported key '%s'", h.Key)
+	}
+	if h.Rate <= 0 {
+		return fmt.Errorf("rate must be greater than 0: %d", h.Rate)
+	}
+	if h.Window < 0 {
+		return fmt.Errorf("window must be at least 0: %s", time.Duration(h.Window))
+	}
+	if h.Window == 0 {
+		h.Window = caddy.Duration(time.Second)
+	}
+	if h.Burst < 0 {
+		return fmt.Errorf("burst must be at least 0: %d", h.Burst)
+	}
+	if h.Burst == 0 {
+		h.Burst = h.Rate
+	}
+
+	h.buckets = newBuckets(rate.Limit(float64(h.Rate)/time.Duration(h.Window).Seconds()), h.Burst)
+	h.done = make(chan struct{})
+	go h.gcLoop()
+
+	return nil
+}
+
+// Cleanup stops forgetting idle buckets.
+func (h *RateLimit) Cleanup() error {
+	if h.done != nil {
+		close(h.done)
+	}
+	return nil
+}
+
+// Handle handles the connection.
+func (h *RateLimit) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	key := remoteIP(cx.RemoteAddr())
+	if !h.buckets.allow(key, time.Now()) {
+		h.logger.Debug("rate limited",
+			zap.String("remote", cx.RemoteAddr().String()),
+			zap.String("key", key),
+		)
+		return nil
+	}
+	return next.Handle(cx)
+}
+
+// UnmarshalCaddyfile sets up the RateLimit from Caddyfile tokens. Syntax:
+//
+//	rate_limit {
+//		key remote_ip
+//		rate <int>
+//		window <duration>
+//		burst <int>
+//	}
+func (h *RateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasKey, hasRate, hasWindow, hasBurst bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "key":
+			if hasKey {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg() // consume option value
+			if d.Val() != keyRemoteIP {
+				return d.Errf("parsing %s option '%s': unsupported key '%s'", wrapper, optionName, d.Val())
+			}
+			h.Key, hasKey = d.Val(), true
+		case "rate":
+			if hasRate {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg() // consume option value
+			val, err := strconv.ParseInt(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			h.Rate, hasRate = int(val), true
+		case "window":
+			if hasWindow {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg() // consume option value
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			h.Window, hasWindow = caddy.Duration(dur), true
+		case "burst":
+			if hasBurst {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg() // consume option value
+			val, err := strconv.ParseInt(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			h.Burst, hasBurst = int(val), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// gcLoop forgets idle buckets until the handler is cleaned up.
+func (h *RateLimit) gcLoop() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			if n := h.buckets.gc(now); n > 0 {
+				h.logger.Debug("forgot idle buckets", zap.Int("count", n))
+			}
+		}
+	}
+}
+
+// buckets holds a token bucket per key.
+type buckets struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	limit    rate.Limit
+	burst    int
+}
+
+func newBuckets(limit rate.Limit, burst int) *buckets {
+	return &buckets{limiters: make(map[string]*rate.Limiter), limit: limit, burst: burst}
+}
+
+// allow takes a token from the bucket of key at now, and returns false if it's empty.
+func (b *buckets) allow(key string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	limiter, ok := b.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(b.limit, b.burst)
+		b.limiters[key] = limiter
+	}
+	return limiter.AllowN(now, 1)
+}
+
+// gc forgets the buckets which are full at now, since they behave like new ones, and returns their number.
+func (b *buckets) gc(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int
+	for key, limiter := range b.limiters {
+		if limiter.TokensAt(now) >= float64(b.burst) {
+			delete(b.limiters, key)
+			n++
+		}
+	}
+	return n
+}
+
+// remoteIP returns the IP address of addr, or addr itself if it has no port, e.g. for a pipe.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Interface guards
+var (
+	_ caddy.CleanerUpper    = (*RateLimit)(nil)
+	_ caddy.Provisioner     = (*RateLimit)(nil)
+	_ caddyfile.Unmarshaler = (*RateLimit)(nil)
+	_ layer4.NextHandler    = (*RateLimit)(nil)
+)
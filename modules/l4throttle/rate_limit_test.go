@@ -0,0 +1,129 @@
+package l4throttle
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// remoteConn overrides the remote address of a connection.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// handleFrom passes n connections from remote to h, and returns how many of them reached the next handler.
+func handleFrom(t *testing.T, h *RateLimit, remote string, n int) int {
+	t.Helper()
+	addr, err := net.ResolveTCPAddr("tcp", remote)
+	if err != nil {
+		t.Fatalf("resolving remote address: %v", err)
+	}
+
+	var handled atomic.Int32
+	next := layer4.HandlerFunc(func(_ *layer4.Connection) error {
+		handled.Add(1)
+		return nil
+	})
+	for range n {
+		in, out := net.Pipe()
+		cx := layer4.WrapConnection(remoteConn{Conn: out, remote: addr}, []byte{}, zap.NewNop())
+		if err := h.Handle(cx, next); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_ = in.Close()
+		_ = out.Close()
+	}
+	return int(handled.Load())
+}
+
+func TestRateLimit_Handle(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &RateLimit{Rate: 10, Window: caddy.Duration(time.Hour), Burst: 20}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = h.Cleanup() }()
+
+	// The burst is allowed, and the excess is dropped
+	if n := handleFrom(t, h, "192.0.2.1:50000", 100); n != 20 {
+		t.Fatalf("unexpected number of connections handled | got %d, want %d", n, 20)
+	}
+	// Other ports of the same IP share its bucket
+	if n := handleFrom(t, h, "192.0.2.1:50001", 10); n != 0 {
+		t.Fatalf("unexpected number of connections handled | got %d, want %d", n, 0)
+	}
+	// Other IPs have their own bucket
+	if n := handleFrom(t, h, "[2001:db8::1]:50000", 30); n != 20 {
+		t.Fatalf("unexpected number of connections handled | got %d, want %d", n, 20)
+	}
+}
+
+func TestRateLimit_Refill(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &RateLimit{Rate: 5, Window: caddy.Duration(100 * time.Millisecond)}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = h.Cleanup() }()
+
+	if n := handleFrom(t, h, "192.0.2.1:50000", 10); n != 5 {
+		t.Fatalf("unexpected number of connections handled | got %d, want %d", n, 5)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := handleFrom(t, h, "192.0.2.1:50000", 10); n != 5 {
+		t.Fatalf("connections should be allowed again after the window | got %d, want %d", n, 5)
+	}
+}
+
+func TestBuckets_GC(t *testing.T) {
+	b := newBuckets(10, 10) // 10 tokens per second
+	now := time.Now()
+
+	for range 10 {
+		b.allow("192.0.2.1", now)
+	}
+	b.allow("192.0.2.2", now)
+
+	// The bucket of 192.0.2.2 is full again after 100ms, the one of 192.0.2.1 after 1s
+	if n := b.gc(now.Add(500 * time.Millisecond)); n != 1 {
+		t.Fatalf("unexpected number of buckets forgotten | got %d, want %d", n, 1)
+	}
+	if n := b.gc(now.Add(time.Second)); n != 1 {
+		t.Fatalf("unexpected number of buckets forgotten | got %d, want %d", n, 1)
+	}
+	if len(b.limiters) != 0 {
+		t.Fatalf("all buckets should be forgotten, %d remain", len(b.limiters))
+	}
+}
+
+func TestRateLimit_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, h := range []*RateLimit{
+		{},
+		{Rate: -1},
+		{Rate: 10, Key: "remote_port"},
+		{Rate: 10, Window: caddy.Duration(-time.Second)},
+		{Rate: 10, Burst: -1},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			_ = h.Cleanup()
+			t.Fatalf("test %d: handler should not be provisioned | %+v", i, h)
+		}
+	}
+}
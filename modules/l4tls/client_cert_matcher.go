@@ -0,0 +1,158 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchClientCert{})
+	caddy.RegisterModule(&MatchRequireClientCert{})
+}
+
+// MatchClientCert is able to match connections by whether the client has presented a certificate during the
+// TLS handshake, e.g. to route mTLS clients and anonymous ones differently. Since certificates are only sent
+// once the server requests them, i.e. after the ClientHello, this matcher must follow the tls handler, whose
+// connection policy must request client certificates, e.g. with the request or require mode of client_auth.
+// It checks the innermost TLS connection terminated so far, and doesn't match connections without any.
+// The subject and the SHA-256 fingerprint (in hex) of the client certificate are exposed as
+// {l4.tls.client_cert.subject} and {l4.tls.client_cert.fingerprint}, or set to empty strings if none.
+// The require_client_cert option of the tls matcher delegates to it (see MatchRequireClientCert).
+type MatchClientCert struct {
+	// Absent makes the matcher match connections without a client certificate instead of those with one.
+	Absent bool `json:"absent,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchClientCert) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.tls_client_cert",
+		New: func() caddy.Module { return new(MatchClientCert) },
+	}
+}
+
+// Match returns true if the presence of a client certificate in the terminated TLS connection is as expected.
+func (m *MatchClientCert) Match(cx *layer4.Connection) (bool, error) {
+	states := GetConnectionStates(cx)
+	if len(states) == 0 {
+		return false, nil
+	}
+	state := states[len(states)-1]
+
+	var subject, fingerprint string
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		sum := sha256.Sum256(cert.Raw)
+		subject, fingerprint = cert.Subject.String(), hex.EncodeToString(sum[:])
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.tls.client_cert.subject", subject)
+	repl.Set("l4.tls.client_cert.fingerprint", fingerprint)
+
+	return (len(state.PeerCertificates) > 0) != m.Absent, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchClientCert from Caddyfile tokens. Syntax:
+//
+//	tls_client_cert [absent]
+func (m *MatchClientCert) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		if d.Val() != "absent" {
+			return d.Errf("parsing %s option '%s': unsupported value", wrapper, d.Val())
+		}
+		m.Absent = true
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s option: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// MatchRequireClientCert is the require_client_cert option of the tls matcher, i.e. `tls { require_client_cert }`,
+// which matches connections whose client has presented a certificate like MatchClientCert does. It turns the tls
+// matcher into a post-handshake check, so it must follow the tls handler as well: the other handshake matchers
+// of the same tls matcher are then checked against the ClientHello recorded when the connection was matched.
+type MatchRequireClientCert struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchRequireClientCert) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.require_client_cert",
+		New: func() caddy.Module { return new(MatchRequireClientCert) },
+	}
+}
+
+// Match returns false, since no client certificate can have been presented with the ClientHello.
+func (m *MatchRequireClientCert) Match(_ *tls.ClientHelloInfo) bool {
+	return false
+}
+
+// matchTerminated returns true if the client has presented a certificate in the terminated TLS connection.
+func (m *MatchRequireClientCert) matchTerminated(cx *layer4.Connection) (bool, error) {
+	return new(MatchClientCert).Match(cx)
+}
+
+// UnmarshalCaddyfile sets up the MatchRequireClientCert from Caddyfile tokens. Syntax:
+//
+//	require_client_cert
+func (m *MatchRequireClientCert) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// No same-line options are supported
+		if d.CountRemainingArgs() > 0 {
+			return d.ArgErr()
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc8446#section-4.3.2
+//	https://www.rfc-editor.org/rfc/rfc5246#section-7.4.6
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler      = (*MatchClientCert)(nil)
+	_ layer4.ConnMatcher         = (*MatchClientCert)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchRequireClientCert)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchRequireClientCert)(nil)
+	_ postHandshakeMatcher       = (*MatchRequireClientCert)(nil)
+)
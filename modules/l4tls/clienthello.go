@@ -15,7 +15,15 @@
 package l4tls
 
 import (
+	"bytes"
+	"crypto/md5"
 	"crypto/tls"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/caddy-l4/layer4"
 )
 
 // ClientHelloInfo holds information about a TLS ClientHello.
@@ -33,6 +41,10 @@ type ClientHelloInfo struct {
 
 	Extensions []uint16
 
+	// ServerNameTypes holds the name types of the entries of the server_name
+	// list in the order they were sent, which are host_name (0) in practice.
+	ServerNameTypes []uint8
+
 	OCSPStapling         bool
 	TicketSupported      bool
 	SessionTicket        []uint8
@@ -44,6 +56,8 @@ type ClientHelloInfo struct {
 	PSKModes             []uint8
 	PSKIdentities        []PSKIdentity
 	PSKBinders           [][]byte
+
+	ja3, ja3Hash string // computed on first use by ja3Fingerprint
 }
 
 // FillTLSClientConfig fills cfg (a client-side TLS config) with information
@@ -77,3 +91,131 @@ func (chi ClientHelloInfo) FillTLSClientConfig(cfg *tls.Config) {
 		cfg.MaxVersion = maxVer
 	}
 }
+
+// DistinctExtensions returns the number of distinct extension types in chi.
+// Clients must not repeat an extension, so it only differs from the length
+// of Extensions for malformed ClientHellos.
+func (chi ClientHelloInfo) DistinctExtensions() int {
+	seen := make(map[uint16]struct{}, len(chi.Extensions))
+	for _, ext := range chi.Extensions {
+		seen[ext] = struct{}{}
+	}
+	return len(seen)
+}
+
+// KeyShareGroups returns the groups of chi's key shares in the order they were sent.
+func (chi ClientHelloInfo) KeyShareGroups() []tls.CurveID {
+	groups := make([]tls.CurveID, 0, len(chi.KeyShares))
+	for _, ks := range chi.KeyShares {
+		groups = append(groups, ks.Group)
+	}
+	return groups
+}
+
+// JA3 returns the JA3 fingerprint string of chi, i.e. the decimal values of its legacy version, cipher suites,
+// extensions, supported groups and EC point formats in the order they were sent, each list joined by dashes
+// and the fields joined by commas, e.g. 771,4865-4866,0-10-11,29-23,0. GREASE values are left out.
+func (chi ClientHelloInfo) JA3() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(chi.Version)),
+		joinJA3Values(chi.CipherSuites),
+		joinJA3Values(chi.Extensions),
+		joinJA3Values(chi.SupportedCurves),
+		joinJA3Values(chi.SupportedPoints),
+	}, ",")
+}
+
+// JA3Hash returns the MD5 hash of chi's JA3 fingerprint string in hex, which is how JA3 fingerprints
+// are usually shared, e.g. in threat intelligence feeds.
+func (chi ClientHelloInfo) JA3Hash() string {
+	return hashJA3(chi.JA3())
+}
+
+// ja3Fingerprint returns chi's JA3 fingerprint string and its hash, which are only computed once,
+// since both the ja3 matcher and the placeholders may need them.
+func (chi *ClientHelloInfo) ja3Fingerprint() (string, string) {
+	if len(chi.ja3) == 0 {
+		chi.ja3 = chi.JA3()
+		chi.ja3Hash = hashJA3(chi.ja3)
+	}
+	return chi.ja3, chi.ja3Hash
+}
+
+// hashJA3 returns the MD5 hash of the JA3 fingerprint string s in hex.
+func hashJA3(s string) string {
+	sum := md5.Sum([]byte(s)) //nolint:gosec // JA3 is defined with MD5
+	return hex.EncodeToString(sum[:])
+}
+
+// ZeroRandom returns true if chi's 32-byte random consists of zeros only. Clients must generate it with
+// a secure random number generator, so it's only ever zeroed by broken, misconfigured or test clients.
+func (chi ClientHelloInfo) ZeroRandom() bool {
+	return len(chi.Random) == 32 && bytes.Equal(chi.Random, make([]byte, 32))
+}
+
+// RenegotiationSignal returns how chi signals support for secure renegotiation (RFC 5746): extension if it sends
+// the renegotiation_info extension, scsv if it sends the TLS_EMPTY_RENEGOTIATION_INFO_SCSV cipher suite instead,
+// both if it sends both, or none if it sends neither, i.e. if it's a legacy client which doesn't support it.
+func (chi ClientHelloInfo) RenegotiationSignal() string {
+	extension := slices.Contains(chi.Extensions, extensionRenegotiationInfo)
+	scsv := slices.Contains(chi.CipherSuites, scsvRenegotiation)
+	switch {
+	case extension && scsv:
+		return renegotiationSignalBoth
+	case extension:
+		return renegotiationSignalExtension
+	case scsv:
+		return renegotiationSignalSCSV
+	}
+	return renegotiationSignalNone
+}
+
+// clientHelloInfoKey is the key used to store ClientHelloInfo in a connection.
+type clientHelloInfoKey struct{}
+
+// GetClientHelloInfo returns the ClientHelloInfo deposited into cx by MatchTLS, if any.
+func GetClientHelloInfo(cx *layer4.Connection) (*ClientHelloInfo, bool) {
+	return layer4.ValueOf[*ClientHelloInfo](cx, clientHelloInfoKey{})
+}
+
+// clientHelloInfoFrom returns the ClientHelloInfo that hello is a part of. It allows
+// TLS handshake matchers to use more information than the standard library's struct
+// holds. If hello doesn't come from MatchTLS, nil is returned.
+func clientHelloInfoFrom(hello *tls.ClientHelloInfo) *ClientHelloInfo {
+	cx, ok := hello.Conn.(*layer4.Connection)
+	if !ok {
+		return nil
+	}
+	chi, ok := GetClientHelloInfo(cx)
+	if !ok || &chi.ClientHelloInfo != hello {
+		return nil
+	}
+	return chi
+}
+
+// joinUints formats values as a comma-separated list of decimal numbers.
+func joinUints[T ~uint8 | ~uint16](values []T) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, ",")
+}
+
+// joinJA3Values formats values as a dash-separated list of decimal numbers, leaving out GREASE values.
+func joinJA3Values[T ~uint8 | ~uint16](values []T) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(uint16(v)) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGREASE returns true if v is one of the values reserved by RFC 8701 to keep TLS extensible,
+// i.e. 0x0a0a, 0x1a1a, ..., 0xfafa, which clients send at random.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
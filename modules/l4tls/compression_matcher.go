@@ -0,0 +1,142 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchCompression{})
+}
+
+// MatchCompression is able to match ClientHellos by their compression methods. Since TLS 1.3
+// forbids compression and earlier versions are affected by CRIME, a ClientHello advertising
+// anything but the null method comes from an old or anomalous client. Note: this matcher
+// only works within the layer4 tls matcher, since it needs more information than the
+// standard library's ClientHelloInfo holds.
+type MatchCompression struct {
+	// NonNull matches ClientHellos advertising at least one compression method other than null.
+	NonNull bool `json:"non_null,omitempty"`
+	// Methods matches ClientHellos advertising at least one of the given compression methods,
+	// e.g. 1 for DEFLATE (RFC 3749) or 64 for LZS (RFC 3943).
+	Methods []int `json:"methods,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchCompression) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.compression",
+		New: func() caddy.Module { return new(MatchCompression) },
+	}
+}
+
+// Match returns true if the ClientHello advertises matching compression methods.
+func (m *MatchCompression) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	for _, method := range chi.CompressionMethods {
+		if m.NonNull && method != compressionNone {
+			return true
+		}
+		if slices.Contains(m.Methods, int(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalCaddyfile sets up the MatchCompression from Caddyfile tokens. Syntax:
+//
+//	compression non_null|<methods...>
+//
+// Methods may be given by their names (null, deflate, lzs) or numbers.
+func (m *MatchCompression) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// At least one same-line option must be provided
+		if d.CountRemainingArgs() == 0 {
+			return d.ArgErr()
+		}
+
+		for d.NextArg() {
+			val := d.Val()
+			if val == "non_null" {
+				m.NonNull = true
+				continue
+			}
+			method, ok := compressionMethods[val]
+			if !ok {
+				num, err := strconv.ParseUint(val, 10, 8)
+				if err != nil {
+					return d.Errf("parsing %s method '%s': %v", wrapper, val, err)
+				}
+				method = uint8(num)
+			}
+			m.Methods = append(m.Methods, int(method))
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Provision validates m.
+func (m *MatchCompression) Provision(_ caddy.Context) error {
+	if !m.NonNull && len(m.Methods) == 0 {
+		return fmt.Errorf("neither non_null nor methods are set")
+	}
+	for _, method := range m.Methods {
+		if method < 0 || method > 255 {
+			return fmt.Errorf("invalid compression method %d", method)
+		}
+	}
+	return nil
+}
+
+// TLS compression methods
+const (
+	compressionNone    uint8 = 0
+	compressionDeflate uint8 = 1
+	compressionLZS     uint8 = 64
+)
+
+var compressionMethods = map[string]uint8{
+	"null":    compressionNone,
+	"deflate": compressionDeflate,
+	"lzs":     compressionLZS,
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner          = (*MatchCompression)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchCompression)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchCompression)(nil)
+)
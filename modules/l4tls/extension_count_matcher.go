@@ -0,0 +1,118 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchExtensionCount{})
+}
+
+// MatchExtensionCount is able to match ClientHellos by the number of distinct extensions they
+// contain. It's a coarse fingerprinting metric: mainstream clients send a fairly stable number of
+// extensions, while very few or unusually many of them may indicate scanners or crafted handshakes.
+// Note: this matcher only works within the layer4 tls matcher, since it needs more information
+// than the standard library's ClientHelloInfo holds.
+type MatchExtensionCount struct {
+	// Min is the minimum number of extensions, inclusive.
+	Min int `json:"min,omitempty"`
+	// Max is the maximum number of extensions, inclusive. If zero, there is no upper bound.
+	Max int `json:"max,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchExtensionCount) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.extension_count",
+		New: func() caddy.Module { return new(MatchExtensionCount) },
+	}
+}
+
+// Match returns true if the number of distinct extensions in the ClientHello is within range.
+func (m *MatchExtensionCount) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	count := chi.DistinctExtensions()
+	return count >= m.Min && (m.Max == 0 || count <= m.Max)
+}
+
+// UnmarshalCaddyfile sets up the MatchExtensionCount from Caddyfile tokens. Syntax:
+//
+//	extension_count <min>-[<max>]|<count>
+func (m *MatchExtensionCount) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// Exactly one same-line option must be provided
+		if d.CountRemainingArgs() != 1 {
+			return d.ArgErr()
+		}
+		d.NextArg()
+
+		minVal, maxVal, isRange := strings.Cut(d.Val(), "-")
+		num, err := strconv.ParseUint(minVal, 10, 16)
+		if err != nil {
+			return d.Errf("parsing %s count '%s': %v", wrapper, d.Val(), err)
+		}
+		m.Min, m.Max = int(num), int(num)
+		if isRange {
+			m.Max = 0
+			if len(maxVal) > 0 {
+				num, err = strconv.ParseUint(maxVal, 10, 16)
+				if err != nil {
+					return d.Errf("parsing %s count '%s': %v", wrapper, d.Val(), err)
+				}
+				m.Max = int(num)
+			}
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Provision validates m.
+func (m *MatchExtensionCount) Provision(_ caddy.Context) error {
+	if m.Min < 0 || m.Max < 0 {
+		return fmt.Errorf("negative extension count")
+	}
+	if m.Max > 0 && m.Max < m.Min {
+		return fmt.Errorf("max extension count %d is less than min %d", m.Max, m.Min)
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner          = (*MatchExtensionCount)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchExtensionCount)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchExtensionCount)(nil)
+)
@@ -15,8 +15,11 @@
 package l4tls
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -30,10 +33,17 @@ func init() {
 	caddy.RegisterModule(&Handler{})
 }
 
+// ErrHandshakeTimeout is logged when a client doesn't complete the TLS handshake within the handshake timeout.
+var ErrHandshakeTimeout = errors.New("aborted TLS handshake according to timeout")
+
 // Handler is a connection handler that terminates TLS.
 type Handler struct {
 	ConnectionPolicies caddytls.ConnectionPolicies `json:"connection_policies,omitempty"`
 
+	// HandshakeTimeout is the maximum time clients have to complete the TLS handshake, as a whole, so that
+	// clients stalling after the ClientHello are dropped. Default: 0 (no timeout).
+	HandshakeTimeout caddy.Duration `json:"handshake_timeout,omitempty"`
+
 	ctx    caddy.Context
 	logger *zap.Logger
 }
@@ -51,6 +61,10 @@ func (t *Handler) Provision(ctx caddy.Context) error {
 	t.ctx = ctx
 	t.logger = ctx.Logger(t)
 
+	if t.HandshakeTimeout < 0 {
+		return fmt.Errorf("handshake timeout must be at least 0: %s", time.Duration(t.HandshakeTimeout))
+	}
+
 	// ensure there is at least one policy, which will act as default
 	if len(t.ConnectionPolicies) == 0 {
 		t.ConnectionPolicies = append(t.ConnectionPolicies, new(caddytls.ConnectionPolicy))
@@ -82,7 +96,23 @@ func (t *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
 	// connection to perform the handshake, and cx might have some
 	// bytes already buffered need to be read first)
 	tlsConn := tls.Server(cx, tlsCfg)
-	err := tlsConn.Handshake()
+	ctx := context.Context(cx.Context)
+	if t.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.HandshakeTimeout))
+		defer cancel()
+	}
+	err := tlsConn.HandshakeContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// the connection has been closed, so log the timeout only, at a lower level than other errors
+		t.logger.Warn("terminating TLS",
+			zap.String("remote", cx.RemoteAddr().String()),
+			zap.String("server_name", clientHello.ServerName),
+			zap.Duration("handshake_timeout", time.Duration(t.HandshakeTimeout)),
+			zap.Error(ErrHandshakeTimeout),
+		)
+		return nil // return nil so the error does not get logged again
+	}
 	if err != nil {
 		return err
 	}
@@ -115,6 +145,7 @@ func (t *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
 //		connection_policy {
 //			...
 //		}
+//		handshake_timeout <duration>
 //	}
 //	tls
 func (t *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -125,6 +156,7 @@ func (t *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		return d.ArgErr()
 	}
 
+	var hasHandshakeTimeout bool
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		optionName := d.Val()
 		switch optionName {
@@ -134,6 +166,19 @@ func (t *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return err
 			}
 			t.ConnectionPolicies = append(t.ConnectionPolicies, cp)
+		case "handshake_timeout":
+			if hasHandshakeTimeout {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			t.HandshakeTimeout, hasHandshakeTimeout = caddy.Duration(dur), true
 		default:
 			return d.ArgErr()
 		}
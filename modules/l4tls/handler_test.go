@@ -0,0 +1,106 @@
+package l4tls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// stalledConn is a connection whose reads block until it's closed, so that a TLS client
+// sends its ClientHello, but never reads the reply of the server.
+type stalledConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *stalledConn) Read([]byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func TestHandler_HandshakeTimeout(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	cert := selfSignedCert(t, "localhost")
+
+	for i, stall := range []bool{false, true} {
+		func() {
+			loggerCore, logs := observer.New(zapcore.WarnLevel)
+			h := &Handler{
+				// connection policies are built by hand, since provisioning them requires the tls app
+				ConnectionPolicies: caddytls.ConnectionPolicies{{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}},
+				HandshakeTimeout:   caddy.Duration(100 * time.Millisecond),
+				ctx:                ctx,
+				logger:             zap.New(loggerCore),
+			}
+
+			in, out := net.Pipe()
+			closed := make(chan struct{})
+			defer func() {
+				close(closed)
+				_ = in.Close()
+			}()
+
+			go func() {
+				var conn net.Conn = in
+				if stall {
+					conn = &stalledConn{Conn: in, closed: closed}
+				}
+				client := tls.Client(conn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+				_, _ = client.Write([]byte("hello"))
+			}()
+
+			var received []byte
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			start := time.Now()
+			err := h.Handle(cx, layer4.HandlerFunc(func(cx *layer4.Connection) error {
+				received = make([]byte, 5)
+				_, err := io.ReadFull(cx, received)
+				return err
+			}))
+			elapsed := time.Since(start)
+			_ = cx.Close()
+
+			if err != nil && !errors.Is(err, io.EOF) {
+				t.Fatalf("test %d: unexpected error | %v\n", i, err)
+			}
+			if elapsed > time.Second {
+				t.Fatalf("test %d: handshake took too long | %s\n", i, elapsed)
+			}
+
+			timedOut := logs.FilterField(zap.Error(ErrHandshakeTimeout)).Len() > 0
+			if stall {
+				if received != nil || !timedOut {
+					t.Fatalf("test %d: stalled handshake isn't aborted | received %q, timeout logged %t\n", i, received, timedOut)
+				}
+			} else {
+				if string(received) != "hello" || timedOut {
+					t.Fatalf("test %d: prompt handshake isn't completed | received %q, timeout logged %t\n", i, received, timedOut)
+				}
+			}
+		}()
+	}
+}
+
+func TestHandler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{HandshakeTimeout: -1}
+	if err := h.Provision(ctx); err == nil {
+		t.Fatalf("negative handshake timeout should not be accepted")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchJA3{})
+}
+
+// MatchJA3 is able to match ClientHellos by their JA3 fingerprint, i.e. the MD5 hash of the legacy version,
+// cipher suites, extensions, supported groups and EC point formats they contain, e.g. to route or block
+// known clients, bots or malware. The fingerprint is exposed as {l4.tls.ja3}, and the string it's the hash
+// of as {l4.tls.ja3_string}. Note: this matcher only works within the layer4 tls matcher, since it needs
+// more information than the standard library's ClientHelloInfo holds.
+type MatchJA3 struct {
+	// Allow is a list of JA3 fingerprints to match, as 32 hex digits. If empty, any fingerprint
+	// that isn't denied is matched.
+	Allow []string `json:"allow,omitempty"`
+	// Deny is a list of JA3 fingerprints not to match, as 32 hex digits.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchJA3) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.ja3",
+		New: func() caddy.Module { return new(MatchJA3) },
+	}
+}
+
+// Match returns true if the JA3 fingerprint of the ClientHello is allowed and not denied.
+func (m *MatchJA3) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	_, hash := chi.ja3Fingerprint()
+	if slices.Contains(m.Deny, hash) {
+		return false
+	}
+	return len(m.Allow) == 0 || slices.Contains(m.Allow, hash)
+}
+
+// UnmarshalCaddyfile sets up the MatchJA3 from Caddyfile tokens. Syntax:
+//
+//	ja3 [<allowed_hashes...>] {
+//		allow <hashes...>
+//		deny <hashes...>
+//	}
+func (m *MatchJA3) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// Same-line options are treated as allowed hashes
+		m.Allow = append(m.Allow, d.RemainingArgs()...)
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			optionName := d.Val()
+			switch optionName {
+			case "allow":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+				m.Allow = append(m.Allow, d.RemainingArgs()...)
+			case "deny":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+				m.Deny = append(m.Deny, d.RemainingArgs()...)
+			default:
+				return d.Errf("unrecognized %s option '%s'", wrapper, optionName)
+			}
+
+			// No nested blocks are supported
+			if d.NextBlock(nesting + 1) {
+				return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Provision validates and normalizes m's fingerprints.
+func (m *MatchJA3) Provision(_ caddy.Context) error {
+	if len(m.Allow) == 0 && len(m.Deny) == 0 {
+		return fmt.Errorf("no fingerprints are set")
+	}
+	for _, hashes := range [][]string{m.Allow, m.Deny} {
+		for i, hash := range hashes {
+			hash = strings.ToLower(hash)
+			if b, err := hex.DecodeString(hash); err != nil || len(b) != 16 {
+				return fmt.Errorf("invalid JA3 fingerprint '%s'", hash)
+			}
+			hashes[i] = hash
+		}
+	}
+	return nil
+}
+
+// Refs:
+//
+//	https://github.com/salesforce/ja3
+//	https://www.rfc-editor.org/rfc/rfc8701
+
+// Interface guards
+var (
+	_ caddy.Provisioner          = (*MatchJA3)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchJA3)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchJA3)(nil)
+)
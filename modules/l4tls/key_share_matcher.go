@@ -0,0 +1,166 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchKeyShare{})
+}
+
+// MatchKeyShare is able to match ClientHellos by the groups of their TLS 1.3 key shares. Unlike
+// supported_groups, which lists all the groups a client is capable of, key shares are only sent
+// for the groups a client actually prefers, e.g. X25519 or a hybrid post-quantum group, so they
+// are useful for routing PQ-capable clients. Note: this matcher only works within the layer4 tls
+// matcher, since it needs more information than the standard library's ClientHelloInfo holds.
+type MatchKeyShare struct {
+	// PostQuantum matches ClientHellos with at least one key share for a post-quantum or hybrid group.
+	PostQuantum bool `json:"post_quantum,omitempty"`
+	// Groups matches ClientHellos with at least one key share for one of the given groups,
+	// e.g. 29 for X25519, 23 for P-256 or 4588 for X25519MLKEM768.
+	Groups []int `json:"groups,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchKeyShare) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.key_share",
+		New: func() caddy.Module { return new(MatchKeyShare) },
+	}
+}
+
+// Match returns true if the ClientHello contains matching key shares.
+func (m *MatchKeyShare) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	for _, group := range chi.KeyShareGroups() {
+		if m.PostQuantum && slices.Contains(postQuantumGroups, group) {
+			return true
+		}
+		if slices.Contains(m.Groups, int(group)) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalCaddyfile sets up the MatchKeyShare from Caddyfile tokens. Syntax:
+//
+//	key_share post_quantum|<groups...>
+//
+// Groups may be given by their names (e.g. x25519, secp256r1, x25519mlkem768) or numbers.
+func (m *MatchKeyShare) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// At least one same-line option must be provided
+		if d.CountRemainingArgs() == 0 {
+			return d.ArgErr()
+		}
+
+		for d.NextArg() {
+			val := d.Val()
+			if val == "post_quantum" {
+				m.PostQuantum = true
+				continue
+			}
+			group, ok := keyShareGroups[strings.ToLower(val)]
+			if !ok {
+				num, err := strconv.ParseUint(val, 10, 16)
+				if err != nil {
+					return d.Errf("parsing %s group '%s': %v", wrapper, val, err)
+				}
+				group = tls.CurveID(num)
+			}
+			m.Groups = append(m.Groups, int(group))
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Provision validates m.
+func (m *MatchKeyShare) Provision(_ caddy.Context) error {
+	if !m.PostQuantum && len(m.Groups) == 0 {
+		return fmt.Errorf("neither post_quantum nor groups are set")
+	}
+	for _, group := range m.Groups {
+		if group < 0 || group > 0xFFFF {
+			return fmt.Errorf("invalid group %d", group)
+		}
+	}
+	return nil
+}
+
+// TLS named groups not defined by crypto/tls, see https://www.iana.org/assignments/tls-parameters/tls-parameters.xhtml#tls-parameters-8
+const (
+	groupMLKEM512              tls.CurveID = 0x0200
+	groupMLKEM768              tls.CurveID = 0x0201
+	groupMLKEM1024             tls.CurveID = 0x0202
+	groupSecP256r1MLKEM768     tls.CurveID = 0x11eb
+	groupX25519MLKEM768        tls.CurveID = 0x11ec
+	groupSecP384r1MLKEM1024    tls.CurveID = 0x11ed
+	groupX25519Kyber768Draft00 tls.CurveID = 0x6399
+)
+
+var keyShareGroups = map[string]tls.CurveID{
+	"secp256r1":             tls.CurveP256,
+	"secp384r1":             tls.CurveP384,
+	"secp521r1":             tls.CurveP521,
+	"x25519":                tls.X25519,
+	"mlkem512":              groupMLKEM512,
+	"mlkem768":              groupMLKEM768,
+	"mlkem1024":             groupMLKEM1024,
+	"secp256r1mlkem768":     groupSecP256r1MLKEM768,
+	"x25519mlkem768":        groupX25519MLKEM768,
+	"secp384r1mlkem1024":    groupSecP384r1MLKEM1024,
+	"x25519kyber768draft00": groupX25519Kyber768Draft00,
+}
+
+// postQuantumGroups are the groups matched by MatchKeyShare.PostQuantum.
+var postQuantumGroups = []tls.CurveID{
+	groupMLKEM512,
+	groupMLKEM768,
+	groupMLKEM1024,
+	groupSecP256r1MLKEM768,
+	groupX25519MLKEM768,
+	groupSecP384r1MLKEM1024,
+	groupX25519Kyber768Draft00,
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner          = (*MatchKeyShare)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchKeyShare)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchKeyShare)(nil)
+)
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -29,6 +30,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchTLS{})
+	layer4.RegisterProtocol("tls")
 }
 
 // MatchTLS is able to match TLS connections. Its structure
@@ -37,8 +39,9 @@ func init() {
 type MatchTLS struct {
 	MatchersRaw caddy.ModuleMap `json:"-" caddy:"namespace=tls.handshake_match"`
 
-	matchers []caddytls.ConnectionMatcher
-	logger   *zap.Logger
+	matchers      []caddytls.ConnectionMatcher
+	postHandshake bool
+	logger        *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -68,12 +71,19 @@ func (m *MatchTLS) Provision(ctx caddy.Context) error {
 	}
 	for _, modIface := range mods.(map[string]any) {
 		m.matchers = append(m.matchers, modIface.(caddytls.ConnectionMatcher))
+		if _, ok := modIface.(postHandshakeMatcher); ok {
+			m.postHandshake = true
+		}
 	}
 	return nil
 }
 
 // Match returns true if the connection is a TLS handshake.
 func (m *MatchTLS) Match(cx *layer4.Connection) (bool, error) {
+	if m.postHandshake {
+		return m.matchTerminated(cx)
+	}
+
 	// read the header bytes
 	const recordHeaderLen = 5
 	hdr := make([]byte, recordHeaderLen)
@@ -99,18 +109,42 @@ func (m *MatchTLS) Match(cx *layer4.Connection) (bool, error) {
 	chi := parseRawClientHello(rawHello)
 	chi.Conn = cx
 
+	// make the whole ClientHelloInfo available to handshake matchers and later handlers
+	cx.SetValue(clientHelloInfoKey{}, &chi)
+
 	// also add values to the replacer
 	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
 	repl.Set("l4.tls.server_name", chi.ServerName)
+	repl.Set("l4.tls.server_name_types", joinUints(chi.ServerNameTypes))
 	repl.Set("l4.tls.version", chi.Version)
+	repl.Set("l4.tls.compression_methods", joinUints(chi.CompressionMethods))
+	repl.Set("l4.tls.extension_count", chi.DistinctExtensions())
+	repl.Set("l4.tls.key_share_groups", joinUints(chi.KeyShareGroups()))
+	repl.Set("l4.tls.alpn", strings.Join(chi.SupportedProtos, ","))
+	repl.Set("l4.tls.versions", joinUints(chi.SupportedVersions))
+	repl.Set("l4.tls.zero_random", chi.ZeroRandom())
+	repl.Set("l4.tls.secure_renegotiation", chi.RenegotiationSignal())
+
+	// the JA3 fingerprint is only computed if it's needed
+	repl.Map(func(key string) (any, bool) {
+		switch key {
+		case "l4.tls.ja3":
+			_, hash := chi.ja3Fingerprint()
+			return hash, true
+		case "l4.tls.ja3_string":
+			ja3, _ := chi.ja3Fingerprint()
+			return ja3, true
+		}
+		return nil, false
+	})
 
 	for _, matcher := range m.matchers {
-		// TODO: even though we have more data than the standard lib's
+		// even though we have more data than the standard lib's
 		// ClientHelloInfo lets us fill, the matcher modules we use do
 		// not accept our own type; but the advantage of this is that
-		// we can reuse TLS connection matchers from the tls app - but
-		// it would be nice if we found a way to give matchers all
-		// the infoz
+		// we can reuse TLS connection matchers from the tls app, and
+		// our own matchers may get all the infoz from the connection
+		// (see clientHelloInfoFrom)
 		if !matcher.Match(&chi.ClientHelloInfo) {
 			return false, nil
 		}
@@ -121,9 +155,39 @@ func (m *MatchTLS) Match(cx *layer4.Connection) (bool, error) {
 		zap.String("server_name", chi.ServerName),
 	)
 
+	cx.SetProtocol("tls")
+	return true, nil
+}
+
+// matchTerminated returns true if the TLS connection terminated by the tls handler matches. Since the
+// ClientHello has been consumed by then, post-handshake matchers check the terminated connection, and
+// the other matchers check the ClientHello recorded when the connection was matched before, if any.
+func (m *MatchTLS) matchTerminated(cx *layer4.Connection) (bool, error) {
+	chi, hasClientHello := GetClientHelloInfo(cx)
+	for _, matcher := range m.matchers {
+		if phm, ok := matcher.(postHandshakeMatcher); ok {
+			matched, err := phm.matchTerminated(cx)
+			if err != nil || !matched {
+				return false, err
+			}
+			continue
+		}
+		if !hasClientHello || !matcher.Match(&chi.ClientHelloInfo) {
+			return false, nil
+		}
+	}
+	cx.SetProtocol("tls")
 	return true, nil
 }
 
+// postHandshakeMatcher is implemented by TLS handshake matchers that can only check
+// a connection once TLS has been terminated, e.g. whether a client certificate has
+// been presented. They make MatchTLS check terminated connections instead of reading
+// a ClientHello, so they must follow the tls handler.
+type postHandshakeMatcher interface {
+	matchTerminated(cx *layer4.Connection) (bool, error)
+}
+
 // UnmarshalCaddyfile sets up the MatchTLS from Caddyfile tokens. Syntax:
 //
 //	tls {
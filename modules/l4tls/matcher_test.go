@@ -0,0 +1,986 @@
+package l4tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// testHello describes a ClientHello to be built by buildClientHello.
+type testHello struct {
+	version            uint16
+	random             []byte
+	cipherSuites       []uint16
+	compressionMethods []uint8
+	serverName         string
+	serverNames        [][2]any // pairs of name type (uint8) and name (string) following serverName
+	extensions         [][2]any // pairs of extension type (uint16) and data ([]byte)
+}
+
+// buildClientHello returns a TLS record containing a ClientHello described by h.
+func buildClientHello(h testHello) []byte {
+	if h.version == 0 {
+		h.version = 0x0303
+	}
+	if len(h.cipherSuites) == 0 {
+		h.cipherSuites = []uint16{0x1301, 0xc02f}
+	}
+	if h.compressionMethods == nil {
+		h.compressionMethods = []uint8{compressionNone}
+	}
+	if h.random == nil {
+		h.random = make([]byte, 32)
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(0x16)    // record type: handshake
+	b.AddUint16(0x0301) // record version
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0x01) // handshake type: ClientHello
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(h.version)
+			b.AddBytes(h.random)
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, cs := range h.cipherSuites {
+					b.AddUint16(cs)
+				}
+			})
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(h.compressionMethods)
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				if len(h.serverName) > 0 || len(h.serverNames) > 0 {
+					b.AddUint16(extensionServerName)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+							if len(h.serverName) > 0 {
+								b.AddUint8(nameTypeHostName)
+								b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+									b.AddBytes([]byte(h.serverName))
+								})
+							}
+							for _, name := range h.serverNames {
+								b.AddUint8(name[0].(uint8))
+								b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+									b.AddBytes([]byte(name[1].(string)))
+								})
+							}
+						})
+					})
+				}
+				for _, ext := range h.extensions {
+					b.AddUint16(ext[0].(uint16))
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(ext[1].([]byte))
+					})
+				}
+			})
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+// matchTLSTester runs a tls matcher with the given handshake matchers against data.
+func matchTLSTester(t *testing.T, matchers caddy.ModuleMap, data []byte) (bool, *layer4.Connection) {
+	t.Helper()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchTLS{MatchersRaw: matchers}
+	if err := m.Provision(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+
+	in, out := net.Pipe()
+	defer func() {
+		_, _ = io.Copy(io.Discard, out)
+		_ = out.Close()
+	}()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	go func() {
+		_, err := in.Write(data)
+		assertNoError(t, err)
+		_ = in.Close()
+	}()
+
+	matched, err := m.Match(cx)
+	assertNoError(t, err)
+
+	return matched, cx
+}
+
+func TestMatchTLS_ClientHelloInfo(t *testing.T) {
+	matched, cx := matchTLSTester(t, caddy.ModuleMap{}, buildClientHello(testHello{serverName: "example.com"}))
+	if !matched {
+		t.Fatalf("matcher did not match")
+	}
+
+	chi, ok := GetClientHelloInfo(cx)
+	if !ok {
+		t.Fatalf("no ClientHelloInfo deposited")
+	}
+	if chi.ServerName != "example.com" {
+		t.Fatalf("unexpected server name: %s", chi.ServerName)
+	}
+	if clientHelloInfoFrom(&chi.ClientHelloInfo) != chi {
+		t.Fatalf("ClientHelloInfo not available to handshake matchers")
+	}
+}
+
+func TestMatchCompression(t *testing.T) {
+	nullOnly := buildClientHello(testHello{serverName: "example.com"})
+	deflate := buildClientHello(testHello{serverName: "example.com", compressionMethods: []uint8{compressionDeflate, compressionNone}})
+
+	for i, tc := range []struct {
+		matcher     json.RawMessage
+		data        []byte
+		shouldMatch bool
+		methods     string
+	}{
+		{matcher: json.RawMessage(`{"non_null":true}`), data: nullOnly, shouldMatch: false, methods: "0"},
+		{matcher: json.RawMessage(`{"non_null":true}`), data: deflate, shouldMatch: true, methods: "1,0"},
+		{matcher: json.RawMessage(`{"methods":[1]}`), data: deflate, shouldMatch: true, methods: "1,0"},
+		{matcher: json.RawMessage(`{"methods":[64]}`), data: deflate, shouldMatch: false, methods: "1,0"},
+		{matcher: json.RawMessage(`{"methods":[0]}`), data: nullOnly, shouldMatch: true, methods: "0"},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"compression": tc.matcher}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matcher)
+			}
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		methods, _ := repl.GetString("l4.tls.compression_methods")
+		if methods != tc.methods {
+			t.Fatalf("test %d: unexpected compression methods | got %q, want %q\n", i, methods, tc.methods)
+		}
+	}
+}
+
+func TestMatchServerNameType(t *testing.T) {
+	hostName := buildClientHello(testHello{serverName: "example.com"})
+	other := buildClientHello(testHello{serverNames: [][2]any{{uint8(1), "example.com"}}})
+	mixed := buildClientHello(testHello{serverName: "example.com", serverNames: [][2]any{{uint8(1), "example.com"}, {uint8(7), "x"}}})
+	none := buildClientHello(testHello{})
+
+	for i, tc := range []struct {
+		matcher     json.RawMessage
+		data        []byte
+		shouldMatch bool
+		serverName  string
+		types       string
+	}{
+		{matcher: json.RawMessage(`{"non_host_name":true}`), data: hostName, shouldMatch: false, serverName: "example.com", types: "0"},
+		{matcher: json.RawMessage(`{"non_host_name":true}`), data: other, shouldMatch: true, types: "1"},
+		{matcher: json.RawMessage(`{"non_host_name":true}`), data: mixed, shouldMatch: true, serverName: "example.com", types: "0,1,7"},
+		{matcher: json.RawMessage(`{"non_host_name":true}`), data: none, shouldMatch: false},
+		{matcher: json.RawMessage(`{"types":[0]}`), data: hostName, shouldMatch: true, serverName: "example.com", types: "0"},
+		{matcher: json.RawMessage(`{"types":[0]}`), data: other, shouldMatch: false, types: "1"},
+		{matcher: json.RawMessage(`{"types":[7]}`), data: mixed, shouldMatch: true, serverName: "example.com", types: "0,1,7"},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"server_name_type": tc.matcher}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matcher)
+			}
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		if serverName, _ := repl.GetString("l4.tls.server_name"); serverName != tc.serverName {
+			t.Fatalf("test %d: unexpected server name | got %q, want %q\n", i, serverName, tc.serverName)
+		}
+		if types, _ := repl.GetString("l4.tls.server_name_types"); types != tc.types {
+			t.Fatalf("test %d: unexpected server name types | got %q, want %q\n", i, types, tc.types)
+		}
+	}
+}
+
+func TestMatchServerNameType_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchServerNameType{
+		{},
+		{Types: []int{256}},
+		{NonHostName: true, Types: []int{-1}},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid matcher should not be provisioned | %+v\n", i, m)
+		}
+	}
+}
+
+func TestMatchZeroRandom(t *testing.T) {
+	random := make([]byte, 32)
+	for i := range random {
+		random[i] = byte(i + 1)
+	}
+	trailingZeros := make([]byte, 32)
+	trailingZeros[0] = 0x01
+
+	for i, tc := range []struct {
+		data        []byte
+		shouldMatch bool
+	}{
+		{data: buildClientHello(testHello{serverName: "example.com", random: make([]byte, 32)}), shouldMatch: true},
+		{data: buildClientHello(testHello{serverName: "example.com", random: random}), shouldMatch: false},
+		{data: buildClientHello(testHello{serverName: "example.com", random: trailingZeros}), shouldMatch: false},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"zero_random": json.RawMessage(`{}`)}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match\n", i)
+			} else {
+				t.Fatalf("test %d: matcher should not match\n", i)
+			}
+		}
+
+		// the placeholder is set regardless of the handshake matchers
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		if zero, _ := repl.Get("l4.tls.zero_random"); zero != tc.shouldMatch {
+			t.Fatalf("test %d: unexpected zero random | got %v, want %t\n", i, zero, tc.shouldMatch)
+		}
+	}
+}
+
+func TestMatchSecureRenegotiation(t *testing.T) {
+	renegotiationInfo := [2]any{extensionRenegotiationInfo, []byte{0x00}}
+	extension := buildClientHello(testHello{serverName: "example.com", extensions: [][2]any{renegotiationInfo}})
+	scsv := buildClientHello(testHello{serverName: "example.com", cipherSuites: []uint16{0xc02f, scsvRenegotiation}})
+	both := buildClientHello(testHello{serverName: "example.com", cipherSuites: []uint16{0xc02f, scsvRenegotiation},
+		extensions: [][2]any{renegotiationInfo}})
+	none := buildClientHello(testHello{serverName: "example.com"})
+
+	for i, tc := range []struct {
+		matcher     json.RawMessage
+		data        []byte
+		shouldMatch bool
+		signal      string
+	}{
+		{matcher: json.RawMessage(`{}`), data: extension, shouldMatch: true, signal: "extension"},
+		{matcher: json.RawMessage(`{}`), data: scsv, shouldMatch: true, signal: "scsv"},
+		{matcher: json.RawMessage(`{}`), data: both, shouldMatch: true, signal: "both"},
+		{matcher: json.RawMessage(`{}`), data: none, shouldMatch: false, signal: "none"},
+		{matcher: json.RawMessage(`{"signals":["none"]}`), data: none, shouldMatch: true, signal: "none"},
+		{matcher: json.RawMessage(`{"signals":["none"]}`), data: extension, shouldMatch: false, signal: "extension"},
+		{matcher: json.RawMessage(`{"signals":["scsv","none"]}`), data: scsv, shouldMatch: true, signal: "scsv"},
+		{matcher: json.RawMessage(`{"signals":["scsv"]}`), data: both, shouldMatch: false, signal: "both"},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"secure_renegotiation": tc.matcher}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matcher)
+			}
+		}
+
+		// the placeholder is set regardless of the handshake matchers
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		if signal, _ := repl.GetString("l4.tls.secure_renegotiation"); signal != tc.signal {
+			t.Fatalf("test %d: unexpected signal | got %q, want %q\n", i, signal, tc.signal)
+		}
+	}
+}
+
+func TestMatchSecureRenegotiation_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchSecureRenegotiation{Signals: []string{"extension", "insecure"}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("unsupported signal should not be accepted | %+v\n", m)
+	}
+}
+
+func TestMatchExtensionCount(t *testing.T) {
+	extensions := func(n int) [][2]any {
+		exts := make([][2]any, 0, n)
+		for i := range n {
+			exts = append(exts, [2]any{uint16(0x5a00 + i), []byte{}})
+		}
+		return exts
+	}
+	none := buildClientHello(testHello{})
+	few := buildClientHello(testHello{serverName: "example.com", extensions: extensions(1)})
+	typical := buildClientHello(testHello{serverName: "example.com", extensions: extensions(11)})
+	many := buildClientHello(testHello{serverName: "example.com", extensions: extensions(40)})
+	repeated := buildClientHello(testHello{serverName: "example.com", extensions: append(extensions(6), extensions(6)...)})
+
+	for i, tc := range []struct {
+		matcher     json.RawMessage
+		data        []byte
+		shouldMatch bool
+		count       string
+	}{
+		{matcher: json.RawMessage(`{"min":5,"max":20}`), data: none, shouldMatch: false, count: "0"},
+		{matcher: json.RawMessage(`{"min":5,"max":20}`), data: few, shouldMatch: false, count: "2"},
+		{matcher: json.RawMessage(`{"min":5,"max":20}`), data: typical, shouldMatch: true, count: "12"},
+		{matcher: json.RawMessage(`{"min":5,"max":20}`), data: many, shouldMatch: false, count: "41"},
+		{matcher: json.RawMessage(`{"min":5,"max":20}`), data: repeated, shouldMatch: true, count: "7"},
+		{matcher: json.RawMessage(`{"min":30}`), data: many, shouldMatch: true, count: "41"},
+		{matcher: json.RawMessage(`{"max":2}`), data: none, shouldMatch: true, count: "0"},
+		{matcher: json.RawMessage(`{"max":2}`), data: few, shouldMatch: true, count: "2"},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"extension_count": tc.matcher}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matcher)
+			}
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		count, _ := repl.GetString("l4.tls.extension_count")
+		if count != tc.count {
+			t.Fatalf("test %d: unexpected extension count | got %q, want %q\n", i, count, tc.count)
+		}
+	}
+}
+
+func TestMatchKeyShare(t *testing.T) {
+	keyShares := func(groups ...tls.CurveID) [2]any {
+		var b cryptobyte.Builder
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, group := range groups {
+				b.AddUint16(uint16(group))
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(make([]byte, 32))
+				})
+			}
+		})
+		return [2]any{extensionKeyShare, b.BytesOrPanic()}
+	}
+	x25519 := buildClientHello(testHello{serverName: "example.com", extensions: [][2]any{keyShares(tls.X25519)}})
+	hybrid := buildClientHello(testHello{serverName: "example.com", extensions: [][2]any{keyShares(groupX25519MLKEM768, tls.X25519)}})
+	p256 := buildClientHello(testHello{serverName: "example.com", extensions: [][2]any{keyShares(tls.CurveP256)}})
+	none := buildClientHello(testHello{serverName: "example.com"})
+	malformed := buildClientHello(testHello{serverName: "example.com", extensions: [][2]any{{extensionKeyShare, []byte{0x00, 0x06, 0x00, 0x1d, 0x00, 0x20, 0x00, 0x00}}}})
+
+	for i, tc := range []struct {
+		matcher     json.RawMessage
+		data        []byte
+		shouldMatch bool
+		groups      string
+	}{
+		{matcher: json.RawMessage(`{"post_quantum":true}`), data: x25519, shouldMatch: false, groups: "29"},
+		{matcher: json.RawMessage(`{"post_quantum":true}`), data: hybrid, shouldMatch: true, groups: "4588,29"},
+		{matcher: json.RawMessage(`{"groups":[29]}`), data: hybrid, shouldMatch: true, groups: "4588,29"},
+		{matcher: json.RawMessage(`{"groups":[29]}`), data: p256, shouldMatch: false, groups: "23"},
+		{matcher: json.RawMessage(`{"groups":[23,24]}`), data: p256, shouldMatch: true, groups: "23"},
+		{matcher: json.RawMessage(`{"groups":[29]}`), data: none, shouldMatch: false, groups: ""},
+		{matcher: json.RawMessage(`{"groups":[29]}`), data: malformed, shouldMatch: false, groups: ""},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"key_share": tc.matcher}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matcher)
+			}
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		groups, _ := repl.GetString("l4.tls.key_share_groups")
+		if groups != tc.groups {
+			t.Fatalf("test %d: unexpected key share groups | got %q, want %q\n", i, groups, tc.groups)
+		}
+	}
+}
+
+func TestMatchSessionTicket(t *testing.T) {
+	// ticket returns an RFC 5077 ticket with the given key name and an encrypted state of n blocks
+	ticket := func(keyName byte, n int) []byte {
+		b := bytes.Repeat([]byte{keyName}, ticketKeyNameLen)
+		return append(b, make([]byte, ticketIVLen+n*ticketBlockLen+ticketMACLen)...)
+	}
+	sessionTicket := func(serverName string, ticket []byte) []byte {
+		return buildClientHello(testHello{serverName: serverName, extensions: [][2]any{{extensionSessionTicket, ticket}}})
+	}
+	preSharedKey := func(serverName string, ticket []byte) []byte {
+		var b cryptobyte.Builder
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(ticket)
+			})
+			b.AddUint32(0x5a5a5a5a) // obfuscated ticket age
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(make([]byte, 32))
+			})
+		})
+		return buildClientHello(testHello{serverName: serverName, extensions: [][2]any{{extensionPreSharedKey, b.BytesOrPanic()}}})
+	}
+
+	// a matcher stays in use during the test, as in a loaded config, so that the epochs are kept across connections
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	inUse := &MatchSessionTicket{Epochs: []string{ticketEpochNone}}
+	if err := inUse.Provision(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+
+	for i, tc := range []struct {
+		matcher     json.RawMessage
+		data        []byte
+		shouldMatch bool
+		epoch       string
+	}{
+		{matcher: json.RawMessage(`{"epochs":["none"]}`), data: buildClientHello(testHello{serverName: "a.example.com"}), shouldMatch: true, epoch: "none"},
+		{matcher: json.RawMessage(`{"epochs":["none"]}`), data: sessionTicket("a.example.com", []byte{}), shouldMatch: true, epoch: "none"},
+
+		// tickets of Go, which have no key name
+		{matcher: json.RawMessage(`{"epochs":["unknown"]}`), data: sessionTicket("a.example.com", make([]byte, 16+115+32)), shouldMatch: true, epoch: "unknown"},
+		{matcher: json.RawMessage(`{"epochs":["current","stale"]}`), data: sessionTicket("a.example.com", make([]byte, 48)), shouldMatch: false, epoch: "unknown"},
+
+		// fresh tickets of the first epoch
+		{matcher: json.RawMessage(`{"epochs":["current"]}`), data: sessionTicket("b.example.com", ticket(1, 10)), shouldMatch: true, epoch: "current"},
+		{matcher: json.RawMessage(`{"epochs":["current"]}`), data: preSharedKey("b.example.com", ticket(1, 12)), shouldMatch: true, epoch: "current"},
+		{matcher: json.RawMessage(`{"epochs":["stale"]}`), data: sessionTicket("b.example.com", ticket(1, 10)), shouldMatch: false, epoch: "current"},
+
+		// once a new key name is seen, tickets of the first epoch become stale
+		{matcher: json.RawMessage(`{"epochs":["current"]}`), data: sessionTicket("b.example.com", ticket(2, 10)), shouldMatch: true, epoch: "current"},
+		{matcher: json.RawMessage(`{"epochs":["stale"]}`), data: sessionTicket("b.example.com", ticket(1, 10)), shouldMatch: true, epoch: "stale"},
+		{matcher: json.RawMessage(`{"epochs":["stale"]}`), data: preSharedKey("b.example.com", ticket(1, 12)), shouldMatch: true, epoch: "stale"},
+		{matcher: json.RawMessage(`{"epochs":["current"]}`), data: preSharedKey("b.example.com", ticket(2, 12)), shouldMatch: true, epoch: "current"},
+
+		// epochs are tracked per server name
+		{matcher: json.RawMessage(`{"epochs":["current"]}`), data: sessionTicket("c.example.com", ticket(1, 10)), shouldMatch: true, epoch: "current"},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"session_ticket": tc.matcher}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matcher)
+			}
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		epoch, _ := repl.GetString("l4.tls.session_ticket_epoch")
+		if epoch != tc.epoch {
+			t.Fatalf("test %d: unexpected session ticket epoch | got %q, want %q\n", i, epoch, tc.epoch)
+		}
+	}
+
+	// once no matcher is in use, the epochs are forgotten
+	if err := inUse.Cleanup(); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	matched, _ := matchTLSTester(t, caddy.ModuleMap{"session_ticket": json.RawMessage(`{"epochs":["current"]}`)}, sessionTicket("b.example.com", ticket(1, 10)))
+	if !matched {
+		t.Fatalf("epochs should be forgotten once no matcher is in use")
+	}
+}
+
+func TestEpochTracker(t *testing.T) {
+	tracker := &epochTracker{servers: make(map[string]*keyEpochs)}
+	ticket := func(keyName byte) []byte {
+		b := bytes.Repeat([]byte{keyName}, ticketKeyNameLen)
+		return append(b, make([]byte, ticketIVLen+ticketBlockLen+ticketMACLen)...)
+	}
+
+	for keyName := range byte(maxTrackedKeyNames + 1) {
+		if epoch := tracker.observe("example.com", ticket(keyName)); epoch != ticketEpochCurrent {
+			t.Fatalf("unexpected epoch of key name %d | got %q, want %q\n", keyName, epoch, ticketEpochCurrent)
+		}
+	}
+
+	// the oldest key name has been forgotten, so it starts a new epoch
+	if epoch := tracker.observe("example.com", ticket(1)); epoch != ticketEpochStale {
+		t.Fatalf("unexpected epoch of a tracked key name | got %q, want %q\n", epoch, ticketEpochStale)
+	}
+	if epoch := tracker.observe("example.com", ticket(0)); epoch != ticketEpochCurrent {
+		t.Fatalf("unexpected epoch of a forgotten key name | got %q, want %q\n", epoch, ticketEpochCurrent)
+	}
+	if n := len(tracker.servers["example.com"].names); n != maxTrackedKeyNames {
+		t.Fatalf("unexpected number of tracked key names | got %d, want %d\n", n, maxTrackedKeyNames)
+	}
+}
+
+func TestMatchJA3(t *testing.T) {
+	curves := func(groups ...uint16) [2]any {
+		var b cryptobyte.Builder
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, group := range groups {
+				b.AddUint16(group)
+			}
+		})
+		return [2]any{extensionSupportedCurves, b.BytesOrPanic()}
+	}
+	points := [2]any{extensionSupportedPoints, []byte{0x01, 0x00}}
+
+	// the examples of the JA3 README
+	tls10 := buildClientHello(testHello{
+		version:      0x0301,
+		cipherSuites: []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		serverName:   "example.com",
+		extensions:   [][2]any{curves(23, 24, 25), points},
+	})
+	tls10NoExtensions := buildClientHello(testHello{
+		version:      0x0301,
+		cipherSuites: []uint16{4, 5, 10, 9, 100, 98, 3, 6, 19, 18, 99},
+	})
+	// a browser-like ClientHello with GREASE values, which must be left out
+	grease := buildClientHello(testHello{
+		cipherSuites: []uint16{0x2a2a, 4865, 4866, 4867, 49195},
+		serverName:   "example.com",
+		extensions: [][2]any{
+			{uint16(0x3a3a), []byte{}},
+			{uint16(23), []byte{}},
+			{extensionRenegotiationInfo, []byte{0x00}},
+			curves(0x4a4a, 29, 23, 24),
+			points,
+			{extensionSessionTicket, []byte{}},
+			{uint16(0x1a1a), []byte{0x00}},
+		},
+	})
+
+	for i, tc := range []struct {
+		matcher     json.RawMessage
+		data        []byte
+		shouldMatch bool
+		ja3         string
+		ja3String   string
+	}{
+		{matcher: json.RawMessage(`{"allow":["ada70206e40642a3e4461f35503241d5"]}`), data: tls10, shouldMatch: true,
+			ja3: "ada70206e40642a3e4461f35503241d5", ja3String: "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"},
+		{matcher: json.RawMessage(`{"allow":["DE350869B8C85DE67A350C8D186F11E6"]}`), data: tls10NoExtensions, shouldMatch: true,
+			ja3: "de350869b8c85de67a350c8d186f11e6", ja3String: "769,4-5-10-9-100-98-3-6-19-18-99,,,"},
+		{matcher: json.RawMessage(`{"allow":["aa6d2adf5771f78c71dbbd519b13bf87"]}`), data: grease, shouldMatch: true,
+			ja3: "aa6d2adf5771f78c71dbbd519b13bf87", ja3String: "771,4865-4866-4867-49195,0-23-65281-10-11-35,29-23-24,0"},
+		{matcher: json.RawMessage(`{"allow":["ada70206e40642a3e4461f35503241d5"]}`), data: grease, shouldMatch: false,
+			ja3: "aa6d2adf5771f78c71dbbd519b13bf87", ja3String: "771,4865-4866-4867-49195,0-23-65281-10-11-35,29-23-24,0"},
+		{matcher: json.RawMessage(`{"deny":["ada70206e40642a3e4461f35503241d5"]}`), data: tls10, shouldMatch: false,
+			ja3: "ada70206e40642a3e4461f35503241d5", ja3String: "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"},
+		{matcher: json.RawMessage(`{"deny":["ada70206e40642a3e4461f35503241d5"]}`), data: grease, shouldMatch: true,
+			ja3: "aa6d2adf5771f78c71dbbd519b13bf87", ja3String: "771,4865-4866-4867-49195,0-23-65281-10-11-35,29-23-24,0"},
+		{matcher: json.RawMessage(`{"allow":["aa6d2adf5771f78c71dbbd519b13bf87"],"deny":["aa6d2adf5771f78c71dbbd519b13bf87"]}`), data: grease, shouldMatch: false,
+			ja3: "aa6d2adf5771f78c71dbbd519b13bf87", ja3String: "771,4865-4866-4867-49195,0-23-65281-10-11-35,29-23-24,0"},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"ja3": tc.matcher}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matcher)
+			}
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		ja3, _ := repl.GetString("l4.tls.ja3")
+		ja3String, _ := repl.GetString("l4.tls.ja3_string")
+		if ja3 != tc.ja3 || ja3String != tc.ja3String {
+			t.Fatalf("test %d: unexpected JA3 | got %q (%q), want %q (%q)\n", i, ja3, ja3String, tc.ja3, tc.ja3String)
+		}
+	}
+}
+
+func TestMatchJA3_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchJA3{
+		{},
+		{Allow: []string{"ada70206e40642a3e4461f35503241d"}},
+		{Deny: []string{"ada70206e40642a3e4461f35503241dz"}},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid fingerprints should not be accepted | %+v\n", i, m)
+		}
+	}
+}
+
+func TestMatchSupportedVersions(t *testing.T) {
+	supportedVersions := func(versions ...uint16) [2]any {
+		var b cryptobyte.Builder
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, version := range versions {
+				b.AddUint16(version)
+			}
+		})
+		return [2]any{extensionSupportedVersions, b.BytesOrPanic()}
+	}
+	alpn := func(protos ...string) [2]any {
+		var b cryptobyte.Builder
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, proto := range protos {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte(proto))
+				})
+			}
+		})
+		return [2]any{extensionALPN, b.BytesOrPanic()}
+	}
+	tls12 := buildClientHello(testHello{serverName: "example.com", extensions: [][2]any{alpn("http/1.1")}})
+	tls13 := buildClientHello(testHello{serverName: "example.com", extensions: [][2]any{
+		alpn("h2", "http/1.1"),
+		supportedVersions(0x0a0a, tls.VersionTLS13, tls.VersionTLS12),
+	}})
+	tls11 := buildClientHello(testHello{version: tls.VersionTLS11, serverName: "example.com"})
+
+	for i, tc := range []struct {
+		matcher     json.RawMessage
+		data        []byte
+		shouldMatch bool
+		alpn        string
+		versions    string
+	}{
+		{matcher: json.RawMessage(`{"min":"tls1.3"}`), data: tls12, shouldMatch: false, alpn: "http/1.1", versions: "771,770,769"},
+		{matcher: json.RawMessage(`{"min":"tls1.3"}`), data: tls13, shouldMatch: true, alpn: "h2,http/1.1", versions: "2570,772,771"},
+		{matcher: json.RawMessage(`{"min":"tls1.2"}`), data: tls12, shouldMatch: true, alpn: "http/1.1", versions: "771,770,769"},
+		{matcher: json.RawMessage(`{"min":"tls1.2"}`), data: tls11, shouldMatch: false, alpn: "", versions: "770,769"},
+		{matcher: json.RawMessage(`{"min":"tls1.0","max":"tls1.2"}`), data: tls13, shouldMatch: false, alpn: "h2,http/1.1", versions: "2570,772,771"},
+		{matcher: json.RawMessage(`{"min":"tls1.0","max":"tls1.2"}`), data: tls12, shouldMatch: true, alpn: "http/1.1", versions: "771,770,769"},
+	} {
+		matched, cx := matchTLSTester(t, caddy.ModuleMap{"supported_versions": tc.matcher}, tc.data)
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matcher)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matcher)
+			}
+		}
+
+		repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+		alpn, _ := repl.GetString("l4.tls.alpn")
+		versions, _ := repl.GetString("l4.tls.versions")
+		if alpn != tc.alpn || versions != tc.versions {
+			t.Fatalf("test %d: unexpected vars | got %q and %q, want %q and %q\n", i, alpn, versions, tc.alpn, tc.versions)
+		}
+	}
+}
+
+func TestMatchSupportedVersions_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchSupportedVersions{
+		{},
+		{Min: "tls1.4"},
+		{Min: "tls1.2", Max: "ssl3.0"},
+		{Min: "tls1.3", Max: "tls1.2"},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid versions should not be accepted | %+v\n", i, m)
+		}
+	}
+}
+
+func TestMatchSNIFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "allowed_sni.txt")
+	err := os.WriteFile(file, []byte("# allowed server names\n"+
+		"example.com\n"+
+		"  API.Example.org.  \n"+
+		"\n"+
+		"*.internal.example.net\n"+
+		"bad name.example.com\n"+
+		"foo.*.example.com\n"+
+		"*\n"), 0o600)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+
+	// the server names are matched by the tls matcher
+	matcher := json.RawMessage(`{"file":"` + filepath.ToSlash(file) + `"}`)
+	for i, tc := range []struct {
+		serverName  string
+		shouldMatch bool
+	}{
+		{serverName: "example.com", shouldMatch: true},
+		{serverName: "EXAMPLE.com", shouldMatch: true},
+		{serverName: "api.example.org", shouldMatch: true},
+		{serverName: "db.internal.example.net", shouldMatch: true},
+		{serverName: "www.example.com", shouldMatch: false},
+		{serverName: "internal.example.net", shouldMatch: false},
+		{serverName: "a.db.internal.example.net", shouldMatch: false},
+		{serverName: "bad name.example.com", shouldMatch: false},
+		{serverName: "", shouldMatch: false},
+	} {
+		matched, _ := matchTLSTester(t, caddy.ModuleMap{"sni_file": matcher}, buildClientHello(testHello{serverName: tc.serverName}))
+		if matched != tc.shouldMatch {
+			if tc.shouldMatch {
+				t.Fatalf("test %d: matcher did not match | %s\n", i, tc.serverName)
+			} else {
+				t.Fatalf("test %d: matcher should not match | %s\n", i, tc.serverName)
+			}
+		}
+	}
+}
+
+func TestMatchSNIFile_Reload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "allowed_sni.txt")
+	if err := os.WriteFile(file, []byte("old.example.com\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchSNIFile{File: file}
+	if err := m.Provision(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	defer func() { _ = m.Cleanup() }()
+
+	// waitFor fails unless the server names are matched as expected within a second
+	waitFor := func(step string, want map[string]bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			ok := true
+			for serverName, shouldMatch := range want {
+				ok = ok && m.Match(&tls.ClientHelloInfo{ServerName: serverName}) == shouldMatch
+			}
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: allow-list isn't reloaded | want %v\n", step, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("initial", map[string]bool{"old.example.com": true, "new.example.com": false})
+
+	// a write is picked up
+	if err := os.WriteFile(file, []byte("new.example.com\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	waitFor("write", map[string]bool{"old.example.com": false, "new.example.com": true})
+
+	// an atomic replacement is picked up
+	tmp := filepath.Join(dir, "allowed_sni.txt.tmp")
+	if err := os.WriteFile(tmp, []byte("*.example.com\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	waitFor("rename", map[string]bool{"old.example.com": true, "new.example.com": true, "example.com": false})
+
+	// a removal empties the allow-list
+	if err := os.Remove(file); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	waitFor("remove", map[string]bool{"old.example.com": false, "new.example.com": false})
+}
+
+func TestMatchSNIFile_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, m := range []*MatchSNIFile{
+		{},
+		{File: filepath.Join(t.TempDir(), "missing", "allowed_sni.txt")},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("file '%s' should not be accepted", m.File)
+		}
+	}
+}
+
+// selfSignedCert returns a self-signed certificate for commonName.
+func selfSignedCert(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s\n", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %s\n", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// terminateTLSTester performs a loopback TLS handshake over a new connection, the server requesting a client
+// certificate like the tls handler would, and returns the connection and the one carrying the decrypted stream.
+func terminateTLSTester(t *testing.T, serverCert tls.Certificate, clientCerts []tls.Certificate) (*layer4.Connection, *layer4.Connection) {
+	t.Helper()
+	in, out := net.Pipe()
+	t.Cleanup(func() { _ = in.Close() })
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	tlsConn := tls.Server(cx, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	clientDone := make(chan error, 1)
+	go func() {
+		client := tls.Client(in, &tls.Config{InsecureSkipVerify: true, Certificates: clientCerts}) //nolint:gosec
+		clientDone <- client.Handshake()
+	}()
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("server handshake failed: %s\n", err)
+	}
+	if err := <-clientDone; err != nil {
+		t.Fatalf("client handshake failed: %s\n", err)
+	}
+	state := tlsConn.ConnectionState()
+	appendConnectionState(cx, &state)
+
+	return cx, cx.Wrap(tlsConn)
+}
+
+func TestMatchClientCert(t *testing.T) {
+	serverCert, clientCert := selfSignedCert(t, "server.example.com"), selfSignedCert(t, "client.example.com")
+	sum := sha256.Sum256(clientCert.Certificate[0])
+
+	for i, tc := range []struct {
+		matcher     *MatchClientCert
+		clientCerts []tls.Certificate
+		shouldMatch bool
+		subject     string
+		fingerprint string
+	}{
+		{matcher: &MatchClientCert{}, clientCerts: []tls.Certificate{clientCert}, shouldMatch: true,
+			subject: "CN=client.example.com,O=Test", fingerprint: hex.EncodeToString(sum[:])},
+		{matcher: &MatchClientCert{}, shouldMatch: false},
+		{matcher: &MatchClientCert{Absent: true}, clientCerts: []tls.Certificate{clientCert}, shouldMatch: false,
+			subject: "CN=client.example.com,O=Test", fingerprint: hex.EncodeToString(sum[:])},
+		{matcher: &MatchClientCert{Absent: true}, shouldMatch: true},
+	} {
+		func() {
+			cx, terminated := terminateTLSTester(t, serverCert, tc.clientCerts)
+			defer func() { _ = cx.Close() }()
+
+			matched, err := tc.matcher.Match(terminated)
+			assertNoError(t, err)
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range map[string]string{
+				"l4.tls.client_cert.subject":     tc.subject,
+				"l4.tls.client_cert.fingerprint": tc.fingerprint,
+			} {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
+		}()
+	}
+
+	// connections without terminated TLS aren't matched
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+	for _, m := range []*MatchClientCert{{}, {Absent: true}} {
+		matched, err := m.Match(layer4.WrapConnection(out, []byte{}, zap.NewNop()))
+		assertNoError(t, err)
+		if matched {
+			t.Fatalf("matcher should not match connections without TLS | %+v\n", m)
+		}
+	}
+}
+
+func TestMatchRequireClientCert(t *testing.T) {
+	serverCert, clientCert := selfSignedCert(t, "server.example.com"), selfSignedCert(t, "client.example.com")
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range []struct {
+		matchers    caddy.ModuleMap
+		clientCerts []tls.Certificate
+		clientHello bool
+		shouldMatch bool
+	}{
+		{matchers: caddy.ModuleMap{"require_client_cert": json.RawMessage("{}")}, clientCerts: []tls.Certificate{clientCert}, shouldMatch: true},
+		{matchers: caddy.ModuleMap{"require_client_cert": json.RawMessage("{}")}, shouldMatch: false},
+
+		// the other handshake matchers check the ClientHello recorded when the connection was matched before
+		{matchers: caddy.ModuleMap{"require_client_cert": json.RawMessage("{}"), "sni": json.RawMessage(`["server.example.com"]`)},
+			clientCerts: []tls.Certificate{clientCert}, clientHello: true, shouldMatch: true},
+		{matchers: caddy.ModuleMap{"require_client_cert": json.RawMessage("{}"), "sni": json.RawMessage(`["other.example.com"]`)},
+			clientCerts: []tls.Certificate{clientCert}, clientHello: true, shouldMatch: false},
+		{matchers: caddy.ModuleMap{"require_client_cert": json.RawMessage("{}"), "sni": json.RawMessage(`["server.example.com"]`)},
+			clientCerts: []tls.Certificate{clientCert}, shouldMatch: false},
+	} {
+		func() {
+			m := &MatchTLS{MatchersRaw: tc.matchers}
+			if err := m.Provision(ctx); err != nil {
+				t.Fatalf("test %d: Unexpected error: %s\n", i, err)
+			}
+
+			cx, terminated := terminateTLSTester(t, serverCert, tc.clientCerts)
+			defer func() { _ = cx.Close() }()
+			if tc.clientHello {
+				chi := &ClientHelloInfo{ClientHelloInfo: tls.ClientHelloInfo{ServerName: "server.example.com", Conn: cx}}
+				cx.SetValue(clientHelloInfoKey{}, chi)
+			}
+
+			matched, err := m.Match(terminated)
+			assertNoError(t, err)
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %s\n", i, tc.matchers)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %s\n", i, tc.matchers)
+				}
+			}
+		}()
+	}
+
+	// connections without terminated TLS aren't matched, even if they start with a ClientHello
+	matched, _ := matchTLSTester(t, caddy.ModuleMap{"require_client_cert": json.RawMessage("{}")}, buildClientHello(testHello{serverName: "example.com"}))
+	if matched {
+		t.Fatalf("matcher should not match connections without TLS")
+	}
+}
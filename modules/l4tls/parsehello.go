@@ -16,6 +16,7 @@ package l4tls
 
 import (
 	"crypto/tls"
+	"slices"
 	"strings"
 
 	"golang.org/x/crypto/cryptobyte"
@@ -100,13 +101,14 @@ func parseRawClientHello(data []byte) (info ClientHelloInfo) {
 					serverName.Empty() {
 					return
 				}
-				if nameType != 0 {
-					continue
-				}
-				if len(info.ServerName) != 0 {
+				if slices.Contains(info.ServerNameTypes, nameType) {
 					// Multiple names of the same name_type are prohibited.
 					return
 				}
+				info.ServerNameTypes = append(info.ServerNameTypes, nameType)
+				if nameType != nameTypeHostName {
+					continue
+				}
 				info.ServerName = string(serverName)
 				// An SNI value may not include a trailing dot.
 				if strings.HasSuffix(info.ServerName, ".") {
@@ -336,6 +338,11 @@ const (
 	extensionRenegotiationInfo       uint16 = 0xff01
 )
 
+// TLS server name types (RFC 6066)
+const (
+	nameTypeHostName uint8 = 0
+)
+
 // TLS signaling cipher suite values
 const (
 	scsvRenegotiation uint16 = 0x00ff
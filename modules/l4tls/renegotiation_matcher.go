@@ -0,0 +1,125 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSecureRenegotiation{})
+}
+
+// MatchSecureRenegotiation is able to match ClientHellos by how they signal support for secure renegotiation
+// (RFC 5746), e.g. to route legacy clients that don't support it to a warning or deny path. The signal is
+// exposed as {l4.tls.secure_renegotiation} for any ClientHello, which is one of:
+//
+//   - extension: the renegotiation_info extension is sent;
+//   - scsv: the TLS_EMPTY_RENEGOTIATION_INFO_SCSV cipher suite (0x00FF) is sent instead, e.g. by clients
+//     sending SSL 3.0 compatible ClientHellos without extensions;
+//   - both: both are sent, which RFC 5746 discourages, but doesn't forbid;
+//   - none: neither is sent, i.e. the client doesn't support secure renegotiation.
+//
+// Note: this matcher only works within the layer4 tls matcher, since it needs more information
+// than the standard library's ClientHelloInfo holds.
+type MatchSecureRenegotiation struct {
+	// Signals is a list of signals to match: extension, scsv, both or none.
+	// Any signal of support, i.e. extension, scsv or both, is matched if empty.
+	Signals []string `json:"signals,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchSecureRenegotiation) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.secure_renegotiation",
+		New: func() caddy.Module { return new(MatchSecureRenegotiation) },
+	}
+}
+
+// Match returns true if the ClientHello signals support for secure renegotiation in a matching way.
+func (m *MatchSecureRenegotiation) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	signal := chi.RenegotiationSignal()
+	if len(m.Signals) == 0 {
+		return signal != renegotiationSignalNone
+	}
+	return slices.Contains(m.Signals, signal)
+}
+
+// UnmarshalCaddyfile sets up the MatchSecureRenegotiation from Caddyfile tokens. Syntax:
+//
+//	secure_renegotiation [<extension|scsv|both|none...>]
+func (m *MatchSecureRenegotiation) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		for d.NextArg() {
+			if !slices.Contains(renegotiationSignals, d.Val()) {
+				return d.Errf("parsing %s signal '%s': unsupported signal", wrapper, d.Val())
+			}
+			m.Signals = append(m.Signals, d.Val())
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Provision validates m.
+func (m *MatchSecureRenegotiation) Provision(_ caddy.Context) error {
+	for _, signal := range m.Signals {
+		if !slices.Contains(renegotiationSignals, signal) {
+			return fmt.Errorf("unsupported signal '%s'", signal)
+		}
+	}
+	return nil
+}
+
+const (
+	renegotiationSignalExtension = "extension"
+	renegotiationSignalSCSV      = "scsv"
+	renegotiationSignalBoth      = "both"
+	renegotiationSignalNone      = "none"
+)
+
+var renegotiationSignals = []string{
+	renegotiationSignalExtension, renegotiationSignalSCSV, renegotiationSignalBoth, renegotiationSignalNone,
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc5746#section-3.3
+//	https://www.rfc-editor.org/rfc/rfc5746#section-3.4
+
+// Interface guards
+var (
+	_ caddy.Provisioner          = (*MatchSecureRenegotiation)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchSecureRenegotiation)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchSecureRenegotiation)(nil)
+)
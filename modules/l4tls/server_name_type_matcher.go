@@ -0,0 +1,128 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchServerNameType{})
+}
+
+// MatchServerNameType is able to match ClientHellos by the name types of their server_name list
+// entries. Since host_name is the only name type ever defined, a ClientHello with an entry of any
+// other type comes from an anomalous client. The types of all the entries are exposed as
+// {l4.tls.server_name_types}, e.g. 0. Note: this matcher only works within the layer4 tls matcher,
+// since it needs more information than the standard library's ClientHelloInfo holds.
+type MatchServerNameType struct {
+	// NonHostName matches ClientHellos with at least one server_name entry of a type other than host_name.
+	NonHostName bool `json:"non_host_name,omitempty"`
+	// Types matches ClientHellos with at least one server_name entry of the given types, e.g. 0 for host_name.
+	Types []int `json:"types,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchServerNameType) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.server_name_type",
+		New: func() caddy.Module { return new(MatchServerNameType) },
+	}
+}
+
+// Match returns true if the ClientHello has server_name entries of matching types.
+func (m *MatchServerNameType) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	for _, nameType := range chi.ServerNameTypes {
+		if m.NonHostName && nameType != nameTypeHostName {
+			return true
+		}
+		if slices.Contains(m.Types, int(nameType)) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalCaddyfile sets up the MatchServerNameType from Caddyfile tokens. Syntax:
+//
+//	server_name_type non_host_name|<types...>
+//
+// Types may be given by their names (host_name) or numbers.
+func (m *MatchServerNameType) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// At least one same-line option must be provided
+		if d.CountRemainingArgs() == 0 {
+			return d.ArgErr()
+		}
+
+		for d.NextArg() {
+			val := d.Val()
+			if val == "non_host_name" {
+				m.NonHostName = true
+				continue
+			}
+			nameType := nameTypeHostName
+			if val != "host_name" {
+				num, err := strconv.ParseUint(val, 10, 8)
+				if err != nil {
+					return d.Errf("parsing %s type '%s': %v", wrapper, val, err)
+				}
+				nameType = uint8(num)
+			}
+			m.Types = append(m.Types, int(nameType))
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Provision validates m.
+func (m *MatchServerNameType) Provision(_ caddy.Context) error {
+	if !m.NonHostName && len(m.Types) == 0 {
+		return fmt.Errorf("neither non_host_name nor types are set")
+	}
+	for _, nameType := range m.Types {
+		if nameType < 0 || nameType > 255 {
+			return fmt.Errorf("invalid server name type %d", nameType)
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner          = (*MatchServerNameType)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchServerNameType)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchServerNameType)(nil)
+)
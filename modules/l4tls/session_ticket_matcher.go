@@ -0,0 +1,252 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSessionTicket{})
+}
+
+// MatchSessionTicket is able to match ClientHellos by the epoch of the session ticket key their session
+// ticket (or TLS 1.3 PSK identity) was issued with, e.g. to route resumption attempts with tickets of a
+// previous epoch elsewhere for diagnosis while canarying TLS config changes. The epoch is exposed as
+// {l4.tls.session_ticket_epoch}, which is one of:
+//
+//   - none: no session ticket is presented;
+//   - unknown: the session ticket doesn't have the structure recommended by RFC 5077, i.e. a 16-byte key name,
+//     a 16-byte IV, an encrypted state of a multiple of 16 bytes and a 32-byte MAC, which is used by OpenSSL
+//     and its derivatives, e.g. nginx or HAProxy, but not by Go, so that key names are unavailable;
+//   - current: the key name is the newest one seen for the server name;
+//   - stale: a newer key name has been seen for the server name since, i.e. the keys have been rotated.
+//
+// This is a best-effort guess: since the keys themselves are unknown, the epochs are learned from the key
+// names presented by clients, so any client presenting a new key name starts a new epoch. The epochs are
+// shared by all the session_ticket matchers, and kept through config reloads as long as any of them is in
+// use, but forgotten when Caddy restarts. Note: this matcher only works within the layer4 tls matcher, since
+// it needs more information than the standard library's ClientHelloInfo holds.
+type MatchSessionTicket struct {
+	// Epochs is a list of epochs to match: none, unknown, current or stale.
+	Epochs []string `json:"epochs,omitempty"`
+
+	tracker *epochTracker
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchSessionTicket) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.session_ticket",
+		New: func() caddy.Module { return new(MatchSessionTicket) },
+	}
+}
+
+// Match returns true if the session ticket of the ClientHello has a matching epoch.
+func (m *MatchSessionTicket) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	epoch := m.tracker.observe(chi.ServerName, chi.sessionTicket())
+
+	cx := chi.Conn.(*layer4.Connection)
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.tls.session_ticket_epoch", epoch)
+
+	return slices.Contains(m.Epochs, epoch)
+}
+
+// UnmarshalCaddyfile sets up the MatchSessionTicket from Caddyfile tokens. Syntax:
+//
+//	session_ticket <none|unknown|current|stale...>
+func (m *MatchSessionTicket) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// At least one same-line option must be provided
+		if d.CountRemainingArgs() == 0 {
+			return d.ArgErr()
+		}
+
+		for d.NextArg() {
+			if !slices.Contains(ticketEpochNames, d.Val()) {
+				return d.Errf("parsing %s epoch '%s': unsupported epoch", wrapper, d.Val())
+			}
+			m.Epochs = append(m.Epochs, d.Val())
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Provision validates m and loads the shared epoch tracker.
+func (m *MatchSessionTicket) Provision(_ caddy.Context) error {
+	if len(m.Epochs) == 0 {
+		return fmt.Errorf("no epochs are set")
+	}
+	for _, epoch := range m.Epochs {
+		if !slices.Contains(ticketEpochNames, epoch) {
+			return fmt.Errorf("unsupported epoch '%s'", epoch)
+		}
+	}
+
+	val, _, err := ticketEpochs.LoadOrNew(ticketEpochsKey, func() (caddy.Destructor, error) {
+		return &epochTracker{servers: make(map[string]*keyEpochs)}, nil
+	})
+	if err != nil {
+		return err
+	}
+	m.tracker = val.(*epochTracker)
+	return nil
+}
+
+// Cleanup releases the shared epoch tracker.
+func (m *MatchSessionTicket) Cleanup() error {
+	if m.tracker != nil {
+		_, err := ticketEpochs.Delete(ticketEpochsKey)
+		return err
+	}
+	return nil
+}
+
+// sessionTicket returns the session ticket presented by the client, either in the session_ticket
+// extension (TLS 1.2) or as the first identity of the pre_shared_key extension (TLS 1.3), if any.
+func (chi *ClientHelloInfo) sessionTicket() []byte {
+	if len(chi.SessionTicket) > 0 {
+		return chi.SessionTicket
+	}
+	if len(chi.PSKIdentities) > 0 {
+		return chi.PSKIdentities[0].label
+	}
+	return nil
+}
+
+// epochTracker learns the epochs of session ticket keys from the key names of the tickets presented
+// for each server name. A key name not seen before starts a new epoch, which becomes the current one.
+type epochTracker struct {
+	mu      sync.Mutex
+	servers map[string]*keyEpochs
+}
+
+// keyEpochs holds the epochs of the key names seen for a server name.
+type keyEpochs struct {
+	names  map[string]uint64
+	newest uint64
+}
+
+// observe returns the epoch of ticket presented for serverName and tracks its key name.
+func (t *epochTracker) observe(serverName string, ticket []byte) string {
+	if len(ticket) == 0 {
+		return ticketEpochNone
+	}
+	if len(ticket) < ticketKeyNameLen+ticketIVLen+ticketBlockLen+ticketMACLen ||
+		(len(ticket)-ticketKeyNameLen-ticketIVLen-ticketMACLen)%ticketBlockLen != 0 {
+		return ticketEpochUnknown
+	}
+	keyName := string(ticket[:ticketKeyNameLen])
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	epochs, ok := t.servers[serverName]
+	if !ok {
+		if len(t.servers) >= maxTrackedServerNames {
+			clear(t.servers)
+		}
+		epochs = &keyEpochs{names: make(map[string]uint64)}
+		t.servers[serverName] = epochs
+	}
+
+	epoch, ok := epochs.names[keyName]
+	if !ok {
+		// Forget the oldest key name if there are too many
+		if len(epochs.names) >= maxTrackedKeyNames {
+			var oldestName string
+			var oldest uint64
+			for name, e := range epochs.names {
+				if oldest == 0 || e < oldest {
+					oldestName, oldest = name, e
+				}
+			}
+			delete(epochs.names, oldestName)
+		}
+		epochs.newest++
+		epoch = epochs.newest
+		epochs.names[keyName] = epoch
+	}
+
+	if epoch == epochs.newest {
+		return ticketEpochCurrent
+	}
+	return ticketEpochStale
+}
+
+// Destruct implements caddy.Destructor.
+func (t *epochTracker) Destruct() error {
+	return nil
+}
+
+// ticketEpochs holds the epoch tracker shared by the session_ticket matchers. Since new configs are provisioned
+// before old ones are cleaned up, it's kept through config reloads, and released once no matcher uses it.
+var ticketEpochs = caddy.NewUsagePool()
+
+const (
+	ticketEpochNone    = "none"
+	ticketEpochUnknown = "unknown"
+	ticketEpochCurrent = "current"
+	ticketEpochStale   = "stale"
+
+	ticketKeyNameLen = 16 // Length of the key name of RFC 5077 tickets
+	ticketIVLen      = 16 // Length of the IV of RFC 5077 tickets (AES-CBC)
+	ticketBlockLen   = 16 // Length of the blocks of the encrypted state of RFC 5077 tickets (AES-CBC)
+	ticketMACLen     = 32 // Length of the MAC of RFC 5077 tickets (HMAC-SHA256)
+
+	maxTrackedKeyNames    = 8
+	maxTrackedServerNames = 1024
+
+	ticketEpochsKey = "session_ticket_epochs" // Key of the epoch tracker in ticketEpochs
+)
+
+var ticketEpochNames = []string{ticketEpochNone, ticketEpochUnknown, ticketEpochCurrent, ticketEpochStale}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc5077#section-4
+//	https://www.rfc-editor.org/rfc/rfc8446#section-4.2.11
+
+// Interface guards
+var (
+	_ caddy.CleanerUpper         = (*MatchSessionTicket)(nil)
+	_ caddy.Destructor           = (*epochTracker)(nil)
+	_ caddy.Provisioner          = (*MatchSessionTicket)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchSessionTicket)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchSessionTicket)(nil)
+)
@@ -0,0 +1,271 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSNIFile{})
+}
+
+// MatchSNIFile is able to match ClientHellos by their server name (SNI) against an allow-list loaded from a file,
+// which is watched and reloaded whenever it changes, so that large and frequently changing allow-lists needn't be
+// inlined into the config. The file has one server name per line, either exact, e.g. example.com, or a wildcard
+// matching a single label, e.g. *.example.com. Names are case-insensitive, empty lines and lines starting with #
+// are ignored, and malformed entries are logged and skipped. If the file doesn't exist, no server name is matched
+// until it's created. If it can't be reloaded, the previous allow-list is kept.
+type MatchSNIFile struct {
+	// File is the path of the file containing the allowed server names.
+	File string `json:"file,omitempty"`
+
+	logger *zap.Logger
+	list   atomic.Pointer[sniList]
+	done   chan struct{}
+	stop   sync.Once
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchSNIFile) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.sni_file",
+		New: func() caddy.Module { return new(MatchSNIFile) },
+	}
+}
+
+// Match returns true if the server name of the ClientHello is in the allow-list.
+func (m *MatchSNIFile) Match(hello *tls.ClientHelloInfo) bool {
+	return m.list.Load().contains(hello.ServerName)
+}
+
+// UnmarshalCaddyfile sets up the MatchSNIFile from Caddyfile tokens. Syntax:
+//
+//	sni_file <path>
+func (m *MatchSNIFile) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// Exactly one same-line option must be provided
+		if d.CountRemainingArgs() != 1 {
+			return d.ArgErr()
+		}
+		_, m.File = d.NextArg(), d.Val()
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Provision loads the allow-list and starts watching its file.
+func (m *MatchSNIFile) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger()
+
+	if len(m.File) == 0 {
+		return errors.New("no file is set")
+	}
+	m.File = filepath.Clean(m.File)
+
+	// The directory is watched rather than the file, so that it can be created or replaced atomically
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating file watcher: %v", err)
+	}
+	if err = watcher.Add(filepath.Dir(m.File)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("watching directory of file '%s': %v", m.File, err)
+	}
+
+	list, err := m.load()
+	if err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	m.list.Store(list)
+
+	m.done = make(chan struct{})
+	go m.watch(ctx, watcher)
+
+	return nil
+}
+
+// Cleanup stops watching the file.
+func (m *MatchSNIFile) Cleanup() error {
+	if m.done != nil {
+		m.stop.Do(func() { close(m.done) })
+	}
+	return nil
+}
+
+// watch reloads the allow-list whenever its file is created, written, renamed or removed,
+// until m is cleaned up or ctx is done.
+func (m *MatchSNIFile) watch(ctx caddy.Context, watcher *fsnotify.Watcher) {
+	defer func() { _ = watcher.Close() }()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ctx.Done():
+			return
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			m.logger.Error("watching SNI file", zap.String("file", m.File), zap.Error(err))
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) != m.File || e.Has(fsnotify.Chmod) && !e.Has(fsnotify.Write) {
+				continue
+			}
+			list, err := m.load()
+			if err != nil {
+				m.logger.Error("reloading SNI file, keeping the previous allow-list", zap.String("file", m.File), zap.Error(err))
+				continue
+			}
+			m.list.Store(list)
+			m.logger.Debug("reloaded SNI file", zap.String("file", m.File), zap.Int("names", list.len()))
+		}
+	}
+}
+
+// load reads the allow-list from m's file. A missing file results in an empty allow-list.
+func (m *MatchSNIFile) load() (*sniList, error) {
+	list := &sniList{exact: make(map[string]struct{}), wildcards: make(map[string]struct{})}
+
+	file, err := os.Open(m.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		m.logger.Warn("SNI file not found, no server name is allowed", zap.String("file", m.File))
+		return list, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening SNI file '%s': %v", m.File, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if !list.add(line) {
+			m.logger.Warn("skipping malformed entry of SNI file",
+				zap.String("file", m.File),
+				zap.Int("line", lineNum),
+				zap.String("entry", line),
+			)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading SNI file '%s': %v", m.File, err)
+	}
+
+	return list, nil
+}
+
+// sniList is an allow-list of server names, holding the exact names and the
+// parent domains of wildcard names separately for constant-time lookups.
+type sniList struct {
+	exact     map[string]struct{}
+	wildcards map[string]struct{} // e.g. example.com for *.example.com
+}
+
+// add adds name to l and returns true, or returns false if name is malformed.
+func (l *sniList) add(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if domain, ok := strings.CutPrefix(name, "*."); ok {
+		if !isServerName(domain) {
+			return false
+		}
+		l.wildcards[domain] = struct{}{}
+		return true
+	}
+	if !isServerName(name) {
+		return false
+	}
+	l.exact[name] = struct{}{}
+	return true
+}
+
+// contains returns true if serverName is in l, either exactly or as a subdomain of a wildcard name.
+func (l *sniList) contains(serverName string) bool {
+	if l == nil || len(serverName) == 0 {
+		return false
+	}
+	serverName = strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if _, ok := l.exact[serverName]; ok {
+		return true
+	}
+	if _, domain, found := strings.Cut(serverName, "."); found {
+		_, ok := l.wildcards[domain]
+		return ok
+	}
+	return false
+}
+
+// len returns the number of names in l.
+func (l *sniList) len() int {
+	return len(l.exact) + len(l.wildcards)
+}
+
+// isServerName returns true if name is a lowercase DNS name of non-empty labels of letters, digits,
+// hyphens and underscores, which isn't longer than 253 characters.
+func isServerName(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Interface guards
+var (
+	_ caddy.CleanerUpper         = (*MatchSNIFile)(nil)
+	_ caddy.Provisioner          = (*MatchSNIFile)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchSNIFile)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchSNIFile)(nil)
+)
@@ -0,0 +1,131 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSupportedVersions{})
+}
+
+// MatchSupportedVersions is able to match ClientHellos by the highest TLS version they support, i.e. the version
+// that will be negotiated with a server supporting all of them, e.g. to route clients capable of TLS 1.3 (and
+// possibly HTTP/3) elsewhere than legacy ones. The versions are taken from the supported_versions extension, or
+// from the legacy version if it's absent. All the versions supported by the client are exposed as
+// {l4.tls.versions}, e.g. 772,771, and its ALPN protocols as {l4.tls.alpn}, e.g. h2,http/1.1.
+// Note: this matcher only works within the layer4 tls matcher, since it needs more information
+// than the standard library's ClientHelloInfo holds.
+type MatchSupportedVersions struct {
+	// Min is the minimum version, inclusive: tls1.0, tls1.1, tls1.2 or tls1.3.
+	Min string `json:"min,omitempty"`
+	// Max is the maximum version, inclusive: tls1.0, tls1.1, tls1.2 or tls1.3. If empty, there is no upper bound.
+	Max string `json:"max,omitempty"`
+
+	min, max uint16
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchSupportedVersions) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.supported_versions",
+		New: func() caddy.Module { return new(MatchSupportedVersions) },
+	}
+}
+
+// Match returns true if the highest version supported by the ClientHello is within range.
+func (m *MatchSupportedVersions) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	var highest uint16
+	for _, version := range chi.SupportedVersions {
+		if !isGREASE(version) && version > highest {
+			highest = version
+		}
+	}
+	return highest >= m.min && (m.max == 0 || highest <= m.max)
+}
+
+// UnmarshalCaddyfile sets up the MatchSupportedVersions from Caddyfile tokens. Syntax:
+//
+//	supported_versions <min> [<max>]
+func (m *MatchSupportedVersions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// One or two same-line options must be provided
+		if d.CountRemainingArgs() == 0 || d.CountRemainingArgs() > 2 {
+			return d.ArgErr()
+		}
+		_, m.Min = d.NextArg(), d.Val()
+		if d.NextArg() {
+			m.Max = d.Val()
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Provision parses m's versions.
+func (m *MatchSupportedVersions) Provision(_ caddy.Context) error {
+	var ok bool
+	if m.min, ok = tlsVersions[m.Min]; !ok {
+		return fmt.Errorf("unsupported min version '%s'", m.Min)
+	}
+	if len(m.Max) > 0 {
+		if m.max, ok = tlsVersions[m.Max]; !ok {
+			return fmt.Errorf("unsupported max version '%s'", m.Max)
+		}
+		if m.max < m.min {
+			return fmt.Errorf("max version %s is less than min %s", m.Max, m.Min)
+		}
+	}
+	return nil
+}
+
+// tlsVersions maps the names of TLS versions to their values, like caddytls.SupportedProtocols,
+// but including the versions deprecated by RFC 8996, which clients may still support.
+var tlsVersions = map[string]uint16{
+	"tls1.0": tls.VersionTLS10,
+	"tls1.1": tls.VersionTLS11,
+	"tls1.2": tls.VersionTLS12,
+	"tls1.3": tls.VersionTLS13,
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc8446#section-4.2.1
+//	https://www.rfc-editor.org/rfc/rfc8996
+
+// Interface guards
+var (
+	_ caddy.Provisioner          = (*MatchSupportedVersions)(nil)
+	_ caddytls.ConnectionMatcher = (*MatchSupportedVersions)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchSupportedVersions)(nil)
+)
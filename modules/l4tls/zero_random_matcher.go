@@ -0,0 +1,83 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4tls
+
+import (
+	"crypto/tls"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchZeroRandom{})
+}
+
+// MatchZeroRandom is able to match ClientHellos whose 32-byte random consists of zeros only, which
+// only broken, misconfigured or test clients send, so that such connections can be flagged or dropped.
+// Whether the random is zeroed is also exposed as {l4.tls.zero_random}, i.e. true or false, for any
+// ClientHello. Note: this matcher only works within the layer4 tls matcher, since it needs more
+// information than the standard library's ClientHelloInfo holds.
+type MatchZeroRandom struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchZeroRandom) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.handshake_match.zero_random",
+		New: func() caddy.Module { return new(MatchZeroRandom) },
+	}
+}
+
+// Match returns true if the random of the ClientHello consists of zeros only.
+func (m *MatchZeroRandom) Match(hello *tls.ClientHelloInfo) bool {
+	chi := clientHelloInfoFrom(hello)
+	if chi == nil {
+		return false
+	}
+
+	return chi.ZeroRandom()
+}
+
+// UnmarshalCaddyfile sets up the MatchZeroRandom from Caddyfile tokens. Syntax:
+//
+//	zero_random
+func (m *MatchZeroRandom) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		wrapper := d.Val()
+
+		// No same-line options are supported
+		if d.CountRemainingArgs() > 0 {
+			return d.ArgErr()
+		}
+
+		// No blocks are supported
+		if d.NextBlock(d.Nesting()) {
+			return d.Errf("malformed TLS handshake matcher '%s': blocks are not supported", wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc8446#section-4.1.2
+
+// Interface guards
+var (
+	_ caddytls.ConnectionMatcher = (*MatchZeroRandom)(nil)
+	_ caddyfile.Unmarshaler      = (*MatchZeroRandom)(nil)
+)
@@ -0,0 +1,363 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4tunnel allows forwarding connections over a persistent multiplexed tunnel
+package l4tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/hashicorp/yamux"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler is a terminal handler that forwards connections to a remote agent over a single persistent
+// multiplexed tunnel, instead of dialing a new connection per client: every connection is carried by
+// a new logical stream of the tunnel, which the agent is expected to accept and forward further, e.g.
+// in hub-and-spoke architectures where agents can't be dialed directly by clients.
+//
+// The tunnel is dialed when the first connection is handled and redialed whenever it has been closed,
+// e.g. by a network failure or a missed keep-alive. Handlers with the same agent address and multiplexer
+// share the tunnel, which stays open through config reloads. Each stream has its own flow control window,
+// so that a slow client or agent only stalls its own stream, not the whole tunnel.
+type Handler struct {
+	// To is the network address of the agent, e.g. agent.example.com:7000.
+	To string `json:"to,omitempty"`
+
+	// Mux is the multiplexing protocol of the tunnel. Only yamux is supported, which is the default.
+	Mux string `json:"mux,omitempty"`
+
+	// DialTimeout is how long to wait for the tunnel to be dialed. Default: 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	// KeepAliveInterval is how often the tunnel is checked with a ping. Default: 30s.
+	KeepAliveInterval caddy.Duration `json:"keep_alive_interval,omitempty"`
+
+	// MaxStreamWindow is the maximum number of bytes of a stream which may be in flight without being
+	// read by the other end, i.e. how much is buffered before the sender of a stream is blocked.
+	// Must be at least 256 KiB, which is the default.
+	MaxStreamWindow int `json:"max_stream_window,omitempty"`
+
+	address caddy.NetworkAddress
+	key     string
+	tunnel  *tunnel
+	logger  *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.tunnel",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+
+	repl := caddy.NewReplacer()
+	to := repl.ReplaceAll(h.To, "")
+	if len(to) == 0 {
+		return fmt.Errorf("no agent address is set")
+	}
+	var err error
+	h.address, err = caddy.ParseNetworkAddress(to)
+	if err != nil {
+		return fmt.Errorf("parsing agent address: %w", err)
+	}
+	if h.address.PortRangeSize() != 1 {
+		return fmt.Errorf("%s: port ranges not supported", to)
+	}
+
+	if len(h.Mux) == 0 {
+		h.Mux = muxYamux
+	}
+	if h.Mux != muxYamux {
+		return fmt.Errorf("unsupported mux '%s'", h.Mux)
+	}
+
+	if h.DialTimeout < 0 || h.KeepAliveInterval < 0 {
+		return fmt.Errorf("durations must be at least 0")
+	}
+	if h.DialTimeout == 0 {
+		h.DialTimeout = caddy.Duration(defaultDialTimeout)
+	}
+
+	config := yamux.DefaultConfig()
+	config.LogOutput, config.Logger = nil, zap.NewStdLog(h.logger)
+	if h.KeepAliveInterval > 0 {
+		config.KeepAliveInterval = time.Duration(h.KeepAliveInterval)
+	}
+	if h.MaxStreamWindow > 0 {
+		config.MaxStreamWindowSize = uint32(h.MaxStreamWindow) //nolint:gosec // disable G115
+	}
+	if err = yamux.VerifyConfig(config); err != nil {
+		return fmt.Errorf("configuring %s: %w", h.Mux, err)
+	}
+
+	h.key = h.Mux + "/" + h.address.String()
+	val, _, err := tunnels.LoadOrNew(h.key, func() (caddy.Destructor, error) {
+		return &tunnel{
+			address:     h.address,
+			dialTimeout: time.Duration(h.DialTimeout),
+			config:      config,
+			logger:      h.logger,
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+	h.tunnel = val.(*tunnel)
+
+	return nil
+}
+
+// Cleanup releases the tunnel, which is closed once no handler uses it anymore.
+func (h *Handler) Cleanup() error {
+	if h.tunnel != nil {
+		_, err := tunnels.Delete(h.key)
+		return err
+	}
+	return nil
+}
+
+// Handle handles the connections.
+func (h *Handler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
+	stream, err := h.tunnel.open()
+	if err != nil {
+		return fmt.Errorf("opening stream to %s: %w", h.address, err)
+	}
+	defer func() { _ = stream.Close() }()
+
+	h.logger.Debug("opened stream",
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.String("agent", h.address.String()),
+		zap.Uint32("stream", stream.StreamID()))
+
+	// the stream is half closed once the client is done sending,
+	// and the client connection once the agent is done sending
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(stream, cx)
+		_ = stream.Close()
+	}()
+	if _, err = io.Copy(cx, stream); err != nil && !errors.Is(err, yamux.ErrStreamClosed) {
+		h.logger.Debug("reading from stream",
+			zap.String("remote", cx.RemoteAddr().String()),
+			zap.Uint32("stream", stream.StreamID()),
+			zap.Error(err))
+	}
+	if conn, ok := cx.Conn.(closeWriter); ok {
+		_ = conn.CloseWrite()
+	}
+	<-done
+
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	tunnel [<to>] {
+//		to <address>
+//		mux yamux
+//		dial_timeout <duration>
+//		keep_alive_interval <duration>
+//		max_stream_window <bytes>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line option is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+
+	var hasTo, hasMux, hasDialTimeout, hasKeepAliveInterval, hasMaxStreamWindow bool
+	if d.NextArg() {
+		h.To, hasTo = d.Val(), true
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "to":
+			if hasTo {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			_, h.To, hasTo = d.NextArg(), d.Val(), true
+		case "mux":
+			if hasMux {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			_, h.Mux, hasMux = d.NextArg(), d.Val(), true
+		case "dial_timeout", "keep_alive_interval":
+			if optionName == "dial_timeout" && hasDialTimeout || optionName == "keep_alive_interval" && hasKeepAliveInterval {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			if optionName == "dial_timeout" {
+				h.DialTimeout, hasDialTimeout = caddy.Duration(dur), true
+			} else {
+				h.KeepAliveInterval, hasKeepAliveInterval = caddy.Duration(dur), true
+			}
+		case "max_stream_window":
+			if hasMaxStreamWindow {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			h.MaxStreamWindow, hasMaxStreamWindow = int(val), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// tunnel holds the session of a multiplexed tunnel to an agent, which is dialed on demand.
+type tunnel struct {
+	address     caddy.NetworkAddress
+	dialTimeout time.Duration
+	config      *yamux.Config
+	logger      *zap.Logger
+
+	mu      sync.Mutex
+	session *yamux.Session
+	closed  bool
+}
+
+// open opens a new stream, (re)dialing the tunnel if it isn't open.
+func (t *tunnel) open() (*yamux.Stream, error) {
+	session, err := t.getSession()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if errors.Is(err, yamux.ErrSessionShutdown) {
+		// the tunnel has just been closed, so try once more with a new one
+		if session, err = t.getSession(); err != nil {
+			return nil, err
+		}
+		stream, err = session.OpenStream()
+	}
+	return stream, err
+}
+
+// getSession returns the session of the tunnel, which is dialed if there is none, or if it's closed.
+func (t *tunnel) getSession() (*yamux.Session, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, yamux.ErrSessionShutdown
+	}
+	if t.session != nil && !t.session.IsClosed() {
+		return t.session, nil
+	}
+
+	conn, err := net.DialTimeout(t.address.Network, t.address.JoinHostPort(0), t.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dialing tunnel: %w", err)
+	}
+	session, err := yamux.Client(conn, t.config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("starting tunnel session: %w", err)
+	}
+	if t.session != nil {
+		t.logger.Info("tunnel reconnected", zap.String("agent", t.address.String()))
+	}
+	t.session = session
+
+	return session, nil
+}
+
+// Destruct closes the tunnel and its streams.
+func (t *tunnel) Destruct() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	if t.session != nil {
+		return t.session.Close()
+	}
+	return nil
+}
+
+// tunnels is the global repository of tunnels that are currently in use
+// by active configuration(s), so that handlers with the same agent share
+// the tunnel, which stays open through config reloads.
+var tunnels = caddy.NewUsagePool()
+
+const (
+	defaultDialTimeout = 10 * time.Second
+
+	muxYamux = "yamux"
+)
+
+// closeWriter is implemented by connections which can be half closed, e.g. net.TCPConn.
+type closeWriter interface {
+	// CloseWrite shuts down the writing side of the connection.
+	CloseWrite() error
+}
+
+// Interface guards
+var (
+	_ caddy.CleanerUpper    = (*Handler)(nil)
+	_ caddy.Destructor      = (*tunnel)(nil)
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
@@ -0,0 +1,207 @@
+package l4tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/hashicorp/yamux"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// testAgent accepts tunnels and replies to the first line of every stream with "echo: <line>".
+type testAgent struct {
+	net.Listener
+	tunnels  atomic.Int32
+	streams  atomic.Int32
+	mu       sync.Mutex
+	sessions []*yamux.Session
+}
+
+func newTestAgent(t *testing.T) *testAgent {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	a := &testAgent{Listener: ln}
+	go a.serve()
+	return a
+}
+
+func (a *testAgent) serve() {
+	for {
+		conn, err := a.Accept()
+		if err != nil {
+			return
+		}
+		session, err := yamux.Server(conn, nil)
+		if err != nil {
+			_ = conn.Close()
+			continue
+		}
+		a.tunnels.Add(1)
+		a.mu.Lock()
+		a.sessions = append(a.sessions, session)
+		a.mu.Unlock()
+
+		go func() {
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					return
+				}
+				a.streams.Add(1)
+				go func() {
+					defer func() { _ = stream.Close() }()
+					line, err := bufio.NewReader(stream).ReadString('\n')
+					if err != nil {
+						return
+					}
+					_, _ = stream.Write([]byte("echo: " + line))
+				}()
+			}
+		}()
+	}
+}
+
+// dropTunnels closes all the tunnels accepted so far.
+func (a *testAgent) dropTunnels() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, session := range a.sessions {
+		_ = session.Close()
+	}
+}
+
+// roundTrip handles a connection sending msg with h and returns the response.
+func roundTrip(t *testing.T, h *Handler, msg string) string {
+	t.Helper()
+	in, out := net.Pipe()
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- h.Handle(cx, nil)
+		_ = out.Close()
+	}()
+
+	_, err := in.Write([]byte(msg + "\n"))
+	assertNoError(t, err)
+	resp := make([]byte, len("echo: ")+len(msg)+1)
+	_, err = io.ReadFull(in, resp)
+	assertNoError(t, err)
+	_ = in.Close()
+
+	if err = <-errs; err != nil {
+		t.Fatalf("handling failed | %s", err)
+	}
+	return string(resp)
+}
+
+func Test_Handler_Multiplexing(t *testing.T) {
+	agent := newTestAgent(t)
+	defer func() { _ = agent.Close() }()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{To: agent.Addr().String(), Mux: "yamux"}
+	err := h.Provision(ctx)
+	assertNoError(t, err)
+	defer func() { _ = h.Cleanup() }()
+
+	// concurrent connections are carried by streams of a single tunnel
+	const connections = 10
+	var wg sync.WaitGroup
+	for i := range connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := fmt.Sprintf("hello %d", i)
+			if resp := roundTrip(t, h, msg); resp != "echo: "+msg+"\n" {
+				t.Errorf("unexpected response to %q | got %q", msg, resp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := agent.tunnels.Load(); n != 1 {
+		t.Fatalf("unexpected number of tunnels | got %d, want 1", n)
+	}
+	if n := agent.streams.Load(); n != connections {
+		t.Fatalf("unexpected number of streams | got %d, want %d", n, connections)
+	}
+
+	// the tunnel is redialed once it has been closed
+	agent.dropTunnels()
+	deadline := time.Now().Add(5 * time.Second)
+	for !h.tunnel.session.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp := roundTrip(t, h, "reconnected"); resp != "echo: reconnected\n" {
+		t.Fatalf("unexpected response after reconnection | got %q", resp)
+	}
+	if n := agent.tunnels.Load(); n != 2 {
+		t.Fatalf("unexpected number of tunnels after reconnection | got %d, want 2", n)
+	}
+}
+
+func Test_Handler_Unavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{To: addr}
+	err = h.Provision(ctx)
+	assertNoError(t, err)
+	defer func() { _ = h.Cleanup() }()
+
+	in, out := net.Pipe()
+	defer func() {
+		_ = in.Close()
+		_ = out.Close()
+	}()
+	if err = h.Handle(layer4.WrapConnection(out, []byte{}, zap.NewNop()), nil); err == nil {
+		t.Fatalf("handling should fail if the agent is unavailable")
+	}
+}
+
+func Test_Handler_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, h := range []*Handler{
+		{},
+		{To: "localhost:7000-7001"},
+		{To: "localhost:7000", Mux: "smux"},
+		{To: "localhost:7000", MaxStreamWindow: 1024},
+		{To: "localhost:7000", DialTimeout: caddy.Duration(-time.Second)},
+	} {
+		if err := h.Provision(ctx); err == nil {
+			t.Fatalf("invalid config should not be accepted | %+v", h)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4vnc allows the L4 multiplexing of VNC (RFB) connections
+package l4vnc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchVNC{})
+	layer4.RegisterProtocol("vnc")
+}
+
+const (
+	protocolVersionLength = 12     // Length of ProtocolVersion messages: "RFB xxx.yyy\n" (bytes)
+	protocolVersionPrefix = "RFB " // Prefix of ProtocolVersion messages
+)
+
+// MatchVNC is able to match VNC connections, which start with a ProtocolVersion message of 12 bytes,
+// i.e. "RFB xxx.yyy\n", where xxx and yyy are the zero-padded major and minor versions, e.g. 003.008.
+// Unlike most protocols, RFB is server-first: the server sends its ProtocolVersion, and the client
+// replies with the version to use in the same format, so this matcher matches either. Since ordinary
+// clients stay silent until the server has spoken, it's useful where the connecting peer is a server,
+// e.g. with reverse connections of VNC servers to listening viewers, or after the greeting has been
+// relayed. The version of a matched message is exposed as {l4.vnc.version}, e.g. 3.8.
+type MatchVNC struct {
+	// Versions is a list of RFB versions to match, e.g. 3.3, 3.7 or 3.8. By default, any version is matched.
+	Versions []string `json:"versions,omitempty"`
+
+	versions []string
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchVNC) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.vnc",
+		New: func() caddy.Module { return new(MatchVNC) },
+	}
+}
+
+// Match returns true if the connection starts with an RFB ProtocolVersion message.
+func (m *MatchVNC) Match(cx *layer4.Connection) (bool, error) {
+	matched, _, err := m.MatchConfidence(cx)
+	return matched, err
+}
+
+// MatchConfidence returns true if the connection starts with an RFB ProtocolVersion message,
+// and the share of the parts of the message format that are valid as the confidence.
+func (m *MatchVNC) MatchConfidence(cx *layer4.Connection) (bool, float64, error) {
+	buf := make([]byte, protocolVersionLength)
+	n, err := io.ReadFull(cx, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, 0, fmt.Errorf("reading protocol version: %w", err)
+	}
+	buf = buf[:n]
+
+	// Validate the format: "RFB ", 3 digits, a dot, 3 digits and a newline
+	_, majorOK := parseDigits(buf[min(4, n):min(7, n)])
+	_, minorOK := parseDigits(buf[min(8, n):min(11, n)])
+	parts := []bool{
+		n >= 4 && string(buf[:4]) == protocolVersionPrefix,
+		n >= 7 && majorOK,
+		n >= 8 && buf[7] == '.',
+		n >= 11 && minorOK,
+		n >= 12 && buf[11] == '\n',
+	}
+	var valid int
+	for _, ok := range parts {
+		if ok {
+			valid++
+		}
+	}
+	confidence := float64(valid) / float64(len(parts))
+	if valid < len(parts) {
+		return false, confidence, nil
+	}
+
+	major, _ := parseDigits(buf[4:7])
+	minor, _ := parseDigits(buf[8:11])
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if len(m.versions) > 0 && !slices.Contains(m.versions, version) {
+		return false, confidence, nil
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.vnc.version", version)
+	cx.SetProtocol("vnc")
+
+	return true, confidence, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchVNC) Provision(_ caddy.Context) error {
+	m.versions = m.versions[:0]
+	for _, version := range m.Versions {
+		major, minor, found := strings.Cut(version, ".")
+		majorNum, err1 := strconv.ParseUint(major, 10, 16)
+		minorNum, err2 := strconv.ParseUint(minor, 10, 16)
+		if !found || err1 != nil || err2 != nil || majorNum > 999 || minorNum > 999 {
+			return fmt.Errorf("invalid RFB version '%s'", version)
+		}
+		m.versions = append(m.versions, fmt.Sprintf("%d.%d", majorNum, minorNum))
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchVNC from Caddyfile tokens. Syntax:
+//
+//	vnc [<versions...>]
+func (m *MatchVNC) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	m.Versions = append(m.Versions, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// parseDigits returns the number made of the decimal digits of b, and false if b has any other characters.
+func parseDigits(b []byte) (int, bool) {
+	var n int
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc6143.html#section-7.1.1
+
+// Interface guards
+var (
+	_ caddy.Provisioner        = (*MatchVNC)(nil)
+	_ caddyfile.Unmarshaler    = (*MatchVNC)(nil)
+	_ layer4.ConfidenceMatcher = (*MatchVNC)(nil)
+)
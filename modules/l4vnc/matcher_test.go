@@ -0,0 +1,135 @@
+package l4vnc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func Test_MatchVNC_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchVNC
+		data        []byte
+		shouldMatch bool
+		version     string
+	}
+
+	tests := []test{
+		{matcher: &MatchVNC{}, data: []byte("RFB 003.008\n"), shouldMatch: true, version: "3.8"},
+		{matcher: &MatchVNC{}, data: []byte("RFB 003.003\n"), shouldMatch: true, version: "3.3"},
+		{matcher: &MatchVNC{}, data: []byte("RFB 003.889\n"), shouldMatch: true, version: "3.889"},
+		{matcher: &MatchVNC{}, data: []byte("RFB 003.008\n\x01\x02"), shouldMatch: true, version: "3.8"},
+		{matcher: &MatchVNC{Versions: []string{"3.7", "3.8"}}, data: []byte("RFB 003.008\n"), shouldMatch: true, version: "3.8"},
+		{matcher: &MatchVNC{Versions: []string{"003.003"}}, data: []byte("RFB 003.003\n"), shouldMatch: true, version: "3.3"},
+
+		{matcher: &MatchVNC{Versions: []string{"3.8"}}, data: []byte("RFB 003.003\n"), shouldMatch: false},
+		{matcher: &MatchVNC{}, data: []byte("SSH-2.0-Open"), shouldMatch: false},
+		{matcher: &MatchVNC{}, data: []byte("RFB 003.008\r"), shouldMatch: false},
+		{matcher: &MatchVNC{}, data: []byte("RFB 3.8     "), shouldMatch: false},
+		{matcher: &MatchVNC{}, data: []byte("RFB 00a.008\n"), shouldMatch: false},
+		{matcher: &MatchVNC{}, data: []byte("rfb 003.008\n"), shouldMatch: false},
+		{matcher: &MatchVNC{}, data: []byte("RFB 003.008"), shouldMatch: false},
+		{matcher: &MatchVNC{}, data: []byte{}, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %q\n", i, tc.data)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %q\n", i, tc.data)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if version, _ := repl.GetString("l4.vnc.version"); version != tc.version {
+				t.Fatalf("test %d: unexpected version | got %q, want %q\n", i, version, tc.version)
+			}
+		}()
+	}
+}
+
+func Test_MatchVNC_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, m := range []*MatchVNC{
+		{Versions: []string{"3"}},
+		{Versions: []string{"3.x"}},
+		{Versions: []string{"1000.8"}},
+		{Versions: []string{"-3.8"}},
+	} {
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: invalid matcher should not be provisioned | %+v\n", i, m)
+		}
+	}
+}
+
+func Test_MatchVNC_MatchConfidence(t *testing.T) {
+	type test struct {
+		data       []byte
+		confidence float64
+	}
+
+	tests := []test{
+		{data: []byte("RFB 003.008\n"), confidence: 1},
+		{data: []byte("RFB 003.008\r"), confidence: 0.8},
+		{data: []byte("RFB 3.8     "), confidence: 0.2},
+		{data: []byte("SSH-2.0-Open"), confidence: 0},
+	}
+
+	for i, tc := range tests {
+		func() {
+			in, out := net.Pipe()
+			defer func() {
+				_ = in.Close()
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, tc.data, zap.NewNop())
+			_, confidence, err := layer4.MatchConfidence(&MatchVNC{}, cx)
+			assertNoError(t, err)
+
+			if confidence != tc.confidence {
+				t.Fatalf("test %d: unexpected confidence | got %v, want %v\n", i, confidence, tc.confidence)
+			}
+		}()
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4websocket allows the L4 multiplexing of WebSocket connections
+package l4websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchWebSocket{})
+	layer4.RegisterProtocol("websocket")
+}
+
+const (
+	defaultMaxBytes = 4096 // Default number of bytes to read at most
+	keySize         = 16   // Size of a decoded Sec-WebSocket-Key
+)
+
+// MatchWebSocket is able to match WebSocket opening handshakes, i.e. HTTP/1.1 GET requests asking
+// to upgrade the connection to the WebSocket protocol, as opposed to plain HTTP requests. The request
+// may arrive in multiple segments, but only its header section is inspected. The subprotocols
+// requested by the client in Sec-WebSocket-Protocol, if any, are exposed as {l4.websocket.subprotocol}.
+type MatchWebSocket struct {
+	// MaxBytes is the number of bytes to read at most in order to find the end of the header section.
+	// It defaults to 4096 and may not exceed layer4.MaxMatchingBytes.
+	MaxBytes uint16 `json:"max_bytes,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchWebSocket) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.websocket",
+		New: func() caddy.Module { return new(MatchWebSocket) },
+	}
+}
+
+// Match returns true if the connection starts with a WebSocket opening handshake.
+func (m *MatchWebSocket) Match(cx *layer4.Connection) (bool, error) {
+	data := cx.MatchingBytes()
+
+	// Reject early if the request line doesn't start with the expected method
+	if !bytes.HasPrefix(data, methodPrefix[:min(len(data), len(methodPrefix))]) {
+		return false, nil
+	}
+
+	// Wait for the whole header section to be prefetched, up to the limit
+	end := headerEnd(data[:min(len(data), int(m.MaxBytes))])
+	if end < 0 {
+		if len(data) >= int(m.MaxBytes) {
+			return false, nil
+		}
+		return false, layer4.ErrConsumedAllPrefetchedBytes
+	}
+
+	// Parse the header section only, leaving any data following it alone
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data[:end])))
+	if err != nil {
+		return false, nil
+	}
+
+	if req.Method != http.MethodGet || !req.ProtoAtLeast(1, 1) ||
+		!headerContainsToken(req.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(req.Header, "Connection", "upgrade") {
+		return false, nil
+	}
+	keys := req.Header.Values("Sec-WebSocket-Key")
+	if len(keys) != 1 {
+		return false, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(keys[0])); err != nil || len(key) != keySize {
+		return false, nil
+	}
+
+	var subprotocols []string
+	for _, value := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); len(token) > 0 {
+				subprotocols = append(subprotocols, token)
+			}
+		}
+	}
+
+	cx.SetProtocol("websocket")
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.websocket.subprotocol", strings.Join(subprotocols, ","))
+
+	return true, nil
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchWebSocket) Provision(_ caddy.Context) error {
+	if m.MaxBytes == 0 {
+		m.MaxBytes = defaultMaxBytes
+	}
+	if int(m.MaxBytes) > layer4.MaxMatchingBytes {
+		return fmt.Errorf("max_bytes may not exceed %d", layer4.MaxMatchingBytes)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchWebSocket from Caddyfile tokens. Syntax:
+//
+//	websocket {
+//		max_bytes <n>
+//	}
+//	websocket
+func (m *MatchWebSocket) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasMaxBytes bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "max_bytes":
+			if hasMaxBytes {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 10, 16)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			m.MaxBytes, hasMaxBytes = uint16(val), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// headerEnd returns the length of the header section including the empty line terminating it,
+// or -1 if the terminator hasn't been found. Bare LF line endings are tolerated as net/http does.
+func headerEnd(data []byte) int {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return i + 4
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		return i + 2
+	}
+	return -1
+}
+
+// headerContainsToken returns true if any of the comma-separated values
+// of the header with the given name equals token case-insensitively.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var methodPrefix = []byte(http.MethodGet + " ")
+
+// Refs:
+//
+//	https://www.rfc-editor.org/rfc/rfc6455#section-4.1
+//	https://www.rfc-editor.org/rfc/rfc6455#section-4.2.1
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchWebSocket)(nil)
+	_ caddyfile.Unmarshaler = (*MatchWebSocket)(nil)
+	_ layer4.ConnMatcher    = (*MatchWebSocket)(nil)
+)
@@ -0,0 +1,172 @@
+package l4websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// testHandler is a connection handler that will set a variable to let us know it was called.
+type testHandler struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*testHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.test_handler",
+		New: func() caddy.Module { return new(testHandler) },
+	}
+}
+
+// Handle handles the connections.
+func (h *testHandler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	cx.SetVar("test_handler_called", true)
+	return next.Handle(cx)
+}
+
+func init() {
+	caddy.RegisterModule(&testHandler{})
+}
+
+// webSocketMatchTester runs segments through a route with the websocket matcher and returns
+// whether it matched along with the value of the subprotocol placeholder. Each segment is
+// written separately, so that the matcher sees the request arriving in multiple reads.
+func webSocketMatchTester(t *testing.T, config string, segments ...[]byte) (bool, string) {
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+	go func() {
+		for _, segment := range segments {
+			_, err := in.Write(segment)
+			assertNoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+		}
+		_ = in.Close()
+	}()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	routes := layer4.RouteList{&layer4.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{
+			{"websocket": json.RawMessage(config)},
+		},
+		HandlersRaw: []json.RawMessage{json.RawMessage("{\"handler\":\"test_handler\"}")},
+	}}
+	err := routes.Provision(ctx)
+	assertNoError(t, err)
+
+	matched, subprotocol := false, ""
+	compiledRoute := routes.Compile(zap.NewNop(), 500*time.Millisecond,
+		layer4.HandlerFunc(func(con *layer4.Connection) error {
+			repl := con.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			matched = con.GetVar("test_handler_called") != nil
+			subprotocol, _ = repl.GetString("l4.websocket.subprotocol")
+			return nil
+		}))
+
+	err = compiledRoute.Handle(cx)
+	assertNoError(t, err)
+
+	return matched, subprotocol
+}
+
+func TestMatchWebSocket(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		config      string
+		segments    [][]byte
+		shouldMatch bool
+		subprotocol string
+	}{
+		{name: "upgrade", config: "{}", segments: [][]byte{upgradeRequest}, shouldMatch: true},
+		{name: "upgrade-with-subprotocols", config: "{}", segments: [][]byte{upgradeRequestWithSubprotocols}, shouldMatch: true, subprotocol: "graphql-transport-ws,graphql-ws"},
+		{name: "upgrade-mixed-case", config: "{}", segments: [][]byte{upgradeRequestMixedCase}, shouldMatch: true},
+		{name: "upgrade-split", config: "{}", segments: [][]byte{upgradeRequest[:10], upgradeRequest[10:60], upgradeRequest[60:]}, shouldMatch: true},
+		{name: "upgrade-with-frame", config: "{}", segments: [][]byte{append(append([]byte{}, upgradeRequest...), 0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d)}, shouldMatch: true},
+		{name: "plain-get", config: "{}", segments: [][]byte{[]byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n")}, shouldMatch: false},
+		{name: "h2c-upgrade", config: "{}", segments: [][]byte{h2cUpgradeRequest}, shouldMatch: false},
+		{name: "invalid-key", config: "{}", segments: [][]byte{[]byte(strings.Replace(string(upgradeRequest), "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1))}, shouldMatch: false},
+		{name: "no-key", config: "{}", segments: [][]byte{[]byte(strings.Replace(string(upgradeRequest), "Sec-WebSocket-Key", "X-Key", 1))}, shouldMatch: false},
+		{name: "http-1.0", config: "{}", segments: [][]byte{[]byte(strings.Replace(string(upgradeRequest), "HTTP/1.1", "HTTP/1.0", 1))}, shouldMatch: false},
+		{name: "post", config: "{}", segments: [][]byte{[]byte(strings.Replace(string(upgradeRequest), "GET", "POST", 1))}, shouldMatch: false},
+		{name: "exceeds-max-bytes", config: "{\"max_bytes\":64}", segments: [][]byte{upgradeRequest}, shouldMatch: false},
+		{name: "incomplete", config: "{}", segments: [][]byte{upgradeRequest[:len(upgradeRequest)-2]}, shouldMatch: false},
+		{name: "not-http", config: "{}", segments: [][]byte{[]byte("\x16\x03\x01\x00\xa5\x01\x00\x00\xa1\x03\x03")}, shouldMatch: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			matched, subprotocol := webSocketMatchTester(t, tc.config, tc.segments...)
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("matcher did not match")
+				} else {
+					t.Fatalf("matcher should not match")
+				}
+			}
+			if subprotocol != tc.subprotocol {
+				t.Fatalf("unexpected subprotocol: got %q, want %q", subprotocol, tc.subprotocol)
+			}
+		})
+	}
+}
+
+func TestMatchWebSocket_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &MatchWebSocket{MaxBytes: layer4.MaxMatchingBytes + 1}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatalf("max_bytes exceeding the matching buffer should not be accepted")
+	}
+}
+
+var upgradeRequest = []byte("GET /chat HTTP/1.1\r\n" +
+	"Host: server.example.com\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Origin: http://example.com\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"\r\n")
+
+var upgradeRequestWithSubprotocols = []byte("GET /graphql HTTP/1.1\r\n" +
+	"Host: server.example.com\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: keep-alive, Upgrade\r\n" +
+	"Sec-WebSocket-Key: x3JJHMbDL1EzLkh9GBhXDw==\r\n" +
+	"Sec-WebSocket-Protocol: graphql-transport-ws, graphql-ws\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"\r\n")
+
+var upgradeRequestMixedCase = []byte("GET /chat HTTP/1.1\n" +
+	"host: server.example.com\n" +
+	"UPGRADE: WebSocket\n" +
+	"connection: upgrade\n" +
+	"sec-websocket-key: dGhlIHNhbXBsZSBub25jZQ==\n" +
+	"sec-websocket-version: 13\n" +
+	"\n")
+
+var h2cUpgradeRequest = []byte("GET / HTTP/1.1\r\n" +
+	"Host: server.example.com\r\n" +
+	"Connection: Upgrade, HTTP2-Settings\r\n" +
+	"Upgrade: h2c\r\n" +
+	"HTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n" +
+	"\r\n")
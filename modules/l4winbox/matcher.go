@@ -28,6 +28,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchWinbox{})
+	layer4.RegisterProtocol("winbox")
 }
 
 // MatchWinbox matches any connections that look like those initiated by Winbox, a graphical tool developed
@@ -128,6 +129,7 @@ func (m *MatchWinbox) Match(cx *layer4.Connection) (bool, error) {
 
 	// Add a username to the replacer
 	repl.Set("l4.winbox.username", msg.GetUsername())
+	cx.SetProtocol("winbox")
 
 	return true, nil
 }
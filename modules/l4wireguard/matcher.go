@@ -28,9 +28,12 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchWireGuard{})
+	layer4.RegisterProtocol("wireguard")
 }
 
-// MatchWireGuard is able to match WireGuard connections.
+// MatchWireGuard is able to match WireGuard connections, which start with a handshake initiation
+// message or, when a session is resumed, a keepalive message. The type of the matched message
+// (initiation or transport) is exposed as {l4.wireguard.message_type}.
 type MatchWireGuard struct {
 	// Zero may be used to match reserved zero bytes of Type field when
 	// they have non-zero values (e.g. for obfuscation purposes). E.g. it
@@ -57,6 +60,7 @@ func (m *MatchWireGuard) Match(cx *layer4.Connection) (bool, error) {
 		return false, err
 	}
 
+	var messageType string
 	switch n {
 	case MessageInitiationBytesTotal: // This is a handshake initiation message
 		// Parse MessageInitiation
@@ -69,6 +73,7 @@ func (m *MatchWireGuard) Match(cx *layer4.Connection) (bool, error) {
 		if msg.Type != (m.Zero&ReservedZeroFilter)|MessageTypeInitiation {
 			return false, nil
 		}
+		messageType = MessageTypeInitiationName
 	case MessageTransportBytesMin: // This is a keepalive message (with empty content)
 		// Parse MessageTransport
 		msg := &MessageTransport{}
@@ -80,10 +85,15 @@ func (m *MatchWireGuard) Match(cx *layer4.Connection) (bool, error) {
 		if msg.Type != (m.Zero&ReservedZeroFilter)|MessageTypeTransport {
 			return false, nil
 		}
+		messageType = MessageTypeTransportName
 	default: // This is anything else, can also be a valid non-empty transport message
 		return false, nil
 	}
 
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.wireguard.message_type", messageType)
+	cx.SetProtocol("wireguard")
+
 	return true, nil
 }
 
@@ -251,5 +261,8 @@ const (
 	MessageTypeCookieReply uint32 = 3
 	MessageTypeTransport   uint32 = 4
 
+	MessageTypeInitiationName = "initiation"
+	MessageTypeTransportName  = "transport"
+
 	ReservedZeroFilter = ^(uint32(0)) >> 8 << 8
 )
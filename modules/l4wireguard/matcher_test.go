@@ -78,11 +78,13 @@ func Test_MatchWireGuard_Match(t *testing.T) {
 		matcher     *MatchWireGuard
 		data        []byte
 		shouldMatch bool
+		messageType string
 	}
 
 	tests := []test{
 		{matcher: &MatchWireGuard{}, data: packet00000001, shouldMatch: false},
-		{matcher: &MatchWireGuard{}, data: append(packet00000001, make([]byte, MessageInitiationBytesTotal-len(packet00000001))...), shouldMatch: true},
+		{matcher: &MatchWireGuard{}, data: append(packet00000001, make([]byte, MessageInitiationBytesTotal-len(packet00000001)-1)...), shouldMatch: false},
+		{matcher: &MatchWireGuard{}, data: append(packet00000001, make([]byte, MessageInitiationBytesTotal-len(packet00000001))...), shouldMatch: true, messageType: MessageTypeInitiationName},
 		{matcher: &MatchWireGuard{}, data: append(packet00000001, make([]byte, MessageInitiationBytesTotal-len(packet00000001)+1)...), shouldMatch: false},
 
 		{matcher: &MatchWireGuard{}, data: packet00000002, shouldMatch: false},
@@ -95,11 +97,11 @@ func Test_MatchWireGuard_Match(t *testing.T) {
 
 		{matcher: &MatchWireGuard{}, data: packet00000004, shouldMatch: false},
 		{matcher: &MatchWireGuard{}, data: append(packet00000004, make([]byte, MessageInitiationBytesTotal-len(packet00000004))...), shouldMatch: false},
-		{matcher: &MatchWireGuard{}, data: append(packet00000004, make([]byte, MessageTransportBytesMin-len(packet00000004))...), shouldMatch: true},
+		{matcher: &MatchWireGuard{}, data: append(packet00000004, make([]byte, MessageTransportBytesMin-len(packet00000004))...), shouldMatch: true, messageType: MessageTypeTransportName},
 
 		{matcher: &MatchWireGuard{}, data: packet010077FF, shouldMatch: false},
 		{matcher: &MatchWireGuard{}, data: append(packet010077FF, make([]byte, MessageInitiationBytesTotal-len(packet010077FF))...), shouldMatch: false},
-		{matcher: &MatchWireGuard{Zero: 4285988864}, data: append(packet010077FF, make([]byte, MessageInitiationBytesTotal-len(packet010077FF))...), shouldMatch: true},
+		{matcher: &MatchWireGuard{Zero: 4285988864}, data: append(packet010077FF, make([]byte, MessageInitiationBytesTotal-len(packet010077FF))...), shouldMatch: true, messageType: MessageTypeInitiationName},
 	}
 
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
@@ -133,6 +135,11 @@ func Test_MatchWireGuard_Match(t *testing.T) {
 					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
 				}
 			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			if messageType, _ := repl.GetString("l4.wireguard.message_type"); messageType != tc.messageType {
+				t.Fatalf("test %d: unexpected message type | got %q, want %q\n", i, messageType, tc.messageType)
+			}
 		}()
 	}
 }
@@ -0,0 +1,151 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4x11 allows the L4 multiplexing of X11 connections
+package l4x11
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/internal/byteparser"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchX11{})
+	layer4.RegisterProtocol("x11")
+}
+
+const (
+	headerLength     = 12  // Length of the fixed part of connection setup requests (bytes)
+	maxAuthLength    = 256 // Maximum length of the authorization protocol name and data accepted (bytes)
+	protocolVersion  = 11  // Major version of the X protocol
+	byteOrderMSB     = 'B' // Byte order byte of big-endian clients
+	byteOrderLSB     = 'l' // Byte order byte of little-endian clients
+	byteOrderMSBName = "MSB"
+	byteOrderLSBName = "LSB"
+)
+
+// MatchX11 is able to match X11 connections, which start with a connection setup request of the client:
+// a byte order byte ('B' or 'l'), the protocol version 11 and the lengths of the authorization protocol
+// name and data, which must follow. The byte order (MSB or LSB) is exposed as {l4.x11.byte_order},
+// the protocol version as {l4.x11.version}, e.g. 11.0, and the authorization protocol name, e.g.
+// MIT-MAGIC-COOKIE-1, as {l4.x11.auth_protocol}.
+type MatchX11 struct{}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchX11) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.x11",
+		New: func() caddy.Module { return new(MatchX11) },
+	}
+}
+
+// Match returns true if the connection looks like X11.
+func (m *MatchX11) Match(cx *layer4.Connection) (bool, error) {
+	// Read the fixed part of the request
+	buf := make([]byte, headerLength)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for X11
+		}
+		return false, fmt.Errorf("reading setup request: %w", err)
+	}
+
+	// Validate the byte order and the unused bytes
+	r := byteparser.NewReader(buf)
+	var readUint16 func() uint16
+	var orderName string
+	switch r.ReadUint8() {
+	case byteOrderMSB:
+		readUint16, orderName = r.ReadUint16, byteOrderMSBName
+	case byteOrderLSB:
+		readUint16, orderName = r.ReadUint16LE, byteOrderLSBName
+	default:
+		return false, nil
+	}
+	if r.ReadUint8() != 0 {
+		return false, nil
+	}
+
+	// Validate the protocol version and the lengths of the authorization protocol name and data
+	major, minor := readUint16(), readUint16()
+	nameLength, dataLength := int(readUint16()), int(readUint16())
+	if readUint16() != 0 || major != protocolVersion || nameLength > maxAuthLength || dataLength > maxAuthLength {
+		return false, nil
+	}
+
+	// Read the authorization protocol name and data, which are padded to a multiple of 4 bytes
+	auth := make([]byte, pad(nameLength)+pad(dataLength))
+	if _, err := io.ReadFull(cx, auth); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil // Not enough data for the authorization protocol
+		}
+		return false, fmt.Errorf("reading authorization protocol: %w", err)
+	}
+	name := auth[:nameLength]
+	for _, c := range name {
+		if c < 0x21 || c > 0x7E {
+			return false, nil
+		}
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("l4.x11.byte_order", orderName)
+	repl.Set("l4.x11.version", fmt.Sprintf("%d.%d", major, minor))
+	repl.Set("l4.x11.auth_protocol", string(name))
+	cx.SetProtocol("x11")
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchX11 from Caddyfile tokens. Syntax:
+//
+//	x11
+func (m *MatchX11) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// pad returns n rounded up to a multiple of 4.
+func pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+// Refs:
+//
+//	https://www.x.org/releases/X11R7.7/doc/xproto/x11protocol.html#Connection_Setup
+//	https://www.x.org/releases/X11R7.7/doc/xproto/x11protocol.html#Encoding::Connection_Setup
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*MatchX11)(nil)
+	_ layer4.ConnMatcher    = (*MatchX11)(nil)
+)
@@ -0,0 +1,120 @@
+package l4x11
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+// setupRequest returns a connection setup request with the given byte order, protocol version
+// and authorization protocol name and data, which are padded.
+func setupRequest(order byte, major, minor uint16, name, data string) []byte {
+	var bo binary.AppendByteOrder = binary.BigEndian
+	if order == 'l' {
+		bo = binary.LittleEndian
+	}
+	b := []byte{order, 0}
+	b = bo.AppendUint16(b, major)
+	b = bo.AppendUint16(b, minor)
+	b = bo.AppendUint16(b, uint16(len(name))) //nolint:gosec // disable G115
+	b = bo.AppendUint16(b, uint16(len(data))) //nolint:gosec // disable G115
+	b = append(b, 0, 0)
+	b = append(b, name...)
+	b = append(b, make([]byte, pad(len(name))-len(name))...)
+	b = append(b, data...)
+	b = append(b, make([]byte, pad(len(data))-len(data))...)
+	return b
+}
+
+func Test_MatchX11_Match(t *testing.T) {
+	type test struct {
+		data         []byte
+		shouldMatch  bool
+		byteOrder    string
+		version      string
+		authProtocol string
+	}
+
+	cookie := "\x8a\x1f\x00\x7b\xe2\x10\x55\x9c\x01\x02\x03\x04\x05\x06\x07\x08"
+
+	badUnused := setupRequest('l', 11, 0, "", "")
+	badUnused[11] = 1
+
+	tooLong := setupRequest('B', 11, 0, "", "")
+	binary.BigEndian.PutUint16(tooLong[8:10], 0xFFFF)
+
+	tests := []test{
+		{data: setupRequest('l', 11, 0, "MIT-MAGIC-COOKIE-1", cookie), shouldMatch: true, byteOrder: "LSB", version: "11.0", authProtocol: "MIT-MAGIC-COOKIE-1"},
+		{data: setupRequest('B', 11, 0, "MIT-MAGIC-COOKIE-1", cookie), shouldMatch: true, byteOrder: "MSB", version: "11.0", authProtocol: "MIT-MAGIC-COOKIE-1"},
+		{data: setupRequest('l', 11, 0, "", ""), shouldMatch: true, byteOrder: "LSB", version: "11.0"},
+		{data: append(setupRequest('B', 11, 1, "XDM-AUTHORIZATION-1", cookie+"12345678"), 0x01, 0x02), shouldMatch: true, byteOrder: "MSB", version: "11.1", authProtocol: "XDM-AUTHORIZATION-1"},
+
+		{data: setupRequest('b', 11, 0, "", ""), shouldMatch: false},
+		{data: setupRequest('l', 10, 0, "", ""), shouldMatch: false},
+		{data: setupRequest('l', 11<<8, 0, "", ""), shouldMatch: false},
+		{data: setupRequest('l', 11, 0, "MIT MAGIC", ""), shouldMatch: false},
+		{data: badUnused, shouldMatch: false},
+		{data: tooLong, shouldMatch: false},
+		{data: setupRequest('l', 11, 0, "MIT-MAGIC-COOKIE-1", cookie)[:40], shouldMatch: false},
+		{data: setupRequest('l', 11, 0, "", "")[:headerLength-1], shouldMatch: false},
+		{data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), shouldMatch: false},
+		{data: []byte("SSH-2.0-OpenSSH_9.6\r\n"), shouldMatch: false},
+		{data: []byte{0x16, 0x03, 0x01, 0x00, 0xa5, 0x01, 0x00, 0x00, 0xa1, 0x03, 0x03, 0x00}, shouldMatch: false},
+		{data: []byte{}, shouldMatch: false},
+	}
+
+	for i, tc := range tests {
+		func() {
+			matcher := &MatchX11{}
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.data)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.data)
+				}
+			}
+
+			repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			for name, want := range map[string]string{
+				"l4.x11.byte_order":    tc.byteOrder,
+				"l4.x11.version":       tc.version,
+				"l4.x11.auth_protocol": tc.authProtocol,
+			} {
+				if got, _ := repl.GetString(name); got != want {
+					t.Fatalf("test %d: unexpected %s | got %q, want %q\n", i, name, got, want)
+				}
+			}
+		}()
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(&MatchXMPP{})
+	layer4.RegisterProtocol("xmpp")
 }
 
 // MatchXMPP is able to match XMPP connections.
@@ -46,7 +47,11 @@ func (m *MatchXMPP) Match(cx *layer4.Connection) (bool, error) {
 	if err != nil { // needs at least 50 (fix for adium/pidgin)
 		return false, err
 	}
-	return strings.Contains(string(p), xmppWord), nil
+	if !strings.Contains(string(p), xmppWord) {
+		return false, nil
+	}
+	cx.SetProtocol("xmpp")
+	return true, nil
 }
 
 // UnmarshalCaddyfile sets up the MatchXMPP from Caddyfile tokens. Syntax: